@@ -1,4 +1,5 @@
-package main
+// Package bench implements a http get benchmark through a shadowsocks server.
+package bench
 
 import (
 	"flag"
@@ -28,7 +29,7 @@ var config struct {
 	// nsec   int
 }
 
-var debug ss.DebugLog
+var debug bool
 
 func doOneRequest(client *http.Client, uri string, buf []byte) (err error) {
 	resp, err := client.Get(uri)
@@ -39,7 +40,7 @@ func doOneRequest(client *http.Client, uri string, buf []byte) (err error) {
 	for err == nil {
 		_, err = resp.Body.Read(buf)
 		if debug {
-			debug.Println(string(buf))
+			fmt.Println(string(buf))
 		}
 	}
 	if err != io.EOF {
@@ -77,26 +78,30 @@ func get(connid int, uri, serverAddr string, rawAddr []byte, cipher *ss.Cipher,
 	}
 }
 
-func main() {
-	flag.StringVar(&config.server, "s", "127.0.0.1", "server:port")
-	flag.IntVar(&config.port, "p", 0, "server:port")
-	flag.IntVar(&config.core, "core", 1, "number of CPU cores to use")
-	flag.StringVar(&config.passwd, "k", "", "password")
-	flag.StringVar(&config.method, "m", "", "encryption method, use empty string or rc4")
-	flag.IntVar(&config.nconn, "nc", 1, "number of connection to server")
-	flag.IntVar(&config.nreq, "nr", 1, "number of request for each connection")
-	// flag.IntVar(&config.nsec, "ns", 0, "run how many seconds for each connection")
-	flag.BoolVar((*bool)(&debug), "d", false, "print http response body for debugging")
+// Main runs concurrent http get requests through a shadowsocks server and
+// reports timing, args don't include the program name.
+func Main(args []string) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
 
-	flag.Parse()
+	fs.StringVar(&config.server, "s", "127.0.0.1", "server:port")
+	fs.IntVar(&config.port, "p", 0, "server:port")
+	fs.IntVar(&config.core, "core", 1, "number of CPU cores to use")
+	fs.StringVar(&config.passwd, "k", "", "password")
+	fs.StringVar(&config.method, "m", "", "encryption method, use empty string or rc4")
+	fs.IntVar(&config.nconn, "nc", 1, "number of connection to server")
+	fs.IntVar(&config.nreq, "nr", 1, "number of request for each connection")
+	// fs.IntVar(&config.nsec, "ns", 0, "run how many seconds for each connection")
+	fs.BoolVar(&debug, "d", false, "print http response body for debugging")
 
-	if config.server == "" || config.port == 0 || config.passwd == "" || len(flag.Args()) != 1 {
+	fs.Parse(args)
+
+	if config.server == "" || config.port == 0 || config.passwd == "" || len(fs.Args()) != 1 {
 		fmt.Printf("Usage: %s -s <server> -p <port> -k <password> <url>\n", os.Args[0])
 		os.Exit(1)
 	}
 
 	runtime.GOMAXPROCS(config.core)
-	uri := flag.Arg(0)
+	uri := fs.Arg(0)
 	if strings.HasPrefix(uri, "https://") {
 		fmt.Println("https not supported")
 		os.Exit(1)
@@ -0,0 +1,11 @@
+package main
+
+import (
+	"os"
+
+	"github.com/shadowsocks/shadowsocks-go/bench"
+)
+
+func main() {
+	bench.Main(os.Args[1:])
+}
@@ -0,0 +1,11 @@
+package main
+
+import (
+	"os"
+
+	"github.com/shadowsocks/shadowsocks-go/local"
+)
+
+func main() {
+	local.Main(os.Args[1:])
+}
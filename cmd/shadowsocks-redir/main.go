@@ -0,0 +1,11 @@
+package main
+
+import (
+	"os"
+
+	"github.com/shadowsocks/shadowsocks-go/redir"
+)
+
+func main() {
+	redir.Main(os.Args[1:])
+}
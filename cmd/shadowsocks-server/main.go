@@ -0,0 +1,11 @@
+package main
+
+import (
+	"os"
+
+	"github.com/shadowsocks/shadowsocks-go/server"
+)
+
+func main() {
+	server.Main(os.Args[1:])
+}
@@ -0,0 +1,11 @@
+package main
+
+import (
+	"os"
+
+	"github.com/shadowsocks/shadowsocks-go/tun"
+)
+
+func main() {
+	tun.Main(os.Args[1:])
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+// genkey prints a random password suitable for port_password. With -m it
+// has the size of the keys of the method, which the Shadowsocks 2022 methods
+// require.
+func genkey(args []string) int {
+	var n int
+	var method string
+	fs := flag.NewFlagSet("genkey", flag.ContinueOnError)
+	fs.StringVar(&method, "m", "", "method the password is for, sizing it to the key of the method")
+	fs.IntVar(&n, "n", 0, "number of random bytes, the key size of -m or 16 by default; not for 2022 methods")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if n < 0 {
+		fmt.Fprintln(os.Stderr, "number of bytes must be positive")
+		return 2
+	}
+	if method != "" {
+		if err := ss.CheckCipherMethod(method); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		if strings.HasPrefix(method, "2022-") {
+			if n != 0 && n != ss.KeySize(method) {
+				fmt.Fprintf(os.Stderr, "the key of %s must be %d bytes\n", method, ss.KeySize(method))
+				return 2
+			}
+			password, err := ss.RandomPassword(method)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "error generating key:", err)
+				return 1
+			}
+			fmt.Println(password)
+			return 0
+		}
+		if n == 0 {
+			n = ss.KeySize(method)
+		}
+	}
+	if n == 0 {
+		n = 16
+	}
+	key := make([]byte, n)
+	if _, err := rand.Read(key); err != nil {
+		fmt.Fprintln(os.Stderr, "error generating key:", err)
+		return 1
+	}
+	fmt.Println(base64.StdEncoding.EncodeToString(key))
+	return 0
+}
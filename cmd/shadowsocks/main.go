@@ -0,0 +1,70 @@
+// Command shadowsocks combines the shadowsocks programs into a single binary,
+// which is easier to package and cross-compile for routers.
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/shadowsocks/shadowsocks-go/bench"
+	"github.com/shadowsocks/shadowsocks-go/loadtest"
+	"github.com/shadowsocks/shadowsocks-go/local"
+	"github.com/shadowsocks/shadowsocks-go/manage"
+	"github.com/shadowsocks/shadowsocks-go/redir"
+	"github.com/shadowsocks/shadowsocks-go/server"
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+	"github.com/shadowsocks/shadowsocks-go/tun"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [arguments]\n\n", os.Args[0])
+	fmt.Fprintln(os.Stderr, "Commands:")
+	fmt.Fprintln(os.Stderr, "  server   run shadowsocks server")
+	fmt.Fprintln(os.Stderr, "  local    run local socks5 proxy")
+	fmt.Fprintln(os.Stderr, "  redir    run transparent proxy (linux)")
+	fmt.Fprintln(os.Stderr, "  tun      relay the traffic of a TUN interface")
+	fmt.Fprintln(os.Stderr, "  manage   manage a running server")
+	fmt.Fprintln(os.Stderr, "  bench    benchmark http get through a server")
+	fmt.Fprintln(os.Stderr, "  loadtest load test a server with concurrent echo connections")
+	fmt.Fprintln(os.Stderr, "  genkey   generate a random password")
+	fmt.Fprintln(os.Stderr, "  version  print version")
+	fmt.Fprintf(os.Stderr, "\nUse \"%s <command> -h\" for more information about a command.\n", os.Args[0])
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	args := os.Args[2:]
+	switch os.Args[1] {
+	case "server":
+		server.Main(args)
+	case "local":
+		local.Main(args)
+	case "redir":
+		redir.Main(args)
+	case "tun":
+		tun.Main(args)
+	case "manage":
+		os.Exit(manage.Main(args))
+	case "bench":
+		bench.Main(args)
+	case "loadtest":
+		os.Exit(loadtest.Main(args))
+	case "genkey":
+		os.Exit(genkey(args))
+	case "version":
+		if len(args) > 0 && args[0] == "-json" {
+			ss.PrintVersionJSON()
+		} else {
+			ss.PrintVersion()
+		}
+	case "help", "-h", "-help", "--help":
+		usage()
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,11 @@
+package main
+
+import (
+	"os"
+
+	"github.com/shadowsocks/shadowsocks-go/loadtest"
+)
+
+func main() {
+	os.Exit(loadtest.Main(os.Args[1:]))
+}
@@ -0,0 +1,257 @@
+// Package loadtest implements a load test of a shadowsocks server: many
+// concurrent connections relay payloads to an echo server through it, the
+// latencies and throughput are reported.
+package loadtest
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+type options struct {
+	server   string
+	method   string
+	password string
+	target   string
+	conns    int
+	size     int
+	rounds   int
+	duration time.Duration
+	timeout  time.Duration
+}
+
+// result is what a connection of the test measured.
+type result struct {
+	connect time.Duration   // until the first echo came back
+	rtts    []time.Duration // of the following round trips
+	bytes   int64           // echoed both ways
+	err     error
+}
+
+func usage(fs *flag.FlagSet) {
+	fmt.Fprintf(os.Stderr, "Usage: ss-bench -s server:port -k password -m method [options] [target]\n")
+	fmt.Fprintf(os.Stderr, "       ss-bench -echo addr\n\n")
+	fmt.Fprintf(os.Stderr, "target is the echo server the payloads are relayed to, reachable from the\n")
+	fmt.Fprintf(os.Stderr, "shadowsocks server, by default the one started with -echo on the server host.\n\n")
+	fs.PrintDefaults()
+}
+
+// Main runs the load test with the command line arguments args, which don't
+// include the program name, and returns the exit status.
+func Main(args []string) int {
+	var o options
+	var echo string
+	fs := flag.NewFlagSet("ss-bench", flag.ContinueOnError)
+	fs.Usage = func() { usage(fs) }
+	fs.StringVar(&o.server, "s", "", "server address, host:port")
+	fs.StringVar(&o.password, "k", "", "password")
+	fs.StringVar(&o.method, "m", "aes-256-gcm", "encryption method")
+	fs.IntVar(&o.conns, "c", 10, "concurrent connections")
+	fs.IntVar(&o.size, "size", 16*1024, "payload bytes of each round trip")
+	fs.IntVar(&o.rounds, "n", 100, "round trips of each connection, ignored with -d")
+	fs.DurationVar(&o.duration, "d", 0, "run for this long instead of -n round trips")
+	fs.DurationVar(&o.timeout, "timeout", 10*time.Second, "timeout of each round trip")
+	fs.StringVar(&echo, "echo", "", "serve as the echo server on this address instead")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if echo != "" {
+		if err := serveEcho(echo); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+	o.target = fs.Arg(0)
+	if o.target == "" {
+		host, _, err := net.SplitHostPort(o.server)
+		if err != nil {
+			usage(fs)
+			return 2
+		}
+		o.target = net.JoinHostPort(host, "7")
+	}
+	if o.server == "" || o.password == "" || fs.NArg() > 1 || o.conns <= 0 || o.size <= 0 {
+		usage(fs)
+		return 2
+	}
+	cipher, err := ss.NewCipher(o.method, o.password)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error creating cipher:", err)
+		return 1
+	}
+	fmt.Printf("%d connections to %s through %s (%s), %d byte payloads\n", o.conns, o.target, o.server, o.method, o.size)
+	start := time.Now()
+	results := run(&o, cipher)
+	report(results, time.Since(start))
+	for _, r := range results {
+		if r.err != nil {
+			return 1
+		}
+	}
+	return 0
+}
+
+// serveEcho echoes the data of the connections to addr.
+func serveEcho(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	fmt.Println("echo server listening on", ln.Addr())
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			io.Copy(c, c)
+			c.Close()
+		}()
+	}
+}
+
+// run opens the connections of o at once and waits for them to finish.
+func run(o *options, cipher *ss.Cipher) []*result {
+	var stop int32
+	if o.duration > 0 {
+		time.AfterFunc(o.duration, func() { atomic.StoreInt32(&stop, 1) })
+	}
+	results := make([]*result, o.conns)
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = runConn(o, cipher.Copy(), &stop)
+		}(i)
+	}
+	wg.Wait()
+	return results
+}
+
+// runConn connects to the target through the server and echoes payloads
+// until the rounds are done or stop is set.
+func runConn(o *options, cipher *ss.Cipher, stop *int32) *result {
+	r := new(result)
+	payload := make([]byte, o.size)
+	rand.Read(payload)
+	echoed := make([]byte, o.size)
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), o.timeout)
+	c, err := ss.DialContext(ctx, o.target, o.server, cipher)
+	cancel()
+	if err != nil {
+		r.err = err
+		return r
+	}
+	defer c.Close()
+	for i := 0; ; i++ {
+		if o.duration > 0 {
+			if atomic.LoadInt32(stop) == 1 {
+				break
+			}
+		} else if i == o.rounds {
+			break
+		}
+		t := time.Now()
+		c.SetDeadline(t.Add(o.timeout))
+		// written concurrently, payloads larger than the socket buffers
+		// would block otherwise
+		werr := make(chan error, 1)
+		go func() {
+			_, err := c.Write(payload)
+			werr <- err
+		}()
+		_, err = io.ReadFull(c, echoed)
+		if e := <-werr; err == nil {
+			err = e
+		}
+		if err == nil && !bytes.Equal(echoed, payload) {
+			err = errors.New("echoed data differs from the payload")
+		}
+		if err != nil {
+			r.err = err
+			return r
+		}
+		r.bytes += 2 * int64(o.size)
+		if i == 0 {
+			r.connect = time.Since(start)
+		} else {
+			r.rtts = append(r.rtts, time.Since(t))
+		}
+	}
+	return r
+}
+
+// percentile returns the p-th percentile of sorted d.
+func percentile(d []time.Duration, p float64) time.Duration {
+	i := int(float64(len(d))*p/100+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(d) {
+		i = len(d) - 1
+	}
+	return d[i]
+}
+
+func printLatencies(name string, d []time.Duration) {
+	if len(d) == 0 {
+		return
+	}
+	sort.Slice(d, func(i, j int) bool { return d[i] < d[j] })
+	var sum time.Duration
+	for _, v := range d {
+		sum += v
+	}
+	fmt.Printf("%-10s avg %-10v p50 %-10v p90 %-10v p99 %-10v max %v\n", name,
+		(sum / time.Duration(len(d))).Round(time.Microsecond), percentile(d, 50).Round(time.Microsecond),
+		percentile(d, 90).Round(time.Microsecond), percentile(d, 99).Round(time.Microsecond),
+		d[len(d)-1].Round(time.Microsecond))
+}
+
+func report(results []*result, elapsed time.Duration) {
+	var connects, rtts []time.Duration
+	var total int64
+	errs := make(map[string]int)
+	for _, r := range results {
+		total += r.bytes
+		if r.connect > 0 {
+			connects = append(connects, r.connect)
+		}
+		rtts = append(rtts, r.rtts...)
+		if r.err != nil {
+			errs[r.err.Error()]++
+		}
+	}
+	fmt.Printf("\n%d of %d connections succeeded in %v\n", len(results)-sumCounts(errs), len(results), elapsed.Round(time.Millisecond))
+	printLatencies("connect", connects)
+	printLatencies("round trip", rtts)
+	mbps := float64(total) * 8 / elapsed.Seconds() / 1e6
+	fmt.Printf("throughput %s Mbit/s (%d bytes echoed)\n", strconv.FormatFloat(mbps, 'f', 1, 64), total)
+	for err, n := range errs {
+		fmt.Printf("error (%d connections): %s\n", n, err)
+	}
+}
+
+func sumCounts(m map[string]int) (n int) {
+	for _, v := range m {
+		n += v
+	}
+	return
+}
@@ -0,0 +1,171 @@
+package local
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+// hopHeaders are only meaningful between the client and the proxy, they are
+// not forwarded.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// httpError answers the client with an empty response of the given status.
+func httpError(conn net.Conn, code int) {
+	resp := &http.Response{
+		StatusCode: code,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Close:      true,
+	}
+	resp.Write(conn)
+}
+
+// hostPort returns host with the port added if it has none.
+func hostPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+func dialHTTP(addr string) (net.Conn, error) {
+	rawaddr, err := ss.RawAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	return createServerConn(rawaddr, addr)
+}
+
+func handleHTTPConnection(conn net.Conn) {
+	logger.Debugf("http connect from %s", conn.RemoteAddr().String())
+	defer conn.Close()
+
+	br := bufio.NewReader(conn)
+	var remote net.Conn
+	var remoteAddr string
+	var rr *bufio.Reader
+	defer func() {
+		if remote != nil {
+			remote.Close()
+		}
+	}()
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			if err != io.EOF {
+				logger.Debug("http request:", err)
+			}
+			return
+		}
+		if req.Method == http.MethodConnect {
+			handleHTTPConnect(conn, br, req)
+			return
+		}
+		if req.URL.Scheme != "http" || req.URL.Host == "" {
+			// not a proxy request, or a scheme we can't forward
+			httpError(conn, http.StatusBadRequest)
+			return
+		}
+
+		addr := hostPort(req.URL.Host, "80")
+		if remote == nil || addr != remoteAddr {
+			if remote != nil {
+				remote.Close()
+			}
+			if remote, err = dialHTTP(addr); err != nil {
+				httpError(conn, http.StatusBadGateway)
+				return
+			}
+			remoteAddr, rr = addr, bufio.NewReader(remote)
+		}
+
+		for _, h := range hopHeaders {
+			req.Header.Del(h)
+		}
+		closing := req.Close
+		req.Close = false
+		if err = req.Write(remote); err != nil {
+			logger.Debug("http write request:", err)
+			httpError(conn, http.StatusBadGateway)
+			return
+		}
+		resp, err := http.ReadResponse(rr, req)
+		if err != nil {
+			logger.Debug("http read response:", err)
+			httpError(conn, http.StatusBadGateway)
+			return
+		}
+		logger.Debug("http", req.Method, req.URL)
+		for _, h := range hopHeaders {
+			resp.Header.Del(h)
+		}
+		// a body without length ends when the connection is closed, close
+		// the client connection too
+		closing = closing || resp.Close
+		resp.Close = closing
+		err = resp.Write(conn)
+		resp.Body.Close()
+		if err != nil || closing {
+			return
+		}
+	}
+}
+
+// handleHTTPConnect tunnels a CONNECT request through a shadowsocks server.
+func handleHTTPConnect(conn net.Conn, br *bufio.Reader, req *http.Request) {
+	addr := hostPort(req.Host, "443")
+	remote, err := dialHTTP(addr)
+	if err != nil {
+		httpError(conn, http.StatusBadGateway)
+		return
+	}
+	defer remote.Close()
+	if _, err = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		return
+	}
+	// the client may have sent data right after the request
+	if n := br.Buffered(); n > 0 {
+		buf, _ := br.Peek(n)
+		if _, err = remote.Write(buf); err != nil {
+			return
+		}
+	}
+
+	ss.Relay(conn, remote, ss.RelayOptions{})
+	logger.Debug("closed connection to", addr)
+}
+
+func runHTTP(listenAddr string) {
+	ln, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	logger.Infof("starting local http proxy at %v ...", listenAddr)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			logger.Warn("accept:", err)
+			if ss.IsFileLimit(err) {
+				time.Sleep(ss.FileLimitReached())
+			}
+			continue
+		}
+		go handleHTTPConnection(conn)
+	}
+}
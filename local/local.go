@@ -0,0 +1,666 @@
+// Package local implements the shadowsocks local socks5 proxy command.
+package local
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shadowsocks/shadowsocks-go/service"
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+// serviceName names the system service of the proxy.
+const serviceName = "shadowsocks-local"
+
+var (
+	errAddrType      = errors.New("socks addr type not supported")
+	errVer           = errors.New("socks version not supported")
+	errMethod        = errors.New("socks only support 1 method now")
+	errAuthExtraData = errors.New("socks authentication get extra data")
+	errReqExtraData  = errors.New("socks request get extra data")
+	errCmd           = errors.New("socks command not supported")
+)
+
+var logger = ss.NewLogger("local")
+
+const (
+	socksVer5            = 5
+	socksCmdConnect      = 1
+	socksCmdUDPAssociate = 3
+)
+
+func init() {
+	rand.Seed(time.Now().Unix())
+}
+
+func handShake(conn net.Conn) (err error) {
+	const (
+		idVer     = 0
+		idNmethod = 1
+	)
+	// version identification and method selection message in theory can have
+	// at most 256 methods, plus version and nmethod field in total 258 bytes
+	// the current rfc defines only 3 authentication methods (plus 2 reserved),
+	// so it won't be such long in practice
+
+	buf := make([]byte, 258)
+
+	var n int
+	// make sure we get the nmethod field
+	if n, err = io.ReadAtLeast(conn, buf, idNmethod+1); err != nil {
+		return
+	}
+	if buf[idVer] != socksVer5 {
+		return errVer
+	}
+	nmethod := int(buf[idNmethod])
+	msgLen := nmethod + 2
+	if n == msgLen { // handshake done, common case
+		// do nothing, jump directly to send confirmation
+	} else if n < msgLen { // has more methods to read, rare case
+		if _, err = io.ReadFull(conn, buf[n:msgLen]); err != nil {
+			return
+		}
+	} else { // error, should not get extra data
+		return errAuthExtraData
+	}
+	// send confirmation: version 5, no authentication required
+	_, err = conn.Write([]byte{socksVer5, 0})
+	return
+}
+
+func getRequest(conn net.Conn) (cmd byte, rawaddr []byte, host string, err error) {
+	const (
+		idVer   = 0
+		idCmd   = 1
+		idType  = 3 // address type index
+		idIP0   = 4 // ip addres start index
+		idDmLen = 4 // domain address length index
+		idDm0   = 5 // domain address start index
+
+		typeIPv4 = 1 // type is ipv4 address
+		typeDm   = 3 // type is domain address
+		typeIPv6 = 4 // type is ipv6 address
+
+		lenIPv4   = 3 + 1 + net.IPv4len + 2 // 3(ver+cmd+rsv) + 1addrType + ipv4 + 2port
+		lenIPv6   = 3 + 1 + net.IPv6len + 2 // 3(ver+cmd+rsv) + 1addrType + ipv6 + 2port
+		lenDmBase = 3 + 1 + 1 + 2           // 3 + 1addrType + 1addrLen + 2port, plus addrLen
+	)
+	// refer to getRequest in server.go for why set buffer size to 263
+	buf := make([]byte, 263)
+	var n int
+	// read till we get possible domain length field
+	if n, err = io.ReadAtLeast(conn, buf, idDmLen+1); err != nil {
+		return
+	}
+	// check version and cmd
+	if buf[idVer] != socksVer5 {
+		err = errVer
+		return
+	}
+	cmd = buf[idCmd]
+	if cmd != socksCmdConnect && cmd != socksCmdUDPAssociate {
+		err = errCmd
+		return
+	}
+
+	reqLen := -1
+	switch buf[idType] {
+	case typeIPv4:
+		reqLen = lenIPv4
+	case typeIPv6:
+		reqLen = lenIPv6
+	case typeDm:
+		reqLen = int(buf[idDmLen]) + lenDmBase
+	default:
+		err = errAddrType
+		return
+	}
+
+	if n == reqLen {
+		// common case, do nothing
+	} else if n < reqLen { // rare case
+		if _, err = io.ReadFull(conn, buf[n:reqLen]); err != nil {
+			return
+		}
+	} else {
+		err = errReqExtraData
+		return
+	}
+
+	rawaddr = buf[idType:reqLen]
+
+	if logger.Enabled(ss.LevelDebug) {
+		switch buf[idType] {
+		case typeIPv4:
+			host = net.IP(buf[idIP0 : idIP0+net.IPv4len]).String()
+		case typeIPv6:
+			host = net.IP(buf[idIP0 : idIP0+net.IPv6len]).String()
+		case typeDm:
+			host = string(buf[idDm0 : idDm0+buf[idDmLen]])
+		}
+		port := binary.BigEndian.Uint16(buf[reqLen-2 : reqLen])
+		host = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+
+	return
+}
+
+type ServerCipher struct {
+	server   string
+	cipher   *ss.Cipher
+	password string // the default key of the kcp transport
+}
+
+var servers struct {
+	srvCipher []*ServerCipher
+	failCnt   []int // failed connection count
+
+	transport      string
+	wsPath, wsHost string
+	tlsConfig      *tls.Config // of the tls and wss transports
+	quic           *ss.QUICDialer
+	kcp            *ss.KCPDialer
+	mux            []*ss.MuxDialer // of each server, with mux
+	uot            bool            // UDP relayed over TCP connections
+	firstPadding   int             // see ss.Conn.SetFirstFlight
+}
+
+func parseServerConfig(config *ss.Config) {
+	hasPort := func(s string) bool {
+		_, port, err := net.SplitHostPort(s)
+		if err != nil {
+			return false
+		}
+		return port != ""
+	}
+
+	if len(config.ServerPassword) == 0 {
+		// only one encryption table
+		cipher, err := ss.NewCipher(config.Method, config.Password)
+		if err != nil {
+			logger.Fatal("Failed generating ciphers:", err)
+		}
+		srvPort := strconv.Itoa(config.ServerPort)
+		srvArr := config.GetServerArray()
+		n := len(srvArr)
+		servers.srvCipher = make([]*ServerCipher, n)
+
+		for i, s := range srvArr {
+			if hasPort(s) {
+				logger.Warn("ignore server_port option for server", s)
+				servers.srvCipher[i] = &ServerCipher{s, cipher, config.Password}
+			} else {
+				servers.srvCipher[i] = &ServerCipher{net.JoinHostPort(s, srvPort), cipher, config.Password}
+			}
+		}
+	} else {
+		// multiple servers
+		n := len(config.ServerPassword)
+		servers.srvCipher = make([]*ServerCipher, n)
+
+		cipherCache := make(map[string]*ss.Cipher)
+		i := 0
+		for _, serverInfo := range config.ServerPassword {
+			if len(serverInfo) < 2 || len(serverInfo) > 3 {
+				logger.Fatalf("server %v syntax error", serverInfo)
+			}
+			server := serverInfo[0]
+			passwd := serverInfo[1]
+			encmethod := ""
+			if len(serverInfo) == 3 {
+				encmethod = serverInfo[2]
+			}
+			if !hasPort(server) {
+				logger.Fatalf("no port for server %s", server)
+			}
+			cipher, ok := cipherCache[passwd]
+			if !ok {
+				var err error
+				cipher, err = ss.NewCipher(encmethod, passwd)
+				if err != nil {
+					logger.Fatal("Failed generating ciphers:", err)
+				}
+				cipherCache[passwd] = cipher
+			}
+			servers.srvCipher[i] = &ServerCipher{server, cipher, passwd}
+			i++
+		}
+	}
+	servers.failCnt = make([]int, len(servers.srvCipher))
+	if err := ss.CheckTransport(config.Transport); err != nil {
+		logger.Fatal(err)
+	}
+	if config.Transport == ss.TransportKCP {
+		if err := ss.CheckKCP(config.KCP); err != nil {
+			logger.Fatal(err)
+		}
+		servers.kcp = ss.NewKCPDialer(config.KCP)
+	}
+	servers.transport, servers.wsPath, servers.wsHost = config.Transport, config.WSPath, config.WSHost
+	if servers.wsPath == "" {
+		servers.wsPath = "/"
+	}
+	if ss.IsTLS(config.Transport) || config.Transport == ss.TransportQUIC {
+		tc, err := clientTLSConfig(config)
+		if err != nil {
+			logger.Fatal("error loading tls_ca:", err)
+		}
+		if config.Transport == ss.TransportQUIC {
+			servers.quic = ss.NewQUICDialer(tc)
+		} else {
+			servers.tlsConfig = tc
+		}
+	}
+	if config.Mux {
+		muxConns := config.MuxConns
+		if muxConns == 0 {
+			muxConns = 2
+		}
+		muxAddr, _ := ss.RawAddr(net.JoinHostPort(ss.MuxHost, "0"))
+		servers.mux = make([]*ss.MuxDialer, len(servers.srvCipher))
+		for i, se := range servers.srvCipher {
+			se := se
+			servers.mux[i] = ss.NewMuxDialer(muxConns, func() (net.Conn, error) {
+				c, err := dialServer(se, muxAddr)
+				if err != nil {
+					return nil, err
+				}
+				return c, nil
+			})
+		}
+	}
+	servers.uot = config.UoT
+	servers.firstPadding = config.FirstFlightPadding
+	for _, se := range servers.srvCipher {
+		logger.Info("available remote server", se.server)
+	}
+	return
+}
+
+func connectToServer(serverId int, rawaddr []byte, addr string) (remote net.Conn, err error) {
+	se := servers.srvCipher[serverId]
+	if servers.mux != nil {
+		remote, err = servers.mux[serverId].Dial(rawaddr)
+	} else if c, e := dialServer(se, rawaddr); e == nil {
+		remote = c
+	} else {
+		err = e
+	}
+	if err != nil {
+		logger.Warn("error connecting to shadowsocks server:", err)
+		const maxFailCnt = 30
+		if servers.failCnt[serverId] < maxFailCnt {
+			servers.failCnt[serverId]++
+		}
+		return nil, err
+	}
+	logger.Debugf("connected to %s via %s", addr, se.server)
+	servers.failCnt[serverId] = 0
+	return
+}
+
+// clientTLSConfig returns the TLS config of the tls, wss and quic
+// transports. The server name defaults to ws_host, or the host of each
+// server if empty.
+func clientTLSConfig(config *ss.Config) (*tls.Config, error) {
+	tc := &tls.Config{ServerName: config.TLSServerName, NextProtos: []string{"http/1.1"}}
+	if tc.ServerName == "" && config.WSHost != "" {
+		tc.ServerName, _, _ = strings.Cut(config.WSHost, ":")
+	}
+	if config.TLSCA != "" {
+		pem, err := ioutil.ReadFile(config.TLSCA)
+		if err != nil {
+			return nil, err
+		}
+		tc.RootCAs = x509.NewCertPool()
+		if !tc.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate in %s", config.TLSCA)
+		}
+	}
+	return tc, nil
+}
+
+// dialServer connects to se over the transport of the config and sends
+// rawaddr.
+func dialServer(se *ServerCipher, rawaddr []byte) (*ss.Conn, error) {
+	var conn net.Conn
+	var err error
+	if servers.quic != nil {
+		conn, err = servers.quic.Dial(se.server)
+	} else if servers.kcp != nil {
+		conn, err = servers.kcp.Dial(se.server, se.password)
+	} else {
+		conn, err = ss.DialTCP(context.Background(), se.server)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if servers.tlsConfig != nil {
+		tc := servers.tlsConfig
+		if tc.ServerName == "" {
+			tc = tc.Clone()
+			tc.ServerName, _, _ = net.SplitHostPort(se.server)
+		}
+		tlsConn := tls.Client(conn, tc)
+		if err = tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	if ss.IsWS(servers.transport) {
+		host := servers.wsHost
+		if host == "" {
+			host = se.server
+		}
+		ws, err := ss.DialWS(conn, host, servers.wsPath)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = ws
+	}
+	c := ss.NewConn(conn, se.cipher.Copy())
+	c.SetFirstFlight(servers.firstPadding, 0)
+	if _, err = c.Write(rawaddr); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Connection to the server in the order specified in the config. On
+// connection failure, try the next server. A failed server will be tried with
+// some probability according to its fail count, so we can discover recovered
+// servers.
+func createServerConn(rawaddr []byte, addr string) (remote net.Conn, err error) {
+	const baseFailCnt = 20
+	n := len(servers.srvCipher)
+	skipped := make([]int, 0)
+	for i := 0; i < n; i++ {
+		// skip failed server, but try it with some probability
+		if servers.failCnt[i] > 0 && rand.Intn(servers.failCnt[i]+baseFailCnt) != 0 {
+			skipped = append(skipped, i)
+			continue
+		}
+		remote, err = connectToServer(i, rawaddr, addr)
+		if err == nil {
+			return
+		}
+	}
+	// last resort, try skipped servers, not likely to succeed
+	for _, i := range skipped {
+		remote, err = connectToServer(i, rawaddr, addr)
+		if err == nil {
+			return
+		}
+	}
+	return nil, err
+}
+
+// ParseServerConfig sets up the servers used by DialServer and
+// DialUDPServer, for other client modes sharing the server selection of the
+// socks5 proxy.
+func ParseServerConfig(config *ss.Config) {
+	parseServerConfig(config)
+}
+
+// DialServer connects to rawaddr, whose printable form is addr, through the
+// first available server.
+func DialServer(rawaddr []byte, addr string) (net.Conn, error) {
+	return createServerConn(rawaddr, addr)
+}
+
+// DialUDPServer returns a UDP relay connection to the server used for UDP.
+func DialUDPServer() (ss.UDPRelayConn, error) {
+	remote, _, err := dialUDPServer()
+	return remote, err
+}
+
+func handleConnection(conn net.Conn) {
+	logger.Debugf("socks connect from %s", conn.RemoteAddr().String())
+
+	closed := false
+	defer func() {
+		if !closed {
+			conn.Close()
+		}
+	}()
+
+	var err error = nil
+	if err = handShake(conn); err != nil {
+		logger.Warn("socks handshake:", err)
+		return
+	}
+	cmd, rawaddr, addr, err := getRequest(conn)
+	if err != nil {
+		logger.Warn("error getting request:", err)
+		return
+	}
+	if cmd == socksCmdUDPAssociate {
+		handleUDPAssociate(conn)
+		return
+	}
+	// Sending connection established message immediately to client.
+	// This some round trip time for creating socks connection with the client.
+	// But if connection failed, the client will get connection reset error.
+	_, err = conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x08, 0x43})
+	if err != nil {
+		logger.Debug("send connection confirmation:", err)
+		return
+	}
+
+	remote, err := createServerConn(rawaddr, addr)
+	if err != nil {
+		if len(servers.srvCipher) > 1 {
+			logger.Error("Failed connect to all avaiable shadowsocks server")
+		}
+		return
+	}
+	defer func() {
+		if !closed {
+			remote.Close()
+		}
+	}()
+
+	ss.Relay(conn, remote, ss.RelayOptions{})
+	closed = true
+	logger.Debug("closed connection to", addr)
+}
+
+func run(listenAddr string) {
+	ln, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	logger.Infof("starting local socks5 server at %v ...", listenAddr)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			logger.Warn("accept:", err)
+			if ss.IsFileLimit(err) {
+				time.Sleep(ss.FileLimitReached())
+			}
+			continue
+		}
+		go handleConnection(conn)
+	}
+}
+
+func enoughOptions(config *ss.Config) bool {
+	return config.Server != nil && config.ServerPort != 0 &&
+		config.LocalPort != 0 && config.Password != ""
+}
+
+// LoadConfig returns the config in configFile, which may not exist,
+// overridden by environment variables (see ss.Config.ApplyEnv) and the
+// command line options cmdConfig. It exits on errors, it's shared by the
+// client commands.
+func LoadConfig(configFile string, cmdConfig *ss.Config) *ss.Config {
+	config, err := ss.ParseConfig(configFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "error reading %s: %v\n", configFile, err)
+			os.Exit(1)
+		}
+		config = &ss.Config{}
+	}
+	for _, name := range config.UnknownOptions() {
+		logger.Warnf("unknown option %s", name)
+	}
+	if err = config.ApplyEnv(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err = config.LoadSecrets(); err != nil {
+		fmt.Fprintf(os.Stderr, "error reading secrets: %v\n", err)
+		os.Exit(1)
+	}
+	ss.UpdateConfig(config, cmdConfig)
+	if config.Method == "" {
+		config.Method = "aes-256-cfb"
+	}
+	if err = config.CheckMethods(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err = ss.SetFastOpen(config.FastOpen); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err = ss.SetMPTCP(config.MPTCP); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err = ss.SetTCPOptions(config.TCP); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	return config
+}
+
+// Main runs the local socks5 server with command line arguments args, which
+// don't include the program name.
+func Main(args []string) {
+	var configFile, cmdServer, cmdLocal string
+	var httpPort int
+	var cmdConfig ss.Config
+	var printVer, jsonVer, debug bool
+	var pidFile, serviceAction string
+	var daemon bool
+
+	fs := flag.NewFlagSet("local", flag.ExitOnError)
+
+	fs.BoolVar(&printVer, "version", false, "print version")
+	fs.BoolVar(&jsonVer, "json", false, "print version in JSON, used with -version")
+	fs.StringVar(&configFile, "c", "config.json", "specify config file, JSON, or YAML or TOML by its extension")
+	fs.StringVar(&cmdServer, "s", "", "server address")
+	fs.StringVar(&cmdLocal, "b", "", "local address, listen only to this address if specified")
+	fs.StringVar(&cmdConfig.Password, "k", "", "password")
+	fs.IntVar(&cmdConfig.ServerPort, "p", 0, "server port")
+	fs.IntVar(&cmdConfig.LocalPort, "l", 0, "local socks5 proxy port")
+	fs.IntVar(&httpPort, "http-port", 0, "local http proxy port, disabled if 0")
+	fs.StringVar(&cmdConfig.Method, "m", "", "encryption method, default: aes-256-cfb")
+	fs.BoolVar(&cmdConfig.AllowInsecureCiphers, "allow-insecure-ciphers", false, "allow the broken or weak methods table, rc4, rc4-md5, des-cfb, bf-cfb and cast5-cfb")
+	fs.BoolVar(&cmdConfig.Mux, "mux", false, "multiplex relays over a few connections to each server, which must enable mux too")
+	fs.BoolVar(&cmdConfig.UoT, "uot", false, "relay UDP over TCP connections to the server, which must enable uot too")
+	fs.StringVar(&cmdConfig.Transport, "transport", "", "transport to the server: tcp (default), ws, tls, wss, quic or kcp")
+	fs.BoolVar(&debug, "d", false, "print debug message")
+	fs.StringVar(&pidFile, "pidfile", "", "write process id to this file")
+	fs.StringVar(&serviceAction, "service", "", "install, uninstall, start or stop the system service (windows, darwin) running the proxy with the other options")
+	fs.BoolVar(&daemon, "daemon", false, "run in the background detached from the terminal, logging to -log-file (not on windows)")
+	logOpts := ss.AddLogFlags(fs)
+
+	fs.Parse(args)
+
+	if printVer {
+		if jsonVer {
+			ss.PrintVersionJSON()
+		} else {
+			ss.PrintVersion()
+		}
+		os.Exit(0)
+	}
+	if serviceAction != "" {
+		if err := service.Control(serviceName, serviceAction, service.Command(fs, args, "service")); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if daemon {
+		if err := service.Daemon(logOpts.File); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	cmdConfig.Server = cmdServer
+	if err := logOpts.Setup(debug); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	exists, err := ss.IsFileExists(configFile)
+	// If no config file in current directory, try search it in the binary directory
+	// Note there's no portable way to detect the binary directory.
+	binDir := path.Dir(os.Args[0])
+	if (!exists || err != nil) && binDir != "" && binDir != "." {
+		oldConfig := configFile
+		configFile = path.Join(binDir, "config.json")
+		logger.Infof("%s not found, try config file %s", oldConfig, configFile)
+	}
+
+	config := LoadConfig(configFile, &cmdConfig)
+	if len(config.ServerPassword) == 0 {
+		if !enoughOptions(config) {
+			fmt.Fprintln(os.Stderr, "must specify server address, password and both server/local port")
+			os.Exit(1)
+		}
+	} else {
+		if config.Password != "" || config.ServerPort != 0 || config.GetServerArray() != nil {
+			fmt.Fprintln(os.Stderr, "given server_password, ignore server, server_port and password option")
+		}
+		if config.LocalPort == 0 {
+			fmt.Fprintln(os.Stderr, "must specify local port")
+			os.Exit(1)
+		}
+	}
+
+	parseServerConfig(config)
+
+	if pidFile != "" {
+		if err = ioutil.WriteFile(pidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "error writing pid file %s: %v\n", pidFile, err)
+			os.Exit(1)
+		}
+	}
+	// the service control manager stops it on windows
+	stop := make(chan os.Signal, 1)
+	service.Notify(serviceName, stop)
+	go func() {
+		<-stop
+		service.Exit(0)
+	}()
+
+	if httpPort != 0 {
+		go runHTTP(cmdLocal + ":" + strconv.Itoa(httpPort))
+	}
+
+	run(cmdLocal + ":" + strconv.Itoa(config.LocalPort))
+}
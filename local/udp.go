@@ -0,0 +1,86 @@
+package local
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+// udpServer returns the server used for UDP associations, the first one
+// without connection failures.
+func udpServer() *ServerCipher {
+	best := 0
+	for i := range servers.srvCipher {
+		if servers.failCnt[i] < servers.failCnt[best] {
+			best = i
+		}
+	}
+	return servers.srvCipher[best]
+}
+
+// dialUDPServer returns a UDP relay connection to the server chosen by
+// udpServer, a UDP over TCP connection with uot.
+func dialUDPServer() (remote ss.UDPRelayConn, server string, err error) {
+	se := udpServer()
+	if servers.uot {
+		rawaddr, _ := ss.RawAddr(net.JoinHostPort(ss.UoTHost, "0"))
+		c, err := dialServer(se, rawaddr)
+		if err != nil {
+			return nil, se.server, err
+		}
+		return ss.NewUoTConn(c), se.server, nil
+	}
+	saddr, err := net.ResolveUDPAddr("udp", se.server)
+	if err != nil {
+		return
+	}
+	conn, err := net.DialUDP("udp", nil, saddr)
+	if err != nil {
+		return
+	}
+	return ss.NewUDPConn(conn, se.cipher.Copy()), se.server, nil
+}
+
+// handleUDPAssociate serves a socks5 UDP ASSOCIATE request. Datagrams from
+// the client are relayed through the shadowsocks server until the control
+// connection conn is closed.
+func handleUDPAssociate(conn net.Conn) {
+	tcpAddr := conn.LocalAddr().(*net.TCPAddr)
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: tcpAddr.IP, Zone: tcpAddr.Zone})
+	if err != nil {
+		logger.Warn("udp associate:", err)
+		conn.Write([]byte{socksVer5, 0x01, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer client.Close()
+
+	// the relay connections are dialed by the relay for each client
+	// address, fail early if the server can't be resolved
+	server := udpServer().server
+	if _, err = net.ResolveUDPAddr("udp", server); err != nil {
+		logger.Warn("udp associate:", err)
+		conn.Write([]byte{socksVer5, 0x04, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		return
+	}
+
+	// reply with the address of the relay socket
+	bnd := client.LocalAddr()
+	if _, err = conn.Write(append([]byte{socksVer5, 0x00, 0x00}, ss.ParseHeader(bnd)...)); err != nil {
+		logger.Debug("send udp associate reply:", err)
+		return
+	}
+	logger.Debugf("udp associate for %s via %s at %s", conn.RemoteAddr(), server, bnd)
+
+	relay := ss.NewSocksUDPRelay(client, conn.RemoteAddr().(*net.TCPAddr).IP, func() (ss.UDPRelayConn, error) {
+		remote, _, err := dialUDPServer()
+		return remote, err
+	})
+	defer relay.Close()
+	go relay.Serve()
+
+	// the association ends with the control connection
+	io.Copy(ioutil.Discard, conn)
+	logger.Debug("closed udp associate for", conn.RemoteAddr())
+}
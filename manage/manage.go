@@ -0,0 +1,64 @@
+// Package manage implements the manage subcommand, which controls a running
+// server by editing its config file or through its management API.
+package manage
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s manage <command> [arguments]\n\n", os.Args[0])
+	fmt.Fprintln(os.Stderr, "Commands:")
+	fmt.Fprintln(os.Stderr, "  port add|edit|remove  add, change or remove a port in the config file and reload the server")
+	fmt.Fprintln(os.Stderr, "  stats                 query traffic statistics from the management API")
+}
+
+// Main runs the manage subcommand with args following "manage" and returns
+// the exit status.
+func Main(args []string) int {
+	if len(args) == 0 {
+		usage()
+		return 2
+	}
+	switch args[0] {
+	case "port":
+		return PortCommand(args[1:])
+	case "stats":
+		return statsCommand(args[1:])
+	}
+	usage()
+	return 2
+}
+
+func statsCommand(args []string) int {
+	var addr, token string
+	fs := flag.NewFlagSet("stats", flag.ContinueOnError)
+	fs.StringVar(&addr, "addr", "127.0.0.1:6001", "management API address")
+	fs.StringVar(&token, "token", "", "management API token")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	req, err := http.NewRequest("GET", "http://"+addr+"/stats", nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintln(os.Stderr, "management API:", resp.Status)
+		return 1
+	}
+	io.Copy(os.Stdout, resp.Body)
+	return 0
+}
@@ -0,0 +1,279 @@
+package manage
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+// The port subcommand edits the port_password option of the config file and
+// makes the running server reload it, signaling the process of the pid file
+// (-pidfile, or pid_file of the config) or else through the management API
+// of the config:
+//
+//	shadowsocks-server port add <port> -password <password> [-udp] [-openvpn] [-quota <GB>]
+//	shadowsocks-server port edit <port> [-password <password>] [-quota <GB>]
+//	shadowsocks-server port remove <port>
+//
+// The quota of a port is kept in port_quota, or in quota_gb if the port is
+// given as an object.
+
+func portUsage() {
+	fmt.Fprintln(os.Stderr, "Usage: port add <port> -password <password> [options]")
+	fmt.Fprintln(os.Stderr, "       port edit <port> [-password <password>] [-quota <GB>] [options]")
+	fmt.Fprintln(os.Stderr, "       port remove <port> [options]")
+}
+
+// PortCommand runs the port subcommand with args following "port" and
+// returns the exit status.
+func PortCommand(args []string) int {
+	if len(args) < 2 || (args[0] != "add" && args[0] != "edit" && args[0] != "remove") {
+		portUsage()
+		return 2
+	}
+	action, port := args[0], args[1]
+	if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+		fmt.Fprintln(os.Stderr, "invalid port:", port)
+		return 2
+	}
+
+	var file, password, pidFile string
+	var openvpn, udpRelay bool
+	quota := -1.0
+	fs := flag.NewFlagSet("port "+action, flag.ContinueOnError)
+	fs.StringVar(&file, "c", "config.json", "config file to edit")
+	fs.StringVar(&pidFile, "pidfile", "", "pid file of the running server to signal, pid_file of the config by default")
+	if action != "remove" {
+		fs.StringVar(&password, "password", "", "password for the port")
+		fs.Float64Var(&quota, "quota", -1, "traffic quota of the port in GB, 0 for none")
+	}
+	if action == "add" {
+		fs.BoolVar(&openvpn, "openvpn", false, "allow connecting to local openvpn on this port")
+		fs.BoolVar(&udpRelay, "udp", false, "enable UDP relay on this port")
+	}
+	if err := fs.Parse(args[2:]); err != nil {
+		return 2
+	}
+	if action == "add" && password == "" {
+		fmt.Fprintln(os.Stderr, "must specify password with -password")
+		return 2
+	}
+	if action == "edit" && password == "" && quota < 0 {
+		fmt.Fprintln(os.Stderr, "must specify -password or -quota to change")
+		return 2
+	}
+
+	var managerAddr, managerToken string
+	err := editConfig(file, func(m map[string]interface{}) error {
+		if pidFile == "" {
+			pidFile, _ = m["pid_file"].(string)
+		}
+		managerAddr, _ = m["manager_address"].(string)
+		managerToken, _ = m["manager_token"].(string)
+		pp, _ := m["port_password"].(map[string]interface{})
+		if pp == nil {
+			pp = make(map[string]interface{})
+			// port_password overrides server_port and password, so keep the
+			// single port setup by moving it into port_password.
+			if sp, ok := m["server_port"].(float64); ok && sp != 0 {
+				if pw, ok := m["password"].(string); ok && pw != "" {
+					pp[strconv.Itoa(int(sp))] = []string{pw, "", ""}
+					delete(m, "server_port")
+					delete(m, "password")
+				}
+			}
+		}
+		pq, _ := m["port_quota"].(map[string]interface{})
+		if pq == nil {
+			pq = make(map[string]interface{})
+		}
+		_, exists := pp[port]
+		switch action {
+		case "add":
+			if exists {
+				return fmt.Errorf("port %s already exists", port)
+			}
+			pp[port] = []string{password, okIf(openvpn), okIf(udpRelay)}
+			delete(pq, port)
+			if quota > 0 {
+				pq[port] = quota
+			}
+		case "edit":
+			if !exists {
+				return fmt.Errorf("port %s not found in %s", port, file)
+			}
+			switch e := pp[port].(type) {
+			case map[string]interface{}:
+				// the object form, {"password": ..., "quota_gb": ...}
+				if password != "" {
+					e["password"] = password
+				}
+				if quota > 0 {
+					e["quota_gb"] = quota
+				} else if quota == 0 {
+					delete(e, "quota_gb")
+				}
+			case []interface{}:
+				if password != "" && len(e) > 0 {
+					e[0] = password
+				}
+				if quota > 0 {
+					pq[port] = quota
+				} else if quota == 0 {
+					delete(pq, port)
+				}
+			default:
+				return fmt.Errorf("port %s of %s is neither an array nor an object", port, file)
+			}
+		case "remove":
+			if !exists {
+				return fmt.Errorf("port %s not found in %s", port, file)
+			}
+			delete(pp, port)
+			delete(pq, port)
+		}
+		m["port_password"] = pp
+		if len(pq) > 0 {
+			m["port_quota"] = pq
+		} else {
+			delete(m, "port_quota")
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("port %s %s in %s\n", port, map[string]string{"add": "added", "edit": "changed", "remove": "removed"}[action], file)
+
+	switch {
+	case pidFile != "":
+		if err = signalServer(pidFile); err != nil {
+			fmt.Fprintln(os.Stderr, "error signaling server:", err)
+			return 1
+		}
+		fmt.Println("server reloading config")
+	case managerAddr != "":
+		if err = reloadServer(managerAddr, managerToken); err != nil {
+			fmt.Fprintln(os.Stderr, "error reloading server through the management API:", err)
+			return 1
+		}
+		fmt.Println("server reloaded config")
+	default:
+		fmt.Fprintln(os.Stderr, "warning: the server was NOT reloaded, as there's no -pidfile, nor pid_file or manager_address in the config;")
+		fmt.Fprintln(os.Stderr, "send SIGUSR1 to the server to apply the change, SIGHUP also resets quotas")
+	}
+	return 0
+}
+
+func okIf(b bool) string {
+	if b {
+		return "ok"
+	}
+	return ""
+}
+
+// editConfig loads file as a generic JSON object, so options unknown to
+// edit are preserved, calls edit and atomically replaces file with the
+// result. YAML and TOML files are refused: written back, they would lose
+// their comments and the order of their options, as JSON has neither.
+func editConfig(file string, edit func(m map[string]interface{}) error) error {
+	if f := ss.ConfigFormat(file); f != ss.ConfigJSON {
+		return fmt.Errorf("%s: only json config files can be edited, a %s file written back would lose its comments and the order of its options; edit it by hand and send SIGUSR1 to the server", file, f)
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	m := make(map[string]interface{})
+	if err = json.Unmarshal(data, &m); err != nil {
+		return fmt.Errorf("error parsing %s: %v", file, err)
+	}
+	if err = edit(m); err != nil {
+		return err
+	}
+	if data, err = json.MarshalIndent(m, "", "\t"); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(file), ".config")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // fails harmlessly after rename
+	if _, err = tmp.Write(append(data, '\n')); err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Chmod(tmp.Name(), fi.Mode()); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+func signalServer(pidFile string) error {
+	data, err := ioutil.ReadFile(pidFile)
+	if err != nil {
+		return err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return errors.New("invalid pid in " + pidFile)
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return p.Signal(reloadSignal)
+}
+
+// reloadServer makes the server reload its config through the management
+// API at addr, which is reached on loopback if it listens on all addresses.
+func reloadServer(addr, token string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified() && ip.To4() != nil) {
+		host = "127.0.0.1"
+	} else if ip != nil && ip.IsUnspecified() {
+		host = "::1"
+	}
+	req, err := http.NewRequest("POST", "http://"+net.JoinHostPort(host, port)+"/reload", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	client := &http.Client{Timeout: time.Minute}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package manage
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// readConfig returns the JSON object of file.
+func readConfig(t *testing.T, file string) map[string]interface{} {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := make(map[string]interface{})
+	if err = json.Unmarshal(data, &m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// writeConfig writes m to file as JSON.
+func writeConfig(t *testing.T, file string, m map[string]interface{}) {
+	data, err := json.Marshal(m)
+	if err == nil {
+		err = ioutil.WriteFile(file, data, 0600)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPortCommand(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.json")
+	data := `{"server_port": 8388, "password": "barfoo", "method": "aes-256-gcm",
+		"port_quota": {"9000": 1}}`
+	if err := ioutil.WriteFile(file, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := PortCommand([]string{"add", "8444", "-c", file, "--password", "foobar", "-udp", "--quota", "100"}); n != 0 {
+		t.Fatal("add exited with", n)
+	}
+	m := readConfig(t, file)
+	want := map[string]interface{}{
+		"8388": []interface{}{"barfoo", "", ""},
+		"8444": []interface{}{"foobar", "", "ok"},
+	}
+	if !reflect.DeepEqual(m["port_password"], want) {
+		t.Errorf("port_password after add %v, want %v", m["port_password"], want)
+	}
+	if _, ok := m["server_port"]; ok {
+		t.Error("server_port not moved to port_password")
+	}
+	if q := m["port_quota"].(map[string]interface{}); q["8444"] != 100.0 || q["9000"] != 1.0 || m["method"] != "aes-256-gcm" {
+		t.Errorf("config after add %v", m)
+	}
+	if n := PortCommand([]string{"add", "8444", "-c", file, "-password", "again"}); n != 1 {
+		t.Error("adding an existing port exited with", n)
+	}
+
+	if n := PortCommand([]string{"edit", "8444", "-c", file, "-password", "changed", "-quota", "200"}); n != 0 {
+		t.Fatal("edit exited with", n)
+	}
+	m = readConfig(t, file)
+	if pp := m["port_password"].(map[string]interface{}); !reflect.DeepEqual(pp["8444"], []interface{}{"changed", "", "ok"}) {
+		t.Errorf("port 8444 after edit %v", pp["8444"])
+	}
+	if q := m["port_quota"].(map[string]interface{}); q["8444"] != 200.0 {
+		t.Errorf("quota after edit %v", q["8444"])
+	}
+	if n := PortCommand([]string{"edit", "8444", "-c", file, "-quota", "0"}); n != 0 {
+		t.Fatal("edit exited with", n)
+	}
+	if q := readConfig(t, file)["port_quota"].(map[string]interface{}); q["8444"] != nil {
+		t.Errorf("quota not removed: %v", q)
+	}
+	if n := PortCommand([]string{"edit", "8445", "-c", file, "-quota", "1"}); n != 1 {
+		t.Error("editing a missing port exited with", n)
+	}
+
+	if n := PortCommand([]string{"remove", "9000", "-c", file}); n != 1 {
+		t.Error("removing a missing port exited with", n)
+	}
+	if n := PortCommand([]string{"remove", "8444", "-c", file}); n != 0 {
+		t.Fatal("remove exited with", n)
+	}
+	m = readConfig(t, file)
+	want = map[string]interface{}{"8388": []interface{}{"barfoo", "", ""}}
+	if !reflect.DeepEqual(m["port_password"], want) {
+		t.Errorf("port_password after remove %v, want %v", m["port_password"], want)
+	}
+}
+
+func TestPortCommandObject(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.json")
+	data := `{"port_password": {"8388": {"password": "barfoo", "udp": true, "quota_gb": 10}}}`
+	if err := ioutil.WriteFile(file, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if n := PortCommand([]string{"edit", "8388", "-c", file, "-quota", "20"}); n != 0 {
+		t.Fatal("edit exited with", n)
+	}
+	m := readConfig(t, file)
+	want := map[string]interface{}{"password": "barfoo", "udp": true, "quota_gb": 20.0}
+	if pp := m["port_password"].(map[string]interface{}); !reflect.DeepEqual(pp["8388"], want) {
+		t.Errorf("port 8388 after edit %v, want %v", pp["8388"], want)
+	}
+	if _, ok := m["port_quota"]; ok {
+		t.Error("port_quota added for a port with quota_gb")
+	}
+}
+
+func TestPortCommandYAML(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	data := "# comment\nport_password:\n  8388: [barfoo, '', '']\n"
+	if err := ioutil.WriteFile(file, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if n := PortCommand([]string{"remove", "8388", "-c", file}); n != 1 {
+		t.Error("editing yaml exited with", n)
+	}
+	if got, _ := ioutil.ReadFile(file); string(got) != data {
+		t.Error("yaml file changed")
+	}
+}
+
+func TestPortCommandReload(t *testing.T) {
+	reloads := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/reload" || r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		reloads++
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "config.json")
+	data := `{"port_password": {"8388": ["barfoo", "", ""]}, "manager_address": "` + ts.Listener.Addr().String() + `", "manager_token": "secret"}`
+	if err := ioutil.WriteFile(file, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if n := PortCommand([]string{"add", "8444", "-c", file, "-password", "foobar"}); n != 0 || reloads != 1 {
+		t.Errorf("add exited with %d after %d reloads", n, reloads)
+	}
+
+	m := readConfig(t, file)
+	m["manager_token"] = "wrong"
+	writeConfig(t, file, m)
+	if n := PortCommand([]string{"remove", "8444", "-c", file}); n != 1 || reloads != 1 {
+		t.Errorf("remove with a wrong token exited with %d after %d reloads", n, reloads)
+	}
+
+	// pid_file of the config wins over the management API
+	pidFile := filepath.Join(dir, "server.pid")
+	if err := ioutil.WriteFile(pidFile, []byte("none\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	m["manager_token"] = "secret"
+	m["pid_file"] = pidFile
+	writeConfig(t, file, m)
+	if n := PortCommand([]string{"add", "8444", "-c", file, "-password", "foobar"}); n != 1 || reloads != 1 {
+		t.Errorf("add with an invalid pid file exited with %d after %d reloads", n, reloads)
+	}
+
+	// with no way to reload, the change is still made
+	delete(m, "pid_file")
+	delete(m, "manager_address")
+	writeConfig(t, file, m)
+	if n := PortCommand([]string{"edit", "8444", "-c", file, "-password", "changed"}); n != 0 {
+		t.Error("edit without a server to reload exited with", n)
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package manage
+
+import (
+	"os"
+	"syscall"
+)
+
+// reloadSignal makes the server reload its config without resetting quotas.
+var reloadSignal os.Signal = syscall.SIGUSR1
@@ -0,0 +1,9 @@
+package manage
+
+import (
+	"os"
+	"syscall"
+)
+
+// reloadSignal is SIGHUP, which can't be sent on windows anyway.
+var reloadSignal os.Signal = syscall.SIGHUP
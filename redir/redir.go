@@ -0,0 +1,232 @@
+// Package redir implements the shadowsocks transparent proxy command, which
+// turns a linux router into a gateway relaying the traffic redirected to it
+// by iptables through a shadowsocks server, like ss-redir of shadowsocks-libev.
+//
+// TCP is redirected with REDIRECT, or TPROXY with the -tproxy option:
+//
+//	iptables -t nat -A PREROUTING -p tcp -j REDIRECT --to-ports 1080
+//
+// UDP (-u option) always needs TPROXY:
+//
+//	ip rule add fwmark 1 lookup 100
+//	ip route add local 0.0.0.0/0 dev lo table 100
+//	iptables -t mangle -A PREROUTING -p udp -j TPROXY --on-port 1080 --tproxy-mark 1
+//
+// The traffic to the shadowsocks server itself must be excluded from the
+// rules.
+package redir
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/shadowsocks/shadowsocks-go/local"
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+var errNoOrigDst = errors.New("no original destination")
+
+var logger = ss.NewLogger("redir")
+
+// idle time after which a UDP session is closed
+const udpTimeout = 60 * time.Second
+
+func handleConnection(conn *net.TCPConn, tproxy bool) {
+	defer conn.Close()
+
+	var dst *net.TCPAddr
+	var err error
+	if tproxy {
+		// TPROXY keeps the original destination as local address
+		dst = conn.LocalAddr().(*net.TCPAddr)
+	} else if dst, err = originalDst(conn); err != nil {
+		logger.Warn("original destination:", err)
+		return
+	}
+	addr := dst.String()
+	logger.Debugf("redir %s to %s", conn.RemoteAddr(), addr)
+
+	remote, err := local.DialServer(ss.ParseHeader(dst), addr)
+	if err != nil {
+		return
+	}
+	defer remote.Close()
+
+	ss.Relay(conn, remote, ss.RelayOptions{})
+	logger.Debug("closed connection to", addr)
+}
+
+func run(listenAddr string, tproxy bool) {
+	ln, err := listenTCP(listenAddr, tproxy)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	logger.Infof("starting transparent proxy at %v ...", listenAddr)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			logger.Warn("accept:", err)
+			if ss.IsFileLimit(err) {
+				time.Sleep(ss.FileLimitReached())
+			}
+			continue
+		}
+		go handleConnection(conn.(*net.TCPConn), tproxy)
+	}
+}
+
+// udpSession relays the datagrams of one client through the server.
+type udpSession struct {
+	client *net.UDPAddr
+	remote ss.UDPRelayConn
+	// sockets replying from the original destinations, by address
+	replies map[string]*net.UDPConn
+}
+
+var udpSessions = struct {
+	sync.Mutex
+	m map[string]*udpSession
+}{m: make(map[string]*udpSession)}
+
+func runUDP(listenAddr string) {
+	conn, err := listenUDP(listenAddr)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	logger.Infof("starting transparent UDP proxy at %v ...", listenAddr)
+	buf := ss.GetBuf(ss.LargeBufSize)
+	defer ss.PutBuf(buf)
+	for {
+		n, src, dst, err := readUDP(conn, buf)
+		if err != nil {
+			if err == errNoOrigDst {
+				continue
+			}
+			logger.Warn("[udp]read:", err)
+			return
+		}
+		s, err := getSession(src)
+		if err != nil {
+			logger.Warn("[udp]connect to server:", err)
+			continue
+		}
+		if _, err = s.remote.Write(append(ss.ParseHeader(dst), buf[:n]...)); err != nil {
+			logger.Debug("[udp]write to server:", err)
+		}
+	}
+}
+
+// getSession returns the session of client src, creating it if needed.
+func getSession(src *net.UDPAddr) (*udpSession, error) {
+	udpSessions.Lock()
+	defer udpSessions.Unlock()
+	if s, ok := udpSessions.m[src.String()]; ok {
+		return s, nil
+	}
+	remote, err := local.DialUDPServer()
+	if err != nil {
+		return nil, err
+	}
+	s := &udpSession{src, remote, make(map[string]*net.UDPConn)}
+	udpSessions.m[src.String()] = s
+	logger.Debug("[udp]new session for", src)
+	go s.relayReplies()
+	return s, nil
+}
+
+// relayReplies sends the replies from the server to the client, until the
+// session is idle for udpTimeout.
+func (s *udpSession) relayReplies() {
+	defer func() {
+		udpSessions.Lock()
+		delete(udpSessions.m, s.client.String())
+		udpSessions.Unlock()
+		s.remote.Close()
+		for _, c := range s.replies {
+			c.Close()
+		}
+		logger.Debug("[udp]closed session for", s.client)
+	}()
+	buf := ss.GetBuf(ss.LargeBufSize)
+	defer ss.PutBuf(buf)
+	for {
+		s.remote.SetReadDeadline(time.Now().Add(udpTimeout))
+		n, err := s.remote.Read(buf)
+		if err != nil {
+			if _, ok := err.(net.Error); ok {
+				return
+			}
+			logger.Debug("[udp]read from server:", err)
+			continue
+		}
+		from, hlen := ss.ParseUDPHeader(buf[:n])
+		if from == nil {
+			continue
+		}
+		c, ok := s.replies[from.String()]
+		if !ok {
+			if c, err = dialUDPFrom(from, s.client); err != nil {
+				logger.Warn("[udp]reply socket:", err)
+				continue
+			}
+			s.replies[from.String()] = c
+		}
+		c.Write(buf[hlen:n])
+	}
+}
+
+// Main runs the transparent proxy with command line arguments args, which
+// don't include the program name.
+func Main(args []string) {
+	var configFile, cmdServer, cmdLocal string
+	var cmdConfig ss.Config
+	var udp, tproxy, debug bool
+
+	fs := flag.NewFlagSet("redir", flag.ExitOnError)
+
+	fs.StringVar(&configFile, "c", "config.json", "specify config file")
+	fs.StringVar(&cmdServer, "s", "", "server address")
+	fs.StringVar(&cmdLocal, "b", "", "local address, listen only to this address if specified")
+	fs.StringVar(&cmdConfig.Password, "k", "", "password")
+	fs.IntVar(&cmdConfig.ServerPort, "p", 0, "server port")
+	fs.IntVar(&cmdConfig.LocalPort, "l", 0, "local transparent proxy port")
+	fs.StringVar(&cmdConfig.Method, "m", "", "encryption method, default: aes-256-cfb")
+	fs.BoolVar(&cmdConfig.AllowInsecureCiphers, "allow-insecure-ciphers", false, "allow the broken or weak methods table, rc4, rc4-md5, des-cfb, bf-cfb and cast5-cfb")
+	fs.BoolVar(&udp, "u", false, "relay UDP redirected with TPROXY")
+	fs.BoolVar(&tproxy, "tproxy", false, "TCP is redirected with TPROXY instead of REDIRECT")
+	fs.BoolVar(&debug, "d", false, "print debug message")
+	logOpts := ss.AddLogFlags(fs)
+
+	fs.Parse(args)
+
+	cmdConfig.Server = cmdServer
+	if err := logOpts.Setup(debug); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	config := local.LoadConfig(configFile, &cmdConfig)
+	if config.LocalPort == 0 {
+		fmt.Fprintln(os.Stderr, "must specify local port")
+		os.Exit(1)
+	}
+	if len(config.ServerPassword) == 0 &&
+		(config.Server == nil || config.ServerPort == 0 || config.Password == "") {
+		fmt.Fprintln(os.Stderr, "must specify server address, password and server port")
+		os.Exit(1)
+	}
+
+	local.ParseServerConfig(config)
+
+	listenAddr := cmdLocal + ":" + strconv.Itoa(config.LocalPort)
+	if udp {
+		go runUDP(listenAddr)
+	}
+	run(listenAddr, tproxy)
+}
@@ -0,0 +1,160 @@
+package redir
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// SO_ORIGINAL_DST of netfilter, the same value for IPv4 and IPv6
+// (IP6T_SO_ORIGINAL_DST)
+const soOriginalDst = 80
+
+// originalDst returns the destination of a connection before it was
+// redirected by an iptables REDIRECT rule.
+func originalDst(c *net.TCPConn) (addr *net.TCPAddr, err error) {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return
+	}
+	ipv6 := c.LocalAddr().(*net.TCPAddr).IP.To4() == nil
+	cerr := raw.Control(func(fd uintptr) {
+		if ipv6 {
+			// sockaddr_in6 fits in the ip6_mtuinfo struct
+			var info *unix.IPv6MTUInfo
+			info, err = unix.GetsockoptIPv6MTUInfo(int(fd), unix.IPPROTO_IPV6, soOriginalDst)
+			if err == nil {
+				a := info.Addr
+				// the port is in network byte order
+				port := (*[2]byte)(unsafe.Pointer(&a.Port))
+				addr = &net.TCPAddr{
+					IP:   append(net.IP{}, a.Addr[:]...),
+					Port: int(binary.BigEndian.Uint16(port[:])),
+				}
+			}
+			return
+		}
+		// sockaddr_in fits in the ipv6_mreq struct
+		var mreq *unix.IPv6Mreq
+		mreq, err = unix.GetsockoptIPv6Mreq(int(fd), unix.IPPROTO_IP, soOriginalDst)
+		if err == nil {
+			b := mreq.Multiaddr
+			addr = &net.TCPAddr{
+				IP:   net.IPv4(b[4], b[5], b[6], b[7]),
+				Port: int(binary.BigEndian.Uint16(b[2:4])),
+			}
+		}
+	})
+	if cerr != nil {
+		err = cerr
+	}
+	return
+}
+
+// transparent sets IP_TRANSPARENT on the socket, so it can accept TPROXY
+// traffic and bind to non-local addresses.
+func transparent(network string, fd uintptr) (err error) {
+	if err = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1); err != nil {
+		return
+	}
+	if network == "tcp6" || network == "udp6" {
+		err = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+	}
+	return
+}
+
+func control(opts func(network string, fd uintptr) error) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		if cerr := c.Control(func(fd uintptr) { err = opts(network, fd) }); cerr != nil {
+			return cerr
+		}
+		return err
+	}
+}
+
+// listenTCP listens on addr, with IP_TRANSPARENT set for TPROXY rules.
+func listenTCP(addr string, tproxy bool) (net.Listener, error) {
+	lc := net.ListenConfig{}
+	if tproxy {
+		lc.Control = control(transparent)
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// listenUDP listens on addr for UDP redirected by a TPROXY rule. The original
+// destination of each datagram is returned by readUDP.
+func listenUDP(addr string) (*net.UDPConn, error) {
+	lc := net.ListenConfig{Control: control(func(network string, fd uintptr) error {
+		if err := transparent(network, fd); err != nil {
+			return err
+		}
+		if err := unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_RECVORIGDSTADDR, 1); err != nil {
+			return err
+		}
+		if network == "udp6" {
+			return unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_RECVORIGDSTADDR, 1)
+		}
+		return nil
+	})}
+	c, err := lc.ListenPacket(context.Background(), "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return c.(*net.UDPConn), nil
+}
+
+// readUDP reads a datagram and its source and original destination.
+func readUDP(c *net.UDPConn, b []byte) (n int, src, dst *net.UDPAddr, err error) {
+	oob := make([]byte, 64)
+	n, oobn, _, src, err := c.ReadMsgUDP(b, oob)
+	if err != nil {
+		return
+	}
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return
+	}
+	for _, m := range msgs {
+		switch {
+		case m.Header.Level == unix.SOL_IP && m.Header.Type == unix.IP_ORIGDSTADDR:
+			if sa, perr := unix.ParseOrigDstAddr(&m); perr == nil {
+				a := sa.(*unix.SockaddrInet4)
+				dst = &net.UDPAddr{IP: net.IP(a.Addr[:]).To16(), Port: a.Port}
+			}
+		case m.Header.Level == unix.SOL_IPV6 && m.Header.Type == unix.IPV6_ORIGDSTADDR:
+			if sa, perr := unix.ParseOrigDstAddr(&m); perr == nil {
+				a := sa.(*unix.SockaddrInet6)
+				dst = &net.UDPAddr{IP: append(net.IP{}, a.Addr[:]...), Port: a.Port}
+			}
+		}
+	}
+	if dst == nil {
+		err = errNoOrigDst
+	}
+	return
+}
+
+// dialUDPFrom returns a socket sending from the non-local address from to
+// the client to, so the replies appear to come from the original
+// destination.
+func dialUDPFrom(from, to *net.UDPAddr) (*net.UDPConn, error) {
+	d := net.Dialer{
+		LocalAddr: from,
+		Control: control(func(network string, fd uintptr) error {
+			if err := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); err != nil {
+				return err
+			}
+			return transparent(network, fd)
+		}),
+	}
+	c, err := d.Dial("udp", to.String())
+	if err != nil {
+		return nil, err
+	}
+	return c.(*net.UDPConn), nil
+}
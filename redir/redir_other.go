@@ -0,0 +1,31 @@
+//go:build !linux
+// +build !linux
+
+package redir
+
+import (
+	"errors"
+	"net"
+)
+
+var errNotLinux = errors.New("transparent proxy is only supported on linux")
+
+func originalDst(c *net.TCPConn) (*net.TCPAddr, error) {
+	return nil, errNotLinux
+}
+
+func listenTCP(addr string, tproxy bool) (net.Listener, error) {
+	return nil, errNotLinux
+}
+
+func listenUDP(addr string) (*net.UDPConn, error) {
+	return nil, errNotLinux
+}
+
+func readUDP(c *net.UDPConn, b []byte) (n int, src, dst *net.UDPAddr, err error) {
+	return 0, nil, nil, errNotLinux
+}
+
+func dialUDPFrom(from, to *net.UDPAddr) (*net.UDPConn, error) {
+	return nil, errNotLinux
+}
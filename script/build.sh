@@ -5,6 +5,10 @@ cd "$( dirname "${BASH_SOURCE[0]}" )/.."
 version=`grep 'const version = ' ./shadowsocks/util.go | sed -e 's/.*= //' | sed -e 's/"//g'`
 echo "creating shadowsocks binary version $version"
 
+pkg=github.com/shadowsocks/shadowsocks-go/shadowsocks
+commit=`git rev-parse --short HEAD 2>/dev/null || echo unknown`
+ldflags="-X $pkg.GitCommit=$commit -X $pkg.BuildDate=`date -u +%Y-%m-%dT%H:%M:%SZ`"
+
 ROOT=`pwd`
 bindir=$ROOT/bin
 mkdir -p $bindir
@@ -25,7 +29,7 @@ build() {
     pushd cmd/$prog
     name=$prog-$3-$version
     echo "building $name"
-    GOOS=$1 GOARCH=$2 go build -a || exit 1
+    GOOS=$1 GOARCH=$2 go build -a -ldflags "$ldflags" || exit 1
     if [[ $1 == "windows" ]]; then
         mv $prog.exe $ROOT/script/
         pushd $ROOT/script/
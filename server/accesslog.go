@@ -0,0 +1,107 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+// With access_log, every relayed connection, or a sample of them, is
+// recorded when it's closed. The log is opened again on reload, so it can
+// be rotated like the other logs.
+
+// syslogTag tags the access log records sent to syslog.
+const syslogTag = "shadowsocks-server"
+
+var accessLog = struct {
+	sync.Mutex
+	l *ss.AccessLog
+}{}
+
+// checkAccessLog checks the access_log options of c.
+func checkAccessLog(c *ss.Config) error {
+	return ss.CheckAccessLog(accessSampleRate(c), c.AccessLogMask)
+}
+
+// accessSampleRate returns the part of the connections recorded, all by
+// default.
+func accessSampleRate(c *ss.Config) float64 {
+	if c.AccessLogSampleRate == 0 {
+		return 1
+	}
+	return c.AccessLogSampleRate
+}
+
+// setAccessLog opens the access_log of c, closing the one open.
+func setAccessLog(c *ss.Config) error {
+	if err := checkAccessLog(c); err != nil {
+		return err
+	}
+	var l *ss.AccessLog
+	if c.AccessLog != "" {
+		var err error
+		if l, err = ss.OpenAccessLog(c.AccessLog, accessSampleRate(c), c.AccessLogMask, syslogTag); err != nil {
+			return err
+		}
+	}
+	accessLog.Lock()
+	old := accessLog.l
+	accessLog.l = l
+	accessLog.Unlock()
+	return old.Close()
+}
+
+// currentAccessLog returns the access log, nil if there's none.
+func currentAccessLog() *ss.AccessLog {
+	accessLog.Lock()
+	defer accessLog.Unlock()
+	return accessLog.l
+}
+
+// closeReason tells why a relay ended from the errors ending its up and
+// down directions, and its ss.Close* class. The direction ending first
+// closes the other, whose error is then that of a closed connection.
+func closeReason(upErr, downErr error) (reason, class string) {
+	// with a half close the client may end first, and the target fail after
+	downFailed := downErr != io.EOF && !errors.Is(downErr, net.ErrClosed)
+	if errors.Is(upErr, net.ErrClosed) || (upErr == io.EOF && downFailed) {
+		return directionReason("target closed", ss.CloseRemoteEOF, downErr)
+	}
+	return directionReason("client closed", ss.CloseClientEOF, upErr)
+}
+
+// directionReason tells why a direction of a relay ended with err, eof
+// and eofClass being the reason of its end of file.
+func directionReason(eof, eofClass string, err error) (string, string) {
+	var ne net.Error
+	switch {
+	case err == nil:
+		return "port closed", ss.CloseServer
+	case err == io.EOF:
+		return eof, eofClass
+	case errors.Is(err, net.ErrClosed):
+		return "closed by the server", ss.CloseServer
+	case errors.As(err, &ne) && ne.Timeout():
+		return "timeout", ss.CloseTimeout
+	}
+	return err.Error(), ss.CloseError
+}
+
+// logAccess records the relay of client to dest, started at start.
+func logAccess(l *ss.AccessLog, start time.Time, client net.Conn, port, user, dest string, up, down int64, reason string) {
+	l.Log(&ss.AccessRecord{
+		Time:       start,
+		Client:     ss.HostOf(client.RemoteAddr()),
+		Port:       port,
+		User:       user,
+		Dest:       dest,
+		Up:         up,
+		Down:       down,
+		DurationMs: int64(time.Since(start) / time.Millisecond),
+		Reason:     reason,
+	})
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"net"
+	"sync"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+// destACL is the ACL checked against destinations, loaded from the acl
+// option and reloaded on SIGHUP.
+var destACL struct {
+	sync.Mutex
+	acl *ss.ACL
+}
+
+// loadACL reads the ACL file at path to replace the one in use, an empty
+// path removes it.
+func loadACL(path string) error {
+	var acl *ss.ACL
+	if path != "" {
+		var err error
+		if acl, err = ss.LoadACL(path); err != nil {
+			return err
+		}
+	}
+	destACL.Lock()
+	destACL.acl = acl
+	destACL.Unlock()
+	return nil
+}
+
+// allowACL reports whether the ACL allows connecting to ip, resolved from
+// domain if it's not empty.
+func allowACL(domain string, ip net.IP) bool {
+	destACL.Lock()
+	acl := destACL.acl
+	destACL.Unlock()
+	return acl == nil || acl.Allow(domain, ip)
+}
+
+// rejectACLDomain reports whether the ACL rejects domain before it's
+// resolved.
+func rejectACLDomain(domain string) bool {
+	destACL.Lock()
+	acl := destACL.acl
+	destACL.Unlock()
+	return acl != nil && acl.RejectDomain(domain)
+}
+
+// allowUDPACL is the ACL policy of the UDP relay.
+func allowUDPACL(domain, ip, port string) bool {
+	return allowACL(domain, net.ParseIP(ip))
+}
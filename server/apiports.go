@@ -0,0 +1,203 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+// Ports created through the management API are not in the config file. They
+// are kept here and merged into the config on every reload, so they survive
+// SIGHUP. A port created with a TTL is removed when the TTL expires.
+
+type apiPort struct {
+	password [3]string
+	method   string // "" for the method of the config
+	tenant   string
+	maxConns *int      // cap of open connections set by the API, if any
+	expires  time.Time // zero for no expiry
+	timer    *time.Timer
+}
+
+var apiPorts = struct {
+	sync.Mutex
+	m map[string]*apiPort
+}{m: make(map[string]*apiPort)}
+
+// mergeAPIPorts adds ports created through the management API to config.
+func mergeAPIPorts(config *ss.Config) {
+	apiPorts.Lock()
+	defer apiPorts.Unlock()
+	for port, ap := range apiPorts.m {
+		if _, ok := config.PortPassword[port]; ok {
+			logger.Warnf("port %s from config overrides port created by management API", port)
+			continue
+		}
+		if config.PortPassword == nil {
+			config.PortPassword = make(map[string][3]string)
+		}
+		config.PortPassword[port] = ap.password
+		if ap.method != "" {
+			if config.PortMethod == nil {
+				config.PortMethod = make(map[string]string)
+			}
+			config.PortMethod[port] = ap.method
+		}
+		if ap.maxConns != nil {
+			if config.PortMaxConnections == nil {
+				config.PortMaxConnections = make(map[string]int)
+			}
+			config.PortMaxConnections[port] = *ap.maxConns
+		}
+		if t, ok := config.Tenants[ap.tenant]; ok {
+			if t.PortPassword == nil {
+				t.PortPassword = make(map[string][3]string)
+			}
+			t.PortPassword[port] = ap.password
+		}
+	}
+}
+
+// addAPIPort starts listening on port, with method unless it's empty. If
+// ttl is positive, the port is removed after ttl.
+func addAPIPort(port string, password [3]string, method, tenant string, ttl time.Duration) error {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	if _, ok := config.PortPassword[port]; ok {
+		return fmt.Errorf("port %s already exists", port)
+	}
+	if method != "" {
+		if err := config.CheckMethod(method); err != nil {
+			return err
+		}
+	}
+	ap := &apiPort{password: password, method: method, tenant: tenant}
+	if ttl > 0 {
+		ap.expires = time.Now().Add(ttl)
+		ap.timer = time.AfterFunc(ttl, func() { expireAPIPort(port, ap) })
+	}
+	apiPorts.Lock()
+	apiPorts.m[port] = ap
+	apiPorts.Unlock()
+	mergeAPIPorts(config)
+
+	passwdManager.updatePortPasswd(port, password)
+	if ttl > 0 {
+		logger.Infof("port %s added by management API, expires at %v", port, ap.expires.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func expireAPIPort(port string, ap *apiPort) {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	apiPorts.Lock()
+	if apiPorts.m[port] != ap {
+		// removed or recreated meanwhile
+		apiPorts.Unlock()
+		return
+	}
+	delete(apiPorts.m, port)
+	apiPorts.Unlock()
+
+	logger.Infof("closing port %s as its TTL expired", port)
+	closePort(port, ap.tenant)
+}
+
+// closePort stops listening on port and removes it from the running config,
+// called with reloadLock held.
+func closePort(port, tenant string) {
+	archiveTraffic(port, tenant)
+	delete(config.PortPassword, port)
+	delete(config.PortMethod, port)
+	delete(config.PortMaxConnections, port)
+	forgetMaxConns(port)
+	if t, ok := config.Tenants[tenant]; ok {
+		delete(t.PortPassword, port)
+	}
+	passwdManager.del(port)
+	forgetBind(port)
+}
+
+var errNoPort = errors.New("no such port")
+
+// removePort closes port. A port from the config file comes back when the
+// config is reloaded.
+func removePort(port string) error {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	if _, ok := config.PortPassword[port]; !ok {
+		return errNoPort
+	}
+	apiPorts.Lock()
+	if ap, ok := apiPorts.m[port]; ok {
+		if ap.timer != nil {
+			ap.timer.Stop()
+		}
+		delete(apiPorts.m, port)
+	}
+	apiPorts.Unlock()
+	logger.Infof("closing port %s as it's removed by management API", port)
+	closePort(port, config.TenantOf(port))
+	return nil
+}
+
+// setPortPassword changes the password of port, restarting its listener. The
+// change of a port from the config file lasts until the config is reloaded.
+func setPortPassword(port string, password [3]string) error {
+	if password[0] == "" {
+		return invalidError{errors.New("password required")}
+	}
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	if _, ok := config.PortPassword[port]; !ok {
+		return errNoPort
+	}
+	apiPorts.Lock()
+	if ap, ok := apiPorts.m[port]; ok {
+		ap.password = password
+	}
+	apiPorts.Unlock()
+	config.PortPassword[port] = password
+	if t, ok := config.Tenants[config.TenantOf(port)]; ok {
+		t.PortPassword[port] = password
+	}
+	passwdManager.updatePortPasswd(port, password)
+	return nil
+}
+
+type archiveRecord struct {
+	Time    time.Time `json:"time"`
+	Port    string    `json:"port"`
+	Tenant  string    `json:"tenant,omitempty"`
+	Traffic int       `json:"traffic"`
+}
+
+// archiveTraffic saves the traffic of a port about to be removed to the
+// stats archive file, as its counter is deleted with the port.
+func archiveTraffic(port, tenant string) {
+	traffic, _ := ss.GetTraffic(port)
+	rec := &archiveRecord{time.Now(), port, tenant, traffic[port]}
+	logger.Infof("archived traffic of port %s: %d bytes", port, rec.Traffic)
+	if config.StatsArchive == "" {
+		return
+	}
+	f, err := os.OpenFile(config.StatsArchive, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		logger.Error("error opening stats archive:", err)
+		return
+	}
+	defer f.Close()
+	if err = json.NewEncoder(f).Encode(rec); err != nil {
+		logger.Error("error writing stats archive:", err)
+	}
+}
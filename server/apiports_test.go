@@ -0,0 +1,150 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+// waitPassword waits until port listens with password.
+func waitPassword(t *testing.T, port, password string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if pl, ok := passwdManager.get(port); ok && pl.password == password {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("port %s isn't listening with password %s", port, password)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAPIPortLifecycle(t *testing.T) {
+	saved, savedTcp, savedUdp := config, netTcp, netUdp
+	defer func() { config, netTcp, netUdp = saved, savedTcp, savedUdp }()
+	archive := filepath.Join(t.TempDir(), "archive.json")
+	config = &ss.Config{Method: "aes-256-gcm", PortPassword: map[string][3]string{}, StatsArchive: archive}
+	netTcp, netUdp = "tcp", "udp"
+	port := freePort(t)
+	defer ss.DelTraffic(port)
+
+	if err := addAPIPort(port, [3]string{"foobar"}, "chacha20-ietf-poly1305", "", 0); err != nil {
+		t.Fatal(err)
+	}
+	defer removePort(port)
+	waitPassword(t, port, "foobar")
+	if err := addAPIPort(port, [3]string{"barfoo"}, "", "", 0); err == nil {
+		t.Error("adding an existing port should fail")
+	}
+	if err := addAPIPort(freePort(t), [3]string{"barfoo"}, "no-such-method", "", 0); err == nil {
+		t.Error("adding a port with an unknown method should fail")
+	}
+	if config.MethodOf(port) != "chacha20-ietf-poly1305" {
+		t.Errorf("port method %s", config.MethodOf(port))
+	}
+
+	// the new password restarts the listener and survives reloads
+	if err := setPortPassword(port, [3]string{"barfoo"}); err != nil {
+		t.Fatal(err)
+	}
+	waitPassword(t, port, "barfoo")
+	reloaded := &ss.Config{}
+	mergeAPIPorts(reloaded)
+	if reloaded.PortPassword[port][0] != "barfoo" || reloaded.PortMethod[port] != "chacha20-ietf-poly1305" {
+		t.Errorf("port not merged on reload: %v %v", reloaded.PortPassword, reloaded.PortMethod)
+	}
+	// a port of the config file wins over the API one
+	reloaded = &ss.Config{PortPassword: map[string][3]string{port: {"fromfile"}}}
+	mergeAPIPorts(reloaded)
+	if reloaded.PortPassword[port][0] != "fromfile" {
+		t.Error("API port overrode the port of the config file")
+	}
+
+	ss.RestoreTraffic(&ss.TrafficSnapshot{Ports: map[string]*ss.PortUsage{port: {Traffic: 4096}}})
+	if err := removePort(port); err != nil {
+		t.Fatal(err)
+	}
+	waitListening(t, port, false)
+	if _, ok := config.PortPassword[port]; ok {
+		t.Error("removed port still in config")
+	}
+	reloaded = &ss.Config{}
+	mergeAPIPorts(reloaded)
+	if _, ok := reloaded.PortPassword[port]; ok {
+		t.Error("removed port merged on reload")
+	}
+	if err := removePort(port); err != errNoPort {
+		t.Errorf("removing a missing port: %v", err)
+	}
+	if err := setPortPassword(port, [3]string{"foobar"}); err != errNoPort {
+		t.Errorf("changing the password of a missing port: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rec archiveRecord
+	if err = json.Unmarshal(data, &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Port != port || rec.Traffic != 4096 {
+		t.Errorf("archived %+v", rec)
+	}
+}
+
+func TestAPIPortTTL(t *testing.T) {
+	saved, savedTcp, savedUdp := config, netTcp, netUdp
+	defer func() { config, netTcp, netUdp = saved, savedTcp, savedUdp }()
+	config = &ss.Config{Method: "aes-256-gcm", PortPassword: map[string][3]string{}}
+	netTcp, netUdp = "tcp", "udp"
+	port := freePort(t)
+	defer ss.DelTraffic(port)
+
+	if err := addAPIPort(port, [3]string{"foobar"}, "", "", 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	defer removePort(port)
+	waitListening(t, port, true)
+	waitListening(t, port, false)
+	reloadLock.Lock()
+	_, ok := config.PortPassword[port]
+	reloadLock.Unlock()
+	if ok {
+		t.Error("expired port still in config")
+	}
+	apiPorts.Lock()
+	_, ok = apiPorts.m[port]
+	apiPorts.Unlock()
+	if ok {
+		t.Error("expired port still managed")
+	}
+
+	// the timer of a removed port doesn't close the port created again
+	if err := addAPIPort(port, [3]string{"foobar"}, "", "", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	waitListening(t, port, true)
+	apiPorts.Lock()
+	first := apiPorts.m[port]
+	apiPorts.Unlock()
+	if err := removePort(port); err != nil {
+		t.Fatal(err)
+	}
+	if first.timer.Stop() {
+		t.Error("timer of the removed port not stopped")
+	}
+	if err := addAPIPort(port, [3]string{"barfoo"}, "", "", 0); err != nil {
+		t.Fatal(err)
+	}
+	waitPassword(t, port, "barfoo")
+	expireAPIPort(port, first)
+	if _, ok := passwdManager.get(port); !ok {
+		t.Error("port closed by the timer of the removed one")
+	}
+}
@@ -0,0 +1,352 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+// Binding a port may fail temporarily, e.g. when the old process hasn't
+// released the port yet during a restart. Listeners are retried with
+// exponential backoff for config.BindRetry seconds, ports that still can't
+// be bound are reported by the management API.
+
+const (
+	bindRetryDefault = 30 // seconds
+	bindBackoffMin   = 100 * time.Millisecond
+	bindBackoffMax   = 5 * time.Second
+)
+
+type bindState struct {
+	Network  string    `json:"network"`
+	Error    string    `json:"error"`
+	Since    time.Time `json:"since"`
+	Attempts int       `json:"attempts"`
+	Retrying bool      `json:"retrying"`
+}
+
+// binds holds the state of listeners that failed to bind, keyed by
+// network/port. A newer bind attempt of the same port replaces the entry,
+// which stops the older attempt.
+var binds = struct {
+	sync.Mutex
+	m map[string]*bindState
+}{m: make(map[string]*bindState)}
+
+func bindRetryWindow() time.Duration {
+	if config.BindRetry < 0 {
+		return 0
+	}
+	if config.BindRetry == 0 {
+		return bindRetryDefault * time.Second
+	}
+	return time.Duration(config.BindRetry) * time.Second
+}
+
+// retryBind calls listen until it succeeds, the retry window passes, or port
+// is removed or changed in the config. gaveUp is true if binding failed for
+// the whole retry window.
+func retryBind(network, port string, password [3]string, listen func() error) (ok, gaveUp bool) {
+	err := listen()
+	if err == nil {
+		return true, false
+	}
+	key := network + "/" + port
+	st := &bindState{Network: network, Since: time.Now()}
+	binds.Lock()
+	binds.m[key] = st
+	binds.Unlock()
+
+	deadline := st.Since.Add(bindRetryWindow())
+	backoff := bindBackoffMin
+	for {
+		binds.Lock()
+		if binds.m[key] != st {
+			// superseded by a newer attempt on this port
+			binds.Unlock()
+			return false, false
+		}
+		st.Attempts++
+		st.Error = err.Error()
+		st.Retrying = time.Now().Add(backoff).Before(deadline)
+		binds.Unlock()
+		if !st.Retrying {
+			logger.Errorf("error listening %s port %v, giving up: %v", network, port, err)
+			return false, true
+		}
+		logger.Debugf("error listening %s port %v, retry in %v: %v", network, port, backoff, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > bindBackoffMax {
+			backoff = bindBackoffMax
+		}
+		if pw, ok := config.PortPassword[port]; !ok || pw != password {
+			logger.Debugf("stop binding %s port %v as its config changed", network, port)
+			clearBind(network, port, st)
+			return false, false
+		}
+		if err = listen(); err == nil {
+			logger.Infof("listening %s port %v after %d retries", network, port, st.Attempts)
+			clearBind(network, port, st)
+			return true, false
+		}
+	}
+}
+
+// clearBind removes the failure record of network/port if it's still st.
+func clearBind(network, port string, st *bindState) {
+	binds.Lock()
+	if key := network + "/" + port; binds.m[key] == st {
+		delete(binds.m, key)
+	}
+	binds.Unlock()
+}
+
+// forgetBind drops failure records of a port removed from the config.
+func forgetBind(port string) {
+	binds.Lock()
+	delete(binds.m, "tcp/"+port)
+	delete(binds.m, "udp/"+port)
+	binds.Unlock()
+	setBoundPort(port, "")
+}
+
+// A port may have a fallback range in config.PortFallback. If the port can't
+// be bound, the first free port in the range is used instead. boundPorts
+// maps config ports to the port actually listened on in that case.
+var boundPorts = struct {
+	sync.Mutex
+	m map[string]string
+}{m: make(map[string]string)}
+
+// boundPort returns the port actually listened on for the config port.
+func boundPort(port string) string {
+	boundPorts.Lock()
+	defer boundPorts.Unlock()
+	if p, ok := boundPorts.m[port]; ok {
+		return p
+	}
+	return port
+}
+
+func setBoundPort(port, actual string) {
+	boundPorts.Lock()
+	if actual == "" || actual == port {
+		delete(boundPorts.m, port)
+	} else {
+		boundPorts.m[port] = actual
+	}
+	boundPorts.Unlock()
+}
+
+// parsePortRange parses ranges like "9000-9010".
+func parsePortRange(s string) (lo, hi int, err error) {
+	i := strings.Index(s, "-")
+	if i < 0 {
+		return 0, 0, fmt.Errorf("invalid port range %q", s)
+	}
+	lo, err1 := strconv.Atoi(strings.TrimSpace(s[:i]))
+	hi, err2 := strconv.Atoi(strings.TrimSpace(s[i+1:]))
+	if err1 != nil || err2 != nil || lo <= 0 || hi > 65535 || lo > hi {
+		return 0, 0, fmt.Errorf("invalid port range %q", s)
+	}
+	return
+}
+
+// bindFallback tries the fallback range of port, listen is called with each
+// candidate port until it succeeds. A port already chosen by the other
+// network (TCP or UDP) is tried first, so both listen on the same port.
+func bindFallback(network, port string, listen func(p string) error) bool {
+	r, ok := config.PortFallback[port]
+	if !ok {
+		return false
+	}
+	lo, hi, err := parsePortRange(r)
+	if err != nil {
+		logger.Warnf("fallback of port %s: %v", port, err)
+		return false
+	}
+	if p := boundPort(port); p != port && listen(p) == nil {
+		return true
+	}
+	for i := lo; i <= hi; i++ {
+		p := strconv.Itoa(i)
+		if _, used := config.PortPassword[p]; used {
+			continue
+		}
+		if listen(p) == nil {
+			logger.Infof("%s port %s bound on fallback port %s", network, port, p)
+			setBoundPort(port, p)
+			binds.Lock()
+			delete(binds.m, network+"/"+port)
+			binds.Unlock()
+			return true
+		}
+	}
+	logger.Errorf("no free fallback port for %s port %s in %s", network, port, r)
+	return false
+}
+
+// checkReusePort checks the reuseport option of c.
+func checkReusePort(c *ss.Config) error {
+	if c.ReusePort < 0 {
+		return errors.New("reuseport must not be negative")
+	}
+	if c.ReusePort > 1 {
+		return ss.CheckReusePort()
+	}
+	return nil
+}
+
+// listenAddrs returns the addresses port listens on when bound on p, port
+// itself or its fallback or rotated port: all addresses by default, or
+// those of port_listen, where the addresses without port or with port move
+// to p. Unix sockets are kept.
+func listenAddrs(port, p string) []string {
+	addrs := config.PortListen[port]
+	if len(addrs) == 0 {
+		return []string{":" + p}
+	}
+	bound := make([]string, len(addrs))
+	for i, addr := range addrs {
+		if isUnixAddr(addr) {
+			bound[i] = addr
+			continue
+		}
+		host, ap, err := net.SplitHostPort(addr)
+		if err != nil {
+			// a host without port
+			host, ap = strings.Trim(addr, "[]"), ""
+		}
+		if ap == "" || ap == port {
+			ap = p
+		}
+		bound[i] = net.JoinHostPort(host, ap)
+	}
+	return bound
+}
+
+// checkPortListen checks the port_listen option of c.
+func checkPortListen(c *ss.Config) error {
+	for port, addrs := range c.PortListen {
+		if len(addrs) == 0 {
+			return fmt.Errorf("port_listen: port %s has no addresses", port)
+		}
+		for _, addr := range addrs {
+			if isUnixAddr(addr) {
+				if addr == unixPrefix {
+					return fmt.Errorf("port_listen: port %s: unix socket without path", port)
+				}
+				continue
+			}
+			host, p, err := net.SplitHostPort(addr)
+			if err != nil {
+				host = strings.Trim(addr, "[]")
+			} else if n, err := strconv.Atoi(p); err != nil || n <= 0 || n > 65535 {
+				return fmt.Errorf("port_listen: port %s: invalid port in %s", port, addr)
+			}
+			if host != "" && net.ParseIP(strings.Split(host, "%")[0]) == nil {
+				return fmt.Errorf("port_listen: port %s: %s is not an IP address", port, addr)
+			}
+		}
+	}
+	return nil
+}
+
+// listenTCP listens for the TCP relays of port, on a UDP port with the quic
+// and kcp transports, or on the socket passed by systemd for it. With
+// port_listen it listens on each address, accepting from all of them. The
+// listeners are created by newListener.
+func listenTCP(port string, password [3]string) (ln net.Listener, ok bool) {
+	listen := func(p string) (err error) {
+		if len(config.PortListen[port]) == 0 && !ss.OverUDP(config.TransportOf(port)) {
+			if ln, err = activatedListener(p); ln != nil || err != nil {
+				return
+			}
+		}
+		var lns []net.Listener
+		for _, addr := range listenAddrs(port, p) {
+			l, err := newListener(port, password, addr)
+			if err != nil {
+				for _, l := range lns {
+					l.Close()
+				}
+				return err
+			}
+			lns = append(lns, l)
+		}
+		ln = ss.MultiListener(lns)
+		return nil
+	}
+	if _, rotating := config.PortRotate[port]; rotating {
+		ok = bindRotated("tcp", port, listen)
+		return
+	}
+	ok, gaveUp := retryBind("tcp", port, password, func() error { return listen(port) })
+	if ok {
+		setBoundPort(port, "")
+	} else if gaveUp {
+		ok = bindFallback("tcp", port, listen)
+	}
+	return
+}
+
+// listenUDP listens for the UDP relay of port, on each address of
+// port_listen if it has some, but unix sockets.
+func listenUDP(port string, password [3]string) (conns []*net.UDPConn, ok bool) {
+	listen := func(p string) error {
+		conns = nil
+		if len(config.PortListen[port]) == 0 {
+			conn, err := activatedUDP(p)
+			if err != nil {
+				return err
+			}
+			if conn != nil {
+				conns = []*net.UDPConn{conn}
+				return nil
+			}
+		}
+		for _, addr := range listenAddrs(port, p) {
+			if isUnixAddr(addr) {
+				continue
+			}
+			network := ss.ListenNetwork(netUdp, addr)
+			udpAddr, err := net.ResolveUDPAddr(network, addr)
+			var conn *net.UDPConn
+			if err == nil {
+				conn, err = net.ListenUDP(network, udpAddr)
+			}
+			if err != nil {
+				for _, c := range conns {
+					c.Close()
+				}
+				conns = nil
+				return err
+			}
+			conns = append(conns, conn)
+		}
+		return nil
+	}
+	if _, rotating := config.PortRotate[port]; rotating {
+		// listen on the port TCP is rotated to
+		p := boundPort(port)
+		ok, _ = retryBind("udp", port, password, func() error { return listen(p) })
+		return
+	}
+	if p := boundPort(port); p != port {
+		// TCP is already on a fallback port, listen on the same one
+		if ok = bindFallback("udp", port, listen); ok {
+			return
+		}
+	}
+	ok, gaveUp := retryBind("udp", port, password, func() error { return listen(port) })
+	if !ok && gaveUp {
+		ok = bindFallback("udp", port, listen)
+	}
+	return
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+// The -bench option measures how fast every method encrypts on this CPU
+// and runs their known-answer tests, to pick a method and catch a broken
+// build. With AES hardware acceleration, the measure is repeated without
+// it in a child process, as aes-gcm is fast only with it:
+//
+//	shadowsocks-server -bench
+
+const benchTime = 200 * time.Millisecond
+
+// benchNoAES turns the AES instructions off in Go's crypto and in
+// ss.AESHardware.
+const benchNoAES = "cpu.aes=off,cpu.pclmulqdq=off"
+
+// cipherBench runs the -bench option and returns the exit status.
+func cipherBench() int {
+	failed := 0
+	if err := ss.KeyDerivationSelfTest(); err != nil {
+		fmt.Println("FAIL key derivation:", err)
+		failed++
+	}
+	hw := ss.AESHardware()
+	if hw {
+		fmt.Println("AES hardware acceleration: yes")
+	} else {
+		fmt.Println("AES hardware acceleration: no")
+	}
+	fmt.Printf("%-24s %10s  %s\n", "method", "MB/s", "self-test")
+	for _, method := range ss.CipherMethods() {
+		speed := "-"
+		if bps, err := ss.CipherThroughput(method, benchTime); err == nil {
+			speed = fmt.Sprintf("%.1f", bps/1e6)
+		}
+		result := "ok"
+		if err := ss.CipherSelfTest(method); err == ss.ErrNoKAT {
+			result = "-"
+		} else if err != nil {
+			result = "FAIL: " + err.Error()
+			failed++
+		}
+		fmt.Printf("%-24s %10s  %s\n", method, speed, result)
+	}
+	if hw && !strings.Contains(os.Getenv("GODEBUG"), benchNoAES) {
+		fmt.Println()
+		if err := benchWithoutAES(); err != nil {
+			fmt.Println("FAIL measuring without AES hardware acceleration:", err)
+			failed++
+		}
+	}
+	if failed != 0 {
+		return 1
+	}
+	return 0
+}
+
+// benchWithoutAES runs the command again with the AES instructions turned
+// off, its arguments are the same in shadowsocks-server and in the
+// shadowsocks server subcommand.
+func benchWithoutAES() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	godebug := benchNoAES
+	if v := os.Getenv("GODEBUG"); v != "" {
+		godebug = v + "," + godebug
+	}
+	cmd.Env = append(os.Environ(), "GODEBUG="+godebug)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	return cmd.Run()
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"net/http"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+// logAutoMethod logs the method chosen for "auto" and why.
+func logAutoMethod() {
+	if ss.AESHardware() {
+		logger.Infof("method auto is %s, the CPU accelerates AES", ss.AutoMethod())
+	} else {
+		logger.Infof("method auto is %s, the CPU doesn't accelerate AES", ss.AutoMethod())
+	}
+}
+
+type cryptoInfo struct {
+	AESHardware bool   `json:"aes_hardware"`
+	AutoMethod  string `json:"auto_method"`
+	// methods in use by port
+	Methods map[string]string `json:"methods"`
+}
+
+// GET /crypto returns whether the CPU accelerates AES, the method chosen
+// for "auto", and the methods of the ports in scope.
+func handleCrypto(w http.ResponseWriter, r *http.Request) {
+	sc := scope(r)
+	if sc == "" {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+	info := cryptoInfo{AESHardware: ss.AESHardware(), AutoMethod: ss.AutoMethod(), Methods: make(map[string]string)}
+	reloadLock.Lock()
+	for port := range config.PortPassword {
+		if inScope(sc, port) {
+			info.Methods[port] = config.MethodOf(port)
+		}
+	}
+	reloadLock.Unlock()
+	writeJSON(w, info)
+}
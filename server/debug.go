@@ -0,0 +1,159 @@
+package server
+
+import (
+	"expvar"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+// With debug_address, the server serves runtime profiles, the expvar
+// counters and the relayed connections over HTTP for troubleshooting. If
+// manager_token is set, requests must carry it like those of the management
+// API.
+
+func init() {
+	expvar.Publish("goroutines", expvar.Func(func() interface{} { return runtime.NumGoroutine() }))
+}
+
+// liveConns are the connections relayed, tracked while there's a debug
+// endpoint.
+var liveConns = struct {
+	sync.Mutex
+	m map[*liveConn]bool
+}{m: make(map[*liveConn]bool)}
+
+// liveConn is a relayed connection, up and down count the bytes sent to and
+// received from the destination.
+type liveConn struct {
+	id, port, user string
+	client, target string
+	remote         string // address of target connected to
+	start          time.Time
+	up, down       int64 // operate by sync/atomic
+}
+
+// trackedConn counts the traffic of the connection to the destination of
+// a relayed connection.
+type trackedConn struct {
+	net.Conn
+	lc *liveConn
+}
+
+func (c *trackedConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	atomic.AddInt64(&c.lc.down, int64(n))
+	return
+}
+
+func (c *trackedConn) Write(b []byte) (n int, err error) {
+	n, err = c.Conn.Write(b)
+	atomic.AddInt64(&c.lc.up, int64(n))
+	return
+}
+
+func (c *trackedConn) CloseWrite() error {
+	return ss.CloseWrite(c.Conn)
+}
+
+// trackConn lists the relay of client to target, host, for /connections
+// if there's a debug endpoint, and returns target to relay to, counting its
+// traffic. Call done when the relay ends.
+func trackConn(id, port, user string, client, target net.Conn, host string) (_ net.Conn, done func()) {
+	if config.DebugAddress == "" {
+		return target, func() {}
+	}
+	lc := &liveConn{
+		id:     id,
+		port:   port,
+		user:   user,
+		client: client.RemoteAddr().String(),
+		target: host,
+		remote: target.RemoteAddr().String(),
+		start:  time.Now(),
+	}
+	liveConns.Lock()
+	liveConns.m[lc] = true
+	liveConns.Unlock()
+	return &trackedConn{target, lc}, func() {
+		liveConns.Lock()
+		delete(liveConns.m, lc)
+		liveConns.Unlock()
+	}
+}
+
+type connInfo struct {
+	ID     string `json:"id"`
+	Port   string `json:"port"`
+	User   string `json:"user,omitempty"`
+	Client string `json:"client"`
+	Target string `json:"target"`
+	Remote string `json:"remote"`
+	Start  string `json:"start"`
+	Age    int64  `json:"age"` // seconds
+	Up     int64  `json:"up"`
+	Down   int64  `json:"down"`
+}
+
+// GET /connections returns the relayed connections, oldest first, only
+// those of a port with ?port=.
+func handleConnections(w http.ResponseWriter, r *http.Request) {
+	port := r.URL.Query().Get("port")
+	now := time.Now()
+	conns := []connInfo{}
+	liveConns.Lock()
+	for lc := range liveConns.m {
+		if port != "" && lc.port != port {
+			continue
+		}
+		conns = append(conns, connInfo{
+			ID:     lc.id,
+			Port:   lc.port,
+			User:   lc.user,
+			Client: lc.client,
+			Target: lc.target,
+			Remote: lc.remote,
+			Start:  lc.start.Format(time.RFC3339),
+			Age:    int64(now.Sub(lc.start) / time.Second),
+			Up:     atomic.LoadInt64(&lc.up),
+			Down:   atomic.LoadInt64(&lc.down),
+		})
+	}
+	liveConns.Unlock()
+	sort.Slice(conns, func(i, j int) bool { return conns[i].Age > conns[j].Age })
+	writeJSON(w, conns)
+}
+
+// debugAuth allows requests to h only with the admin token, if there's one.
+func debugAuth(h http.Handler) http.Handler {
+	admin := adminOnly(h)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if config.ManagerToken == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		admin.ServeHTTP(w, r)
+	})
+}
+
+func runDebug(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/connections", handleConnections)
+	logger.Infof("debug endpoint listening at %s ...", addr)
+	if err := http.ListenAndServe(addr, debugAuth(mux)); err != nil {
+		logger.Error("debug endpoint:", err)
+	}
+}
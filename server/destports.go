@@ -0,0 +1,52 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+// The dest_ports rules restrict the destination ports clients of each port,
+// or each user of a port, may connect to, e.g. only web ports, or not SMTP
+// to keep spammers away.
+
+var errPortDest = errors.New("destination port not allowed")
+
+// checkDestPorts checks the dest_ports rules of c.
+func checkDestPorts(c *ss.Config) error {
+	for port, r := range c.DestPorts {
+		if r == nil {
+			continue
+		}
+		if err := r.Check(); err != nil {
+			return fmt.Errorf("dest_ports of port %s: %v", port, err)
+		}
+	}
+	return nil
+}
+
+// destPortRule returns the rule of port, or the rule of "*" if it has none.
+func destPortRule(port string) *ss.DestPortRule {
+	if r, ok := config.DestPorts[port]; ok {
+		return r
+	}
+	return config.DestPorts["*"]
+}
+
+// allowDestPort reports whether user, empty if the port isn't shared, of
+// server port srvPort may connect to port.
+func allowDestPort(srvPort, user, port string) bool {
+	r := destPortRule(srvPort)
+	if r == nil {
+		return true
+	}
+	n, err := strconv.Atoi(port)
+	return err == nil && r.Of(user).Allows(n)
+}
+
+// allowUDPDestPort is the destination port policy of the UDP relay.
+func allowUDPDestPort(srvPort, ip, port string) bool {
+	return allowDestPort(srvPort, "", port)
+}
@@ -0,0 +1,239 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+// Destination hostnames are looked up with the caching resolver, then the
+// addresses are raced, see dialRace. The destination policy is checked in
+// the dialer's Control hook, which sees the IP of each connection attempt,
+// and binds the socket to the outbound interface.
+
+var errIllegalDest = errors.New("illegal connect to local network")
+
+var errCountryDest = errors.New("destination country not allowed")
+
+var errACLDest = errors.New("destination not allowed by acl")
+
+var systemResolver, _ = ss.NewResolver(nil, 0, dnsGoroutineNum)
+
+// dns is the resolver of destination hostnames, set from the dns_server,
+// dns_servers and dns_cache_size options.
+var dns = struct {
+	sync.Mutex
+	r   *ss.Resolver
+	key string // options r was made from
+}{r: systemResolver}
+
+// setResolver replaces the resolver with one for the options of c, unless
+// they haven't changed, which keeps the cache.
+func setResolver(c *ss.Config) error {
+	var upstreams []string
+	if c.DNSServer != "" {
+		upstreams = append(upstreams, c.DNSServer)
+	}
+	upstreams = append(upstreams, c.DNSServers...)
+	key := fmt.Sprint(upstreams, c.DNSCacheSize)
+	dns.Lock()
+	defer dns.Unlock()
+	if key == dns.key {
+		return nil
+	}
+	r, err := ss.NewResolver(upstreams, c.DNSCacheSize, dnsGoroutineNum)
+	if err != nil {
+		return err
+	}
+	dns.r, dns.key = r, key
+	return nil
+}
+
+func resolver() *ss.Resolver {
+	dns.Lock()
+	defer dns.Unlock()
+	return dns.r
+}
+
+// resolveUDPDest looks up the destination of a datagram of the UDP relay
+// on server port srvPort, returning the address of the preferred family.
+func resolveUDPDest(srvPort, domain string) (*net.IPAddr, error) {
+	if strings.IndexByte(domain, '%') >= 0 {
+		// link-local IPv6 address with zone
+		return net.ResolveIPAddr("ip", domain)
+	}
+	ips, err := lookupDest(context.Background(), srvPort, domain)
+	if err != nil {
+		return nil, err
+	}
+	return &net.IPAddr{IP: ips[0]}, nil
+}
+
+// lookupDest returns the addresses of host, which may be an IP address, to
+// try for server port srvPort. Looking up a hostname is traced in the trace
+// of ctx.
+func lookupDest(ctx context.Context, srvPort, host string) ([]net.IP, error) {
+	var span *ss.Span
+	if net.ParseIP(host) == nil {
+		_, span = ss.StartSpan(ctx, "resolve", ss.SpanInternal)
+		span.SetAttr("dns.question.name", host)
+		defer span.End()
+	}
+	ips, err := resolver().LookupIP(context.Background(), host)
+	if err != nil {
+		span.SetError(err)
+		return nil, err
+	}
+	pref := ipPreferenceOf(srvPort)
+	if ip := ss.OutboundIP(); ip != nil {
+		// the source address can only reach its own family
+		if ip.To4() != nil {
+			pref = ipv4Only
+		} else {
+			pref = ipv6Only
+		}
+	}
+	if ips = orderAddrs(ips, pref); len(ips) == 0 {
+		return nil, &net.AddrError{Err: "no address of the family allowed by ip_preference or outbound_bind", Addr: host}
+	}
+	return ips, nil
+}
+
+// destPolicy decides which destinations clients may connect to, set from the
+// dest_policy, dest_deny and dest_allow options.
+var destPolicy = struct {
+	sync.Mutex
+	p *ss.DestPolicy
+}{p: ss.LegacyDestPolicy}
+
+// setDestPolicy replaces the destination policy with the one of c.
+func setDestPolicy(c *ss.Config) error {
+	p, err := ss.NewDestPolicy(c.DestPolicy, c.DestDeny, c.DestAllow)
+	if err != nil {
+		return err
+	}
+	destPolicy.Lock()
+	destPolicy.p = p
+	destPolicy.Unlock()
+	return nil
+}
+
+// allowDest reports whether connecting to ip:port, resolved from domain if
+// it's not empty, is permitted by the destination policy.
+func allowDest(domain, ip, port, openvpn string) bool {
+	destPolicy.Lock()
+	p := destPolicy.p
+	destPolicy.Unlock()
+	return p.Allow(domain, net.ParseIP(ip), port, openvpn == "ok")
+}
+
+// testTargetKey is the context key of the loopback echo server of a health
+// check or self test, which its own connection may reach past the
+// destination checks.
+type testTargetKey struct{}
+
+// withTestTarget returns ctx letting its connection reach addr, an ip:port.
+func withTestTarget(ctx context.Context, addr string) context.Context {
+	return context.WithValue(ctx, testTargetKey{}, addr)
+}
+
+// isTestTarget reports whether addr is the test target of the connection of
+// ctx.
+func isTestTarget(ctx context.Context, addr string) bool {
+	t, _ := ctx.Value(testTargetKey{}).(string)
+	return t != "" && t == addr
+}
+
+// checkDest returns why connecting to ip:port, resolved from domain if it's
+// not empty, for server port srvPort isn't allowed by the destination
+// policy, GeoIP rule or ACL, nil if it is.
+func checkDest(srvPort, domain, ip, port, openvpn string) error {
+	if i := strings.IndexByte(ip, '%'); i >= 0 {
+		ip = ip[:i] // zone of link-local IPv6 address
+	}
+	if !allowDest(domain, ip, port, openvpn) {
+		return errIllegalDest
+	}
+	if !allowCountry(srvPort, net.ParseIP(ip)) {
+		return errCountryDest
+	}
+	if !allowACL(domain, net.ParseIP(ip)) {
+		return errACLDest
+	}
+	return nil
+}
+
+// dialDest connects to host:port for server port srvPort, checking each
+// resolved address against the destination policy, GeoIP rule and ACL.
+// Through the forward proxy, which resolves hostnames itself, only IP
+// address destinations are checked. The lookup and the connection are
+// traced in the trace of ctx.
+func dialDest(ctx context.Context, srvPort, host, port, openvpn string) (conn net.Conn, err error) {
+	domain := host
+	if net.ParseIP(host) != nil {
+		domain = ""
+	} else if rejectACLDomain(domain) {
+		return nil, errACLDest
+	}
+	// test targets are loopback echo servers the upstream can't reach
+	if fd := forwarder(); fd != nil && !isTestTarget(ctx, net.JoinHostPort(host, port)) {
+		if domain == "" || strings.IndexByte(host, '%') >= 0 {
+			if err := checkDest(srvPort, "", host, port, openvpn); err != nil {
+				return nil, err
+			}
+		}
+		_, span := ss.StartSpan(ctx, "dial", ss.SpanClient)
+		span.SetAttr("server.address", net.JoinHostPort(host, port))
+		span.SetAttr("ss.forward", true)
+		conn, err = fd.DialContext(context.Background(), "tcp", net.JoinHostPort(host, port))
+		span.SetError(err)
+		span.End()
+		return
+	}
+	d := &net.Dialer{
+		Control: func(network, address string, c syscall.RawConn) error {
+			ip, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if isTestTarget(ctx, address) {
+				return nil
+			}
+			if err = checkDest(srvPort, domain, ip, port, openvpn); err != nil {
+				return err
+			}
+			return ss.OutboundControl(network, address, c)
+		},
+	}
+	d.SetMultipathTCP(ss.MPTCP())
+	if ip := ss.OutboundIP(); ip != nil {
+		d.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+	var ips []net.IP
+	if strings.IndexByte(host, '%') < 0 {
+		if ips, err = lookupDest(ctx, srvPort, host); err != nil {
+			return nil, err
+		}
+	}
+	_, span := ss.StartSpan(ctx, "dial", ss.SpanClient)
+	span.SetAttr("server.address", net.JoinHostPort(host, port))
+	defer func() {
+		if conn != nil {
+			ss.ApplyTCPOptions(conn)
+			span.SetAttr("network.peer.address", conn.RemoteAddr().String())
+		}
+		span.SetError(err)
+		span.End()
+	}()
+	if ips == nil {
+		// link-local IPv6 address with zone
+		return d.Dial("tcp", net.JoinHostPort(host, port))
+	}
+	return dialRace(d, ips, port)
+}
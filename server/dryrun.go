@@ -0,0 +1,180 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+type effectivePort struct {
+	Port       string           `json:"port"`
+	Tenant     string           `json:"tenant,omitempty"`
+	Method     string           `json:"method"`
+	Transport  string           `json:"transport"`
+	Password   string           `json:"password"`
+	OpenVPN    bool             `json:"openvpn"`
+	UDP        bool             `json:"udp"`
+	UDPTimeout int              `json:"udp_timeout,omitempty"`
+	IPPref     string           `json:"ip_preference"`
+	GeoIP      *ss.GeoIPRule    `json:"geoip,omitempty"`
+	DestPorts  *ss.DestPortRule `json:"dest_ports,omitempty"`
+	Users      []string         `json:"users,omitempty"` // ids of users sharing the port
+	// limits, left out if there's none
+	QuotaGB    float64 `json:"quota_gb,omitempty"`
+	SpeedLimit float64 `json:"speed_limit_mbps,omitempty"`
+	MaxConns   int     `json:"max_connections,omitempty"`
+}
+
+type effectiveConfig struct {
+	ConfigFile    string           `json:"config_file"`
+	ConfDir       string           `json:"conf_dir,omitempty"`
+	Method        string           `json:"method"`
+	Timeout       int              `json:"timeout"`
+	UDPTimeout    int              `json:"udp_timeout"`
+	UDPNATMax     int              `json:"udp_nat_max"`
+	UDPNATEvict   string           `json:"udp_nat_evict"`
+	UDPMaxSize    int              `json:"udp_max_size"`
+	Net           string           `json:"net"`
+	UDP           bool             `json:"udp"`
+	Transport     string           `json:"transport"`
+	WSPath        string           `json:"ws_path,omitempty"`
+	HandshakeRate int              `json:"handshake_rate"`
+	DrainTimeout  int              `json:"drain_timeout"`
+	Shutdown      int              `json:"shutdown_timeout"`
+	Tarpit        bool             `json:"tarpit"`
+	DestPolicy    string           `json:"dest_policy"`
+	OutboundBind  string           `json:"outbound_bind,omitempty"`
+	OutboundIface string           `json:"outbound_interface,omitempty"`
+	Forward       string           `json:"forward,omitempty"`
+	ProbeLog      string           `json:"probe_log,omitempty"`
+	AccessLog     string           `json:"access_log,omitempty"`
+	Manager       string           `json:"manager_address,omitempty"`
+	Debug         string           `json:"debug_address,omitempty"`
+	TrafficFile   string           `json:"traffic_file,omitempty"`
+	Webhook       string           `json:"traffic_webhook,omitempty"`
+	Trace         string           `json:"trace_endpoint,omitempty"`
+	Ports         []*effectivePort `json:"ports"`
+}
+
+// maskPassword hides all but the first and last character.
+func maskPassword(s string) string {
+	if len(s) <= 2 {
+		return strings.Repeat("*", len(s))
+	}
+	return s[:1] + strings.Repeat("*", len(s)-2) + s[len(s)-1:]
+}
+
+// transportName returns the name of transport, "" being tcp.
+func transportName(transport string) string {
+	if transport == "" {
+		return ss.TransportTCP
+	}
+	return transport
+}
+
+// userIDs returns the sorted ids of users.
+func userIDs(users map[string]string) []string {
+	ids := make([]string, 0, len(users))
+	for id := range users {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// printEffectiveConfig writes the configuration the server would run with
+// after merging config file, conf.d fragments and command line options.
+func printEffectiveConfig(w io.Writer) error {
+	ec := &effectiveConfig{
+		ConfigFile:    configFile,
+		ConfDir:       config.ConfDir,
+		Method:        config.Method,
+		Timeout:       config.Timeout,
+		UDPTimeout:    config.UDPTimeout,
+		UDPNATMax:     config.UDPNATMax,
+		UDPNATEvict:   config.UDPNATEvict,
+		UDPMaxSize:    config.UDPMaxSize,
+		Net:           netTcp,
+		UDP:           udp,
+		Transport:     config.Transport,
+		HandshakeRate: config.HandshakeRate,
+		DrainTimeout:  config.DrainTimeout,
+		Shutdown:      config.ShutdownTimeout,
+		Tarpit:        config.Tarpit,
+		DestPolicy:    config.DestPolicy,
+		OutboundBind:  config.OutboundBind,
+		OutboundIface: config.OutboundInterface,
+		Forward:       redactURL(config.Forward),
+		ProbeLog:      config.ProbeLog,
+		AccessLog:     config.AccessLog,
+		Manager:       config.ManagerAddress,
+		Debug:         config.DebugAddress,
+		TrafficFile:   config.TrafficFile,
+		Webhook:       redactURL(config.TrafficWebhook),
+		Trace:         redactURL(config.TraceEndpoint),
+	}
+	if ec.UDPTimeout == 0 {
+		ec.UDPTimeout = 120
+	}
+	if ec.DrainTimeout == 0 {
+		ec.DrainTimeout = int(defaultDrainTimeout / time.Second)
+	}
+	if ec.Shutdown <= 0 {
+		ec.Shutdown = int(defaultShutdownTimeout / time.Second)
+	}
+	if ec.UDPMaxSize == 0 {
+		ec.UDPMaxSize = 65535
+	}
+	if ec.UDPNATEvict == "" {
+		ec.UDPNATEvict = ss.NATEvictLRU
+	}
+	if ec.DestPolicy == "" {
+		ec.DestPolicy = "legacy"
+	}
+	ec.Transport = transportName(ec.Transport)
+	if used := config.Transports(); used[ss.TransportWS] || used[ss.TransportWSS] {
+		ec.WSPath = config.WSPath
+	}
+	ports := make([]string, 0, len(config.PortPassword))
+	for port := range config.PortPassword {
+		ports = append(ports, port)
+	}
+	sort.Strings(ports)
+	for _, port := range ports {
+		passwd := config.PortPassword[port]
+		udpTimeout := 0
+		if udp && passwd[2] == "ok" {
+			udpTimeout = ec.UDPTimeout
+			if sec, ok := config.PortUDPTimeout[port]; ok {
+				udpTimeout = sec
+			}
+		}
+		ec.Ports = append(ec.Ports, &effectivePort{
+			Port:       port,
+			Tenant:     config.TenantOf(port),
+			Method:     config.MethodOf(port),
+			Transport:  transportName(config.TransportOf(port)),
+			Password:   maskPassword(passwd[0]),
+			OpenVPN:    passwd[1] == "ok",
+			UDP:        udp && passwd[2] == "ok",
+			UDPTimeout: udpTimeout,
+			IPPref:     ipPreferenceOf(port),
+			GeoIP:      geoIPRule(port),
+			DestPorts:  destPortRule(port),
+			Users:      userIDs(config.PortUsers[port]),
+			QuotaGB:    config.PortQuota[port],
+			SpeedLimit: speedLimitOf(port),
+			MaxConns:   maxConnsOf(port),
+		})
+	}
+	data, err := json.MarshalIndent(ec, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
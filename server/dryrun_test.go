@@ -0,0 +1,57 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+func TestPrintEffectiveConfig(t *testing.T) {
+	saved, savedUDP := config, udp
+	defer func() { config, udp = saved, savedUDP }()
+	udp = true
+	config = &ss.Config{
+		Method: "aes-256-gcm",
+		PortPassword: map[string][3]string{
+			"8388": {"barfoo", "", "ok"},
+			"8389": {"foobar", "", ""},
+		},
+		PortQuota:          map[string]float64{"8388": 100},
+		SpeedLimit:         10,
+		PortSpeedLimit:     map[string]float64{"8389": 2.5},
+		MaxConnections:     1000,
+		PortMaxConnections: map[string]int{"8389": 0},
+	}
+
+	var buf bytes.Buffer
+	if err := printEffectiveConfig(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var ec effectiveConfig
+	if err := json.Unmarshal(buf.Bytes(), &ec); err != nil {
+		t.Fatal(err)
+	}
+	if len(ec.Ports) != 2 {
+		t.Fatalf("printed %d ports, want 2", len(ec.Ports))
+	}
+	want := []effectivePort{
+		{Port: "8388", Password: "b****o", UDP: true, UDPTimeout: 120, QuotaGB: 100, SpeedLimit: 10, MaxConns: 1000},
+		{Port: "8389", Password: "f****r", SpeedLimit: 2.5},
+	}
+	for i, w := range want {
+		p := ec.Ports[i]
+		if p.Port != w.Port || p.Password != w.Password || p.UDP != w.UDP || p.UDPTimeout != w.UDPTimeout ||
+			p.QuotaGB != w.QuotaGB || p.SpeedLimit != w.SpeedLimit || p.MaxConns != w.MaxConns {
+			t.Errorf("port %d printed as %+v, want %+v", i, *p, w)
+		}
+	}
+	// no limit is left out
+	if bytes.Contains(buf.Bytes(), []byte(`"quota_gb": 0`)) || bytes.Contains(buf.Bytes(), []byte(`"max_connections": 0`)) {
+		t.Errorf("printed limits of 0:\n%s", buf.Bytes())
+	}
+	if !bytes.Contains(buf.Bytes(), []byte(`"quota_gb": 100`)) {
+		t.Errorf("quota not printed:\n%s", buf.Bytes())
+	}
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+// Destinations with several addresses are dialed the Happy Eyeballs way
+// (RFC 8305): the address families alternate, starting with the preferred
+// one, and a new attempt starts when the previous one fails or hasn't
+// connected within connAttemptDelay. The first connection wins.
+
+// connAttemptDelay is the recommended Connection Attempt Delay of RFC 8305.
+const connAttemptDelay = 250 * time.Millisecond
+
+// Values of the ip_preference and port_ip_preference options.
+const (
+	preferIPv6 = "prefer_ipv6" // the default
+	preferIPv4 = "prefer_ipv4"
+	ipv4Only   = "ipv4_only"
+	ipv6Only   = "ipv6_only"
+)
+
+// checkIPPreference checks the ip_preference options of c.
+func checkIPPreference(c *ss.Config) error {
+	check := func(pref string) error {
+		switch pref {
+		case "", preferIPv6, preferIPv4, ipv4Only, ipv6Only:
+			return nil
+		}
+		return fmt.Errorf("unknown ip preference %s", pref)
+	}
+	if err := check(c.IPPreference); err != nil {
+		return err
+	}
+	for port, pref := range c.PortIPPreference {
+		if err := check(pref); err != nil {
+			return fmt.Errorf("port %s: %v", port, err)
+		}
+	}
+	return nil
+}
+
+// ipPreferenceOf returns the address family preference of port.
+func ipPreferenceOf(port string) string {
+	if pref, ok := config.PortIPPreference[port]; ok && pref != "" {
+		return pref
+	}
+	if config.IPPreference != "" {
+		return config.IPPreference
+	}
+	return preferIPv6
+}
+
+// orderAddrs returns ips in the order to try them with pref: alternating
+// families starting with the preferred one, or only the addresses of one
+// family.
+func orderAddrs(ips []net.IP, pref string) []net.IP {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	first, second := v6, v4
+	switch pref {
+	case ipv4Only:
+		return v4
+	case ipv6Only:
+		return v6
+	case preferIPv4:
+		first, second = v4, v6
+	}
+	ordered := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			ordered = append(ordered, first[i])
+		}
+		if i < len(second) {
+			ordered = append(ordered, second[i])
+		}
+	}
+	return ordered
+}
+
+// dialRace connects to port of the first of ips accepting the connection,
+// staggering the attempts by connAttemptDelay. It returns the error of the
+// first attempt if they all fail.
+func dialRace(d *net.Dialer, ips []net.IP, port string) (net.Conn, error) {
+	if len(ips) == 1 {
+		return d.Dial("tcp", net.JoinHostPort(ips[0].String(), port))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	type result struct {
+		conn net.Conn
+		err  error
+		i    int
+	}
+	results := make(chan result)
+	errs := make([]error, len(ips))
+	next, pending := 0, 0
+	start := time.Now()
+	for {
+		var delay <-chan time.Time
+		if next < len(ips) {
+			delay = time.After(time.Until(start))
+		} else if pending == 0 {
+			for _, err := range errs {
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		select {
+		case <-delay:
+			go func(i int) {
+				conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(ips[i].String(), port))
+				results <- result{conn, err, i}
+			}(next)
+			next++
+			pending++
+			start = time.Now().Add(connAttemptDelay)
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// the attempts still running are canceled, close the
+				// connections of those that win anyway
+				go func(n int) {
+					for ; n > 0; n-- {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			errs[r.i] = r.err
+			// don't wait for the delay to try the next address
+			start = time.Now()
+		}
+	}
+}
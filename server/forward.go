@@ -0,0 +1,92 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+	"golang.org/x/net/proxy"
+)
+
+// With the forward option, connections to destinations go through an
+// upstream SOCKS5 or shadowsocks server, which resolves their hostnames.
+
+// forward is the upstream proxy of outbound connections, nil to connect
+// directly, set from the forward option.
+var forward = struct {
+	sync.Mutex
+	d   proxy.ContextDialer
+	url string
+}{}
+
+// outboundDialer connects to the upstream proxy from the outbound_bind
+// address and interface.
+type outboundDialer struct{}
+
+func (outboundDialer) Dial(network, addr string) (net.Conn, error) {
+	return outboundDialer{}.DialContext(context.Background(), network, addr)
+}
+
+func (outboundDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d := &net.Dialer{Control: ss.OutboundControl}
+	if ip := ss.OutboundIP(); ip != nil {
+		d.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+	return d.DialContext(ctx, network, addr)
+}
+
+// setForward sets the upstream proxy from the forward option of c,
+// socks5://[user:pass@]host:port or ss://method:password@host:port.
+func setForward(c *ss.Config) error {
+	forward.Lock()
+	defer forward.Unlock()
+	if c.Forward == forward.url {
+		return nil
+	}
+	if c.Forward == "" {
+		forward.d, forward.url = nil, ""
+		return nil
+	}
+	u, err := url.Parse(c.Forward)
+	if err != nil {
+		return fmt.Errorf("forward: %v", err)
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h", "ss":
+	default:
+		return fmt.Errorf("forward %s: unknown scheme %s", redactURL(c.Forward), u.Scheme)
+	}
+	d, err := proxy.FromURL(u, outboundDialer{})
+	if err != nil {
+		return fmt.Errorf("forward %s: %v", redactURL(c.Forward), err)
+	}
+	cd, ok := d.(proxy.ContextDialer)
+	if !ok {
+		return fmt.Errorf("forward %s: dialer can't be canceled", redactURL(c.Forward))
+	}
+	forward.d, forward.url = cd, c.Forward
+	return nil
+}
+
+// forwarder returns the upstream proxy, nil if there's none.
+func forwarder() proxy.ContextDialer {
+	forward.Lock()
+	defer forward.Unlock()
+	return forward.d
+}
+
+// redactURL hides the password in the URL s, and the userinfo of ss:// URLs
+// where it's base64 encoded.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return s
+	}
+	if _, ok := u.User.Password(); !ok && u.Scheme == "ss" {
+		u.User = url.User("xxxxx")
+	}
+	return u.Redacted()
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+// The GeoIP rules restrict the countries the destinations of each port may
+// be in, e.g. relay operators keep users from connecting back into the
+// server's own country.
+
+var geoIP struct {
+	sync.Mutex
+	path string
+	db   *ss.GeoIP
+}
+
+// setupGeoIP loads the database used by the GeoIP rules of c.
+func setupGeoIP(c *ss.Config) error {
+	if len(c.GeoIPRules) > 0 && c.GeoIPDatabase == "" {
+		return errors.New("geoip_rules need geoip_database")
+	}
+	if err := loadGeoIP(c.GeoIPDatabase); err != nil {
+		return fmt.Errorf("error loading geoip database %s: %v", c.GeoIPDatabase, err)
+	}
+	return nil
+}
+
+// loadGeoIP opens the MaxMind DB at path, unless it's loaded already.
+func loadGeoIP(path string) error {
+	geoIP.Lock()
+	defer geoIP.Unlock()
+	if path == geoIP.path {
+		return nil
+	}
+	var db *ss.GeoIP
+	if path != "" {
+		var err error
+		if db, err = ss.OpenGeoIP(path); err != nil {
+			return err
+		}
+	}
+	geoIP.path, geoIP.db = path, db
+	return nil
+}
+
+// geoIPRule returns the rule of port, or the rule of "*" if it has none.
+func geoIPRule(port string) *ss.GeoIPRule {
+	if r, ok := config.GeoIPRules[port]; ok {
+		return r
+	}
+	return config.GeoIPRules["*"]
+}
+
+// allowCountry reports whether the GeoIP rule of port allows connecting to ip.
+func allowCountry(port string, ip net.IP) bool {
+	r := geoIPRule(port)
+	if r == nil {
+		return true
+	}
+	geoIP.Lock()
+	db := geoIP.db
+	geoIP.Unlock()
+	if db == nil {
+		return true
+	}
+	return r.Allows(db.Country(ip))
+}
+
+// allowUDPCountry is the GeoIP policy of the UDP relay.
+func allowUDPCountry(srvPort, ip, port string) bool {
+	return allowCountry(srvPort, net.ParseIP(ip))
+}
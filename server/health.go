@@ -0,0 +1,135 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+// The health check exercises the whole proxy path in process instead of only
+// checking that ports are listening: every configured cipher is run through
+// an encrypt/decrypt round trip, a test connection is relayed through a
+// temporary loopback port to a loopback echo server, and a canary name is
+// resolved with the destination resolver.
+
+const (
+	healthTimeout       = 5 * time.Second
+	healthCanaryDefault = "example.com"
+)
+
+type componentHealth struct {
+	Status  string  `json:"status"`
+	Latency float64 `json:"latency_ms"`
+	Error   string  `json:"error,omitempty"`
+}
+
+type healthReport struct {
+	Status     string                      `json:"status"`
+	Components map[string]*componentHealth `json:"components"`
+}
+
+func checkComponent(f func() error) *componentHealth {
+	start := time.Now()
+	err := f()
+	ch := &componentHealth{
+		Status:  "ok",
+		Latency: float64(time.Since(start)) / float64(time.Millisecond),
+	}
+	if err != nil {
+		ch.Status, ch.Error = "fail", err.Error()
+	}
+	return ch
+}
+
+// checkCiphers encrypts and decrypts a message with every method in use.
+func checkCiphers() error {
+	methods := map[string]bool{config.Method: true}
+	for port := range config.PortPassword {
+		methods[config.MethodOf(port)] = true
+	}
+	msg := []byte("shadowsocks health check")
+	for method := range methods {
+		password, err := ss.RandomPassword(method)
+		if err != nil {
+			return fmt.Errorf("%s: %v", method, err)
+		}
+		enc, err := ss.NewCipher(method, password)
+		if err != nil {
+			return fmt.Errorf("%s: %v", method, err)
+		}
+		dec := enc.Copy()
+		var out, in bytes.Buffer
+		c := ss.NewConn(&bufConn{w: &out}, enc)
+		if _, err = c.Write(msg); err != nil {
+			return fmt.Errorf("%s: %v", method, err)
+		}
+		in.Write(out.Bytes())
+		c = ss.NewConn(&bufConn{r: &in}, dec)
+		got := make([]byte, len(msg))
+		if _, err = io.ReadFull(c, got); err != nil {
+			return fmt.Errorf("%s: %v", method, err)
+		}
+		if !bytes.Equal(got, msg) {
+			return fmt.Errorf("%s: round trip mismatch", method)
+		}
+	}
+	return nil
+}
+
+// bufConn is a net.Conn reading from r and writing to w.
+type bufConn struct {
+	net.Conn
+	r io.Reader
+	w io.Writer
+}
+
+func (c *bufConn) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c *bufConn) Write(b []byte) (int, error) { return c.w.Write(b) }
+func (c *bufConn) CloseWrite() error           { return ss.CloseWrite(c.Conn) }
+
+// checkRelay relays a message through a temporary loopback server port.
+func checkRelay() error {
+	return relayTCP(config.Method, []byte("shadowsocks health check"))
+}
+
+func checkDNS() error {
+	name := config.HealthCanary
+	if name == "" {
+		name = healthCanaryDefault
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), healthTimeout)
+	defer cancel()
+	_, err := resolver().LookupIP(ctx, name)
+	return err
+}
+
+func runHealthCheck() *healthReport {
+	report := &healthReport{Status: "ok", Components: map[string]*componentHealth{
+		"cipher": checkComponent(checkCiphers),
+		"relay":  checkComponent(checkRelay),
+		"dns":    checkComponent(checkDNS),
+	}}
+	for _, ch := range report.Components {
+		if ch.Status != "ok" {
+			report.Status = "fail"
+		}
+	}
+	return report
+}
+
+// GET /health runs the self check, it responds 503 if any component fails.
+// No token is required, only the status of each component is reported.
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	report := runHealthCheck()
+	w.Header().Set("Content-Type", "application/json")
+	if report.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writeJSON(w, report)
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+// unixPrefix marks port_listen addresses of unix domain sockets, e.g.
+// unix:/run/shadowsocks/8388.sock, to serve behind a local proxy like the
+// nginx stream module.
+const unixPrefix = "unix:"
+
+func isUnixAddr(addr string) bool {
+	return strings.HasPrefix(addr, unixPrefix)
+}
+
+// newListener is the factory of the listeners of the TCP relays of port,
+// used by run through listenTCP: it listens on addr, host:port or a unix
+// socket, as the transport of port needs.
+func newListener(port string, password [3]string, addr string) (net.Listener, error) {
+	transport := config.TransportOf(port)
+	if isUnixAddr(addr) {
+		if ss.OverUDP(transport) {
+			return nil, fmt.Errorf("transport %s can't listen on %s", transport, addr)
+		}
+		return listenUnix(strings.TrimPrefix(addr, unixPrefix))
+	}
+	switch transport {
+	case ss.TransportQUIC:
+		return ss.ListenQUIC(ss.ListenNetwork(netUdp, addr), addr, quicTLSConfig())
+	case ss.TransportKCP:
+		return ss.ListenKCP(ss.ListenNetwork(netUdp, addr), addr, config.KCP, password[0])
+	}
+	var lc net.ListenConfig
+	if config.FastOpen {
+		lc.Control = ss.FastOpenListenControl
+	}
+	lc.SetMultipathTCP(ss.MPTCP())
+	network := ss.ListenNetwork(netTcp, addr)
+	if config.ReusePort > 1 {
+		return ss.ListenReusePort(network, addr, config.ReusePort, lc.Control)
+	}
+	return lc.Listen(context.Background(), network, addr)
+}
+
+// listenUnix listens on the unix socket path, replacing a socket left by a
+// server that didn't shut down, but not one still accepting connections.
+// The socket is removed when the listener is closed.
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("listen unix %s: address already in use", path)
+		}
+		os.Remove(path)
+	}
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,421 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+// The management API is served over HTTP on config.ManagerAddress. Requests
+// authenticate with "Authorization: Bearer <token>". The admin token
+// (config.ManagerToken) may see everything, a tenant token only that tenant's
+// ports.
+
+const adminScope = "*"
+
+// scope returns the tenant name the request's token belongs to, adminScope
+// for the admin token, or "" if the token is invalid.
+func scope(r *http.Request) string {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		return ""
+	}
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	if config.ManagerToken != "" && tokenEqual(token, config.ManagerToken) {
+		return adminScope
+	}
+	for name, t := range config.Tenants {
+		if t.Token != "" && tokenEqual(token, t.Token) {
+			return name
+		}
+	}
+	return ""
+}
+
+// tokenEqual compares tokens in constant time, so timing doesn't tell how
+// much of a guess is right.
+func tokenEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// inScope reports whether port is visible to the given scope. The caller
+// holds reloadLock.
+func inScope(sc, port string) bool {
+	return sc == adminScope || config.TenantOf(port) == sc
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Debug("manager write response:", err)
+	}
+}
+
+type tenantStat struct {
+	Ports   map[string]int `json:"ports"`
+	Traffic int            `json:"traffic"`
+	// rejected connections per port and policy stage
+	Rejected map[string]map[string]int64 `json:"rejected,omitempty"`
+	// relay errors per port and class
+	Errors map[string]map[string]int64 `json:"errors,omitempty"`
+	// closed connections per port, their average duration and close reasons
+	Conns map[string]*ss.ConnStats `json:"conns,omitempty"`
+}
+
+// GET /stats returns traffic per port, aggregated per tenant.
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	sc := scope(r)
+	if sc == "" {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+	// the tenant of each port in scope
+	ports := make(map[string]string)
+	reloadLock.Lock()
+	for port := range config.PortPassword {
+		if inScope(sc, port) {
+			ports[port] = config.TenantOf(port)
+		}
+	}
+	reloadLock.Unlock()
+	stats := make(map[string]*tenantStat)
+	if len(ports) != 0 {
+		names := make([]string, 0, len(ports))
+		for port := range ports {
+			names = append(names, port)
+		}
+		traffic, _ := ss.GetTraffic(names...)
+		for port, n := range traffic {
+			name := ports[port]
+			st, ok := stats[name]
+			if !ok {
+				st = &tenantStat{Ports: make(map[string]int)}
+				stats[name] = st
+			}
+			st.Ports[port] = n
+			st.Traffic += n
+			if rej := ss.GetRejected(port); rej != nil {
+				if st.Rejected == nil {
+					st.Rejected = make(map[string]map[string]int64)
+				}
+				st.Rejected[port] = rej
+			}
+			if errs := ss.GetErrors(port); errs != nil {
+				if st.Errors == nil {
+					st.Errors = make(map[string]map[string]int64)
+				}
+				st.Errors[port] = errs
+			}
+			if cs := ss.GetConnStats(port); cs != nil {
+				if st.Conns == nil {
+					st.Conns = make(map[string]*ss.ConnStats)
+				}
+				st.Conns[port] = cs
+			}
+		}
+	}
+	writeJSON(w, stats)
+}
+
+type portRequest struct {
+	Port     string `json:"port"`
+	Password string `json:"password"`
+	OpenVPN  bool   `json:"openvpn"`
+	UDP      bool   `json:"udp"`
+	Method   string `json:"method"` // method of the config if empty
+	TTL      int    `json:"ttl"`    // seconds, 0 for a permanent port
+	// cap of open connections, the one of the config if 0
+	MaxConnections int `json:"max_connections"`
+}
+
+type maxConnsRequest struct {
+	MaxConnections int `json:"max_connections"` // 0 for no cap
+}
+
+type portInfo struct {
+	Tenant string `json:"tenant,omitempty"`
+	Listen string `json:"listen"` // actual port, may be a fallback port
+}
+
+// GET /ports returns the ports in scope and the port each listens on.
+func listPorts(w http.ResponseWriter, sc string) {
+	ports := make(map[string]portInfo)
+	reloadLock.Lock()
+	for port := range config.PortPassword {
+		if inScope(sc, port) {
+			ports[port] = portInfo{config.TenantOf(port), boundPort(port)}
+		}
+	}
+	reloadLock.Unlock()
+	writeJSON(w, ports)
+}
+
+// GET /ports lists ports. POST /ports creates a port, which is removed
+// automatically after ttl seconds if ttl is given. Ports created by a tenant
+// token belong to that tenant.
+func handlePorts(w http.ResponseWriter, r *http.Request) {
+	sc := scope(r)
+	if sc == "" {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+	if r.Method == "GET" {
+		listPorts(w, sc)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req portRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if n, err := strconv.Atoi(req.Port); err != nil || n <= 0 || n > 65535 {
+		http.Error(w, "invalid port", http.StatusBadRequest)
+		return
+	}
+	if req.Password == "" || req.TTL < 0 || req.MaxConnections < 0 {
+		http.Error(w, "password required, ttl and max_connections must not be negative", http.StatusBadRequest)
+		return
+	}
+	tenant := ""
+	if sc != adminScope {
+		tenant = sc
+	}
+	password := [3]string{req.Password, okIf(req.OpenVPN), okIf(req.UDP)}
+	ttl := time.Duration(req.TTL) * time.Second
+	if req.Method == ss.MethodAuto {
+		req.Method = ss.AutoMethod()
+	}
+	if req.Method != "" {
+		reloadLock.Lock()
+		err := config.CheckMethod(req.Method)
+		reloadLock.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := addAPIPort(req.Port, password, req.Method, tenant, ttl); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if req.MaxConnections > 0 {
+		setMaxConns(req.Port, req.MaxConnections)
+	}
+	resp := map[string]interface{}{"port": req.Port}
+	if ttl > 0 {
+		resp["expires"] = time.Now().Add(ttl).Format(time.RFC3339)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(resp)
+}
+
+type portDetail struct {
+	Port        string `json:"port"`
+	Tenant      string `json:"tenant,omitempty"`
+	Listen      string `json:"listen"`
+	Connections int64  `json:"connections"` // open client connections
+	Traffic     int    `json:"traffic"`
+	// bytes used since the quota was reset, and the quota if there's one
+	QuotaUsed int64 `json:"quota_used"`
+	Quota     int64 `json:"quota,omitempty"`
+	OverQuota bool  `json:"over_quota,omitempty"`
+	// path of the SIP008 online config document, if it's served
+	SIP008 string `json:"sip008,omitempty"`
+	// traffic of the users sharing the port
+	Users map[string]int64 `json:"users,omitempty"`
+	// when the port moves to another port of its port_rotate range
+	NextRotation *time.Time `json:"next_rotation,omitempty"`
+	// cap of open client connections, and connections rejected over it
+	MaxConnections int   `json:"max_connections,omitempty"`
+	MaxConnsHit    int64 `json:"max_connections_rejected,omitempty"`
+	// connections closed so far, their average duration and close reasons
+	ConnStats *ss.ConnStats `json:"conn_stats,omitempty"`
+}
+
+// GET /ports/{port} returns the live state of a port. PUT /ports/{port}
+// changes its password, the body is like POST /ports without port and ttl.
+// DELETE /ports/{port} closes it. POST /ports/{port}/quota/reset (admin
+// token only) clears the traffic used against the quota of the port. PUT
+// /ports/{port}/max_connections (admin token only) changes the cap of its
+// open connections.
+func handlePort(w http.ResponseWriter, r *http.Request) {
+	sc := scope(r)
+	if sc == "" {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+	port := strings.TrimPrefix(r.URL.Path, "/ports/")
+	port, quotaReset := strings.CutSuffix(port, "/quota/reset")
+	port, maxConns := strings.CutSuffix(port, "/max_connections")
+	if (quotaReset || maxConns) && sc != adminScope {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+	reloadLock.Lock()
+	passwd, ok := config.PortPassword[port]
+	ok = ok && inScope(sc, port)
+	tenant := config.TenantOf(port)
+	online := config.OnlineConfig != nil
+	max := maxConnsOf(port)
+	reloadLock.Unlock()
+	if !ok {
+		http.Error(w, "no such port", http.StatusNotFound)
+		return
+	}
+
+	var err error
+	switch {
+	case quotaReset && r.Method == "POST":
+		err = resetQuota(port)
+	case maxConns && r.Method == "PUT":
+		var req maxConnsRequest
+		if err = json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = setMaxConns(port, req.MaxConnections)
+	case quotaReset || maxConns:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	case r.Method == "GET":
+		traffic, _ := ss.GetTraffic(port)
+		used, quota := ss.GetQuota(port)
+		detail := portDetail{port, tenant, boundPort(port), ss.ActiveConns(port),
+			traffic[port], used, quota, ss.OverQuota(port), "", ss.GetUserTraffic(port), nextRotation(port),
+			max, ss.GetRejected(port)[ss.RejectMaxConns], ss.GetConnStats(port)}
+		if online {
+			detail.SIP008 = sip008Path(port, passwd[0])
+		}
+		writeJSON(w, detail)
+		return
+	case r.Method == "PUT":
+		var req portRequest
+		if err = json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = setPortPassword(port, [3]string{req.Password, okIf(req.OpenVPN), okIf(req.UDP)})
+	case r.Method == "DELETE":
+		err = removePort(port)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// invalidError is an error of a request the server can't carry out as
+// asked, answered with 400.
+type invalidError struct{ error }
+
+// errorStatus returns the status answering a request that failed with err:
+// 404 if the port was removed meanwhile, 400 if the request is invalid and
+// 500 otherwise.
+func errorStatus(err error) int {
+	var inv invalidError
+	switch {
+	case errors.Is(err, errNoPort):
+		return http.StatusNotFound
+	case errors.As(err, &inv):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// GET /binds returns ports that failed to bind and whether they're still
+// being retried.
+func handleBinds(w http.ResponseWriter, r *http.Request) {
+	sc := scope(r)
+	if sc == "" {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+	failures := make(map[string]bindState)
+	reloadLock.Lock()
+	binds.Lock()
+	for key, st := range binds.m {
+		if inScope(sc, key[len(st.Network)+1:]) {
+			failures[key] = *st
+		}
+	}
+	binds.Unlock()
+	reloadLock.Unlock()
+	writeJSON(w, failures)
+}
+
+// POST /reload (admin token only) reloads the config like SIGUSR1, keeping
+// the traffic used against quotas. Errors in the config are logged and the
+// old one is kept, as on a signal.
+func handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if atomic.LoadInt32(&shuttingDown) != 0 {
+		http.Error(w, "server shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	sdNotify("RELOADING=1")
+	updatePasswd(false)
+	sdNotify("READY=1")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func okIf(b bool) string {
+	if b {
+		return "ok"
+	}
+	return ""
+}
+
+// adminOnly allows only requests with the admin token to h.
+func adminOnly(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if scope(r) != adminScope {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func runManager(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", handleStats)
+	mux.HandleFunc("/ports", handlePorts)
+	mux.HandleFunc("/ports/", handlePort)
+	mux.HandleFunc("/binds", handleBinds)
+	mux.Handle("/reload", adminOnly(http.HandlerFunc(handleReload)))
+	mux.HandleFunc("/health", handleHealth)
+	mux.HandleFunc("/crypto", handleCrypto)
+	mux.Handle("/debug/vars", adminOnly(expvar.Handler()))
+	logger.Infof("management API listening at %s ...", addr)
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      30 * time.Second,
+	}
+	if err := srv.ListenAndServe(); err != nil {
+		logger.Error("management API:", err)
+	}
+}
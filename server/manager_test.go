@@ -0,0 +1,55 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+func TestHandlePortStatus(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config = &ss.Config{ManagerToken: "secret", PortPassword: map[string][3]string{"8388": {"foobar"}}}
+
+	for _, c := range []struct {
+		method, path, body string
+		status             int
+	}{
+		{"PATCH", "/ports/8388", "", http.StatusMethodNotAllowed},
+		{"POST", "/ports/8388", `{"password":"barfoo"}`, http.StatusMethodNotAllowed},
+		{"GET", "/ports/8388/max_connections", "", http.StatusMethodNotAllowed},
+		{"PUT", "/ports/8388", `{"password":""}`, http.StatusBadRequest},
+		{"PUT", "/ports/8388", `{"password":`, http.StatusBadRequest},
+		{"PUT", "/ports/8388/max_connections", `{"max_connections":-1}`, http.StatusBadRequest},
+		{"GET", "/ports/8389", "", http.StatusNotFound},
+		{"DELETE", "/ports/8389", "", http.StatusNotFound},
+	} {
+		r := httptest.NewRequest(c.method, c.path, strings.NewReader(c.body))
+		r.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		handlePort(w, r)
+		if w.Code != c.status {
+			t.Errorf("%s %s %s: status %d, want %d", c.method, c.path, c.body, w.Code, c.status)
+		}
+		if w.Body.Len() == 0 {
+			t.Errorf("%s %s %s: no message in the body", c.method, c.path, c.body)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	handleReload(w, httptest.NewRequest("GET", "/reload", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /reload: status %d", w.Code)
+	}
+
+	if s := errorStatus(errNoPort); s != http.StatusNotFound {
+		t.Errorf("errNoPort answered with %d", s)
+	}
+	if s := errorStatus(errors.New("disk full")); s != http.StatusInternalServerError {
+		t.Errorf("internal error answered with %d", s)
+	}
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+// A port with a cap in config.PortMaxConnections, or config.MaxConnections,
+// keeps at most that many client connections open, so a single user can't
+// use up the open files of the server. Connections over the cap are closed
+// right after the accept and counted as rejected with ss.RejectMaxConns.
+// The management API changes the cap of a running port.
+
+var portConns = struct {
+	sync.Mutex
+	open map[string]int // client connections open per port
+	max  map[string]int // cap per port, none if absent
+}{open: make(map[string]int), max: make(map[string]int)}
+
+// checkMaxConns checks the max_connections options of c.
+func checkMaxConns(c *ss.Config) error {
+	if c.MaxConnections < 0 {
+		return errors.New("max_connections must not be negative")
+	}
+	for port, n := range c.PortMaxConnections {
+		if n < 0 {
+			return fmt.Errorf("port_max_connections: port %s must not be negative", port)
+		}
+	}
+	return nil
+}
+
+// maxConnsOf returns the cap of open connections of port, 0 for none.
+func maxConnsOf(port string) int {
+	if n, ok := config.PortMaxConnections[port]; ok {
+		return n
+	}
+	return config.MaxConnections
+}
+
+// applyMaxConns sets the cap of every port from the config, it's called on
+// start and reloads.
+func applyMaxConns() {
+	portConns.Lock()
+	defer portConns.Unlock()
+	portConns.max = make(map[string]int)
+	for port := range config.PortPassword {
+		if n := maxConnsOf(port); n > 0 {
+			portConns.max[port] = n
+		}
+	}
+}
+
+// openConn counts a new client connection of port, unless port has its cap
+// of connections open.
+func openConn(port string) bool {
+	portConns.Lock()
+	defer portConns.Unlock()
+	if max, ok := portConns.max[port]; ok && portConns.open[port] >= max {
+		return false
+	}
+	portConns.open[port]++
+	return true
+}
+
+// closeConn counts a closed client connection of port.
+func closeConn(port string) {
+	portConns.Lock()
+	defer portConns.Unlock()
+	if portConns.open[port]--; portConns.open[port] <= 0 {
+		delete(portConns.open, port)
+	}
+}
+
+// setMaxConns changes the cap of open connections of port, 0 removes it.
+// Connections already open over the new cap are left open. The cap of
+// ports from the config holds until the next reload, the one of ports
+// created through the management API is kept.
+func setMaxConns(port string, n int) error {
+	if n < 0 {
+		return invalidError{errors.New("max_connections must not be negative")}
+	}
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	if _, ok := config.PortPassword[port]; !ok {
+		return errNoPort
+	}
+	apiPorts.Lock()
+	if ap, ok := apiPorts.m[port]; ok {
+		ap.maxConns = &n
+	}
+	apiPorts.Unlock()
+	if config.PortMaxConnections == nil {
+		config.PortMaxConnections = make(map[string]int)
+	}
+	config.PortMaxConnections[port] = n
+	portConns.Lock()
+	if n > 0 {
+		portConns.max[port] = n
+	} else {
+		delete(portConns.max, port)
+	}
+	portConns.Unlock()
+	logger.Infof("max connections of port %s set to %d", port, n)
+	return nil
+}
+
+// forgetMaxConns removes the cap of port, which was closed.
+func forgetMaxConns(port string) {
+	portConns.Lock()
+	delete(portConns.max, port)
+	portConns.Unlock()
+}
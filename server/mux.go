@@ -0,0 +1,72 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+// serveMux relays the streams of a multiplexed connection, extra being the
+// data read after its request.
+func serveMux(id string, conn *ss.Conn, extra []byte, port string, pflag *uint32, openvpn string, limit *ss.Bandwidth) {
+	logger.Debugf("[%s] multiplexed connection from %s", id, conn.RemoteAddr())
+	// the connection is idle between relays, smux keepalives tell if it's
+	// dead
+	conn.SetReadDeadline(time.Time{})
+	var c net.Conn = conn
+	if extra != nil {
+		c = &bufConn{conn, io.MultiReader(bytes.NewReader(extra), conn), conn}
+	}
+	m := ss.NewMuxSession(c, false)
+	defer m.Close()
+	for n := 1; ; n++ {
+		st, err := m.Accept()
+		if err != nil || atomic.LoadUint32(pflag) == 1 {
+			return
+		}
+		go handleMuxStream(id+"/"+strconv.Itoa(n), st, conn.User, port, pflag, openvpn, limit)
+	}
+}
+
+// handleMuxStream relays a stream of a multiplexed connection of user.
+func handleMuxStream(id string, st net.Conn, user, port string, pflag *uint32, openvpn string, limit *ss.Bandwidth) {
+	ss.ConnOpened(port)
+	defer ss.ConnClosed(port)
+	ctx, span := ss.StartTrace(context.Background(), "stream", ss.SpanServer)
+	span.SetAttr("ss.conn_id", id)
+	span.SetAttr("ss.port", port)
+	defer span.End()
+	_, ps := ss.StartSpan(ctx, "parse_request", ss.SpanInternal)
+	h, p, extra, err := ss.GetRequest(st)
+	ps.SetError(err)
+	ps.End()
+	if err != nil {
+		span.SetError(err)
+		logger.Warnf("[%s] error getting request of stream: %v", id, err)
+		st.Close()
+		return
+	}
+	if !relay(ctx, id, st, user, h, p, extra, port, pflag, openvpn, limit) {
+		st.Close()
+	}
+	logger.Debugf("[%s] closed stream to %s:%s", id, h, p)
+}
+
+// serveUoT relays the UDP packets carried by conn, a UDP over TCP connection
+// whose request had destination host, extra being the data read after it.
+func serveUoT(id string, conn *ss.Conn, extra []byte, host, port, openvpn string) {
+	logger.Debugf("[%s] udp over tcp connection from %s", id, conn.RemoteAddr())
+	var c net.Conn = conn
+	if extra != nil {
+		c = &bufConn{conn, io.MultiReader(bytes.NewReader(extra), conn), conn}
+	}
+	if err := ss.ServeUoT(c, host, port, openvpn); err != nil && err != io.EOF {
+		logger.Debugf("[%s] udp over tcp connection closed: %v", id, err)
+	}
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+// Ports with a quota in config.PortQuota are closed when their traffic
+// reaches it. They stay closed, even if their password is changed, until the
+// quota is reset by SIGHUP or the management API. Other reloads, from
+// reloadSignal, conf_dir or rotated secrets, keep the traffic used, but that
+// of ports whose quota changed.
+
+const gigabyte = 1 << 30
+
+// applyQuotas sets the quota of every port from the config, and clears the
+// traffic used so far if reset is set.
+func applyQuotas(reset bool) {
+	for port := range config.PortPassword {
+		if reset {
+			ss.ResetQuota(port)
+		}
+		ss.SetQuota(port, int64(config.PortQuota[port]*gigabyte))
+	}
+}
+
+// resetChangedQuotas clears the traffic used by the ports whose quota
+// differs in old and config.
+func resetChangedQuotas(old *ss.Config) {
+	for port := range config.PortPassword {
+		if old.PortQuota[port] != config.PortQuota[port] {
+			ss.ResetQuota(port)
+		}
+	}
+}
+
+// closeOverQuota is ss.QuotaExceeded. It runs apart from the traffic
+// accounting, the quota may have been reset meanwhile.
+func closeOverQuota(port string) {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	if _, ok := config.PortPassword[port]; !ok || !ss.OverQuota(port) {
+		return
+	}
+	logger.Infof("closing port %s as it has used up its quota", port)
+	passwdManager.stop(port)
+}
+
+// resetQuota clears the traffic used by port and starts it again if it was
+// closed over quota.
+func resetQuota(port string) error {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	password, ok := config.PortPassword[port]
+	if !ok {
+		return errNoPort
+	}
+	closed := ss.OverQuota(port)
+	ss.ResetQuota(port)
+	if _, ok := passwdManager.get(port); closed && !ok {
+		logger.Infof("port %s quota reset, listening again", port)
+		go run(port, password)
+	}
+	return nil
+}
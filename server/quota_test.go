@@ -0,0 +1,77 @@
+package server
+
+import (
+	"testing"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+func TestQuotaReset(t *testing.T) {
+	saved, savedTcp, savedUdp, savedHook := config, netTcp, netUdp, ss.QuotaExceeded
+	defer func() { config, netTcp, netUdp, ss.QuotaExceeded = saved, savedTcp, savedUdp, savedHook }()
+	config = &ss.Config{Method: "aes-256-gcm", PortPassword: map[string][3]string{}}
+	netTcp, netUdp = "tcp", "udp"
+	ss.QuotaExceeded = closeOverQuota
+	port := freePort(t)
+	defer ss.DelTraffic(port)
+
+	if err := addAPIPort(port, [3]string{"foobar"}, "", "", 0); err != nil {
+		t.Fatal(err)
+	}
+	defer removePort(port)
+	waitListening(t, port, true)
+
+	// a port using up its quota is closed but stays in the config
+	config.PortQuota = map[string]float64{port: 1}
+	ss.RestoreTraffic(&ss.TrafficSnapshot{Ports: map[string]*ss.PortUsage{port: {}},
+		QuotaUsed: map[string]int64{port: gigabyte}})
+	applyQuotas(false)
+	waitListening(t, port, false)
+	if !ss.OverQuota(port) {
+		t.Fatal("port not over quota")
+	}
+	if _, ok := config.PortPassword[port]; !ok {
+		t.Error("port closed over quota removed from config")
+	}
+
+	// reloads keep the traffic used, unless the quota of the port changed
+	old := &ss.Config{PortQuota: map[string]float64{port: 1}}
+	resetChangedQuotas(old)
+	applyQuotas(false)
+	if !ss.OverQuota(port) {
+		t.Error("reload with the same quota reset it")
+	}
+	old.PortQuota[port] = 2
+	resetChangedQuotas(old)
+	if used, _ := ss.GetQuota(port); used != 0 {
+		t.Errorf("reload changing the quota kept %d bytes used", used)
+	}
+	applyQuotas(false)
+	if ss.OverQuota(port) {
+		t.Error("port over quota after its quota changed")
+	}
+
+	// SIGHUP resets every quota
+	ss.RestoreTraffic(&ss.TrafficSnapshot{Ports: map[string]*ss.PortUsage{port: {}},
+		QuotaUsed: map[string]int64{port: gigabyte}})
+	applyQuotas(true)
+	if used, quota := ss.GetQuota(port); used != 0 || quota != gigabyte {
+		t.Errorf("after reset used %d, quota %d", used, quota)
+	}
+
+	// the management API reset starts the port again
+	ss.RestoreTraffic(&ss.TrafficSnapshot{Ports: map[string]*ss.PortUsage{port: {}},
+		QuotaUsed: map[string]int64{port: gigabyte}})
+	applyQuotas(false)
+	waitListening(t, port, false)
+	if err := resetQuota(port); err != nil {
+		t.Fatal(err)
+	}
+	waitListening(t, port, true)
+	if ss.OverQuota(port) {
+		t.Error("port still over quota after reset")
+	}
+	if err := resetQuota("1"); err != errNoPort {
+		t.Errorf("resetting the quota of a missing port: %v", err)
+	}
+}
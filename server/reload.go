@@ -0,0 +1,136 @@
+package server
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+// A reload (SIGHUP, a changed conf_dir or a management API change) applies
+// every option but these, which are only read when the server starts.
+var restartOptions = map[string]bool{
+	"net":                    true,
+	"kcp":                    true,
+	"fast_open":              true,
+	"reuseport":              true,
+	"manager_address":        true,
+	"ss_manager_address":     true,
+	"ss_manager_remote":      true,
+	"debug_address":          true,
+	"online_config":          true,
+	"replay_filter":          true,
+	"replay_filter_file":     true,
+	"replay_filter_capacity": true,
+	"replay_filter_fp_rate":  true,
+	"probe_log":              true,
+}
+
+// changedOptions returns the names of the options that differ in a and b,
+// empty and missing maps and lists are the same.
+func changedOptions(a, b *ss.Config) []string {
+	va, vb := reflect.ValueOf(a).Elem(), reflect.ValueOf(b).Elem()
+	t := va.Type()
+	var changed []string
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		fa, fb := va.Field(i), vb.Field(i)
+		if k := fa.Kind(); (k == reflect.Map || k == reflect.Slice) && fa.Len() == 0 && fb.Len() == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(fa.Interface(), fb.Interface()) {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+// logReload reports the options changed by a reload.
+func logReload(changed []string) {
+	if len(changed) == 0 {
+		logger.Info("config reloaded, nothing changed")
+		return
+	}
+	logger.Infof("config reloaded, changed: %s", strings.Join(changed, ", "))
+	for _, name := range changed {
+		if restartOptions[name] {
+			logger.Warnf("%s changed, it takes effect when the server restarts", name)
+		}
+	}
+}
+
+const defaultDrainTimeout = 30 * time.Second
+
+// drainTimeout returns how long open connections of ports removed or
+// restarted by a reload keep running, negative to close them at once.
+func drainTimeout() time.Duration {
+	switch {
+	case config.DrainTimeout < 0:
+		return -1
+	case config.DrainTimeout == 0:
+		return defaultDrainTimeout
+	}
+	return time.Duration(config.DrainTimeout) * time.Second
+}
+
+// closeAfterDrain closes the connections of port flagged by pflag after the
+// drain timeout, then calls done if it's not nil.
+func closeAfterDrain(port string, pflag *uint32, done func()) {
+	d := drainTimeout()
+	if d < 0 {
+		d = 0
+	} else {
+		logger.Infof("open connections of port %s are closed in %v", port, d)
+	}
+	time.AfterFunc(d, func() {
+		atomic.StoreUint32(pflag, 1)
+		if done != nil {
+			done()
+		}
+	})
+}
+
+// logOpts are the logging flags, logFlags the ones set on the command line,
+// which take precedence over the log_level and log_format options.
+var (
+	logOpts  *ss.LogOptions
+	logFlags = make(map[string]bool)
+	debug    bool
+)
+
+// checkLogConfig checks the log_level and log_format options of c.
+func checkLogConfig(c *ss.Config) error {
+	if _, _, err := ss.ParseLogLevels(c.LogLevel); err != nil {
+		return fmt.Errorf("log_level: %v", err)
+	}
+	switch c.LogFormat {
+	case "", "text", "json":
+		return nil
+	}
+	return fmt.Errorf("unknown log_format %q, must be text or json", c.LogFormat)
+}
+
+// applyLogConfig sets the log levels and format of c, unless they're set by
+// flags.
+func applyLogConfig(c *ss.Config) error {
+	level, format := logOpts.Level, logOpts.Format
+	if !logFlags["log-level"] && c.LogLevel != "" {
+		level = c.LogLevel
+	}
+	if !logFlags["log-format"] && c.LogFormat != "" {
+		format = c.LogFormat
+	}
+	if debug {
+		level = "debug," + level
+	}
+	if err := ss.SetLogLevels(level); err != nil {
+		return err
+	}
+	return ss.SetLogFormat(format)
+}
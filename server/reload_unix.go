@@ -0,0 +1,13 @@
+//go:build !windows
+// +build !windows
+
+package server
+
+import (
+	"os"
+	"syscall"
+)
+
+// reloadSignal reloads the config like SIGHUP, but keeps the traffic used
+// against quotas.
+var reloadSignal os.Signal = syscall.SIGUSR1
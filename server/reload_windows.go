@@ -0,0 +1,6 @@
+package server
+
+import "os"
+
+// reloadSignal is nil, windows has no signal to spare.
+var reloadSignal os.Signal
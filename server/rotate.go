@@ -0,0 +1,224 @@
+package server
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+// A port in config.PortRotate listens on a random free port of its range,
+// chosen again on its schedule. The configured port stays the identity of
+// the port for the management API, quotas and traffic, boundPort returns
+// the port listened on, which the SIP008 documents publish so clients
+// follow. Open connections drain like on a config change when the port
+// moves.
+
+// rotateAttempts is the number of ports of the range tried when the chosen
+// one can't be bound.
+const rotateAttempts = 16
+
+type rotator struct {
+	spec ss.PortRotation
+	stop chan struct{}
+	next time.Time
+}
+
+var rotations = struct {
+	sync.Mutex
+	// port each rotating port is rotated to
+	port     map[string]string
+	rotators map[string]*rotator
+}{port: make(map[string]string), rotators: make(map[string]*rotator)}
+
+// checkPortRotate checks the port_rotate option of c.
+func checkPortRotate(c *ss.Config) error {
+	for port, r := range c.PortRotate {
+		if r == nil {
+			return fmt.Errorf("port_rotate: port %s has no rotation", port)
+		}
+		lo, hi, err := parsePortRange(r.Range)
+		if err != nil {
+			return fmt.Errorf("port_rotate: port %s: %v", port, err)
+		}
+		if lo == hi {
+			return fmt.Errorf("port_rotate: port %s: range %s has a single port", port, r.Range)
+		}
+		if _, err = ss.ParseSchedule(r.Schedule); err != nil {
+			return fmt.Errorf("port_rotate: port %s: %v", port, err)
+		}
+	}
+	return nil
+}
+
+// pickRotatedPort chooses a port of the range of port other than its
+// current one, and not used by a configured or another rotating port.
+// rotations must be locked.
+func pickRotatedPort(port string) string {
+	r := config.PortRotate[port]
+	if r == nil {
+		return ""
+	}
+	lo, hi, err := parsePortRange(r.Range)
+	if err != nil {
+		return ""
+	}
+	used := make(map[string]bool, len(rotations.port))
+	for _, p := range rotations.port {
+		used[p] = true
+	}
+	n := hi - lo + 1
+	start := rand.Intn(n)
+	for i := 0; i < n; i++ {
+		p := strconv.Itoa(lo + (start+i)%n)
+		if _, ok := config.PortPassword[p]; ok || used[p] {
+			continue
+		}
+		rotations.port[port] = p
+		return p
+	}
+	return ""
+}
+
+// rotatedPort returns the port port is rotated to, choosing one if needed.
+func rotatedPort(port string) string {
+	rotations.Lock()
+	defer rotations.Unlock()
+	if p, ok := rotations.port[port]; ok {
+		return p
+	}
+	return pickRotatedPort(port)
+}
+
+// bindRotated listens on the port port is rotated to, or on other ports of
+// its range if it can't be bound.
+func bindRotated(network, port string, listen func(p string) error) bool {
+	p := rotatedPort(port)
+	for i := 0; i < rotateAttempts && p != ""; i++ {
+		err := listen(p)
+		if err == nil {
+			logger.Infof("%s port %s listening on rotated port %s", network, port, p)
+			setBoundPort(port, p)
+			return true
+		}
+		logger.Debugf("error listening %s port %s rotated to %s: %v", network, port, p, err)
+		rotations.Lock()
+		p = pickRotatedPort(port)
+		rotations.Unlock()
+	}
+	logger.Errorf("no free port in the rotation range of %s port %s", network, port)
+	return false
+}
+
+// restartPort moves the listeners of port to the port it's rotated to, or
+// back to port if it isn't rotating anymore. It returns false if port isn't
+// listening.
+func restartPort(port string) bool {
+	pl, ok := passwdManager.get(port)
+	password, configured := config.PortPassword[port]
+	if !ok || !configured {
+		return false
+	}
+	pl.listener.Close()
+	closeAfterDrain(port, pl.pflag, nil)
+	if upl, ok := passwdManager.getUDP(port); ok {
+		upl.Close()
+	}
+	go run(port, password)
+	return true
+}
+
+// rotatePort moves port to another port of its range, unless r was
+// stopped meanwhile.
+func rotatePort(port string, r *rotator) {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	rotations.Lock()
+	if rotations.rotators[port] != r {
+		rotations.Unlock()
+		return
+	}
+	p := pickRotatedPort(port)
+	rotations.Unlock()
+	if p == "" {
+		logger.Errorf("no free port in the rotation range of port %s", port)
+		return
+	}
+	logger.Infof("rotating port %s from %s to %s", port, boundPort(port), p)
+	restartPort(port)
+}
+
+func (r *rotator) run(port string, sched ss.Schedule) {
+	for {
+		next := sched.Next(time.Now())
+		if next.IsZero() {
+			logger.Warnf("port_rotate: schedule %q of port %s never comes", r.spec.Schedule, port)
+			return
+		}
+		rotations.Lock()
+		r.next = next
+		rotations.Unlock()
+		t := time.NewTimer(time.Until(next))
+		select {
+		case <-r.stop:
+			t.Stop()
+			return
+		case <-t.C:
+		}
+		rotatePort(port, r)
+	}
+}
+
+// applyRotations starts the rotation of the ports of config.PortRotate and
+// stops the others, it's called on start and reloads. It returns the ports
+// to restart: ports whose range changed move right away, ports that stop
+// rotating move back, and listening ports that start rotating move to their
+// range.
+func applyRotations() (restart map[string]bool) {
+	restart = make(map[string]bool)
+	rotations.Lock()
+	defer rotations.Unlock()
+	for port, r := range rotations.rotators {
+		spec := config.PortRotate[port]
+		if spec != nil && *spec == r.spec {
+			continue
+		}
+		close(r.stop)
+		delete(rotations.rotators, port)
+		if spec == nil || spec.Range != r.spec.Range {
+			delete(rotations.port, port)
+			restart[port] = true
+		}
+	}
+	for port, spec := range config.PortRotate {
+		if _, ok := rotations.rotators[port]; ok {
+			continue
+		}
+		sched, err := ss.ParseSchedule(spec.Schedule)
+		if err != nil {
+			// checked before the config is used
+			continue
+		}
+		if _, ok := rotations.port[port]; !ok {
+			restart[port] = true
+		}
+		r := &rotator{spec: *spec, stop: make(chan struct{})}
+		rotations.rotators[port] = r
+		go r.run(port, sched)
+	}
+	return restart
+}
+
+// nextRotation returns when port rotates next, nil if it doesn't.
+func nextRotation(port string) *time.Time {
+	rotations.Lock()
+	defer rotations.Unlock()
+	if r, ok := rotations.rotators[port]; ok && !r.next.IsZero() {
+		next := r.next
+		return &next
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+// The selftest subcommand starts an ephemeral server on loopback for every
+// configured method, proxies test traffic through it over TCP and UDP to a
+// loopback echo server, and prints the result with timings:
+//
+//	shadowsocks-server selftest [-c config.json] [-all]
+
+const selfTestTimeout = 5 * time.Second
+
+// relayTCP relays msg through a temporary server port with method to an echo
+// server and checks that it comes back unchanged.
+func relayTCP(method string, msg []byte) error {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	defer echo.Close()
+	go func() {
+		conn, err := echo.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	password, err := ss.RandomPassword(method)
+	if err != nil {
+		return err
+	}
+	cipher, err := ss.NewCipher(method, password)
+	if err != nil {
+		return err
+	}
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		var flag uint32
+		ctx := withTestTarget(context.Background(), echo.Addr().String())
+		handleConnection(ctx, ss.NewConn(conn, cipher.Copy()), "", &flag, "", nil)
+	}()
+
+	rawaddr, err := ss.RawAddr(echo.Addr().String())
+	if err != nil {
+		return err
+	}
+	c, err := ss.DialWithRawAddr(rawaddr, ln.Addr().String(), cipher.Copy())
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(selfTestTimeout))
+	go c.Write(msg)
+	got := make([]byte, len(msg))
+	if _, err = io.ReadFull(c, got); err != nil {
+		return err
+	}
+	if !bytes.Equal(got, msg) {
+		return errors.New("relayed data mismatch")
+	}
+	return nil
+}
+
+// relayUDP relays a datagram through a temporary UDP server port with method
+// to an echo server and checks the reply.
+func relayUDP(method string, msg []byte) error {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return err
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 4096)
+		n, addr, err := echo.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		echo.WriteToUDP(buf[:n], addr)
+	}()
+	srv, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return err
+	}
+	defer srv.Close()
+	password, err := ss.RandomPassword(method)
+	if err != nil {
+		return err
+	}
+	cipher, err := ss.NewCipher(method, password)
+	if err != nil {
+		return err
+	}
+	uc := ss.NewUDPConn(srv, cipher.Copy())
+	uc.SetTestTarget(echo.LocalAddr().String())
+	go ss.HandleUDPConnection(uc, "")
+
+	c, err := ss.ListenPacket("udp", srv.LocalAddr().String(), cipher.Copy())
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(selfTestTimeout))
+	if _, err = c.WriteTo(msg, echo.LocalAddr()); err != nil {
+		return err
+	}
+	buf := make([]byte, 4096)
+	n, from, err := c.ReadFrom(buf)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(buf[:n], msg) || from.String() != echo.LocalAddr().String() {
+		return errors.New("relayed datagram mismatch")
+	}
+	return nil
+}
+
+// selfTest runs the selftest subcommand and returns the exit status.
+func selfTest(args []string) int {
+	var file string
+	var all bool
+	fs := flag.NewFlagSet("selftest", flag.ContinueOnError)
+	fs.StringVar(&file, "c", "config.json", "test the methods used in this config file")
+	fs.BoolVar(&all, "all", false, "test all supported methods")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	config = &ss.Config{}
+	var methods []string
+	if all {
+		methods = ss.CipherMethods()
+	} else {
+		if c, err := ss.ParseConfig(file); err == nil {
+			config = c
+			config.ResolveAutoMethods()
+		} else if !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "error reading %s: %v\n", file, err)
+			return 1
+		}
+		if config.Method == "" {
+			config.Method = "aes-256-cfb"
+		}
+		seen := map[string]bool{}
+		add := func(method string) {
+			if !seen[method] {
+				seen[method] = true
+				methods = append(methods, method)
+			}
+		}
+		add(config.Method)
+		for _, t := range config.Tenants {
+			if t.Method != "" {
+				add(t.Method)
+			}
+		}
+		for _, m := range config.PortMethod {
+			add(m)
+		}
+	}
+	ss.UDPDestAllowed = allowDest
+
+	msg := make([]byte, 32*1024)
+	rand.Read(msg)
+	failed, total := 0, 0
+	for _, method := range methods {
+		for _, t := range []struct {
+			transport string
+			relay     func(string, []byte) error
+			msg       []byte
+		}{
+			{"tcp", relayTCP, msg},
+			{"udp", relayUDP, msg[:1024]},
+		} {
+			if t.transport == "udp" && !ss.UDPSupported(method) {
+				fmt.Printf("SKIP %-12s %s: not supported by method\n", method, t.transport)
+				continue
+			}
+			start := time.Now()
+			err := t.relay(method, t.msg)
+			elapsed := time.Since(start)
+			total++
+			if err != nil {
+				failed++
+				fmt.Printf("FAIL %-12s %s %v: %v\n", method, t.transport, elapsed, err)
+			} else {
+				fmt.Printf("PASS %-12s %s %v\n", method, t.transport, elapsed)
+			}
+		}
+	}
+	if failed != 0 {
+		fmt.Printf("%d of %d tests failed\n", failed, total)
+		return 1
+	}
+	return 0
+}
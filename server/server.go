@@ -0,0 +1,1353 @@
+// Package server implements the shadowsocks server command.
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/shadowsocks/shadowsocks-go/manage"
+	"github.com/shadowsocks/shadowsocks-go/service"
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+// dnsGoroutineNum bounds the destination hostnames looked up at a time.
+const dnsGoroutineNum = 64
+
+const logCntDelta = 100
+
+// serviceName names the system service of the server.
+const serviceName = "shadowsocks-server"
+
+var connCnt uint64 // operate by sync/atomic
+
+var logger = ss.NewLogger("server")
+
+// handleConnection relays the client connection conn of port. ctx carries
+// the test target of a health check or self test, see withTestTarget.
+func handleConnection(ctx context.Context, conn *ss.Conn, port string, pflag *uint32, openvpn string, limit *ss.Bandwidth) {
+	var host string
+
+	newConnCnt := atomic.AddUint64(&connCnt, 1) // connCnt++
+	ss.ConnOpened(port)
+	if newConnCnt%logCntDelta == 0 {
+		logger.Infof("Number of client connections reaches %d", newConnCnt)
+	}
+
+	// id is included in every log line of this session
+	id := ss.NewConnID()
+	// function arguments are always evaluated, so surround debug statement
+	// with if statement
+	logger.Debugf("[%s] new client %s->%s", id, conn.RemoteAddr().String(), conn.LocalAddr())
+	closed := false
+	defer func() {
+		logger.Debugf("[%s] closed pipe %s<->%s", id, conn.RemoteAddr(), host)
+		atomic.AddUint64(&connCnt, ^uint64(0)) // connCnt--
+		ss.ConnClosed(port)
+		if !closed {
+			conn.Close()
+		}
+	}()
+
+	ctx, span := ss.StartTrace(ctx, "connection", ss.SpanServer)
+	span.SetAttr("ss.conn_id", id)
+	span.SetAttr("ss.port", port)
+	span.SetAttr("client.address", conn.RemoteAddr().String())
+	defer span.End()
+
+	_, ps := ss.StartSpan(ctx, "parse_request", ss.SpanInternal)
+	h, p, extra, err := ss.GetRequest(conn)
+	ps.SetError(err)
+	ps.End()
+	if err != nil {
+		span.SetError(err)
+		logger.Warnf("[%s] error getting request %s %s %v", id, conn.RemoteAddr(), conn.LocalAddr(), err)
+		if _, ok := err.(ss.AddrTypeError); ok {
+			ss.CountErrorClass(port, ss.ErrDecrypt)
+		} else if err == ss.ErrReplay || err == ss.ErrBadTimestamp {
+			ss.CountReject(port, ss.RejectReplay)
+		} else {
+			ss.CountError(port, err)
+		}
+		ip := ss.HostOf(conn.RemoteAddr())
+		if probers.Fail(ip) {
+			logger.Debugf("[%s] %s flagged as prober", id, conn.RemoteAddr())
+		}
+		if err != io.EOF {
+			// closed before sending anything isn't a failed handshake
+			sources.Fail(ip)
+		}
+		if rc, ok := conn.Conn.(*ss.RecordConn); ok {
+			probeLog.Record(rc, port, err)
+		}
+		if fc := fallbackConn(conn); fc != nil {
+			closed = true
+			fc.Fallback(config.Fallback)
+		}
+		return
+	}
+	if fc := fallbackConn(conn); fc != nil {
+		fc.Done()
+	}
+	host = h + ":" + p
+	if h == ss.MuxHost {
+		if !config.Mux {
+			logger.Warnf("[%s] multiplexed connection refused, mux isn't enabled", id)
+			return
+		}
+		closed = true
+		serveMux(id, conn, extra, port, pflag, openvpn, limit)
+		return
+	}
+	if h == ss.UoTHost || h == ss.UoTHostV1 {
+		if !config.UoT {
+			logger.Warnf("[%s] udp over tcp connection refused, uot isn't enabled", id)
+			return
+		}
+		serveUoT(id, conn, extra, h, port, openvpn)
+		return
+	}
+	closed = relay(ctx, id, conn, conn.User, h, p, extra, port, pflag, openvpn, limit)
+}
+
+// relay connects to the destination h:p of conn, a connection or a stream
+// of user, and pipes them, it returns false if conn is left open. ctx
+// carries the trace of conn.
+func relay(ctx context.Context, id string, conn net.Conn, user, h, p string, extra []byte, port string, pflag *uint32, openvpn string, limit *ss.Bandwidth) (closed bool) {
+	host := h + ":" + p
+	start := time.Now()
+	al := currentAccessLog()
+	if user != "" {
+		logger.Debugf("[%s] user %s connecting %s", id, user, host)
+	} else {
+		logger.Debugf("[%s] connecting %s", id, host)
+	}
+	var remote net.Conn
+	err := errPortDest
+	if allowDestPort(port, user, p) || isTestTarget(ctx, host) {
+		remote, err = dialDest(ctx, port, h, p, openvpn)
+	}
+	if err != nil {
+		logAccess(al, start, conn, port, user, host, 0, 0, err.Error())
+		if errors.Is(err, errPortDest) || errors.Is(err, errIllegalDest) || errors.Is(err, errCountryDest) || errors.Is(err, errACLDest) {
+			ss.CountClose(port, ss.CloseDenied, time.Since(start))
+		} else {
+			ss.CountClose(port, ss.CloseDialError, time.Since(start))
+		}
+		if errors.Is(err, errPortDest) {
+			logger.Warnf("[%s] %s rejected by dest_ports rule of port %s", id, host, port)
+			ss.CountReject(port, ss.RejectDestPort)
+			return
+		}
+		if errors.Is(err, errIllegalDest) {
+			logger.Warnf("[%s] illegal connect to local network(%s)", id, host)
+			ss.CountReject(port, ss.RejectDest)
+			return
+		}
+		if errors.Is(err, errCountryDest) {
+			logger.Warnf("[%s] %s rejected by geoip rule", id, host)
+			ss.CountReject(port, ss.RejectGeoIP)
+			return
+		}
+		if errors.Is(err, errACLDest) {
+			logger.Warnf("[%s] %s rejected by acl", id, host)
+			ss.CountReject(port, ss.RejectACL)
+			return
+		}
+		if ss.IsFileLimit(err) {
+			// EMFILE is process reaches open file limits, ENFILE is system limit
+			logger.Warnf("[%s] dial error: %v", id, err)
+			ss.FileLimitReached()
+		} else {
+			logger.Warnf("[%s] error connecting to: %s %v", id, host, err)
+		}
+		ss.CountError(port, err)
+		return
+	}
+	defer func() {
+		if !closed {
+			remote.Close()
+		}
+	}()
+	var client, target net.Conn = conn, remote
+	if extra != nil {
+		// the data read with the request is relayed first, counted and
+		// limited like the rest
+		client = &bufConn{conn, io.MultiReader(bytes.NewReader(extra), conn), conn}
+	}
+	if flow := captureFlow(id, conn, remote, port, host); flow != nil {
+		client, target = ss.NewCaptureConn(client, flow, true), ss.NewCaptureConn(remote, flow, false)
+	}
+	if user != "" {
+		client = &userConn{client, port, user}
+	}
+	target, done := trackConn(id, port, user, conn, target, host)
+	defer done()
+	logger.Debugf("[%s] ping %s<->%s", id, conn.RemoteAddr(), host)
+	var connLimit *ss.Bandwidth
+	if config.ConnSpeedLimit > 0 {
+		connLimit = ss.NewBandwidth(config.ConnSpeedLimit)
+	}
+	_, rs := ss.StartSpan(ctx, "relay", ss.SpanInternal)
+	defer rs.End()
+	up, down, upErr, downErr := ss.Relay(client, target, relayOptions(pflag, port, limit, connLimit))
+	reason, class := closeReason(upErr, downErr)
+	ss.CountClose(port, class, time.Since(start))
+	if al == nil {
+		return true
+	}
+	logAccess(al, start, conn, port, user, host, up, down, reason)
+	return true
+}
+
+// relayOptions returns the bounds of the TCP relays of port, timeout is the
+// idle timeout of clients unless client_timeout is set.
+func relayOptions(pflag *uint32, port string, limits ...*ss.Bandwidth) ss.RelayOptions {
+	clientIdle := config.ClientTimeout
+	if clientIdle == 0 {
+		clientIdle = config.Timeout
+	}
+	return ss.RelayOptions{
+		ClientIdle: time.Duration(clientIdle) * time.Second,
+		RemoteIdle: time.Duration(config.RemoteTimeout) * time.Second,
+		Lifetime:   time.Duration(config.MaxLifetime) * time.Second,
+		Flag:       pflag,
+		Port:       port,
+		Limits:     limits,
+	}
+}
+
+// fallbackConn returns the connection keeping the handshake of conn for
+// the fallback, nil if there's no fallback.
+func fallbackConn(conn *ss.Conn) *ss.FallbackConn {
+	c := conn.Conn
+	if rc, ok := c.(*ss.RecordConn); ok {
+		c = rc.Conn
+	}
+	if wc, ok := c.(*ss.WSConn); ok {
+		c = wc.Conn
+	}
+	fc, _ := c.(*ss.FallbackConn)
+	return fc
+}
+
+type PortListener struct {
+	password  string
+	openvpn   string
+	udp       string
+	method    string
+	transport string
+	listener  net.Listener
+	pflag     *uint32
+	limit     *ss.Bandwidth     // shared by all connections of the port
+	users     map[string]string // keys of the users sharing the port
+	handshake *ss.RateLimiter   // handshake_rate of the port
+}
+
+type UDPListener struct {
+	password  string
+	openvpn   string
+	udp       string
+	listeners []*net.UDPConn // one per address of port_listen
+}
+
+// Close closes the sockets of the UDP relay.
+func (ul *UDPListener) Close() {
+	for _, c := range ul.listeners {
+		c.Close()
+	}
+}
+
+type PasswdManager struct {
+	sync.Mutex
+	portListener map[string]*PortListener
+	udpListener  map[string]*UDPListener
+}
+
+func (pm *PasswdManager) add(port string, password [3]string, method, transport string, listener net.Listener, pflag *uint32, limit *ss.Bandwidth, users map[string]string, handshake *ss.RateLimiter) {
+	pm.Lock()
+	pm.portListener[port] = &PortListener{password[0], password[1], password[2], method, transport, listener, pflag, limit, users, handshake}
+	pm.Unlock()
+
+	ss.AddTraffic(port)
+}
+
+func (pm *PasswdManager) addUDP(port string, password [3]string, listeners []*net.UDPConn) {
+	pm.Lock()
+	pm.udpListener[port] = &UDPListener{password[0], password[1], password[2], listeners}
+	pm.Unlock()
+
+	ss.AddTraffic(port)
+}
+
+func (pm *PasswdManager) get(port string) (pl *PortListener, ok bool) {
+	pm.Lock()
+	pl, ok = pm.portListener[port]
+	pm.Unlock()
+	return
+}
+
+func (pm *PasswdManager) getUDP(port string) (pl *UDPListener, ok bool) {
+	pm.Lock()
+	pl, ok = pm.udpListener[port]
+	pm.Unlock()
+	return
+}
+
+func (pm *PasswdManager) del(port string) {
+	pm.stop(port)
+	ss.DelTraffic(port)
+	ss.DelUserTraffic(port)
+}
+
+// drain closes the listeners of port, its open connections are closed and
+// its traffic deleted after the drain timeout, unless it's added again.
+func (pm *PasswdManager) drain(port string) {
+	pl, ok := pm.close(port)
+	if !ok {
+		return
+	}
+	closeAfterDrain(port, pl.pflag, func() {
+		if _, ok := pm.get(port); !ok {
+			ss.DelTraffic(port)
+			ss.DelUserTraffic(port)
+		}
+	})
+}
+
+// closeAll closes the listeners of every port, their connections keep
+// running.
+func (pm *PasswdManager) closeAll() {
+	pm.Lock()
+	ports := make([]string, 0, len(pm.portListener))
+	for port := range pm.portListener {
+		ports = append(ports, port)
+	}
+	pm.Unlock()
+	for _, port := range ports {
+		pm.close(port)
+	}
+}
+
+// stop closes the listeners and connections of port, but keeps its traffic.
+func (pm *PasswdManager) stop(port string) bool {
+	pl, ok := pm.close(port)
+	if ok {
+		atomic.StoreUint32(pl.pflag, 1)
+	}
+	return ok
+}
+
+// close closes the listeners of port, its connections keep running.
+func (pm *PasswdManager) close(port string) (*PortListener, bool) {
+	pl, ok := pm.get(port)
+	if !ok {
+		return nil, false
+	}
+	if upl, ok := pm.getUDP(port); ok {
+		upl.Close()
+	}
+	pl.listener.Close()
+	pm.Lock()
+	delete(pm.portListener, port)
+	delete(pm.udpListener, port)
+	pm.Unlock()
+	return pl, true
+}
+
+// Update port password would first close a port and restart listening on that
+// port. A different approach would be directly change the password used by
+// that port, but that requires **sharing** password between the port listener
+// and password manager.
+func (pm *PasswdManager) updatePortPasswd(port string, password [3]string) {
+	if pl, ok := pm.get(port); !ok {
+		logger.Infof("new port %s added", port)
+	} else {
+		if pl.password != password[0] || pl.openvpn != password[1] || pl.method != config.MethodOf(port) ||
+			pl.transport != config.TransportOf(port) || !sameUsers(pl.users, config.PortUsers[port]) {
+			logger.Infof("closing port %s to update config", port)
+			pl.listener.Close()
+			closeAfterDrain(port, pl.pflag, nil)
+			if udp {
+				if pl, ok := pm.getUDP(port); ok {
+					logger.Infof("[udp]closing port %s to update config", port)
+					pl.Close()
+				}
+			}
+		} else if udp && pl.udp != password[2] {
+			if pl, ok := pm.getUDP(port); ok {
+				logger.Infof("[udp]closing port %s to update config", port)
+				pl.Close()
+			}
+			// the TCP listener is kept, only restart UDP
+			pm.Lock()
+			pl.udp = password[2]
+			pm.Unlock()
+			if password[2] == "ok" && !ss.OverUDP(config.TransportOf(port)) {
+				go runUDP(port, password)
+			}
+			return
+		} else {
+			// nothing to change
+			return
+		}
+	}
+	// run will add the new port listener to passwdManager.
+	// So there maybe concurrent access to passwdManager and we need lock to protect it.
+	go run(port, password)
+}
+
+var probers = ss.NewProbeTracker()
+var replayFilter *ss.ReplayFilter
+
+const replaySaveInterval = time.Minute
+
+// startReplayFilter creates the IV replay filter, bounded to bloom filters
+// of capacity IVs if capacity isn't 0. If path is given the filter is
+// loaded from it and saved to it periodically, so a restart doesn't let old
+// connections be replayed.
+func startReplayFilter(path string, capacity int, fpRate float64) (err error) {
+	if path == "" {
+		if capacity > 0 {
+			replayFilter = ss.NewBloomReplayFilter(capacity, fpRate)
+		} else {
+			replayFilter = ss.NewReplayFilter()
+		}
+		return nil
+	}
+	if capacity > 0 {
+		replayFilter, err = ss.LoadBloomReplayFilter(path, capacity, fpRate)
+	} else {
+		replayFilter, err = ss.LoadReplayFilter(path)
+	}
+	if err != nil {
+		return
+	}
+	go func() {
+		for {
+			time.Sleep(replaySaveInterval)
+			if atomic.LoadInt32(&handedOver) == 1 {
+				return
+			}
+			if err := replayFilter.Save(path); err != nil {
+				logger.Errorf("error saving replay filter %s: %v", path, err)
+			}
+		}
+	}()
+	return nil
+}
+
+var probeLog *ss.ProbeLog
+var capture *ss.Capture
+
+// captureFlow returns a flow to record the session to if decrypted traffic
+// capture is running and the session matches the capture filter.
+func captureFlow(id string, conn, remote net.Conn, port, host string) *ss.CaptureFlow {
+	if !capture.Active() || !capture.Filter.Match(port, ss.HostOf(conn.RemoteAddr()), host) {
+		return nil
+	}
+	client, ok1 := conn.RemoteAddr().(*net.TCPAddr)
+	dest, ok2 := remote.RemoteAddr().(*net.TCPAddr)
+	if !ok1 || !ok2 {
+		return nil
+	}
+	logger.Infof("[%s] capturing decrypted traffic %s<->%s", id, client, host)
+	return capture.NewFlow(client, dest)
+}
+
+var passwdManager = PasswdManager{portListener: map[string]*PortListener{}, udpListener: map[string]*UDPListener{}}
+
+// loadConfig reads the config file and merges fragments from the conf.d
+// directory, then applies environment variables and command line options on
+// top. The config file may be missing if the environment has the options.
+func loadConfig() (*ss.Config, error) {
+	config, err := ss.ParseConfig(configFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		config = &ss.Config{}
+	}
+	if cmdConfig.ConfDir != "" {
+		config.ConfDir = cmdConfig.ConfDir
+	}
+	if config.ConfDir != "" {
+		if err = ss.MergeConfigDir(config, config.ConfDir); err != nil {
+			return nil, err
+		}
+	}
+	if err = config.ApplyEnv(); err != nil {
+		return nil, err
+	}
+	// command line options override passwords from file
+	if err = config.LoadSecrets(); err != nil {
+		return nil, fmt.Errorf("error reading secrets: %v", err)
+	}
+	ss.UpdateConfig(config, &cmdConfig)
+	setDefaults(config)
+	return config, nil
+}
+
+// setDefaults sets the options of c left empty which have a default.
+func setDefaults(c *ss.Config) {
+	if c.Method == "" {
+		c.Method = "aes-256-cfb"
+	}
+	if c.ResolveAutoMethods() {
+		logAutoMethod()
+	}
+	if c.WSPath == "" {
+		c.WSPath = "/"
+	}
+	if c.ProbeLog != "" && c.ProbeLogBytes <= 0 {
+		c.ProbeLogBytes = 64
+	}
+	if c.ReplayFilter && c.ReplayFilterFPRate == 0 {
+		c.ReplayFilterFPRate = 1e-6
+	}
+}
+
+// warnUnknownOptions logs the options of the config files of c the server
+// doesn't know, usually misspelled.
+func warnUnknownOptions(c *ss.Config) {
+	for _, name := range c.UnknownOptions() {
+		logger.Warnf("unknown option %s", name)
+	}
+}
+
+var reloadLock sync.Mutex
+
+// updatePasswd reloads the config, clearing the traffic used against the
+// quota of every port if resetQuotas is set.
+func updatePasswd(resetQuotas bool) {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	logger.Info("reloading config")
+	newconfig, err := loadConfig()
+	if err != nil {
+		logger.Errorf("error parsing config file %s to reload: %v", configFile, err)
+		return
+	}
+	warnUnknownOptions(newconfig)
+	if err = checkLogConfig(newconfig); err != nil {
+		logger.Error(err)
+		return
+	}
+	if err = newconfig.CheckMethods(); err != nil {
+		logger.Error(err)
+		return
+	}
+	if err = newconfig.CheckTransports(); err != nil {
+		logger.Error(err)
+		return
+	}
+	if err = setupTLS(newconfig); err != nil {
+		logger.Error("error loading tls certificate:", err)
+		return
+	}
+	if err = setDestPolicy(newconfig); err != nil {
+		logger.Error(err)
+		return
+	}
+	if err = setResolver(newconfig); err != nil {
+		logger.Error(err)
+		return
+	}
+	if err = checkIPPreference(newconfig); err != nil {
+		logger.Error(err)
+		return
+	}
+	if err = ss.SetOutbound(newconfig.OutboundBind, newconfig.OutboundInterface); err != nil {
+		logger.Error(err)
+		return
+	}
+	if err = setForward(newconfig); err != nil {
+		logger.Error(err)
+		return
+	}
+	if err = checkTrafficWebhook(newconfig); err != nil {
+		logger.Error(err)
+		return
+	}
+	if err = setSourceLimits(newconfig); err != nil {
+		logger.Error(err)
+		return
+	}
+	if err = checkMaxConns(newconfig); err != nil {
+		logger.Error(err)
+		return
+	}
+	if err = setTracing(newconfig); err != nil {
+		logger.Error(err)
+		return
+	}
+	if err = checkDestPorts(newconfig); err != nil {
+		logger.Error(err)
+		return
+	}
+	if err = checkPortRotate(newconfig); err != nil {
+		logger.Error(err)
+		return
+	}
+	if err = checkPortListen(newconfig); err != nil {
+		logger.Error(err)
+		return
+	}
+	if err = ss.CheckProxyTrusted(newconfig.ProxyProtocol); err != nil {
+		logger.Error(err)
+		return
+	}
+	if err = ss.SetMPTCP(newconfig.MPTCP); err != nil {
+		logger.Error(err)
+		return
+	}
+	if err = ss.SetTCPOptions(newconfig.TCP); err != nil {
+		logger.Error(err)
+		return
+	}
+	if err = setAccessLog(newconfig); err != nil {
+		logger.Errorf("error opening access log %s: %v", newconfig.AccessLog, err)
+		return
+	}
+	if err = setupGeoIP(newconfig); err != nil {
+		logger.Error(err)
+		return
+	}
+	if err = loadACL(newconfig.ACL); err != nil {
+		logger.Errorf("error loading acl %s: %v", newconfig.ACL, err)
+		return
+	}
+	if err = ss.SetNATLimit(newconfig.UDPNATMax, newconfig.UDPNATEvict); err != nil {
+		logger.Error(err)
+		return
+	}
+	if err = ss.SetUDPMaxSize(newconfig.UDPMaxSize); err != nil {
+		logger.Error(err)
+		return
+	}
+	ss.SetUDPTimeout(time.Duration(newconfig.UDPTimeout) * time.Second)
+	oldconfig := config
+	config = newconfig
+
+	if err = unifyPortPassword(config); err != nil {
+		logger.Error(err)
+		config = oldconfig
+		return
+	}
+	if err = checkPortUsers(config); err != nil {
+		logger.Error(err)
+		config = oldconfig
+		return
+	}
+	changed := changedOptions(oldconfig, config)
+	if err = applyLogConfig(config); err != nil {
+		logger.Error(err)
+	}
+	ss.SetBufferAccounting(config.BufferDebug)
+	// reset quotas first, so ports closed over quota are started again
+	if !resetQuotas {
+		resetChangedQuotas(oldconfig)
+	}
+	applyQuotas(resetQuotas)
+	applyMaxConns()
+	moved := applyRotations()
+	proxyChanged := strings.Join(oldconfig.ProxyProtocol, " ") != strings.Join(config.ProxyProtocol, " ")
+	for port := range config.PortPassword {
+		if proxyChanged || strings.Join(oldconfig.PortListen[port], " ") != strings.Join(config.PortListen[port], " ") {
+			moved[port] = true
+		}
+	}
+	for port, passwd := range config.PortPassword {
+		if pl, ok := passwdManager.get(port); ok {
+			pl.limit.SetRate(speedLimitOf(port))
+			pl.handshake.SetRate(config.HandshakeRate, 0)
+		}
+		if !moved[port] || !restartPort(port) {
+			passwdManager.updatePortPasswd(port, passwd)
+		}
+		if oldconfig.PortPassword != nil {
+			delete(oldconfig.PortPassword, port)
+		}
+	}
+	// port password still left in the old config should be closed, their
+	// connections drain before Traffic is deleted
+	for port, _ := range oldconfig.PortPassword {
+		logger.Infof("closing port %s as it's deleted", port)
+		passwdManager.drain(port)
+		forgetBind(port)
+	}
+	logReload(changed)
+}
+
+func waitSignal() {
+	var sigChan = make(chan os.Signal, 1)
+	sigs := []os.Signal{syscall.SIGHUP, syscall.SIGTERM, os.Interrupt}
+	if upgradeSignal != nil {
+		sigs = append(sigs, upgradeSignal)
+	}
+	if reloadSignal != nil {
+		sigs = append(sigs, reloadSignal)
+	}
+	signal.Notify(sigChan, sigs...)
+	service.Notify(serviceName, sigChan)
+	for sig := range sigChan {
+		switch {
+		case sig == syscall.SIGHUP:
+			if atomic.LoadInt32(&shuttingDown) == 0 {
+				sdNotify("RELOADING=1")
+				updatePasswd(true)
+				sdNotify("READY=1")
+			}
+		case sig == reloadSignal:
+			if atomic.LoadInt32(&shuttingDown) == 0 {
+				sdNotify("RELOADING=1")
+				updatePasswd(false)
+				sdNotify("READY=1")
+			}
+		case sig == upgradeSignal:
+			if atomic.LoadInt32(&shuttingDown) == 0 {
+				go upgrade()
+			}
+		case atomic.CompareAndSwapInt32(&shuttingDown, 0, 1):
+			go shutdown(sig)
+		default:
+			// a second signal doesn't wait for the connections
+			logger.Infof("caught signal %v again, exit", sig)
+			os.Exit(1)
+		}
+	}
+}
+
+// confDirStamp summarizes names, sizes and modification times of the
+// fragments in dir, so changes can be detected by comparing stamps.
+func confDirStamp(dir string) string {
+	files, err := ss.ConfDirFiles(dir)
+	if err != nil {
+		return ""
+	}
+	var stamp []string
+	for _, file := range files {
+		if fi, err := os.Stat(file); err == nil {
+			stamp = append(stamp, fmt.Sprintf("%s:%d:%d", file, fi.Size(), fi.ModTime().UnixNano()))
+		}
+	}
+	return strings.Join(stamp, "|")
+}
+
+// watchConfDir reloads config when a fragment in dir is added, removed or
+// modified.
+func watchConfDir(dir string) {
+	const interval = 5 * time.Second
+	last := confDirStamp(dir)
+	for {
+		time.Sleep(interval)
+		if stamp := confDirStamp(dir); stamp != last {
+			logger.Infof("config directory %s changed", dir)
+			last = stamp
+			updatePasswd(false)
+		}
+	}
+}
+
+// secretsStamp summarizes sizes and modification times of the secret files
+// of the config, like confDirStamp.
+func secretsStamp() string {
+	var stamp []string
+	for _, file := range config.SecretFiles() {
+		if fi, err := os.Stat(file); err == nil {
+			stamp = append(stamp, fmt.Sprintf("%s:%d:%d", file, fi.Size(), fi.ModTime().UnixNano()))
+		}
+	}
+	return strings.Join(stamp, "|")
+}
+
+// watchSecrets reloads config when a secret file is rotated, e.g. a
+// kubernetes secret updated in place, so new passwords apply without a
+// restart. Environment variables can't change, they need one.
+func watchSecrets() {
+	const interval = 10 * time.Second
+	last := secretsStamp()
+	for {
+		time.Sleep(interval)
+		if stamp := secretsStamp(); stamp != last {
+			logger.Info("secret files changed")
+			last = stamp
+			updatePasswd(false)
+			// the reload may reference other files
+			last = secretsStamp()
+		}
+	}
+}
+
+// speedLimitOf returns the throughput limit of port in Mbit/s, 0 for none.
+func speedLimitOf(port string) float64 {
+	if mbps, ok := config.PortSpeedLimit[port]; ok {
+		return mbps
+	}
+	return config.SpeedLimit
+}
+
+// raiseFileLimit raises the open files limit of the process to max, or to
+// the hard limit if it's 0.
+func raiseFileLimit(max int) {
+	n, err := ss.RaiseFileLimit(uint64(max))
+	if err != nil && max > 0 {
+		logger.Warnf("raising the open files limit to %d: %v", max, err)
+	}
+	if n > 0 {
+		logger.Infof("open files limit %d", n)
+	}
+}
+
+// udpTimeoutOf returns the NAT timeout of UDP relay clients of port, 0 if
+// it's not set for the port.
+func udpTimeoutOf(port string) time.Duration {
+	return time.Duration(config.PortUDPTimeout[port]) * time.Second
+}
+
+func run(port string, password [3]string) {
+	if ss.OverQuota(port) {
+		logger.Infof("port %s has used up its quota, not listening", port)
+		return
+	}
+	ln, ok := listenTCP(port, password)
+	if !ok {
+		return
+	}
+	if len(config.ProxyProtocol) > 0 {
+		// checked before the config is used
+		ln, _ = ss.NewProxyListener(ln, config.ProxyProtocol)
+	}
+	var flag uint32 = 0
+	method := config.MethodOf(port)
+	transport := config.TransportOf(port)
+	keys := config.PortUsers[port]
+	limit := ss.NewBandwidth(speedLimitOf(port))
+	hsLimiter := ss.NewRateLimiter(config.HandshakeRate, 0)
+	passwdManager.add(port, password, method, transport, ln, &flag, limit, keys, hsLimiter)
+	// UDP is started after TCP is bound, so it listens on the same port if
+	// TCP is on a fallback port. QUIC and KCP have taken the UDP port.
+	if udp && password[2] == "ok" && !ss.OverUDP(transport) {
+		go runUDP(port, password)
+	}
+	var cipher *ss.Cipher
+	var users *ss.Users
+	logger.Infof("server listening port %v ...", port)
+	for {
+		ss.WaitFileLimit()
+		conn, err := ln.Accept()
+		if ss.IsFileLimit(err) {
+			d := ss.FileLimitReached()
+			logger.Warnf("accept on port %s: %v, pausing for %v", port, err, d)
+			time.Sleep(d)
+			continue
+		}
+		if err != nil {
+			// listener maybe closed to update password
+			logger.Debugf("accept error: %v", err)
+			return
+		}
+		// Check the rate before doing any crypto work for this connection.
+		ip := ss.HostOf(conn.RemoteAddr())
+		if !hsLimiter.Allow(ip) {
+			logger.Debugf("handshake rate exceeded for %s on port %s", conn.RemoteAddr(), port)
+			ss.CountReject(port, ss.RejectRateLimit)
+			conn.Close()
+			continue
+		}
+		if !sources.Open(ip) {
+			logger.Debugf("%s over its limits or banned, closing connection to port %s", conn.RemoteAddr(), port)
+			ss.CountReject(port, ss.RejectSource)
+			conn.Close()
+			continue
+		}
+		if config.Tarpit && probers.Flagged(ip) {
+			ss.CountReject(port, ss.RejectProber)
+			go func() {
+				ss.Tarpit(conn)
+				sources.Close(ip)
+			}()
+			continue
+		}
+		ss.ApplyTCPOptions(conn)
+		// Creating cipher upon first connection.
+		if cipher == nil && users == nil {
+			if len(keys) > 0 {
+				logger.Infof("creating ciphers for %d users of port %s", len(keys), port)
+				users, err = ss.NewUsers(method, password[0], keys)
+			} else {
+				logger.Info("creating cipher for port:", port)
+				cipher, err = ss.NewCipher(method, password[0])
+			}
+			if err != nil {
+				logger.Errorf("error generating cipher for port: %s %v", port, err)
+				conn.Close()
+				sources.Close(ip)
+				continue
+			}
+		}
+		if tc := tlsConfig(); tc != nil && ss.IsTLS(transport) {
+			// the fallback relays visitors to the website decrypted
+			conn = tls.Server(conn, tc)
+		}
+		if config.Fallback != "" {
+			conn = ss.NewFallbackConn(conn)
+		}
+		if ss.IsWS(transport) {
+			// under the fallback, so visitors get the decoy's response
+			conn = ss.NewWSServerConn(conn, config.WSPath)
+		}
+		if probeLog != nil {
+			conn = ss.NewRecordConn(conn, config.ProbeLogBytes)
+		}
+		var c *ss.Conn
+		if users != nil {
+			c = ss.NewUsersConn(conn, users)
+		} else {
+			c = ss.NewConn(conn, cipher.Copy())
+		}
+		c.SetReplayFilter(replayFilter)
+		c.SetFirstFlight(config.FirstFlightPadding, time.Duration(config.ResponseJitter)*time.Millisecond)
+		if !openConn(port) {
+			logger.Debugf("port %s has its max connections open, closing connection from %s", port, conn.RemoteAddr())
+			ss.CountReject(port, ss.RejectMaxConns)
+			conn.Close()
+			sources.Close(ip)
+			continue
+		}
+		go func() {
+			handleConnection(context.Background(), c, port, &flag, password[1], limit)
+			closeConn(port)
+			sources.Close(ip)
+		}()
+	}
+}
+
+func runUDP(port string, password [3]string) {
+	conns, ok := listenUDP(port, password)
+	if !ok || len(conns) == 0 {
+		return
+	}
+	ul := &UDPListener{listeners: conns}
+	passwdManager.addUDP(port, password, conns)
+	logger.Infof("server listening udp port %v ...", port)
+	defer ul.Close()
+	method := config.MethodOf(port)
+	if !ss.UDPSupported(method) {
+		logger.Warnf("UDP relay not supported by method %s on port %s", method, port)
+		return
+	}
+	if len(config.PortUsers[port]) > 0 {
+		logger.Warnf("UDP relay not supported on port %s shared by users", port)
+		return
+	}
+	cipher, err := ss.NewCipher(method, password[0])
+	if err != nil {
+		logger.Errorf("error generating cipher for udp port: %s %v", port, err)
+		return
+	}
+	pl, limited := passwdManager.get(port)
+	var wg sync.WaitGroup
+	for _, conn := range conns {
+		c := ss.NewUDPConn(conn, cipher.Copy())
+		c.SetPort(port)
+		if limited {
+			// share the limit of the TCP port
+			c.SetBandwidth(pl.limit)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ss.HandleUDPConnection(c, password[1])
+		}()
+	}
+	wg.Wait()
+}
+
+func enoughOptions(config *ss.Config) bool {
+	return config.ServerPort != 0 && config.Password != ""
+}
+
+func unifyPortPassword(config *ss.Config) (err error) {
+	if len(config.PortPassword) == 0 { // this handles both nil PortPassword and empty one
+		if enoughOptions(config) {
+			port := strconv.Itoa(config.ServerPort)
+			config.PortPassword = map[string][3]string{port: [3]string{config.Password}}
+		}
+	} else {
+		if config.Password != "" || config.ServerPort != 0 {
+			fmt.Fprintln(os.Stderr, "given port_password, ignore server_port and password option")
+		}
+	}
+	if err = config.MergeTenants(); err != nil {
+		return
+	}
+	mergeAPIPorts(config)
+	return
+}
+
+// prepareConfig checks c and completes it before the dry run prints it: the
+// network of the listeners, the TLS certificate, and the ports of
+// server_port, the tenants and the management API.
+func prepareConfig(c *ss.Config) error {
+	switch c.Net {
+	case 4:
+		netTcp = "tcp4"
+		netUdp = "udp4"
+	case 6:
+		netTcp = "tcp6"
+		netUdp = "udp6"
+	default:
+		netTcp = "tcp"
+		netUdp = "udp"
+	}
+	if err := c.CheckMethods(); err != nil {
+		return err
+	}
+	if err := c.CheckTransports(); err != nil {
+		return err
+	}
+	if err := setupTLS(c); err != nil {
+		return fmt.Errorf("error loading tls certificate: %v", err)
+	}
+	if used := c.Transports(); udp && (used[ss.TransportQUIC] || used[ss.TransportKCP]) {
+		logger.Warn("UDP relay is disabled on the quic and kcp ports, they listen on the UDP ports")
+	}
+	if err := unifyPortPassword(c); err != nil {
+		return err
+	}
+	return checkPortUsers(c)
+}
+
+// applyConfig checks the other options of c and applies them to the
+// shadowsocks package and the globals of the server, before the ports are
+// started.
+func applyConfig(c *ss.Config) (err error) {
+	ss.SetBufferAccounting(c.BufferDebug)
+	if c.Fallback != "" && c.Fallback != "discard" {
+		if _, _, err = net.SplitHostPort(c.Fallback); err != nil {
+			return fmt.Errorf("fallback must be \"discard\" or host:port: %v", err)
+		}
+	}
+	if oc := c.OnlineConfig; oc != nil {
+		if oc.Address == "" || oc.Server == "" {
+			return errors.New("online_config needs address and server")
+		}
+		if (oc.Cert == "") != (oc.Key == "") {
+			return errors.New("online_config needs both cert and key")
+		}
+	}
+	if err = setResolver(c); err != nil {
+		return
+	}
+	if err = checkIPPreference(c); err != nil {
+		return
+	}
+	if err = setForward(c); err != nil {
+		return
+	}
+	if err = checkTrafficWebhook(c); err != nil {
+		return
+	}
+	if err = setSourceLimits(c); err != nil {
+		return
+	}
+	if err = checkMaxConns(c); err != nil {
+		return
+	}
+	if err = checkSSManager(c); err != nil {
+		return
+	}
+	if err = setTracing(c); err != nil {
+		return
+	}
+	if err = checkDestPorts(c); err != nil {
+		return
+	}
+	if err = checkPortRotate(c); err != nil {
+		return
+	}
+	if err = checkPortListen(c); err != nil {
+		return
+	}
+	if err = checkReusePort(c); err != nil {
+		return
+	}
+	if err = ss.SetOutbound(c.OutboundBind, c.OutboundInterface); err != nil {
+		return
+	}
+	if err = ss.CheckProxyTrusted(c.ProxyProtocol); err != nil {
+		return
+	}
+	if err = setAccessLog(c); err != nil {
+		return fmt.Errorf("error opening access log %s: %v", c.AccessLog, err)
+	}
+	if c.FastOpen {
+		if err = ss.CheckFastOpen(); err != nil {
+			return
+		}
+	}
+	if err = ss.SetMPTCP(c.MPTCP); err != nil {
+		return
+	}
+	if err = ss.SetTCPOptions(c.TCP); err != nil {
+		return
+	}
+	ss.NATSourceAllowed = sources.OpenNAT
+	ss.NATSourceClosed = sources.CloseNAT
+	ss.UDPResolve = resolveUDPDest
+	if err = setDestPolicy(c); err != nil {
+		return
+	}
+	ss.UDPDestAllowed = allowDest
+	if err = setupGeoIP(c); err != nil {
+		return
+	}
+	ss.UDPCountryAllowed = allowUDPCountry
+	if err = loadACL(c.ACL); err != nil {
+		return fmt.Errorf("error loading acl %s: %v", c.ACL, err)
+	}
+	ss.UDPACLAllowed = allowUDPACL
+	ss.UDPDestPortAllowed = allowUDPDestPort
+	if err = ss.SetNATLimit(c.UDPNATMax, c.UDPNATEvict); err != nil {
+		return
+	}
+	if err = ss.SetUDPMaxSize(c.UDPMaxSize); err != nil {
+		return
+	}
+	ss.SetUDPTimeout(time.Duration(c.UDPTimeout) * time.Second)
+	ss.UDPTimeoutOf = udpTimeoutOf
+	return nil
+}
+
+var configFile string
+var config *ss.Config
+var cmdConfig ss.Config
+var netTcp, netUdp string
+var udp bool
+
+func writePidFile(pidFile string) error {
+	return ioutil.WriteFile(pidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+}
+
+// Main runs the server with command line arguments args, which don't include
+// the program name.
+func Main(args []string) {
+	var printVer, jsonVer, dryRun, validate, benchCiphers bool
+	var core int
+	var pidFile, serviceAction string
+	var daemon bool
+	var captureFile, captureFilter string
+	var captureTime time.Duration
+
+	if len(args) > 0 && args[0] == "port" {
+		os.Exit(manage.PortCommand(args[1:]))
+	}
+	if len(args) > 0 && args[0] == "selftest" {
+		os.Exit(selfTest(args[1:]))
+	}
+
+	fs := flag.NewFlagSet("server", flag.ExitOnError)
+
+	fs.BoolVar(&printVer, "version", false, "print version")
+	fs.BoolVar(&jsonVer, "json", false, "print version in JSON, used with -version")
+	fs.StringVar(&configFile, "c", "config.json", "specify config file, JSON, or YAML or TOML by its extension")
+	fs.StringVar(&cmdConfig.ConfDir, "confdir", "", "directory of config fragments (*.json, *.yaml, *.toml) merged on top of config file")
+	fs.StringVar(&cmdConfig.Password, "k", "", "password")
+	fs.IntVar(&cmdConfig.ServerPort, "p", 0, "server port")
+	fs.IntVar(&cmdConfig.Timeout, "t", 0, "connection timeout (in seconds), overrides timeout in config file")
+	fs.StringVar(&cmdConfig.Method, "m", "", "encryption method, default: aes-256-cfb")
+	fs.BoolVar(&cmdConfig.AllowInsecureCiphers, "allow-insecure-ciphers", false, "allow the broken or weak methods table, rc4, rc4-md5, des-cfb, bf-cfb and cast5-cfb")
+	fs.IntVar(&cmdConfig.Net, "n", 0, "ipv4(4) or ipv6(6) or both(0), default is both")
+	fs.IntVar(&cmdConfig.ReusePort, "reuseport", 0, "accept the connections of each port with this many sockets sharing it by SO_REUSEPORT (Linux only)")
+	fs.IntVar(&cmdConfig.HandshakeRate, "hr", 0, "max new handshakes per second from one source IP on each port, 0 means no limit")
+	fs.BoolVar(&cmdConfig.Tarpit, "tarpit", false, "trickle-read connections from detected probers instead of closing them")
+	fs.BoolVar(&cmdConfig.Mux, "mux", false, "accept clients multiplexing their relays over a few connections")
+	fs.BoolVar(&cmdConfig.UoT, "uot", false, "accept clients relaying UDP over TCP connections")
+	fs.StringVar(&cmdConfig.Fallback, "fallback", "", "on failed handshakes, \"discard\" to read until the client times out, or host:port of a decoy server to relay the connection to")
+	fs.StringVar(&cmdConfig.Transport, "transport", "", "transport of TCP relays: tcp (default), ws, tls, wss, quic or kcp")
+	fs.IntVar(&core, "core", 0, "maximum number of CPU cores to use, default is determinied by logical CPUs on server")
+	fs.StringVar(&cmdConfig.DestPolicy, "dest-policy", "", "networks clients may not connect to: legacy (default, loopback and 10.8.0.0/16), private (also private and link-local networks) or none")
+	fs.StringVar(&cmdConfig.ACL, "acl", "", "shadowsocks-libev style ACL file of destinations to relay or reject, reloaded on SIGHUP")
+	fs.StringVar(&cmdConfig.DNSServer, "dns", "", "resolve destination hostnames with this DNS server (host:port, tcp://, tls:// or https:// URL) instead of the system resolver")
+	fs.BoolVar(&udp, "u", false, "UDP Relay")
+	fs.BoolVar(&debug, "d", false, "print debug message")
+	fs.StringVar(&pidFile, "pidfile", "", "write process id to this file")
+	fs.StringVar(&serviceAction, "service", "", "install, uninstall, start or stop the system service (windows, darwin) running the server with the other options")
+	fs.BoolVar(&daemon, "daemon", false, "run in the background detached from the terminal, logging to -log-file (not on windows)")
+	fs.BoolVar(&dryRun, "dry-run", false, "print the effective configuration and exit")
+	fs.BoolVar(&benchCiphers, "bench", false, "measure the throughput of every method on this CPU, run their self-tests and exit")
+	fs.BoolVar(&validate, "validate", false, "check the configuration, print every problem found and exit")
+	fs.StringVar(&captureFile, "capture", "", "DEBUG ONLY: write decrypted traffic to this pcap file")
+	fs.StringVar(&captureFilter, "capture-filter", "", "sessions to capture, e.g. port=8388,client=1.2.3.4,dest=example.com:443")
+	fs.DurationVar(&captureTime, "capture-time", 10*time.Minute, "stop capturing decrypted traffic after this duration")
+	logOpts = ss.AddLogFlags(fs)
+	fs.Parse(args)
+	fs.Visit(func(f *flag.Flag) { logFlags[f.Name] = true })
+
+	if benchCiphers {
+		os.Exit(cipherBench())
+	}
+	if printVer {
+		if jsonVer {
+			ss.PrintVersionJSON()
+		} else {
+			ss.PrintVersion()
+		}
+		os.Exit(0)
+	}
+	if serviceAction != "" {
+		if err := service.Control(serviceName, serviceAction, service.Command(fs, args, "service")); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if daemon {
+		if err := service.Daemon(logOpts.File); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	if err := logOpts.Setup(debug); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	var err error
+	config, err = loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error loading config %s: %v\n", configFile, err)
+		os.Exit(1)
+	}
+	if validate {
+		os.Exit(validateConfig(os.Stdout, config))
+	}
+	if err = checkLogConfig(config); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err = applyLogConfig(config); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	warnUnknownOptions(config)
+	if err = prepareConfig(config); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if dryRun {
+		if err = printEffectiveConfig(os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if config.ProbeLog != "" {
+		if probeLog, err = ss.OpenProbeLog(config.ProbeLog); err != nil {
+			fmt.Fprintf(os.Stderr, "error opening probe log %s: %v\n", config.ProbeLog, err)
+			os.Exit(1)
+		}
+	}
+	if err = applyConfig(config); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if config.MaxOpenFiles < 0 {
+		fmt.Fprintln(os.Stderr, "max_open_files must not be negative")
+		os.Exit(1)
+	}
+	raiseFileLimit(config.MaxOpenFiles)
+	if err = setActivation(config); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if config.ReplayFilter {
+		if config.ReplayFilterCapacity < 0 || config.ReplayFilterFPRate <= 0 || config.ReplayFilterFPRate >= 1 {
+			fmt.Fprintln(os.Stderr, "replay_filter_capacity must not be negative and replay_filter_fp_rate must be between 0 and 1")
+			os.Exit(1)
+		}
+		if err = startReplayFilter(config.ReplayFilterFile, config.ReplayFilterCapacity, config.ReplayFilterFPRate); err != nil {
+			fmt.Fprintf(os.Stderr, "error loading replay filter %s: %v\n", config.ReplayFilterFile, err)
+			os.Exit(1)
+		}
+	}
+	if captureFile != "" {
+		filter, err := ss.ParseCaptureFilter(captureFilter)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if capture, err = ss.OpenCapture(captureFile, filter, captureTime); err != nil {
+			fmt.Fprintf(os.Stderr, "error creating capture file %s: %v\n", captureFile, err)
+			os.Exit(1)
+		}
+		logger.Warnf("writing decrypted traffic to %s for %v", captureFile, captureTime)
+	}
+	if core > 0 {
+		runtime.GOMAXPROCS(runtime.NumCPU())
+	}
+	if pidFile == "" {
+		pidFile = config.PidFile
+	}
+	if pidFile != "" {
+		if err = writePidFile(pidFile); err != nil {
+			fmt.Fprintf(os.Stderr, "error writing pid file %s: %v\n", pidFile, err)
+			os.Exit(1)
+		}
+	}
+	ss.NewTraffic()
+	if config.TrafficFile != "" {
+		if err = ss.LoadTraffic(config.TrafficFile); err != nil {
+			fmt.Fprintf(os.Stderr, "error loading traffic %s: %v\n", config.TrafficFile, err)
+			os.Exit(1)
+		}
+	}
+	go saveTrafficPeriodically()
+	go exportUsage()
+	ss.QuotaExceeded = closeOverQuota
+	applyQuotas(false)
+	applyMaxConns()
+	if config.ManagerAddress != "" {
+		go runManager(config.ManagerAddress)
+	}
+	if config.SSManagerAddress != "" {
+		go runSSManager(config.SSManagerAddress)
+	}
+	if config.DebugAddress != "" {
+		go runDebug(config.DebugAddress)
+	}
+	if config.OnlineConfig != nil {
+		go runOnlineConfig(config.OnlineConfig)
+	}
+	if config.ConfDir != "" {
+		go watchConfDir(config.ConfDir)
+	}
+	go watchSecrets()
+	applyRotations()
+	for port, password := range config.PortPassword {
+		go run(port, password)
+	}
+	go keepWatchdog()
+	sdNotify("READY=1")
+	notifyUpgraded()
+
+	waitSignal()
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/shadowsocks/shadowsocks-go/service"
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+const defaultShutdownTimeout = 30 * time.Second
+
+// shuttingDown is set once SIGTERM or SIGINT is caught, operate by
+// sync/atomic.
+var shuttingDown int32
+
+// shutdownTimeout returns how long the server waits for open connections
+// when it's stopped.
+func shutdownTimeout() time.Duration {
+	if config.ShutdownTimeout <= 0 {
+		return defaultShutdownTimeout
+	}
+	return time.Duration(config.ShutdownTimeout) * time.Second
+}
+
+// shutdown stops accepting connections, waits up to the shutdown timeout for
+// the open ones to finish, then saves the traffic of every port to the stats
+// archive, reports and saves the traffic, saves the replay filter and the
+// capture and exports the traces before exiting. Shutting down after an
+// upgrade, the traffic is only reported, the new server keeps it.
+func shutdown(sig os.Signal) {
+	// no reload or management API change from now on
+	reloadLock.Lock()
+	sdNotify("STOPPING=1")
+	d := shutdownTimeout()
+	logger.Infof("caught signal %v, shutting down, waiting up to %v for %d connections",
+		sig, d, atomic.LoadUint64(&connCnt))
+	passwdManager.closeAll()
+	deadline := time.Now().Add(d)
+	for atomic.LoadUint64(&connCnt) > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if n := atomic.LoadUint64(&connCnt); n > 0 {
+		logger.Warnf("closing %d connections still open", n)
+	}
+
+	// upgraded, the new server goes on counting the traffic
+	upgraded := atomic.LoadInt32(&handedOver) == 1
+	if !upgraded {
+		for port := range config.PortPassword {
+			archiveTraffic(port, config.TenantOf(port))
+		}
+	}
+	exportUsageNow()
+	saveTraffic()
+	ss.FlushTraces()
+	if replayFilter != nil && config.ReplayFilterFile != "" && !upgraded {
+		if err := replayFilter.Save(config.ReplayFilterFile); err != nil {
+			logger.Errorf("error saving replay filter %s: %v", config.ReplayFilterFile, err)
+		}
+	}
+	if capture != nil {
+		capture.Close()
+	}
+	if probeLog != nil {
+		probeLog.Close()
+	}
+	logger.Info("shut down")
+	service.Exit(0)
+}
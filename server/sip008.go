@@ -0,0 +1,118 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+// The SIP008 online config document of each port is served at
+// /sip008/{port}/{token}, see https://shadowsocks.org/doc/sip008.html. The
+// token is derived from the password of the port, so the URL can only be
+// guessed by who knows the password, and changes with it. The management
+// API returns the path of each port.
+
+type sip008Server struct {
+	ID         string `json:"id"`
+	Remarks    string `json:"remarks,omitempty"`
+	Server     string `json:"server"`
+	ServerPort int    `json:"server_port"`
+	Password   string `json:"password"`
+	Method     string `json:"method"`
+	Plugin     string `json:"plugin,omitempty"`
+	PluginOpts string `json:"plugin_opts,omitempty"`
+}
+
+type sip008Document struct {
+	Version int            `json:"version"`
+	Servers []sip008Server `json:"servers"`
+	// traffic counted against the quota of the port, if there's one
+	BytesUsed      *int64 `json:"bytes_used,omitempty"`
+	BytesRemaining *int64 `json:"bytes_remaining,omitempty"`
+}
+
+func sip008Token(port, password string) string {
+	mac := hmac.New(sha256.New, []byte(password))
+	mac.Write([]byte("sip008 " + port))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// sip008Path returns the path of the online config document of port.
+func sip008Path(port, password string) string {
+	return "/sip008/" + port + "/" + sip008Token(port, password)
+}
+
+// serverID returns the UUID of the server of port, which clients use to
+// track it across updates of the document.
+func serverID(host, port string) string {
+	sum := sha256.Sum256([]byte(host + ":" + port))
+	sum[6] = sum[6]&0x0f | 0x80 // version 8, custom
+	sum[8] = sum[8]&0x3f | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+func handleSIP008(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	port, token, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/sip008/"), "/")
+	reloadLock.Lock()
+	passwd, ok := config.PortPassword[port]
+	oc := config.OnlineConfig
+	method := config.MethodOf(port)
+	reloadLock.Unlock()
+	if !ok || oc == nil || !hmac.Equal([]byte(token), []byte(sip008Token(port, passwd[0]))) {
+		http.Error(w, "no such document", http.StatusNotFound)
+		return
+	}
+
+	listen, _ := strconv.Atoi(boundPort(port))
+	srv := sip008Server{
+		ID:         serverID(oc.Server, port),
+		Remarks:    oc.Remarks,
+		Server:     oc.Server,
+		ServerPort: listen,
+		Password:   passwd[0],
+		Method:     method,
+	}
+	plugin, ok := oc.Plugins[port]
+	if !ok {
+		plugin = oc.Plugins["*"]
+	}
+	if plugin != nil {
+		srv.Plugin, srv.PluginOpts = plugin.Plugin, plugin.PluginOpts
+	}
+	doc := sip008Document{Version: 1, Servers: []sip008Server{srv}}
+	if used, quota := ss.GetQuota(port); quota > 0 {
+		remaining := quota - used
+		if remaining < 0 {
+			remaining = 0
+		}
+		doc.BytesUsed, doc.BytesRemaining = &used, &remaining
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, doc)
+}
+
+// runOnlineConfig serves the SIP008 documents, over HTTPS if a certificate
+// is configured.
+func runOnlineConfig(oc *ss.OnlineConfig) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sip008/", handleSIP008)
+	var err error
+	if oc.Cert != "" {
+		logger.Infof("SIP008 online config listening at %s ...", oc.Address)
+		err = http.ListenAndServeTLS(oc.Address, oc.Cert, oc.Key, mux)
+	} else {
+		logger.Warnf("SIP008 online config listening at %s without TLS, passwords are sent in the clear unless a proxy terminates TLS", oc.Address)
+		err = http.ListenAndServe(oc.Address, mux)
+	}
+	logger.Error("SIP008 online config:", err)
+}
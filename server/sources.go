@@ -0,0 +1,71 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"expvar"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+const (
+	defaultBanWindow = 10 * time.Minute
+	defaultBanTime   = time.Hour
+)
+
+// sources limits what each client IP uses across all ports, and bans the
+// ones failing handshakes.
+var sources = ss.NewSourceLimiter()
+
+func init() {
+	expvar.Publish("banned_sources", expvar.Func(func() interface{} { return sources.Banned() }))
+	sources.OnBan = banAtFirewall
+}
+
+// setSourceLimits sets the limits of each client IP from the source_*
+// options of c, and the bans of the ban_* options.
+func setSourceLimits(c *ss.Config) error {
+	if c.SourceMaxConns < 0 || c.SourceConnRate < 0 || c.SourceMaxUDP < 0 || c.SourceBanTime < 0 {
+		return errors.New("source_max_conns, source_conn_rate, source_max_udp and source_ban_time must not be negative")
+	}
+	if c.BanFailures < 0 || c.BanWindow < 0 || c.BanTime < 0 {
+		return errors.New("ban_failures, ban_window and ban_time must not be negative")
+	}
+	if c.BanCommand != "" {
+		if _, err := exec.LookPath(strings.Fields(c.BanCommand)[0]); err != nil {
+			return fmt.Errorf("ban_command: %v", err)
+		}
+	}
+	sources.SetLimits(c.SourceMaxConns, c.SourceConnRate, c.SourceMaxUDP, time.Duration(c.SourceBanTime)*time.Second)
+	window, banTime := defaultBanWindow, defaultBanTime
+	if c.BanWindow > 0 {
+		window = time.Duration(c.BanWindow) * time.Second
+	}
+	if c.BanTime > 0 {
+		banTime = time.Duration(c.BanTime) * time.Second
+	}
+	sources.SetFailureBan(c.BanFailures, window, banTime)
+	return nil
+}
+
+// banAtFirewall runs the ban_command for ip banned for d, so its traffic is
+// dropped before reaching the server. The command is run without a shell.
+func banAtFirewall(ip string, d time.Duration) {
+	cmd := config.BanCommand
+	if cmd == "" {
+		return
+	}
+	r := strings.NewReplacer("{ip}", ip, "{seconds}", strconv.Itoa(int(d/time.Second)))
+	args := strings.Fields(cmd)
+	for i, arg := range args {
+		args[i] = r.Replace(arg)
+	}
+	if out, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+		logger.Errorf("ban_command for %s failed: %v %s", ip, err, bytes.TrimSpace(out))
+	}
+}
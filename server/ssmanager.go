@@ -0,0 +1,180 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+// The ss-manager protocol of shadowsocks-libev is served over UDP on
+// config.SSManagerAddress, so panels written for ss-manager can drive this
+// server. Each datagram is one command, answered with one datagram:
+//
+//	add: {"server_port": 8001, "password": "foobar"}	ok
+//	remove: {"server_port": 8001}				ok
+//	list							[{"server_port":"8001","password":"foobar"}]
+//	ping							stat: {"8001":11370}
+//
+// Failed commands are answered with "err". The protocol has no
+// authentication and list returns the passwords, so the address must be on
+// loopback, or a unix socket like unix:/run/shadowsocks/manager.sock, unless
+// config.SSManagerRemote is set.
+
+type ssManagerPort struct {
+	// libev sends the port as number, some panels as string
+	ServerPort json.Number `json:"server_port"`
+	Password   string      `json:"password"`
+	Method     string      `json:"method"`
+}
+
+// checkSSManager checks that the ss-manager address of c is a unix socket or
+// on loopback, unless ss_manager_remote is set.
+func checkSSManager(c *ss.Config) error {
+	addr := c.SSManagerAddress
+	if addr == "" {
+		return nil
+	}
+	if isUnixAddr(addr) {
+		if addr == unixPrefix {
+			return errors.New("ss_manager_address: unix socket without path")
+		}
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("ss_manager_address: %v", err)
+	}
+	if c.SSManagerRemote {
+		return nil
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("ss_manager_address: %s is not on loopback, anyone reaching it controls the ports and reads their passwords; set ss_manager_remote to serve it anyway", addr)
+	}
+	return nil
+}
+
+// listenSSManager listens for ss-manager commands on addr, a UDP address or
+// a unix socket.
+func listenSSManager(addr string) (net.PacketConn, error) {
+	if isUnixAddr(addr) {
+		path := strings.TrimPrefix(addr, unixPrefix)
+		// a socket left by a server that didn't shut down
+		if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+		return net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	}
+	return net.ListenPacket("udp", addr)
+}
+
+func runSSManager(addr string) {
+	conn, err := listenSSManager(addr)
+	if err != nil {
+		logger.Error("ss-manager:", err)
+		return
+	}
+	logger.Infof("ss-manager protocol listening at %s ...", addr)
+	serveSSManager(conn)
+}
+
+// serveSSManager answers the commands received on conn until it's closed.
+func serveSSManager(conn net.PacketConn) {
+	buf := make([]byte, 4096)
+	for {
+		n, src, err := conn.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logger.Warn("ss-manager:", err)
+			}
+			return
+		}
+		reply := ssManagerCommand(buf[:n])
+		if src == nil {
+			// an unbound unix socket can't be answered
+			continue
+		}
+		if _, err = conn.WriteTo(reply, src); err != nil {
+			logger.Debug("ss-manager reply:", err)
+		}
+	}
+}
+
+// ssManagerCommand executes a command and returns the reply.
+func ssManagerCommand(cmd []byte) []byte {
+	cmd = bytes.TrimRight(cmd, "\x00\r\n")
+	action, arg := cmd, []byte(nil)
+	if i := bytes.IndexByte(cmd, ':'); i >= 0 {
+		action, arg = cmd[:i], bytes.TrimSpace(cmd[i+1:])
+	}
+	switch string(action) {
+	case "ping":
+		return ssManagerStat()
+	case "list":
+		return ssManagerList()
+	case "add", "remove":
+		var p ssManagerPort
+		if err := json.Unmarshal(arg, &p); err != nil {
+			logger.Debugf("ss-manager %s: %v", action, err)
+			return []byte("err")
+		}
+		port := p.ServerPort.String()
+		if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+			return []byte("err")
+		}
+		if string(action) == "remove" {
+			if err := removePort(port); err != nil {
+				logger.Debugf("ss-manager remove %s: %v", port, err)
+				return []byte("err")
+			}
+			return []byte("ok")
+		}
+		if p.Password == "" {
+			return []byte("err")
+		}
+		if err := addAPIPort(port, [3]string{p.Password, "", okIf(udp)}, p.Method, "", 0); err != nil {
+			logger.Debugf("ss-manager add %s: %v", port, err)
+			return []byte("err")
+		}
+		return []byte("ok")
+	}
+	return []byte("err")
+}
+
+// ssManagerStat returns the traffic of all ports in bytes.
+func ssManagerStat() []byte {
+	reloadLock.Lock()
+	ports := make([]string, 0, len(config.PortPassword))
+	for port := range config.PortPassword {
+		ports = append(ports, port)
+	}
+	reloadLock.Unlock()
+	traffic := map[string]int{}
+	if len(ports) != 0 {
+		traffic, _ = ss.GetTraffic(ports...)
+	}
+	b, _ := json.Marshal(traffic)
+	return append([]byte("stat: "), b...)
+}
+
+func ssManagerList() []byte {
+	reloadLock.Lock()
+	list := make([]map[string]string, 0, len(config.PortPassword))
+	for port, password := range config.PortPassword {
+		list = append(list, map[string]string{"server_port": port, "password": password[0]})
+	}
+	reloadLock.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i]["server_port"] < list[j]["server_port"] })
+	b, _ := json.Marshal(list)
+	return b
+}
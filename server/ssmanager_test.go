@@ -0,0 +1,159 @@
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+// freePort returns a TCP port nothing listens on.
+func freePort(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+}
+
+// waitListening waits until port is listening, or isn't if want is false.
+func waitListening(t *testing.T, port string, want bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := passwdManager.get(port); ok == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("port %s listening: %v, want %v", port, !want, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSSManagerCommand(t *testing.T) {
+	saved, savedTcp, savedUdp := config, netTcp, netUdp
+	defer func() { config, netTcp, netUdp = saved, savedTcp, savedUdp }()
+	config = &ss.Config{Method: "aes-256-gcm", PortPassword: map[string][3]string{}}
+	netTcp, netUdp = "tcp", "udp"
+	port := freePort(t)
+	defer ss.DelTraffic(port)
+
+	if r := string(ssManagerCommand([]byte("ping"))); r != "stat: {}" {
+		t.Errorf("ping without ports: %q", r)
+	}
+	if r := string(ssManagerCommand([]byte(`add: {"server_port": ` + port + `, "password": "foobar"}`))); r != "ok" {
+		t.Fatalf("add: %q", r)
+	}
+	defer removePort(port)
+	waitListening(t, port, true)
+	if r := string(ssManagerCommand([]byte(`add: {"server_port": "` + port + `", "password": "barfoo"}`))); r != "err" {
+		t.Errorf("adding an existing port: %q", r)
+	}
+
+	var list []map[string]string
+	if err := json.Unmarshal(ssManagerCommand([]byte("list\n")), &list); err != nil {
+		t.Fatal("list:", err)
+	}
+	if len(list) != 1 || list[0]["server_port"] != port || list[0]["password"] != "foobar" {
+		t.Errorf("list: %v", list)
+	}
+	ss.RestoreTraffic(&ss.TrafficSnapshot{Ports: map[string]*ss.PortUsage{port: {Traffic: 11370}}})
+	if r := string(ssManagerCommand([]byte("ping"))); r != `stat: {"`+port+`":11370}` {
+		t.Errorf("ping: %q", r)
+	}
+
+	if r := string(ssManagerCommand([]byte(`remove: {"server_port": ` + port + `}`))); r != "ok" {
+		t.Fatalf("remove: %q", r)
+	}
+	waitListening(t, port, false)
+	if _, ok := config.PortPassword[port]; ok {
+		t.Error("removed port still in config")
+	}
+	if r := string(ssManagerCommand([]byte(`remove: {"server_port": ` + port + `}`))); r != "err" {
+		t.Errorf("removing a missing port: %q", r)
+	}
+
+	for _, cmd := range []string{"", "stat", "add: {}", `add: {"server_port": 70000, "password": "x"}`,
+		`add: {"server_port": 8001}`, "remove: nothing"} {
+		if r := string(ssManagerCommand([]byte(cmd))); r != "err" {
+			t.Errorf("%q answered with %q, want err", cmd, r)
+		}
+	}
+}
+
+func TestServeSSManager(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config = &ss.Config{Method: "aes-256-gcm", PortPassword: map[string][3]string{}}
+
+	for _, addr := range []string{"127.0.0.1:0", unixPrefix + filepath.Join(t.TempDir(), "manager.sock")} {
+		conn, err := listenSSManager(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan bool)
+		go func() {
+			serveSSManager(conn)
+			close(done)
+		}()
+
+		var c net.Conn
+		if isUnixAddr(addr) {
+			// the client binds its socket to get answers, like ss-manager clients
+			laddr := &net.UnixAddr{Name: filepath.Join(t.TempDir(), "client.sock"), Net: "unixgram"}
+			c, err = net.DialUnix("unixgram", laddr, conn.LocalAddr().(*net.UnixAddr))
+		} else {
+			c, err = net.Dial("udp", conn.LocalAddr().String())
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = c.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 64)
+		n, err := c.Read(buf)
+		if err != nil {
+			t.Fatalf("%s: %v", addr, err)
+		}
+		if r := string(buf[:n]); r != "stat: {}" {
+			t.Errorf("%s: ping answered with %q", addr, r)
+		}
+		c.Close()
+		conn.Close()
+		<-done
+	}
+}
+
+func TestCheckSSManager(t *testing.T) {
+	for _, tt := range []struct {
+		addr   string
+		remote bool
+		ok     bool
+	}{
+		{"", false, true},
+		{"127.0.0.1:6001", false, true},
+		{"[::1]:6001", false, true},
+		{"localhost:6001", false, true},
+		{"unix:/run/shadowsocks/manager.sock", false, true},
+		{"unix:", false, false},
+		{"0.0.0.0:6001", false, false},
+		{":6001", false, false},
+		{"192.0.2.1:6001", false, false},
+		{"example.com:6001", false, false},
+		{"192.0.2.1:6001", true, true},
+		{":6001", true, true},
+		{"127.0.0.1", false, false},
+	} {
+		err := checkSSManager(&ss.Config{SSManagerAddress: tt.addr, SSManagerRemote: tt.remote})
+		if (err == nil) != tt.ok {
+			t.Errorf("%q remote %v: %v", tt.addr, tt.remote, err)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+// Programs embedding the server test it in process with Start, package
+// sstest runs its test servers with it. The ports relay through the same
+// code as in the server process, with its destination checks, quotas and
+// limits.
+
+// startTimeout is how long Start waits for the ports to listen.
+const startTimeout = 5 * time.Second
+
+var started struct {
+	sync.Mutex
+	on bool
+}
+
+// ssHooks are the functions the server sets in the shadowsocks package.
+type ssHooks struct {
+	natSourceAllowed   func(string) bool
+	natSourceClosed    func(string)
+	udpResolve         func(string, string) (*net.IPAddr, error)
+	udpDestAllowed     func(string, string, string, string) bool
+	udpCountryAllowed  func(string, string, string) bool
+	udpACLAllowed      func(string, string, string) bool
+	udpDestPortAllowed func(string, string, string) bool
+	udpTimeoutOf       func(string) time.Duration
+	quotaExceeded      func(string)
+}
+
+func saveHooks() *ssHooks {
+	return &ssHooks{ss.NATSourceAllowed, ss.NATSourceClosed, ss.UDPResolve, ss.UDPDestAllowed,
+		ss.UDPCountryAllowed, ss.UDPACLAllowed, ss.UDPDestPortAllowed, ss.UDPTimeoutOf, ss.QuotaExceeded}
+}
+
+func (h *ssHooks) restore() {
+	ss.NATSourceAllowed, ss.NATSourceClosed, ss.UDPResolve, ss.UDPDestAllowed = h.natSourceAllowed,
+		h.natSourceClosed, h.udpResolve, h.udpDestAllowed
+	ss.UDPCountryAllowed, ss.UDPACLAllowed, ss.UDPDestPortAllowed = h.udpCountryAllowed,
+		h.udpACLAllowed, h.udpDestPortAllowed
+	ss.UDPTimeoutOf, ss.QuotaExceeded = h.udpTimeoutOf, h.quotaExceeded
+}
+
+// Start serves the ports of c in this process like the server does once
+// its config is loaded, setting the defaults of the options c leaves empty.
+// udpRelay turns the UDP relay on like -u. What only
+// the server process has isn't started: the management and debug
+// listeners, reloads, signals, the traffic file. Start returns once every
+// port listens.
+//
+// A single server runs in a process at a time. stop closes its ports, makes
+// their connections stop relaying, resets the options of the shadowsocks
+// package and restores the functions the server set there.
+func Start(c *ss.Config, udpRelay bool) (stop func(), err error) {
+	started.Lock()
+	defer started.Unlock()
+	if started.on {
+		return nil, errors.New("a server is already started in this process")
+	}
+
+	hooks := saveHooks()
+	savedUDP := udp
+	reset := func() {
+		applyConfig(&ss.Config{})
+		hooks.restore()
+		udp = savedUDP
+	}
+	setDefaults(c)
+	config, udp = c, udpRelay
+	if err = prepareConfig(c); err == nil {
+		err = applyConfig(c)
+	}
+	if err != nil {
+		reset()
+		return nil, err
+	}
+	ss.QuotaExceeded = closeOverQuota
+	applyQuotas(false)
+	applyMaxConns()
+	for port, password := range c.PortPassword {
+		go run(port, password)
+	}
+	closePorts := func() {
+		reloadLock.Lock()
+		for port := range config.PortPassword {
+			passwdManager.del(port)
+			forgetMaxConns(port)
+			forgetBind(port)
+		}
+		reloadLock.Unlock()
+		// connections still open may read config, it's kept until the next
+		// start
+		reset()
+	}
+	if err = waitPorts(c); err != nil {
+		closePorts()
+		return nil, err
+	}
+	started.on = true
+	return func() {
+		started.Lock()
+		defer started.Unlock()
+		if started.on {
+			closePorts()
+			started.on = false
+		}
+	}, nil
+}
+
+// waitPorts waits until the ports of c listen, with their UDP relay if it's
+// on, and fails if one gave up binding.
+func waitPorts(c *ss.Config) error {
+	deadline := time.Now().Add(startTimeout)
+	for port, password := range c.PortPassword {
+		wantUDP := udp && password[2] == "ok" && !ss.OverUDP(c.TransportOf(port))
+		for {
+			_, tcp := passwdManager.get(port)
+			_, udpOK := passwdManager.getUDP(port)
+			if tcp && (udpOK || !wantUDP) {
+				break
+			}
+			binds.Lock()
+			st := binds.m["tcp/"+port]
+			if st == nil {
+				st = binds.m["udp/"+port]
+			}
+			var failed error
+			if st != nil && !st.Retrying {
+				failed = fmt.Errorf("port %s: %s", port, st.Error)
+			}
+			binds.Unlock()
+			if failed != nil {
+				return failed
+			}
+			if time.Now().After(deadline) {
+				return fmt.Errorf("port %s isn't listening after %v", port, startTimeout)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+// Started by a systemd socket unit, the server listens on the sockets passed
+// instead of binding its ports, so connections wait in their queues while
+// the server restarts. As a Type=notify service it reports when it's ready,
+// reloading or stopping, and keeps the watchdog alive.
+
+// activated holds the sockets passed by systemd or by the server upgraded
+// to this one, keyed by "tcp/port" and "udp/port". They're kept open,
+// listeners are made from them every time a port is listened, e.g. after a
+// reload.
+var activated map[string]*os.File
+
+// setActivation takes the sockets passed by systemd, or by the server
+// upgraded to this one.
+func setActivation(c *ss.Config) error {
+	files, err := ss.ListenFDs()
+	if err != nil {
+		return err
+	}
+	from := "systemd"
+	inherited, err := inheritedSockets()
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		files, from = inherited, "the old server"
+	}
+	if len(files) == 0 {
+		return nil
+	}
+	activated = files
+	for key := range files {
+		port := key[strings.Index(key, "/")+1:]
+		if _, ok := c.PortPassword[port]; !ok {
+			logger.Warnf("socket %s passed by %s isn't a port of the config", key, from)
+		}
+	}
+	logger.Infof("listening on %d sockets passed by %s", len(files), from)
+	return nil
+}
+
+// activatedListener returns a listener of the TCP socket of port passed to
+// the server, nil if there's none.
+func activatedListener(port string) (net.Listener, error) {
+	f, ok := activated["tcp/"+port]
+	if !ok {
+		return nil, nil
+	}
+	return net.FileListener(f)
+}
+
+// activatedUDP returns the UDP socket of port passed to the server, nil if
+// there's none.
+func activatedUDP(port string) (*net.UDPConn, error) {
+	f, ok := activated["udp/"+port]
+	if !ok {
+		return nil, nil
+	}
+	c, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, err
+	}
+	return c.(*net.UDPConn), nil
+}
+
+// sdNotify reports state to systemd, if it runs the server as a Type=notify
+// service.
+func sdNotify(state string) {
+	if _, err := ss.SdNotify(state); err != nil {
+		logger.Warnf("error notifying systemd of %s: %v", state, err)
+	}
+}
+
+// keepWatchdog notifies systemd at half its watchdog timeout, if it's on.
+func keepWatchdog() {
+	d := ss.SdWatchdog()
+	if d == 0 {
+		return
+	}
+	logger.Debugf("notifying systemd watchdog every %v", d/2)
+	for range time.Tick(d / 2) {
+		sdNotify("WATCHDOG=1")
+	}
+}
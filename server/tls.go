@@ -0,0 +1,80 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"sync"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// serverTLS is the TLS config of the tls, wss and quic transports, nil with
+// the others. It's set from the tls_* options and reloaded on SIGHUP, so renewed
+// certificate files are picked up.
+var serverTLS = struct {
+	sync.Mutex
+	c *tls.Config
+}{}
+
+// setupTLS loads the certificate of c, or sets up ACME to issue it.
+func setupTLS(c *ss.Config) error {
+	var tc *tls.Config
+	used := c.Transports()
+	switch {
+	case !used[ss.TransportTLS] && !used[ss.TransportWSS] && !used[ss.TransportQUIC]:
+	case len(c.TLSACMEDomains) > 0 && used[ss.TransportQUIC]:
+		// the CA validates over TCP, which QUIC ports don't listen on
+		return errors.New("the quic transport needs tls_cert and tls_key, ACME isn't supported")
+	case len(c.TLSACMEDomains) > 0:
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(c.TLSACMEDomains...),
+			Email:      c.TLSACMEEmail,
+		}
+		if c.TLSACMECache != "" {
+			m.Cache = autocert.DirCache(c.TLSACMECache)
+		}
+		tc = m.TLSConfig()
+		// the acme-tls/1 protocol answers the challenges of the CA, h2 isn't
+		// offered as the fallback website may not speak it
+		tc.NextProtos = []string{"http/1.1", "acme-tls/1"}
+	case c.TLSCert != "" && c.TLSKey != "":
+		cert, err := tls.LoadX509KeyPair(c.TLSCert, c.TLSKey)
+		if err != nil {
+			return err
+		}
+		tc = &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"http/1.1"}}
+	default:
+		return errors.New("the tls and quic transports need tls_cert and tls_key, or tls_acme_domains")
+	}
+	if tc != nil {
+		tc.MinVersion = tls.VersionTLS12
+	}
+	serverTLS.Lock()
+	serverTLS.c = tc
+	serverTLS.Unlock()
+	return nil
+}
+
+func tlsConfig() *tls.Config {
+	serverTLS.Lock()
+	defer serverTLS.Unlock()
+	return serverTLS.c
+}
+
+// quicTLSConfig returns the TLS config of QUIC listeners. The certificate is
+// looked up on each handshake, so a reload applies to ports listening.
+func quicTLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS13,
+		NextProtos: []string{ss.QUICALPN},
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			tc := tlsConfig()
+			if tc == nil || len(tc.Certificates) == 0 {
+				return nil, errors.New("no certificate for quic")
+			}
+			return &tc.Certificates[0], nil
+		},
+	}
+}
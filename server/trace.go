@@ -0,0 +1,18 @@
+package server
+
+import (
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+// traceService is the service.name of the spans of the server.
+const traceService = "shadowsocks-server"
+
+// setTracing exports the traces of connections to the trace_endpoint of c,
+// if set, sampling trace_sample_rate of them, all by default.
+func setTracing(c *ss.Config) error {
+	rate := c.TraceSampleRate
+	if rate == 0 {
+		rate = 1
+	}
+	return ss.SetTracing(c.TraceEndpoint, rate, traceService)
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// On SIGUSR2 the server upgrades itself without refusing connections: it
+// starts its executable again, which may have been replaced by a new
+// version, passing it the sockets of its ports. Once the new server is
+// ready, the old one stops accepting connections and shuts down, waiting
+// for the open ones like on SIGTERM. If the new server fails to start, the
+// old one keeps running.
+//
+// The new server owns the traffic file and the replay filter file from the
+// handover, the old one no longer saves them.
+
+const (
+	// upgradeFdsEnv lists the keys, like "tcp/8388", of the sockets passed
+	// from fd 3 on to the new server.
+	upgradeFdsEnv = "SHADOWSOCKS_UPGRADE_FDS"
+	// upgradeReadyEnv is the fd the new server reports it's ready on.
+	upgradeReadyEnv = "SHADOWSOCKS_UPGRADE_READY"
+	// upgradeTimeout bounds the start of the new server.
+	upgradeTimeout = time.Minute
+)
+
+// upgrading is set while a new server starts, handedOver once it's ready,
+// operate by sync/atomic.
+var upgrading, handedOver int32
+
+// upgradeReady is where the server reports it's ready to the old one it
+// replaces, nil if it didn't replace one.
+var upgradeReady *os.File
+
+// inheritedSockets returns the sockets passed by the server upgraded to this
+// one, keyed like those passed by systemd, nil if there are none.
+func inheritedSockets() (map[string]*os.File, error) {
+	defer os.Unsetenv(upgradeFdsEnv)
+	defer os.Unsetenv(upgradeReadyEnv)
+	if fd, err := strconv.Atoi(os.Getenv(upgradeReadyEnv)); err == nil {
+		upgradeReady = os.NewFile(uintptr(fd), "upgrade ready")
+	}
+	list := os.Getenv(upgradeFdsEnv)
+	if list == "" {
+		return nil, nil
+	}
+	files := make(map[string]*os.File)
+	for i, key := range strings.Split(list, ",") {
+		if !strings.HasPrefix(key, "tcp/") && !strings.HasPrefix(key, "udp/") {
+			return nil, fmt.Errorf("invalid %s %q", upgradeFdsEnv, list)
+		}
+		files[key] = os.NewFile(uintptr(3+i), key)
+	}
+	return files, nil
+}
+
+// notifyUpgraded tells the old server this one is ready.
+func notifyUpgraded() {
+	if upgradeReady == nil {
+		return
+	}
+	upgradeReady.Write([]byte("ready"))
+	upgradeReady.Close()
+	upgradeReady = nil
+}
+
+// filer is a listener or UDP socket whose socket can be passed on.
+type filer interface {
+	File() (*os.File, error)
+}
+
+// socketFiles returns the sockets of the ports listened on, keyed by
+// "tcp/port" and "udp/port" of the port actually bound. Listeners sharing
+// their port by SO_REUSEPORT, and those of the quic and kcp transports,
+// aren't passed on, the new server binds their ports again.
+func socketFiles() (keys []string, files []*os.File) {
+	add := func(network string, addr net.Addr, l interface{}) {
+		fl, ok := l.(filer)
+		if !ok || addr.Network() == "unix" {
+			logger.Infof("not passing %s listener %s to the new server", network, addr)
+			return
+		}
+		f, err := fl.File()
+		if err != nil {
+			logger.Warnf("error passing %s listener %s to the new server: %v", network, addr, err)
+			return
+		}
+		_, port, _ := net.SplitHostPort(addr.String())
+		keys = append(keys, network+"/"+port)
+		files = append(files, f)
+	}
+	passwdManager.Lock()
+	defer passwdManager.Unlock()
+	for _, pl := range passwdManager.portListener {
+		add("tcp", pl.listener.Addr(), pl.listener)
+	}
+	for _, ul := range passwdManager.udpListener {
+		if len(ul.listeners) == 1 {
+			add("udp", ul.listeners[0].LocalAddr(), ul.listeners[0])
+		}
+	}
+	return
+}
+
+// upgrade starts the new server and shuts down once it's ready.
+func upgrade() {
+	if !atomic.CompareAndSwapInt32(&upgrading, 0, 1) {
+		logger.Warn("already upgrading")
+		return
+	}
+	defer atomic.StoreInt32(&upgrading, 0)
+	reloadLock.Lock()
+	pid, err := startUpgraded()
+	reloadLock.Unlock()
+	if err != nil {
+		logger.Error("upgrade failed, keep running:", err)
+		return
+	}
+	logger.Infof("upgraded to process %d", pid)
+	sdNotify("MAINPID=" + strconv.Itoa(pid))
+	if atomic.CompareAndSwapInt32(&shuttingDown, 0, 1) {
+		shutdown(upgradeSignal)
+	}
+}
+
+// startUpgraded starts the executable with the sockets of the ports and
+// waits for it to be ready, returning its process id.
+func startUpgraded() (int, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	// the new server starts with the traffic and the replay filter as they
+	// are now
+	saveTraffic()
+	if replayFilter != nil && config.ReplayFilterFile != "" {
+		if err = replayFilter.Save(config.ReplayFilterFile); err != nil {
+			return 0, fmt.Errorf("error saving replay filter %s: %v", config.ReplayFilterFile, err)
+		}
+	}
+	keys, files := socketFiles()
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	r, w, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, w)
+	cmd.Env = append(os.Environ(),
+		upgradeFdsEnv+"="+strings.Join(keys, ","),
+		upgradeReadyEnv+"="+strconv.Itoa(3+len(files)))
+	logger.Infof("starting %s with %d sockets", exe, len(files))
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return 0, err
+	}
+	ready := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 8)
+		if n, _ := r.Read(buf); n > 0 {
+			ready <- nil
+			return
+		}
+		ready <- errors.New("new server exited")
+	}()
+	select {
+	case err = <-ready:
+	case <-time.After(upgradeTimeout):
+		err = fmt.Errorf("new server not ready in %v", upgradeTimeout)
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return 0, err
+	}
+	atomic.StoreInt32(&handedOver, 1)
+	go cmd.Wait()
+	return cmd.Process.Pid, nil
+}
@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package server
+
+import (
+	"os"
+	"syscall"
+)
+
+// upgradeSignal makes the server upgrade itself.
+var upgradeSignal os.Signal = syscall.SIGUSR2
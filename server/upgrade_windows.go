@@ -0,0 +1,6 @@
+package server
+
+import "os"
+
+// upgradeSignal is nil, the server can't upgrade itself on windows.
+var upgradeSignal os.Signal
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+const (
+	trafficSaveInterval    = time.Minute
+	defaultWebhookInterval = time.Minute
+	// attempts to post a report, backing off webhookBackoff, twice that, ...
+	// in between, a report that fails is sent again before new traffic
+	webhookAttempts = 3
+)
+
+var (
+	webhookClient  = &http.Client{Timeout: 30 * time.Second}
+	webhookBackoff = time.Second
+	// exports are made one at a time, periodically and on shutdown
+	exportLock sync.Mutex
+)
+
+// saveTraffic saves the traffic counters to the traffic_file, if set.
+func saveTraffic() {
+	path := config.TrafficFile
+	if path == "" || atomic.LoadInt32(&handedOver) == 1 {
+		return
+	}
+	if err := ss.SaveTraffic(path); err != nil {
+		logger.Errorf("error saving traffic to %s: %v", path, err)
+	}
+}
+
+// saveTrafficPeriodically saves the traffic counters every
+// trafficSaveInterval, so they survive a crash too.
+func saveTrafficPeriodically() {
+	for {
+		time.Sleep(trafficSaveInterval)
+		saveTraffic()
+	}
+}
+
+// checkTrafficWebhook checks the traffic_webhook options of c.
+func checkTrafficWebhook(c *ss.Config) error {
+	if c.TrafficWebhookInterval < 0 {
+		return errors.New("traffic_webhook_interval must not be negative")
+	}
+	if c.TrafficWebhook == "" {
+		return nil
+	}
+	u, err := url.Parse(c.TrafficWebhook)
+	if err != nil {
+		return fmt.Errorf("traffic_webhook: %v", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("traffic_webhook %s is not an http or https URL", u.Redacted())
+	}
+	return nil
+}
+
+// webhookInterval returns the interval of traffic reports.
+func webhookInterval() time.Duration {
+	if config.TrafficWebhookInterval <= 0 {
+		return defaultWebhookInterval
+	}
+	return time.Duration(config.TrafficWebhookInterval) * time.Second
+}
+
+// usageReport is the body of traffic reports, the traffic in bytes by port
+// and user since the last report. Receivers may drop reports with an id
+// seen before: a report that wasn't acknowledged, e.g. timed out, may have
+// arrived, it's sent again unchanged until it is.
+type usageReport struct {
+	ID    string                   `json:"id"`
+	Time  time.Time                `json:"time"`
+	Ports map[string]*ss.PortUsage `json:"ports"`
+}
+
+// exportUsage reports the traffic to the traffic_webhook every
+// traffic_webhook_interval.
+func exportUsage() {
+	for {
+		time.Sleep(webhookInterval())
+		exportUsageNow()
+	}
+}
+
+// exportUsageNow reports the traffic since the last report, if there's a
+// webhook and traffic to report. A report the webhook didn't acknowledge is
+// sent again first, with its id, the new traffic waits for the next one.
+func exportUsageNow() {
+	exportLock.Lock()
+	defer exportLock.Unlock()
+
+	webhook, secret := config.TrafficWebhook, config.TrafficWebhookSecret
+	if webhook == "" {
+		return
+	}
+	body := ss.UnackedReport()
+	if body == nil {
+		m := ss.TakeUsage()
+		if len(m) == 0 {
+			return
+		}
+		id := make([]byte, 8)
+		rand.Read(id)
+		var err error
+		if body, err = json.Marshal(&usageReport{hex.EncodeToString(id), time.Now(), m}); err != nil {
+			logger.Error("error encoding traffic report:", err)
+			ss.ReturnUsage(m)
+			return
+		}
+		ss.SetUnackedReport(body)
+	}
+	if err := postUsage(webhook, secret, body); err != nil {
+		logger.Warnf("error reporting traffic to %s, sending the report again with the next one: %v", redactURL(webhook), err)
+		return
+	}
+	ss.SetUnackedReport(nil)
+	logger.Debugf("reported traffic to %s", redactURL(webhook))
+}
+
+// postUsage posts the report body to webhook, retrying webhookAttempts
+// times.
+func postUsage(webhook, secret string, body []byte) (err error) {
+	for i := 0; i < webhookAttempts; i++ {
+		if i > 0 {
+			time.Sleep(webhookBackoff << uint(i-1))
+		}
+		if err = postSigned(webhook, secret, body); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// usageSignature returns the hex HMAC-SHA256 of body keyed by secret.
+func usageSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// postSigned posts the JSON body to webhook, signed in the X-Signature
+// header as "sha256=" and the usageSignature if secret is set.
+func postSigned(webhook, secret string, body []byte) error {
+	req, err := http.NewRequest("POST", webhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if secret != "" {
+		req.Header.Set("X-Signature", "sha256="+usageSignature(secret, body))
+	}
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+func TestExportUsageResendsReport(t *testing.T) {
+	saved, savedClient, savedBackoff := config, webhookClient, webhookBackoff
+	defer func() { config, webhookClient, webhookBackoff = saved, savedClient, savedBackoff }()
+	ss.TakeUsage()
+	ss.SetUnackedReport(nil)
+	defer ss.SetUnackedReport(nil)
+
+	// the receiver applies every report once by id, but answers the first
+	// ones too late
+	var mu sync.Mutex
+	seen := make(map[string]bool)
+	var total int64
+	calls := 0
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var rep usageReport
+		if err := json.NewDecoder(r.Body).Decode(&rep); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		calls++
+		late := calls <= webhookAttempts
+		if !seen[rep.ID] {
+			seen[rep.ID] = true
+			for _, u := range rep.Ports {
+				total += u.Traffic
+			}
+		}
+		mu.Unlock()
+		if late {
+			time.Sleep(200 * time.Millisecond)
+		}
+	}))
+	defer hook.Close()
+	config = &ss.Config{TrafficWebhook: hook.URL}
+	webhookClient = &http.Client{Timeout: 50 * time.Millisecond}
+	webhookBackoff = time.Millisecond
+
+	ss.ReturnUsage(map[string]*ss.PortUsage{"8388": {Traffic: 100}})
+	exportUsageNow()
+	if ss.UnackedReport() == nil {
+		t.Fatal("report timing out not kept")
+	}
+	ss.ReturnUsage(map[string]*ss.PortUsage{"8388": {Traffic: 10}})
+	exportUsageNow()
+	if ss.UnackedReport() != nil {
+		t.Fatal("report acknowledged still kept")
+	}
+	exportUsageNow()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(seen) != 2 || total != 110 {
+		t.Errorf("%d reports applied with %d bytes, want 2 with 110", len(seen), total)
+	}
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"fmt"
+	"net"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+// checkPortUsers checks the users of each port in port_users.
+func checkPortUsers(c *ss.Config) error {
+	for port, keys := range c.PortUsers {
+		passwd, ok := c.PortPassword[port]
+		if !ok {
+			return fmt.Errorf("port_users: port %s not in port_password", port)
+		}
+		if _, err := ss.NewUsers(c.MethodOf(port), passwd[0], keys); err != nil {
+			return fmt.Errorf("port_users: port %s: %v", port, err)
+		}
+	}
+	return nil
+}
+
+// sameUsers reports whether a and b hold the same users with the same keys.
+func sameUsers(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for id, key := range a {
+		if k, ok := b[id]; !ok || k != key {
+			return false
+		}
+	}
+	return true
+}
+
+// userConn counts the traffic of a connection to its user.
+type userConn struct {
+	net.Conn
+	port, user string
+}
+
+func (c *userConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	ss.AddUserTraffic(c.port, c.user, n)
+	return
+}
+
+func (c *userConn) Write(b []byte) (n int, err error) {
+	n, err = c.Conn.Write(b)
+	ss.AddUserTraffic(c.port, c.user, n)
+	return
+}
+
+func (c *userConn) CloseWrite() error {
+	return ss.CloseWrite(c.Conn)
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+// validateConfig checks c like the server does when starting, without
+// stopping at the first problem, and reports every problem to w, so config
+// files can be linted before deployment. Unknown options and options of
+// ports that don't exist are warnings. It returns the exit status, 1 if
+// there's an error.
+func validateConfig(w io.Writer, c *ss.Config) int {
+	var errs, warnings []string
+	check := func(err error) {
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	for _, name := range c.UnknownOptions() {
+		warnings = append(warnings, "unknown option "+name)
+	}
+
+	check(c.CheckMethods())
+	check(c.CheckTransports())
+	if err := setupTLS(c); err != nil {
+		check(fmt.Errorf("tls certificate: %v", err))
+	}
+	if len(c.PortPassword) == 0 && enoughOptions(c) {
+		c.PortPassword = map[string][3]string{strconv.Itoa(c.ServerPort): {c.Password}}
+	}
+	check(c.MergeTenants())
+	if len(c.PortPassword) == 0 {
+		check(errors.New("no ports, set port_password, or server_port and password"))
+	}
+	for port, passwd := range c.PortPassword {
+		if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+			check(fmt.Errorf("port_password: %s is not a port number", port))
+		}
+		if passwd[0] == "" {
+			check(fmt.Errorf("port_password: port %s has no password", port))
+		}
+		if (passwd[1] != "" && passwd[1] != "ok") || (passwd[2] != "" && passwd[2] != "ok") {
+			check(fmt.Errorf("port_password: port %s: the openvpn and udp flags must be \"ok\" or empty", port))
+		}
+	}
+	check(checkPortUsers(c))
+	portOptions := map[string][]string{
+		"port_method":           keys(c.PortMethod),
+		"port_transport":        keys(c.PortTransport),
+		"port_udp_timeout":      keys(c.PortUDPTimeout),
+		"port_ip_preference":    keys(c.PortIPPreference),
+		"port_speed_limit_mbps": keys(c.PortSpeedLimit),
+		"port_quota":            keys(c.PortQuota),
+		"port_max_connections":  keys(c.PortMaxConnections),
+		"port_fallback":         keys(c.PortFallback),
+		"port_rotate":           keys(c.PortRotate),
+		"port_listen":           keys(c.PortListen),
+	}
+	for option, ports := range portOptions {
+		for _, port := range ports {
+			if _, ok := c.PortPassword[port]; !ok {
+				warnings = append(warnings, fmt.Sprintf("%s: port %s is not in port_password", option, port))
+			}
+		}
+	}
+
+	if _, err := ss.NewDestPolicy(c.DestPolicy, c.DestDeny, c.DestAllow); err != nil {
+		check(err)
+	}
+	if c.ACL != "" {
+		if _, err := ss.LoadACL(c.ACL); err != nil {
+			check(fmt.Errorf("acl %s: %v", c.ACL, err))
+		}
+	}
+	check(setupGeoIP(c))
+	check(setResolver(c))
+	check(checkIPPreference(c))
+	check(ss.SetNATLimit(c.UDPNATMax, c.UDPNATEvict))
+	check(ss.SetUDPMaxSize(c.UDPMaxSize))
+	check(checkLogConfig(c))
+	// the address is checked to be local when the server starts, on the
+	// host it's deployed to
+	if c.OutboundBind != "" && net.ParseIP(c.OutboundBind) == nil {
+		check(fmt.Errorf("outbound_bind %s is not an IP address", c.OutboundBind))
+	}
+	check(setForward(c))
+	check(checkTrafficWebhook(c))
+	check(setSourceLimits(c))
+	check(checkMaxConns(c))
+	check(checkSSManager(c))
+	check(setTracing(c))
+	check(checkAccessLog(c))
+	check(checkDestPorts(c))
+	check(checkPortRotate(c))
+	check(checkPortListen(c))
+	check(ss.CheckProxyTrusted(c.ProxyProtocol))
+	if c.FastOpen {
+		check(ss.CheckFastOpen())
+	}
+	if c.MPTCP {
+		check(ss.CheckMPTCP())
+	}
+	check(ss.CheckTCPOptions(c.TCP))
+	if c.MaxOpenFiles < 0 {
+		check(errors.New("max_open_files must not be negative"))
+	}
+	check(checkReusePort(c))
+	if c.Fallback != "" && c.Fallback != "discard" {
+		if _, _, err := net.SplitHostPort(c.Fallback); err != nil {
+			check(fmt.Errorf("fallback must be \"discard\" or host:port: %v", err))
+		}
+	}
+	if oc := c.OnlineConfig; oc != nil {
+		if oc.Address == "" || oc.Server == "" {
+			check(errors.New("online_config needs address and server"))
+		}
+		if (oc.Cert == "") != (oc.Key == "") {
+			check(errors.New("online_config needs both cert and key"))
+		}
+	}
+	if c.ReplayFilter && (c.ReplayFilterCapacity < 0 || c.ReplayFilterFPRate < 0 || c.ReplayFilterFPRate >= 1) {
+		check(errors.New("replay_filter_capacity must not be negative and replay_filter_fp_rate must be between 0 and 1"))
+	}
+
+	sort.Strings(errs)
+	sort.Strings(warnings)
+	for _, s := range warnings {
+		fmt.Fprintln(w, "warning:", s)
+	}
+	for _, s := range errs {
+		fmt.Fprintln(w, "error:", s)
+	}
+	if len(errs) > 0 {
+		fmt.Fprintf(w, "%s: %d errors, %d warnings\n", configFile, len(errs), len(warnings))
+		return 1
+	}
+	fmt.Fprintf(w, "%s: ok, %d warnings\n", configFile, len(warnings))
+	return 0
+}
+
+// keys returns the ports of m, a map of port options.
+func keys(m interface{}) []string {
+	var ports []string
+	for _, k := range reflect.ValueOf(m).MapKeys() {
+		ports = append(ports, k.String())
+	}
+	return ports
+}
@@ -0,0 +1,67 @@
+//go:build !windows
+// +build !windows
+
+package service
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// daemonCheckTime is how long Daemon waits for the started process to fail,
+// e.g. on a bad config, before leaving it running.
+const daemonCheckTime = time.Second
+
+// Daemon starts the program again with the same arguments in a new session
+// detached from the terminal and exits, the output of the new process
+// appended to logFile, discarded if it's empty. In the process started, it
+// returns nil so the program goes on.
+func Daemon(logFile string) error {
+	if os.Getenv(daemonEnv) != "" {
+		return nil
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if logFile != "" {
+		out, err = os.OpenFile(logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	}
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), daemonEnv+"=1")
+	cmd.Stdout, cmd.Stderr = out, out
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	select {
+	case err = <-exited:
+		if logFile != "" {
+			return fmt.Errorf("daemon exited: %v, see %s", err, logFile)
+		}
+		return fmt.Errorf("daemon exited: %v, run without -daemon to see why", err)
+	case <-time.After(daemonCheckTime):
+	}
+	fmt.Printf("started daemon, process id %d\n", cmd.Process.Pid)
+	os.Exit(0)
+	return nil
+}
+
+// Notify does nothing, service managers other than that of Windows stop
+// the program by signals.
+func Notify(name string, c chan<- os.Signal) {}
+
+// Exit exits the program with code.
+func Exit(code int) {
+	os.Exit(code)
+}
@@ -0,0 +1,52 @@
+// Package service runs the shadowsocks programs as services managed by the
+// system, without wrapper scripts: a Windows service registered with the
+// service control manager, a launchd daemon on macOS, or a daemon detached
+// from the terminal with -daemon elsewhere.
+package service
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// Actions of -service.
+const (
+	Install   = "install"
+	Uninstall = "uninstall"
+	Start     = "start"
+	Stop      = "stop"
+)
+
+// daemonEnv is set in the environment of the process started by Daemon, so
+// it doesn't start another one. It doesn't start with SS_, which is the
+// prefix of config options given by environment variables.
+const daemonEnv = "SHADOWSOCKS_DAEMON"
+
+// CheckAction checks the action of -service.
+func CheckAction(action string) error {
+	switch action {
+	case Install, Uninstall, Start, Stop:
+		return nil
+	}
+	return fmt.Errorf("unknown service action %q, must be install, uninstall, start or stop", action)
+}
+
+// Command returns the arguments the service runs the program with: the
+// subcommand args follow in the command line, if any, then the flags set on
+// fs except those named in skip.
+func Command(fs *flag.FlagSet, args []string, skip ...string) []string {
+	var cmd []string
+	if n := len(os.Args) - len(args); n > 1 {
+		cmd = append(cmd, os.Args[1:n]...)
+	}
+	fs.Visit(func(f *flag.Flag) {
+		for _, name := range skip {
+			if f.Name == name {
+				return
+			}
+		}
+		cmd = append(cmd, "-"+f.Name+"="+f.Value.String())
+	})
+	return cmd
+}
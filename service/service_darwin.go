@@ -0,0 +1,97 @@
+package service
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+)
+
+// The service is a launchd daemon, started at boot and restarted if it
+// exits, defined by a property list in /Library/LaunchDaemons.
+
+const launchdDir = "/Library/LaunchDaemons"
+
+func label(name string) string {
+	return "com.github.shadowsocks." + name
+}
+
+func plistPath(name string) string {
+	return launchdDir + "/" + label(name) + ".plist"
+}
+
+func xmlString(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return "<string>" + b.String() + "</string>"
+}
+
+// launchdPlist returns the property list of the daemon running exe with
+// args in dir, its output appended to logFile.
+func launchdPlist(name, exe string, args []string, dir, logFile string) []byte {
+	var b bytes.Buffer
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+`)
+	fmt.Fprintf(&b, "\t<key>Label</key>\n\t%s\n", xmlString(label(name)))
+	b.WriteString("\t<key>ProgramArguments</key>\n\t<array>\n")
+	for _, arg := range append([]string{exe}, args...) {
+		fmt.Fprintf(&b, "\t\t%s\n", xmlString(arg))
+	}
+	b.WriteString("\t</array>\n")
+	fmt.Fprintf(&b, "\t<key>WorkingDirectory</key>\n\t%s\n", xmlString(dir))
+	b.WriteString("\t<key>RunAtLoad</key>\n\t<true/>\n")
+	b.WriteString("\t<key>KeepAlive</key>\n\t<true/>\n")
+	fmt.Fprintf(&b, "\t<key>StandardOutPath</key>\n\t%s\n", xmlString(logFile))
+	fmt.Fprintf(&b, "\t<key>StandardErrorPath</key>\n\t%s\n", xmlString(logFile))
+	b.WriteString("</dict>\n</plist>\n")
+	return b.Bytes()
+}
+
+func launchctl(args ...string) error {
+	out, err := exec.Command("launchctl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("launchctl %s: %v %s", args[0], err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// Control installs the launchd daemon name running the program with args
+// in the current directory, or uninstalls, starts or stops it.
+func Control(name, action string, args []string) error {
+	if err := CheckAction(action); err != nil {
+		return err
+	}
+	path := plistPath(name)
+	switch action {
+	case Install:
+		exe, err := os.Executable()
+		if err != nil {
+			return err
+		}
+		dir, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		plist := launchdPlist(name, exe, args, dir, "/var/log/"+name+".log")
+		if err = ioutil.WriteFile(path, plist, 0644); err != nil {
+			return err
+		}
+		fmt.Printf("installed %s, start it with -service start\n", path)
+	case Uninstall:
+		launchctl("unload", path)
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		fmt.Printf("removed %s\n", path)
+	case Start:
+		return launchctl("load", "-w", path)
+	case Stop:
+		return launchctl("unload", "-w", path)
+	}
+	return nil
+}
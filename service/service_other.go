@@ -0,0 +1,15 @@
+//go:build !windows && !darwin
+// +build !windows,!darwin
+
+package service
+
+import "errors"
+
+// Control is not supported, run the program with -daemon or from a unit of
+// the init system, e.g. a systemd service.
+func Control(name, action string, args []string) error {
+	if err := CheckAction(action); err != nil {
+		return err
+	}
+	return errors.New("-service is only supported on windows and darwin, use -daemon and -pidfile or a systemd unit")
+}
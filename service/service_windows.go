@@ -0,0 +1,121 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// The service is registered with the service control manager, started at
+// boot. Run by it, the program works in the directory of its executable, so
+// relative paths in its arguments and config are found next to it.
+
+// Control installs the Windows service name running the program with args,
+// or uninstalls, starts or stops it.
+func Control(name, action string, args []string) error {
+	if err := CheckAction(action); err != nil {
+		return err
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	if action == Install {
+		exe, err := os.Executable()
+		if err != nil {
+			return err
+		}
+		s, err := m.CreateService(name, exe, mgr.Config{
+			DisplayName: name,
+			Description: "shadowsocks " + name,
+			StartType:   mgr.StartAutomatic,
+		}, args...)
+		if err != nil {
+			return err
+		}
+		s.Close()
+		fmt.Printf("installed service %s, start it with -service start\n", name)
+		return nil
+	}
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("service %s: %v", name, err)
+	}
+	defer s.Close()
+	switch action {
+	case Uninstall:
+		err = s.Delete()
+	case Start:
+		err = s.Start()
+	case Stop:
+		_, err = s.Control(svc.Stop)
+	}
+	return err
+}
+
+// Daemon is not supported, install a service instead.
+func Daemon(logFile string) error {
+	return errors.New("-daemon is not supported on windows, use -service install")
+}
+
+var (
+	running  bool
+	exitCode = make(chan int, 1)
+	stopped  = make(chan struct{})
+)
+
+type handler struct {
+	c chan<- os.Signal
+}
+
+func (h handler) Execute(args []string, r <-chan svc.ChangeRequest, s chan<- svc.Status) (bool, uint32) {
+	s <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case req := <-r:
+			switch req.Cmd {
+			case svc.Interrogate:
+				s <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				s <- svc.Status{State: svc.StopPending}
+				select {
+				case h.c <- os.Interrupt:
+				default:
+				}
+			}
+		case code := <-exitCode:
+			return false, uint32(code)
+		}
+	}
+}
+
+// Notify relays the stop requests of the service control manager to c as
+// os.Interrupt, if the program runs as the Windows service name.
+func Notify(name string, c chan<- os.Signal) {
+	if ok, err := svc.IsWindowsService(); err != nil || !ok {
+		return
+	}
+	if exe, err := os.Executable(); err == nil {
+		os.Chdir(filepath.Dir(exe))
+	}
+	running = true
+	go func() {
+		svc.Run(name, handler{c})
+		close(stopped)
+	}()
+}
+
+// Exit exits the program with code, reporting the service stopped first if
+// it runs as a Windows service.
+func Exit(code int) {
+	if running {
+		exitCode <- code
+		<-stopped
+	}
+	os.Exit(code)
+}
@@ -0,0 +1,144 @@
+package shadowsocks
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	mrand "math/rand"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Masks of the destinations written to the access log.
+const (
+	AccessMaskNone   = "none"   // host:port as requested
+	AccessMaskDomain = "domain" // the last two labels of hostnames, the /24 or /48 network of IPs
+	AccessMaskHash   = "hash"   // a hash of the host
+	AccessMaskPort   = "port"   // only the port
+)
+
+// AccessSyslog is the destination of an access log sent to the local syslog
+// daemon.
+const AccessSyslog = "syslog"
+
+// AccessRecord is a relayed connection, written to the access log as a line
+// of JSON.
+type AccessRecord struct {
+	Time       time.Time `json:"time"` // when the relay started
+	Client     string    `json:"client"`
+	Port       string    `json:"port"`
+	User       string    `json:"user,omitempty"`
+	Dest       string    `json:"dest"`
+	Up         int64     `json:"up"`   // bytes sent to dest
+	Down       int64     `json:"down"` // bytes received from dest
+	DurationMs int64     `json:"duration_ms"`
+	Reason     string    `json:"reason"` // why the connection was closed
+}
+
+// AccessLog records a sampled part of the relayed connections to a file or
+// syslog.
+type AccessLog struct {
+	mu   sync.Mutex
+	w    io.WriteCloser
+	rate float64
+	mask string
+}
+
+// CheckAccessLog checks the sample rate and the destination mask of an
+// access log.
+func CheckAccessLog(sampleRate float64, mask string) error {
+	if sampleRate < 0 || sampleRate > 1 {
+		return fmt.Errorf("access_log_sample_rate must be between 0 and 1")
+	}
+	switch mask {
+	case "", AccessMaskNone, AccessMaskDomain, AccessMaskHash, AccessMaskPort:
+		return nil
+	}
+	return fmt.Errorf("access_log_mask must be none, domain, hash or port, not %q", mask)
+}
+
+// OpenAccessLog opens the access log at dest, a file appended to or
+// AccessSyslog for the local syslog daemon, where the records are tagged with
+// tag. sampleRate of the connections are recorded, with destinations masked
+// by mask.
+func OpenAccessLog(dest string, sampleRate float64, mask, tag string) (*AccessLog, error) {
+	if err := CheckAccessLog(sampleRate, mask); err != nil {
+		return nil, err
+	}
+	var w io.WriteCloser
+	var err error
+	if dest == AccessSyslog {
+		w, err = openSyslog(tag)
+	} else {
+		w, err = os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &AccessLog{w: w, rate: sampleRate, mask: mask}, nil
+}
+
+// Log records r if it's sampled. l may be nil.
+func (l *AccessLog) Log(r *AccessRecord) {
+	if l == nil || (l.rate < 1 && mrand.Float64() >= l.rate) {
+		return
+	}
+	rec := *r
+	rec.Dest = MaskDest(r.Dest, l.mask)
+	b, err := json.Marshal(&rec)
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err = l.w.Write(append(b, '\n')); err != nil {
+		logger.Debug("write access log:", err)
+	}
+}
+
+// Close closes l, which may be nil.
+func (l *AccessLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Close()
+}
+
+// MaskDest masks the host of dest, host:port, by mask.
+func MaskDest(dest, mask string) string {
+	if mask == "" || mask == AccessMaskNone {
+		return dest
+	}
+	host, port, err := net.SplitHostPort(dest)
+	if err != nil {
+		host, port = dest, ""
+	}
+	switch mask {
+	case AccessMaskPort:
+		host = "*"
+	case AccessMaskHash:
+		sum := sha256.Sum256([]byte(strings.ToLower(host)))
+		host = hex.EncodeToString(sum[:8])
+	case AccessMaskDomain:
+		if ip := net.ParseIP(host); ip == nil {
+			if labels := strings.Split(host, "."); len(labels) > 2 {
+				host = "*." + strings.Join(labels[len(labels)-2:], ".")
+			}
+		} else if ip4 := ip.To4(); ip4 != nil {
+			host = ip4.Mask(net.CIDRMask(24, 32)).String()
+		} else {
+			host = ip.Mask(net.CIDRMask(48, 128)).String()
+		}
+	}
+	if port == "" {
+		return host
+	}
+	return net.JoinHostPort(host, port)
+}
@@ -0,0 +1,83 @@
+package shadowsocks
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMaskDest(t *testing.T) {
+	tests := []struct {
+		dest, mask, want string
+	}{
+		{"www.example.com:443", "", "www.example.com:443"},
+		{"www.example.com:443", AccessMaskNone, "www.example.com:443"},
+		{"www.example.com:443", AccessMaskPort, "*:443"},
+		{"www.example.com:443", AccessMaskDomain, "*.example.com:443"},
+		{"example.com:80", AccessMaskDomain, "example.com:80"},
+		{"192.0.2.77:53", AccessMaskDomain, "192.0.2.0:53"},
+		{"[2001:db8:1:2::1]:443", AccessMaskDomain, "[2001:db8:1::]:443"},
+		{"WWW.Example.com:443", AccessMaskHash, MaskDest("www.example.com:443", AccessMaskHash)},
+	}
+	for _, tt := range tests {
+		if got := MaskDest(tt.dest, tt.mask); got != tt.want {
+			t.Errorf("MaskDest(%q, %q) = %q, want %q", tt.dest, tt.mask, got, tt.want)
+		}
+	}
+	if h := MaskDest("example.com:443", AccessMaskHash); len(h) != 16+4 || h == MaskDest("example.org:443", AccessMaskHash) {
+		t.Errorf("hashed destination %q", h)
+	}
+}
+
+func TestCheckAccessLog(t *testing.T) {
+	if err := CheckAccessLog(1.5, ""); err == nil {
+		t.Error("sample rate 1.5 accepted")
+	}
+	if err := CheckAccessLog(0.5, "everything"); err == nil {
+		t.Error("unknown mask accepted")
+	}
+	if err := CheckAccessLog(0.5, AccessMaskDomain); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	l, err := OpenAccessLog(path, 1, AccessMaskPort, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now().Add(-time.Second)
+	l.Log(&AccessRecord{Time: start, Client: "203.0.113.7", Port: "8388", Dest: "example.com:443",
+		Up: 10, Down: 20, DurationMs: 1000, Reason: "client closed"})
+	l.rate = 0
+	l.Log(&AccessRecord{Dest: "not.sampled:80"})
+	l.Close()
+	var nilLog *AccessLog
+	nilLog.Log(&AccessRecord{})
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var recs []AccessRecord
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var r AccessRecord
+		if err := json.Unmarshal(s.Bytes(), &r); err != nil {
+			t.Fatal(err)
+		}
+		recs = append(recs, r)
+	}
+	if len(recs) != 1 {
+		t.Fatalf("%d records, want 1", len(recs))
+	}
+	r := recs[0]
+	if r.Dest != "*:443" || r.Up != 10 || r.Down != 20 || r.Reason != "client closed" || !r.Time.Equal(start) {
+		t.Errorf("record %+v", r)
+	}
+}
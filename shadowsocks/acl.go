@@ -0,0 +1,212 @@
+package shadowsocks
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ACL is an access control list in the format of shadowsocks-libev:
+//
+//	[proxy_all]
+//	[bypass_list]
+//	10.0.0.0/8
+//	(^|\.)example\.com$
+//	[outbound_block_list]
+//	192.0.2.1
+//
+// A list holds IP addresses, CIDRs, and regular expressions matched against
+// domain names. [proxy_all] (the default) or [bypass_all] sets the mode,
+// i.e. whether addresses in neither of [proxy_list] and [bypass_list] are
+// proxied. Addresses in [bypass_list] are never proxied, addresses in
+// [outbound_block_list] are blocked. The server relays what would be
+// proxied, and rejects what would be bypassed or blocked.
+type ACL struct {
+	bypassAll bool
+	lists     [3]aclList
+}
+
+// index of the lists, in order of precedence
+const (
+	aclBlock = iota
+	aclBypass
+	aclProxy
+)
+
+// aclList holds the rules of a list, the CIDRs as sorted ranges of 16 byte
+// addresses.
+type aclList struct {
+	ranges  ipRanges
+	domains *regexp.Regexp
+}
+
+type ipRange struct {
+	lo, hi net.IP
+}
+
+// ipRanges are sorted ranges of 16 byte addresses without overlap.
+type ipRanges []ipRange
+
+var aclSections = map[string]int{
+	"bypass_list":         aclBypass,
+	"black_list":          aclBypass,
+	"proxy_list":          aclProxy,
+	"white_list":          aclProxy,
+	"outbound_block_list": aclBlock,
+	"block_list":          aclBlock,
+}
+
+// LoadACL reads the ACL file at path.
+func LoadACL(path string) (*ACL, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseACL(f)
+}
+
+// ParseACL parses an ACL. Like shadowsocks-libev, rules before the first
+// list go to [bypass_list].
+func ParseACL(r io.Reader) (*ACL, error) {
+	acl := new(ACL)
+	var nets [3][]*net.IPNet
+	var domains [3][]string
+	list := aclBypass
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := sc.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			switch name := line[1 : len(line)-1]; name {
+			case "proxy_all", "accept_all":
+				acl.bypassAll = false
+			case "bypass_all", "reject_all":
+				acl.bypassAll = true
+			default:
+				l, ok := aclSections[name]
+				if !ok {
+					return nil, fmt.Errorf("acl line %d: unknown section %s", n, line)
+				}
+				list = l
+			}
+			continue
+		}
+		if ipnet := parseCIDR(line); ipnet != nil {
+			nets[list] = append(nets[list], ipnet)
+			continue
+		}
+		if _, err := regexp.Compile(line); err != nil {
+			return nil, fmt.Errorf("acl line %d: %v", n, err)
+		}
+		domains[list] = append(domains[list], line)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	for i := range acl.lists {
+		acl.lists[i].ranges = mergeRanges(nets[i])
+		if len(domains[i]) > 0 {
+			// one regexp matches all rules much faster than the rules one by one
+			acl.lists[i].domains = regexp.MustCompile("(?:" + strings.Join(domains[i], ")|(?:") + ")")
+		}
+	}
+	return acl, nil
+}
+
+// parseCIDR parses a CIDR or single IP address, it returns nil for anything
+// else.
+func parseCIDR(s string) *net.IPNet {
+	if _, ipnet, err := net.ParseCIDR(s); err == nil {
+		return ipnet
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+// mergeRanges turns nets into ranges, so an address is looked up with binary
+// search.
+func mergeRanges(nets []*net.IPNet) ipRanges {
+	ranges := make([]ipRange, 0, len(nets))
+	for _, ipnet := range nets {
+		lo := ipnet.IP.To16()
+		hi := make(net.IP, net.IPv6len)
+		mask := ipnet.Mask
+		if len(mask) == net.IPv4len {
+			// IPv4 masks cover the last 4 bytes of 16 byte addresses
+			mask = append(net.CIDRMask(96, 128)[:12], mask...)
+		}
+		for i := range hi {
+			hi[i] = lo[i] | ^mask[i]
+		}
+		ranges = append(ranges, ipRange{lo, hi})
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		return bytes.Compare(ranges[i].lo, ranges[j].lo) < 0
+	})
+	merged := ranges[:0]
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && bytes.Compare(r.lo, merged[n-1].hi) <= 0 {
+			if bytes.Compare(r.hi, merged[n-1].hi) > 0 {
+				merged[n-1].hi = r.hi
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+func (rs ipRanges) contains(ip net.IP) bool {
+	ip = ip.To16()
+	if ip == nil {
+		return false
+	}
+	// first range starting after ip, the one before may hold it
+	i := sort.Search(len(rs), func(i int) bool {
+		return bytes.Compare(rs[i].lo, ip) > 0
+	})
+	return i > 0 && bytes.Compare(ip, rs[i-1].hi) <= 0
+}
+
+func (l *aclList) match(domain string, ip net.IP) bool {
+	return (domain != "" && l.domains != nil && l.domains.MatchString(domain)) ||
+		(ip != nil && l.ranges.contains(ip))
+}
+
+// RejectDomain reports whether destinations named domain are rejected
+// whatever they resolve to, so they needn't be resolved.
+func (acl *ACL) RejectDomain(domain string) bool {
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	return acl.lists[aclBlock].match(domain, nil) || acl.lists[aclBypass].match(domain, nil)
+}
+
+// Allow reports whether the destination with domain name domain, "" for
+// destinations given by address, resolved to ip may be relayed.
+func (acl *ACL) Allow(domain string, ip net.IP) bool {
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	for i := range acl.lists {
+		if acl.lists[i].match(domain, ip) {
+			return i == aclProxy
+		}
+	}
+	return !acl.bypassAll
+}
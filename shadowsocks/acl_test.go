@@ -0,0 +1,71 @@
+package shadowsocks
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestACL(t *testing.T) {
+	acl, err := ParseACL(strings.NewReader(`
+[proxy_all]
+
+[bypass_list]
+10.0.0.0/8
+192.168.1.1  # router
+(^|\.)intra\.example$
+fd00::/8
+
+[proxy_list]
+10.1.0.0/16  # bypass_list takes precedence
+(^|\.)example\.com$
+
+[outbound_block_list]
+198.51.100.0/24
+198.51.100.128/25
+^ads\.
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		domain, ip string
+		allow      bool
+	}{
+		{"", "8.8.8.8", true},
+		{"", "10.1.2.3", false},
+		{"", "192.168.1.1", false},
+		{"", "192.168.1.2", true},
+		{"", "fd12::1", false},
+		{"", "2001:db8::1", true},
+		{"", "198.51.100.200", false},
+		{"", "198.51.101.1", true},
+		{"www.intra.example", "8.8.8.8", false},
+		{"WWW.Example.com.", "8.8.8.8", true},
+		{"ads.example.com", "8.8.8.8", false},
+		{"www.example.com", "10.0.0.1", false},
+	} {
+		if acl.Allow(tc.domain, net.ParseIP(tc.ip)) != tc.allow {
+			t.Errorf("%s %s should be allowed: %v", tc.domain, tc.ip, tc.allow)
+		}
+	}
+
+	if !acl.RejectDomain("ads.example.com") || !acl.RejectDomain("intra.example") || acl.RejectDomain("example.com") {
+		t.Error("only domains in the block and bypass lists should be rejected before resolving")
+	}
+
+	acl, err = ParseACL(strings.NewReader("[bypass_all]\n[proxy_list]\n(^|\\.)example\\.com$\n1.1.1.0/24\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !acl.Allow("example.com", net.ParseIP("8.8.8.8")) || !acl.Allow("", net.ParseIP("1.1.1.1")) ||
+		acl.Allow("", net.ParseIP("8.8.8.8")) || acl.Allow("example.org", net.ParseIP("1.0.0.1")) {
+		t.Error("bypass_all should only allow the proxy list")
+	}
+
+	for _, bad := range []string{"[unknown]\n", "[bypass_list]\n(unclosed\n"} {
+		if _, err = ParseACL(strings.NewReader(bad)); err == nil {
+			t.Errorf("%q should be rejected", bad)
+		}
+	}
+}
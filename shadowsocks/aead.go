@@ -0,0 +1,308 @@
+package shadowsocks
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	mrand "math/rand"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// AEAD ciphers as specified by SIP004. Each direction of a connection starts
+// with a random salt, the session subkey is derived from the key and salt
+// with HKDF-SHA1. TCP data is sent in chunks:
+//
+//	[encrypted payload length][length tag][encrypted payload][payload tag]
+//
+// with a little endian counter as nonce, incremented after each seal/open. A
+// UDP packet is [salt][encrypted payload][tag] with an all zero nonce.
+
+const aeadMaxPayload = 0x3FFF
+
+// aeadPadding flags the length of a padding chunk, whose payload is
+// discarded by the reader. Data chunks never set it, their length is at
+// most aeadMaxPayload. The 2022 methods use all 16 bits of the length and
+// pad their headers instead.
+const aeadPadding = 0x8000
+
+// ErrAuth is returned when AEAD authentication of received data fails,
+// usually because the peer uses a different password or method.
+var ErrAuth = errors.New("shadowsocks: message authentication failed")
+
+// errChunkLength is returned for a chunk length with bits set that are
+// neither the padding flag nor part of a length of at most aeadMaxPayload.
+var errChunkLength = errors.New("shadowsocks: reserved bits set in chunk length")
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func newChaCha20Poly1305(key []byte) (cipher.AEAD, error) {
+	return chacha20poly1305.New(key)
+}
+
+func newXChaCha20Poly1305(key []byte) (cipher.AEAD, error) {
+	return chacha20poly1305.NewX(key)
+}
+
+func newSM4GCM(key []byte) (cipher.AEAD, error) {
+	block, err := newSM4Cipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (c *Cipher) isAEAD() bool {
+	return c.info.newAEAD != nil
+}
+
+// SessionSubkey returns the key of the AEAD session of method with salt,
+// the random salt starting each TCP stream and UDP packet, derived from the
+// master key (see KeyFromPassword) with HKDF-SHA1 and info "ss-subkey"
+// (SIP004), or with BLAKE3 for the Shadowsocks 2022 methods.
+func SessionSubkey(method string, key, salt []byte) ([]byte, error) {
+	mi, ok := cipherMethod[method]
+	if !ok || mi.newAEAD == nil {
+		return nil, errors.New("not an AEAD method: " + method)
+	}
+	if len(key) != mi.keyLen {
+		return nil, fmt.Errorf("%s needs a %d byte key", method, mi.keyLen)
+	}
+	c := &Cipher{key: key, info: mi, sip022: strings.HasPrefix(method, "2022-")}
+	return c.subkey(salt)
+}
+
+// subkeyAEAD derives the session subkey for salt.
+func (c *Cipher) subkeyAEAD(salt []byte) (cipher.AEAD, error) {
+	subkey, err := c.subkey(salt)
+	if err != nil {
+		return nil, err
+	}
+	return c.info.newAEAD(subkey)
+}
+
+func (c *Cipher) subkey(salt []byte) ([]byte, error) {
+	subkey := make([]byte, c.info.keyLen)
+	if c.sip022 {
+		blake3DeriveKey("shadowsocks 2022 session subkey", append(append([]byte{}, c.key...), salt...), subkey)
+		return subkey, nil
+	}
+	if err := hkdfSHA1(c.key, salt, subkey); err != nil {
+		return nil, err
+	}
+	return subkey, nil
+}
+
+// hkdfSHA1 fills subkey with the SIP004 session subkey of key and salt.
+func hkdfSHA1(key, salt, subkey []byte) error {
+	r := hkdf.New(sha1.New, key, salt, []byte("ss-subkey"))
+	_, err := io.ReadFull(r, subkey)
+	return err
+}
+
+func (c *Cipher) initAEADEncrypt() (salt []byte, err error) {
+	salt = make([]byte, c.info.ivLen)
+	if _, err = io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	if c.encAEAD, err = c.subkeyAEAD(salt); err != nil {
+		return nil, err
+	}
+	c.encNonce = make([]byte, c.encAEAD.NonceSize())
+	c.encSalt = salt
+	return append([]byte{}, salt...), nil
+}
+
+func (c *Cipher) initAEADDecrypt(salt []byte) (err error) {
+	if c.decAEAD, err = c.subkeyAEAD(salt); err != nil {
+		return err
+	}
+	c.decNonce = make([]byte, c.decAEAD.NonceSize())
+	c.decSalt = append([]byte{}, salt...)
+	return nil
+}
+
+// increment the little endian nonce
+func increment(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+func (c *Conn) maxPayload() int {
+	if c.sip022 {
+		return sip022MaxPayload
+	}
+	return aeadMaxPayload
+}
+
+// sealChunk appends the encrypted chunk of p to buf.
+func (c *Conn) sealChunk(buf, p []byte) []byte {
+	buf = c.encAEAD.Seal(buf, c.encNonce, p, nil)
+	increment(c.encNonce)
+	return buf
+}
+
+// openChunk reads and decrypts a chunk with size bytes of plaintext.
+// The plaintext is in the read buffer of c, valid until the next chunk is
+// read.
+func (c *Conn) openChunk(size int) ([]byte, error) {
+	buf := connBuf(&c.rb, size+c.decAEAD.Overhead())
+	if err := c.readFull(buf); err != nil {
+		return nil, err
+	}
+	b, err := c.decAEAD.Open(buf[:0], c.decNonce, buf, nil)
+	if err != nil {
+		return nil, ErrAuth
+	}
+	increment(c.decNonce)
+	return b, nil
+}
+
+func (c *Conn) writeAEAD(b []byte) (n int, err error) {
+	buf := c.wb[:0]
+	p := b
+	if c.encAEAD == nil {
+		if c.firstDelay > 0 {
+			time.Sleep(time.Duration(mrand.Int63n(int64(c.firstDelay))))
+		}
+		var salt []byte
+		if salt, err = c.initAEADEncrypt(); err != nil {
+			return
+		}
+		buf = append(buf, salt...)
+		if c.sip022 {
+			if c.decAEAD == nil {
+				// client
+				if buf, err = c.appendIdentityHeaders(buf, c.encSalt); err != nil {
+					return
+				}
+			}
+			if buf, p, err = c.writeHeader2022(buf, b); err != nil {
+				return
+			}
+		} else if c.firstPadding > 0 && (c.decAEAD == nil || c.peerPadded) {
+			// a client writes first, a server only pads for clients that did
+			size := mrand.Intn(c.firstPadding + 1)
+			binary.BigEndian.PutUint16(c.lenBuf[:], uint16(aeadPadding|size))
+			buf = c.sealChunk(buf, c.lenBuf[:])
+			buf = c.sealChunk(buf, make([]byte, size))
+		}
+	}
+	max := c.maxPayload()
+	for len(p) > 0 {
+		size := len(p)
+		if size > max {
+			size = max
+		}
+		binary.BigEndian.PutUint16(c.lenBuf[:], uint16(size))
+		buf = c.sealChunk(buf, c.lenBuf[:])
+		buf = c.sealChunk(buf, p[:size])
+		p = p[size:]
+	}
+	keepBuf(&c.wb, buf)
+	if _, err = c.Conn.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// readAEAD returns data of at most one chunk, the part of the chunk that
+// doesn't fit in b is kept for the next read.
+func (c *Conn) readAEAD(b []byte) (n int, err error) {
+	if len(c.rbuf) > 0 {
+		n = copy(b, c.rbuf)
+		c.rbuf = c.rbuf[n:]
+		return
+	}
+	var payload []byte
+	if c.decAEAD == nil {
+		salt := make([]byte, c.info.ivLen)
+		if err = c.readFull(salt); err != nil {
+			return
+		}
+		if !c.replay.Add(salt) || (c.sip022 && !saltFilter2022.Add(salt)) {
+			return 0, ErrReplay
+		}
+		if err = c.initAEADDecrypt(salt); err != nil {
+			return
+		}
+		if c.sip022 {
+			if payload, err = c.readHeader2022(); err != nil {
+				return
+			}
+		}
+	}
+	for payload == nil {
+		var l []byte
+		if l, err = c.openChunk(2); err != nil {
+			return
+		}
+		size := int(binary.BigEndian.Uint16(l))
+		if !c.sip022 && size&^(aeadPadding|aeadMaxPayload) != 0 {
+			return 0, errChunkLength
+		}
+		if !c.sip022 && size&aeadPadding != 0 {
+			if _, err = c.openChunk(size & aeadMaxPayload); err != nil {
+				return
+			}
+			c.peerPadded = true
+			continue
+		}
+		if payload, err = c.openChunk(size & c.maxPayload()); err != nil {
+			return
+		}
+	}
+	n = copy(b, payload)
+	c.rbuf = payload[n:]
+	return
+}
+
+// sealPacket encrypts a UDP packet.
+func (c *Cipher) sealPacket(b []byte) ([]byte, error) {
+	salt := make([]byte, c.info.ivLen)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	aead, err := c.subkeyAEAD(salt)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(salt, make([]byte, aead.NonceSize()), b, nil), nil
+}
+
+// openPacket decrypts the UDP packet pkt into dst.
+func (c *Cipher) openPacket(dst, pkt []byte) (n int, err error) {
+	if len(pkt) < c.info.ivLen {
+		return 0, errUDPShort
+	}
+	aead, err := c.subkeyAEAD(pkt[:c.info.ivLen])
+	if err != nil {
+		return 0, err
+	}
+	if len(pkt) < c.info.ivLen+aead.Overhead() {
+		return 0, errUDPShort
+	}
+	b, err := aead.Open(dst[:0], make([]byte, aead.NonceSize()), pkt[c.info.ivLen:], nil)
+	if err != nil {
+		return 0, ErrAuth
+	}
+	return len(b), nil
+}
@@ -0,0 +1,282 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+var aeadMethods = []string{"aes-128-gcm", "aes-192-gcm", "aes-256-gcm", "chacha20-ietf-poly1305", "xchacha20-ietf-poly1305", "sm4-gcm"}
+
+// encryptStream writes msg to a Conn with cipher c and returns the ciphertext.
+func encryptStream(t *testing.T, c *Cipher, msg []byte) []byte {
+	var out bytes.Buffer
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		io.Copy(&out, server)
+		close(done)
+	}()
+	if _, err := NewConn(client, c).Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	<-done
+	return out.Bytes()
+}
+
+func readStream(c *Cipher, data []byte, bufSize int) ([]byte, error) {
+	client, server := net.Pipe()
+	go func() {
+		server.Write(data)
+		server.Close()
+	}()
+	conn := NewConn(client, c)
+	var got []byte
+	buf := make([]byte, bufSize)
+	for {
+		n, err := conn.Read(buf)
+		got = append(got, buf[:n]...)
+		if err == io.EOF {
+			return got, nil
+		}
+		if err != nil {
+			return got, err
+		}
+	}
+}
+
+func TestAEADStream(t *testing.T) {
+	msg := make([]byte, 3*aeadMaxPayload+100)
+	rand.Read(msg)
+	for _, method := range aeadMethods {
+		cipher, err := NewCipher(method, "foobar")
+		if err != nil {
+			t.Fatal(method, err)
+		}
+		data := encryptStream(t, cipher.Copy(), msg)
+		// salt, then 4 chunks of length and payload with a tag each
+		if want := cipher.info.ivLen + len(msg) + 4*(2+2*16); len(data) != want {
+			t.Errorf("%s: ciphertext is %d bytes, want %d", method, len(data), want)
+		}
+		// reads smaller than a chunk are served from the decrypted chunk
+		for _, size := range []int{100, 64 * 1024} {
+			got, err := readStream(cipher.Copy(), data, size)
+			if err != nil {
+				t.Fatal(method, err)
+			}
+			if !bytes.Equal(got, msg) {
+				t.Errorf("%s: read with %d byte buffer differs from data written", method, size)
+			}
+		}
+
+		data[len(data)-1] ^= 1
+		if _, err = readStream(cipher.Copy(), data, 1024); err != ErrAuth {
+			t.Errorf("%s: tampered data should give ErrAuth, got %v", method, err)
+		}
+		other, _ := NewCipher(method, "barfoo")
+		if _, err = readStream(other, data, 1024); err != ErrAuth {
+			t.Errorf("%s: wrong password should give ErrAuth, got %v", method, err)
+		}
+	}
+}
+
+func TestAEADChunkLengthReserved(t *testing.T) {
+	cipher, _ := NewCipher("aes-256-gcm", "foobar")
+	for _, flags := range []uint16{0x4000, aeadPadding | 0x4000} {
+		c := NewConn(nil, cipher.Copy())
+		salt, err := c.initAEADEncrypt()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := append([]byte(nil), salt...)
+		binary.BigEndian.PutUint16(c.lenBuf[:], flags|5)
+		data = c.sealChunk(data, c.lenBuf[:])
+		data = c.sealChunk(data, []byte("hello"))
+		if _, err = readStream(cipher.Copy(), data, 1024); err != errChunkLength {
+			t.Errorf("length %#x: got %v, want %v", flags|5, err, errChunkLength)
+		}
+	}
+}
+
+func TestAEADReplay(t *testing.T) {
+	cipher, _ := NewCipher("aes-256-gcm", "foobar")
+	data := encryptStream(t, cipher.Copy(), []byte(text))
+	rf := NewReplayFilter()
+	for i, want := range []error{nil, ErrReplay} {
+		client, server := net.Pipe()
+		go func() {
+			server.Write(data)
+			server.Close()
+		}()
+		conn := NewConn(client, cipher.Copy())
+		conn.SetReplayFilter(rf)
+		_, err := io.ReadAll(conn)
+		if err != want {
+			t.Errorf("read %d: got %v, want %v", i, err, want)
+		}
+	}
+}
+
+func TestAEADFirstFlightPadding(t *testing.T) {
+	msg := []byte(text)
+	for _, method := range aeadMethods {
+		cipher, _ := NewCipher(method, "foobar")
+		sizes := make(map[int]bool)
+		for i := 0; i < 8; i++ {
+			var out bytes.Buffer
+			client, server := net.Pipe()
+			done := make(chan struct{})
+			go func() {
+				io.Copy(&out, server)
+				close(done)
+			}()
+			c := NewConn(client, cipher.Copy())
+			c.SetFirstFlight(1000, time.Millisecond)
+			// only the first write is padded
+			for j := 0; j < 2; j++ {
+				if _, err := c.Write(msg); err != nil {
+					t.Fatal(method, err)
+				}
+			}
+			client.Close()
+			<-done
+			sizes[out.Len()] = true
+			got, err := readStream(cipher.Copy(), out.Bytes(), 4096)
+			if err != nil {
+				t.Fatal(method, err)
+			}
+			if want := text + text; string(got) != want {
+				t.Errorf("%s: got %q, want %q", method, got, want)
+			}
+		}
+		if len(sizes) < 2 {
+			t.Errorf("%s: first flights all have the same size", method)
+		}
+	}
+}
+
+// serverResponse returns the response, as sent, of a server conn padding
+// its first flight with serverPadding to a client padding its request with
+// clientPadding.
+func serverResponse(t *testing.T, cipher *Cipher, clientPadding, serverPadding int) []byte {
+	client, server := net.Pipe()
+	defer client.Close()
+	c := NewConn(client, cipher.Copy())
+	c.SetFirstFlight(clientPadding, 0)
+	go c.Write([]byte("request"))
+	s := NewConn(server, cipher.Copy())
+	s.SetFirstFlight(serverPadding, 0)
+	buf := make([]byte, 64)
+	if _, err := s.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		s.Write([]byte(text))
+		server.Close()
+	}()
+	out, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestAEADPaddingOnlyForPaddingClients(t *testing.T) {
+	for _, method := range aeadMethods {
+		cipher, _ := NewCipher(method, "foobar")
+		plain := len(serverResponse(t, cipher, 0, 0))
+		if n := len(serverResponse(t, cipher, 0, 1000)); n != plain {
+			t.Errorf("%s: response to a client not padding has %d bytes, want %d", method, n, plain)
+		}
+		for i := 0; i < 4; i++ {
+			out := serverResponse(t, cipher, 100, 1000)
+			if len(out) <= plain {
+				t.Errorf("%s: response to a padding client isn't padded", method)
+			}
+			got, err := readStream(cipher.Copy(), out, 4096)
+			if err != nil {
+				t.Fatal(method, err)
+			}
+			if string(got) != text {
+				t.Errorf("%s: got %q, want %q", method, got, text)
+			}
+		}
+	}
+}
+
+func TestAEADPacket(t *testing.T) {
+	for _, method := range aeadMethods {
+		cipher, _ := NewCipher(method, "foobar")
+		pkt, err := cipher.Copy().sealPacket([]byte(text))
+		if err != nil {
+			t.Fatal(method, err)
+		}
+		buf := make([]byte, len(pkt))
+		n, err := cipher.Copy().openPacket(buf, pkt)
+		if err != nil {
+			t.Fatal(method, err)
+		}
+		if string(buf[:n]) != text {
+			t.Errorf("%s: decrypted packet differs", method)
+		}
+		pkt[len(pkt)-1] ^= 1
+		if _, err = cipher.Copy().openPacket(buf, pkt); err != ErrAuth {
+			t.Errorf("%s: tampered packet should give ErrAuth, got %v", method, err)
+		}
+		if _, err = cipher.Copy().openPacket(buf, pkt[:cipher.info.ivLen+1]); err != errUDPShort {
+			t.Errorf("%s: short packet should give errUDPShort, got %v", method, err)
+		}
+	}
+}
+
+func TestSessionSubkey(t *testing.T) {
+	key, err := KeyFromPassword("aes-256-gcm", "foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// EVP_BytesToKey, as computed by OpenSSL
+	if got := hex.EncodeToString(key); got != "3858f62230ac3c915f300c664312c63f568378529614d22ddb49237d2f60bfdf" {
+		t.Errorf("key %s", got)
+	}
+	if _, err = SessionSubkey("aes-256-cfb", key, nil); err == nil {
+		t.Error("subkey of a stream method")
+	}
+	if _, err = SessionSubkey("aes-128-gcm", key, nil); err == nil {
+		t.Error("subkey of a key of the wrong length")
+	}
+
+	// a packet sealed by a Cipher opens with the subkey of its salt
+	for _, method := range append(aeadMethods, "2022-blake3-aes-256-gcm") {
+		password := "foobar"
+		if method == "2022-blake3-aes-256-gcm" {
+			password = "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8="
+		}
+		cipher, _ := NewCipher(method, password)
+		pkt, err := cipher.Copy().sealPacket([]byte(text))
+		if err != nil {
+			t.Fatal(method, err)
+		}
+		if key, err = KeyFromPassword(method, password); err != nil {
+			t.Fatal(method, err)
+		}
+		salt := pkt[:cipher.info.ivLen]
+		subkey, err := SessionSubkey(method, key, salt)
+		if err != nil {
+			t.Fatal(method, err)
+		}
+		aead, err := cipher.info.newAEAD(subkey)
+		if err != nil {
+			t.Fatal(method, err)
+		}
+		b, err := aead.Open(nil, make([]byte, aead.NonceSize()), pkt[len(salt):], nil)
+		if err != nil || string(b) != text {
+			t.Errorf("%s: packet doesn't open with the session subkey: %v", method, err)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package shadowsocks
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// A minimal BLAKE3 implementation, only what Shadowsocks 2022 needs for key
+// derivation: hashing with the derive_key mode and up to 64 bytes of output.
+// See https://github.com/BLAKE3-team/BLAKE3-specs for the reference.
+
+const (
+	blake3BlockLen = 64
+	blake3ChunkLen = 1024
+
+	blake3ChunkStart        = 1 << 0
+	blake3ChunkEnd          = 1 << 1
+	blake3Parent            = 1 << 2
+	blake3Root              = 1 << 3
+	blake3DeriveKeyContext  = 1 << 5
+	blake3DeriveKeyMaterial = 1 << 6
+)
+
+var blake3IV = [8]uint32{
+	0x6A09E667, 0xBB67AE85, 0x3C6EF372, 0xA54FF53A,
+	0x510E527F, 0x9B05688C, 0x1F83D9AB, 0x5BE0CD19,
+}
+
+var blake3Permutation = [16]int{2, 6, 3, 10, 7, 0, 4, 13, 1, 11, 12, 5, 9, 14, 15, 8}
+
+func blake3G(s *[16]uint32, a, b, c, d int, mx, my uint32) {
+	s[a] += s[b] + mx
+	s[d] = bits.RotateLeft32(s[d]^s[a], -16)
+	s[c] += s[d]
+	s[b] = bits.RotateLeft32(s[b]^s[c], -12)
+	s[a] += s[b] + my
+	s[d] = bits.RotateLeft32(s[d]^s[a], -8)
+	s[c] += s[d]
+	s[b] = bits.RotateLeft32(s[b]^s[c], -7)
+}
+
+func blake3Compress(cv *[8]uint32, block *[16]uint32, counter uint64, blockLen, flags uint32) [16]uint32 {
+	s := [16]uint32{
+		cv[0], cv[1], cv[2], cv[3], cv[4], cv[5], cv[6], cv[7],
+		blake3IV[0], blake3IV[1], blake3IV[2], blake3IV[3],
+		uint32(counter), uint32(counter >> 32), blockLen, flags,
+	}
+	m := *block
+	for r := 0; r < 7; r++ {
+		blake3G(&s, 0, 4, 8, 12, m[0], m[1])
+		blake3G(&s, 1, 5, 9, 13, m[2], m[3])
+		blake3G(&s, 2, 6, 10, 14, m[4], m[5])
+		blake3G(&s, 3, 7, 11, 15, m[6], m[7])
+		blake3G(&s, 0, 5, 10, 15, m[8], m[9])
+		blake3G(&s, 1, 6, 11, 12, m[10], m[11])
+		blake3G(&s, 2, 7, 8, 13, m[12], m[13])
+		blake3G(&s, 3, 4, 9, 14, m[14], m[15])
+		var pm [16]uint32
+		for i, j := range blake3Permutation {
+			pm[i] = m[j]
+		}
+		m = pm
+	}
+	for i := 0; i < 8; i++ {
+		s[i] ^= s[i+8]
+		s[i+8] ^= cv[i]
+	}
+	return s
+}
+
+func blake3Words(b []byte) (w [16]uint32) {
+	var block [blake3BlockLen]byte
+	copy(block[:], b)
+	for i := range w {
+		w[i] = binary.LittleEndian.Uint32(block[4*i:])
+	}
+	return
+}
+
+// blake3Output is a compression that hasn't been done yet, because whether
+// it's the root depends on input that may follow.
+type blake3Output struct {
+	cv       [8]uint32
+	block    [16]uint32
+	counter  uint64
+	blockLen uint32
+	flags    uint32
+}
+
+func (o *blake3Output) chainingValue() (cv [8]uint32) {
+	s := blake3Compress(&o.cv, &o.block, o.counter, o.blockLen, o.flags)
+	copy(cv[:], s[:8])
+	return
+}
+
+func (o *blake3Output) root(out []byte) {
+	s := blake3Compress(&o.cv, &o.block, 0, o.blockLen, o.flags|blake3Root)
+	var b [blake3BlockLen]byte
+	for i, w := range s {
+		binary.LittleEndian.PutUint32(b[4*i:], w)
+	}
+	copy(out, b[:])
+}
+
+// blake3Hash hashes in with key as chaining value and the given mode flags,
+// filling out, which must be at most 64 bytes.
+func blake3Hash(key *[8]uint32, flags uint32, in, out []byte) {
+	var stack [][8]uint32
+	var chunks uint64
+	// all chunks but the last are complete and not the root
+	for len(in) > blake3ChunkLen {
+		o := blake3Chunk(key, flags, chunks, in[:blake3ChunkLen])
+		cv := o.chainingValue()
+		in = in[blake3ChunkLen:]
+		chunks++
+		for n := chunks; n&1 == 0; n >>= 1 {
+			cv = blake3ParentOutput(&stack[len(stack)-1], &cv, key, flags).chainingValue()
+			stack = stack[:len(stack)-1]
+		}
+		stack = append(stack, cv)
+	}
+	o := blake3Chunk(key, flags, chunks, in)
+	for i := len(stack) - 1; i >= 0; i-- {
+		cv := o.chainingValue()
+		o = blake3ParentOutput(&stack[i], &cv, key, flags)
+	}
+	o.root(out)
+}
+
+// blake3Chunk compresses all blocks of a chunk but the last.
+func blake3Chunk(key *[8]uint32, flags uint32, counter uint64, chunk []byte) *blake3Output {
+	cv := *key
+	start := uint32(blake3ChunkStart)
+	for len(chunk) > blake3BlockLen {
+		block := blake3Words(chunk[:blake3BlockLen])
+		s := blake3Compress(&cv, &block, counter, blake3BlockLen, flags|start)
+		copy(cv[:], s[:8])
+		chunk = chunk[blake3BlockLen:]
+		start = 0
+	}
+	return &blake3Output{
+		cv:       cv,
+		block:    blake3Words(chunk),
+		counter:  counter,
+		blockLen: uint32(len(chunk)),
+		flags:    flags | start | blake3ChunkEnd,
+	}
+}
+
+func blake3ParentOutput(left, right, key *[8]uint32, flags uint32) *blake3Output {
+	o := &blake3Output{cv: *key, blockLen: blake3BlockLen, flags: flags | blake3Parent}
+	copy(o.block[:8], left[:])
+	copy(o.block[8:], right[:])
+	return o
+}
+
+// blake3DeriveKey fills out with key material derived from material in the
+// given context, like the BLAKE3 derive_key function.
+func blake3DeriveKey(context string, material, out []byte) {
+	var ck [32]byte
+	blake3Hash(&blake3IV, blake3DeriveKeyContext, []byte(context), ck[:])
+	var key [8]uint32
+	for i := range key {
+		key[i] = binary.LittleEndian.Uint32(ck[4*i:])
+	}
+	blake3Hash(&key, blake3DeriveKeyMaterial, material, out)
+}
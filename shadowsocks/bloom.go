@@ -0,0 +1,70 @@
+package shadowsocks
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+)
+
+// bloomFilter is a bloom filter of IVs. The fields are exported for gob.
+type bloomFilter struct {
+	Salt uint64 // keys the hash, so probers can't pick colliding IVs
+	K    int    // number of hash functions
+	Bits []uint64
+	N    int // keys added
+}
+
+// bloomSize returns the number of bits and hash functions of a filter
+// holding capacity keys with false positive rate fpRate.
+func bloomSize(capacity int, fpRate float64) (m uint64, k int) {
+	m = uint64(math.Ceil(-float64(capacity) * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	m = (m + 63) &^ 63
+	k = int(math.Round(float64(m) / float64(capacity) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return
+}
+
+func newBloomFilter(capacity int, fpRate float64) *bloomFilter {
+	m, k := bloomSize(capacity, fpRate)
+	var salt [8]byte
+	rand.Read(salt[:])
+	return &bloomFilter{Salt: binary.LittleEndian.Uint64(salt[:]), K: k, Bits: make([]uint64, m/64)}
+}
+
+// hashes returns the two hashes combined into the K bit positions of key.
+func (bf *bloomFilter) hashes(key []byte) (h1, h2 uint64) {
+	h := fnv.New64a()
+	var salt [8]byte
+	binary.LittleEndian.PutUint64(salt[:], bf.Salt)
+	h.Write(salt[:])
+	h.Write(key)
+	h1 = h.Sum64()
+	h.Write(salt[:])
+	h2 = h.Sum64() | 1
+	return
+}
+
+func (bf *bloomFilter) test(key []byte) bool {
+	h1, h2 := bf.hashes(key)
+	m := uint64(len(bf.Bits)) * 64
+	for i := 0; i < bf.K; i++ {
+		bit := (h1 + uint64(i)*h2) % m
+		if bf.Bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (bf *bloomFilter) add(key []byte) {
+	h1, h2 := bf.hashes(key)
+	m := uint64(len(bf.Bits)) * 64
+	for i := 0; i < bf.K; i++ {
+		bit := (h1 + uint64(i)*h2) % m
+		bf.Bits[bit/64] |= 1 << (bit % 64)
+	}
+	bf.N++
+}
@@ -0,0 +1,132 @@
+package shadowsocks
+
+import (
+	"expvar"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Buffers of the relays come from pools of three sizes: small for short
+// datagrams, medium for TCP pipes and large for full size datagrams.
+const (
+	SmallBufSize  = 2 * 1024
+	MediumBufSize = 8 * 1024
+	LargeBufSize  = 64 * 1024
+)
+
+var bufTiers = [...]int{SmallBufSize, MediumBufSize, LargeBufSize}
+
+var bufPools [len(bufTiers)]sync.Pool
+
+// bufStats counts the buffers of a tier while buffer accounting is on.
+type bufStats struct {
+	gets, puts int64
+}
+
+var (
+	bufAccounting int32
+	bufCounts     [len(bufTiers) + 1]bufStats // the last counts oversized buffers
+)
+
+func init() {
+	for i := range bufPools {
+		size := bufTiers[i]
+		bufPools[i].New = func() interface{} {
+			return make([]byte, size)
+		}
+	}
+	expvar.Publish("buffers", expvar.Func(func() interface{} {
+		if atomic.LoadInt32(&bufAccounting) == 0 {
+			return nil
+		}
+		return BufferStats()
+	}))
+}
+
+// bufTier returns the index of the smallest tier holding n bytes,
+// len(bufTiers) if none does.
+func bufTier(n int) int {
+	for i, size := range bufTiers {
+		if n <= size {
+			return i
+		}
+	}
+	return len(bufTiers)
+}
+
+// GetBuf returns a buffer of n bytes from the smallest pool holding them, or
+// a new one if n is larger than LargeBufSize. Give it back with PutBuf once
+// it's no longer used.
+func GetBuf(n int) []byte {
+	i := bufTier(n)
+	if atomic.LoadInt32(&bufAccounting) != 0 {
+		atomic.AddInt64(&bufCounts[i].gets, 1)
+	}
+	if i == len(bufTiers) {
+		return make([]byte, n)
+	}
+	return bufPools[i].Get().([]byte)[:n]
+}
+
+// PutBuf gives back a buffer returned by GetBuf, resliced or not. Buffers of
+// other sizes are left to the garbage collector.
+func PutBuf(b []byte) {
+	i := len(bufTiers)
+	for j, size := range bufTiers {
+		if cap(b) == size {
+			i = j
+			break
+		}
+	}
+	if atomic.LoadInt32(&bufAccounting) != 0 {
+		atomic.AddInt64(&bufCounts[i].puts, 1)
+	}
+	if i < len(bufTiers) {
+		bufPools[i].Put(b[:cap(b)])
+	}
+}
+
+// SetBufferAccounting turns on or off counting the buffers taken and given
+// back, to tell leaks, shown in the buffers expvar. The counts restart when
+// it's turned on, so buffers taken before show as given back too often.
+func SetBufferAccounting(on bool) {
+	if !on {
+		atomic.StoreInt32(&bufAccounting, 0)
+		return
+	}
+	if atomic.LoadInt32(&bufAccounting) != 0 {
+		return
+	}
+	for i := range bufCounts {
+		atomic.StoreInt64(&bufCounts[i].gets, 0)
+		atomic.StoreInt64(&bufCounts[i].puts, 0)
+	}
+	atomic.StoreInt32(&bufAccounting, 1)
+}
+
+// BufferUsage is the accounting of the buffers of a size.
+type BufferUsage struct {
+	Gets        int64 `json:"gets"`
+	Puts        int64 `json:"puts"`
+	Outstanding int64 `json:"outstanding"`
+}
+
+// BufferStats returns the buffer accounting by buffer size, "oversized" for
+// buffers larger than LargeBufSize, see SetBufferAccounting.
+func BufferStats() map[string]BufferUsage {
+	m := make(map[string]BufferUsage, len(bufCounts))
+	for i := range bufCounts {
+		name := "oversized"
+		if i < len(bufTiers) {
+			name = strconv.Itoa(bufTiers[i])
+		}
+		u := BufferUsage{
+			Gets: atomic.LoadInt64(&bufCounts[i].gets),
+			Puts: atomic.LoadInt64(&bufCounts[i].puts),
+		}
+		u.Outstanding = u.Gets - u.Puts
+		m[name] = u
+	}
+	return m
+}
@@ -0,0 +1,42 @@
+package shadowsocks
+
+import "testing"
+
+func TestGetBuf(t *testing.T) {
+	for _, tt := range []struct{ n, cap int }{
+		{1, SmallBufSize},
+		{SmallBufSize, SmallBufSize},
+		{SmallBufSize + 1, MediumBufSize},
+		{udpMaxSizeDefault + 1, LargeBufSize},
+		{LargeBufSize + 1, LargeBufSize + 1},
+	} {
+		b := GetBuf(tt.n)
+		if len(b) != tt.n || cap(b) != tt.cap {
+			t.Errorf("GetBuf(%d) has len %d cap %d, want cap %d", tt.n, len(b), cap(b), tt.cap)
+		}
+		PutBuf(b[:1])
+	}
+}
+
+func TestBufferAccounting(t *testing.T) {
+	SetBufferAccounting(true)
+	defer SetBufferAccounting(false)
+	a, b := GetBuf(100), GetBuf(MediumBufSize)
+	PutBuf(a)
+	c := GetBuf(LargeBufSize + 1)
+	PutBuf(c)
+	m := BufferStats()
+	if u := m["2048"]; u.Gets != 1 || u.Puts != 1 || u.Outstanding != 0 {
+		t.Errorf("small buffers %+v", u)
+	}
+	if u := m["8192"]; u.Gets != 1 || u.Outstanding != 1 {
+		t.Errorf("medium buffers %+v", u)
+	}
+	if u := m["oversized"]; u.Gets != 1 || u.Outstanding != 0 {
+		t.Errorf("oversized buffers %+v", u)
+	}
+	PutBuf(b)
+	if u := BufferStats()["8192"]; u.Outstanding != 0 {
+		t.Errorf("medium buffers %+v after PutBuf", u)
+	}
+}
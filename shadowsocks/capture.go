@@ -0,0 +1,93 @@
+package shadowsocks
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// RecordConn remembers the first bytes read from the underlying connection,
+// so failed handshakes can be logged with the raw data the peer sent.
+type RecordConn struct {
+	net.Conn
+	start time.Time
+	max   int
+	head  []byte
+	total int64
+}
+
+func NewRecordConn(c net.Conn, max int) *RecordConn {
+	return &RecordConn{Conn: c, start: time.Now(), max: max}
+}
+
+func (c *RecordConn) CloseWrite() error {
+	return CloseWrite(c.Conn)
+}
+
+func (c *RecordConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	if left := c.max - len(c.head); left > 0 && n > 0 {
+		if left > n {
+			left = n
+		}
+		c.head = append(c.head, b[:left]...)
+	}
+	c.total += int64(n)
+	return
+}
+
+type probeCapture struct {
+	Time      time.Time `json:"time"`
+	Client    string    `json:"client"`
+	Port      string    `json:"port"`
+	ElapsedMs int64     `json:"elapsed_ms"`
+	BytesRead int64     `json:"bytes_read"`
+	Head      string    `json:"head"`
+	Error     string    `json:"error"`
+	RTTUs     uint32    `json:"rtt_us,omitempty"`
+	MSS       uint32    `json:"mss,omitempty"`
+}
+
+// ProbeLog writes one JSON record per failed handshake.
+type ProbeLog struct {
+	sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+func OpenProbeLog(path string) (*ProbeLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &ProbeLog{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+// Record logs the data read from c before the handshake failed with err.
+func (pl *ProbeLog) Record(c *RecordConn, port string, err error) {
+	r := &probeCapture{
+		Time:      c.start,
+		Client:    c.RemoteAddr().String(),
+		Port:      port,
+		ElapsedMs: int64(time.Since(c.start) / time.Millisecond),
+		BytesRead: c.total,
+		Head:      hex.EncodeToString(c.head),
+		Error:     err.Error(),
+	}
+	r.RTTUs, r.MSS, _ = tcpInfo(c.Conn)
+
+	pl.Lock()
+	defer pl.Unlock()
+	if err := pl.enc.Encode(r); err != nil {
+		logger.Debug("write probe log:", err)
+	}
+}
+
+func (pl *ProbeLog) Close() error {
+	pl.Lock()
+	defer pl.Unlock()
+	return pl.f.Close()
+}
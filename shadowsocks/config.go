@@ -13,7 +13,11 @@ import (
 	"io/ioutil"
 	// "log"
 	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -22,22 +26,556 @@ type Config struct {
 	ServerPort int         `json:"server_port"`
 	LocalPort  int         `json:"local_port"`
 	Password   string      `json:"password"`
-	Method     string      `json:"method"` // encryption method
-	Net        int         `json:"net"`
+	// file holding password, or directory of files named by port holding
+	// the password of that port (e.g. docker/kubernetes secrets)
+	PasswordFile string `json:"password_file"`
+	// environment variable holding password, and the files or environment
+	// variables holding the password of ports, by port
+	PasswordEnv      string            `json:"password_env"`
+	PortPasswordFile map[string]string `json:"port_password_file"`
+	PortPasswordEnv  map[string]string `json:"port_password_env"`
+	Method           string            `json:"method"` // encryption method
+	Net              int               `json:"net"`
+
+	// directory of config fragments merged on top of this config
+	ConfDir string `json:"conf_dir"`
+
+	// transport of the shadowsocks stream, "tcp" (default), "ws", "tls",
+	// "wss", "quic" or "kcp", and the transport of ports using another
+	Transport     string            `json:"transport"`
+	PortTransport map[string]string `json:"port_transport"`
+	// encryption method of the ports not using the one of method, e.g.
+	// legacy stream method users next to AEAD ones
+	PortMethod map[string]string `json:"port_method"`
+	// allow the broken or weak methods of InsecureCipher
+	AllowInsecureCiphers bool `json:"allow_insecure_ciphers"`
+	// path of WebSocket upgrades, "/" by default, and the Host header sent
+	// by clients, the server address by default
+	WSPath string `json:"ws_path"`
+	WSHost string `json:"ws_host"`
+	// certificate of the server for the TLS and QUIC transports, from files
+	// or issued by ACME (e.g. Let's Encrypt) for the domains, kept in the
+	// cache directory, ACME is TLS only
+	TLSCert        string   `json:"tls_cert"`
+	TLSKey         string   `json:"tls_key"`
+	TLSACMEDomains []string `json:"tls_acme_domains"`
+	TLSACMEEmail   string   `json:"tls_acme_email"`
+	TLSACMECache   string   `json:"tls_acme_cache"`
+	// name the client sends in SNI and verifies the certificate against,
+	// and a CA certificate file to verify it with instead of the system's
+	TLSServerName string `json:"tls_server_name"`
+	TLSCA         string `json:"tls_ca"`
+	// parameters of the kcp transport
+	KCP *KCPConfig `json:"kcp"`
+	// multiplex TCP relays over a few connections, set on both ends, and
+	// the connections a client keeps to each server, 2 by default
+	Mux      bool `json:"mux"`
+	MuxConns int  `json:"mux_conns"`
+	// carry the UDP relay in TCP connections, set on both ends
+	UoT bool `json:"uot"`
+	// TCP Fast Open on server listeners and client connections to servers,
+	// Linux only
+	FastOpen bool `json:"fast_open"`
+	// Multipath TCP on server listeners and outbound connections, and client
+	// connections to servers, Linux only
+	MPTCP bool `json:"mptcp"`
+	// socket options of accepted and dialed TCP connections
+	TCP *TCPOptions `json:"tcp"`
 
 	// following options are only used by server
 	PortPassword map[string][3]string `json:"port_password"`
-	Timeout      int                  `json:"timeout"`
+	// users sharing a port, told apart by their key, by port and user id
+	PortUsers map[string]map[string]string `json:"port_users"`
+	Timeout   int                          `json:"timeout"`
+	// seconds reads from the clients of TCP relays may idle, timeout by
+	// default, and reads from their destinations, no limit by default
+	ClientTimeout int `json:"client_timeout"`
+	RemoteTimeout int `json:"remote_timeout"`
+	// seconds a TCP relay may last, no limit if 0
+	MaxLifetime int `json:"max_lifetime"`
+	// seconds a UDP NAT entry lives without datagrams from the client, 120
+	// by default
+	UDPTimeout int `json:"udp_timeout"`
+	// udp_timeout by port
+	PortUDPTimeout map[string]int `json:"port_udp_timeout"`
+	// max UDP NAT entries, each using a socket, 0 for no limit, and what to
+	// do with new clients past it: "lru" closes the least recently used
+	// entry, "reject" drops their datagrams
+	UDPNATMax   int    `json:"udp_nat_max"`
+	UDPNATEvict string `json:"udp_nat_evict"`
+	// largest datagram relayed, 65535 by default
+	UDPMaxSize int `json:"udp_max_size"`
+	// max new handshakes per second from a single source IP on each port
+	HandshakeRate int `json:"handshake_rate"`
+	// limits of each source IP across all ports, 0 for none: open TCP
+	// connections, new connections per second and UDP NAT entries, and
+	// seconds a source going over one is banned, 0 only rejects the excess
+	SourceMaxConns int `json:"source_max_conns"`
+	SourceConnRate int `json:"source_conn_rate"`
+	SourceMaxUDP   int `json:"source_max_udp"`
+	SourceBanTime  int `json:"source_ban_time"`
+	// sources failing ban_failures handshakes (wrong password or method,
+	// malformed or replayed requests) within ban_window seconds, 600 by
+	// default, are banned for ban_time seconds, 3600 by default, 0 disables
+	BanFailures int `json:"ban_failures"`
+	BanWindow   int `json:"ban_window"`
+	BanTime     int `json:"ban_time"`
+	// command run for each ban, e.g. adding the source to an nftables set
+	// or ipset with a timeout, {ip} and {seconds} are replaced
+	BanCommand string `json:"ban_command"`
+	// seconds connections of ports removed or restarted by a reload keep
+	// running before they're closed, 30 by default, -1 closes them at once
+	DrainTimeout int `json:"drain_timeout"`
+	// seconds the server waits for open connections to finish when it's
+	// stopped by SIGTERM or SIGINT, 30 by default
+	ShutdownTimeout int `json:"shutdown_timeout"`
+	// hold connections from flagged probers open instead of closing them
+	Tarpit bool `json:"tarpit"`
+	// pad the first flight of AEAD connections with up to this many bytes,
+	// and delay the first response by up to this many milliseconds, so
+	// their size and timing vary. Padding isn't SIP004: the server only pads
+	// responses to clients that padded their requests, the local pads its
+	// requests, so it must only be set when the server is shadowsocks-go
+	FirstFlightPadding int `json:"first_flight_padding"`
+	ResponseJitter     int `json:"response_jitter"`
+	// on failed handshakes, "discard" reads until the client times out,
+	// host:port relays the connection to a decoy server there
+	Fallback string `json:"fallback"`
+	// sockets accepting the connections of each port, sharing it by
+	// SO_REUSEPORT, Linux only
+	ReusePort int `json:"reuseport"`
+	// seconds to keep retrying a port that fails to bind, -1 disables retry
+	BindRetry int `json:"bind_retry"`
+	// port range (e.g. "9000-9010") to bind instead of a port that can't be bound
+	PortFallback map[string]string `json:"port_fallback"`
+	// addresses of ports, e.g. ["0.0.0.0:8388", "[::]:9388"], instead of all
+	// addresses, IP literals bind their IP version only, see ListenNetwork.
+	// Addresses without port or with the port itself follow it to fallback
+	// and rotated ports
+	PortListen map[string][]string `json:"port_listen"`
+	// addresses or CIDRs of the proxies, or "unix" for unix sockets, whose
+	// TCP connections start with a PROXY protocol header giving the client
+	ProxyProtocol []string `json:"proxy_protocol"`
+	// ports listening on a random port of a range, chosen again on a
+	// schedule, and published by SIP008
+	PortRotate map[string]*PortRotation `json:"port_rotate"`
+	// traffic quota of ports in GB, a port is closed when it's used up
+	PortQuota map[string]float64 `json:"port_quota"`
+	// throughput limits in Mbit/s of every port, of single ports overriding
+	// speed_limit_mbps, and of each connection
+	SpeedLimit     float64            `json:"speed_limit_mbps"`
+	PortSpeedLimit map[string]float64 `json:"port_speed_limit_mbps"`
+	ConnSpeedLimit float64            `json:"conn_speed_limit_mbps"`
+	// open client connections of every port, and of single ports overriding
+	// max_connections, the ones over it are closed after the accept
+	MaxConnections     int            `json:"max_connections"`
+	PortMaxConnections map[string]int `json:"port_max_connections"`
+	// open files limit of the server process, raised to at start, Linux
+	// only; the hard limit if 0
+	MaxOpenFiles int `json:"max_open_files"`
+	// DNS server used to resolve destination hostnames, host:port or
+	// udp://, tcp://, tls:// (DoT) or https:// (DoH) URL, and servers tried
+	// after it, and the number of names whose answers are cached
+	DNSServer    string   `json:"dns_server"`
+	DNSServers   []string `json:"dns_servers"`
+	DNSCacheSize int      `json:"dns_cache_size"`
+	// address family of destinations with both: "prefer_ipv6" (default),
+	// "prefer_ipv4", "ipv4_only" or "ipv6_only", and by port
+	IPPreference     string            `json:"ip_preference"`
+	PortIPPreference map[string]string `json:"port_ip_preference"`
+	// source address and network interface (Linux only) of relayed
+	// traffic, for hosts with several
+	OutboundBind      string `json:"outbound_bind"`
+	OutboundInterface string `json:"outbound_interface"`
+	// upstream proxy of connections to destinations,
+	// socks5://[user:pass@]host:port or ss://method:password@host:port
+	Forward string `json:"forward"`
+	// name resolved by the health check, example.com by default
+	HealthCanary string `json:"health_canary"`
+	// reject connections reusing a recently seen IV, and keep the seen IVs
+	// in replay_filter_file across restarts
+	ReplayFilter     bool   `json:"replay_filter"`
+	ReplayFilterFile string `json:"replay_filter_file"`
+	// bound the memory of the replay filter with bloom filters of this many
+	// IVs and false positive rate, 0 keeps all IVs exactly
+	ReplayFilterCapacity int     `json:"replay_filter_capacity"`
+	ReplayFilterFPRate   float64 `json:"replay_filter_fp_rate"`
+	// networks clients may not connect to: "legacy" (default) denies
+	// 127.0.0.0/8, 10.8.0.0/16 and ::1, "private" also private and
+	// link-local networks, "none" only dest_deny
+	DestPolicy string `json:"dest_policy"`
+	// CIDRs denied in addition to dest_policy
+	DestDeny []string `json:"dest_deny"`
+	// host:port destinations allowed despite being denied
+	DestAllow []string `json:"dest_allow"`
+	// shadowsocks-libev style ACL file checked against destinations
+	ACL string `json:"acl"`
+	// MaxMind DB (e.g. GeoLite2-Country.mmdb) used by geoip_rules
+	GeoIPDatabase string `json:"geoip_database"`
+	// countries destinations of ports may or may not be in, the rule of
+	// port "*" applies to ports without their own
+	GeoIPRules map[string]*GeoIPRule `json:"geoip_rules"`
+	// destination ports clients of each port may connect to, the rule of
+	// port "*" applies to ports without their own
+	DestPorts map[string]*DestPortRule `json:"dest_ports"`
+	// record raw bytes of failed handshakes to this file
+	ProbeLog      string `json:"probe_log"`
+	ProbeLogBytes int    `json:"probe_log_bytes"`
+	// relayed connections are recorded to this file, or to syslog with
+	// "syslog", access_log_sample_rate of them, 1 (all) by default, their
+	// destinations masked by access_log_mask: none (default), domain, hash
+	// or port
+	AccessLog           string  `json:"access_log"`
+	AccessLogSampleRate float64 `json:"access_log_sample_rate"`
+	AccessLogMask       string  `json:"access_log_mask"`
+
+	// ports grouped by tenant, each tenant may override defaults
+	Tenants map[string]*Tenant `json:"tenants"`
+	// management API listen address and admin token
+	ManagerAddress string `json:"manager_address"`
+	ManagerToken   string `json:"manager_token"`
+	// HTTP address serving profiles, expvar counters and the relayed
+	// connections for troubleshooting
+	DebugAddress string `json:"debug_address"`
+	// UDP address on loopback, or unix socket, serving the ss-manager
+	// protocol of shadowsocks-libev, which has no authentication
+	SSManagerAddress string `json:"ss_manager_address"`
+	// allow an ss_manager_address not on loopback
+	SSManagerRemote bool `json:"ss_manager_remote"`
+	// traffic of removed temporary ports is appended to this file
+	StatsArchive string `json:"stats_archive"`
+	// the process id is written to this file, like -pidfile, so the port
+	// subcommand finds the server to reload
+	PidFile string `json:"pid_file"`
+	// traffic counters are saved to this JSON file every minute and on
+	// shutdown, and restored from it on start
+	TrafficFile string `json:"traffic_file"`
+	// the traffic by port and user since the last report is posted to this
+	// URL every traffic_webhook_interval seconds, 60 by default, signed
+	// with HMAC-SHA256 keyed by traffic_webhook_secret
+	TrafficWebhook         string `json:"traffic_webhook"`
+	TrafficWebhookInterval int    `json:"traffic_webhook_interval"`
+	TrafficWebhookSecret   string `json:"traffic_webhook_secret"`
+	// spans of the connections are exported to this OTLP/HTTP collector,
+	// e.g. http://127.0.0.1:4318, for trace_sample_rate of them, 1 (all)
+	// by default
+	TraceEndpoint   string  `json:"trace_endpoint"`
+	TraceSampleRate float64 `json:"trace_sample_rate"`
+	// SIP008 online config documents clients subscribe to
+	OnlineConfig *OnlineConfig `json:"online_config"`
+	// log levels and format like the -log-level and -log-format flags,
+	// which take precedence, changed by a reload
+	LogLevel  string `json:"log_level"`
+	LogFormat string `json:"log_format"`
+	// count the relay buffers taken and given back, shown in the buffers
+	// expvar, to tell leaks
+	BufferDebug bool `json:"buffer_debug"`
 
 	// following options are only used by client
 
 	// The order of servers in the client config is significant, so use array
 	// instead of map to preserve the order.
 	ServerPassword [][]string `json:"server_password"`
+
+	// options of the config files no field has, see UnknownOptions
+	unknown []string
+	// options the config file sets, even to a zero value, see UpdateConfig
+	set map[string]bool
+	// tenant each port was merged from by MergeTenants
+	tenantPorts map[string]string
+}
+
+// PortRotation moves a port to a random free port of Range, e.g.
+// "20000-29999", on Schedule, see ParseSchedule.
+type PortRotation struct {
+	Range    string `json:"range"`
+	Schedule string `json:"schedule"`
+}
+
+// Tenant groups ports of one reseller. Options left empty in the tenant
+// take the value from the top level config.
+type Tenant struct {
+	Method       string               `json:"method"`
+	Token        string               `json:"token"` // management API token scoped to this tenant
+	PortPassword map[string][3]string `json:"port_password"`
+}
+
+// OnlineConfig serves the SIP008 online config document of each port, which
+// clients subscribe to, to provision the server with its password.
+type OnlineConfig struct {
+	Address string `json:"address"` // listen address of the endpoint
+	// TLS certificate and key files, plain HTTP is served without them, e.g.
+	// behind a reverse proxy terminating TLS
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+	// hostname or address of this server clients connect to
+	Server  string `json:"server"`
+	Remarks string `json:"remarks"`
+	// plugin of ports, the plugin of "*" applies to ports without their own
+	Plugins map[string]*SIP008Plugin `json:"plugins"`
+}
+
+// KCPConfig holds the parameters of the kcp transport, named like the
+// kcptun options they match. Zero values take the defaults of kcptun.
+type KCPConfig struct {
+	Key   string `json:"key"`   // the password of the port by default
+	Crypt string `json:"crypt"` // aes, aes-128, aes-192, blowfish, twofish, cast5, 3des, xtea, sm4, salsa20, none or null
+	Mode  string `json:"mode"`  // normal, fast (default), fast2 or fast3
+	MTU   int    `json:"mtu"`
+	// windows in packets, 1024 on servers, 128 and 512 on clients by default
+	SndWnd int `json:"sndwnd"`
+	RcvWnd int `json:"rcvwnd"`
+	// packets of each FEC group, 10 and 3 if both are 0, FEC is off unless
+	// both are positive
+	DataShard   int  `json:"datashard"`
+	ParityShard int  `json:"parityshard"`
+	NoComp      bool `json:"nocomp"` // don't wrap the streams in snappy framing
+}
+
+// TCPOptions are socket options of TCP connections, zero values keep the
+// defaults of the system, or of Go: keepalive every 15 seconds and no Nagle
+// delay.
+type TCPOptions struct {
+	KeepAlive  int   `json:"keepalive"`   // seconds between keepalive probes, -1 turns them off
+	NoDelay    *bool `json:"nodelay"`     // false delays small writes (Nagle's algorithm)
+	SendBuffer int   `json:"send_buffer"` // SO_SNDBUF in bytes
+	RecvBuffer int   `json:"recv_buffer"` // SO_RCVBUF in bytes
+	// milliseconds sent data may stay unacknowledged before the connection
+	// is dropped (TCP_USER_TIMEOUT), Linux only
+	UserTimeout int `json:"user_timeout"`
+}
+
+// SIP008Plugin is the SIP003 plugin clients run for a port.
+type SIP008Plugin struct {
+	Plugin     string `json:"plugin"`
+	PluginOpts string `json:"plugin_opts"`
+}
+
+// GeoIPRule restricts the destinations of a port by country, given as ISO
+// 3166-1 codes like "CN". Destinations not found in the database are in no
+// country.
+type GeoIPRule struct {
+	Allow []string `json:"allow,omitempty"` // only these countries, if not empty
+	Deny  []string `json:"deny,omitempty"`
+}
+
+// Allows reports whether destinations in country are allowed by the rule.
+func (r *GeoIPRule) Allows(country string) bool {
+	for _, c := range r.Deny {
+		if strings.EqualFold(c, country) {
+			return false
+		}
+	}
+	if len(r.Allow) == 0 {
+		return true
+	}
+	for _, c := range r.Allow {
+		if strings.EqualFold(c, country) {
+			return true
+		}
+	}
+	return false
+}
+
+// DestPortRule restricts the destination ports of a port, given as numbers
+// like "443" or ranges like "8000-8100". Users sharing the port may have
+// rules of their own.
+type DestPortRule struct {
+	Allow []string                 `json:"allow,omitempty"` // only these ports, if not empty
+	Deny  []string                 `json:"deny,omitempty"`
+	Users map[string]*DestPortRule `json:"users,omitempty"`
+}
+
+// parsePortSpec parses a port number or a range of them.
+func parsePortSpec(s string) (lo, hi int, err error) {
+	lo, err = strconv.Atoi(s)
+	hi = lo
+	if i := strings.IndexByte(s, '-'); i > 0 {
+		lo, err = strconv.Atoi(s[:i])
+		if err == nil {
+			hi, err = strconv.Atoi(s[i+1:])
+		}
+	}
+	if err != nil || lo < 1 || hi > 65535 || lo > hi {
+		return 0, 0, fmt.Errorf("invalid port or port range %q", s)
+	}
+	return lo, hi, nil
+}
+
+func matchPorts(specs []string, port int) bool {
+	for _, s := range specs {
+		if lo, hi, err := parsePortSpec(s); err == nil && lo <= port && port <= hi {
+			return true
+		}
+	}
+	return false
+}
+
+// Check checks the ports of the rule and of its users.
+func (r *DestPortRule) Check() error {
+	for _, specs := range [][]string{r.Allow, r.Deny} {
+		for _, s := range specs {
+			if _, _, err := parsePortSpec(s); err != nil {
+				return err
+			}
+		}
+	}
+	for user, ur := range r.Users {
+		if ur == nil {
+			continue
+		}
+		if len(ur.Users) > 0 {
+			return fmt.Errorf("user %s: users can't have users", user)
+		}
+		if err := ur.Check(); err != nil {
+			return fmt.Errorf("user %s: %v", user, err)
+		}
+	}
+	return nil
+}
+
+// Of returns the rule of user, the rule of the port if the user has none.
+func (r *DestPortRule) Of(user string) *DestPortRule {
+	if ur, ok := r.Users[user]; ok && ur != nil {
+		return ur
+	}
+	return r
+}
+
+// Allows reports whether connecting to port is allowed by the rule.
+func (r *DestPortRule) Allows(port int) bool {
+	if matchPorts(r.Deny, port) {
+		return false
+	}
+	return len(r.Allow) == 0 || matchPorts(r.Allow, port)
 }
 
 var readTimeout time.Duration
 
+// TenantOf returns the name of the tenant owning port, or "" if the port is
+// not owned by any tenant.
+func (config *Config) TenantOf(port string) string {
+	for name, t := range config.Tenants {
+		if _, ok := t.PortPassword[port]; ok {
+			return name
+		}
+	}
+	return ""
+}
+
+// TransportOf returns the transport of port.
+func (config *Config) TransportOf(port string) string {
+	if t, ok := config.PortTransport[port]; ok {
+		return t
+	}
+	return config.Transport
+}
+
+// MethodOf returns the encryption method to use for port: the one of
+// port_method, of its tenant, or method.
+func (config *Config) MethodOf(port string) string {
+	if m, ok := config.PortMethod[port]; ok && m != "" {
+		return m
+	}
+	if t, ok := config.Tenants[config.TenantOf(port)]; ok && t.Method != "" {
+		return t.Method
+	}
+	return config.Method
+}
+
+// ResolveAutoMethods replaces the "auto" method in method, port_method and
+// the methods of tenants with AutoMethod, and reports whether it did.
+func (config *Config) ResolveAutoMethods() bool {
+	resolved := false
+	resolve := func(m *string) {
+		if *m == MethodAuto {
+			*m = AutoMethod()
+			resolved = true
+		}
+	}
+	resolve(&config.Method)
+	for port, m := range config.PortMethod {
+		resolve(&m)
+		config.PortMethod[port] = m
+	}
+	for _, t := range config.Tenants {
+		if t != nil {
+			resolve(&t.Method)
+		}
+	}
+	return resolved
+}
+
+// CheckMethod returns an error if method isn't supported, or is insecure
+// and allow_insecure_ciphers isn't set.
+func (config *Config) CheckMethod(method string) error {
+	if err := CheckCipherMethod(method); err != nil {
+		return err
+	}
+	if InsecureCipher(method) && !config.AllowInsecureCiphers {
+		if method == "" {
+			method = "table"
+		}
+		return fmt.Errorf("method %s is insecure, set allow_insecure_ciphers to use it", method)
+	}
+	return nil
+}
+
+// CheckMethods returns an error if method, a method of port_method or of
+// server_password can't be used, see CheckMethod. Methods of tenants are
+// checked by MergeTenants.
+func (config *Config) CheckMethods() error {
+	if err := config.CheckMethod(config.Method); err != nil {
+		return err
+	}
+	for port, m := range config.PortMethod {
+		if err := config.CheckMethod(m); err != nil {
+			return fmt.Errorf("port %s: %v", port, err)
+		}
+	}
+	for _, sp := range config.ServerPassword {
+		if len(sp) == 3 {
+			if err := config.CheckMethod(sp[2]); err != nil {
+				return fmt.Errorf("server %s: %v", sp[0], err)
+			}
+		}
+	}
+	return nil
+}
+
+// MergeTenants adds ports of all tenants to PortPassword. It's an error for
+// a port to appear more than once. Merging again only updates the ports.
+func (config *Config) MergeTenants() error {
+	if len(config.Tenants) == 0 {
+		return nil
+	}
+	if config.PortPassword == nil {
+		config.PortPassword = make(map[string][3]string)
+	}
+	if config.tenantPorts == nil {
+		config.tenantPorts = make(map[string]string)
+	}
+	for name, t := range config.Tenants {
+		if t == nil {
+			return fmt.Errorf("tenant %s has no options", name)
+		}
+		if t.Method != "" {
+			if err := config.CheckMethod(t.Method); err != nil {
+				return fmt.Errorf("tenant %s: %v", name, err)
+			}
+		}
+		for port, passwd := range t.PortPassword {
+			owner, merged := config.tenantPorts[port]
+			if _, ok := config.PortPassword[port]; ok && (!merged || owner != name) {
+				return fmt.Errorf("tenant %s: port %s is used more than once", name, port)
+			}
+			config.PortPassword[port] = passwd
+			config.tenantPorts[port] = name
+		}
+	}
+	return nil
+}
+
 func (config *Config) GetServerArray() []string {
 	// Specifying multiple servers in the "server" options is deprecated.
 	// But for backward compatiblity, keep this.
@@ -69,6 +607,8 @@ typeError:
 	panic(fmt.Sprintf("Config.Server type error %v", reflect.TypeOf(config.Server)))
 }
 
+// ParseConfig reads the config file path, JSON, YAML or TOML as told by
+// ConfigFormat.
 func ParseConfig(path string) (config *Config, err error) {
 	file, err := os.Open(path) // For read access.
 	if err != nil {
@@ -81,20 +621,226 @@ func ParseConfig(path string) (config *Config, err error) {
 		return
 	}
 
+	if data, err = configToJSON(path, data); err != nil {
+		return nil, err
+	}
+	var v interface{}
+	if err = json.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	objects, err := portPasswordObjects(v)
+	if err != nil {
+		return nil, err
+	}
+	if data, err = json.Marshal(v); err != nil {
+		return nil, err
+	}
 	config = &Config{}
 	if err = json.Unmarshal(data, config); err != nil {
 		return nil, err
 	}
+	if m, ok := v.(map[string]interface{}); ok {
+		config.set = make(map[string]bool, len(m))
+		for name := range m {
+			config.set[name] = true
+		}
+	}
+	for _, name := range append(unknownOptions(v, reflect.TypeOf(config), ""), objects...) {
+		config.unknown = append(config.unknown, path+": "+name)
+	}
 	readTimeout = time.Duration(config.Timeout) * time.Second
 	return
 }
 
-func SetDebug(d bool) {
-	Debug = DebugLog(d)
+// ConfDirFiles returns the config fragments in dir, JSON, YAML or TOML files,
+// sorted by name.
+func ConfDirFiles(dir string) ([]string, error) {
+	var files []string
+	for _, ext := range []string{"*.json", "*.yaml", "*.yml", "*.toml"} {
+		matches, err := filepath.Glob(filepath.Join(dir, ext))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matches...)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// MergeConfigDir parses every fragment in dir in sorted order and merges it
+// into config. Options set in a later fragment override earlier ones; the
+// entries of per-port maps like port_password, port_method or port_quota,
+// tenants and servers are added, other lists like dest_deny are replaced.
+func MergeConfigDir(config *Config, dir string) error {
+	files, err := ConfDirFiles(dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		frag, err := ParseConfig(file)
+		if err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+		UpdateConfig(config, frag)
+		mergeLists(config, frag)
+		config.unknown = append(config.unknown, frag.unknown...)
+	}
+	// ParseConfig sets the timeout from each fragment, restore the merged one
+	readTimeout = time.Duration(config.Timeout) * time.Second
+	return nil
+}
+
+// mergeLists merges the maps and slices frag sets into config, which
+// UpdateConfig leaves alone: map entries are set key by key, server_password
+// is appended to, other slices are replaced.
+func mergeLists(config, frag *Config) {
+	newVal := reflect.ValueOf(frag).Elem()
+	oldVal := reflect.ValueOf(config).Elem()
+	typeOfT := newVal.Type()
+	for i := 0; i < newVal.NumField(); i++ {
+		f := typeOfT.Field(i)
+		if f.PkgPath != "" {
+			continue // unexported
+		}
+		newField, oldField := newVal.Field(i), oldVal.Field(i)
+		switch newField.Kind() {
+		case reflect.Map:
+			if newField.Len() == 0 {
+				continue
+			}
+			if oldField.IsNil() {
+				oldField.Set(reflect.MakeMap(newField.Type()))
+			}
+			iter := newField.MapRange()
+			for iter.Next() {
+				oldField.SetMapIndex(iter.Key(), iter.Value())
+			}
+		case reflect.Slice:
+			if f.Name == "ServerPassword" {
+				oldField.Set(reflect.AppendSlice(oldField, newField))
+			} else if frag.set[strings.Split(f.Tag.Get("json"), ",")[0]] {
+				oldField.Set(newField)
+			}
+		}
+	}
+}
+
+func readSecret(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// LoadPasswordFile reads passwords from PasswordFile. If it's a regular file,
+// its content is used as Password. If it's a directory, each file named by a
+// port number sets the password for that port, adding the port if needed.
+func (config *Config) LoadPasswordFile() error {
+	if config.PasswordFile == "" {
+		return nil
+	}
+	fi, err := os.Stat(config.PasswordFile)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		config.Password, err = readSecret(config.PasswordFile)
+		return err
+	}
+	files, err := ioutil.ReadDir(config.PasswordFile)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		port := f.Name()
+		if f.IsDir() {
+			continue
+		}
+		if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+			continue // e.g. ..data links created by kubernetes
+		}
+		passwd, err := readSecret(filepath.Join(config.PasswordFile, port))
+		if err != nil {
+			return err
+		}
+		if config.PortPassword == nil {
+			config.PortPassword = make(map[string][3]string)
+		}
+		pp := config.PortPassword[port]
+		pp[0] = passwd
+		config.PortPassword[port] = pp
+	}
+	return nil
+}
+
+// LoadSecrets reads the passwords the config references instead of holding
+// them: password_file (see LoadPasswordFile), password_env, and the files
+// and environment variables of port_password_file and port_password_env,
+// which add their port if needed. Errors name the reference, never the
+// secret.
+func (config *Config) LoadSecrets() error {
+	if err := config.LoadPasswordFile(); err != nil {
+		return err
+	}
+	if config.PasswordEnv != "" {
+		passwd, ok := os.LookupEnv(config.PasswordEnv)
+		if !ok {
+			return fmt.Errorf("password_env: environment variable %s not set", config.PasswordEnv)
+		}
+		config.Password = strings.TrimSpace(passwd)
+	}
+	setPort := func(port, passwd string) {
+		if config.PortPassword == nil {
+			config.PortPassword = make(map[string][3]string)
+		}
+		pp := config.PortPassword[port]
+		pp[0] = passwd
+		config.PortPassword[port] = pp
+	}
+	for port, file := range config.PortPasswordFile {
+		passwd, err := readSecret(file)
+		if err != nil {
+			return fmt.Errorf("port_password_file of port %s: %v", port, err)
+		}
+		setPort(port, passwd)
+	}
+	for port, env := range config.PortPasswordEnv {
+		passwd, ok := os.LookupEnv(env)
+		if !ok {
+			return fmt.Errorf("port_password_env of port %s: environment variable %s not set", port, env)
+		}
+		setPort(port, strings.TrimSpace(passwd))
+	}
+	return nil
+}
+
+// SecretFiles returns the files LoadSecrets reads, with the directory of
+// password_file if it's one, so rotated secrets can be detected.
+func (config *Config) SecretFiles() []string {
+	var files []string
+	if config.PasswordFile != "" {
+		files = append(files, config.PasswordFile)
+		if fis, err := ioutil.ReadDir(config.PasswordFile); err == nil {
+			for _, fi := range fis {
+				if n, err := strconv.Atoi(fi.Name()); err == nil && n > 0 && n <= 65535 {
+					files = append(files, filepath.Join(config.PasswordFile, fi.Name()))
+				}
+			}
+		}
+	}
+	for _, file := range config.PortPasswordFile {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	return files
 }
 
 // Useful for command line to override options specified in config file
-// Debug is not updated.
+// Debug is not updated. The read timeout is set from the merged config.
+// Options of new left to their zero value are ignored, unless new was read
+// by ParseConfig and its file sets them, so a conf.d fragment can turn a
+// boolean off or set a number to 0.
 func UpdateConfig(old, new *Config) {
 	// Using reflection here is not necessary, but it's a good exercise.
 	// For more information on reflections in Go, read "The Laws of Reflection"
@@ -102,30 +848,43 @@ func UpdateConfig(old, new *Config) {
 	newVal := reflect.ValueOf(new).Elem()
 	oldVal := reflect.ValueOf(old).Elem()
 
-	// typeOfT := newVal.Type()
+	typeOfT := newVal.Type()
 	for i := 0; i < newVal.NumField(); i++ {
 		newField := newVal.Field(i)
 		oldField := oldVal.Field(i)
-		// log.Printf("%d: %s %s = %v\n", i,
-		// typeOfT.Field(i).Name, newField.Type(), newField.Interface())
+		set := new.set[strings.Split(typeOfT.Field(i).Tag.Get("json"), ",")[0]]
 		switch newField.Kind() {
 		case reflect.Interface:
-			if fmt.Sprintf("%v", newField.Interface()) != "" {
+			if set || !newField.IsNil() && fmt.Sprintf("%v", newField.Interface()) != "" {
 				oldField.Set(newField)
 			}
 		case reflect.String:
 			s := newField.String()
-			if s != "" {
+			if set || s != "" {
 				oldField.SetString(s)
 			}
 		case reflect.Int:
 			i := newField.Int()
-			if i != 0 {
+			if set || i != 0 {
 				oldField.SetInt(i)
 			}
+		case reflect.Float64:
+			f := newField.Float()
+			if set || f != 0 {
+				oldField.SetFloat(f)
+			}
+		case reflect.Bool:
+			if set || newField.Bool() {
+				oldField.SetBool(newField.Bool())
+			}
+		case reflect.Ptr:
+			if set || !newField.IsNil() {
+				oldField.Set(newField)
+			}
 		}
 	}
 	if old.Method == "table" {
 		old.Method = ""
 	}
+	readTimeout = time.Duration(old.Timeout) * time.Second
 }
@@ -1,6 +1,10 @@
 package shadowsocks
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
 )
 
@@ -42,6 +46,83 @@ func TestServerMultiPort(t *testing.T) {
 	}
 }
 
+func TestPortPasswordObject(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "config.json")
+	data := `{"port_password": {"8387": ["foobar", "", "ok"], "8388": {"password": "barfoo", "udp": true, "quota_gb": 100, "quota": 1}},
+		"tenants": {"acme": {"port_password": {"9000": {"password": "acme", "openvpn": true, "quota_gb": 0.5}}}}}`
+	if err := ioutil.WriteFile(file, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config, err := ParseConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pp := config.PortPassword; pp["8387"] != [3]string{"foobar", "", "ok"} || pp["8388"] != [3]string{"barfoo", "", "ok"} {
+		t.Errorf("port_password %q", pp)
+	}
+	if pp := config.Tenants["acme"].PortPassword; pp["9000"] != [3]string{"acme", "ok", ""} {
+		t.Errorf("port_password of tenant %q", pp)
+	}
+	if q := config.PortQuota; len(q) != 2 || q["8388"] != 100 || q["9000"] != 0.5 {
+		t.Errorf("port_quota %v", q)
+	}
+	unknown := []string{file + ": port_password.8388.quota"}
+	if got := config.UnknownOptions(); !reflect.DeepEqual(got, unknown) {
+		t.Errorf("unknown options %q, want %q", got, unknown)
+	}
+
+	for _, data := range []string{
+		`{"port_password": {"8388": {"password": "barfoo", "quota_gb": 1}}, "port_quota": {"8388": 2}}`,
+		`{"port_password": {"8388": {"password": "barfoo", "udp": "ok"}}}`,
+		`{"port_password": {"8388": {"quota_gb": 1}}}`,
+	} {
+		if err := ioutil.WriteFile(file, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ParseConfig(file); err == nil {
+			t.Errorf("%s accepted", data)
+		}
+	}
+}
+
+func TestConfigFormats(t *testing.T) {
+	want, err := ParseConfig("../sample-config/server-multi-port.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{"../sample-config/server-multi-port.yaml", "../sample-config/server-multi-port.toml"} {
+		config, err := ParseConfig(file)
+		if err != nil {
+			t.Fatalf("error parsing %s: %v", file, err)
+		}
+		if !reflect.DeepEqual(config, want) {
+			t.Errorf("%s parsed to %+v, want %+v", file, config, want)
+		}
+	}
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "typo.yaml")
+	data := "method: aes-256-gcm\nmetod: aes-256-gcm\ntenants:\n  acme:\n    token: x\n    tokn: x\n"
+	if err = ioutil.WriteFile(file, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config, err := ParseConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknown := []string{file + ": metod", file + ": tenants.acme.tokn"}
+	if got := config.UnknownOptions(); !reflect.DeepEqual(got, unknown) {
+		t.Errorf("unknown options %q, want %q", got, unknown)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "bad.toml"), []byte("method = "), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ParseConfig(filepath.Join(dir, "bad.toml")); err == nil {
+		t.Error("malformed toml accepted")
+	}
+}
+
 func TestDeprecatedClientMultiServerArray(t *testing.T) {
 	// This form of config is deprecated. Provided only for backward compatibility.
 	config, err := ParseConfig("testdata/deprecated-client-multi-server.json")
@@ -105,3 +186,263 @@ func TestParseConfigEmpty(t *testing.T) {
 		t.Error("GetServerArray should return nil if no server option is given")
 	}
 }
+
+func TestTenants(t *testing.T) {
+	config, err := ParseConfig("../sample-config/server-tenants.json")
+	if err != nil {
+		t.Fatal("error parsing server-tenants.json:", err)
+	}
+	if err = config.MergeTenants(); err != nil {
+		t.Fatal("error merging tenants:", err)
+	}
+	if config.PortPassword["8401"][0] != "acme-user2" {
+		t.Error("tenant port not merged into port_password")
+	}
+	if config.TenantOf("8500") != "globex" {
+		t.Error("port 8500 should belong to tenant globex")
+	}
+	if config.TenantOf("8387") != "" {
+		t.Error("port 8387 should not belong to any tenant")
+	}
+	if config.MethodOf("8400") != "aes-256-cfb" {
+		t.Error("tenant method should override default method")
+	}
+	if config.MethodOf("8500") != "aes-128-cfb" {
+		t.Error("tenant without method should use default method")
+	}
+
+	config.PortMethod = map[string]string{"8400": "chacha20-ietf-poly1305"}
+	if config.MethodOf("8400") != "chacha20-ietf-poly1305" {
+		t.Error("port_method should override tenant method")
+	}
+	if err = config.CheckMethods(); err != nil {
+		t.Error(err)
+	}
+	config.PortMethod["8401"] = "rot13"
+	if err = config.CheckMethods(); err == nil {
+		t.Error("unknown port method accepted")
+	}
+
+	// merging again only updates the ports
+	config.Tenants["acme"].PortPassword["8401"] = [3]string{"changed"}
+	if err = config.MergeTenants(); err != nil {
+		t.Fatal("error merging tenants again:", err)
+	}
+	if config.PortPassword["8401"][0] != "changed" {
+		t.Error("tenant port not updated by merging again")
+	}
+	config.Tenants["globex"].PortPassword["8387"] = [3]string{"dup"}
+	if err = config.MergeTenants(); err == nil {
+		t.Error("port of the top level and a tenant should be an error")
+	}
+	delete(config.Tenants["globex"].PortPassword, "8387")
+	config.Tenants["globex"].PortPassword["8401"] = [3]string{"dup"}
+	if err = config.MergeTenants(); err == nil {
+		t.Error("port of two tenants should be an error")
+	}
+}
+
+func TestMergeConfigDir(t *testing.T) {
+	config, err := ParseConfig("../sample-config/server-multi-port.json")
+	if err != nil {
+		t.Fatal("error parsing server-multi-port.json:", err)
+	}
+	if err = MergeConfigDir(config, "testdata/conf.d"); err != nil {
+		t.Fatal("error merging conf.d:", err)
+	}
+	if config.PortPassword["8387"][0] != "foobar" {
+		t.Error("port from main config should be kept")
+	}
+	if config.PortPassword["8400"][0] != "customer-a-rotated" {
+		t.Error("later fragment should override earlier one")
+	}
+	if config.PortPassword["8401"][0] != "customer-b" {
+		t.Error("port from fragment not merged")
+	}
+	if config.Method != "aes-256-cfb" {
+		t.Error("method from fragment should override main config")
+	}
+	if config.Timeout != 600 {
+		t.Error("timeout from main config should be kept")
+	}
+	if config.PortPassword["9000"][0] != "customer-c" || config.PortQuota["9000"] != 50 {
+		t.Errorf("port object from fragment not merged: %v, quota %v", config.PortPassword["9000"], config.PortQuota)
+	}
+	if config.PortMethod["9000"] != "chacha20-ietf-poly1305" || config.PortSpeedLimit["9000"] != 10 ||
+		config.PortMaxConnections["9000"] != 100 {
+		t.Errorf("per-port options from fragment not merged: %v %v %v",
+			config.PortMethod, config.PortSpeedLimit, config.PortMaxConnections)
+	}
+	if len(config.DestDeny) != 1 || config.DestDeny[0] != "10.0.0.0/8" {
+		t.Errorf("dest_deny from fragment not merged: %v", config.DestDeny)
+	}
+}
+
+func TestMergeConfigDirZeroValues(t *testing.T) {
+	dir := t.TempDir()
+	frag := `{"mux": false, "timeout": 0, "fallback": "", "replay_filter_fp_rate": 0.01}`
+	if err := ioutil.WriteFile(filepath.Join(dir, "10-off.json"), []byte(frag), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{Mux: true, UoT: true, Timeout: 600, Fallback: "discard"}
+	if err := MergeConfigDir(config, dir); err != nil {
+		t.Fatal("error merging conf.d:", err)
+	}
+	if config.Mux || config.Timeout != 0 || config.Fallback != "" {
+		t.Errorf("fragment didn't turn the options off: mux %v, timeout %d, fallback %q",
+			config.Mux, config.Timeout, config.Fallback)
+	}
+	if !config.UoT {
+		t.Error("option the fragment doesn't set should be kept")
+	}
+	if config.ReplayFilterFPRate != 0.01 {
+		t.Error("float option from fragment not merged")
+	}
+
+	// options left to their zero value on the command line don't override
+	config = &Config{Mux: true}
+	UpdateConfig(config, &Config{})
+	if !config.Mux {
+		t.Error("unset command line option should be ignored")
+	}
+}
+
+func TestLoadPasswordFile(t *testing.T) {
+	config, err := ParseConfig("../sample-config/server-multi-port.json")
+	if err != nil {
+		t.Fatal("error parsing server-multi-port.json:", err)
+	}
+	config.PasswordFile = "testdata/secrets"
+	if err = config.LoadPasswordFile(); err != nil {
+		t.Fatal("error loading password directory:", err)
+	}
+	if config.PortPassword["8387"][0] != "foobar" {
+		t.Error("port without secret file should keep its password")
+	}
+	if config.PortPassword["8388"][0] != "from-secret" {
+		t.Errorf("password should be read from secret file, got %q", config.PortPassword["8388"][0])
+	}
+	if config.PortPassword["8390"][0] != "new-port" {
+		t.Error("port only in secret directory should be added")
+	}
+
+	config = &Config{PasswordFile: "testdata/secrets/8388"}
+	if err = config.LoadPasswordFile(); err != nil {
+		t.Fatal("error loading password file:", err)
+	}
+	if config.Password != "from-secret" {
+		t.Error("password should be read from file with trailing newline trimmed")
+	}
+}
+
+func TestLoadSecrets(t *testing.T) {
+	os.Setenv("SS_TEST_PASSWORD", "from-env\n")
+	defer os.Unsetenv("SS_TEST_PASSWORD")
+	config := &Config{
+		PasswordEnv:      "SS_TEST_PASSWORD",
+		PortPasswordFile: map[string]string{"8391": "testdata/secrets/8388"},
+		PortPasswordEnv:  map[string]string{"8392": "SS_TEST_PASSWORD"},
+	}
+	if err := config.LoadSecrets(); err != nil {
+		t.Fatal(err)
+	}
+	if config.Password != "from-env" {
+		t.Errorf("password_env gave %q", config.Password)
+	}
+	if config.PortPassword["8391"][0] != "from-secret" || config.PortPassword["8392"][0] != "from-env" {
+		t.Errorf("port passwords %v", config.PortPassword)
+	}
+	if files := config.SecretFiles(); !reflect.DeepEqual(files, []string{"testdata/secrets/8388"}) {
+		t.Errorf("secret files %v", files)
+	}
+
+	config = &Config{PortPasswordEnv: map[string]string{"8392": "SS_TEST_UNSET"}}
+	if err := config.LoadSecrets(); err == nil {
+		t.Error("unset port_password_env variable should be an error")
+	}
+
+	config = &Config{PasswordFile: "testdata/secrets"}
+	want := []string{"testdata/secrets", filepath.Join("testdata/secrets", "8388"), filepath.Join("testdata/secrets", "8390")}
+	if files := config.SecretFiles(); !reflect.DeepEqual(files, want) {
+		t.Errorf("secret files of a directory %v, want %v", files, want)
+	}
+}
+
+func TestDestPortRule(t *testing.T) {
+	r := &DestPortRule{
+		Allow: []string{"80", "443", "8000-8100"},
+		Deny:  []string{"8025"},
+		Users: map[string]*DestPortRule{"alice": {Deny: []string{"25"}}},
+	}
+	if err := r.Check(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		user  string
+		port  int
+		allow bool
+	}{
+		{"", 80, true},
+		{"", 8050, true},
+		{"", 8025, false},
+		{"", 22, false},
+		{"bob", 22, false},
+		{"alice", 22, true},
+		{"alice", 25, false},
+	}
+	for _, tt := range tests {
+		if got := r.Of(tt.user).Allows(tt.port); got != tt.allow {
+			t.Errorf("user %q port %d allowed %v, want %v", tt.user, tt.port, got, tt.allow)
+		}
+	}
+	for _, bad := range []string{"0", "70000", "90-80", "http", "80-"} {
+		if err := (&DestPortRule{Deny: []string{bad}}).Check(); err == nil {
+			t.Errorf("port %q accepted", bad)
+		}
+	}
+	nested := &DestPortRule{Users: map[string]*DestPortRule{"alice": {Users: map[string]*DestPortRule{"bob": {}}}}}
+	if err := nested.Check(); err == nil {
+		t.Error("users of a user accepted")
+	}
+}
+
+func TestResolveAutoMethods(t *testing.T) {
+	config := &Config{
+		Method:     "aes-128-cfb",
+		PortMethod: map[string]string{"8388": MethodAuto, "8389": "aes-256-cfb"},
+		Tenants:    map[string]*Tenant{"acme": {Method: MethodAuto}},
+	}
+	if !config.ResolveAutoMethods() {
+		t.Fatal("auto methods not resolved")
+	}
+	if config.PortMethod["8388"] != AutoMethod() || config.Tenants["acme"].Method != AutoMethod() {
+		t.Errorf("auto resolved to %s and %s, want %s", config.PortMethod["8388"], config.Tenants["acme"].Method, AutoMethod())
+	}
+	if config.Method != "aes-128-cfb" || config.PortMethod["8389"] != "aes-256-cfb" {
+		t.Error("explicit methods changed")
+	}
+	if config.ResolveAutoMethods() {
+		t.Error("resolved again")
+	}
+}
+
+func TestCheckInsecureMethods(t *testing.T) {
+	for _, method := range []string{"table", "rc4", "rc4-md5", "des-cfb", "bf-cfb", "cast5-cfb"} {
+		config := &Config{Method: method}
+		if err := config.CheckMethods(); err == nil {
+			t.Errorf("%s allowed without allow_insecure_ciphers", method)
+		}
+		config.AllowInsecureCiphers = true
+		if err := config.CheckMethods(); err != nil {
+			t.Errorf("%s with allow_insecure_ciphers: %v", method, err)
+		}
+	}
+	config := &Config{Method: "aes-256-gcm", PortMethod: map[string]string{"8388": "rc4-md5"}}
+	if err := config.CheckMethods(); err == nil {
+		t.Error("insecure port_method allowed")
+	}
+	config = &Config{Method: "aes-256-gcm", ServerPassword: [][]string{{"127.0.0.1:8388", "foobar", "table"}}}
+	if err := config.CheckMethods(); err == nil {
+		t.Error("insecure server_password method allowed")
+	}
+}
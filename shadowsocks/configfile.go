@@ -0,0 +1,213 @@
+package shadowsocks
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// Config files are JSON, or YAML or TOML by their extension, with the same
+// option names. YAML and TOML files are converted to JSON, so the json tags
+// of Config apply to all of them.
+
+// Formats of config files.
+const (
+	ConfigJSON = "json"
+	ConfigYAML = "yaml"
+	ConfigTOML = "toml"
+)
+
+// ConfigFormat returns the format of the config file path by its
+// extension, JSON unless it's .yaml, .yml or .toml.
+func ConfigFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return ConfigYAML
+	case ".toml":
+		return ConfigTOML
+	}
+	return ConfigJSON
+}
+
+// configToJSON returns the content data of the config file path as JSON.
+func configToJSON(path string, data []byte) ([]byte, error) {
+	var v interface{}
+	switch ConfigFormat(path) {
+	case ConfigYAML:
+		if err := yaml.Unmarshal(data, &v); err != nil {
+			return nil, err
+		}
+		v = stringKeys(v)
+	case ConfigTOML:
+		m := make(map[string]interface{})
+		if _, err := toml.Decode(string(data), &m); err != nil {
+			return nil, err
+		}
+		v = m
+	default:
+		return data, nil
+	}
+	if v == nil {
+		// an empty file
+		return []byte("{}"), nil
+	}
+	return json.Marshal(v)
+}
+
+// stringKeys converts the maps decoded from YAML, which may have keys of any
+// type like port numbers, to maps with string keys JSON can encode.
+func stringKeys(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = stringKeys(e)
+		}
+		return m
+	case []interface{}:
+		for i, e := range v {
+			v[i] = stringKeys(e)
+		}
+	}
+	return v
+}
+
+// portPasswordObjects converts the ports of port_password, in the JSON object
+// v of a config and its tenants, given as objects like
+//
+//	"8388": {"password": "barfoo", "openvpn": true, "udp": true, "quota_gb": 100}
+//
+// to the array form ["barfoo", "ok", "ok"], and their quota_gb to port_quota.
+// It returns the fields of the objects it doesn't know, named like options.
+func portPasswordObjects(v interface{}) (unknown []string, err error) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, nil
+	}
+	quota, _ := m["port_quota"].(map[string]interface{})
+	convert := func(pp interface{}, prefix string) error {
+		ports, ok := pp.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		for port, e := range ports {
+			obj, ok := e.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			password, ok := obj["password"].(string)
+			if !ok {
+				return fmt.Errorf("%s%s: password must be a string", prefix, port)
+			}
+			a := []interface{}{password, "", ""}
+			for i, name := range []string{"openvpn", "udp"} {
+				switch b := obj[name].(type) {
+				case nil:
+				case bool:
+					if b {
+						a[i+1] = "ok"
+					}
+				default:
+					return fmt.Errorf("%s%s: %s must be true or false", prefix, port, name)
+				}
+			}
+			if q, ok := obj["quota_gb"]; ok {
+				if _, ok := q.(float64); !ok {
+					return fmt.Errorf("%s%s: quota_gb must be a number", prefix, port)
+				}
+				if _, ok := quota[port]; ok {
+					return fmt.Errorf("%s%s: quota set by both quota_gb and port_quota", prefix, port)
+				}
+				if quota == nil {
+					quota = make(map[string]interface{})
+					m["port_quota"] = quota
+				}
+				quota[port] = q
+			}
+			for name := range obj {
+				switch name {
+				case "password", "openvpn", "udp", "quota_gb":
+				default:
+					unknown = append(unknown, prefix+port+"."+name)
+				}
+			}
+			ports[port] = a
+		}
+		return nil
+	}
+	if err = convert(m["port_password"], "port_password."); err != nil {
+		return nil, err
+	}
+	if tenants, ok := m["tenants"].(map[string]interface{}); ok {
+		for name, t := range tenants {
+			if t, ok := t.(map[string]interface{}); ok {
+				if err = convert(t["port_password"], "tenants."+name+".port_password."); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	sort.Strings(unknown)
+	return unknown, nil
+}
+
+// unknownOptions returns the names of the options in the JSON object v
+// that t, a struct type, has no field for, by json tag. Options of nested
+// structs are named like tenants.acme.method.
+func unknownOptions(v interface{}, t reflect.Type, prefix string) []string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	var unknown []string
+	switch t.Kind() {
+	case reflect.Struct:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		fields := make(map[string]reflect.Type)
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if name := strings.Split(f.Tag.Get("json"), ",")[0]; name != "" && name != "-" {
+				fields[name] = f.Type
+			}
+		}
+		for name, e := range m {
+			if ft, ok := fields[name]; ok {
+				unknown = append(unknown, unknownOptions(e, ft, prefix+name+".")...)
+			} else {
+				unknown = append(unknown, prefix+name)
+			}
+		}
+	case reflect.Map:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		for k, e := range m {
+			unknown = append(unknown, unknownOptions(e, t.Elem(), prefix+k+".")...)
+		}
+	case reflect.Slice, reflect.Array:
+		a, ok := v.([]interface{})
+		if !ok {
+			return nil
+		}
+		for i, e := range a {
+			unknown = append(unknown, unknownOptions(e, t.Elem(), fmt.Sprintf("%s%d.", prefix, i))...)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// UnknownOptions returns the options of the config files config was parsed
+// from that no Config field has, usually misspelled, as "file: option".
+func (config *Config) UnknownOptions() []string {
+	return config.unknown
+}
@@ -1,15 +1,18 @@
 package shadowsocks
 
 import (
+	"bytes"
+	"container/list"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"strconv"
 	"strings"
 	"sync"
-	"syscall"
+	"sync/atomic"
 	"time"
 )
 
@@ -31,6 +34,54 @@ const (
 type Conn struct {
 	net.Conn
 	*Cipher
+	replay *ReplayFilter
+	rbuf   []byte // decrypted AEAD chunk not yet returned by Read
+
+	// on ports shared by users, the users until the first read identifies
+	// the user, then its id
+	users   *Users
+	User    string
+	pending []byte // read to identify the user, not yet decrypted
+
+	// buffers reused by Read and Write, see connBuf
+	rb, wb []byte
+	lenBuf [2]byte // length of AEAD chunks, not to allocate it per chunk
+
+	// maximum padding and delay of the first write, see SetFirstFlight
+	firstPadding int
+	firstDelay   time.Duration
+	peerPadded   bool // a padding chunk was read, the peer understands them
+}
+
+// connBufMax is the largest buffer a Conn keeps between reads or writes,
+// larger ones are only used for the call needing them.
+const connBufMax = 64 * 1024
+
+// connBuf returns a buffer of n bytes, reusing *buf if it's large enough.
+// Otherwise the new buffer has room for twice as much as *buf had, so
+// growing a little at a time is cheap, and replaces it if not larger than
+// connBufMax.
+func connBuf(buf *[]byte, n int) []byte {
+	if n <= cap(*buf) {
+		return (*buf)[:n]
+	}
+	size := 2 * cap(*buf)
+	if size > connBufMax {
+		size = connBufMax
+	}
+	if size < n {
+		size = n
+	}
+	b := make([]byte, n, size)
+	keepBuf(buf, b)
+	return b
+}
+
+// keepBuf keeps b in *buf for reuse, unless it's larger than connBufMax.
+func keepBuf(buf *[]byte, b []byte) {
+	if cap(b) <= connBufMax {
+		*buf = b[:0]
+	}
 }
 
 type UDP interface {
@@ -47,30 +98,145 @@ type UDP interface {
 }
 
 func NewConn(cn net.Conn, cipher *Cipher) *Conn {
-	return &Conn{cn, cipher}
+	return &Conn{Conn: cn, Cipher: cipher}
 }
 
 type UDPConn struct {
 	UDP
 	*Cipher
+	s2022 *udp2022
+	limit *Bandwidth
+	// destination exempt from the destination checks, see SetTestTarget
+	testTarget string
+	port       string // server port of the relay, see SetPort
 }
 
 func NewUDPConn(cn UDP, cipher *Cipher) *UDPConn {
-	return &UDPConn{cn, cipher}
+	c := &UDPConn{cn, cipher, nil, nil, "", ""}
+	if cipher.sip022 {
+		c.s2022 = newUDP2022(cipher)
+	}
+	return c
+}
+
+// SetBandwidth throttles the datagrams relayed by HandleUDPConnection, in
+// both directions, to the rate of b.
+func (c *UDPConn) SetBandwidth(b *Bandwidth) {
+	c.limit = b
+}
+
+// SetTestTarget lets the clients of c send datagrams to addr, an ip:port,
+// past the destination checks. The health checks and self tests of the
+// server relay through a server port of their own to a loopback echo server.
+func (c *UDPConn) SetTestTarget(addr string) {
+	c.testTarget = addr
+}
+
+// SetPort sets the server port the datagrams of c are counted, checked and
+// limited as, which is the port c listens on by default. A port may listen
+// on other port numbers, with port_listen, port_fallback or port_rotate.
+func (c *UDPConn) SetPort(port string) {
+	c.port = port
+}
+
+// Port returns the server port of c, see SetPort.
+func (c *UDPConn) Port() string {
+	if c.port != "" {
+		return c.port
+	}
+	return strconv.Itoa(c.LocalAddr().(*net.UDPAddr).Port)
+}
+
+// udpNATTimeout is the default lifetime of NAT entries of the UDP relay.
+const udpNATTimeout = 120 * time.Second
+
+var udpTimeout = int64(udpNATTimeout)
+
+// SetUDPTimeout sets how long NAT entries of the UDP relay, and the
+// destinations a client sent datagrams to, live without the client sending
+// anything, 2 minutes if d is 0.
+func SetUDPTimeout(d time.Duration) {
+	if d <= 0 {
+		d = udpNATTimeout
+	}
+	atomic.StoreInt64(&udpTimeout, int64(d))
+}
+
+func natTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&udpTimeout))
 }
 
+// UDPTimeoutOf returns the lifetime of new NAT entries of clients of server
+// port port, 0 for the one of SetUDPTimeout. Replace it to set it by port.
+var UDPTimeoutOf = func(port string) time.Duration {
+	return 0
+}
+
+// NAT eviction policies of SetNATLimit.
+const (
+	NATEvictLRU    = "lru"    // close the least recently used entry
+	NATEvictReject = "reject" // drop datagrams of new clients
+)
+
+var errNATFull = errors.New("udp NAT table full")
+var errSourceLimit = errors.New("udp NAT entries of source over limit")
+
+// NATSourceAllowed is called before a NAT entry is created for a client at
+// ip, none is created if it returns false. NATSourceClosed is called when an
+// entry created is removed. The server sets them to limit the entries of
+// each source.
+var NATSourceAllowed = func(ip string) bool { return true }
+var NATSourceClosed = func(ip string) {}
+
+// SetNATLimit limits the UDP relay to max NAT entries, each using a socket,
+// and sets what to do with new clients once they're all in use. max 0
+// means no limit.
+func SetNATLimit(max int, policy string) error {
+	switch policy {
+	case "":
+		policy = NATEvictLRU
+	case NATEvictLRU, NATEvictReject:
+	default:
+		return fmt.Errorf("unknown NAT eviction policy %s", policy)
+	}
+	nl.Lock()
+	nl.max, nl.policy = max, policy
+	nl.Unlock()
+	return nil
+}
+
+// CachedUDPConn is the NAT entry of a client of the UDP relay, relaying its
+// datagrams from a socket of its own.
 type CachedUDPConn struct {
 	timer *time.Timer
 	UDP
-	i string
+	i       string
+	id      string // included in log lines of this NAT entry
+	src     string // IP of the client
+	span    *Span  // of the NAT session, if traced
+	timeout time.Duration
+	elem    *list.Element // in the LRU list of the NATlist
+	used    time.Time     // last datagram from the client, set by NATlist.Get
+
+	mu    sync.Mutex
+	reqs  map[string]*ReqNode // headers the client sent, by destination
+	swept time.Time
+}
+
+// ReqNode is the address header a client sent for a destination, used for
+// the datagrams relayed back from it until it expires.
+type ReqNode struct {
+	Req     []byte
+	ReqLen  int
+	Expires time.Time
 }
 
 func NewCachedUDPConn(cn UDP) *CachedUDPConn {
-	return &CachedUDPConn{nil, cn, ""}
+	return &CachedUDPConn{UDP: cn, id: NewConnID(), timeout: natTimeout(), reqs: map[string]*ReqNode{}}
 }
 
 func (c *CachedUDPConn) Check() {
-	nl.Delete(c.i)
+	nl.Delete(c)
 }
 
 func (c *CachedUDPConn) Close() error {
@@ -80,66 +246,203 @@ func (c *CachedUDPConn) Close() error {
 
 func (c *CachedUDPConn) SetTimer(index string) {
 	c.i = index
-	c.timer = time.AfterFunc(120*time.Second, c.Check)
+	c.timer = time.AfterFunc(c.timeout, c.Check)
 }
 
 func (c *CachedUDPConn) Refresh() bool {
-	return c.timer.Reset(120 * time.Second)
+	return c.timer.Reset(c.timeout)
+}
+
+// SetReq records req as the header the client sent for dst, dropping the
+// expired ones now and then.
+func (c *CachedUDPConn) SetReq(dst string, req []byte) {
+	now := time.Now()
+	timeout := c.timeout
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.Sub(c.swept) >= timeout {
+		for k, n := range c.reqs {
+			if now.After(n.Expires) {
+				delete(c.reqs, k)
+			}
+		}
+		c.swept = now
+	}
+	n, ok := c.reqs[dst]
+	if !ok || !bytes.Equal(n.Req, req) {
+		n = &ReqNode{Req: append([]byte(nil), req...), ReqLen: len(req)}
+		c.reqs[dst] = n
+	}
+	n.Expires = now.Add(timeout)
 }
 
+// Req returns the header the client sent for dst, nil if it has none or
+// it expired.
+func (c *CachedUDPConn) Req(dst string) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n, ok := c.reqs[dst]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(n.Expires) {
+		delete(c.reqs, dst)
+		return nil
+	}
+	return n.Req
+}
+
+// NumReqs returns the number of destinations recorded by SetReq.
+func (c *CachedUDPConn) NumReqs() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.reqs)
+}
+
+// NATlist holds the NAT entries of the UDP relay, by server port and client
+// address.
 type NATlist struct {
 	sync.Mutex
 	Conns      map[string]*CachedUDPConn
 	AliveConns int
+
+	lru    *list.List // of the entries, most recently used first
+	max    int
+	policy string
 }
 
-func (nl *NATlist) Delete(srcaddr string) {
+// Delete closes c and removes it, unless it was replaced already.
+func (nl *NATlist) Delete(c *CachedUDPConn) {
 	nl.Lock()
 	defer nl.Unlock()
-	c, ok := nl.Conns[srcaddr]
-	if ok {
-		c.Close()
-		delete(nl.Conns, srcaddr)
-		nl.AliveConns -= 1
+	if nl.remove(c) {
+		natExpired.Add(1)
 	}
-	ReqList = map[string]*ReqNode{} //del all
+}
+
+func (nl *NATlist) remove(c *CachedUDPConn) bool {
+	if nl.Conns[c.i] != c {
+		return false
+	}
+	c.Close()
+	c.span.End()
+	delete(nl.Conns, c.i)
+	nl.lru.Remove(c.elem)
+	nl.AliveConns -= 1
+	NATSourceClosed(c.src)
+	return true
 }
 
 func (nl *NATlist) Get(srcaddr *net.UDPAddr, ss *UDPConn) (c *CachedUDPConn, ok bool, err error) {
 	nl.Lock()
 	defer nl.Unlock()
-	index := srcaddr.String()
-	_, ok = nl.Conns[index]
+	index := ss.LocalAddr().String() + "|" + srcaddr.String()
+	c, ok = nl.Conns[index]
 	if !ok {
 		//NAT not exists or expired
-		Debug.Printf("new udp conn %v<-->%v\n", srcaddr, ss.LocalAddr())
-		nl.AliveConns += 1
-		ok = false
+		if nl.max > 0 && nl.AliveConns >= nl.max && nl.policy == NATEvictReject {
+			natRejected.Add(1)
+			return nil, false, errNATFull
+		}
+		src := srcaddr.IP.String()
+		if !NATSourceAllowed(src) {
+			return nil, false, errSourceLimit
+		}
+		// the limit may have been lowered, evict down to it
+		for nl.max > 0 && nl.AliveConns >= nl.max {
+			old := nl.lru.Back().Value.(*CachedUDPConn)
+			logger.Debugf("[%s] evicting udp conn, %d in use", old.id, nl.AliveConns)
+			nl.remove(old)
+			natEvicted.Add(1)
+		}
+		_, span := StartTrace(context.Background(), "udp_session", SpanServer)
+		span.SetAttr("client.address", srcaddr.String())
+		ds := span.child("dial", SpanClient, time.Now())
 		//full cone
-		addr, _ := net.ResolveUDPAddr("udp", ":0")
-		conn, err := net.ListenUDP("udp", addr)
+		addr := &net.UDPAddr{IP: OutboundIP()}
+		lc := net.ListenConfig{Control: OutboundControl}
+		pc, err := lc.ListenPacket(context.Background(), "udp", addr.String())
+		ds.SetError(err)
+		ds.End()
 		if err != nil {
+			span.SetError(err)
+			span.End()
+			NATSourceClosed(src)
 			return nil, false, err
 		}
+		conn := pc.(*net.UDPConn)
+		nl.AliveConns += 1
+		natCreated.Add(1)
 		c = NewCachedUDPConn(conn)
+		c.src = src
+		c.span = span
+		_, port, _ := net.SplitHostPort(ss.LocalAddr().String())
+		span.SetAttr("ss.conn_id", c.id)
+		span.SetAttr("ss.port", port)
+		if d := UDPTimeoutOf(port); d > 0 {
+			c.timeout = d
+		}
+		c.used = time.Now()
+		c.elem = nl.lru.PushFront(c)
+		logger.Debugf("[%s] new udp conn %v<-->%v", c.id, srcaddr, ss.LocalAddr())
 		nl.Conns[index] = c
 		c.SetTimer(index)
 		go Pipeloop(ss, srcaddr, c)
 	} else {
 		//NAT exists
-		c, _ = nl.Conns[index]
 		c.Refresh()
+		c.used = time.Now()
+		nl.lru.MoveToFront(c.elem)
 	}
 	err = nil
 	return
 }
 
+// evictIdle closes the entries whose client sent nothing for idle, and
+// returns their number.
+func (nl *NATlist) evictIdle(idle time.Duration) (n int) {
+	nl.Lock()
+	defer nl.Unlock()
+	for e := nl.lru.Back(); e != nil; e = nl.lru.Back() {
+		c := e.Value.(*CachedUDPConn)
+		if time.Since(c.used) < idle {
+			break
+		}
+		nl.remove(c)
+		natEvicted.Add(1)
+		n++
+	}
+	return
+}
+
+// numReqs returns the number of destinations recorded by all NAT entries.
+func (nl *NATlist) numReqs() int {
+	nl.Lock()
+	defer nl.Unlock()
+	n := 0
+	for _, c := range nl.Conns {
+		n += c.NumReqs()
+	}
+	return n
+}
+
 func ParseHeader(addr net.Addr) []byte {
 	//what if the request address type is domain???
 	ip, port, err := net.SplitHostPort(addr.String())
 	if err != nil {
 		return nil
 	}
+	port_i, _ := strconv.Atoi(port)
+	if strings.Contains(ip, "%") {
+		// the IPv6 address type can't carry the zone of a link-local
+		// address (fe80::1%eth0), send it as domain name instead
+		buf := make([]byte, lenDmBase+len(ip))
+		buf[0] = typeDm
+		buf[1] = byte(len(ip))
+		copy(buf[2:], ip)
+		binary.BigEndian.PutUint16(buf[2+len(ip):], uint16(port_i))
+		return buf
+	}
 	buf := make([]byte, 20)
 	IP := net.ParseIP(ip)
 	b1 := IP.To4()
@@ -153,63 +456,136 @@ func ParseHeader(addr net.Addr) []byte {
 		iplen = net.IPv4len
 	}
 	copy(buf[1:], b1)
-	port_i, _ := strconv.Atoi(port)
 	binary.BigEndian.PutUint16(buf[1+iplen:], uint16(port_i))
 	return buf[:1+iplen+2]
 }
 
-func Pipeloop(ss *UDPConn, srcaddr *net.UDPAddr, remote UDP) {
-	buf := pool.Get().([]byte)
-	defer pool.Put(buf)
-	defer nl.Delete(srcaddr.String())
+func Pipeloop(ss *UDPConn, srcaddr *net.UDPAddr, remote *CachedUDPConn) {
+	id := remote.id
+	buf := getUDPBuf()
+	defer PutBuf(buf)
+	defer nl.Delete(remote)
 	for {
 		n, raddr, err := remote.ReadFrom(buf)
 		if err != nil {
-			if ne, ok := err.(*net.OpError); ok && (ne.Err == syscall.EMFILE || ne.Err == syscall.ENFILE) {
+			if IsFileLimit(err) {
 				// log too many open file error
 				// EMFILE is process reaches open file limits, ENFILE is system limit
-				fmt.Println("[udp]read error:", err)
-			} else if ne.Err.Error() == "use of closed network connection" {
-				fmt.Println("[udp]Connection Closing:", remote.LocalAddr())
+				logger.Errorf("[udp][%s]read error: %v", id, err)
+			} else if errors.Is(err, net.ErrClosed) {
+				logger.Debugf("[udp][%s]Connection Closing: %v", id, remote.LocalAddr())
 			} else {
-				fmt.Println("[udp]error reading from:", remote.LocalAddr(), err)
+				logger.Debugf("[udp][%s]error reading from: %v %v", id, remote.LocalAddr(), err)
 			}
+			CountError(ss.Port(), err)
 			return
 		}
+		if n == len(buf) || int64(n) > atomic.LoadInt64(&udpMaxSize) {
+			// may be truncated, don't relay a partial datagram, buf is
+			// larger if the max size was lowered since
+			dropOversized(raddr)
+			continue
+		}
 		// need improvement here
-		ReqListLock.RLock()
-		N, ok := ReqList[raddr.String()]
-		ReqListLock.RUnlock()
-		if ok {
-			ss.WriteToUDP(append(N.Req, buf[:n]...), srcaddr)
+		ss.limit.Wait(n)
+		if req := remote.Req(raddr.String()); req != nil {
+			ss.WriteToUDP(append(req, buf[:n]...), srcaddr)
 		} else {
 			header := ParseHeader(raddr)
 			ss.WriteToUDP(append(header, buf[:n]...), srcaddr)
 		}
-		upTraffic(strconv.Itoa(ss.LocalAddr().(*net.UDPAddr).Port), n, srcaddr.IP.String())
+		upTraffic(ss.Port(), n, srcaddr.IP.String())
 	}
 }
 
-type ReqNode struct {
-	Req    []byte
-	ReqLen int
+// UDPDestAllowed reports whether datagrams to ip:port may be relayed, domain
+// is the name the client sent for ip, if any, and openvpn the openvpn option
+// of the port. Replace it to change the policy.
+var UDPDestAllowed = func(domain, ip, port, openvpn string) bool {
+	return LegacyDestPolicy.Allow(domain, net.ParseIP(ip), port, openvpn == "ok")
 }
 
-var ReqListLock sync.RWMutex
-var ReqList = map[string]*ReqNode{}
+// UDPCountryAllowed reports whether the GeoIP rule of server port srvPort
+// allows relaying datagrams to ip:port. Replace it to enable the rules.
+var UDPCountryAllowed = func(srvPort, ip, port string) bool {
+	return true
+}
+
+// UDPACLAllowed reports whether the ACL allows relaying datagrams to ip:port,
+// domain is the name the client sent for ip, if any. Replace it to enable
+// the ACL.
+var UDPACLAllowed = func(domain, ip, port string) bool {
+	return true
+}
+
+// UDPDestPortAllowed reports whether the dest_ports rule of server port
+// srvPort allows relaying datagrams to ip:port. Replace it to enable the
+// rules.
+var UDPDestPortAllowed = func(srvPort, ip, port string) bool {
+	return true
+}
+
+// UDPResolve looks up the domain names clients of server port srvPort send
+// datagrams to. Replace it to use another resolver.
+var UDPResolve = func(srvPort, domain string) (*net.IPAddr, error) {
+	return net.ResolveIPAddr("ip", domain)
+}
+
+// udpDestAllowed reports whether a client of server port port may send
+// datagrams to ip:port, logging and counting the rejection if not.
+func udpDestAllowed(port, domain, ip, p, openvpn string) bool {
+	if !UDPDestAllowed(domain, ip, p, openvpn) {
+		logger.Warnf("[udp]illegal connect to local network(%s)", ip)
+		CountReject(port, RejectDest)
+		return false
+	}
+	if !UDPCountryAllowed(port, ip, p) {
+		logger.Warnf("[udp]destination %s rejected by geoip rule of port %s", ip, port)
+		CountReject(port, RejectGeoIP)
+		return false
+	}
+	if !UDPACLAllowed(domain, ip, p) {
+		logger.Warnf("[udp]destination %s rejected by acl", net.JoinHostPort(ip, p))
+		CountReject(port, RejectACL)
+		return false
+	}
+	if !UDPDestPortAllowed(port, ip, p) {
+		logger.Warnf("[udp]destination %s rejected by dest_ports rule of port %s", net.JoinHostPort(ip, p), port)
+		CountReject(port, RejectDestPort)
+		return false
+	}
+	return true
+}
 
 func HandleUDPConnection(c *UDPConn, openvpn string) {
-	buf := pool.Get().([]byte)
-	defer pool.Put(buf)
+	buf := getUDPBuf()
+	defer PutBuf(buf)
+	port := c.Port()
 	for {
 		n, src, err := c.ReadFromUDP(buf)
+		if err == errUDPOversized {
+			dropOversized(src)
+			continue
+		}
+		if err == errUDPShort {
+			udpDropped.Add(1)
+			continue
+		}
 		if err != nil {
 			return
 		}
+		received := time.Now()
 
 		var dstIP net.IP
+		var domain string
+		var resolved time.Time
+		var zone string // of link-local IPv6 addresses sent as domain name
 		var reqLen int
 
+		if n < lenIPv4 {
+			udpDropped.Add(1)
+			continue
+		}
 		switch buf[idType] {
 		case typeIPv4:
 			reqLen = lenIPv4
@@ -219,53 +595,141 @@ func HandleUDPConnection(c *UDPConn, openvpn string) {
 			dstIP = net.IP(buf[idIP0 : idIP0+net.IPv6len])
 		case typeDm:
 			reqLen = int(buf[idDmLen]) + lenDmBase
-			dIP, err := net.ResolveIPAddr("ip", string(buf[idDm0:idDm0+buf[idDmLen]]))
+			domain = string(buf[idDm0 : idDm0+buf[idDmLen]])
+			dIP, err := UDPResolve(port, domain)
+			resolved = time.Now()
 			if err != nil {
-				fmt.Sprintf("[udp]failed to resolve domain name: %s\n", string(buf[idDm0:idDm0+buf[idDmLen]]))
-				return
+				logger.Warnf("[udp]failed to resolve domain name: %s", domain)
+				udpDropped.Add(1)
+				continue
 			}
-			dstIP = dIP.IP
+			dstIP, zone = dIP.IP, dIP.Zone
 		default:
-			fmt.Sprintf("[udp]addr type %d not supported", buf[idType])
-			return
+			logger.Warnf("[udp]addr type %d not supported", buf[idType])
+			udpDropped.Add(1)
+			continue
+		}
+		if reqLen > n {
+			udpDropped.Add(1)
+			continue
 		}
 		ip := dstIP.String()
 		p := strconv.Itoa(int(binary.BigEndian.Uint16(buf[reqLen-2 : reqLen])))
-		if (strings.HasPrefix(ip, "127.") && (p != "1194" || openvpn != "ok")) ||
-			strings.HasPrefix(ip, "10.8.") || ip == "::1" {
-			log.Printf("[udp]illegal connect to local network(%s)\n", ip)
-			return
+		if (c.testTarget == "" || c.testTarget != net.JoinHostPort(ip, p)) && !udpDestAllowed(port, domain, ip, p, openvpn) {
+			udpDropped.Add(1)
+			continue
 		}
-		dst, _ := net.ResolveUDPAddr("udp", net.JoinHostPort(ip, p))
-		ReqListLock.Lock()
-		if _, ok := ReqList[dst.String()]; !ok {
-			req := make([]byte, reqLen)
-			copy(req, buf)
-			ReqList[dst.String()] = &ReqNode{req, reqLen}
+		dst := &net.UDPAddr{IP: dstIP, Port: int(binary.BigEndian.Uint16(buf[reqLen-2 : reqLen])), Zone: zone}
+		remote, found, err := nl.Get(src, c)
+		if err == nil && !found {
+			// the first datagram of the session starts its trace
+			remote.span.setStart(received)
+			if domain != "" {
+				rs := remote.span.child("resolve", SpanInternal, received)
+				rs.SetAttr("dns.question.name", domain)
+				rs.endAt(resolved)
+			}
+		}
+		if err == errNATFull {
+			udpDropped.Add(1)
+			continue
+		}
+		if err == errSourceLimit {
+			CountReject(port, RejectSource)
+			udpDropped.Add(1)
+			continue
 		}
-		ReqListLock.Unlock()
-
-		remote, _, err := nl.Get(src, c)
 		if err != nil {
-			return
+			logger.Errorf("[udp]error creating NAT entry for %v: %v", src, err)
+			if IsFileLimit(err) {
+				FileLimitReached()
+			}
+			udpDropped.Add(1)
+			continue
 		}
+		remote.SetReq(dst.String(), buf[:reqLen])
+		c.limit.Wait(n - reqLen)
 		_, err = remote.WriteToUDP(buf[reqLen:n], dst)
 		if err != nil {
-			if ne, ok := err.(*net.OpError); ok && (ne.Err == syscall.EMFILE || ne.Err == syscall.ENFILE) {
+			if IsFileLimit(err) {
 				// log too many open file error
 				// EMFILE is process reaches open file limits, ENFILE is system limit
-				fmt.Println("[udp]write error:", err)
+				logger.Errorf("[udp][%s]write error: %v", remote.id, err)
 			} else {
-				fmt.Println("[udp]error connecting to:", dst, err)
+				logger.Debugf("[udp][%s]error connecting to: %v %v", remote.id, dst, err)
 			}
-			return
+			CountError(port, err)
+			udpDropped.Add(1)
+			continue
 		}
-		upTraffic(p, n, ip)
+		upTraffic(port, n, src.IP.String())
 		// Pipeloop
 	} // for
 }
 
-var nl = NATlist{Conns: map[string]*CachedUDPConn{}}
+var nl = NATlist{Conns: map[string]*CachedUDPConn{}, lru: list.New(), policy: NATEvictLRU}
+
+// AddrTypeError is returned by GetRequest for requests that can't be parsed,
+// usually because the client uses a different password or method.
+type AddrTypeError byte
+
+func (e AddrTypeError) Error() string {
+	return fmt.Sprintf("addr type %d not supported", byte(e))
+}
+
+// GetRequest reads the destination address of a connection accepted by a
+// server, or a stream of a multiplexed connection. extra holds data read
+// after the address, which must be sent to the destination.
+func GetRequest(conn net.Conn) (host, port string, extra []byte, err error) {
+	// buf size should at least have the same size with the largest possible
+	// request size (when addrType is 3, domain name has at most 256 bytes)
+	// 1(addrType) + 1(lenByte) + 256(max length address) + 2(port)
+	buf := make([]byte, 260)
+	var n int
+	// read till we get possible domain length field
+	SetReadTimeout(conn)
+	if n, err = io.ReadAtLeast(conn, buf, idDmLen+1); err != nil {
+		return
+	}
+
+	reqLen := -1
+	switch buf[idType] {
+	case typeIPv4:
+		reqLen = lenIPv4
+	case typeIPv6:
+		reqLen = lenIPv6
+	case typeDm:
+		reqLen = int(buf[idDmLen]) + lenDmBase
+	default:
+		err = AddrTypeError(buf[idType])
+		return
+	}
+
+	if n < reqLen { // rare case
+		SetReadTimeout(conn)
+		if _, err = io.ReadFull(conn, buf[n:reqLen]); err != nil {
+			return
+		}
+	} else if n > reqLen {
+		// it's possible to read more than just the request head
+		extra = buf[reqLen:n]
+	}
+
+	// Return string for typeIP is not most efficient, but browsers (Chrome,
+	// Safari, Firefox) all seems using typeDm exclusively. So this is not a
+	// big problem.
+	switch buf[idType] {
+	case typeIPv4:
+		host = net.IP(buf[idIP0 : idIP0+net.IPv4len]).String()
+	case typeIPv6:
+		host = net.IP(buf[idIP0 : idIP0+net.IPv6len]).String()
+	case typeDm:
+		host = string(buf[idDm0 : idDm0+buf[idDmLen]])
+	}
+	// parse port
+	port = strconv.Itoa(int(binary.BigEndian.Uint16(buf[reqLen-2 : reqLen])))
+	return
+}
 
 func RawAddr(addr string) (buf []byte, err error) {
 	host, portStr, err := net.SplitHostPort(addr)
@@ -291,12 +755,18 @@ func RawAddr(addr string) (buf []byte, err error) {
 // rawaddr shoud contain part of the data in socks request, starting from the
 // ATYP field. (Refer to rfc1928 for more information.)
 func DialWithRawAddr(rawaddr []byte, server string, cipher *Cipher) (c *Conn, err error) {
-	conn, err := net.Dial("tcp", server)
+	return DialWithRawAddrContext(context.Background(), rawaddr, server, cipher)
+}
+
+// DialWithRawAddrContext is DialWithRawAddr giving up when ctx is done,
+// while connecting to the server or sending rawaddr.
+func DialWithRawAddrContext(ctx context.Context, rawaddr []byte, server string, cipher *Cipher) (c *Conn, err error) {
+	conn, err := DialTCP(ctx, server)
 	if err != nil {
 		return
 	}
 	c = NewConn(conn, cipher)
-	if _, err = c.Write(rawaddr); err != nil {
+	if _, err = c.WriteContext(ctx, rawaddr); err != nil {
 		c.Close()
 		return nil, err
 	}
@@ -305,22 +775,151 @@ func DialWithRawAddr(rawaddr []byte, server string, cipher *Cipher) (c *Conn, er
 
 // addr should be in the form of host:port
 func Dial(addr, server string, cipher *Cipher) (c *Conn, err error) {
+	return DialContext(context.Background(), addr, server, cipher)
+}
+
+// DialContext connects to addr through server like Dial, giving up when ctx
+// is done, so it fits http.Transport.DialContext.
+func DialContext(ctx context.Context, addr, server string, cipher *Cipher) (c *Conn, err error) {
 	ra, err := RawAddr(addr)
 	if err != nil {
 		return
 	}
-	return DialWithRawAddr(ra, server, cipher)
+	return DialWithRawAddrContext(ctx, ra, server, cipher)
+}
+
+// WriteContext is Write giving up when ctx is done, with the error of ctx.
+// The deadline of ctx applies to this write only.
+func (c *Conn) WriteContext(ctx context.Context, b []byte) (n int, err error) {
+	if err = ctx.Err(); err != nil {
+		return 0, err
+	}
+	if d, ok := ctx.Deadline(); ok {
+		c.SetWriteDeadline(d)
+	}
+	fired := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		// a deadline in the past unblocks the write
+		c.SetWriteDeadline(time.Unix(1, 0))
+		close(fired)
+	})
+	n, err = c.Write(b)
+	if !stop() {
+		<-fired
+		if err != nil {
+			err = ctx.Err()
+		}
+	}
+	c.SetWriteDeadline(time.Time{})
+	return
+}
+
+var (
+	errUDPShort     = errors.New("udp datagram shorter than iv")
+	errUDPOversized = errors.New("udp datagram too large")
+)
+
+// udpMaxSizeDefault is the largest datagram UDP can carry.
+const udpMaxSizeDefault = 65535
+
+var udpMaxSize = int64(udpMaxSizeDefault)
+
+// SetUDPMaxSize sets the size of the largest datagram relayed, larger ones
+// are dropped, 65535 if n is 0. Each NAT entry keeps a buffer of this size.
+func SetUDPMaxSize(n int) error {
+	if n < 0 || n > udpMaxSizeDefault {
+		return fmt.Errorf("udp max size %d out of range 0-%d", n, udpMaxSizeDefault)
+	}
+	if n == 0 {
+		n = udpMaxSizeDefault
+	}
+	atomic.StoreInt64(&udpMaxSize, int64(n))
+	return nil
+}
+
+// getUDPBuf returns a buffer of the UDP relay, one byte longer than
+// udpMaxSize to tell larger datagrams, which are dropped. Give it back with
+// PutBuf.
+func getUDPBuf() []byte {
+	return GetBuf(int(atomic.LoadInt64(&udpMaxSize)) + 1)
+}
+
+var oversizedLogged int64 // unix time oversized datagrams were last logged
+
+// dropOversized counts a datagram from src dropped for being larger than
+// the max size, logging it at most once a minute.
+func dropOversized(src net.Addr) {
+	udpOversized.Add(1)
+	udpDropped.Add(1)
+	now, last := time.Now().Unix(), atomic.LoadInt64(&oversizedLogged)
+	if now-last < 60 || !atomic.CompareAndSwapInt64(&oversizedLogged, last, now) {
+		return
+	}
+	logger.Warnf("[udp]dropped datagram from %v larger than %d bytes, udp_max_size may be too small",
+		src, atomic.LoadInt64(&udpMaxSize))
+}
+
+// ParseUDPHeader is the inverse of ParseHeader, it returns the address at
+// the start of a UDP relay datagram and the length of the header. addr is
+// nil if b doesn't start with an IP address.
+func ParseUDPHeader(b []byte) (addr *net.UDPAddr, n int) {
+	if len(b) < lenIPv4 {
+		return nil, 0
+	}
+	switch b[idType] {
+	case typeIPv4:
+		n = lenIPv4
+		addr = &net.UDPAddr{IP: net.IP(append([]byte{}, b[idIP0:idIP0+net.IPv4len]...))}
+	case typeIPv6:
+		if len(b) < lenIPv6 {
+			return nil, 0
+		}
+		n = lenIPv6
+		addr = &net.UDPAddr{IP: net.IP(append([]byte{}, b[idIP0:idIP0+net.IPv6len]...))}
+	case typeDm:
+		// only link-local addresses with zone are sent as domain name
+		n = int(b[idDmLen]) + lenDmBase
+		if len(b) < n {
+			return nil, 0
+		}
+		host, zone := string(b[idDm0:n-2]), ""
+		if i := strings.IndexByte(host, '%'); i >= 0 {
+			host, zone = host[:i], host[i+1:]
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return nil, 0
+		}
+		addr = &net.UDPAddr{IP: ip, Zone: zone}
+	default:
+		return nil, 0
+	}
+	addr.Port = int(binary.BigEndian.Uint16(b[n-2 : n]))
+	return
 }
 
 //n is the size of the payload
 func (c *UDPConn) ReadFromUDP(b []byte) (n int, src *net.UDPAddr, err error) {
-	buf := pool.Get().([]byte)
-	defer pool.Put(buf)
+	if c.s2022 != nil {
+		return c.s2022.readFrom(c.UDP, b)
+	}
+	buf := getUDPBuf()
+	defer PutBuf(buf)
 
 	n, src, err = c.UDP.ReadFromUDP(buf)
 	if err != nil {
 		return
 	}
+	if n == len(buf) {
+		return 0, src, errUDPOversized
+	}
+	if n <= c.info.ivLen {
+		return 0, src, errUDPShort
+	}
+	if c.isAEAD() {
+		n, err = c.openPacket(b, buf[:n])
+		return
+	}
 
 	iv := buf[:c.info.ivLen]
 	if err = c.initDecrypt(iv); err != nil {
@@ -332,13 +931,25 @@ func (c *UDPConn) ReadFromUDP(b []byte) (n int, src *net.UDPAddr, err error) {
 }
 
 func (c *UDPConn) Read(b []byte) (n int, err error) {
-	buf := pool.Get().([]byte)
-	defer pool.Put(buf)
+	if c.s2022 != nil {
+		return c.s2022.read(c.UDP, b)
+	}
+	buf := getUDPBuf()
+	defer PutBuf(buf)
 
 	n, err = c.UDP.Read(buf)
 	if err != nil {
 		return
 	}
+	if n == len(buf) {
+		return 0, errUDPOversized
+	}
+	if n <= c.info.ivLen {
+		return 0, errUDPShort
+	}
+	if c.isAEAD() {
+		return c.openPacket(b, buf[:n])
+	}
 
 	iv := buf[:c.info.ivLen]
 	if err = c.initDecrypt(iv); err != nil {
@@ -351,6 +962,16 @@ func (c *UDPConn) Read(b []byte) (n int, err error) {
 
 //n = iv + payload
 func (c *UDPConn) WriteToUDP(b []byte, src *net.UDPAddr) (n int, err error) {
+	if c.s2022 != nil {
+		return c.s2022.writeTo(c.UDP, b, src)
+	}
+	if c.isAEAD() {
+		var pkt []byte
+		if pkt, err = c.sealPacket(b); err != nil {
+			return
+		}
+		return c.UDP.WriteToUDP(pkt, src)
+	}
 	var cipherData []byte
 	dataStart := 0
 
@@ -361,7 +982,8 @@ func (c *UDPConn) WriteToUDP(b []byte, src *net.UDPAddr) (n int, err error) {
 	}
 	// Put initialization vector in buffer, do a single write to send both
 	// iv and data.
-	cipherData = make([]byte, len(b)+len(iv))
+	cipherData = GetBuf(len(b) + len(iv))
+	defer PutBuf(cipherData)
 	copy(cipherData, iv)
 	dataStart = len(iv)
 
@@ -371,6 +993,16 @@ func (c *UDPConn) WriteToUDP(b []byte, src *net.UDPAddr) (n int, err error) {
 }
 
 func (c *UDPConn) Write(b []byte) (n int, err error) {
+	if c.s2022 != nil {
+		return c.s2022.write(c.UDP, b)
+	}
+	if c.isAEAD() {
+		var pkt []byte
+		if pkt, err = c.sealPacket(b); err != nil {
+			return
+		}
+		return c.UDP.Write(pkt)
+	}
 	var cipherData []byte
 	dataStart := 0
 
@@ -381,7 +1013,8 @@ func (c *UDPConn) Write(b []byte) (n int, err error) {
 	}
 	// Put initialization vector in buffer, do a single write to send both
 	// iv and data.
-	cipherData = make([]byte, len(b)+len(iv))
+	cipherData = GetBuf(len(b) + len(iv))
+	defer PutBuf(cipherData)
 	copy(cipherData, iv)
 	dataStart = len(iv)
 
@@ -390,17 +1023,50 @@ func (c *UDPConn) Write(b []byte) (n int, err error) {
 	return
 }
 
+// SetReplayFilter makes Read fail with ErrReplay if the IV sent by the peer
+// is already in rf.
+func (c *Conn) SetReplayFilter(rf *ReplayFilter) {
+	c.replay = rf
+}
+
+// SetFirstFlight makes the first write of c wait a random time up to delay,
+// and with AEAD methods other than the 2022 ones, carry a padding chunk of
+// up to padding random bytes, so the size and timing of the first flight of
+// the connection vary. Padding chunks aren't part of SIP004: only
+// shadowsocks-go of this version or later discards them, other
+// implementations take them for data and corrupt the stream. So a server
+// only pads its first write if the client padded its own, which tells it
+// the client understands them, while a client always pads, and must only
+// set padding when its server is a shadowsocks-go.
+func (c *Conn) SetFirstFlight(padding int, delay time.Duration) {
+	if padding > aeadMaxPayload {
+		padding = aeadMaxPayload
+	}
+	c.firstPadding, c.firstDelay = padding, delay
+}
+
 func (c *Conn) Read(b []byte) (n int, err error) {
+	if c.users != nil {
+		if err = c.identify(); err != nil {
+			return
+		}
+	}
+	if c.isAEAD() {
+		return c.readAEAD(b)
+	}
 	if c.dec == nil {
 		iv := make([]byte, c.info.ivLen)
 		if _, err = io.ReadFull(c.Conn, iv); err != nil {
 			return
 		}
+		if !c.replay.Add(iv) {
+			return 0, ErrReplay
+		}
 		if err = c.initDecrypt(iv); err != nil {
 			return
 		}
 	}
-	cipherData := make([]byte, len(b))
+	cipherData := connBuf(&c.rb, len(b))
 	n, err = c.Conn.Read(cipherData)
 	if n > 0 {
 		c.decrypt(b[0:n], cipherData[0:n])
@@ -409,6 +1075,9 @@ func (c *Conn) Read(b []byte) (n int, err error) {
 }
 
 func (c *Conn) Write(b []byte) (n int, err error) {
+	if c.isAEAD() {
+		return c.writeAEAD(b)
+	}
 	var cipherData []byte
 	dataStart := 0
 	if c.enc == nil {
@@ -419,13 +1088,23 @@ func (c *Conn) Write(b []byte) (n int, err error) {
 		}
 		// Put initialization vector in buffer, do a single write to send both
 		// iv and data.
-		cipherData = make([]byte, len(b)+len(iv))
+		cipherData = connBuf(&c.wb, len(b)+len(iv))
 		copy(cipherData, iv)
 		dataStart = len(iv)
 	} else {
-		cipherData = make([]byte, len(b))
+		cipherData = connBuf(&c.wb, len(b))
 	}
 	c.encrypt(cipherData[dataStart:], b)
 	n, err = c.Conn.Write(cipherData)
+	// don't count the iv, io.Writer requires n <= len(b)
+	if n -= dataStart; n < 0 {
+		n = 0
+	}
 	return
 }
+
+// CloseWrite closes the writing side of the underlying connection, the
+// peer reads the end of the stream after the data written.
+func (c *Conn) CloseWrite() error {
+	return CloseWrite(c.Conn)
+}
@@ -0,0 +1,386 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseHeader(t *testing.T) {
+	tests := []struct {
+		addr   net.Addr
+		header []byte
+	}{
+		{&net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 53}, []byte{typeIPv4, 1, 2, 3, 4, 0, 53}},
+		{&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 53},
+			[]byte{typeIPv6, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 53}},
+		// zone is kept by sending the address as domain name
+		{&net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 53, Zone: "eth0"},
+			append(append([]byte{typeDm, 12}, "fe80::1%eth0"...), 0, 53)},
+	}
+	for _, tt := range tests {
+		if header := ParseHeader(tt.addr); !reflect.DeepEqual(header, tt.header) {
+			t.Errorf("ParseHeader(%v) = %v, want %v", tt.addr, header, tt.header)
+		}
+		if addr, n := ParseUDPHeader(append(tt.header, "payload"...)); n != len(tt.header) ||
+			addr == nil || addr.String() != tt.addr.String() {
+			t.Errorf("ParseUDPHeader(%v) = %v, %d", tt.header, addr, n)
+		}
+	}
+}
+
+func TestGetRequestZone(t *testing.T) {
+	cipher, err := NewCipher("aes-128-cfb", "foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawaddr, err := RawAddr("[fe80::1%eth0]:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go NewConn(client, cipher.Copy()).Write(rawaddr)
+
+	host, port, _, err := GetRequest(NewConn(server, cipher.Copy()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr := net.JoinHostPort(host, port); addr != "[fe80::1%eth0]:8080" {
+		t.Errorf("zone lost in request, got %s", addr)
+	}
+}
+
+func TestWriteContext(t *testing.T) {
+	cipher, err := NewCipher("aes-128-gcm", "foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, server := net.Pipe()
+	defer server.Close()
+	c := NewConn(client, cipher)
+
+	// nobody reads the pipe, so the writes block until ctx is done
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err = c.WriteContext(ctx, []byte(text)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("write past the deadline: %v, want context.DeadlineExceeded", err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	if _, err = c.WriteContext(ctx, []byte(text)); !errors.Is(err, context.Canceled) {
+		t.Errorf("write canceled: %v, want context.Canceled", err)
+	}
+	// the deadline doesn't outlive the write
+	go io.Copy(io.Discard, server)
+	if _, err = c.WriteContext(context.Background(), []byte(text)); err != nil {
+		t.Errorf("write after canceled ones: %v", err)
+	}
+}
+
+func TestDialContext(t *testing.T) {
+	cipher, err := NewCipher("aes-128-gcm", "foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		c := NewConn(conn, cipher.Copy())
+		defer c.Close()
+		host, port, _, err := GetRequest(c)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		c.Write([]byte(net.JoinHostPort(host, port)))
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = DialContext(ctx, "example.com:80", ln.Addr().String(), cipher.Copy()); !errors.Is(err, context.Canceled) {
+		t.Errorf("dial with a canceled context: %v, want context.Canceled", err)
+	}
+	c, err := DialContext(context.Background(), "example.com:80", ln.Addr().String(), cipher.Copy())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	got, err := io.ReadAll(c)
+	if err != nil || string(got) != "example.com:80" {
+		t.Errorf("server got %q, %v, want example.com:80", got, err)
+	}
+}
+
+func TestUDPReqPerClient(t *testing.T) {
+	allowed := UDPDestAllowed
+	UDPDestAllowed = func(domain, ip, port, openvpn string) bool { return true }
+	defer func() { UDPDestAllowed = allowed }()
+	SetUDPTimeout(200 * time.Millisecond)
+	defer SetUDPTimeout(0)
+
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, addr, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(buf[:n], addr)
+		}
+	}()
+	cipher, err := NewCipher("aes-128-gcm", "foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	go HandleUDPConnection(NewUDPConn(srv, cipher.Copy()), "")
+
+	// the same destination sent as IP address and as domain name by two
+	// clients, each gets its own header back
+	port := echo.LocalAddr().(*net.UDPAddr).Port
+	byName, _ := RawAddr(net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	headers := [][]byte{ParseHeader(echo.LocalAddr()), byName, ParseHeader(echo.LocalAddr())}
+	var clients []*UDPConn
+	for range headers[:2] {
+		conn, err := net.DialUDP("udp", nil, srv.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		clients = append(clients, NewUDPConn(conn, cipher.Copy()))
+	}
+	buf := make([]byte, 4096)
+	for i, header := range headers {
+		c := clients[i%2]
+		msg := append(append([]byte{}, header...), text...)
+		if _, err = c.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		n, err := c.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:n], msg) {
+			t.Errorf("client %d got header %v, want %v", i%2, buf[:n-len(text)], header)
+		}
+	}
+
+	// NAT entries of the clients expire
+	time.Sleep(500 * time.Millisecond)
+	nl.Lock()
+	defer nl.Unlock()
+	for index := range nl.Conns {
+		if strings.HasPrefix(index, srv.LocalAddr().String()+"|") {
+			t.Errorf("NAT entry %s not expired", index)
+		}
+	}
+}
+
+func TestNATLimit(t *testing.T) {
+	allowed := UDPDestAllowed
+	UDPDestAllowed = func(domain, ip, port, openvpn string) bool { return true }
+	defer func() { UDPDestAllowed = allowed }()
+	defer SetNATLimit(0, "")
+	if err := SetNATLimit(1, "fifo"); err == nil {
+		t.Error("unknown eviction policy accepted")
+	}
+	// start from an empty table, other tests leave entries
+	nl.Lock()
+	for _, c := range nl.Conns {
+		nl.remove(c)
+	}
+	nl.Unlock()
+
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, addr, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(buf[:n], addr)
+		}
+	}()
+	cipher, err := NewCipher("aes-128-gcm", "foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, srvPort, _ := net.SplitHostPort(srv.LocalAddr().String())
+	timeoutOf := UDPTimeoutOf
+	UDPTimeoutOf = func(port string) time.Duration {
+		if port == srvPort {
+			return time.Minute
+		}
+		return 0
+	}
+	defer func() { UDPTimeoutOf = timeoutOf }()
+	done := make(chan struct{})
+	go func() {
+		HandleUDPConnection(NewUDPConn(srv, cipher.Copy()), "")
+		close(done)
+	}()
+	defer func() {
+		srv.Close()
+		<-done
+	}()
+	evictedTotal := func() int64 {
+		natEvicted.Lock()
+		defer natEvicted.Unlock()
+		return natEvicted.total
+	}
+
+	// relayed returns whether a new client gets its datagram echoed
+	relayed := func() bool {
+		c, err := ListenPacket("udp", srv.LocalAddr().String(), cipher.Copy())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(300 * time.Millisecond))
+		c.WriteTo([]byte(text), echo.LocalAddr())
+		_, _, err = c.ReadFrom(make([]byte, 4096))
+		return err == nil
+	}
+	entries := func() (n int) {
+		nl.Lock()
+		defer nl.Unlock()
+		for index, c := range nl.Conns {
+			if strings.HasPrefix(index, srv.LocalAddr().String()+"|") {
+				if c.timeout != time.Minute {
+					t.Errorf("NAT entry timeout %v, want the one of the port", c.timeout)
+				}
+				n++
+			}
+		}
+		return
+	}
+
+	SetNATLimit(1, NATEvictLRU)
+	evicted := evictedTotal()
+	for i := 0; i < 3; i++ {
+		if !relayed() {
+			t.Errorf("client %d not relayed with lru policy", i)
+		}
+	}
+	if n := entries(); n != 1 {
+		t.Errorf("%d NAT entries, want 1", n)
+	}
+	if n := evictedTotal() - evicted; n != 2 {
+		t.Errorf("%d NAT entries evicted, want 2", n)
+	}
+
+	SetNATLimit(1, NATEvictReject)
+	if relayed() {
+		t.Error("client relayed past the limit with reject policy")
+	}
+	SetNATLimit(2, NATEvictReject)
+	if !relayed() {
+		t.Error("client not relayed under the limit")
+	}
+}
+
+// bufferConn is a net.Conn writing to buf.
+type bufferConn struct {
+	net.Conn
+	buf *bytes.Buffer
+}
+
+func (c bufferConn) Write(b []byte) (int, error) {
+	return c.buf.Write(b)
+}
+
+// sealingConn is a net.Conn reading the data sealed by w, which writes more
+// of it whenever all is read.
+type sealingConn struct {
+	net.Conn
+	w    *Conn
+	buf  *bytes.Buffer
+	data []byte
+}
+
+func (c *sealingConn) Read(b []byte) (int, error) {
+	if c.buf.Len() == 0 {
+		if _, err := c.w.Write(c.data); err != nil {
+			return 0, err
+		}
+	}
+	return c.buf.Read(b)
+}
+
+const connBenchSize = 8 * 1024
+
+func benchmarkConnWrite(b *testing.B, method string) {
+	cipher, err := NewCipher(method, "foobar")
+	if err != nil {
+		b.Fatal(err)
+	}
+	var buf bytes.Buffer
+	c := NewConn(bufferConn{buf: &buf}, cipher)
+	data := make([]byte, connBenchSize)
+	b.SetBytes(connBenchSize)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		if _, err = c.Write(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkConnRead(b *testing.B, method string) {
+	cipher, err := NewCipher(method, "foobar")
+	if err != nil {
+		b.Fatal(err)
+	}
+	var buf bytes.Buffer
+	w := NewConn(bufferConn{buf: &buf}, cipher.Copy())
+	c := NewConn(&sealingConn{w: w, buf: &buf, data: make([]byte, connBenchSize)}, cipher)
+	data := make([]byte, connBenchSize)
+	b.SetBytes(connBenchSize)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err = io.ReadFull(c, data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkConnWriteAES128CFB(b *testing.B) { benchmarkConnWrite(b, "aes-128-cfb") }
+func BenchmarkConnWriteAES128GCM(b *testing.B) { benchmarkConnWrite(b, "aes-128-gcm") }
+func BenchmarkConnReadAES128CFB(b *testing.B)  { benchmarkConnRead(b, "aes-128-cfb") }
+func BenchmarkConnReadAES128GCM(b *testing.B)  { benchmarkConnRead(b, "aes-128-gcm") }
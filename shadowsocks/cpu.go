@@ -0,0 +1,28 @@
+package shadowsocks
+
+import (
+	"golang.org/x/sys/cpu"
+)
+
+// AESHardware reports whether the CPU accelerates AES-GCM: AES-NI and
+// CLMUL on x86, the AES and PMULL extensions on arm64, or the AES and
+// GHASH functions of s390x. Without them aes-gcm is much slower than
+// chacha20-ietf-poly1305. Running with GODEBUG=cpu.aes=off turns it off.
+func AESHardware() bool {
+	return cpu.X86.HasAES && cpu.X86.HasPCLMULQDQ ||
+		cpu.ARM64.HasAES && cpu.ARM64.HasPMULL ||
+		cpu.S390X.HasAES && cpu.S390X.HasGHASH
+}
+
+// MethodAuto is the method replaced by AutoMethod in server configs.
+const MethodAuto = "auto"
+
+// AutoMethod returns the AEAD method that's fastest on this CPU:
+// aes-256-gcm with AES hardware acceleration, chacha20-ietf-poly1305
+// otherwise.
+func AutoMethod() string {
+	if AESHardware() {
+		return "aes-256-gcm"
+	}
+	return "chacha20-ietf-poly1305"
+}
@@ -0,0 +1,104 @@
+package shadowsocks
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// DestPolicy decides which destinations clients may connect to, protecting
+// the networks of the server. A mode denies a set of networks, more can be
+// denied by CIDR, and single destinations can be allowed despite the
+// denials. Loopback port 1194 is always allowed to ports with openvpn
+// enabled.
+type DestPolicy struct {
+	denied ipRanges
+	allow  []destException
+}
+
+// destException allows host:port, the host being an address, CIDR or the
+// name requested by the client, the port "*" matches any port.
+type destException struct {
+	ipnet *net.IPNet
+	name  string
+	port  string
+}
+
+// Modes of DestPolicy and the networks they deny.
+var destPolicyModes = map[string][]string{
+	// the checks of older versions
+	"legacy": {"127.0.0.0/8", "10.8.0.0/16", "::1/128"},
+	// loopback, private (RFC 1918, RFC 4193), shared (RFC 6598), link-local
+	// and unspecified addresses
+	"private": {
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+		"172.16.0.0/12", "192.168.0.0/16", "::/128", "::1/128", "fc00::/7", "fe80::/10",
+	},
+	"none": nil,
+}
+
+var loopback = mergeRanges([]*net.IPNet{parseCIDR("127.0.0.0/8")})
+
+// LegacyDestPolicy is the policy of older versions, which deny 127.0.0.0/8,
+// 10.8.0.0/16 (the OpenVPN subnet) and ::1.
+var LegacyDestPolicy, _ = NewDestPolicy("legacy", nil, nil)
+
+// NewDestPolicy returns the policy of mode ("legacy" if empty, "private" or
+// "none"), also denying the CIDRs in deny, and allowing the host:port
+// destinations in allow.
+func NewDestPolicy(mode string, deny, allow []string) (*DestPolicy, error) {
+	if mode == "" {
+		mode = "legacy"
+	}
+	nets, ok := destPolicyModes[mode]
+	if !ok {
+		return nil, fmt.Errorf("unknown destination policy %q, must be legacy, private or none", mode)
+	}
+	var denied []*net.IPNet
+	for _, s := range append(append([]string{}, nets...), deny...) {
+		ipnet := parseCIDR(s)
+		if ipnet == nil {
+			return nil, fmt.Errorf("invalid CIDR %q in denied destinations", s)
+		}
+		denied = append(denied, ipnet)
+	}
+	p := &DestPolicy{denied: mergeRanges(denied)}
+	for _, s := range allow {
+		host, port, err := net.SplitHostPort(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed destination %q: %v", s, err)
+		}
+		if port != "*" {
+			if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+				return nil, fmt.Errorf("invalid port in allowed destination %q", s)
+			}
+		}
+		e := destException{ipnet: parseCIDR(host), port: port}
+		if e.ipnet == nil {
+			e.name = host
+		}
+		p.allow = append(p.allow, e)
+	}
+	return p, nil
+}
+
+// Allow reports whether ip:port may be connected to, domain is the name the
+// client requested, if any, and openvpn tells whether the port of the server
+// has openvpn enabled.
+func (p *DestPolicy) Allow(domain string, ip net.IP, port string, openvpn bool) bool {
+	if !p.denied.contains(ip) {
+		return true
+	}
+	if openvpn && port == "1194" && loopback.contains(ip) {
+		return true
+	}
+	for _, e := range p.allow {
+		if e.port != "*" && e.port != port {
+			continue
+		}
+		if (e.ipnet != nil && e.ipnet.Contains(ip)) || (e.name != "" && e.name == domain) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,81 @@
+package shadowsocks
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestLegacyDestPolicy(t *testing.T) {
+	// the checks the legacy policy replaced
+	old := func(ip, port, openvpn string) bool {
+		return !((strings.HasPrefix(ip, "127.") && (port != "1194" || openvpn != "ok")) ||
+			strings.HasPrefix(ip, "10.8.") || ip == "::1")
+	}
+	for _, ip := range []string{"127.0.0.1", "127.1.2.3", "10.8.0.1", "10.9.0.1", "192.168.1.1", "8.8.8.8",
+		"::1", "::2", "fe80::1", "::ffff:127.0.0.1"} {
+		for _, port := range []string{"80", "1194"} {
+			for _, openvpn := range []string{"", "ok"} {
+				want := old(net.ParseIP(ip).String(), port, openvpn)
+				if LegacyDestPolicy.Allow("", net.ParseIP(ip), port, openvpn == "ok") != want {
+					t.Errorf("legacy policy for %s port %s openvpn %q should allow: %v", ip, port, openvpn, want)
+				}
+			}
+		}
+	}
+}
+
+func TestDestPolicy(t *testing.T) {
+	p, err := NewDestPolicy("private", []string{"203.0.113.0/24"},
+		[]string{"192.168.1.10:53", "[fd00::1]:*", "nas.lan:445", "10.1.0.0/16:80"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		domain, ip, port string
+		allow            bool
+	}{
+		{"", "8.8.8.8", "53", true},
+		{"", "192.168.1.1", "80", false},
+		{"", "172.20.0.1", "80", false},
+		{"", "169.254.169.254", "80", false},
+		{"", "fe80::1", "80", false},
+		{"", "203.0.113.5", "443", false},
+		{"", "192.168.1.10", "53", true},
+		{"", "192.168.1.10", "54", false},
+		{"", "fd00::1", "22", true},
+		{"nas.lan", "192.168.1.20", "445", true},
+		{"other.lan", "192.168.1.20", "445", false},
+		{"", "10.1.2.3", "80", true},
+		{"", "10.2.2.3", "80", false},
+	} {
+		if p.Allow(tc.domain, net.ParseIP(tc.ip), tc.port, false) != tc.allow {
+			t.Errorf("%s %s:%s should be allowed: %v", tc.domain, tc.ip, tc.port, tc.allow)
+		}
+	}
+	if !p.Allow("", net.ParseIP("127.0.0.1"), "1194", true) {
+		t.Error("openvpn port should be allowed on loopback")
+	}
+
+	p, err = NewDestPolicy("none", []string{"198.51.100.1"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.Allow("", net.ParseIP("127.0.0.1"), "80", false) || p.Allow("", net.ParseIP("198.51.100.1"), "80", false) {
+		t.Error("none policy should only deny the given CIDRs")
+	}
+
+	for _, bad := range []struct {
+		mode        string
+		deny, allow []string
+	}{
+		{"strict", nil, nil},
+		{"", []string{"example.com"}, nil},
+		{"", nil, []string{"10.0.0.1"}},
+		{"", nil, []string{"10.0.0.1:http"}},
+	} {
+		if _, err = NewDestPolicy(bad.mode, bad.deny, bad.allow); err == nil {
+			t.Errorf("%v should be rejected", bad)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package shadowsocks
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+
+	"golang.org/x/net/proxy"
+)
+
+// Dialer connects to addresses through a shadowsocks server. It's a
+// proxy.Dialer and proxy.ContextDialer, so it can be used where an outbound
+// dialer is taken, e.g. in http.Transport or proxy.FromURL.
+type Dialer struct {
+	Server   string // host:port of the server
+	Method   string
+	Password string
+	// Forward connects to the server, directly if it's nil
+	Forward proxy.Dialer
+
+	once   sync.Once
+	cipher *Cipher
+	err    error
+}
+
+var (
+	_ proxy.Dialer        = (*Dialer)(nil)
+	_ proxy.ContextDialer = (*Dialer)(nil)
+)
+
+// Dial connects to addr through the server, network must be tcp, tcp4 or
+// tcp6, the server resolves addr.
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext is Dial giving up when ctx is done.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("shadowsocks: unsupported network %s", network)
+	}
+	d.once.Do(func() {
+		d.cipher, d.err = NewCipher(d.Method, d.Password)
+	})
+	if d.err != nil {
+		return nil, d.err
+	}
+	if d.Forward == nil {
+		c, err := DialContext(ctx, addr, d.Server, d.cipher.Copy())
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+	ra, err := RawAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	var conn net.Conn
+	if cd, ok := d.Forward.(proxy.ContextDialer); ok {
+		conn, err = cd.DialContext(ctx, "tcp", d.Server)
+	} else {
+		conn, err = d.Forward.Dial("tcp", d.Server)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := NewConn(conn, d.cipher.Copy())
+	if _, err = c.WriteContext(ctx, ra); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// dialerFromURL returns the Dialer of an ss://method:password@host:port
+// URL, the userinfo may also be base64 encoded as in SIP002 URLs.
+func dialerFromURL(u *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
+	if u.User == nil || u.Port() == "" {
+		return nil, fmt.Errorf("shadowsocks: %s is not ss://method:password@host:port", redactUserinfo(u))
+	}
+	method, password, err := urlUserinfo(u)
+	if err != nil {
+		return nil, fmt.Errorf("shadowsocks: %v", err)
+	}
+	if _, err := NewCipher(method, password); err != nil {
+		return nil, err
+	}
+	if forward == proxy.Direct {
+		forward = nil
+	}
+	return &Dialer{Server: u.Host, Method: method, Password: password, Forward: forward}, nil
+}
+
+func init() {
+	// proxy.FromURL knows ss:// URLs
+	proxy.RegisterDialerType("ss", dialerFromURL)
+}
@@ -0,0 +1,111 @@
+package shadowsocks
+
+import (
+	"encoding/base64"
+	"io"
+	"net"
+	"net/url"
+	"testing"
+
+	"golang.org/x/net/proxy"
+)
+
+// requestEchoServer returns a server writing back the address of the
+// requests it gets.
+func requestEchoServer(t *testing.T) net.Listener {
+	cipher, err := NewCipher("chacha20-ietf-poly1305", "foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				c := NewConn(conn, cipher.Copy())
+				defer c.Close()
+				host, port, _, err := GetRequest(c)
+				if err != nil {
+					return
+				}
+				c.Write([]byte(net.JoinHostPort(host, port)))
+			}()
+		}
+	}()
+	return ln
+}
+
+func TestDialer(t *testing.T) {
+	ln := requestEchoServer(t)
+	defer ln.Close()
+	d := &Dialer{Server: ln.Addr().String(), Method: "chacha20-ietf-poly1305", Password: "foobar"}
+	for _, addr := range []string{"example.com:80", "[2001:db8::1]:443"} {
+		c, err := d.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(c)
+		c.Close()
+		if err != nil || string(got) != addr {
+			t.Errorf("server got %q, %v, want %s", got, err, addr)
+		}
+	}
+	if _, err := d.Dial("udp", "example.com:53"); err == nil {
+		t.Error("dialing udp succeeded")
+	}
+	bad := &Dialer{Server: ln.Addr().String(), Method: "rot13", Password: "foobar"}
+	if _, err := bad.Dial("tcp", "example.com:80"); err == nil {
+		t.Error("dialing with an unknown method succeeded")
+	}
+}
+
+// countingDialer counts the connections it makes.
+type countingDialer struct {
+	n int
+}
+
+func (d *countingDialer) Dial(network, addr string) (net.Conn, error) {
+	d.n++
+	return net.Dial(network, addr)
+}
+
+func TestDialerFromURL(t *testing.T) {
+	ln := requestEchoServer(t)
+	defer ln.Close()
+	userinfo := base64.RawURLEncoding.EncodeToString([]byte("chacha20-ietf-poly1305:foobar"))
+	forward := &countingDialer{}
+	for _, s := range []string{
+		"ss://chacha20-ietf-poly1305:foobar@" + ln.Addr().String(),
+		"ss://" + userinfo + "@" + ln.Addr().String(),
+	} {
+		u, _ := url.Parse(s)
+		d, err := proxy.FromURL(u, forward)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := d.Dial("tcp", "example.com:80")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(c)
+		c.Close()
+		if err != nil || string(got) != "example.com:80" {
+			t.Errorf("%s: server got %q, %v", s, got, err)
+		}
+	}
+	if forward.n != 2 {
+		t.Errorf("%d connections through the forward dialer, want 2", forward.n)
+	}
+	for _, s := range []string{"ss://127.0.0.1:8388", "ss://rot13:foobar@127.0.0.1:8388", "ss://aes-256-gcm:foobar@127.0.0.1"} {
+		u, _ := url.Parse(s)
+		if _, err := proxy.FromURL(u, proxy.Direct); err == nil {
+			t.Errorf("%s accepted", s)
+		}
+	}
+}
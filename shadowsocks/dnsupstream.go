@@ -0,0 +1,301 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsTimeout bounds a lookup from an upstream, all queries included.
+const dnsTimeout = 5 * time.Second
+
+// dnsUpstream is a DNS server queried by a Resolver, over UDP falling back
+// to TCP for truncated answers, TCP, TLS (DoT) or HTTPS (DoH).
+type dnsUpstream struct {
+	scheme string // udp, tcp, tls or https
+	addr   string // host:port, the URL for https
+	tls    *tls.Config
+	client *http.Client
+}
+
+// parseDNSUpstream parses the address of an upstream: host[:port] or
+// udp://host[:port] for plain DNS, tcp://host[:port], tls://host[:port] for
+// DNS over TLS and https://host[:port]/path for DNS over HTTPS.
+func parseDNSUpstream(s string) (*dnsUpstream, error) {
+	if !strings.Contains(s, "://") {
+		s = "udp://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("dns server %s has no host", s)
+	}
+	up := &dnsUpstream{scheme: u.Scheme}
+	port := "53"
+	switch u.Scheme {
+	case "udp", "tcp":
+	case "tls":
+		port = "853"
+		up.tls = &tls.Config{ServerName: u.Hostname()}
+	case "https":
+		if u.Path == "" {
+			u.Path = "/dns-query"
+		}
+		up.addr = u.String()
+		up.client = &http.Client{Timeout: dnsTimeout}
+		return up, nil
+	default:
+		return nil, fmt.Errorf("dns server %s: unknown scheme %s", s, u.Scheme)
+	}
+	if u.Port() != "" {
+		port = u.Port()
+	}
+	up.addr = net.JoinHostPort(u.Hostname(), port)
+	return up, nil
+}
+
+func (up *dnsUpstream) String() string {
+	if up.scheme == "https" {
+		return up.addr
+	}
+	return up.scheme + "://" + up.addr
+}
+
+// exchange sends the query q and returns the answer.
+func (up *dnsUpstream) exchange(ctx context.Context, q []byte) ([]byte, error) {
+	switch up.scheme {
+	case "udp":
+		resp, err := up.exchangeUDP(ctx, q)
+		if err != nil {
+			return nil, err
+		}
+		// the TC flag, the answer didn't fit in the datagram
+		if len(resp) > 2 && resp[2]&0x02 != 0 {
+			return up.exchangeStream(ctx, q)
+		}
+		return resp, nil
+	case "https":
+		return up.exchangeHTTPS(ctx, q)
+	default:
+		return up.exchangeStream(ctx, q)
+	}
+}
+
+func (up *dnsUpstream) exchangeUDP(ctx context.Context, q []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", up.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err = conn.Write(q); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// skip datagrams not answering q, e.g. late answers to a
+		// previous query from the same port
+		if n >= 2 && bytes.Equal(buf[:2], q[:2]) {
+			return buf[:n], nil
+		}
+	}
+}
+
+// exchangeStream sends q over TCP, or TLS, prefixed with its length.
+func (up *dnsUpstream) exchangeStream(ctx context.Context, q []byte) ([]byte, error) {
+	var conn net.Conn
+	var err error
+	if up.tls != nil {
+		d := &tls.Dialer{Config: up.tls}
+		conn, err = d.DialContext(ctx, "tcp", up.addr)
+	} else {
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, "tcp", up.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	msg := make([]byte, 2+len(q))
+	binary.BigEndian.PutUint16(msg, uint16(len(q)))
+	copy(msg[2:], q)
+	if _, err = conn.Write(msg); err != nil {
+		return nil, err
+	}
+	if _, err = io.ReadFull(conn, msg[:2]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(msg))
+	if _, err = io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (up *dnsUpstream) exchangeHTTPS(ctx context.Context, q []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", up.addr, bytes.NewReader(q))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := up.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("dns server %s: %s", up.addr, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 65535))
+}
+
+var errDNSFormat = errors.New("malformed dns answer")
+
+// dnsQuery returns a recursive query of name for records of type t.
+func dnsQuery(id uint16, name string, t dnsmessage.Type) ([]byte, error) {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	n, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, err
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	b.EnableCompression()
+	if err = b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err = b.Question(dnsmessage.Question{Name: n, Type: t, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, err
+	}
+	return b.Finish()
+}
+
+// dnsAnswer is the outcome of a query: the addresses and how long they may
+// be cached, or the error, which is cached for ttl too if it's a negative
+// answer.
+type dnsAnswer struct {
+	ips []net.IP
+	ttl time.Duration
+	err error
+}
+
+// negativeTTLMax caps how long a name that doesn't exist is cached.
+const negativeTTLMax = 5 * time.Minute
+
+// parseDNSAnswer returns the addresses in resp, the answer to a query of
+// name. Names that don't exist, or have no address of the type, result in
+// a not found *net.DNSError cached for the SOA minimum TTL.
+func parseDNSAnswer(name string, resp []byte) *dnsAnswer {
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	if err != nil {
+		return &dnsAnswer{err: errDNSFormat}
+	}
+	if err = p.SkipAllQuestions(); err != nil {
+		return &dnsAnswer{err: errDNSFormat}
+	}
+	notFound := &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	switch h.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return &dnsAnswer{err: notFound, ttl: negativeTTL(&p)}
+	default:
+		return &dnsAnswer{err: &net.DNSError{Err: "server failure: " + h.RCode.String(), Name: name, IsTemporary: true}}
+	}
+	a := &dnsAnswer{ttl: -1}
+	for {
+		rh, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return &dnsAnswer{err: errDNSFormat}
+		}
+		var ip net.IP
+		switch rh.Type {
+		case dnsmessage.TypeA:
+			r, err := p.AResource()
+			if err != nil {
+				return &dnsAnswer{err: errDNSFormat}
+			}
+			ip = net.IP(r.A[:])
+		case dnsmessage.TypeAAAA:
+			r, err := p.AAAAResource()
+			if err != nil {
+				return &dnsAnswer{err: errDNSFormat}
+			}
+			ip = net.IP(r.AAAA[:])
+		default:
+			// CNAMEs are followed by the records of their target
+			if err = p.SkipAnswer(); err != nil {
+				return &dnsAnswer{err: errDNSFormat}
+			}
+			continue
+		}
+		a.ips = append(a.ips, ip)
+		if ttl := time.Duration(rh.TTL) * time.Second; a.ttl < 0 || ttl < a.ttl {
+			a.ttl = ttl
+		}
+	}
+	if len(a.ips) == 0 {
+		return &dnsAnswer{err: notFound, ttl: negativeTTL(&p)}
+	}
+	return a
+}
+
+// negativeTTL returns how long a negative answer may be cached, from the
+// SOA record in its authority section (RFC 2308).
+func negativeTTL(p *dnsmessage.Parser) time.Duration {
+	if err := p.SkipAllAnswers(); err != nil {
+		return 0
+	}
+	for {
+		h, err := p.AuthorityHeader()
+		if err != nil {
+			return 0
+		}
+		if h.Type != dnsmessage.TypeSOA {
+			if err = p.SkipAuthority(); err != nil {
+				return 0
+			}
+			continue
+		}
+		soa, err := p.SOAResource()
+		if err != nil {
+			return 0
+		}
+		ttl := h.TTL
+		if soa.MinTTL < ttl {
+			ttl = soa.MinTTL
+		}
+		if d := time.Duration(ttl) * time.Second; d < negativeTTLMax {
+			return d
+		}
+		return negativeTTLMax
+	}
+}
@@ -8,12 +8,16 @@ import (
 	"crypto/md5"
 	"crypto/rand"
 	"crypto/rc4"
+	"encoding/base64"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"github.com/codahale/chacha20"
 	"golang.org/x/crypto/blowfish"
 	"golang.org/x/crypto/cast5"
 	"io"
+	"sort"
+	"strings"
 )
 
 var errEmptyPassword = errors.New("empty key")
@@ -129,6 +133,11 @@ func newCast5Stream(key, iv []byte, doe DecOrEnc) (cipher.Stream, error) {
 	return newStream(block, err, key, iv, doe)
 }
 
+func newSM4Stream(key, iv []byte, doe DecOrEnc) (cipher.Stream, error) {
+	block, err := newSM4Cipher(key)
+	return newStream(block, err, key, iv, doe)
+}
+
 func newRC4MD5Stream(key, iv []byte, _ DecOrEnc) (cipher.Stream, error) {
 	h := md5.New()
 	h.Write(key)
@@ -144,21 +153,115 @@ func newChaCha20Stream(key, iv []byte, _ DecOrEnc) (cipher.Stream, error) {
 
 type cipherInfo struct {
 	keyLen    int
-	ivLen     int
+	ivLen     int // salt length for AEAD ciphers
 	newStream func(key, iv []byte, doe DecOrEnc) (cipher.Stream, error)
+	newAEAD   func(key []byte) (cipher.AEAD, error)
+	insecure  bool // only allowed with allow_insecure_ciphers
 }
 
 var cipherMethod = map[string]*cipherInfo{
-	"aes-128-cfb": {16, 16, newAESStream},
-	"aes-192-cfb": {24, 16, newAESStream},
-	"aes-256-cfb": {32, 16, newAESStream},
-	"des-cfb":     {8, 8, newDESStream},
-	"bf-cfb":      {16, 8, newBlowFishStream},
-	"cast5-cfb":   {16, 8, newCast5Stream},
-	"rc4-md5":     {16, 16, newRC4MD5Stream},
-	"rc4":         {16, 0, nil},
-	"table":       {16, 0, nil},
-	"chacha20":    {32, 8, newChaCha20Stream},
+	"aes-128-cfb":             {16, 16, newAESStream, nil, false},
+	"aes-192-cfb":             {24, 16, newAESStream, nil, false},
+	"aes-256-cfb":             {32, 16, newAESStream, nil, false},
+	"des-cfb":                 {8, 8, newDESStream, nil, true},
+	"bf-cfb":                  {16, 8, newBlowFishStream, nil, true},
+	"cast5-cfb":               {16, 8, newCast5Stream, nil, true},
+	"rc4-md5":                 {16, 16, newRC4MD5Stream, nil, true},
+	"rc4":                     {16, 0, nil, nil, true},
+	"table":                   {16, 0, nil, nil, true},
+	"chacha20":                {32, 8, newChaCha20Stream, nil, false},
+	"sm4-cfb":                 {16, 16, newSM4Stream, nil, false},
+	"aes-128-gcm":             {16, 16, nil, newAESGCM, false},
+	"aes-192-gcm":             {24, 24, nil, newAESGCM, false},
+	"aes-256-gcm":             {32, 32, nil, newAESGCM, false},
+	"chacha20-ietf-poly1305":  {32, 32, nil, newChaCha20Poly1305, false},
+	"xchacha20-ietf-poly1305": {32, 32, nil, newXChaCha20Poly1305, false},
+	"sm4-gcm":                 {16, 16, nil, newSM4GCM, false},
+	// Shadowsocks 2022, see sip022.go
+	"2022-blake3-aes-128-gcm": {16, 16, nil, newAESGCM, false},
+	"2022-blake3-aes-256-gcm": {32, 32, nil, newAESGCM, false},
+}
+
+// RegisterCipher adds the AEAD method name, with keys of keyLen bytes and
+// salts of saltLen bytes. newAEAD returns the AEAD of a session subkey,
+// derived from the key and salt like for the other AEAD methods. It must be
+// called before the method is used, e.g. in an init function, and panics if
+// the method exists.
+func RegisterCipher(name string, keyLen, saltLen int, newAEAD func(key []byte) (cipher.AEAD, error)) {
+	registerCipher(name, &cipherInfo{keyLen: keyLen, ivLen: saltLen, newAEAD: newAEAD})
+}
+
+// RegisterStreamCipher adds the stream cipher method name, with keys of
+// keyLen bytes and IVs of ivLen bytes. If insecure, the method is only
+// allowed in configs with allow_insecure_ciphers. Like RegisterCipher, it
+// must be called before the method is used.
+func RegisterStreamCipher(name string, keyLen, ivLen int, newStream func(key, iv []byte, doe DecOrEnc) (cipher.Stream, error), insecure bool) {
+	registerCipher(name, &cipherInfo{keyLen: keyLen, ivLen: ivLen, newStream: newStream, insecure: insecure})
+}
+
+func registerCipher(name string, mi *cipherInfo) {
+	if _, ok := cipherMethod[name]; ok || name == MethodAuto {
+		panic("shadowsocks: method " + name + " registered twice")
+	}
+	if mi.keyLen <= 0 || mi.ivLen <= 0 {
+		panic("shadowsocks: method " + name + " needs keys and IVs")
+	}
+	cipherMethod[name] = mi
+}
+
+// InsecureCipher reports whether method is broken or weak, and only allowed
+// with allow_insecure_ciphers: table, rc4, rc4-md5, and the ciphers with
+// 64 bit blocks, des-cfb, bf-cfb and cast5-cfb.
+func InsecureCipher(method string) bool {
+	if method == "" {
+		method = "table"
+	}
+	mi, ok := cipherMethod[method]
+	return ok && mi.insecure
+}
+
+// CipherMethods returns the supported encryption methods, sorted.
+func CipherMethods() []string {
+	methods := make([]string, 0, len(cipherMethod))
+	for method := range cipherMethod {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	return methods
+}
+
+// UDPSupported reports whether method can be used by the UDP relay, which
+// needs an IV in every datagram. rc4 and table don't have one.
+func UDPSupported(method string) bool {
+	mi, ok := cipherMethod[method]
+	return ok && mi.ivLen != 0
+}
+
+// KeySize returns the size in bytes of the keys of method, 0 if it's
+// unknown.
+func KeySize(method string) int {
+	if mi, ok := cipherMethod[method]; ok {
+		return mi.keyLen
+	}
+	return 0
+}
+
+// RandomPassword returns a random password for method. For the Shadowsocks
+// 2022 methods that's a base64 encoded key of the right size.
+func RandomPassword(method string) (string, error) {
+	mi, ok := cipherMethod[method]
+	if !ok || !strings.HasPrefix(method, "2022-") {
+		b := make([]byte, 16)
+		if _, err := io.ReadFull(rand.Reader, b); err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(b), nil
+	}
+	key := make([]byte, mi.keyLen)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
 }
 
 func CheckCipherMethod(method string) error {
@@ -177,6 +280,16 @@ type Cipher struct {
 	dec  cipher.Stream
 	key  []byte
 	info *cipherInfo
+
+	// session state of AEAD ciphers
+	encAEAD, decAEAD   cipher.AEAD
+	encNonce, decNonce []byte
+	encSalt, decSalt   []byte
+
+	sip022 bool // Shadowsocks 2022 edition, key is the PSK
+	// identity keys of the ports shared by users a 2022 client passes, sent
+	// as EIH, see users.go
+	identity [][]byte
 }
 
 // NewCipher creates a cipher that can be used in Dial() etc.
@@ -194,9 +307,26 @@ func NewCipher(method, password string) (c *Cipher, err error) {
 		return nil, errors.New("Unsupported encryption method: " + method)
 	}
 
-	key := evpBytesToKey(password, mi.keyLen)
+	var key []byte
+	var identity [][]byte
+	sip022 := strings.HasPrefix(method, "2022-")
+	if sip022 {
+		// identity keys come first, as in "iPSK:uPSK"
+		psks := strings.Split(password, ":")
+		for _, psk := range psks[:len(psks)-1] {
+			if key, err = decodePSK(psk, mi.keyLen); err != nil {
+				return nil, err
+			}
+			identity = append(identity, key)
+		}
+		if key, err = decodePSK(psks[len(psks)-1], mi.keyLen); err != nil {
+			return nil, err
+		}
+	} else {
+		key = evpBytesToKey(password, mi.keyLen)
+	}
 
-	c = &Cipher{key: key, info: mi}
+	c = &Cipher{key: key, info: mi, sip022: sip022, identity: identity}
 
 	if mi.newStream == nil {
 		if method == "table" {
@@ -211,6 +341,28 @@ func NewCipher(method, password string) (c *Cipher, err error) {
 	return c, nil
 }
 
+// KeyFromPassword returns the master key of method for password, as used by
+// NewCipher: derived with EVP_BytesToKey, or the base64 decoded PSK for the
+// Shadowsocks 2022 methods, the user PSK if password has identity keys. The
+// keys of AEAD sessions are derived from it, see SessionSubkey.
+func KeyFromPassword(method, password string) ([]byte, error) {
+	if password == "" {
+		return nil, errEmptyPassword
+	}
+	if method == "" {
+		method = "table"
+	}
+	mi, ok := cipherMethod[method]
+	if !ok {
+		return nil, errors.New("Unsupported encryption method: " + method)
+	}
+	if strings.HasPrefix(method, "2022-") {
+		psks := strings.Split(password, ":")
+		return decodePSK(psks[len(psks)-1], mi.keyLen)
+	}
+	return evpBytesToKey(password, mi.keyLen), nil
+}
+
 // Initializes the block cipher with CFB mode, returns IV.
 func (c *Cipher) initEncrypt() (iv []byte, err error) {
 	iv = make([]byte, c.info.ivLen)
@@ -259,11 +411,14 @@ func (c *Cipher) Copy() *Cipher {
 		enc, _ := c.enc.(*rc4.Cipher)
 		encCpy := *enc
 		decCpy := *enc
-		return &Cipher{enc: &encCpy, dec: &decCpy}
+		return &Cipher{enc: &encCpy, dec: &decCpy, key: c.key, info: c.info}
 	default:
 		nc := *c
 		nc.enc = nil
 		nc.dec = nil
+		nc.encAEAD, nc.decAEAD = nil, nil
+		nc.encNonce, nc.decNonce = nil, nil
+		nc.encSalt, nc.decSalt = nil, nil
 		return &nc
 	}
 }
@@ -147,6 +147,62 @@ func TestChaCha20(t *testing.T) {
 	testBlockCipher(t, "chacha20")
 }
 
+func TestSM4(t *testing.T) {
+	testBlockCipher(t, "sm4-cfb")
+}
+
+func TestXChaCha20Poly1305(t *testing.T) {
+	cipher, err := NewCipher("xchacha20-ietf-poly1305", "foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cipher.initAEADEncrypt(); err != nil {
+		t.Fatal(err)
+	}
+	if n := cipher.encAEAD.NonceSize(); n != 24 {
+		t.Errorf("nonce size %d, want 24", n)
+	}
+}
+
+func TestRegisterCipher(t *testing.T) {
+	RegisterCipher("test-xchacha20", 32, 32, newXChaCha20Poly1305)
+	defer delete(cipherMethod, "test-xchacha20")
+	if err := CheckCipherMethod("test-xchacha20"); err != nil {
+		t.Fatal(err)
+	}
+	if InsecureCipher("test-xchacha20") {
+		t.Error("registered AEAD method is insecure")
+	}
+	if _, err := NewCipher("test-xchacha20", "foobar"); err != nil {
+		t.Error(err)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("registering an existing method didn't panic")
+		}
+	}()
+	RegisterCipher("aes-256-gcm", 32, 32, newAESGCM)
+}
+
+func TestSM4KnownAnswer(t *testing.T) {
+	// example from GB/T 32907-2016
+	key := []byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef, 0xfe, 0xdc, 0xba, 0x98, 0x76, 0x54, 0x32, 0x10}
+	target := []byte{0x68, 0x1e, 0xdf, 0x34, 0xd2, 0x06, 0x96, 0x5e, 0x86, 0xb3, 0xe9, 0x4f, 0x53, 0x6e, 0x42, 0x46}
+	block, err := newSM4Cipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := make([]byte, 16)
+	block.Encrypt(dst, key)
+	if !reflect.DeepEqual(dst, target) {
+		t.Errorf("sm4 encrypt not correct\n\texpect: %x\n\tgot:   %x\n", target, dst)
+	}
+	block.Decrypt(dst, dst)
+	if !reflect.DeepEqual(dst, key) {
+		t.Errorf("sm4 decrypt not correct\n\texpect: %x\n\tgot:   %x\n", key, dst)
+	}
+}
+
 var cipherKey = make([]byte, 64)
 
 func init() {
@@ -209,3 +265,8 @@ func BenchmarkChaCha20Init(b *testing.B) {
 	ci := cipherMethod["chacha20"]
 	benchmarkCipherInit(b, ci)
 }
+
+func BenchmarkSM4Init(b *testing.B) {
+	ci := cipherMethod["sm4-cfb"]
+	benchmarkCipherInit(b, ci)
+}
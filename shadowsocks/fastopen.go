@@ -0,0 +1,82 @@
+package shadowsocks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"syscall"
+)
+
+// fastOpen is set by SetFastOpen, operate by sync/atomic.
+var fastOpen int32
+
+// SetFastOpen turns TCP Fast Open on or off for the connections to servers
+// made by the Dial functions and DialTCP. It's only supported on Linux.
+func SetFastOpen(on bool) error {
+	if on {
+		if err := CheckFastOpen(); err != nil {
+			return err
+		}
+	}
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&fastOpen, v)
+	return nil
+}
+
+// CheckFastOpen returns an error if TCP Fast Open isn't supported on this
+// platform.
+func CheckFastOpen() error {
+	if !fastOpenSupported {
+		return errors.New("fast_open is only supported on Linux")
+	}
+	return nil
+}
+
+// FastOpenListenControl enables TCP Fast Open on a listening socket, it's
+// meant for the Control hook of net.ListenConfig.
+func FastOpenListenControl(network, address string, c syscall.RawConn) error {
+	return setControl(c, "enabling fast open", fastOpenListen)
+}
+
+// fastOpenDialControl enables TCP Fast Open on a socket dialing out, for the
+// Control hook of net.Dialer.
+func fastOpenDialControl(network, address string, c syscall.RawConn) error {
+	return setControl(c, "enabling fast open", fastOpenConnect)
+}
+
+// setControl calls set with the file descriptor of c.
+func setControl(c syscall.RawConn, what string, set func(fd uintptr) error) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		err = set(fd)
+	}); cerr != nil {
+		return cerr
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", what, err)
+	}
+	return nil
+}
+
+// DialTCP connects to the server at addr, with Fast Open if it's turned on
+// by SetFastOpen, and Multipath TCP by SetMPTCP, with the socket options of
+// SetTCPOptions. With Fast Open the
+// handshake is done with the first write, which is sent in the SYN, so
+// connection errors may be returned by it.
+func DialTCP(ctx context.Context, addr string) (net.Conn, error) {
+	var d net.Dialer
+	if atomic.LoadInt32(&fastOpen) == 1 {
+		d.Control = fastOpenDialControl
+	}
+	d.SetMultipathTCP(MPTCP())
+	c, err := d.DialContext(ctx, "tcp", addr)
+	if err == nil {
+		ApplyTCPOptions(c)
+	}
+	return c, err
+}
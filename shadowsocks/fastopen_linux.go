@@ -0,0 +1,26 @@
+package shadowsocks
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+const fastOpenSupported = true
+
+// fastOpenQueueLen is the number of pending Fast Open requests a listener
+// keeps.
+const fastOpenQueueLen = 256
+
+// fastOpenListen enables Fast Open on the listening socket fd.
+func fastOpenListen(fd uintptr) error {
+	return unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_FASTOPEN, fastOpenQueueLen)
+}
+
+// fastOpenConnect makes the socket fd send the data of the first write in
+// the SYN, connect returns before the handshake is done (Linux 4.11+).
+func fastOpenConnect(fd uintptr) error {
+	return unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_FASTOPEN_CONNECT, 1)
+}
+
+func init() {
+	RegisterFeature("fastopen")
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package shadowsocks
+
+import (
+	"errors"
+)
+
+const fastOpenSupported = false
+
+func fastOpenListen(fd uintptr) error {
+	return errors.New("not supported on this platform")
+}
+
+func fastOpenConnect(fd uintptr) error {
+	return errors.New("not supported on this platform")
+}
@@ -0,0 +1,45 @@
+package shadowsocks
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestFastOpen(t *testing.T) {
+	if err := CheckFastOpen(); err != nil {
+		t.Skip(err)
+	}
+	lc := net.ListenConfig{Control: FastOpenListenControl}
+	ln, err := lc.Listen(context.Background(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(c, c)
+		c.Close()
+	}()
+
+	if err = SetFastOpen(true); err != nil {
+		t.Fatal(err)
+	}
+	defer SetFastOpen(false)
+	c, err := DialTCP(context.Background(), ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err = c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 5)
+	if _, err = io.ReadFull(c, b); err != nil || string(b) != "hello" {
+		t.Errorf("echoed %q, %v", b, err)
+	}
+}
@@ -0,0 +1,83 @@
+package shadowsocks
+
+import (
+	"errors"
+	"expvar"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// When the process runs out of file descriptors, EMFILE, or the system does,
+// ENFILE, accepting more connections only fails again right away, and
+// accept loops spin. FileLimitReached records such an error: accepting
+// pauses for a backoff, doubling while the errors go on, and the UDP NAT
+// entries idle for natIdleEvict, each holding a socket, are closed to free
+// descriptors.
+
+const (
+	fdBackoffMin = 5 * time.Millisecond
+	fdBackoffMax = time.Second
+	// the backoff starts over after this long without errors
+	fdCalm = 10 * time.Second
+	// NAT entries whose client sent nothing for this long are closed when
+	// descriptors run out
+	natIdleEvict = 30 * time.Second
+)
+
+var fdPressure struct {
+	sync.Mutex
+	backoff time.Duration
+	last    time.Time // of the last error
+	until   time.Time // accepting is paused until then
+	swept   time.Time // idle NAT entries last closed
+}
+
+var fdLimitErrors = expvar.NewInt("fd_limit_errors")
+
+// IsFileLimit reports whether err is EMFILE or ENFILE.
+func IsFileLimit(err error) bool {
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE)
+}
+
+// FileLimitReached records an EMFILE or ENFILE error, closes the idle NAT
+// entries, at most once a second, and returns how long accepting pauses,
+// which accept loops failing with the error should sleep.
+func FileLimitReached() time.Duration {
+	now := time.Now()
+	fdPressure.Lock()
+	if now.Sub(fdPressure.last) > fdCalm {
+		fdPressure.backoff = 0
+	}
+	if fdPressure.backoff *= 2; fdPressure.backoff < fdBackoffMin {
+		fdPressure.backoff = fdBackoffMin
+	} else if fdPressure.backoff > fdBackoffMax {
+		fdPressure.backoff = fdBackoffMax
+	}
+	d := fdPressure.backoff
+	fdPressure.last = now
+	fdPressure.until = now.Add(d)
+	sweep := now.Sub(fdPressure.swept) >= time.Second
+	if sweep {
+		fdPressure.swept = now
+	}
+	fdPressure.Unlock()
+	fdLimitErrors.Add(1)
+	if sweep {
+		if n := nl.evictIdle(natIdleEvict); n > 0 {
+			logger.Warnf("out of file descriptors, closed %d idle udp NAT entries", n)
+		}
+	}
+	return d
+}
+
+// WaitFileLimit sleeps while accepting is paused by FileLimitReached, accept
+// loops call it before accepting.
+func WaitFileLimit() {
+	fdPressure.Lock()
+	d := time.Until(fdPressure.until)
+	fdPressure.Unlock()
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
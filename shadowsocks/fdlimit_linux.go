@@ -0,0 +1,38 @@
+package shadowsocks
+
+import (
+	"syscall"
+)
+
+// RaiseFileLimit raises the open files limit (RLIMIT_NOFILE) of the process
+// to want, or to its hard limit if want is 0, and returns the limit set.
+// Raising it above the hard limit needs CAP_SYS_RESOURCE, without it the
+// limit is raised to the hard limit and the error is returned.
+func RaiseFileLimit(want uint64) (uint64, error) {
+	var lim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &lim); err != nil {
+		return 0, err
+	}
+	if want == 0 {
+		want = lim.Max
+	}
+	if lim.Cur >= want {
+		return lim.Cur, nil
+	}
+	raised := syscall.Rlimit{Cur: want, Max: lim.Max}
+	if want > lim.Max {
+		raised.Max = want
+	}
+	err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &raised)
+	if err == nil {
+		return want, nil
+	}
+	if want <= lim.Max || lim.Cur == lim.Max {
+		return lim.Cur, err
+	}
+	raised = syscall.Rlimit{Cur: lim.Max, Max: lim.Max}
+	if err2 := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &raised); err2 != nil {
+		return lim.Cur, err2
+	}
+	return lim.Max, err
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package shadowsocks
+
+import (
+	"errors"
+)
+
+// RaiseFileLimit is only supported on Linux, the Go runtime raises the soft
+// limit of open files to the hard one on other Unix systems.
+func RaiseFileLimit(want uint64) (uint64, error) {
+	return 0, errors.New("raising the open files limit is only supported on Linux")
+}
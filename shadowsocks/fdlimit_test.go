@@ -0,0 +1,69 @@
+package shadowsocks
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestFileLimitReached(t *testing.T) {
+	var err error = &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept4", syscall.EMFILE)}
+	if !IsFileLimit(err) || IsFileLimit(syscall.ECONNRESET) {
+		t.Error("IsFileLimit misclassifies errors")
+	}
+
+	// start from an empty table and no backoff, other tests leave entries
+	nl.Lock()
+	for _, c := range nl.Conns {
+		nl.remove(c)
+	}
+	nl.Unlock()
+	fdPressure.Lock()
+	fdPressure.backoff, fdPressure.last, fdPressure.swept = 0, time.Time{}, time.Time{}
+	fdPressure.Unlock()
+
+	srv, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	cipher, err := NewCipher("aes-128-gcm", "foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewUDPConn(srv, cipher)
+	idle, _, err := nl.Get(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	active, _, err := nl.Get(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40001}, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nl.Delete(active)
+	nl.Lock()
+	idle.used = time.Now().Add(-2 * natIdleEvict)
+	nl.lru.MoveToBack(idle.elem)
+	nl.Unlock()
+
+	if d := FileLimitReached(); d != fdBackoffMin {
+		t.Errorf("first backoff %v, want %v", d, fdBackoffMin)
+	}
+	if d := FileLimitReached(); d != 2*fdBackoffMin {
+		t.Errorf("second backoff %v, want %v", d, 2*fdBackoffMin)
+	}
+	start := time.Now()
+	WaitFileLimit()
+	if time.Since(start) > time.Second {
+		t.Error("WaitFileLimit paused longer than the backoff")
+	}
+	nl.Lock()
+	_, idleLeft := nl.Conns[idle.i]
+	_, activeLeft := nl.Conns[active.i]
+	nl.Unlock()
+	if idleLeft || !activeLeft {
+		t.Errorf("idle NAT entry kept %v, active one kept %v, want only the active one", idleLeft, activeLeft)
+	}
+}
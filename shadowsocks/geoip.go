@@ -0,0 +1,339 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"sync"
+)
+
+// GeoIP looks up the country of IP addresses in a MaxMind DB file, e.g.
+// GeoLite2-Country.mmdb. Only the parts of the format needed to find the
+// country are implemented.
+type GeoIP struct {
+	buf        []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	dataStart  uint // offset of the data section in buf
+
+	ipv4Start uint // node of ::/96 in IPv6 databases
+
+	mu    sync.RWMutex
+	cache map[uint]string // country by data offset
+}
+
+var errGeoIPFormat = errors.New("invalid MaxMind DB file")
+
+var metadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// max number of countries of data records cached, city databases have more
+// records than worth caching
+const geoIPCacheSize = 4096
+
+// OpenGeoIP loads the MaxMind DB at path into memory.
+func OpenGeoIP(path string) (*GeoIP, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewGeoIP(buf)
+}
+
+// NewGeoIP parses a MaxMind DB held in buf.
+func NewGeoIP(buf []byte) (*GeoIP, error) {
+	i := bytes.LastIndex(buf, metadataMarker)
+	if i < 0 {
+		return nil, errGeoIPFormat
+	}
+	mstart := uint(i + len(metadataMarker))
+	d := mmdbDecoder{buf[mstart:]}
+	v, _, err := d.decode(0, 0)
+	if err != nil {
+		return nil, err
+	}
+	meta, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errGeoIPFormat
+	}
+	g := &GeoIP{buf: buf, cache: make(map[uint]string)}
+	for _, f := range []struct {
+		key string
+		v   *uint
+	}{{"node_count", &g.nodeCount}, {"record_size", &g.recordSize}, {"ip_version", &g.ipVersion}} {
+		n, ok := meta[f.key].(uint64)
+		if !ok {
+			return nil, fmt.Errorf("%v: no %s in metadata", errGeoIPFormat, f.key)
+		}
+		*f.v = uint(n)
+	}
+	if g.recordSize != 24 && g.recordSize != 28 && g.recordSize != 32 {
+		return nil, fmt.Errorf("unsupported record size %d of MaxMind DB", g.recordSize)
+	}
+	treeSize := g.nodeCount * g.recordSize / 4
+	if treeSize+16 > uint(i) {
+		return nil, errGeoIPFormat
+	}
+	g.dataStart = treeSize + 16
+	if g.ipVersion == 6 {
+		node := uint(0)
+		for i := 0; i < 96 && node < g.nodeCount; i++ {
+			node = g.record(node, 0)
+		}
+		g.ipv4Start = node
+	}
+	return g, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of node.
+func (g *GeoIP) record(node, bit uint) uint {
+	switch g.recordSize {
+	case 24:
+		b := g.buf[node*6+bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		b := g.buf[node*7:]
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(g.buf[node*8+bit*4:]))
+	}
+}
+
+// Country returns the ISO 3166-1 code of the country of ip, e.g. "US", or ""
+// if it's not in the database.
+func (g *GeoIP) Country(ip net.IP) string {
+	node := uint(0)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		if g.ipVersion == 6 {
+			node = g.ipv4Start
+		}
+	} else if g.ipVersion == 4 {
+		return ""
+	}
+	for i := 0; i < len(ip)*8 && node < g.nodeCount; i++ {
+		node = g.record(node, uint(ip[i/8]>>(7-uint(i%8)))&1)
+	}
+	if node <= g.nodeCount {
+		return "" // not found
+	}
+	off := node - g.nodeCount - 16
+	g.mu.RLock()
+	c, ok := g.cache[off]
+	g.mu.RUnlock()
+	if ok {
+		return c
+	}
+	c = g.lookupCountry(off)
+	g.mu.Lock()
+	if len(g.cache) < geoIPCacheSize {
+		g.cache[off] = c
+	}
+	g.mu.Unlock()
+	return c
+}
+
+// lookupCountry decodes the country of the data record at off, the
+// registered country is used if there's no country, e.g. for anycast.
+func (g *GeoIP) lookupCountry(off uint) string {
+	if g.dataStart+off >= uint(len(g.buf)) {
+		return ""
+	}
+	d := mmdbDecoder{g.buf[g.dataStart:]}
+	v, _, err := d.decode(off, 0)
+	if err != nil {
+		return ""
+	}
+	rec, _ := v.(map[string]interface{})
+	for _, key := range []string{"country", "registered_country"} {
+		if c, ok := rec[key].(map[string]interface{}); ok {
+			if code, ok := c["iso_code"].(string); ok {
+				return code
+			}
+		}
+	}
+	return ""
+}
+
+// mmdbDecoder decodes values of the MaxMind DB data section, or metadata,
+// in buf. Pointers are offsets in buf.
+type mmdbDecoder struct {
+	buf []byte
+}
+
+const (
+	mmdbPointer = 1
+	mmdbString  = 2
+	mmdbDouble  = 3
+	mmdbBytes   = 4
+	mmdbUint16  = 5
+	mmdbUint32  = 6
+	mmdbMap     = 7
+	mmdbInt32   = 8
+	mmdbUint64  = 9
+	mmdbUint128 = 10
+	mmdbArray   = 11
+	mmdbBool    = 14
+	mmdbFloat   = 15
+)
+
+// pointers may only point to values, limit the depth to stay safe on
+// corrupt files
+const mmdbMaxDepth = 32
+
+// decode returns the value at off and the offset following it. Unsigned
+// integers are returned as uint64, uint128 as []byte.
+func (d *mmdbDecoder) decode(off uint, depth int) (interface{}, uint, error) {
+	if depth > mmdbMaxDepth {
+		return nil, 0, errGeoIPFormat
+	}
+	typ, size, off, err := d.control(off)
+	if err != nil {
+		return nil, 0, err
+	}
+	if typ == mmdbPointer {
+		ptr, next, err := d.pointer(size, off)
+		if err != nil {
+			return nil, 0, err
+		}
+		v, _, err := d.decode(ptr, depth+1)
+		return v, next, err
+	}
+	switch typ {
+	case mmdbMap:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			var k, v interface{}
+			if k, off, err = d.decode(off, depth+1); err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errGeoIPFormat
+			}
+			if v, off, err = d.decode(off, depth+1); err != nil {
+				return nil, 0, err
+			}
+			m[key] = v
+		}
+		return m, off, nil
+	case mmdbArray:
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			var v interface{}
+			if v, off, err = d.decode(off, depth+1); err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+		}
+		return a, off, nil
+	case mmdbBool:
+		return size != 0, off, nil
+	}
+	if off+size > uint(len(d.buf)) {
+		return nil, 0, errGeoIPFormat
+	}
+	b := d.buf[off : off+size]
+	next := off + size
+	switch typ {
+	case mmdbString:
+		return string(b), next, nil
+	case mmdbBytes, mmdbUint128:
+		return b, next, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64:
+		var n uint64
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		return n, next, nil
+	case mmdbInt32:
+		var n uint32
+		for _, c := range b {
+			n = n<<8 | uint32(c)
+		}
+		return int32(n), next, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, errGeoIPFormat
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), next, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, errGeoIPFormat
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(b)), next, nil
+	}
+	return nil, 0, fmt.Errorf("%v: unknown data type %d", errGeoIPFormat, typ)
+}
+
+// control parses the control byte at off, returning the type and size of the
+// value and the offset of its payload. The size of pointers is the control
+// byte itself, which holds part of the pointer.
+func (d *mmdbDecoder) control(off uint) (typ, size, next uint, err error) {
+	if off >= uint(len(d.buf)) {
+		return 0, 0, 0, errGeoIPFormat
+	}
+	ctrl := uint(d.buf[off])
+	off++
+	typ = ctrl >> 5
+	if typ == mmdbPointer {
+		return typ, ctrl, off, nil
+	}
+	if typ == 0 { // extended type
+		if off >= uint(len(d.buf)) {
+			return 0, 0, 0, errGeoIPFormat
+		}
+		typ = 7 + uint(d.buf[off])
+		off++
+	}
+	size = ctrl & 0x1f
+	if size >= 29 {
+		n := size - 28 // bytes holding the size
+		if off+n > uint(len(d.buf)) {
+			return 0, 0, 0, errGeoIPFormat
+		}
+		var v uint
+		for _, c := range d.buf[off : off+n] {
+			v = v<<8 | uint(c)
+		}
+		off += n
+		switch size {
+		case 29:
+			size = 29 + v
+		case 30:
+			size = 285 + v
+		default:
+			size = 65821 + v
+		}
+	}
+	return typ, size, off, nil
+}
+
+// pointer decodes the pointer with control byte ctrl at off.
+func (d *mmdbDecoder) pointer(ctrl, off uint) (ptr, next uint, err error) {
+	n := (ctrl>>3)&3 + 1
+	if off+n > uint(len(d.buf)) {
+		return 0, 0, errGeoIPFormat
+	}
+	v := ctrl & 7
+	if n == 4 {
+		v = 0
+	}
+	for _, c := range d.buf[off : off+n] {
+		v = v<<8 | uint(c)
+	}
+	switch n {
+	case 2:
+		v += 2048
+	case 3:
+		v += 526336
+	}
+	return v, off + n, nil
+}
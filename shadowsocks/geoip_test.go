@@ -0,0 +1,134 @@
+package shadowsocks
+
+import (
+	"net"
+	"testing"
+)
+
+// buildMMDB returns an IPv6 MaxMind DB with 24 bit records, mapping each
+// network to {"country": {"iso_code": code}}. Strings seen before are
+// written as pointers, like in real databases.
+func buildMMDB(t *testing.T, networks map[string]string) []byte {
+	type node [2]int // node index, -1 if empty, -2-i for data record i
+	nodes := []node{{-1, -1}}
+	var data []byte
+	var records []int // offsets of data records
+	strOff := make(map[string]int)
+	str := func(s string) {
+		if off, ok := strOff[s]; ok {
+			data = append(data, 0x20|byte(off>>8), byte(off))
+			return
+		}
+		strOff[s] = len(data)
+		data = append(data, 0x40|byte(len(s)))
+		data = append(data, s...)
+	}
+
+	for cidr, code := range networks {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ones, bits := ipnet.Mask.Size()
+		ip := ipnet.IP.To16()
+		if bits == 32 {
+			// IPv4 networks are in ::/96
+			ip = make(net.IP, 16)
+			copy(ip[12:], ipnet.IP.To4())
+			ones += 96
+		}
+		records = append(records, len(data))
+		data = append(data, 0xe1)
+		str("country")
+		data = append(data, 0xe1)
+		str("iso_code")
+		str(code)
+
+		n := 0
+		for i := 0; i < ones; i++ {
+			bit := ip[i/8] >> (7 - uint(i%8)) & 1
+			if i == ones-1 {
+				nodes[n][bit] = -2 - (len(records) - 1)
+				break
+			}
+			if nodes[n][bit] < 0 {
+				nodes = append(nodes, node{-1, -1})
+				nodes[n][bit] = len(nodes) - 1
+			}
+			n = nodes[n][bit]
+		}
+	}
+
+	var db []byte
+	count := len(nodes)
+	for _, nd := range nodes {
+		for _, r := range nd {
+			v := r
+			if r == -1 {
+				v = count
+			} else if r <= -2 {
+				v = count + 16 + records[-r-2]
+			}
+			db = append(db, byte(v>>16), byte(v>>8), byte(v))
+		}
+	}
+	db = append(db, make([]byte, 16)...)
+	db = append(db, data...)
+	db = append(db, metadataMarker...)
+	db = append(db, 0xe3)
+	db = append(db, 0x40|10)
+	db = append(db, "node_count"...)
+	db = append(db, 0xc4, byte(count>>24), byte(count>>16), byte(count>>8), byte(count))
+	db = append(db, 0x40|11)
+	db = append(db, "record_size"...)
+	db = append(db, 0xa1, 24)
+	db = append(db, 0x40|10)
+	db = append(db, "ip_version"...)
+	db = append(db, 0xa1, 6)
+	return db
+}
+
+func TestGeoIP(t *testing.T) {
+	g, err := NewGeoIP(buildMMDB(t, map[string]string{
+		"1.2.3.0/24":    "CN",
+		"5.0.0.0/8":     "US",
+		"9.9.9.9/32":    "CN",
+		"2001:db8::/32": "DE",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		ip, country string
+	}{
+		{"1.2.3.4", "CN"},
+		{"1.2.3.255", "CN"},
+		{"1.2.4.1", ""},
+		{"5.6.7.8", "US"},
+		{"9.9.9.9", "CN"},
+		{"9.9.9.8", ""},
+		{"::ffff:5.1.1.1", "US"},
+		{"2001:db8::1", "DE"},
+		{"2001:db9::1", ""},
+		{"5.6.7.8", "US"}, // cached
+	} {
+		if c := g.Country(net.ParseIP(tc.ip)); c != tc.country {
+			t.Errorf("country of %s is %q, want %q", tc.ip, c, tc.country)
+		}
+	}
+
+	if _, err = NewGeoIP([]byte("not a database")); err == nil {
+		t.Error("invalid database should be rejected")
+	}
+}
+
+func TestGeoIPRule(t *testing.T) {
+	deny := &GeoIPRule{Deny: []string{"CN"}}
+	if deny.Allows("cn") || !deny.Allows("US") || !deny.Allows("") {
+		t.Error("deny rule should only reject listed countries")
+	}
+	allow := &GeoIPRule{Allow: []string{"US", "CA"}, Deny: []string{"CA"}}
+	if !allow.Allows("US") || allow.Allows("CA") || allow.Allows("DE") || allow.Allows("") {
+		t.Error("allow rule should only accept listed countries not denied")
+	}
+}
@@ -0,0 +1,161 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Known-answer tests check the ciphers against fixed outputs, so a broken
+// build or a bad CPU specific code path is caught before serving. The
+// outputs of the stream ciphers were computed with OpenSSL, those of the
+// AEAD ciphers with implementations checked against the GCM specification
+// and RFC 8439 (and draft-irtf-cfrg-xchacha) vectors, sm4-gcm with the block cipher of sm4-cfb.
+
+// ErrNoKAT is returned by CipherSelfTest for methods without a known-answer
+// test, rc4 and table.
+var ErrNoKAT = errors.New("no known-answer test")
+
+var katPlaintext = []byte("shadowsocks known answer test!!")
+
+// katOutputs are the encryptions of katPlaintext with key 00 01 02 ... of
+// the key length of the method, and IV ff fe fd ... for stream ciphers or
+// an all zero nonce for AEAD ciphers, whose output ends with the tag.
+var katOutputs = map[string]string{
+	"aes-128-cfb":             "c0ec8dc0dcee66c8409ef1c94beb2b2e32a22c355ffe5d3014d5c490cae0d6",
+	"aes-192-cfb":             "e830a738a2c8bb3c2237a82a829ff87cd2f6b5e7a54b5d7ab043128ba4643e",
+	"aes-256-cfb":             "728558fd84e5c46c704e6c7d821974307dc2e6d0b8b71025733c7657f92367",
+	"des-cfb":                 "ab73f937886e6e5b8edae9f39d1f9b0adf640a2e324fadec138170982054f0",
+	"bf-cfb":                  "ddf5f9f2a81b4ca729f3a0ea84032e4b6c8bb499c7c5e92d5c22daa0644d4a",
+	"cast5-cfb":               "8f2ca2677f422db26e567a51a9914071be40e57d77eae5c741c45b926b8273",
+	"sm4-cfb":                 "83983874f51a78d51df7831abf3a173f3e8c38349d101ca0509fefbca4d022",
+	"rc4-md5":                 "4edebc2697797ea63ceacc67573d744ac876f34c9877628d99652b01761cab",
+	"chacha20":                "f12afb64e6cf2455eeed2332f40be189779b2db0b5c87e34a6b9c7e1fa8b31",
+	"aes-128-gcm":             "3abee637f6ecd5e380e209480befdfead78d4a40471da74a7029532de896ddf94564e24df79fda4a3b066fee7f67e2",
+	"aes-192-gcm":             "a86b73efd83a5743e02931069ca44ab1f552ffcb0269cf243b79f6acf1e282e239e326823d04dc9c21e50046c035ee",
+	"aes-256-gcm":             "7dd4d4bada5bf0d26bc3da157342feeebc63373d5bf6055da0ead6f0b1de7ce249deccefdf31d9b61bb5fe601c73bd",
+	"chacha20-ietf-poly1305":  "6bd02355c291d5be700a2f41c42d21509691929b92da3e2ecc8c99615e14547698812b6c36ee48f06dd0654bab6a34",
+	"xchacha20-ietf-poly1305": "e66eeda383ff967675e50c198778519d529cccfd09e72879eb99f02ea3c73b39b3ddec3079fb4afc483c24412de91f",
+	"sm4-gcm":                 "5135ecab8d572933cd8dc88b60ba5d12668bf55548f464a8d2276509afbc982fdac6102453d551188b7f8fd8338625",
+	"2022-blake3-aes-128-gcm": "3abee637f6ecd5e380e209480befdfead78d4a40471da74a7029532de896ddf94564e24df79fda4a3b066fee7f67e2",
+	"2022-blake3-aes-256-gcm": "7dd4d4bada5bf0d26bc3da157342feeebc63373d5bf6055da0ead6f0b1de7ce249deccefdf31d9b61bb5fe601c73bd",
+}
+
+func katBytes(n int, start byte, step int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = start + byte(i*step)
+	}
+	return b
+}
+
+// CipherSelfTest runs the known-answer test of method, and checks that
+// decrypting its output gives the plaintext back.
+func CipherSelfTest(method string) error {
+	mi, ok := cipherMethod[method]
+	if !ok {
+		return errors.New("Unsupported encryption method: " + method)
+	}
+	want, ok := katOutputs[method]
+	if !ok {
+		return ErrNoKAT
+	}
+	key := katBytes(mi.keyLen, 0, 1)
+	var out, back []byte
+	if mi.newAEAD != nil {
+		aead, err := mi.newAEAD(key)
+		if err != nil {
+			return err
+		}
+		nonce := make([]byte, aead.NonceSize())
+		out = aead.Seal(nil, nonce, katPlaintext, nil)
+		if back, err = aead.Open(nil, nonce, out, nil); err != nil {
+			return fmt.Errorf("%s: %v", method, err)
+		}
+	} else {
+		iv := katBytes(mi.ivLen, 0xff, -1)
+		streams := [2]cipher.Stream{}
+		for i, doe := range []DecOrEnc{Encrypt, Decrypt} {
+			s, err := mi.newStream(key, iv, doe)
+			if err != nil {
+				return err
+			}
+			streams[i] = s
+		}
+		out = make([]byte, len(katPlaintext))
+		streams[0].XORKeyStream(out, katPlaintext)
+		back = make([]byte, len(out))
+		streams[1].XORKeyStream(back, out)
+	}
+	if got := hex.EncodeToString(out); got != want {
+		return fmt.Errorf("%s: known-answer test output %s, want %s", method, got, want)
+	}
+	if !bytes.Equal(back, katPlaintext) {
+		return fmt.Errorf("%s: decrypted output differs from the plaintext", method)
+	}
+	return nil
+}
+
+// KeyDerivationSelfTest checks the derivation of keys from passwords
+// (EVP_BytesToKey, checked against OpenSSL) and of AEAD session subkeys
+// (HKDF-SHA1).
+func KeyDerivationSelfTest() error {
+	const wantKey = "3858f62230ac3c915f300c664312c63f568378529614d22ddb49237d2f60bfdf"
+	if got := hex.EncodeToString(evpBytesToKey("foobar", 32)); got != wantKey {
+		return fmt.Errorf("EVP_BytesToKey output %s, want %s", got, wantKey)
+	}
+	const wantSubkey = "8a164759965bfebd24e122b2cff311909abc78372e3922c8c1b6a90a78befcde"
+	subkey := make([]byte, 32)
+	if err := hkdfSHA1(katBytes(32, 0, 1), katBytes(32, 0xff, -1), subkey); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(subkey); got != wantSubkey {
+		return fmt.Errorf("HKDF-SHA1 subkey %s, want %s", got, wantSubkey)
+	}
+	return nil
+}
+
+// CipherThroughput returns the bytes per second method encrypts on this
+// CPU, measured for about d on a single core. TCP chunks are sealed with
+// AEAD ciphers.
+func CipherThroughput(method string, d time.Duration) (float64, error) {
+	password, err := RandomPassword(method)
+	if err != nil {
+		return 0, err
+	}
+	c, err := NewCipher(method, password)
+	if err != nil {
+		return 0, err
+	}
+	var encrypt func(b []byte)
+	buf := make([]byte, aeadMaxPayload)
+	if c.isAEAD() {
+		if _, err = c.initAEADEncrypt(); err != nil {
+			return 0, err
+		}
+		out := make([]byte, 0, len(buf)+c.encAEAD.Overhead())
+		encrypt = func(b []byte) {
+			c.encAEAD.Seal(out[:0], c.encNonce, b, nil)
+			increment(c.encNonce)
+		}
+	} else {
+		if c.info.newStream != nil {
+			if _, err = c.initEncrypt(); err != nil {
+				return 0, err
+			}
+		}
+		encrypt = func(b []byte) { c.encrypt(b, b) }
+	}
+	var n int64
+	start := time.Now()
+	for time.Since(start) < d {
+		for i := 0; i < 16; i++ {
+			encrypt(buf)
+			n += int64(len(buf))
+		}
+	}
+	return float64(n) / time.Since(start).Seconds(), nil
+}
@@ -0,0 +1,16 @@
+package shadowsocks
+
+import (
+	"testing"
+)
+
+func TestCipherSelfTest(t *testing.T) {
+	for _, method := range CipherMethods() {
+		if err := CipherSelfTest(method); err != nil && err != ErrNoKAT {
+			t.Error(err)
+		}
+	}
+	if err := KeyDerivationSelfTest(); err != nil {
+		t.Error(err)
+	}
+}
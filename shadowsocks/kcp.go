@@ -0,0 +1,351 @@
+package shadowsocks
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	kcp "github.com/xtaci/kcp-go/v5"
+	"github.com/xtaci/smux"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// The kcp transport speaks the protocol of kcptun
+// (https://github.com/xtaci/kcptun) with the libraries kcptun is built on:
+// kcp-go sessions, with its crypt and FEC, carry smux v1 frames, in snappy
+// framing unless nocomp. A kcptun client with the same key, crypt, mode,
+// shards and nocomp can connect to a kcp port, and the local proxy to a
+// kcptun server forwarding to shadowsocks.
+
+const (
+	kcpMTULimit   = 1500
+	kcpSalt       = "kcp-go"
+	kcpAcceptWait = 128
+	kcpSmuxBuf    = 4 << 20 // smux receive buffer, -smuxbuf of kcptun
+	kcpKeepAlive  = 10 * time.Second
+)
+
+// kcpModes are the nodelay, interval, resend and nc parameters of the modes
+// of kcptun, which all turn the congestion window off.
+var kcpModes = map[string][4]int{
+	"normal": {0, 40, 2, 1},
+	"fast":   {0, 30, 2, 1},
+	"fast2":  {1, 20, 2, 1},
+	"fast3":  {1, 10, 2, 1},
+}
+
+// withDefaults returns a copy of c with the defaults of kcptun for the
+// unset parameters.
+func (c *KCPConfig) withDefaults(server bool) KCPConfig {
+	var d KCPConfig
+	if c != nil {
+		d = *c
+	}
+	if d.Crypt == "" {
+		d.Crypt = "aes"
+	}
+	if d.Mode == "" {
+		d.Mode = "fast"
+	}
+	if d.MTU == 0 {
+		d.MTU = 1350
+	}
+	if d.SndWnd == 0 {
+		d.SndWnd = 128
+		if server {
+			d.SndWnd = 1024
+		}
+	}
+	if d.RcvWnd == 0 {
+		d.RcvWnd = 512
+		if server {
+			d.RcvWnd = 1024
+		}
+	}
+	if d.DataShard == 0 && d.ParityShard == 0 {
+		d.DataShard, d.ParityShard = 10, 3
+	}
+	return d
+}
+
+// CheckKCP returns an error if the kcp parameters are invalid.
+func CheckKCP(c *KCPConfig) error {
+	d := c.withDefaults(true)
+	if _, ok := kcpModes[d.Mode]; !ok {
+		return fmt.Errorf("unsupported kcp mode %q, must be normal, fast, fast2 or fast3", d.Mode)
+	}
+	if _, err := newKCPBlock(d.Crypt, "x"); err != nil {
+		return err
+	}
+	if d.MTU < 100 || d.MTU > kcpMTULimit {
+		return fmt.Errorf("kcp mtu %d out of range, must be 100 to %d", d.MTU, kcpMTULimit)
+	}
+	if d.SndWnd < 0 || d.RcvWnd < 0 {
+		return fmt.Errorf("kcp windows can't be negative")
+	}
+	if d.DataShard > 0 && d.ParityShard > 0 && d.DataShard+d.ParityShard > 256 {
+		return fmt.Errorf("kcp shards %d and %d out of range", d.DataShard, d.ParityShard)
+	}
+	return nil
+}
+
+// newKCPBlock returns the packet crypt of kcptun for crypt, keyed by key
+// like kcptun does. null is no crypt at all, none the header without
+// encryption.
+func newKCPBlock(crypt, key string) (kcp.BlockCrypt, error) {
+	pass := pbkdf2.Key([]byte(key), []byte(kcpSalt), 4096, 32, sha1.New)
+	switch crypt {
+	case "aes":
+		return kcp.NewAESBlockCrypt(pass)
+	case "aes-128":
+		return kcp.NewAESBlockCrypt(pass[:16])
+	case "aes-192":
+		return kcp.NewAESBlockCrypt(pass[:24])
+	case "blowfish":
+		return kcp.NewBlowfishBlockCrypt(pass)
+	case "twofish":
+		return kcp.NewTwofishBlockCrypt(pass)
+	case "cast5":
+		return kcp.NewCast5BlockCrypt(pass[:16])
+	case "3des":
+		return kcp.NewTripleDESBlockCrypt(pass[:24])
+	case "xtea":
+		return kcp.NewXTEABlockCrypt(pass[:16])
+	case "sm4":
+		return kcp.NewSM4BlockCrypt(pass[:16])
+	case "salsa20":
+		return kcp.NewSalsa20BlockCrypt(pass)
+	case "none":
+		return kcp.NewNoneBlockCrypt(pass)
+	case "null":
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unsupported kcp crypt %q", crypt)
+}
+
+// setupKCP sets the parameters of cfg on s, as kcptun does on both ends.
+func setupKCP(s *kcp.UDPSession, cfg *KCPConfig) {
+	m := kcpModes[cfg.Mode]
+	s.SetStreamMode(true)
+	s.SetWriteDelay(false)
+	s.SetNoDelay(m[0], m[1], m[2], m[3])
+	s.SetMtu(cfg.MTU)
+	s.SetWindowSize(cfg.SndWnd, cfg.RcvWnd)
+}
+
+func kcpSmuxConfig() *smux.Config {
+	c := smux.DefaultConfig()
+	c.Version = 1
+	c.MaxReceiveBuffer = kcpSmuxBuf
+	c.KeepAliveInterval = kcpKeepAlive
+	return c
+}
+
+// compConn is the snappy framing of kcptun, each write is flushed.
+type compConn struct {
+	net.Conn
+	w *snappy.Writer
+	r *snappy.Reader
+}
+
+func (c *compConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *compConn) Write(b []byte) (int, error) {
+	if _, err := c.w.Write(b); err != nil {
+		return 0, err
+	}
+	if err := c.w.Flush(); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// wrapKCP returns the connection smux runs on.
+func wrapKCP(s net.Conn, nocomp bool) io.ReadWriteCloser {
+	if nocomp {
+		return s
+	}
+	return &compConn{s, snappy.NewBufferedWriter(s), snappy.NewReader(s)}
+}
+
+// KCPListener accepts the smux streams opened by kcp clients as
+// connections.
+type KCPListener struct {
+	conn     net.PacketConn
+	ln       *kcp.Listener
+	cfg      KCPConfig
+	mu       sync.Mutex
+	sessions map[*smux.Session]bool
+	streams  chan net.Conn
+	done     chan struct{}
+	once     sync.Once
+}
+
+// ListenKCP listens for kcp clients on the UDP address. The key of cfg
+// defaults to password.
+func ListenKCP(network, addr string, cfg *KCPConfig, password string) (net.Listener, error) {
+	d := cfg.withDefaults(true)
+	if d.Key == "" {
+		d.Key = password
+	}
+	block, err := newKCPBlock(d.Crypt, d.Key)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenPacket(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := kcp.ServeConn(block, d.DataShard, d.ParityShard, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	l := &KCPListener{
+		conn:     conn,
+		ln:       ln,
+		cfg:      d,
+		sessions: make(map[*smux.Session]bool),
+		streams:  make(chan net.Conn, kcpAcceptWait),
+		done:     make(chan struct{}),
+	}
+	go l.acceptSessions()
+	return l, nil
+}
+
+func (l *KCPListener) acceptSessions() {
+	for {
+		s, err := l.ln.AcceptKCP()
+		if err != nil {
+			l.Close()
+			return
+		}
+		setupKCP(s, &l.cfg)
+		m, err := smux.Server(wrapKCP(s, l.cfg.NoComp), kcpSmuxConfig())
+		if err != nil {
+			s.Close()
+			continue
+		}
+		l.mu.Lock()
+		if l.sessions == nil {
+			l.mu.Unlock()
+			m.Close()
+			return
+		}
+		l.sessions[m] = true
+		l.mu.Unlock()
+		go l.acceptStreams(m)
+	}
+}
+
+func (l *KCPListener) acceptStreams(m *smux.Session) {
+	defer func() {
+		m.Close()
+		l.mu.Lock()
+		delete(l.sessions, m)
+		l.mu.Unlock()
+	}()
+	for {
+		st, err := m.AcceptStream()
+		if err != nil {
+			return
+		}
+		select {
+		case l.streams <- st:
+		case <-l.done:
+			return
+		}
+	}
+}
+
+func (l *KCPListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.streams:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops listening and ends the sessions.
+func (l *KCPListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.ln.Close()
+		l.mu.Lock()
+		sessions := l.sessions
+		l.sessions = nil
+		l.mu.Unlock()
+		for m := range sessions {
+			m.Close()
+		}
+		l.conn.Close()
+	})
+	return nil
+}
+
+func (l *KCPListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// KCPDialer opens streams to kcp servers, over one session to each.
+type KCPDialer struct {
+	cfg      KCPConfig
+	mu       sync.Mutex
+	sessions map[string]*smux.Session
+}
+
+// NewKCPDialer returns a dialer with the parameters of cfg, which may be
+// nil.
+func NewKCPDialer(cfg *KCPConfig) *KCPDialer {
+	return &KCPDialer{cfg: cfg.withDefaults(false), sessions: make(map[string]*smux.Session)}
+}
+
+// session returns the session to addr, connecting if there's none alive.
+func (d *KCPDialer) session(addr, password string) (*smux.Session, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if m, ok := d.sessions[addr]; ok && !m.IsClosed() {
+		return m, nil
+	}
+	key := d.cfg.Key
+	if key == "" {
+		key = password
+	}
+	block, err := newKCPBlock(d.cfg.Crypt, key)
+	if err != nil {
+		return nil, err
+	}
+	s, err := kcp.DialWithOptions(addr, block, d.cfg.DataShard, d.cfg.ParityShard)
+	if err != nil {
+		return nil, err
+	}
+	setupKCP(s, &d.cfg)
+	m, err := smux.Client(wrapKCP(s, d.cfg.NoComp), kcpSmuxConfig())
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	d.sessions[addr] = m
+	return m, nil
+}
+
+// Dial opens a stream to the server at addr, the key defaults to password.
+func (d *KCPDialer) Dial(addr, password string) (net.Conn, error) {
+	m, err := d.session(addr, password)
+	if err != nil {
+		return nil, err
+	}
+	st, err := m.OpenStream()
+	if err != nil {
+		m.Close()
+		return nil, err
+	}
+	return st, nil
+}
@@ -0,0 +1,65 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestKCP(t *testing.T) {
+	for _, cfg := range []*KCPConfig{{Crypt: "aes"}, {Crypt: "none", NoComp: true}, {Crypt: "null", DataShard: -1}} {
+		crypt := cfg.Crypt
+		ln, err := ListenKCP("udp", "127.0.0.1:0", cfg, "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			for {
+				c, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					io.Copy(c, c)
+					c.Close()
+				}()
+			}
+		}()
+
+		d := NewKCPDialer(cfg)
+		addr := ln.Addr().String()
+		payload := bytes.Repeat([]byte(text), 100)
+		for i := 0; i < 3; i++ {
+			c, err := d.Dial(addr, "password")
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.Write(payload)
+			got := make([]byte, len(payload))
+			c.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, err = io.ReadFull(c, got); err != nil {
+				t.Errorf("%s stream %d: %v", crypt, i, err)
+			} else if !bytes.Equal(got, payload) {
+				t.Errorf("%s stream %d: echo differs", crypt, i)
+			}
+			c.Close()
+		}
+		d.mu.Lock()
+		if len(d.sessions) != 1 {
+			t.Errorf("%s: %d sessions to the server, want 1", crypt, len(d.sessions))
+		}
+		d.mu.Unlock()
+		ln.Close()
+	}
+
+	if err := CheckKCP(&KCPConfig{Mode: "turbo"}); err == nil {
+		t.Error("mode turbo passed the check")
+	}
+	if err := CheckKCP(&KCPConfig{Crypt: "rot13"}); err == nil {
+		t.Error("crypt rot13 passed the check")
+	}
+	if err := CheckKCP(&KCPConfig{DataShard: 250, ParityShard: 10}); err == nil {
+		t.Error("260 shards passed the check")
+	}
+}
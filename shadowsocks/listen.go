@@ -0,0 +1,115 @@
+package shadowsocks
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// multiListener accepts from several listeners, each by a goroutine of its
+// own, e.g. sockets sharing a port with SO_REUSEPORT, or bound to several
+// addresses.
+type multiListener struct {
+	lns   []net.Listener
+	conns chan net.Conn
+	err   error // of an accept loop, set before done is closed
+	done  chan struct{}
+	once  sync.Once
+}
+
+// MultiListener returns a listener accepting the connections of all lns,
+// which must not be empty. Its address is the one of the first, closing it
+// closes them all, as does an accept error of any of them.
+func MultiListener(lns []net.Listener) net.Listener {
+	if len(lns) == 1 {
+		return lns[0]
+	}
+	l := &multiListener{lns: lns, conns: make(chan net.Conn), done: make(chan struct{})}
+	for _, ln := range l.lns {
+		go l.acceptLoop(ln)
+	}
+	return l
+}
+
+func (l *multiListener) acceptLoop(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if IsFileLimit(err) {
+			time.Sleep(FileLimitReached())
+			continue
+		}
+		if err != nil {
+			l.close(err)
+			return
+		}
+		select {
+		case l.conns <- conn:
+		case <-l.done:
+			conn.Close()
+			return
+		}
+	}
+}
+
+func (l *multiListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		if l.err != nil {
+			return nil, l.err
+		}
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *multiListener) Addr() net.Addr {
+	return l.lns[0].Addr()
+}
+
+func (l *multiListener) Close() error {
+	return l.close(nil)
+}
+
+// close closes all the listeners, Accept returns failed then, net.ErrClosed
+// if it's nil.
+func (l *multiListener) close(failed error) (err error) {
+	l.once.Do(func() {
+		l.err = failed
+		close(l.done)
+		for _, ln := range l.lns {
+			if cerr := ln.Close(); err == nil {
+				err = cerr
+			}
+		}
+	})
+	return
+}
+
+// ListenNetwork returns the network to listen on addr with, network ("tcp"
+// or "udp", maybe with a version already) for addresses with a hostname or
+// without host, and the network of the IP version of IP literals. IPv6
+// sockets are IPv6 only then, so 0.0.0.0 and [::] can be bound separately,
+// while [::] with network "tcp" accepts both versions.
+func ListenNetwork(network, addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil || host == "" {
+		return network
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		if i := strings.LastIndexByte(host, '%'); i > 0 {
+			// link-local IPv6 with a zone
+			ip = net.ParseIP(host[:i])
+		}
+		if ip == nil {
+			return network
+		}
+	}
+	base := strings.TrimRight(network, "46")
+	if ip.To4() != nil {
+		return base + "4"
+	}
+	return base + "6"
+}
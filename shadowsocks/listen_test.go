@@ -0,0 +1,62 @@
+package shadowsocks
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestListenNetwork(t *testing.T) {
+	tests := []struct{ network, addr, want string }{
+		{"tcp", ":8388", "tcp"},
+		{"tcp4", ":8388", "tcp4"},
+		{"tcp", "0.0.0.0:8388", "tcp4"},
+		{"tcp", "[::]:8388", "tcp6"},
+		{"tcp4", "[::1]:8388", "tcp6"},
+		{"udp", "[fe80::1%eth0]:8388", "udp6"},
+		{"udp6", "127.0.0.1:8388", "udp4"},
+		{"tcp", "localhost:8388", "tcp"},
+	}
+	for _, tt := range tests {
+		if got := ListenNetwork(tt.network, tt.addr); got != tt.want {
+			t.Errorf("ListenNetwork(%s, %s) = %s, want %s", tt.network, tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestMultiListener(t *testing.T) {
+	var lns []net.Listener
+	for i := 0; i < 2; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		lns = append(lns, ln)
+	}
+	ln := MultiListener(lns)
+	for _, l := range lns {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		a, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.LocalAddr().String() != l.Addr().String() {
+			t.Errorf("accepted on %s, want %s", a.LocalAddr(), l.Addr())
+		}
+		a.Close()
+	}
+	ln.Close()
+	if _, err := ln.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Error("Accept after Close returned", err)
+	}
+	for _, l := range lns {
+		if c, err := net.Dial("tcp", l.Addr().String()); err == nil {
+			c.Close()
+			t.Errorf("%s still accepting after Close", l.Addr())
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package shadowsocks
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// listenHandshakeTimeout bounds the time clients of Listen take to send
+// their destination.
+const listenHandshakeTimeout = 30 * time.Second
+
+// ServerConn is a connection accepted by a listener of Listen, whose
+// destination has been read. Reads return the data sent after it.
+type ServerConn struct {
+	*Conn
+	target string
+	extra  []byte
+}
+
+// TargetAddr returns the destination the client asked for, as host:port,
+// the host being a domain name or an IP address.
+func (c *ServerConn) TargetAddr() string {
+	return c.target
+}
+
+func (c *ServerConn) Read(b []byte) (int, error) {
+	if len(c.extra) > 0 {
+		n := copy(b, c.extra)
+		c.extra = c.extra[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+type listener struct {
+	net.Listener
+	cipher *Cipher
+	conns  chan *ServerConn
+	err    error // of the accept loop, set before done is closed
+	done   chan struct{}
+	once   sync.Once
+}
+
+// Listen listens for shadowsocks clients encrypting with cipher, so a Go
+// server can terminate shadowsocks itself. Accept returns *ServerConn,
+// clients failing to send their destination are dropped.
+func Listen(network, addr string, cipher *Cipher) (net.Listener, error) {
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	l := &listener{Listener: ln, cipher: cipher, conns: make(chan *ServerConn), done: make(chan struct{})}
+	go l.acceptLoop()
+	return l, nil
+}
+
+func (l *listener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if IsFileLimit(err) {
+			time.Sleep(FileLimitReached())
+			continue
+		}
+		if err != nil {
+			l.close(err)
+			return
+		}
+		go l.handshake(conn)
+	}
+}
+
+// handshake reads the destination of conn, then queues it for Accept.
+func (l *listener) handshake(conn net.Conn) {
+	c := NewConn(conn, l.cipher.Copy())
+	c.SetReadDeadline(time.Now().Add(listenHandshakeTimeout))
+	host, port, extra, err := GetRequest(c)
+	if err != nil {
+		logger.Debugf("handshake of %s: %v", conn.RemoteAddr(), err)
+		c.Close()
+		return
+	}
+	c.SetReadDeadline(time.Time{})
+	sc := &ServerConn{Conn: c, target: net.JoinHostPort(host, port), extra: extra}
+	select {
+	case l.conns <- sc:
+	case <-l.done:
+		c.Close()
+	}
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		if l.err != nil {
+			return nil, l.err
+		}
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *listener) Close() error {
+	return l.close(nil)
+}
+
+// close stops accepting, Accept returns failed then, net.ErrClosed if
+// it's nil.
+func (l *listener) close(failed error) (err error) {
+	l.once.Do(func() {
+		l.err = failed
+		close(l.done)
+		err = l.Listener.Close()
+	})
+	return
+}
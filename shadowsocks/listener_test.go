@@ -0,0 +1,63 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestListen(t *testing.T) {
+	cipher, err := NewCipher("aes-256-gcm", "foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := Listen("tcp", "127.0.0.1:0", cipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a client sending garbage doesn't hold up the others
+	junk, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer junk.Close()
+	junk.Write(bytes.Repeat([]byte{0xff}, 100))
+
+	d := &Dialer{Server: ln.Addr().String(), Method: "aes-256-gcm", Password: "foobar"}
+	c, err := d.Dial("tcp", "example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte(text))
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc, ok := conn.(*ServerConn)
+	if !ok {
+		t.Fatalf("accepted %T, want *ServerConn", conn)
+	}
+	if sc.TargetAddr() != "example.com:443" {
+		t.Errorf("target %s, want example.com:443", sc.TargetAddr())
+	}
+	got := make([]byte, len(text))
+	if _, err = io.ReadFull(sc, got); err != nil || string(got) != text {
+		t.Errorf("read %q, %v, want %q", got, err, text)
+	}
+	sc.Write([]byte("pong"))
+	reply := make([]byte, 4)
+	if _, err = io.ReadFull(c, reply); err != nil || string(reply) != "pong" {
+		t.Errorf("client read %q, %v, want pong", reply, err)
+	}
+	sc.Close()
+
+	ln.Close()
+	if _, err = ln.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("accept after close: %v, want net.ErrClosed", err)
+	}
+}
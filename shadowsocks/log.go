@@ -1,24 +1,381 @@
 package shadowsocks
 
 import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-type DebugLog bool
+// Level is the severity of a log record.
+type Level int
 
-var Debug DebugLog
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = [...]string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel parses one of debug, info, warn and error.
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	if strings.EqualFold(s, "warning") {
+		return LevelWarn, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+// logLevels holds the level of records written for each module, the default
+// applies to modules not listed.
+type logLevels struct {
+	def     Level
+	modules map[string]Level
+}
+
+var (
+	levels atomic.Value // logLevels
+
+	outMu   sync.Mutex
+	out     io.Writer = os.Stdout
+	jsonLog bool
+)
+
+func init() {
+	levels.Store(logLevels{def: LevelInfo})
+}
+
+// ParseLogLevels parses a level spec like "info,server=debug,tun=warn": a
+// bare level sets the default, module=level overrides it for a module. Later
+// entries take precedence.
+func ParseLogLevels(spec string) (def Level, modules map[string]Level, err error) {
+	def = LevelInfo
+	modules = make(map[string]Level)
+	for _, f := range strings.Split(spec, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		module, name := "", f
+		if i := strings.Index(f, "="); i >= 0 {
+			module, name = strings.TrimSpace(f[:i]), strings.TrimSpace(f[i+1:])
+			if module == "" {
+				return 0, nil, fmt.Errorf("missing module in log level %q", f)
+			}
+		}
+		l, err := ParseLevel(name)
+		if err != nil {
+			return 0, nil, err
+		}
+		if module == "" {
+			def = l
+		} else {
+			modules[module] = l
+		}
+	}
+	return
+}
+
+// SetLogLevels sets the levels of records written, see ParseLogLevels for the
+// format of spec.
+func SetLogLevels(spec string) error {
+	def, modules, err := ParseLogLevels(spec)
+	if err != nil {
+		return err
+	}
+	levels.Store(logLevels{def, modules})
+	return nil
+}
 
-var dbgLog = log.New(os.Stdout, "[DEBUG] ", log.Ltime)
+// SetLogFormat selects "text" or "json" records.
+func SetLogFormat(format string) error {
+	switch format {
+	case "", "text":
+		outMu.Lock()
+		jsonLog = false
+		outMu.Unlock()
+	case "json":
+		outMu.Lock()
+		jsonLog = true
+		outMu.Unlock()
+	default:
+		return fmt.Errorf("unknown log format %q, must be text or json", format)
+	}
+	return nil
+}
+
+// SetLogOutput sets where records are written, stdout by default.
+func SetLogOutput(w io.Writer) {
+	outMu.Lock()
+	out = w
+	outMu.Unlock()
+}
+
+// Logger writes the records of a module, e.g. server or tun.
+type Logger struct {
+	module string
+}
+
+func NewLogger(module string) *Logger {
+	return &Logger{module}
+}
+
+// Enabled tells whether records of level are written, so callers can skip
+// preparing expensive arguments.
+func (l *Logger) Enabled(level Level) bool {
+	lv := levels.Load().(logLevels)
+	min, ok := lv.modules[l.module]
+	if !ok {
+		min = lv.def
+	}
+	return level >= min
+}
 
-func (d DebugLog) Printf(format string, args ...interface{}) {
-	if d {
-		dbgLog.Printf(format, args...)
+type jsonRecord struct {
+	Time   string `json:"time"`
+	Level  string `json:"level"`
+	Module string `json:"module,omitempty"`
+	Msg    string `json:"msg"`
+}
+
+func (l *Logger) output(level Level, msg string) {
+	now := time.Now()
+	msg = strings.TrimRight(msg, "\n")
+	outMu.Lock()
+	defer outMu.Unlock()
+	if jsonLog {
+		b, _ := json.Marshal(jsonRecord{now.Format(time.RFC3339Nano), level.String(), l.module, msg})
+		out.Write(append(b, '\n'))
+		return
+	}
+	prefix := ""
+	if l.module != "" {
+		prefix = l.module + ": "
+	}
+	fmt.Fprintf(out, "%s [%s] %s%s\n", now.Format("2006/01/02 15:04:05"),
+		strings.ToUpper(level.String()), prefix, msg)
+}
+
+func (l *Logger) log(level Level, args []interface{}) {
+	if l.Enabled(level) {
+		l.output(level, fmt.Sprintln(args...))
 	}
 }
 
-func (d DebugLog) Println(args ...interface{}) {
-	if d {
-		dbgLog.Println(args...)
+func (l *Logger) logf(level Level, format string, args []interface{}) {
+	if l.Enabled(level) {
+		l.output(level, fmt.Sprintf(format, args...))
+	}
+}
+
+func (l *Logger) Debug(args ...interface{}) { l.log(LevelDebug, args) }
+func (l *Logger) Info(args ...interface{})  { l.log(LevelInfo, args) }
+func (l *Logger) Warn(args ...interface{})  { l.log(LevelWarn, args) }
+func (l *Logger) Error(args ...interface{}) { l.log(LevelError, args) }
+
+func (l *Logger) Debugf(format string, args ...interface{}) { l.logf(LevelDebug, format, args) }
+func (l *Logger) Infof(format string, args ...interface{})  { l.logf(LevelInfo, format, args) }
+func (l *Logger) Warnf(format string, args ...interface{})  { l.logf(LevelWarn, format, args) }
+func (l *Logger) Errorf(format string, args ...interface{}) { l.logf(LevelError, format, args) }
+
+// Fatal writes an error record regardless of the level and exits.
+func (l *Logger) Fatal(args ...interface{}) {
+	l.output(LevelError, fmt.Sprintln(args...))
+	os.Exit(1)
+}
+
+// Fatalf writes an error record regardless of the level and exits.
+func (l *Logger) Fatalf(format string, args ...interface{}) {
+	l.output(LevelError, fmt.Sprintf(format, args...))
+	os.Exit(1)
+}
+
+var logger = NewLogger("ss")
+
+// stdLogger turns the lines written through the standard log package, e.g.
+// by net/http, into info records.
+type stdLogger struct{}
+
+var stdLog = NewLogger("")
+
+func (stdLogger) Write(b []byte) (int, error) {
+	stdLog.log(LevelInfo, []interface{}{string(b)})
+	return len(b), nil
+}
+
+// RotatingFile is a log file that's renamed to path.YYYYMMDD-hhmmss and
+// reopened when it grows over MaxSize bytes or gets older than MaxAge. Only
+// the newest Backups of the renamed files are kept. Zero values disable the
+// corresponding limit.
+type RotatingFile struct {
+	path    string
+	MaxSize int64
+	MaxAge  time.Duration
+	Backups int
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+// OpenRotatingFile opens path for appending.
+func OpenRotatingFile(path string, maxSize int64, maxAge time.Duration, backups int) (*RotatingFile, error) {
+	rf := &RotatingFile{path: path, MaxSize: maxSize, MaxAge: maxAge, Backups: backups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *RotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f = f
+	rf.size = fi.Size()
+	rf.opened = time.Now()
+	return nil
+}
+
+func (rf *RotatingFile) Write(b []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.f == nil {
+		return 0, errors.New("log file closed")
+	}
+	if (rf.MaxSize > 0 && rf.size > 0 && rf.size+int64(len(b)) > rf.MaxSize) ||
+		(rf.MaxAge > 0 && time.Since(rf.opened) >= rf.MaxAge) {
+		if err := rf.rotate(); err != nil {
+			// keep writing to the old file rather than losing records
+			fmt.Fprintln(os.Stderr, "rotate log file:", err)
+		}
+	}
+	n, err := rf.f.Write(b)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *RotatingFile) rotate() error {
+	base := rf.path + "." + time.Now().Format("20060102-150405")
+	name := base
+	// rotated more than once in a second
+	for i := 1; ; i++ {
+		if _, err := os.Stat(name); os.IsNotExist(err) {
+			break
+		}
+		name = fmt.Sprintf("%s.%d", base, i)
+	}
+	if err := os.Rename(rf.path, name); err != nil {
+		return err
+	}
+	old := rf.f
+	if err := rf.open(); err != nil {
+		// the old file is still open on the renamed path
+		return err
+	}
+	old.Close()
+	if rf.Backups > 0 {
+		rf.removeBackups()
+	}
+	return nil
+}
+
+// removeBackups removes the oldest rotated files over the Backups limit.
+func (rf *RotatingFile) removeBackups() {
+	names, err := filepath.Glob(rf.path + ".[0-9]*")
+	if err != nil || len(names) <= rf.Backups {
+		return
+	}
+	// the timestamps in the names sort by time
+	sort.Strings(names)
+	for _, name := range names[:len(names)-rf.Backups] {
+		os.Remove(name)
+	}
+}
+
+func (rf *RotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.f == nil {
+		return nil
+	}
+	err := rf.f.Close()
+	rf.f = nil
+	return err
+}
+
+// LogOptions are the logging command line options shared by the programs.
+type LogOptions struct {
+	Format  string
+	File    string
+	Level   string
+	MaxSize int // in MB
+	MaxAge  time.Duration
+	Backups int
+}
+
+// AddLogFlags registers the logging options on fs.
+func AddLogFlags(fs *flag.FlagSet) *LogOptions {
+	o := new(LogOptions)
+	fs.StringVar(&o.Format, "log-format", "text", "format of log records, text or json")
+	fs.StringVar(&o.File, "log-file", "", "write logs to this file instead of stdout")
+	fs.StringVar(&o.Level, "log-level", "", "log levels, e.g. info,server=debug,tun=warn, default is info or debug with -d")
+	fs.IntVar(&o.MaxSize, "log-max-size", 0, "rotate the log file when it grows over this size in MB, 0 means no limit")
+	fs.DurationVar(&o.MaxAge, "log-max-age", 0, "rotate the log file after this duration, e.g. 24h, 0 means no limit")
+	fs.IntVar(&o.Backups, "log-backups", 0, "number of rotated log files kept, 0 means all")
+	return o
+}
+
+// Setup applies the options, debug lowers the default level to debug unless
+// the level option sets one.
+func (o *LogOptions) Setup(debug bool) error {
+	spec := o.Level
+	if debug {
+		spec = "debug," + spec
+	}
+	if err := SetLogLevels(spec); err != nil {
+		return err
+	}
+	if err := SetLogFormat(o.Format); err != nil {
+		return err
+	}
+	if o.File != "" {
+		rf, err := OpenRotatingFile(o.File, int64(o.MaxSize)<<20, o.MaxAge, o.Backups)
+		if err != nil {
+			return err
+		}
+		SetLogOutput(rf)
 	}
+	log.SetFlags(0)
+	log.SetOutput(stdLogger{})
+	return nil
 }
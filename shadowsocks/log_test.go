@@ -0,0 +1,104 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseLogLevels(t *testing.T) {
+	def, modules, err := ParseLogLevels("debug, server=warn,tun=error,info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if def != LevelInfo {
+		t.Error("later bare level should set the default, got", def)
+	}
+	if modules["server"] != LevelWarn || modules["tun"] != LevelError || len(modules) != 2 {
+		t.Error("wrong module levels:", modules)
+	}
+	for _, spec := range []string{"verbose", "server=", "=debug"} {
+		if _, _, err = ParseLogLevels(spec); err == nil {
+			t.Errorf("%q should be rejected", spec)
+		}
+	}
+}
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	SetLogOutput(&buf)
+	defer SetLogOutput(os.Stdout)
+	defer SetLogLevels("")
+	defer SetLogFormat("text")
+
+	if err := SetLogLevels("warn,test=debug"); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetLogFormat("json"); err != nil {
+		t.Fatal(err)
+	}
+	NewLogger("test").Debugf("port %d\n", 8388)
+	NewLogger("other").Info("dropped")
+	NewLogger("other").Error("failed:", "oops")
+
+	var recs []jsonRecord
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var r jsonRecord
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatalf("bad record %q: %v", line, err)
+		}
+		recs = append(recs, r)
+	}
+	if len(recs) != 2 {
+		t.Fatalf("got %d records, want 2", len(recs))
+	}
+	if r := recs[0]; r.Level != "debug" || r.Module != "test" || r.Msg != "port 8388" {
+		t.Error("wrong debug record:", r)
+	}
+	if r := recs[1]; r.Level != "error" || r.Module != "other" || r.Msg != "failed: oops" {
+		t.Error("wrong error record:", r)
+	}
+
+	buf.Reset()
+	SetLogFormat("text")
+	NewLogger("test").Warn("text")
+	if s := buf.String(); !strings.HasSuffix(s, " [WARN] test: text\n") {
+		t.Errorf("wrong text record %q", s)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "ss.log")
+	rf, err := OpenRotatingFile(path, 100, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+	line := []byte(strings.Repeat("x", 59) + "\n")
+	for i := 0; i < 4; i++ {
+		if _, err = rf.Write(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, line) {
+		t.Errorf("current file has %d bytes, want one line", len(b))
+	}
+	names, _ := filepath.Glob(path + ".*")
+	if len(names) != 2 {
+		t.Errorf("got %d rotated files, want 2: %v", len(names), names)
+	}
+}
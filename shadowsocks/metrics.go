@@ -0,0 +1,285 @@
+package shadowsocks
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Relay internals and policy counters are published with expvar, served as
+// JSON by the management API at /debug/vars.
+
+const rateWindow = 60 // seconds
+
+// RateCounter counts events and the average rate per second over the last
+// minute.
+type RateCounter struct {
+	sync.Mutex
+	total   int64
+	buckets [rateWindow]int64
+	stamps  [rateWindow]int64 // second each bucket belongs to
+}
+
+func (rc *RateCounter) Add(delta int64) {
+	now := time.Now().Unix()
+	i := now % rateWindow
+	rc.Lock()
+	if rc.stamps[i] != now {
+		rc.stamps[i], rc.buckets[i] = now, 0
+	}
+	rc.buckets[i] += delta
+	rc.total += delta
+	rc.Unlock()
+}
+
+// Rate returns events per second over the last minute, not counting the
+// current second which is still incomplete.
+func (rc *RateCounter) Rate() float64 {
+	now := time.Now().Unix()
+	var sum int64
+	rc.Lock()
+	for i, stamp := range rc.stamps {
+		if stamp < now && now-stamp <= rateWindow {
+			sum += rc.buckets[i]
+		}
+	}
+	rc.Unlock()
+	return float64(sum) / rateWindow
+}
+
+func (rc *RateCounter) String() string {
+	rc.Lock()
+	total := rc.total
+	rc.Unlock()
+	return fmt.Sprintf(`{"total": %d, "per_sec": %g}`, total, rc.Rate())
+}
+
+func newRateCounter(name string) *RateCounter {
+	rc := new(RateCounter)
+	expvar.Publish(name, rc)
+	return rc
+}
+
+var (
+	natCreated   = newRateCounter("udp_nat_created")
+	natExpired   = newRateCounter("udp_nat_expired")
+	natEvicted   = newRateCounter("udp_nat_evicted")  // closed for new clients by the LRU policy
+	natRejected  = newRateCounter("udp_nat_rejected") // new clients dropped by the reject policy
+	udpDropped   = expvar.NewInt("udp_dropped")       // datagrams not relayed
+	udpOversized = expvar.NewInt("udp_oversized")     // datagrams larger than the max size, dropped
+)
+
+// Stages of connection policy that may reject a connection.
+const (
+	RejectDest      = "dest"      // destination not allowed
+	RejectRateLimit = "ratelimit" // handshake rate exceeded
+	RejectProber    = "prober"    // source flagged as prober
+	RejectReplay    = "replay"    // IV seen before, connection replayed
+	RejectGeoIP     = "geoip"     // destination country not allowed
+	RejectACL       = "acl"       // destination blocked or bypassed by the ACL
+	RejectSource    = "source"    // source over its limits or banned
+	RejectDestPort  = "dest_port" // destination port not allowed by dest_ports
+	RejectMaxConns  = "max_conns" // port has its max_connections open
+)
+
+// PortCounter counts events per port and label, published as
+// {"port": {"label": n}}.
+type PortCounter struct {
+	sync.Mutex
+	m *expvar.Map
+}
+
+func NewPortCounter(name string) *PortCounter {
+	return &PortCounter{m: expvar.NewMap(name)}
+}
+
+func (pc *PortCounter) Add(port, label string) {
+	pc.Lock()
+	m, ok := pc.m.Get(port).(*expvar.Map)
+	if !ok {
+		m = new(expvar.Map).Init()
+		pc.m.Set(port, m)
+	}
+	pc.Unlock()
+	m.Add(label, 1)
+}
+
+// Get returns the counts of port by label, nil if there's none.
+func (pc *PortCounter) Get(port string) map[string]int64 {
+	pc.Lock()
+	m, ok := pc.m.Get(port).(*expvar.Map)
+	pc.Unlock()
+	if !ok {
+		return nil
+	}
+	counts := make(map[string]int64)
+	m.Do(func(kv expvar.KeyValue) {
+		counts[kv.Key] = kv.Value.(*expvar.Int).Value()
+	})
+	return counts
+}
+
+var rejected = NewPortCounter("rejected")
+
+// CountReject records a connection to port rejected by stage.
+func CountReject(port, stage string) {
+	rejected.Add(port, stage)
+}
+
+// GetRejected returns rejected connection counts of port by stage.
+func GetRejected(port string) map[string]int64 {
+	return rejected.Get(port)
+}
+
+// activeConns is the number of open client connections per port.
+var activeConns = expvar.NewMap("conns_active")
+
+// ConnOpened and ConnClosed track the open client connections of port.
+func ConnOpened(port string) {
+	if port != "" {
+		activeConns.Add(port, 1)
+	}
+}
+
+func ConnClosed(port string) {
+	if port != "" {
+		activeConns.Add(port, -1)
+	}
+}
+
+// ActiveConns returns the number of open client connections of port.
+func ActiveConns(port string) int64 {
+	if v, ok := activeConns.Get(port).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+// Classes of relay errors.
+const (
+	ErrDialTimeout = "dial_timeout"
+	ErrRefused     = "refused"
+	ErrReset       = "reset"
+	ErrTimeout     = "timeout"
+	ErrDecrypt     = "decrypt" // invalid request, usually wrong password or method
+	ErrFileLimit   = "emfile"  // process or system open file limit reached
+	ErrOther       = "other"
+)
+
+var relayErrors = NewPortCounter("errors")
+
+// ErrorClass classifies err, returns "" for errors that are part of normal
+// connection teardown (EOF, closed connection).
+func ErrorClass(err error) string {
+	switch {
+	case err == nil || err == io.EOF || errors.Is(err, net.ErrClosed):
+		return ""
+	case errors.Is(err, ErrAuth) || errors.Is(err, errChunkLength):
+		return ErrDecrypt
+	case IsFileLimit(err):
+		return ErrFileLimit
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ErrRefused
+	case errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE):
+		return ErrReset
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		if oe, ok := err.(*net.OpError); ok && oe.Op == "dial" {
+			return ErrDialTimeout
+		}
+		return ErrTimeout
+	}
+	return ErrOther
+}
+
+// CountError records a relay error on port, errors of normal teardown are
+// ignored.
+func CountError(port string, err error) {
+	if class := ErrorClass(err); class != "" && port != "" {
+		relayErrors.Add(port, class)
+	}
+}
+
+// CountErrorClass records an error of the given class on port.
+func CountErrorClass(port, class string) {
+	relayErrors.Add(port, class)
+}
+
+// GetErrors returns relay error counts of port by class.
+func GetErrors(port string) map[string]int64 {
+	return relayErrors.Get(port)
+}
+
+// Reasons relayed connections, and streams of multiplexed ones, are closed
+// for.
+const (
+	CloseClientEOF = "client_eof" // the client ended the connection
+	CloseRemoteEOF = "remote_eof" // the destination ended it
+	CloseTimeout   = "timeout"    // idle for too long or over its lifetime
+	CloseDenied    = "denied"     // destination rejected by the policy, ACL, GeoIP or dest_ports rules
+	CloseDialError = "dial_error" // destination couldn't be connected
+	CloseServer    = "server"     // port closed, removed or over quota, or server shut down
+	CloseError     = "error"      // relay failed
+)
+
+// ConnStats are the counts of the connections of a port closed so far.
+type ConnStats struct {
+	Conns         int64            `json:"conns"`
+	AvgDurationMs int64            `json:"avg_duration_ms"`
+	Reasons       map[string]int64 `json:"reasons"` // by Close* reason
+}
+
+var (
+	connCloses    = NewPortCounter("conn_closes")
+	connDurations = struct {
+		sync.Mutex
+		m map[string]time.Duration // total duration of the connections closed, by port
+	}{m: make(map[string]time.Duration)}
+)
+
+// CountClose records a connection of port closed for reason after d.
+func CountClose(port, reason string, d time.Duration) {
+	if port == "" {
+		return
+	}
+	connDurations.Lock()
+	connDurations.m[port] += d
+	connDurations.Unlock()
+	connCloses.Add(port, reason)
+}
+
+// GetConnStats returns the stats of the connections of port closed so far,
+// nil if there's none.
+func GetConnStats(port string) *ConnStats {
+	reasons := connCloses.Get(port)
+	if reasons == nil {
+		return nil
+	}
+	st := &ConnStats{Reasons: reasons}
+	for _, n := range reasons {
+		st.Conns += n
+	}
+	connDurations.Lock()
+	total := connDurations.m[port]
+	connDurations.Unlock()
+	if st.Conns > 0 {
+		st.AvgDurationMs = int64(total/time.Millisecond) / st.Conns
+	}
+	return st
+}
+
+func init() {
+	expvar.Publish("udp_nat_alive", expvar.Func(func() interface{} {
+		nl.Lock()
+		defer nl.Unlock()
+		return nl.AliveConns
+	}))
+	expvar.Publish("udp_req_cache_size", expvar.Func(func() interface{} {
+		return nl.numReqs()
+	}))
+}
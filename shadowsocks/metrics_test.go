@@ -0,0 +1,92 @@
+package shadowsocks
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRateCounter(t *testing.T) {
+	rc := new(RateCounter)
+	rc.Add(3)
+	rc.Add(2)
+	var v struct {
+		Total  int64   `json:"total"`
+		PerSec float64 `json:"per_sec"`
+	}
+	if err := json.Unmarshal([]byte(rc.String()), &v); err != nil {
+		t.Fatal("counter is not valid JSON:", err)
+	}
+	if v.Total != 5 {
+		t.Errorf("total should be 5, got %d", v.Total)
+	}
+	// events in the current second are not counted in the rate yet
+	if v.PerSec != 0 {
+		t.Errorf("rate should be 0 within the first second, got %g", v.PerSec)
+	}
+}
+
+func TestCountReject(t *testing.T) {
+	if GetRejected("65001") != nil {
+		t.Fatal("port without rejections should return nil")
+	}
+	CountReject("65001", RejectDest)
+	CountReject("65001", RejectDest)
+	CountReject("65001", RejectRateLimit)
+	rej := GetRejected("65001")
+	if rej[RejectDest] != 2 || rej[RejectRateLimit] != 1 {
+		t.Errorf("wrong reject counts: %v", rej)
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestErrorClass(t *testing.T) {
+	opErr := func(op string, err error) error {
+		return &net.OpError{Op: op, Net: "tcp", Err: err}
+	}
+	tests := []struct {
+		err   error
+		class string
+	}{
+		{io.EOF, ""},
+		{opErr("read", net.ErrClosed), ""},
+		{opErr("dial", os.NewSyscallError("connect", syscall.ECONNREFUSED)), ErrRefused},
+		{opErr("read", os.NewSyscallError("read", syscall.ECONNRESET)), ErrReset},
+		{opErr("accept", os.NewSyscallError("accept", syscall.EMFILE)), ErrFileLimit},
+		{opErr("dial", timeoutError{}), ErrDialTimeout},
+		{opErr("read", timeoutError{}), ErrTimeout},
+		{io.ErrUnexpectedEOF, ErrOther},
+	}
+	for _, tt := range tests {
+		if class := ErrorClass(tt.err); class != tt.class {
+			t.Errorf("ErrorClass(%v) = %q, want %q", tt.err, class, tt.class)
+		}
+	}
+}
+
+func TestConnStats(t *testing.T) {
+	const port = "test-conn-stats"
+	if GetConnStats(port) != nil {
+		t.Fatal("stats of a port without connections")
+	}
+	CountClose(port, CloseClientEOF, 100*time.Millisecond)
+	CountClose(port, CloseClientEOF, 300*time.Millisecond)
+	CountClose(port, CloseTimeout, 2*time.Second)
+	CountClose("", CloseError, time.Second)
+	st := GetConnStats(port)
+	if st.Conns != 3 || st.AvgDurationMs != 800 {
+		t.Errorf("%d connections of %dms on average, want 3 of 800ms", st.Conns, st.AvgDurationMs)
+	}
+	if st.Reasons[CloseClientEOF] != 2 || st.Reasons[CloseTimeout] != 1 || len(st.Reasons) != 2 {
+		t.Errorf("close reasons %v", st.Reasons)
+	}
+}
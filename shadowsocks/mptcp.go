@@ -0,0 +1,43 @@
+package shadowsocks
+
+import (
+	"errors"
+	"runtime"
+	"sync/atomic"
+)
+
+// mptcp is set by SetMPTCP, operate by sync/atomic.
+var mptcp int32
+
+// SetMPTCP turns Multipath TCP on or off for the connections to servers made
+// by DialTCP, and the listeners and dialers of the server asking MPTCP, so
+// relays survive clients switching networks. It's only supported on Linux,
+// 5.6 or later with sysctl net.mptcp.enabled=1; connections fall back to TCP
+// when the kernel or the peer doesn't support it.
+func SetMPTCP(on bool) error {
+	if on {
+		if err := CheckMPTCP(); err != nil {
+			return err
+		}
+	}
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&mptcp, v)
+	return nil
+}
+
+// MPTCP reports whether Multipath TCP is turned on by SetMPTCP.
+func MPTCP() bool {
+	return atomic.LoadInt32(&mptcp) == 1
+}
+
+// CheckMPTCP returns an error if Multipath TCP isn't supported on this
+// platform.
+func CheckMPTCP() error {
+	if runtime.GOOS != "linux" {
+		return errors.New("mptcp is only supported on Linux")
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package shadowsocks
+
+import (
+	"context"
+	"io"
+	"testing"
+)
+
+func TestMPTCP(t *testing.T) {
+	if err := CheckMPTCP(); err != nil {
+		t.Skip(err)
+	}
+	if err := SetMPTCP(true); err != nil {
+		t.Fatal(err)
+	}
+	defer SetMPTCP(false)
+	// falls back to TCP if the kernel has no MPTCP
+	ln, err := ListenReusePort("tcp", "127.0.0.1:0", 1, nil)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(c, c)
+		c.Close()
+	}()
+
+	c, err := DialTCP(context.Background(), ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err = c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 5)
+	if _, err = io.ReadFull(c, b); err != nil || string(b) != "hello" {
+		t.Errorf("echoed %q, %v", b, err)
+	}
+}
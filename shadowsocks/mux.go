@@ -0,0 +1,152 @@
+package shadowsocks
+
+import (
+	"net"
+	"sync"
+
+	"github.com/xtaci/smux"
+)
+
+// Multiplexing carries many relays over a few shadowsocks connections, so
+// a client doesn't pay for a handshake and a new IV with each of them. The
+// client connects with MuxHost as destination, then the connection holds
+// xtaci/smux v1 frames, like kcptun streams, and each stream starts with the address of
+// its destination like a connection does.
+
+// MuxHost is the destination of multiplexed connections, which servers
+// only accept with mux enabled.
+const MuxHost = "mux.shadowsocks.invalid"
+
+// MuxSession is a multiplexed connection.
+type MuxSession struct {
+	s *smux.Session
+}
+
+// NewMuxSession multiplexes conn, client is true on the end opening the
+// streams.
+func NewMuxSession(conn net.Conn, client bool) *MuxSession {
+	c := smux.DefaultConfig()
+	c.Version = 1
+	// smux only fails on an invalid config
+	var s *smux.Session
+	if client {
+		s, _ = smux.Client(conn, c)
+	} else {
+		s, _ = smux.Server(conn, c)
+	}
+	return &MuxSession{s}
+}
+
+// Open opens a stream.
+func (m *MuxSession) Open() (net.Conn, error) {
+	st, err := m.s.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// Accept returns the next stream opened by the client.
+func (m *MuxSession) Accept() (net.Conn, error) {
+	st, err := m.s.AcceptStream()
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// Close closes the connection and its streams.
+func (m *MuxSession) Close() error {
+	return m.s.Close()
+}
+
+// Closed reports whether the connection is closed.
+func (m *MuxSession) Closed() bool {
+	return m.s.IsClosed()
+}
+
+// NumStreams returns the number of open streams.
+func (m *MuxSession) NumStreams() int {
+	return m.s.NumStreams()
+}
+
+// MuxDialer opens relays to a server as streams of up to conns
+// connections, made with dial.
+type MuxDialer struct {
+	dial     func() (net.Conn, error)
+	conns    int
+	mu       sync.Mutex
+	sessions []*MuxSession
+}
+
+// NewMuxDialer returns a dialer keeping up to conns connections, dial
+// connects to the server with MuxHost as destination.
+func NewMuxDialer(conns int, dial func() (net.Conn, error)) *MuxDialer {
+	if conns <= 0 {
+		conns = 1
+	}
+	return &MuxDialer{dial: dial, conns: conns}
+}
+
+// session returns the connection with the fewest streams, connecting while
+// there are fewer than conns and each carries a stream.
+func (d *MuxDialer) session() (*MuxSession, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var best *MuxSession
+	least := 0
+	alive := d.sessions[:0]
+	for _, m := range d.sessions {
+		if m.Closed() {
+			continue
+		}
+		alive = append(alive, m)
+		if n := m.NumStreams(); best == nil || n < least {
+			best, least = m, n
+		}
+	}
+	d.sessions = alive
+	if best != nil && (least == 0 || len(d.sessions) >= d.conns) {
+		return best, nil
+	}
+	conn, err := d.dial()
+	if err != nil {
+		if best != nil {
+			return best, nil
+		}
+		return nil, err
+	}
+	m := NewMuxSession(conn, true)
+	d.sessions = append(d.sessions, m)
+	return m, nil
+}
+
+// Dial opens a stream and sends rawaddr, the destination in the form of a
+// SOCKS5 request.
+func (d *MuxDialer) Dial(rawaddr []byte) (net.Conn, error) {
+	m, err := d.session()
+	if err != nil {
+		return nil, err
+	}
+	st, err := m.Open()
+	if err != nil {
+		m.Close()
+		return nil, err
+	}
+	if _, err = st.Write(rawaddr); err != nil {
+		st.Close()
+		return nil, err
+	}
+	return st, nil
+}
+
+// Close closes the connections.
+func (d *MuxDialer) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, m := range d.sessions {
+		m.Close()
+	}
+	d.sessions = nil
+	return nil
+}
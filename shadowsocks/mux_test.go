@@ -0,0 +1,76 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMux(t *testing.T) {
+	var mu sync.Mutex
+	dials := 0
+	var got []string
+	d := NewMuxDialer(2, func() (net.Conn, error) {
+		c, s := net.Pipe()
+		mu.Lock()
+		dials++
+		mu.Unlock()
+		m := NewMuxSession(s, false)
+		go func() {
+			for {
+				st, err := m.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer st.Close()
+					host, port, extra, err := GetRequest(st)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					mu.Lock()
+					got = append(got, net.JoinHostPort(host, port))
+					mu.Unlock()
+					st.Write(extra)
+					io.Copy(st, st)
+				}()
+			}
+		}()
+		return c, nil
+	})
+	defer d.Close()
+
+	rawaddr, _ := RawAddr("example.com:80")
+	payload := bytes.Repeat([]byte(text), 1000)
+	var streams []net.Conn
+	for i := 0; i < 4; i++ {
+		st, err := d.Dial(rawaddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		streams = append(streams, st)
+	}
+	for i, st := range streams {
+		go st.Write(payload)
+		buf := make([]byte, len(payload))
+		st.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(st, buf); err != nil {
+			t.Errorf("stream %d: %v", i, err)
+		} else if !bytes.Equal(buf, payload) {
+			t.Errorf("stream %d: echo differs", i)
+		}
+		st.Close()
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if dials != 2 {
+		t.Errorf("%d connections for 4 streams, want 2", dials)
+	}
+	if len(got) != 4 || got[0] != "example.com:80" {
+		t.Errorf("destinations %v, want 4 of example.com:80", got)
+	}
+}
@@ -0,0 +1,75 @@
+package shadowsocks
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+)
+
+// outbound is the source address and network interface of relayed
+// traffic, set from the outbound_bind and outbound_interface options.
+var outbound = struct {
+	sync.Mutex
+	ip    net.IP
+	iface string
+}{}
+
+// SetOutbound makes relayed connections and UDP NAT sockets use bind as
+// source address and egress through the interface iface, either may be
+// empty. bind must be an address of this host.
+func SetOutbound(bind, iface string) error {
+	var ip net.IP
+	if bind != "" {
+		if ip = net.ParseIP(bind); ip == nil {
+			return fmt.Errorf("outbound_bind %s is not an IP address", bind)
+		}
+		// fail now rather than on each connection if it isn't local
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+		if err != nil {
+			return fmt.Errorf("outbound_bind %s: %v", bind, err)
+		}
+		conn.Close()
+	}
+	if iface != "" {
+		if !bindToDeviceSupported {
+			return fmt.Errorf("outbound_interface is not supported on this platform")
+		}
+		if _, err := net.InterfaceByName(iface); err != nil {
+			return fmt.Errorf("outbound_interface %s: %v", iface, err)
+		}
+	}
+	outbound.Lock()
+	outbound.ip, outbound.iface = ip, iface
+	outbound.Unlock()
+	return nil
+}
+
+// OutboundIP returns the source address of relayed traffic, nil if it's
+// chosen by the system.
+func OutboundIP() net.IP {
+	outbound.Lock()
+	defer outbound.Unlock()
+	return outbound.ip
+}
+
+// OutboundControl binds the socket c to the outbound interface if there's
+// one, it's meant for the Control hook of net.Dialer and net.ListenConfig.
+func OutboundControl(network, address string, c syscall.RawConn) error {
+	outbound.Lock()
+	iface := outbound.iface
+	outbound.Unlock()
+	if iface == "" {
+		return nil
+	}
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		err = bindToDevice(fd, iface)
+	}); cerr != nil {
+		return cerr
+	}
+	if err != nil {
+		return fmt.Errorf("binding to interface %s: %v", iface, err)
+	}
+	return nil
+}
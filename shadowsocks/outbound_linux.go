@@ -0,0 +1,12 @@
+package shadowsocks
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+const bindToDeviceSupported = true
+
+// bindToDevice makes the socket fd send and receive through iface only.
+func bindToDevice(fd uintptr, iface string) error {
+	return unix.SetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE, iface)
+}
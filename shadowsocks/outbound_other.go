@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package shadowsocks
+
+import (
+	"errors"
+)
+
+const bindToDeviceSupported = false
+
+func bindToDevice(fd uintptr, iface string) error {
+	return errors.New("not supported on this platform")
+}
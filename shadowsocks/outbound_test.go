@@ -0,0 +1,24 @@
+package shadowsocks
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSetOutbound(t *testing.T) {
+	defer SetOutbound("", "")
+	for _, bind := range []string{"localhost", "192.0.2.77"} {
+		if err := SetOutbound(bind, ""); err == nil {
+			t.Errorf("outbound_bind %s accepted", bind)
+		}
+	}
+	if err := SetOutbound("", "nonexistent0"); err == nil {
+		t.Error("unknown outbound_interface accepted")
+	}
+	if err := SetOutbound("127.0.0.1", ""); err != nil {
+		t.Fatal(err)
+	}
+	if ip := OutboundIP(); !ip.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("outbound ip %v, want 127.0.0.1", ip)
+	}
+}
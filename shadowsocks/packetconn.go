@@ -0,0 +1,99 @@
+package shadowsocks
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// packetConn relays datagrams through a shadowsocks server, adding and
+// removing the address header of the UDP relay.
+type packetConn struct {
+	conn *UDPConn
+	raw  *net.UDPConn
+}
+
+// ListenPacket returns a net.PacketConn relaying through the server at
+// server: WriteTo sends to any address through the server, ReadFrom returns
+// the datagrams of the destinations with their address. network is udp,
+// udp4 or udp6.
+func ListenPacket(network, server string, cipher *Cipher) (net.PacketConn, error) {
+	saddr, err := net.ResolveUDPAddr(network, server)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := net.DialUDP(network, nil, saddr)
+	if err != nil {
+		return nil, err
+	}
+	return &packetConn{conn: NewUDPConn(raw, cipher), raw: raw}, nil
+}
+
+// udpHeader returns the address header of datagrams to addr, whose host is
+// sent as domain name unless it's an IP address.
+func udpHeader(addr net.Addr) ([]byte, error) {
+	if ua, ok := addr.(*net.UDPAddr); ok {
+		return ParseHeader(ua), nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return ParseHeader(addr), nil
+	}
+	return RawAddr(addr.String())
+}
+
+func (c *packetConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	header, err := udpHeader(addr)
+	if err != nil {
+		return 0, err
+	}
+	if _, err = c.conn.Write(append(header, b...)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// ReadFrom returns the next datagram relayed by the server, skipping the
+// ones it can't decrypt or parse.
+func (c *packetConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := getUDPBuf()
+	defer PutBuf(buf)
+	for {
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) {
+				return 0, nil, err
+			}
+			continue
+		}
+		addr, hl := ParseUDPHeader(buf[:n])
+		if addr == nil {
+			continue
+		}
+		return copy(b, buf[hl:n]), addr, nil
+	}
+}
+
+func (c *packetConn) Close() error {
+	return c.raw.Close()
+}
+
+func (c *packetConn) LocalAddr() net.Addr {
+	return c.raw.LocalAddr()
+}
+
+func (c *packetConn) SetDeadline(t time.Time) error {
+	return c.raw.SetDeadline(t)
+}
+
+func (c *packetConn) SetReadDeadline(t time.Time) error {
+	return c.raw.SetReadDeadline(t)
+}
+
+func (c *packetConn) SetWriteDeadline(t time.Time) error {
+	return c.raw.SetWriteDeadline(t)
+}
@@ -0,0 +1,147 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+type stringAddr string
+
+func (a stringAddr) Network() string { return "udp" }
+func (a stringAddr) String() string  { return string(a) }
+
+func TestPacketConn(t *testing.T) {
+	allowed := UDPDestAllowed
+	UDPDestAllowed = func(domain, ip, port, openvpn string) bool { return true }
+	defer func() { UDPDestAllowed = allowed }()
+
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, addr, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(buf[:n], addr)
+		}
+	}()
+
+	for _, method := range []string{"aes-256-cfb", "chacha20-ietf-poly1305"} {
+		cipher, err := NewCipher(method, "foobar")
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		go HandleUDPConnection(NewUDPConn(srv, cipher.Copy()), "")
+
+		c, err := ListenPacket("udp", srv.LocalAddr().String(), cipher.Copy())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		for _, addr := range []net.Addr{echo.LocalAddr(), stringAddr(echo.LocalAddr().String())} {
+			if _, err = c.WriteTo([]byte(text), addr); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 4096)
+			n, from, err := c.ReadFrom(buf)
+			if err != nil {
+				t.Fatalf("%s: %v", method, err)
+			}
+			if !bytes.Equal(buf[:n], []byte(text)) || from.String() != echo.LocalAddr().String() {
+				t.Errorf("%s: got %q from %v", method, buf[:n], from)
+			}
+		}
+		c.Close()
+		srv.Close()
+	}
+
+	// host names are sent as such for the server to resolve
+	header, err := udpHeader(stringAddr("example.com:53"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, _ := RawAddr("example.com:53"); !bytes.Equal(header, want) {
+		t.Errorf("header %v, want %v", header, want)
+	}
+}
+
+func TestUDPMaxSize(t *testing.T) {
+	allowed := UDPDestAllowed
+	UDPDestAllowed = func(domain, ip, port, openvpn string) bool { return true }
+	defer func() { UDPDestAllowed = allowed }()
+	defer SetUDPMaxSize(0)
+	if err := SetUDPMaxSize(70000); err == nil {
+		t.Error("max size larger than a datagram accepted")
+	}
+
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, addr, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(buf[:n], addr)
+		}
+	}()
+	cipher, err := NewCipher("aes-256-gcm", "foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	go HandleUDPConnection(NewUDPConn(srv, cipher.Copy()), "")
+	c, err := ListenPacket("udp", srv.LocalAddr().String(), cipher.Copy())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// relayed returns whether a datagram of size bytes is echoed
+	relayed := func(size int) bool {
+		msg := bytes.Repeat([]byte{'x'}, size)
+		c.SetDeadline(time.Now().Add(500 * time.Millisecond))
+		if _, err := c.WriteTo(msg, echo.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 65536)
+		n, _, err := c.ReadFrom(buf)
+		return err == nil && bytes.Equal(buf[:n], msg)
+	}
+	// fragmented by IP, larger than the buffers of the TCP relay
+	if !relayed(60000) {
+		t.Error("60000 byte datagram not relayed")
+	}
+	SetUDPMaxSize(1000)
+	// the pending read of the server still has a buffer of the old size
+	relayed(10)
+	oversized := udpOversized.Value()
+	if relayed(2000) {
+		t.Error("datagram larger than the max size relayed")
+	}
+	if udpOversized.Value() == oversized {
+		t.Error("oversized datagram not counted")
+	}
+	if !relayed(500) {
+		t.Error("datagram under the max size not relayed")
+	}
+}
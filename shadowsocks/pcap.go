@@ -0,0 +1,247 @@
+package shadowsocks
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Decrypted traffic capture for debugging. Plaintext relayed between client
+// and destination is written to a pcap file with synthetic IP/TCP headers, so
+// it can be inspected with wireshark. This exposes user traffic, so it's only
+// enabled explicitly and stops automatically after a limited time.
+
+const (
+	pcapLinkTypeRaw = 101   // LINKTYPE_RAW, packets begin with IPv4/IPv6 header
+	pcapMaxPayload  = 65000 // keep IP total length within 16 bits
+)
+
+// CaptureFilter selects sessions to capture, empty fields match everything.
+type CaptureFilter struct {
+	Port   string // server port
+	Client string // client IP
+	Dest   string // destination host or host:port
+}
+
+// ParseCaptureFilter parses filters like "port=8388,client=1.2.3.4,dest=example.com:443".
+func ParseCaptureFilter(s string) (f CaptureFilter, err error) {
+	if s == "" {
+		return
+	}
+	for _, kv := range strings.Split(s, ",") {
+		i := strings.Index(kv, "=")
+		if i < 0 {
+			return f, errors.New("capture filter: expect key=value, got " + kv)
+		}
+		k, v := strings.TrimSpace(kv[:i]), strings.TrimSpace(kv[i+1:])
+		switch k {
+		case "port":
+			f.Port = v
+		case "client":
+			f.Client = v
+		case "dest":
+			f.Dest = v
+		default:
+			return f, errors.New("capture filter: unknown key " + k)
+		}
+	}
+	return
+}
+
+func (f CaptureFilter) Match(port, client, dest string) bool {
+	if f.Port != "" && f.Port != port {
+		return false
+	}
+	if f.Client != "" && f.Client != client {
+		return false
+	}
+	if f.Dest != "" && f.Dest != dest {
+		if host, _, err := net.SplitHostPort(dest); err != nil || host != f.Dest {
+			return false
+		}
+	}
+	return true
+}
+
+// Capture writes matched sessions to a pcap file until it expires.
+type Capture struct {
+	sync.Mutex
+	Filter CaptureFilter
+	f      *os.File
+	w      *bufio.Writer
+	timer  *time.Timer
+}
+
+// OpenCapture creates the pcap file at path, capture stops after d.
+func OpenCapture(path string, filter CaptureFilter, d time.Duration) (*Capture, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	c := &Capture{Filter: filter, f: f, w: bufio.NewWriter(f)}
+	var hdr [24]byte
+	binary.LittleEndian.PutUint32(hdr[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(hdr[4:], 2) // version 2.4
+	binary.LittleEndian.PutUint16(hdr[6:], 4)
+	binary.LittleEndian.PutUint32(hdr[16:], 65535) // snaplen
+	binary.LittleEndian.PutUint32(hdr[20:], pcapLinkTypeRaw)
+	if _, err = c.w.Write(hdr[:]); err != nil {
+		f.Close()
+		return nil, err
+	}
+	c.timer = time.AfterFunc(d, func() {
+		logger.Debug("decrypted traffic capture expired")
+		c.Close()
+	})
+	return c, nil
+}
+
+// Active reports whether the capture is still running.
+func (c *Capture) Active() bool {
+	if c == nil {
+		return false
+	}
+	c.Lock()
+	defer c.Unlock()
+	return c.w != nil
+}
+
+func (c *Capture) Close() error {
+	c.Lock()
+	defer c.Unlock()
+	if c.w == nil {
+		return nil
+	}
+	c.timer.Stop()
+	c.w.Flush()
+	c.w = nil
+	return c.f.Close()
+}
+
+func (c *Capture) writePacket(pkt []byte) {
+	c.Lock()
+	defer c.Unlock()
+	if c.w == nil {
+		return
+	}
+	now := time.Now()
+	var hdr [16]byte
+	binary.LittleEndian.PutUint32(hdr[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(hdr[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(hdr[8:], uint32(len(pkt)))
+	binary.LittleEndian.PutUint32(hdr[12:], uint32(len(pkt)))
+	c.w.Write(hdr[:])
+	c.w.Write(pkt)
+	c.w.Flush()
+}
+
+// CaptureFlow is one captured TCP session.
+type CaptureFlow struct {
+	sync.Mutex   // protects sequence numbers
+	c            *Capture
+	client, dest *net.TCPAddr
+	clientSeq    uint32
+	destSeq      uint32
+}
+
+func (c *Capture) NewFlow(client, dest *net.TCPAddr) *CaptureFlow {
+	return &CaptureFlow{c: c, client: client, dest: dest, clientSeq: 1, destSeq: 1}
+}
+
+func ipChecksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// Record writes data sent by the client (fromClient) or the destination.
+func (fl *CaptureFlow) Record(fromClient bool, data []byte) {
+	for len(data) > 0 {
+		n := len(data)
+		if n > pcapMaxPayload {
+			n = pcapMaxPayload
+		}
+		fl.record(fromClient, data[:n])
+		data = data[n:]
+	}
+}
+
+func (fl *CaptureFlow) record(fromClient bool, data []byte) {
+	src, dst := fl.client, fl.dest
+	if !fromClient {
+		src, dst = dst, src
+	}
+	fl.Lock()
+	seq, ack := &fl.clientSeq, fl.destSeq
+	if !fromClient {
+		seq, ack = &fl.destSeq, fl.clientSeq
+	}
+	s := *seq
+	*seq += uint32(len(data))
+	fl.Unlock()
+
+	tcp := make([]byte, 20, 20+len(data))
+	binary.BigEndian.PutUint16(tcp[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(tcp[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint32(tcp[4:], s)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = 5 << 4 // data offset
+	tcp[13] = 0x18   // PSH, ACK
+	binary.BigEndian.PutUint16(tcp[14:], 65535)
+	tcp = append(tcp, data...)
+
+	var ip []byte
+	src4, dst4 := src.IP.To4(), dst.IP.To4()
+	if src4 != nil && dst4 != nil {
+		ip = make([]byte, 20, 20+len(tcp))
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(tcp)))
+		ip[8] = 64 // ttl
+		ip[9] = 6  // tcp
+		copy(ip[12:], src4)
+		copy(ip[16:], dst4)
+		binary.BigEndian.PutUint16(ip[10:], ipChecksum(ip))
+	} else {
+		ip = make([]byte, 40, 40+len(tcp))
+		ip[0] = 0x60
+		binary.BigEndian.PutUint16(ip[4:], uint16(len(tcp)))
+		ip[6] = 6
+		ip[7] = 64
+		copy(ip[8:], src.IP.To16())
+		copy(ip[24:], dst.IP.To16())
+	}
+	fl.c.writePacket(append(ip, tcp...))
+}
+
+// CaptureConn records data read from the wrapped connection to a flow.
+type CaptureConn struct {
+	net.Conn
+	flow       *CaptureFlow
+	fromClient bool
+}
+
+func NewCaptureConn(c net.Conn, flow *CaptureFlow, fromClient bool) *CaptureConn {
+	return &CaptureConn{c, flow, fromClient}
+}
+
+func (c *CaptureConn) CloseWrite() error {
+	return CloseWrite(c.Conn)
+}
+
+func (c *CaptureConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	if n > 0 {
+		c.flow.Record(c.fromClient, b[:n])
+	}
+	return
+}
@@ -0,0 +1,62 @@
+package shadowsocks
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCaptureFilter(t *testing.T) {
+	f, err := ParseCaptureFilter("port=8388, dest=example.com")
+	if err != nil {
+		t.Fatal("error parsing capture filter:", err)
+	}
+	if !f.Match("8388", "1.2.3.4", "example.com:443") {
+		t.Error("destination host should match host:port")
+	}
+	if f.Match("8389", "1.2.3.4", "example.com:443") {
+		t.Error("different port should not match")
+	}
+	if f.Match("8388", "1.2.3.4", "example.org:443") {
+		t.Error("different destination should not match")
+	}
+	if _, err = ParseCaptureFilter("user=foo"); err == nil {
+		t.Error("unknown filter key should be an error")
+	}
+}
+
+func TestCaptureFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sscapture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.pcap")
+
+	c, err := OpenCapture(path, CaptureFilter{}, time.Minute)
+	if err != nil {
+		t.Fatal("error creating capture:", err)
+	}
+	client := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}
+	dest := &net.TCPAddr{IP: net.ParseIP("93.184.216.34"), Port: 80}
+	fl := c.NewFlow(client, dest)
+	fl.Record(true, []byte("GET / HTTP/1.0\r\n\r\n"))
+	fl.Record(false, []byte("HTTP/1.0 200 OK\r\n\r\n"))
+	c.Close()
+	if c.Active() {
+		t.Error("capture should not be active after close")
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// global header + 2 * (record header + ipv4 + tcp + payload)
+	want := 24 + 2*(16+20+20) + 18 + 19
+	if len(data) != want {
+		t.Errorf("pcap file size %d, want %d", len(data), want)
+	}
+}
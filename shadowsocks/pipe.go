@@ -1,10 +1,9 @@
 package shadowsocks
 
 import (
-
-	// "io"
+	"errors"
+	"io"
 	"net"
-	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -14,9 +13,10 @@ const (
 	SET_TIMEOUT
 )
 
-var pool = &sync.Pool{New: func() interface{} {
-	return make([]byte, 4096)
-}}
+// halfClosedIdle bounds the idle time of the direction of a relay left when
+// the other ended, if it has no idle timeout, so a peer which never closes
+// doesn't hold the relay forever.
+const halfClosedIdle = time.Minute
 
 func SetReadTimeout(c net.Conn) {
 	if readTimeout != 0 {
@@ -24,45 +24,147 @@ func SetReadTimeout(c net.Conn) {
 	}
 }
 
-// PipeThenClose copies data from src to dst, closes dst when done.
-func PipeThenClose(src, dst net.Conn, timeoutOpt int, pflag *uint32, port, dir string) {
+// PipeThenClose copies data from src to dst, closes dst when done. The data
+// is throttled to the rate of all limits. Between plain TCP connections the
+// data is spliced in the kernel where supported, see newRelay. It returns
+// the bytes copied and the error that ended the copy, io.EOF at the end of
+// src, nil if the port was closed. Closing dst ends both directions of a
+// connection, connections are relayed both ways by Relay, which passes on
+// half closes.
+func PipeThenClose(src, dst net.Conn, timeoutOpt int, pflag *uint32, port, dir string, limits ...*Bandwidth) (copied int64, err error) {
 	defer dst.Close()
-	buf := pool.Get().([]byte)
-	defer pool.Put(buf)
+	var idle time.Duration
+	if timeoutOpt == SET_TIMEOUT {
+		idle = readTimeout
+	}
+	return pipe(src, dst, idle, time.Time{}, nil, pflag, port, dir, limits)
+}
+
+// RelayOptions bound the relays of Relay, zero values don't.
+type RelayOptions struct {
+	ClientIdle time.Duration // reads from the client may idle this long
+	RemoteIdle time.Duration // reads from the remote may idle this long
+	Lifetime   time.Duration // the relay ends after this long
+	Flag       *uint32       // the relay ends when it's set, like pflag of PipeThenClose
+	Port       string        // the port whose traffic is counted, if any
+	Limits     []*Bandwidth  // rates the data is throttled to
+}
+
+// Relay copies data between client and remote both ways, like two
+// PipeThenClose, but when a side ends its data, the writing side of the
+// other is closed (CloseWrite) and the other direction goes on, its idle
+// time bounded by halfClosedIdle if o doesn't bound it. Both are closed
+// when both directions ended, or one failed, or the other side can't be
+// half closed. It returns the bytes relayed from the client (up) and from
+// the remote (down), and the errors which ended each direction.
+func Relay(client, remote net.Conn, o RelayOptions) (up, down int64, upErr, downErr error) {
+	defer client.Close()
+	defer remote.Close()
+	var deadline time.Time
+	if o.Lifetime > 0 {
+		deadline = time.Now().Add(o.Lifetime)
+		client.SetWriteDeadline(deadline)
+		remote.SetWriteDeadline(deadline)
+	}
+	var halfClosed int32
+	// end is called when the direction to dst ends with err, the direction
+	// left has idle time idle.
+	end := func(dst net.Conn, err error, idle time.Duration) {
+		if !atomic.CompareAndSwapInt32(&halfClosed, 0, 1) {
+			return
+		}
+		if err == io.EOF && CloseWrite(dst) == nil {
+			if idle == 0 {
+				// wake the read of the direction left, to take the bound
+				dst.SetReadDeadline(readDeadline(halfClosedIdle, deadline))
+			}
+			return
+		}
+		client.Close()
+		remote.Close()
+	}
+	upDone := make(chan struct{})
+	go func() {
+		up, upErr = pipe(client, remote, o.ClientIdle, deadline, &halfClosed, o.Flag, o.Port, "out", o.Limits)
+		end(remote, upErr, o.RemoteIdle)
+		close(upDone)
+	}()
+	down, downErr = pipe(remote, client, o.RemoteIdle, deadline, &halfClosed, o.Flag, o.Port, "in", o.Limits)
+	end(client, downErr, o.ClientIdle)
+	<-upDone
+	return
+}
+
+// CloseWrite closes the writing side of c, sending a FIN on TCP, if it has
+// a CloseWrite method. Connections wrapping another pass it on by theirs,
+// it returns errors.ErrUnsupported for the others.
+func CloseWrite(c net.Conn) error {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+// readDeadline returns the deadline of a read which may idle for idle,
+// before deadline if it isn't zero.
+func readDeadline(idle time.Duration, deadline time.Time) time.Time {
+	t := deadline
+	if idle > 0 {
+		if d := time.Now().Add(idle); t.IsZero() || d.Before(t) {
+			t = d
+		}
+	}
+	return t
+}
+
+// pipe copies src to dst until the end of src, the reads of src may idle
+// for idle, or halfClosedIdle once halfClosed is set if idle is 0, and
+// don't go past deadline if it isn't zero.
+func pipe(src, dst net.Conn, idle time.Duration, deadline time.Time, halfClosed *int32, pflag *uint32, port, dir string, limits []*Bandwidth) (copied int64, err error) {
+	r := newRelay(src, dst)
+	defer r.release()
+	wait := func(n int) {
+		for _, l := range limits {
+			l.Wait(n)
+		}
+	}
 	for {
 		if pflag != nil && atomic.LoadUint32(pflag) > 0 {
 			break
 		}
-		if timeoutOpt == SET_TIMEOUT {
-			SetReadTimeout(src)
+		d := idle
+		if d == 0 && halfClosed != nil && atomic.LoadInt32(halfClosed) == 1 {
+			d = halfClosedIdle
 		}
-		n, err := src.Read(buf)
-		// read may return EOF with n > 0
-		// should always process n > 0 bytes before handling error
-		if n > 0 {
-			_, err := dst.Write(buf[0:n])
-			if port != "" {
-				var ip string
-				if dir == "out" {
-					ip = src.RemoteAddr().(*net.TCPAddr).IP.String()
-				}
-				upTraffic(port, n, ip)
-			}
-			if err != nil {
-				Debug.Println("write:", err)
-				break
+		if d > 0 || !deadline.IsZero() {
+			src.SetReadDeadline(readDeadline(d, deadline))
+		}
+		var n int
+		n, err = r.copyChunk(wait)
+		copied += int64(n)
+		if n > 0 && port != "" {
+			var ip string
+			if dir == "out" {
+				ip = HostOf(src.RemoteAddr())
 			}
+			upTraffic(port, n, ip)
 		}
 		if err != nil {
+			if werr, ok := err.(*writeError); ok {
+				logger.Debug("write:", werr.err)
+				err = werr.err
+			}
 			// Always "use of closed network connection", but no easy way to
 			// identify this specific error. So just leave the error along for now.
 			// More info here: https://code.google.com/p/go/issues/detail?id=4373
 			/*
 				if err != io.EOF {
-					Debug.Println("read:", err)
+					logger.Debug("read:", err)
 				}
 			*/
-			break
+			CountError(port, err)
+			return
 		}
 	}
+	return
 }
@@ -0,0 +1,218 @@
+package shadowsocks
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	probeWindow    = 10 * time.Minute // failures older than this are forgotten
+	probeThreshold = 3                // failures within window to flag a source
+	probeFlagTime  = time.Hour        // how long a source stays flagged
+	probeSweep     = time.Minute      // expired sources are removed at most this often
+	probeMaxSrcs   = 1 << 16          // sources tracked at most
+
+	tarpitInterval = 10 * time.Second // read one byte per interval
+	tarpitMaxTime  = 10 * time.Minute
+	tarpitMaxConns = 256
+)
+
+type probeRecord struct {
+	failures int
+	first    time.Time
+	flagged  time.Time
+}
+
+// expired reports whether r is neither counting failures nor flagged.
+func (r *probeRecord) expired(now time.Time) bool {
+	return now.Sub(r.first) > probeWindow && now.Sub(r.flagged) >= probeFlagTime
+}
+
+// ProbeTracker counts failed handshakes per source IP and flags sources that
+// fail repeatedly as probers. Expired sources are swept on failures, and at
+// most max sources are tracked, so a scan from many addresses can't grow it
+// without bound.
+type ProbeTracker struct {
+	sync.Mutex
+	m     map[string]*probeRecord
+	max   int
+	swept time.Time
+}
+
+func NewProbeTracker() *ProbeTracker {
+	return &ProbeTracker{m: make(map[string]*probeRecord), max: probeMaxSrcs, swept: time.Now()}
+}
+
+// sweep removes the expired sources.
+func (pt *ProbeTracker) sweep(now time.Time) {
+	for ip, r := range pt.m {
+		if r.expired(now) {
+			delete(pt.m, ip)
+		}
+	}
+	pt.swept = now
+}
+
+// makeRoom makes room for a new source when max are tracked: the expired
+// ones are removed, else one that isn't flagged. It returns false if every
+// source is flagged, the new one isn't tracked then.
+func (pt *ProbeTracker) makeRoom(now time.Time) bool {
+	if len(pt.m) < pt.max {
+		return true
+	}
+	pt.sweep(now)
+	if len(pt.m) < pt.max {
+		return true
+	}
+	for ip, r := range pt.m {
+		if now.Sub(r.flagged) >= probeFlagTime {
+			delete(pt.m, ip)
+			return true
+		}
+	}
+	return false
+}
+
+// Fail records a failed handshake from ip, returns true if the source is
+// flagged as prober after this failure.
+func (pt *ProbeTracker) Fail(ip string) bool {
+	now := time.Now()
+	pt.Lock()
+	defer pt.Unlock()
+
+	if now.Sub(pt.swept) >= probeSweep {
+		pt.sweep(now)
+	}
+	r, ok := pt.m[ip]
+	if !ok || now.Sub(r.first) > probeWindow {
+		if ok && now.Sub(r.flagged) < probeFlagTime {
+			// keep the flag, only restart counting
+			r.failures, r.first = 0, now
+		} else {
+			if !ok && !pt.makeRoom(now) {
+				return false
+			}
+			r = &probeRecord{first: now}
+			pt.m[ip] = r
+		}
+	}
+	r.failures++
+	if r.failures >= probeThreshold {
+		r.flagged = now
+	}
+	return now.Sub(r.flagged) < probeFlagTime
+}
+
+// Flagged reports whether ip is currently flagged as prober.
+func (pt *ProbeTracker) Flagged(ip string) bool {
+	now := time.Now()
+	pt.Lock()
+	defer pt.Unlock()
+
+	r, ok := pt.m[ip]
+	if !ok {
+		return false
+	}
+	if now.Sub(r.flagged) < probeFlagTime {
+		return true
+	}
+	if r.expired(now) {
+		delete(pt.m, ip)
+	}
+	return false
+}
+
+var tarpitCnt int32
+
+// Tarpit holds conn open and trickle-reads it at a tiny rate until the peer
+// gives up or tarpitMaxTime passes, then closes it. If too many connections
+// are already held, conn is closed immediately.
+func Tarpit(conn net.Conn) {
+	defer conn.Close()
+	if atomic.AddInt32(&tarpitCnt, 1) > tarpitMaxConns {
+		atomic.AddInt32(&tarpitCnt, -1)
+		return
+	}
+	defer atomic.AddInt32(&tarpitCnt, -1)
+
+	logger.Debugf("tarpit %s->%s", conn.RemoteAddr(), conn.LocalAddr())
+	deadline := time.Now().Add(tarpitMaxTime)
+	conn.SetReadDeadline(deadline)
+	b := make([]byte, 1)
+	for time.Now().Before(deadline) {
+		if _, err := conn.Read(b); err != nil {
+			return
+		}
+		time.Sleep(tarpitInterval)
+	}
+}
+
+// at most this many raw bytes of a handshake are kept for the fallback
+const fallbackMaxBytes = 64 * 1024
+
+// FallbackConn keeps the raw bytes read during the handshake, so a
+// connection failing it can be handed to a decoy server as if it had been
+// connected to the decoy from the start, instead of being closed, which
+// fingerprints the server.
+type FallbackConn struct {
+	net.Conn
+	buf      []byte
+	overflow bool // more than fallbackMaxBytes read, or recording stopped
+}
+
+func NewFallbackConn(c net.Conn) *FallbackConn {
+	return &FallbackConn{Conn: c}
+}
+
+func (c *FallbackConn) CloseWrite() error {
+	return CloseWrite(c.Conn)
+}
+
+func (c *FallbackConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	if !c.overflow && n > 0 {
+		if len(c.buf)+n > fallbackMaxBytes {
+			c.overflow, c.buf = true, nil
+		} else {
+			c.buf = append(c.buf, b[:n]...)
+		}
+	}
+	return
+}
+
+// Done stops recording after a successful handshake.
+func (c *FallbackConn) Done() {
+	c.overflow, c.buf = true, nil
+}
+
+// Fallback handles the connection after a failed handshake and closes it.
+// If addr is "discard" the data sent by the peer is read and discarded until
+// it's idle for the read timeout, otherwise the connection is relayed to the
+// decoy server at addr, starting with the bytes of the handshake. Without
+// them, if too much was read, the data is discarded too.
+func (c *FallbackConn) Fallback(addr string) {
+	defer c.Close()
+	head, overflow := c.buf, c.overflow
+	c.Done()
+	if addr != "discard" && !overflow {
+		decoy, err := net.DialTimeout("tcp", addr, 5*time.Second)
+		if err == nil {
+			logger.Debugf("fallback %s to %s", c.RemoteAddr(), addr)
+			if _, err = decoy.Write(head); err == nil {
+				Relay(c.Conn, decoy, RelayOptions{ClientIdle: readTimeout})
+				return
+			}
+			decoy.Close()
+		}
+		logger.Debug("fallback:", err)
+	}
+	b := make([]byte, 4096)
+	for {
+		SetReadTimeout(c.Conn)
+		if _, err := c.Conn.Read(b); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFallback(t *testing.T) {
+	// the decoy answers with what it got
+	decoy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decoy.Close()
+	go func() {
+		c, err := decoy.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		b := make([]byte, 100)
+		n, _ := io.ReadFull(c, b)
+		c.Write(b[:n])
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a probe the server can't make sense of
+	probe := bytes.Repeat([]byte{0xff}, 100)
+	client.Write(probe)
+	cipher, err := NewCipher("aes-128-gcm", "foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc := NewFallbackConn(conn)
+	if _, _, _, err = GetRequest(NewConn(fc, cipher)); err == nil {
+		t.Fatal("probe should fail the handshake")
+	}
+	go fc.Fallback(decoy.Addr().String())
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	got := make([]byte, len(probe))
+	if _, err = io.ReadFull(client, got); err != nil {
+		t.Fatal("no reply from decoy:", err)
+	}
+	if !bytes.Equal(got, probe) {
+		t.Error("decoy didn't get the probe data")
+	}
+}
+
+func TestProbeTrackerBounded(t *testing.T) {
+	pt := NewProbeTracker()
+	pt.max = 3
+	for i := 0; i < probeThreshold; i++ {
+		pt.Fail("10.0.0.1")
+	}
+	pt.Fail("10.0.0.2")
+	pt.Fail("10.0.0.3")
+
+	// full: a source that isn't flagged makes room for the new one
+	pt.Fail("10.0.0.4")
+	if len(pt.m) != 3 {
+		t.Fatalf("%d sources tracked, want 3", len(pt.m))
+	}
+	if !pt.Flagged("10.0.0.1") {
+		t.Error("flagged source evicted")
+	}
+	if _, ok := pt.m["10.0.0.4"]; !ok {
+		t.Error("new source not tracked")
+	}
+
+	// expired sources are swept on the next failure
+	old := time.Now().Add(-probeFlagTime - time.Second)
+	for _, r := range pt.m {
+		r.first, r.flagged = old, old
+	}
+	pt.swept = old
+	pt.Fail("10.0.0.5")
+	if len(pt.m) != 1 {
+		t.Errorf("%d sources tracked after the sweep, want 1", len(pt.m))
+	}
+
+	// every source flagged: new ones aren't tracked
+	pt = NewProbeTracker()
+	pt.max = 1
+	for i := 0; i < probeThreshold; i++ {
+		pt.Fail("10.0.0.1")
+	}
+	if pt.Fail("10.0.0.2") || len(pt.m) != 1 || !pt.Flagged("10.0.0.1") {
+		t.Error("flagged source replaced by a new one")
+	}
+}
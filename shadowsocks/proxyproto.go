@@ -0,0 +1,267 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyHeaderTimeout bounds the time trusted proxies take to send the PROXY
+// protocol header of a connection.
+const proxyHeaderTimeout = 10 * time.Second
+
+// proxyV1Max is the longest PROXY protocol v1 header.
+const proxyV1Max = 107
+
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyConn is a connection relayed by a proxy, from the client of its
+// PROXY protocol header.
+type proxyConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// NetConn returns the connection from the proxy.
+func (c *proxyConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// CloseWrite closes the sending side of the connection to the proxy.
+func (c *proxyConn) CloseWrite() error {
+	return CloseWrite(c.Conn)
+}
+
+// ReadProxyHeader reads the PROXY protocol header, version 1 or 2, at the
+// start of conn, and returns conn with the client address of the header as
+// remote address. Headers without address, LOCAL health checks of version 2
+// or UNKNOWN of version 1, keep the address of conn.
+func ReadProxyHeader(conn net.Conn) (net.Conn, error) {
+	start := make([]byte, len(proxyV2Sig))
+	if _, err := io.ReadFull(conn, start); err != nil {
+		return nil, err
+	}
+	var addr net.Addr
+	var err error
+	switch {
+	case bytes.Equal(start, proxyV2Sig):
+		addr, err = readProxyV2(conn)
+	case bytes.HasPrefix(start, []byte("PROXY ")):
+		addr, err = readProxyV1(conn, start)
+	default:
+		return nil, errors.New("no PROXY protocol header")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if addr == nil {
+		return conn, nil
+	}
+	return &proxyConn{Conn: conn, remote: addr}, nil
+}
+
+// readProxyV1 reads the rest of a text header, start being its first bytes.
+// It's read a byte at a time, not to read past it.
+func readProxyV1(conn net.Conn, start []byte) (net.Addr, error) {
+	line := append(make([]byte, 0, proxyV1Max), start...)
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == proxyV1Max {
+			return nil, errors.New("PROXY protocol v1 header too long")
+		}
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return nil, err
+		}
+		line = append(line, b[0])
+	}
+	f := strings.Fields(string(line))
+	if len(f) >= 2 && f[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(f) != 6 || (f[1] != "TCP4" && f[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid PROXY protocol v1 header %q", bytes.TrimSpace(line))
+	}
+	ip := net.ParseIP(f[2])
+	port, err := strconv.Atoi(f[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 || (ip.To4() != nil) != (f[1] == "TCP4") {
+		return nil, fmt.Errorf("invalid PROXY protocol v1 header %q", bytes.TrimSpace(line))
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// readProxyV2 reads the rest of a binary header, after its signature.
+func readProxyV2(conn net.Conn) (net.Addr, error) {
+	hdr := make([]byte, 4)
+	if _, err := io.ReadFull(conn, hdr); err != nil {
+		return nil, err
+	}
+	if hdr[0]>>4 != 2 {
+		return nil, fmt.Errorf("PROXY protocol version %d", hdr[0]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[2:]))
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return nil, err
+	}
+	switch hdr[0] & 0xf {
+	case 0: // LOCAL
+		return nil, nil
+	case 1: // PROXY
+	default:
+		return nil, fmt.Errorf("invalid PROXY protocol v2 command %d", hdr[0]&0xf)
+	}
+	// the addresses are followed by TLVs, which aren't used
+	switch hdr[1] >> 4 {
+	case 1: // AF_INET
+		if len(body) < 12 {
+			return nil, errors.New("PROXY protocol v2 header too short")
+		}
+		return &net.TCPAddr{IP: net.IP(body[:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+	case 2: // AF_INET6
+		if len(body) < 36 {
+			return nil, errors.New("PROXY protocol v2 header too short")
+		}
+		return &net.TCPAddr{IP: net.IP(body[:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+	}
+	// AF_UNSPEC and unix sockets
+	return nil, nil
+}
+
+type proxyListener struct {
+	net.Listener
+	trusted ipRanges
+	unix    bool
+	conns   chan net.Conn
+	err     error // of the accept loop, set before done is closed
+	done    chan struct{}
+	once    sync.Once
+}
+
+// NewProxyListener returns a listener accepting from ln, whose connections
+// from the proxies in trusted, addresses or CIDRs, or "unix" for those on
+// unix sockets, start with a PROXY protocol header, as sent by HAProxy,
+// nginx or load balancers. They are returned with the client address of the
+// header as remote address, connections from others are returned as is.
+// Trusted connections without valid header are dropped.
+func NewProxyListener(ln net.Listener, trusted []string) (net.Listener, error) {
+	l := &proxyListener{Listener: ln, conns: make(chan net.Conn), done: make(chan struct{})}
+	var nets []*net.IPNet
+	for _, s := range trusted {
+		if s == "unix" {
+			l.unix = true
+			continue
+		}
+		ipnet := parseCIDR(s)
+		if ipnet == nil {
+			return nil, fmt.Errorf("invalid address %q of PROXY protocol proxy", s)
+		}
+		nets = append(nets, ipnet)
+	}
+	l.trusted = mergeRanges(nets)
+	go l.acceptLoop()
+	return l, nil
+}
+
+// CheckProxyTrusted checks the trusted proxies of NewProxyListener.
+func CheckProxyTrusted(trusted []string) error {
+	for _, s := range trusted {
+		if s != "unix" && parseCIDR(s) == nil {
+			return fmt.Errorf("invalid address %q of PROXY protocol proxy", s)
+		}
+	}
+	return nil
+}
+
+func (l *proxyListener) isTrusted(addr net.Addr) bool {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return l.trusted.contains(a.IP)
+	case *net.UnixAddr:
+		return l.unix
+	}
+	return false
+}
+
+func (l *proxyListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if IsFileLimit(err) {
+			time.Sleep(FileLimitReached())
+			continue
+		}
+		if err != nil {
+			l.close(err)
+			return
+		}
+		if !l.isTrusted(conn.RemoteAddr()) {
+			l.queue(conn)
+			continue
+		}
+		// a slow proxy doesn't hold the others
+		go l.readHeader(conn)
+	}
+}
+
+func (l *proxyListener) readHeader(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	c, err := ReadProxyHeader(conn)
+	if err != nil {
+		logger.Debugf("PROXY protocol header from %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	l.queue(c)
+}
+
+func (l *proxyListener) queue(c net.Conn) {
+	select {
+	case l.conns <- c:
+	case <-l.done:
+		c.Close()
+	}
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		if l.err != nil {
+			return nil, l.err
+		}
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *proxyListener) Close() error {
+	return l.close(nil)
+}
+
+func (l *proxyListener) close(failed error) (err error) {
+	l.once.Do(func() {
+		l.err = failed
+		close(l.done)
+		err = l.Listener.Close()
+	})
+	return
+}
+
+// File returns the socket of the listener, to pass it to a new server.
+func (l *proxyListener) File() (*os.File, error) {
+	if fl, ok := l.Listener.(interface{ File() (*os.File, error) }); ok {
+		return fl.File()
+	}
+	return nil, errors.New("listener has no socket")
+}
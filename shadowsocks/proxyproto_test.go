@@ -0,0 +1,123 @@
+package shadowsocks
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func proxyV2Header(cmd, fam byte, addrs []byte) []byte {
+	h := append(append([]byte{}, proxyV2Sig...), 0x20|cmd, fam, 0, 0)
+	binary.BigEndian.PutUint16(h[14:], uint16(len(addrs)))
+	return append(h, addrs...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v4 := []byte{203, 0, 113, 7, 10, 0, 0, 1, 0x30, 0x39, 0x20, 0xc4}
+	v6 := make([]byte, 36)
+	copy(v6, net.ParseIP("2001:db8::7"))
+	binary.BigEndian.PutUint16(v6[32:], 443)
+	tests := []struct {
+		header string
+		want   string // remote address, "" for the one of the connection
+	}{
+		{"PROXY TCP4 203.0.113.7 10.0.0.1 12345 8388\r\n", "203.0.113.7:12345"},
+		{"PROXY TCP6 2001:db8::7 2001:db8::1 443 8388\r\n", "[2001:db8::7]:443"},
+		{"PROXY UNKNOWN\r\n", ""},
+		{string(proxyV2Header(1, 0x11, v4)), "203.0.113.7:12345"},
+		// TLVs after the addresses
+		{string(proxyV2Header(1, 0x11, append(v4, 4, 0, 1, 0))), "203.0.113.7:12345"},
+		{string(proxyV2Header(1, 0x21, v6)), "[2001:db8::7]:443"},
+		{string(proxyV2Header(0, 0, nil)), ""},
+	}
+	for _, tt := range tests {
+		client, server := net.Pipe()
+		go func() {
+			client.Write([]byte(tt.header + "payload"))
+			client.Close()
+		}()
+		c, err := ReadProxyHeader(server)
+		if err != nil {
+			t.Errorf("%q: %v", tt.header, err)
+			continue
+		}
+		want := tt.want
+		if want == "" {
+			want = server.RemoteAddr().String()
+		}
+		if got := c.RemoteAddr().String(); got != want {
+			t.Errorf("%q: remote address %s, want %s", tt.header, got, want)
+		}
+		rest, _ := io.ReadAll(c)
+		if string(rest) != "payload" {
+			t.Errorf("%q: data after the header %q", tt.header, rest)
+		}
+	}
+
+	for _, bad := range []string{
+		"GET / HTTP/1.1\r\n\r\n",
+		"PROXY TCP4 203.0.113.7 10.0.0.1 12345\r\n",
+		"PROXY TCP4 2001:db8::7 10.0.0.1 12345 8388\r\n",
+		"PROXY TCP4 203.0.113.7 10.0.0.1 123456 8388\r\n",
+		string(proxyV2Header(1, 0x11, v4[:8])),
+		string(proxyV2Header(2, 0x11, v4)),
+	} {
+		client, server := net.Pipe()
+		go func() {
+			client.Write([]byte(bad))
+			client.Close()
+		}()
+		if _, err := ReadProxyHeader(server); err == nil {
+			t.Errorf("%q should be rejected", bad)
+		}
+	}
+}
+
+func TestProxyListener(t *testing.T) {
+	if _, err := NewProxyListener(nil, []string{"proxy.example"}); err == nil {
+		t.Error("invalid trusted proxy accepted")
+	}
+	accept := func(trusted []string, send string) net.Conn {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pl, err := NewProxyListener(ln, trusted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pl.Close()
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.Write([]byte(send))
+		done := make(chan net.Conn, 1)
+		go func() {
+			conn, _ := pl.Accept()
+			done <- conn
+		}()
+		select {
+		case conn := <-done:
+			return conn
+		case <-time.After(5 * time.Second):
+			t.Fatal("connection not accepted")
+		}
+		return nil
+	}
+
+	c := accept([]string{"127.0.0.0/8"}, "PROXY TCP4 198.51.100.1 127.0.0.1 4000 8388\r\n")
+	if got := c.RemoteAddr().String(); got != "198.51.100.1:4000" {
+		t.Errorf("trusted proxy: remote address %s", got)
+	}
+	c.Close()
+	// the header of others isn't read
+	c = accept([]string{"192.0.2.1"}, "PROXY TCP4 198.51.100.1 127.0.0.1 4000 8388\r\n")
+	if got := HostOf(c.RemoteAddr()); got != "127.0.0.1" {
+		t.Errorf("untrusted client: remote address %s", c.RemoteAddr())
+	}
+	c.Close()
+}
@@ -0,0 +1,262 @@
+package shadowsocks
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/quic"
+)
+
+// QUIC transport: each relayed connection is a bidirectional stream of a
+// QUIC connection, clients keep one connection to each server and open a
+// stream per relay, so there's no handshake after the first. It's built on
+// golang.org/x/net/quic, which has NewReno congestion control only and
+// doesn't migrate connections to new client addresses.
+
+// QUICALPN is the application protocol negotiated by QUIC clients and
+// servers, the one of HTTP/3 so the port looks like a web server.
+const QUICALPN = "h3"
+
+func quicConfig(tc *tls.Config) *quic.Config {
+	return &quic.Config{
+		TLSConfig:            tc,
+		MaxBidiRemoteStreams: 1024,
+		// the connection wide flow control window bounds the throughput of
+		// all the relays of a client to window/RTT
+		MaxConnReadBufferSize: 16 << 20,
+		KeepAlivePeriod:       15 * time.Second,
+	}
+}
+
+// QUICConn is a net.Conn over a QUIC stream.
+type QUICConn struct {
+	*quic.Stream
+	conn *quic.Conn
+
+	// the contexts of reads and writes derive from ctx, canceled by Close
+	ctx                 context.Context
+	cancel              context.CancelFunc
+	mu                  sync.Mutex
+	readStop, writeStop context.CancelFunc // of the deadline contexts
+}
+
+func newQUICConn(c *quic.Conn, s *quic.Stream) *QUICConn {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.SetReadContext(ctx)
+	s.SetWriteContext(ctx)
+	return &QUICConn{Stream: s, conn: c, ctx: ctx, cancel: cancel}
+}
+
+// closedErr returns net.ErrClosed for the errors of operations aborted by
+// Close, like other connections do.
+func (c *QUICConn) closedErr(err error) error {
+	if err != nil && err != io.EOF && c.ctx.Err() != nil {
+		return net.ErrClosed
+	}
+	return err
+}
+
+func (c *QUICConn) Read(b []byte) (n int, err error) {
+	n, err = c.Stream.Read(b)
+	return n, c.closedErr(err)
+}
+
+// Write sends b right away, the stream would buffer it otherwise.
+func (c *QUICConn) Write(b []byte) (n int, err error) {
+	if n, err = c.Stream.Write(b); err == nil {
+		err = c.Stream.Flush()
+	}
+	return n, c.closedErr(err)
+}
+
+// Close ends the stream, the data written is still delivered but Close
+// doesn't wait for it. Reads are aborted without telling the peer to stop
+// sending, x/net/quic mishandles the reset that makes the peer send.
+func (c *QUICConn) Close() error {
+	c.Stream.CloseWrite()
+	c.cancel()
+	return nil
+}
+
+func (c *QUICConn) LocalAddr() net.Addr {
+	return net.UDPAddrFromAddrPort(c.conn.LocalAddr())
+}
+
+func (c *QUICConn) RemoteAddr() net.Addr {
+	return net.UDPAddrFromAddrPort(c.conn.RemoteAddr())
+}
+
+// deadline returns a context expiring at t, and replaces stop with its
+// cancel function.
+func (c *QUICConn) deadline(t time.Time, stop *context.CancelFunc) context.Context {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if *stop != nil {
+		(*stop)()
+		*stop = nil
+	}
+	if t.IsZero() {
+		return c.ctx
+	}
+	ctx, cancel := context.WithDeadline(c.ctx, t)
+	*stop = cancel
+	return ctx
+}
+
+func (c *QUICConn) SetReadDeadline(t time.Time) error {
+	c.Stream.SetReadContext(c.deadline(t, &c.readStop))
+	return nil
+}
+
+func (c *QUICConn) SetWriteDeadline(t time.Time) error {
+	c.Stream.SetWriteContext(c.deadline(t, &c.writeStop))
+	return nil
+}
+
+func (c *QUICConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+// QUICListener accepts the streams opened by the clients of a QUIC endpoint
+// as connections.
+type QUICListener struct {
+	ep      *quic.Endpoint
+	streams chan *QUICConn
+	done    chan struct{}
+	once    sync.Once
+}
+
+// ListenQUIC listens for QUIC connections on the UDP address, tc must have
+// a certificate and negotiate QUICALPN.
+func ListenQUIC(network, addr string, tc *tls.Config) (net.Listener, error) {
+	ep, err := quic.Listen(network, addr, quicConfig(tc))
+	if err != nil {
+		return nil, err
+	}
+	l := &QUICListener{ep: ep, streams: make(chan *QUICConn), done: make(chan struct{})}
+	go l.acceptConns()
+	return l, nil
+}
+
+func (l *QUICListener) acceptConns() {
+	for {
+		c, err := l.ep.Accept(context.Background())
+		if err != nil {
+			l.Close()
+			return
+		}
+		go l.acceptStreams(c)
+	}
+}
+
+func (l *QUICListener) acceptStreams(c *quic.Conn) {
+	for {
+		s, err := c.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		select {
+		case l.streams <- newQUICConn(c, s):
+		case <-l.done:
+			s.Reset(0)
+			return
+		}
+	}
+}
+
+func (l *QUICListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.streams:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops listening and aborts the connections of the endpoint.
+func (l *QUICListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		l.ep.Close(ctx)
+	})
+	return nil
+}
+
+func (l *QUICListener) Addr() net.Addr {
+	return net.UDPAddrFromAddrPort(l.ep.LocalAddr())
+}
+
+// QUICDialer opens streams to servers, over one QUIC connection to each.
+type QUICDialer struct {
+	config *quic.Config
+	mu     sync.Mutex
+	ep     *quic.Endpoint
+	conns  map[string]*quic.Conn
+}
+
+// NewQUICDialer returns a dialer verifying servers with tc, which defaults
+// the server name to the host of the address dialed.
+func NewQUICDialer(tc *tls.Config) *QUICDialer {
+	tc = tc.Clone()
+	tc.NextProtos = []string{QUICALPN}
+	return &QUICDialer{config: quicConfig(tc), conns: make(map[string]*quic.Conn)}
+}
+
+// conn returns the connection to addr, connecting if there's none.
+func (d *QUICDialer) conn(addr string) (*quic.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if c, ok := d.conns[addr]; ok {
+		return c, nil
+	}
+	if d.ep == nil {
+		ep, err := quic.Listen("udp", ":0", nil)
+		if err != nil {
+			return nil, err
+		}
+		d.ep = ep
+	}
+	c, err := d.ep.Dial(context.Background(), "udp", addr, d.config)
+	if err != nil {
+		return nil, err
+	}
+	d.conns[addr] = c
+	go func() {
+		c.Wait(context.Background())
+		d.forget(addr, c)
+	}()
+	return c, nil
+}
+
+func (d *QUICDialer) forget(addr string, c *quic.Conn) {
+	d.mu.Lock()
+	if d.conns[addr] == c {
+		delete(d.conns, addr)
+	}
+	d.mu.Unlock()
+}
+
+// Dial opens a stream to the server at addr.
+func (d *QUICDialer) Dial(addr string) (net.Conn, error) {
+	c, err := d.conn(addr)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s, err := c.NewStream(ctx)
+	if err != nil {
+		// the connection may have died without Wait noticing yet
+		d.forget(addr, c)
+		c.Abort(nil)
+		return nil, err
+	}
+	return newQUICConn(c, s), nil
+}
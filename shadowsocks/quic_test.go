@@ -0,0 +1,98 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// selfSigned returns a certificate for localhost and a pool trusting it.
+func selfSigned(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestQUIC(t *testing.T) {
+	cert, pool := selfSigned(t)
+	ln, err := ListenQUIC("udp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{QUICALPN},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+
+	d := NewQUICDialer(&tls.Config{ServerName: "localhost", RootCAs: pool})
+	addr := ln.Addr().String()
+	payload := bytes.Repeat([]byte(text), 100)
+	// the streams share the connection
+	for i := 0; i < 3; i++ {
+		c, err := d.Dial(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = c.Write(payload); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, len(payload))
+		if _, err = io.ReadFull(c, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, payload) {
+			t.Errorf("stream %d: echo differs", i)
+		}
+		c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		if _, err = c.Read(got); err == nil {
+			t.Error("read after the deadline succeeded")
+		} else if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			t.Errorf("read after the deadline: %v, want a timeout", err)
+		}
+		c.Close()
+		if _, err = c.Read(got); !errors.Is(err, net.ErrClosed) {
+			t.Errorf("read after close: %v, want net.ErrClosed", err)
+		}
+	}
+	d.mu.Lock()
+	if len(d.conns) != 1 {
+		t.Errorf("%d connections to the server, want 1", len(d.conns))
+	}
+	d.mu.Unlock()
+}
@@ -0,0 +1,152 @@
+package shadowsocks
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Idle buckets are dropped after this long so the map doesn't grow with
+// every address that ever connected.
+const bucketIdleTimeout = time.Minute
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter is a token bucket limiter keyed by source address. Each key
+// may do rate operations per second, with bursts of up to burst operations.
+type RateLimiter struct {
+	sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+// NewRateLimiter returns a limiter allowing rate operations per second for
+// each key. If burst is less than 1, rate is used as the burst size.
+func NewRateLimiter(rate, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = rate
+	}
+	return &RateLimiter{
+		rate:    float64(rate),
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+		swept:   time.Now(),
+	}
+}
+
+// SetRate changes the rate and burst, like NewRateLimiter. Buckets already
+// holding more tokens than burst are cut down when they're used next.
+func (rl *RateLimiter) SetRate(rate, burst int) {
+	if burst < 1 {
+		burst = rate
+	}
+	rl.Lock()
+	rl.rate = float64(rate)
+	rl.burst = float64(burst)
+	rl.Unlock()
+}
+
+// Allow reports whether another operation from key is allowed now. A nil
+// limiter or one with a non-positive rate allows everything.
+func (rl *RateLimiter) Allow(key string) bool {
+	if rl == nil {
+		return true
+	}
+	now := time.Now()
+	rl.Lock()
+	defer rl.Unlock()
+	if rl.rate <= 0 {
+		return true
+	}
+
+	if now.Sub(rl.swept) > bucketIdleTimeout {
+		for k, b := range rl.buckets {
+			if now.Sub(b.last) > bucketIdleTimeout {
+				delete(rl.buckets, k)
+			}
+		}
+		rl.swept = now
+	}
+
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &bucket{tokens: rl.burst, last: now}
+		rl.buckets[key] = b
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * rl.rate
+		if b.tokens > rl.burst {
+			b.tokens = rl.burst
+		}
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Bandwidth is a token bucket limiting throughput in bytes per second. All
+// connections using the same Bandwidth share its rate.
+type Bandwidth struct {
+	sync.Mutex
+	rate   float64 // bytes per second
+	tokens float64
+	last   time.Time
+}
+
+// NewBandwidth returns a limiter of mbps megabits per second. If mbps isn't
+// positive the limiter doesn't limit, like a nil *Bandwidth.
+func NewBandwidth(mbps float64) *Bandwidth {
+	b := &Bandwidth{last: time.Now()}
+	b.SetRate(mbps)
+	return b
+}
+
+// SetRate changes the limit to mbps megabits per second.
+func (b *Bandwidth) SetRate(mbps float64) {
+	b.Lock()
+	b.rate = mbps * 1e6 / 8
+	b.Unlock()
+}
+
+// Wait blocks until n more bytes may be sent. Bursts of up to 100ms worth of
+// traffic are sent at once.
+func (b *Bandwidth) Wait(n int) {
+	if b == nil {
+		return
+	}
+	b.Lock()
+	if b.rate <= 0 {
+		b.Unlock()
+		return
+	}
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if burst := b.rate / 10; b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+	// take the tokens now, so concurrent senders queue up behind each other
+	b.tokens -= float64(n)
+	var wait time.Duration
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.Unlock()
+	time.Sleep(wait)
+}
+
+// HostOf returns the IP part of addr, which is used as limiter key.
+func HostOf(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
@@ -0,0 +1,68 @@
+package shadowsocks
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterBurst(t *testing.T) {
+	rl := NewRateLimiter(3, 0)
+	for i := 0; i < 3; i++ {
+		if !rl.Allow("1.2.3.4") {
+			t.Fatalf("request %d should be allowed within burst", i)
+		}
+	}
+	if rl.Allow("1.2.3.4") {
+		t.Error("request exceeding burst should be rejected")
+	}
+	if !rl.Allow("5.6.7.8") {
+		t.Error("different source should have its own bucket")
+	}
+}
+
+func TestRateLimiterDisabled(t *testing.T) {
+	var rl *RateLimiter
+	if !rl.Allow("1.2.3.4") {
+		t.Error("nil limiter should allow everything")
+	}
+	rl = NewRateLimiter(0, 0)
+	for i := 0; i < 100; i++ {
+		if !rl.Allow("1.2.3.4") {
+			t.Fatal("zero rate limiter should allow everything")
+		}
+	}
+}
+
+func TestRateLimiterSetRate(t *testing.T) {
+	rl := NewRateLimiter(0, 0)
+	rl.SetRate(2, 0)
+	rl.Allow("1.2.3.4")
+	rl.Allow("1.2.3.4")
+	if rl.Allow("1.2.3.4") {
+		t.Error("request exceeding the new burst should be rejected")
+	}
+	rl.SetRate(0, 0)
+	if !rl.Allow("1.2.3.4") {
+		t.Error("limiter set to zero rate should allow everything")
+	}
+}
+
+func TestBandwidth(t *testing.T) {
+	b := NewBandwidth(8) // 1MB/s
+	start := time.Now()
+	for i := 0; i < 75; i++ {
+		b.Wait(4096)
+	}
+	// 300KB with a 100KB burst take 200ms
+	if d := time.Since(start); d < 150*time.Millisecond || d > time.Second {
+		t.Error("300KB at 1MB/s took", d)
+	}
+
+	start = time.Now()
+	var unlimited *Bandwidth
+	unlimited.Wait(1 << 30)
+	NewBandwidth(0).Wait(1 << 30)
+	if d := time.Since(start); d > 10*time.Millisecond {
+		t.Error("unlimited bandwidth waited", d)
+	}
+}
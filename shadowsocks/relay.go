@@ -0,0 +1,84 @@
+package shadowsocks
+
+import (
+	"net"
+)
+
+// spliceChunk is the most a splice relay moves at once, so the pipe flag,
+// the read timeout and the limits are still checked between chunks.
+const spliceChunk = 64 * 1024
+
+// A relay copies src to dst for PipeThenClose a chunk at a time, by the
+// fastest means the pair of connections allows.
+type relay interface {
+	// copyChunk copies a chunk of src to dst, calling wait with its size
+	// before writing it. It returns io.EOF at the end of src, and a
+	// *writeError if writing dst failed.
+	copyChunk(wait func(int)) (int, error)
+	release()
+}
+
+// writeError is an error writing the destination of a relay.
+type writeError struct {
+	err error
+}
+
+func (e *writeError) Error() string { return e.err.Error() }
+
+// newRelay returns the relay from src to dst. Data between plain TCP
+// connections is spliced in the kernel where supported, anything else is
+// copied through a pooled buffer. The relays of clients go through a *Conn,
+// which encrypts, so they're copied; splice only moves the data of the
+// fallback to the decoy server, of plain TCP or PROXY protocol connections.
+// Wrappers counting or recording the data, like the capture ones, need it in
+// user space too.
+func newRelay(src, dst net.Conn) relay {
+	if spliceSupported {
+		s, ok1 := plainTCP(src)
+		d, ok2 := plainTCP(dst)
+		if ok1 && ok2 {
+			if r, err := newSpliceRelay(s, d); err == nil {
+				return r
+			}
+		}
+	}
+	return &bufRelay{src: src, dst: dst, buf: GetBuf(MediumBufSize)}
+}
+
+// plainTCP returns the TCP connection c is, or wraps without changing or
+// seeing its data.
+func plainTCP(c net.Conn) (*net.TCPConn, bool) {
+	for {
+		switch v := c.(type) {
+		case *net.TCPConn:
+			return v, true
+		case *proxyConn:
+			c = v.Conn
+		default:
+			return nil, false
+		}
+	}
+}
+
+type bufRelay struct {
+	src, dst net.Conn
+	buf      []byte
+}
+
+func (r *bufRelay) copyChunk(wait func(int)) (int, error) {
+	n, err := r.src.Read(r.buf)
+	// read may return EOF with n > 0
+	// should always process n > 0 bytes before handling error
+	if n > 0 {
+		wait(n)
+		if _, werr := r.dst.Write(r.buf[:n]); werr != nil {
+			return n, &writeError{werr}
+		}
+	}
+	return n, err
+}
+
+func (r *bufRelay) release() {
+	PutBuf(r.buf)
+	r.buf = nil
+}
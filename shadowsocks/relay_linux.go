@@ -0,0 +1,93 @@
+package shadowsocks
+
+import (
+	"io"
+	"net"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const spliceSupported = true
+
+func init() {
+	RegisterFeature("splice")
+}
+
+// spliceRelay moves data between TCP connections with splice(2) through a
+// pipe, without copying it to user space. Unlike ReadFrom of net.TCPConn,
+// which splices as well, it moves the data in and out of the pipe in
+// separate steps, so it knows which connection failed.
+type spliceRelay struct {
+	src, dst   *net.TCPConn
+	rsrc, rdst syscall.RawConn
+	pipe       [2]int
+}
+
+func newSpliceRelay(src, dst *net.TCPConn) (*spliceRelay, error) {
+	r := &spliceRelay{src: src, dst: dst}
+	var err error
+	if r.rsrc, err = src.SyscallConn(); err != nil {
+		return nil, err
+	}
+	if r.rdst, err = dst.SyscallConn(); err != nil {
+		return nil, err
+	}
+	if err = unix.Pipe2(r.pipe[:], unix.O_CLOEXEC|unix.O_NONBLOCK); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *spliceRelay) copyChunk(wait func(int)) (int, error) {
+	var n int
+	var serr error
+	err := r.rsrc.Read(func(fd uintptr) bool {
+		for {
+			n, serr = splice(int(fd), r.pipe[1], spliceChunk)
+			if serr != syscall.EINTR {
+				return serr != syscall.EAGAIN
+			}
+		}
+	})
+	if err == nil && serr != nil {
+		err = os.NewSyscallError("splice", serr)
+	}
+	if err != nil {
+		return 0, &net.OpError{Op: "read", Net: "tcp", Source: r.src.LocalAddr(), Addr: r.src.RemoteAddr(), Err: err}
+	}
+	if n == 0 {
+		return 0, io.EOF
+	}
+	wait(n)
+	for left := n; left > 0; {
+		var m int
+		err = r.rdst.Write(func(fd uintptr) bool {
+			for {
+				m, serr = splice(r.pipe[0], int(fd), left)
+				if serr != syscall.EINTR {
+					return serr != syscall.EAGAIN
+				}
+			}
+		})
+		if err == nil && serr != nil {
+			err = os.NewSyscallError("splice", serr)
+		}
+		if err != nil {
+			return n, &writeError{&net.OpError{Op: "write", Net: "tcp", Source: r.dst.LocalAddr(), Addr: r.dst.RemoteAddr(), Err: err}}
+		}
+		left -= m
+	}
+	return n, nil
+}
+
+func splice(in, out, max int) (int, error) {
+	n, err := unix.Splice(in, nil, out, nil, max, unix.SPLICE_F_MOVE|unix.SPLICE_F_NONBLOCK)
+	return int(n), err
+}
+
+func (r *spliceRelay) release() {
+	unix.Close(r.pipe[0])
+	unix.Close(r.pipe[1])
+}
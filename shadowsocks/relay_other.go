@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package shadowsocks
+
+import (
+	"errors"
+	"net"
+)
+
+const spliceSupported = false
+
+// spliceRelay is never used without splice(2).
+type spliceRelay struct {
+	bufRelay
+}
+
+func newSpliceRelay(src, dst *net.TCPConn) (*spliceRelay, error) {
+	return nil, errors.ErrUnsupported
+}
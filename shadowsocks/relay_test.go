@@ -0,0 +1,192 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpPair returns both ends of a TCP connection.
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	c1, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c1, c2
+}
+
+func TestNewRelay(t *testing.T) {
+	a, b := tcpPair(t)
+	defer a.Close()
+	defer b.Close()
+	r := newRelay(a, b)
+	if _, ok := r.(*spliceRelay); ok != spliceSupported {
+		t.Errorf("relay between TCP connections is %T", r)
+	}
+	r.release()
+	// connections of the PROXY protocol are spliced too
+	r = newRelay(&proxyConn{Conn: a}, b)
+	if _, ok := r.(*spliceRelay); ok != spliceSupported {
+		t.Errorf("relay from a PROXY protocol connection is %T", r)
+	}
+	r.release()
+	p1, p2 := net.Pipe()
+	defer p1.Close()
+	defer p2.Close()
+	r = newRelay(p1, p2)
+	if _, ok := r.(*bufRelay); !ok {
+		t.Errorf("relay between pipes is %T", r)
+	}
+	r.release()
+}
+
+func TestPipeThenCloseTCP(t *testing.T) {
+	// a port of its own in the shared counters
+	AddTraffic("18389")
+	defer DelTraffic("18389")
+
+	// client -> (in, out) -> server
+	client, in := tcpPair(t)
+	out, server := tcpPair(t)
+	defer server.Close()
+	go PipeThenClose(in, out, NO_TIMEOUT, nil, "18389", "in")
+
+	msg := make([]byte, 3*spliceChunk+100)
+	rand.Read(msg)
+	go func() {
+		client.Write(msg)
+		client.Close()
+	}()
+	got, err := io.ReadAll(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatalf("relayed %d bytes, want %d", len(got), len(msg))
+	}
+	if m, _ := GetTraffic("18389"); m["18389"] != len(msg) {
+		t.Errorf("traffic %d, want %d", m["18389"], len(msg))
+	}
+}
+
+func TestRelayWriteError(t *testing.T) {
+	client, in := tcpPair(t)
+	out, server := tcpPair(t)
+	defer client.Close()
+	defer in.Close()
+	// writing out fails once it's closed
+	out.Close()
+	server.Close()
+	r := newRelay(in, out)
+	defer r.release()
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	for i := 0; i < 10 && err == nil; i++ {
+		_, err = r.copyChunk(func(int) {})
+	}
+	if _, ok := err.(*writeError); !ok {
+		t.Errorf("%T relay failed with %v, want a write error", r, err)
+	}
+}
+
+func TestRelayHalfClose(t *testing.T) {
+	// client -> (in, out) -> server
+	client, in := tcpPair(t)
+	out, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+	done := make(chan struct{})
+	var up, down int64
+	go func() {
+		up, down, _, _ = Relay(in, out, RelayOptions{})
+		close(done)
+	}()
+
+	client.Write([]byte("request"))
+	client.(*net.TCPConn).CloseWrite()
+	got, err := io.ReadAll(server)
+	if err != nil || string(got) != "request" {
+		t.Fatalf("server read %q, %v", got, err)
+	}
+	// the response still gets through
+	server.Write([]byte("response"))
+	server.Close()
+	got, err = io.ReadAll(client)
+	if err != nil || string(got) != "response" {
+		t.Fatalf("client read %q, %v", got, err)
+	}
+	<-done
+	if up != 7 || down != 8 {
+		t.Errorf("relayed %d up and %d down", up, down)
+	}
+}
+
+func TestRelayTimeouts(t *testing.T) {
+	client, in := tcpPair(t)
+	out, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+	start := time.Now()
+	_, _, upErr, downErr := Relay(in, out, RelayOptions{Lifetime: 200 * time.Millisecond})
+	// the direction timing out first closes the other
+	ne1, ok1 := upErr.(net.Error)
+	ne2, ok2 := downErr.(net.Error)
+	if !(ok1 && ne1.Timeout()) && !(ok2 && ne2.Timeout()) {
+		t.Errorf("relay ended with %v and %v, want a timeout", upErr, downErr)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("relay lasted %v", d)
+	}
+
+	client2, in2 := tcpPair(t)
+	out2, server2 := tcpPair(t)
+	defer client2.Close()
+	defer server2.Close()
+	_, _, _, downErr = Relay(in2, out2, RelayOptions{RemoteIdle: 100 * time.Millisecond})
+	if ne, ok := downErr.(net.Error); !ok || !ne.Timeout() {
+		t.Errorf("remote idle relay ended with %v, want a timeout", downErr)
+	}
+}
+
+func TestRelayHalfCloseEncrypted(t *testing.T) {
+	cipher, err := NewCipher("aes-256-gcm", "foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// client -> (in, out) -> server, client and in encrypted
+	rawClient, rawIn := tcpPair(t)
+	client, in := NewConn(rawClient, cipher.Copy()), NewConn(rawIn, cipher.Copy())
+	out, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+	go Relay(in, out, RelayOptions{})
+
+	client.Write([]byte("request"))
+	if err = client.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(server)
+	if err != nil || string(got) != "request" {
+		t.Fatalf("server read %q, %v", got, err)
+	}
+	server.Write([]byte("response"))
+	server.Close()
+	got, err = io.ReadAll(client)
+	if err != nil || string(got) != "response" {
+		t.Fatalf("client read %q, %v", got, err)
+	}
+}
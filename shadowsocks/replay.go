@@ -0,0 +1,198 @@
+package shadowsocks
+
+import (
+	"encoding/gob"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ErrReplay is returned by Conn.Read if the IV of the connection has been
+// seen before, which means the connection is replayed by a prober.
+var ErrReplay = errors.New("replayed iv")
+
+const (
+	replayWindow     = time.Hour // IVs are remembered for 1 to 2 windows
+	replayMaxEntries = 1 << 20   // rotate early if a generation gets this big
+)
+
+// ReplayFilter remembers recently seen IVs. IVs are kept in two
+// generations, the older one is dropped when the current one is older than
+// replayWindow.
+type ReplayFilter struct {
+	sync.Mutex
+	cur, prev           map[string]struct{}
+	curStart, prevStart time.Time
+
+	// bloom filters used instead of cur and prev by a bounded filter
+	bloomCur, bloomPrev *bloomFilter
+	capacity            int
+	fpRate              float64
+}
+
+func NewReplayFilter() *ReplayFilter {
+	return &ReplayFilter{cur: make(map[string]struct{}), curStart: time.Now()}
+}
+
+// NewBloomReplayFilter returns a filter with bounded memory, which keeps
+// the generations in bloom filters of capacity IVs each with false positive
+// rate fpRate. A generation is rotated early when it's full. As two
+// generations are checked, about 2*fpRate of new connections are rejected
+// by mistake.
+func NewBloomReplayFilter(capacity int, fpRate float64) *ReplayFilter {
+	return &ReplayFilter{
+		bloomCur: newBloomFilter(capacity, fpRate),
+		curStart: time.Now(),
+		capacity: capacity,
+		fpRate:   fpRate,
+	}
+}
+
+// Add records iv, returns false if it has been seen before.
+func (rf *ReplayFilter) Add(iv []byte) bool {
+	if rf == nil || len(iv) == 0 {
+		return true
+	}
+	rf.Lock()
+	defer rf.Unlock()
+	if rf.bloomCur != nil {
+		return rf.addBloom(iv)
+	}
+	k := string(iv)
+	if _, ok := rf.cur[k]; ok {
+		return false
+	}
+	if _, ok := rf.prev[k]; ok {
+		return false
+	}
+	if time.Since(rf.curStart) > replayWindow || len(rf.cur) >= replayMaxEntries {
+		rf.prev, rf.prevStart = rf.cur, rf.curStart
+		rf.cur, rf.curStart = make(map[string]struct{}), time.Now()
+	}
+	rf.cur[k] = struct{}{}
+	return true
+}
+
+func (rf *ReplayFilter) addBloom(iv []byte) bool {
+	if rf.bloomCur.test(iv) || (rf.bloomPrev != nil && rf.bloomPrev.test(iv)) {
+		return false
+	}
+	if time.Since(rf.curStart) > replayWindow || rf.bloomCur.N >= rf.capacity {
+		rf.bloomPrev, rf.prevStart = rf.bloomCur, rf.curStart
+		rf.bloomCur, rf.curStart = newBloomFilter(rf.capacity, rf.fpRate), time.Now()
+	}
+	rf.bloomCur.add(iv)
+	return true
+}
+
+type replaySnapshot struct {
+	Start [2]time.Time
+	IVs   [2][]string
+	Bloom [2]bloomFilter // generations of a bounded filter, without bits if absent
+}
+
+// Save writes the filter to path, replacing the file atomically.
+func (rf *ReplayFilter) Save(path string) error {
+	var snap replaySnapshot
+	rf.Lock()
+	for i, gen := range []map[string]struct{}{rf.cur, rf.prev} {
+		snap.IVs[i] = make([]string, 0, len(gen))
+		for k := range gen {
+			snap.IVs[i] = append(snap.IVs[i], k)
+		}
+	}
+	snap.Start = [2]time.Time{rf.curStart, rf.prevStart}
+	if rf.bloomCur != nil {
+		// copy the bits, Add changes them in place
+		for i, bf := range []*bloomFilter{rf.bloomCur, rf.bloomPrev} {
+			if bf != nil {
+				snap.Bloom[i] = *bf
+				snap.Bloom[i].Bits = append([]uint64{}, bf.Bits...)
+			}
+		}
+	}
+	rf.Unlock()
+
+	f, err := os.CreateTemp(filepath.Dir(path), ".replay")
+	if err != nil {
+		return err
+	}
+	if err = gob.NewEncoder(f).Encode(&snap); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func loadSnapshot(path string) (*replaySnapshot, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var snap replaySnapshot
+	if err = gob.NewDecoder(f).Decode(&snap); err != nil {
+		return nil, err
+	}
+	return &snap, nil
+}
+
+// live reports whether a generation started at start is still needed, which
+// is the case if newer IVs may be added to it or the following generation
+// within one window.
+func live(start time.Time) bool {
+	return !start.IsZero() && time.Since(start) <= 2*replayWindow
+}
+
+// LoadReplayFilter reads a filter saved by Save. Generations that have
+// expired since are dropped. A missing file gives an empty filter.
+func LoadReplayFilter(path string) (*ReplayFilter, error) {
+	rf := NewReplayFilter()
+	snap, err := loadSnapshot(path)
+	if snap == nil {
+		return rf, err
+	}
+	for i := 1; i >= 0; i-- {
+		if !live(snap.Start[i]) {
+			continue
+		}
+		gen := make(map[string]struct{}, len(snap.IVs[i]))
+		for _, k := range snap.IVs[i] {
+			gen[k] = struct{}{}
+		}
+		rf.prev, rf.prevStart = rf.cur, rf.curStart
+		rf.cur, rf.curStart = gen, snap.Start[i]
+	}
+	return rf, nil
+}
+
+// LoadBloomReplayFilter is LoadReplayFilter for a bounded filter. The saved
+// generations are dropped if they were saved by an unbounded filter or with
+// a different capacity or fpRate.
+func LoadBloomReplayFilter(path string, capacity int, fpRate float64) (*ReplayFilter, error) {
+	rf := NewBloomReplayFilter(capacity, fpRate)
+	snap, err := loadSnapshot(path)
+	if snap == nil {
+		return rf, err
+	}
+	m, k := bloomSize(capacity, fpRate)
+	for i := 1; i >= 0; i-- {
+		bf := &snap.Bloom[i]
+		if !live(snap.Start[i]) || bf.K != k || uint64(len(bf.Bits))*64 != m {
+			continue
+		}
+		rf.bloomPrev, rf.prevStart = rf.bloomCur, rf.curStart
+		rf.bloomCur, rf.curStart = bf, snap.Start[i]
+	}
+	return rf, nil
+}
@@ -0,0 +1,133 @@
+package shadowsocks
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReplayFilter(t *testing.T) {
+	rf := NewReplayFilter()
+	if !rf.Add([]byte("iv1")) {
+		t.Fatal("new iv should be accepted")
+	}
+	if rf.Add([]byte("iv1")) {
+		t.Error("seen iv should be rejected")
+	}
+	// rotate into the previous generation, which is still checked
+	rf.curStart = time.Now().Add(-replayWindow - time.Second)
+	if !rf.Add([]byte("iv2")) {
+		t.Fatal("new iv should be accepted")
+	}
+	if rf.Add([]byte("iv1")) {
+		t.Error("iv in previous generation should be rejected")
+	}
+	var nilFilter *ReplayFilter
+	if !nilFilter.Add([]byte("iv1")) {
+		t.Error("nil filter should accept everything")
+	}
+}
+
+func TestReplayFilterSaveLoad(t *testing.T) {
+	dir, err := os.MkdirTemp("", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "replay")
+
+	rf, err := LoadReplayFilter(path)
+	if err != nil {
+		t.Fatal("missing file should give empty filter:", err)
+	}
+	rf.Add([]byte("iv1"))
+	if err = rf.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	if rf, err = LoadReplayFilter(path); err != nil {
+		t.Fatal(err)
+	}
+	if rf.Add([]byte("iv1")) {
+		t.Error("iv saved before restart should be rejected")
+	}
+
+	// expired generations are dropped on load
+	rf.curStart = time.Now().Add(-3 * replayWindow)
+	rf.prev = nil
+	if err = rf.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	if rf, err = LoadReplayFilter(path); err != nil {
+		t.Fatal(err)
+	}
+	if !rf.Add([]byte("iv1")) {
+		t.Error("expired iv should be accepted")
+	}
+}
+
+func TestBloomReplayFilter(t *testing.T) {
+	rf := NewBloomReplayFilter(1000, 1e-6)
+	if !rf.Add([]byte("iv1")) {
+		t.Fatal("new iv should be accepted")
+	}
+	if rf.Add([]byte("iv1")) {
+		t.Error("seen iv should be rejected")
+	}
+	// filling the generation rotates it, the previous one is still checked
+	for i := 0; i < 1000; i++ {
+		rf.Add([]byte{byte(i), byte(i >> 8), 'x'})
+	}
+	if rf.bloomPrev == nil {
+		t.Fatal("full generation not rotated")
+	}
+	if rf.Add([]byte("iv1")) {
+		t.Error("iv in previous generation should be rejected")
+	}
+
+	// false positives stay near the configured rate
+	rf = NewBloomReplayFilter(10000, 0.01)
+	for i := 0; i < 10000; i++ {
+		rf.Add([]byte{byte(i), byte(i >> 8), 'a'})
+	}
+	fp := 0
+	for i := 0; i < 10000; i++ {
+		if rf.bloomCur.test([]byte{byte(i), byte(i >> 8), 'b'}) {
+			fp++
+		}
+	}
+	if fp > 200 {
+		t.Errorf("%d false positives in 10000, want about 100", fp)
+	}
+}
+
+func TestBloomReplayFilterSaveLoad(t *testing.T) {
+	dir, err := os.MkdirTemp("", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "replay")
+
+	rf, err := LoadBloomReplayFilter(path, 1000, 1e-6)
+	if err != nil {
+		t.Fatal("missing file should give empty filter:", err)
+	}
+	rf.Add([]byte("iv1"))
+	if err = rf.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	if rf, err = LoadBloomReplayFilter(path, 1000, 1e-6); err != nil {
+		t.Fatal(err)
+	}
+	if rf.Add([]byte("iv1")) {
+		t.Error("iv saved before restart should be rejected")
+	}
+	// a filter of another size starts empty
+	if rf, err = LoadBloomReplayFilter(path, 2000, 1e-6); err != nil {
+		t.Fatal(err)
+	}
+	if !rf.Add([]byte("iv1")) {
+		t.Error("iv saved with another capacity should be accepted")
+	}
+}
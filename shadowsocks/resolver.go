@@ -0,0 +1,245 @@
+package shadowsocks
+
+import (
+	"container/list"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"expvar"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	dnsCacheSizeDefault = 1024
+	// answers of the system resolver come without TTL
+	systemDNSTTL         = time.Minute
+	systemDNSNegativeTTL = 10 * time.Second
+	// dnsTTLMax caps how long answers are cached whatever their TTL
+	dnsTTLMax = time.Hour
+)
+
+var (
+	dnsCacheHits   = expvar.NewInt("dns_cache_hits")
+	dnsCacheMisses = expvar.NewInt("dns_cache_misses")
+)
+
+// Resolver looks up host names from upstream DNS servers, or the system
+// resolver if there's none, keeping the answers in an LRU cache for their
+// TTL. Names that don't exist are cached too. Concurrent lookups of a name
+// share one query, and at most a fixed number of names are looked up at a
+// time.
+type Resolver struct {
+	upstreams []*dnsUpstream
+	sem       chan struct{}
+
+	mu    sync.Mutex
+	size  int
+	lru   *list.List               // of *dnsEntry, most recently used first
+	cache map[string]*list.Element // by name
+	calls map[string]*dnsCall      // lookups in flight, by name
+}
+
+type dnsEntry struct {
+	name    string
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+type dnsCall struct {
+	done chan struct{}
+	a    *dnsAnswer
+}
+
+// NewResolver returns a resolver querying upstreams in order until one
+// answers, see parseDNSUpstream for their syntax, and the system resolver
+// if there's none. It caches the answers of cacheSize names, 1024 if it's
+// 0, none if it's negative, and looks up at most workers names at a time.
+func NewResolver(upstreams []string, cacheSize, workers int) (*Resolver, error) {
+	if cacheSize == 0 {
+		cacheSize = dnsCacheSizeDefault
+	}
+	if workers <= 0 {
+		workers = 1
+	}
+	r := &Resolver{
+		sem:   make(chan struct{}, workers),
+		size:  cacheSize,
+		lru:   list.New(),
+		cache: make(map[string]*list.Element),
+		calls: make(map[string]*dnsCall),
+	}
+	for _, s := range upstreams {
+		up, err := parseDNSUpstream(s)
+		if err != nil {
+			return nil, err
+		}
+		r.upstreams = append(r.upstreams, up)
+	}
+	return r, nil
+}
+
+// LookupIP returns the addresses of host, IPv4 ones first. host may be an
+// IP address, returned as is.
+func (r *Resolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	name := strings.ToLower(strings.TrimSuffix(host, "."))
+	r.mu.Lock()
+	if e, ok := r.cache[name]; ok {
+		entry := e.Value.(*dnsEntry)
+		if time.Now().Before(entry.expires) {
+			r.lru.MoveToFront(e)
+			r.mu.Unlock()
+			dnsCacheHits.Add(1)
+			return entry.ips, entry.err
+		}
+		r.lru.Remove(e)
+		delete(r.cache, name)
+	}
+	dnsCacheMisses.Add(1)
+	c, ok := r.calls[name]
+	if !ok {
+		c = &dnsCall{done: make(chan struct{})}
+		r.calls[name] = c
+		go r.lookup(name, c)
+	}
+	r.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.a.ips, c.a.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// lookup looks up name for the callers waiting on c, it isn't canceled
+// when they give up so the answer is cached for the next ones.
+func (r *Resolver) lookup(name string, c *dnsCall) {
+	r.sem <- struct{}{}
+	ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+	if len(r.upstreams) == 0 {
+		c.a = lookupSystem(ctx, name)
+	} else {
+		for _, up := range r.upstreams {
+			if c.a = lookupUpstream(ctx, up, name); !isTemporary(c.a.err) {
+				break
+			}
+			logger.Debugf("dns lookup of %s from %s: %v", name, up, c.a.err)
+		}
+	}
+	cancel()
+	<-r.sem
+
+	r.mu.Lock()
+	delete(r.calls, name)
+	// temporary errors have no TTL, they aren't cached
+	if r.size > 0 && c.a.ttl > 0 {
+		ttl := c.a.ttl
+		if ttl > dnsTTLMax {
+			ttl = dnsTTLMax
+		}
+		entry := &dnsEntry{name: name, ips: c.a.ips, err: c.a.err, expires: time.Now().Add(ttl)}
+		r.cache[name] = r.lru.PushFront(entry)
+		for r.lru.Len() > r.size {
+			old := r.lru.Remove(r.lru.Back()).(*dnsEntry)
+			delete(r.cache, old.name)
+		}
+	}
+	r.mu.Unlock()
+	close(c.done)
+}
+
+// isTemporary reports whether err may not happen with another server.
+func isTemporary(err error) bool {
+	var dnsErr *net.DNSError
+	return err != nil && !(errors.As(err, &dnsErr) && dnsErr.IsNotFound)
+}
+
+func lookupSystem(ctx context.Context, name string) *dnsAnswer {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, name)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return &dnsAnswer{err: err, ttl: systemDNSNegativeTTL}
+		}
+		return &dnsAnswer{err: err}
+	}
+	a := &dnsAnswer{ttl: systemDNSTTL}
+	for _, addr := range addrs {
+		a.ips = append(a.ips, addr.IP)
+	}
+	sortIPv4First(a.ips)
+	return a
+}
+
+// lookupUpstream queries up for the IPv4 and IPv6 addresses of name.
+func lookupUpstream(ctx context.Context, up *dnsUpstream, name string) *dnsAnswer {
+	types := []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	answers := make([]*dnsAnswer, len(types))
+	var wg sync.WaitGroup
+	for i, t := range types {
+		wg.Add(1)
+		go func(i int, t dnsmessage.Type) {
+			defer wg.Done()
+			var id [2]byte
+			rand.Read(id[:])
+			q, err := dnsQuery(binary.BigEndian.Uint16(id[:]), name, t)
+			if err != nil {
+				answers[i] = &dnsAnswer{err: err}
+				return
+			}
+			resp, err := up.exchange(ctx, q)
+			if err != nil {
+				answers[i] = &dnsAnswer{err: err}
+				return
+			}
+			answers[i] = parseDNSAnswer(name, resp)
+		}(i, t)
+	}
+	wg.Wait()
+
+	// the addresses of either query, a negative answer if both are, an
+	// error otherwise
+	a := &dnsAnswer{ttl: -1}
+	for _, b := range answers {
+		if b.err != nil {
+			continue
+		}
+		a.ips = append(a.ips, b.ips...)
+		if a.ttl < 0 || b.ttl < a.ttl {
+			a.ttl = b.ttl
+		}
+	}
+	if len(a.ips) > 0 {
+		return a
+	}
+	for _, b := range answers {
+		if isTemporary(b.err) {
+			return b
+		}
+	}
+	a = answers[0]
+	if answers[1].ttl < a.ttl {
+		a.ttl = answers[1].ttl
+	}
+	return a
+}
+
+func sortIPv4First(ips []net.IP) {
+	i := 0
+	for j, ip := range ips {
+		if ip.To4() != nil {
+			ips[i], ips[j] = ips[j], ips[i]
+			i++
+		}
+	}
+}
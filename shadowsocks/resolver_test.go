@@ -0,0 +1,224 @@
+package shadowsocks
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeDNS answers queries of a.test, big.test, whose answer doesn't fit in
+// a datagram, and nx.test, which doesn't exist, counting them by name.
+type fakeDNS struct {
+	sync.Mutex
+	queries map[string]int
+}
+
+func (f *fakeDNS) answer(q []byte, stream bool) []byte {
+	var p dnsmessage.Parser
+	h, err := p.Start(q)
+	if err != nil {
+		return nil
+	}
+	question, err := p.Question()
+	if err != nil {
+		return nil
+	}
+	name := question.Name.String()
+	f.Lock()
+	f.queries[name]++
+	f.Unlock()
+
+	h.Response = true
+	b := dnsmessage.NewBuilder(nil, h)
+	hdr := dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: 60}
+	if name == "nx.test." {
+		h.RCode = dnsmessage.RCodeNameError
+		b = dnsmessage.NewBuilder(nil, h)
+		b.StartQuestions()
+		b.Question(question)
+		b.StartAuthorities()
+		hdr.TTL = 30
+		b.SOAResource(hdr, dnsmessage.SOAResource{NS: question.Name, MBox: question.Name, MinTTL: 30})
+		msg, _ := b.Finish()
+		return msg
+	}
+	if name == "big.test." && !stream {
+		h.Truncated = true
+		b = dnsmessage.NewBuilder(nil, h)
+		b.StartQuestions()
+		b.Question(question)
+		msg, _ := b.Finish()
+		return msg
+	}
+	b.StartQuestions()
+	b.Question(question)
+	b.StartAnswers()
+	switch question.Type {
+	case dnsmessage.TypeA:
+		ip := [4]byte{192, 0, 2, 1}
+		if name == "big.test." {
+			ip[3] = 2
+		}
+		b.AResource(hdr, dnsmessage.AResource{A: ip})
+	case dnsmessage.TypeAAAA:
+		if name == "a.test." {
+			var ip [16]byte
+			copy(ip[:], net.ParseIP("2001:db8::1"))
+			b.AAAAResource(hdr, dnsmessage.AAAAResource{AAAA: ip})
+		}
+	}
+	msg, _ := b.Finish()
+	return msg
+}
+
+func (f *fakeDNS) count(name string) int {
+	f.Lock()
+	defer f.Unlock()
+	return f.queries[name]
+}
+
+func (f *fakeDNS) serveUDP(conn net.PacketConn) {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		conn.WriteTo(f.answer(buf[:n], false), addr)
+	}
+}
+
+func (f *fakeDNS) serveStream(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			var l [2]byte
+			for {
+				if _, err := io.ReadFull(conn, l[:]); err != nil {
+					return
+				}
+				q := make([]byte, binary.BigEndian.Uint16(l[:]))
+				if _, err := io.ReadFull(conn, q); err != nil {
+					return
+				}
+				msg := f.answer(q, true)
+				binary.BigEndian.PutUint16(l[:], uint16(len(msg)))
+				conn.Write(append(l[:], msg...))
+			}
+		}()
+	}
+}
+
+func TestResolver(t *testing.T) {
+	f := &fakeDNS{queries: make(map[string]int)}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go f.serveUDP(pc)
+	// TCP on the same port for truncated answers
+	ln, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go f.serveStream(ln)
+
+	// a closed port first, the lookup fails over to the fake server
+	r, err := NewResolver([]string{"udp://127.0.0.1:1", pc.LocalAddr().String()}, 2, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		ips, err := r.LookupIP(ctx, "a.test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ips) != 2 || !ips[0].Equal(net.IPv4(192, 0, 2, 1)) || !ips[1].Equal(net.ParseIP("2001:db8::1")) {
+			t.Errorf("a.test resolved to %v", ips)
+		}
+	}
+	if n := f.count("a.test."); n != 2 {
+		t.Errorf("%d queries of a.test, want 2, A and AAAA, the second lookup is cached", n)
+	}
+
+	for i := 0; i < 2; i++ {
+		var dnsErr *net.DNSError
+		if _, err = r.LookupIP(ctx, "nx.test"); !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			t.Errorf("nx.test: %v, want not found", err)
+		}
+	}
+	if n := f.count("nx.test."); n != 2 {
+		t.Errorf("%d queries of nx.test, want 2, the negative answer is cached", n)
+	}
+
+	ips, err := r.LookupIP(ctx, "big.test")
+	if err != nil || len(ips) != 1 || !ips[0].Equal(net.IPv4(192, 0, 2, 2)) {
+		t.Errorf("big.test resolved to %v, %v, want 192.0.2.2 over TCP", ips, err)
+	}
+	// the cache holds 2 names, a.test was evicted
+	if _, err = r.LookupIP(ctx, "a.test"); err != nil {
+		t.Fatal(err)
+	}
+	if n := f.count("a.test."); n != 4 {
+		t.Errorf("%d queries of a.test, want 4 after its eviction", n)
+	}
+
+	if _, err = NewResolver([]string{"ftp://127.0.0.1"}, 0, 1); err == nil {
+		t.Error("unknown dns server scheme accepted")
+	}
+}
+
+func TestResolverEncrypted(t *testing.T) {
+	f := &fakeDNS{queries: make(map[string]int)}
+	doh := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		q, _ := io.ReadAll(req.Body)
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(f.answer(q, true))
+	}))
+	defer doh.Close()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: doh.TLS.Certificates})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go f.serveStream(ln)
+
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	for _, upstream := range []string{doh.URL + "/dns-query", "tls://example.com:" + port} {
+		r, err := NewResolver([]string{upstream}, 0, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		up := r.upstreams[0]
+		if up.client != nil {
+			up.client = doh.Client()
+		} else {
+			// the test certificate is for example.com and 127.0.0.1
+			up.addr = ln.Addr().String()
+			up.tls.RootCAs = doh.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+		}
+		ips, err := r.LookupIP(context.Background(), "a.test")
+		if err != nil || len(ips) != 2 {
+			t.Errorf("%s: a.test resolved to %v, %v", upstream, ips, err)
+		}
+	}
+	if n := f.count("a.test."); n != 4 {
+		t.Errorf("%d queries of a.test, want 2 by each server", n)
+	}
+}
@@ -0,0 +1,55 @@
+package shadowsocks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+)
+
+// CheckReusePort returns an error if ListenReusePort isn't supported on
+// this platform.
+func CheckReusePort() error {
+	if !reusePortSupported {
+		return errors.New("reuseport is only supported on Linux")
+	}
+	return nil
+}
+
+// ListenReusePort listens on the TCP address addr with n sockets sharing the
+// port by SO_REUSEPORT, so the kernel spreads new connections over them and
+// they're accepted in parallel. control, if not nil, is called for each
+// socket too, e.g. FastOpenListenControl. The sockets are Multipath TCP if
+// it's turned on by SetMPTCP. It's only supported on Linux.
+func ListenReusePort(network, addr string, n int, control func(network, address string, c syscall.RawConn) error) (net.Listener, error) {
+	if err := CheckReusePort(); err != nil {
+		return nil, err
+	}
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		if err := setControl(c, "setting SO_REUSEPORT", reusePort); err != nil {
+			return err
+		}
+		if control != nil {
+			return control(network, address, c)
+		}
+		return nil
+	}}
+	lc.SetMultipathTCP(MPTCP())
+	var lns []net.Listener
+	for i := 0; i < n; i++ {
+		if i == 1 {
+			// the others bind the port the first one got, if addr has
+			// port 0
+			addr = lns[0].Addr().String()
+		}
+		ln, err := lc.Listen(context.Background(), network, addr)
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return nil, err
+		}
+		lns = append(lns, ln)
+	}
+	return MultiListener(lns), nil
+}
@@ -0,0 +1,13 @@
+package shadowsocks
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+const reusePortSupported = true
+
+// reusePort lets the socket fd bind a port other sockets are bound to, the
+// kernel balances connections over them.
+func reusePort(fd uintptr) error {
+	return unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+}
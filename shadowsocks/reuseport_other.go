@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package shadowsocks
+
+import (
+	"errors"
+)
+
+const reusePortSupported = false
+
+func reusePort(fd uintptr) error {
+	return errors.New("not supported on this platform")
+}
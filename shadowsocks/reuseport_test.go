@@ -0,0 +1,40 @@
+package shadowsocks
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestListenReusePort(t *testing.T) {
+	if err := CheckReusePort(); err != nil {
+		t.Skip(err)
+	}
+	ln, err := ListenReusePort("tcp", "127.0.0.1:0", 4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 20
+	for i := 0; i < n; i++ {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+	}
+	for i := 0; i < n; i++ {
+		c, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+	}
+	ln.Close()
+	if _, err = ln.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Error("Accept after Close returned", err)
+	}
+	if c, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+		c.Close()
+		t.Error("port still accepting after Close")
+	}
+}
@@ -0,0 +1,419 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	mrand "math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Shadowsocks 2022 (SIP022) builds on the AEAD ciphers with these changes:
+//
+//   - the password is a base64 encoded key (PSK) of the cipher's key size,
+//     session subkeys are derived from it and the salt with BLAKE3
+//   - the first chunk of each direction is a fixed size header carrying the
+//     stream type, a timestamp that must be within 30 seconds of the
+//     receiver's clock and the length of the next chunk. The response header
+//     also echoes the request salt. Salts are remembered to reject replays.
+//   - the request address is followed by random padding to hide the length
+//     of the first packet
+//   - chunks carry up to 0xFFFF bytes
+//   - UDP packets belong to sessions, see udp2022
+//
+// See https://github.com/Shadowsocks-NET/shadowsocks-specs for the spec.
+
+const (
+	sip022MaxPayload = 0xFFFF
+	sip022MaxPadding = 900
+	sip022TimeSkew   = 30 * time.Second
+
+	streamTypeClient = 0
+	streamTypeServer = 1
+)
+
+// ErrBadTimestamp is returned when the timestamp of a Shadowsocks 2022
+// header is not within 30 seconds of the local clock. This happens with
+// replayed data, or if the clock of either end is off.
+var ErrBadTimestamp = errors.New("shadowsocks: timestamp out of window")
+
+var errHeader2022 = errors.New("shadowsocks: invalid 2022 header")
+
+// saltFilter2022 holds the salts of all Shadowsocks 2022 sessions, replay
+// protection is mandatory in this edition.
+var saltFilter2022 = NewReplayFilter()
+
+func decodePSK(password string, keyLen int) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(password)
+	if err != nil || len(key) != keyLen {
+		return nil, fmt.Errorf("shadowsocks: 2022 methods need a base64 encoded %d byte key as password", keyLen)
+	}
+	return key, nil
+}
+
+func checkTimestamp(ts uint64) error {
+	d := time.Since(time.Unix(int64(ts), 0))
+	if d > sip022TimeSkew || d < -sip022TimeSkew {
+		return ErrBadTimestamp
+	}
+	return nil
+}
+
+func putTimestamp(b []byte) {
+	binary.BigEndian.PutUint64(b, uint64(time.Now().Unix()))
+}
+
+// addrLen returns the length of the socks address at the start of b.
+func addrLen(b []byte) (int, error) {
+	if len(b) < idDmLen+1 {
+		return 0, errHeader2022
+	}
+	n := 0
+	switch b[idType] {
+	case typeIPv4:
+		n = lenIPv4
+	case typeIPv6:
+		n = lenIPv6
+	case typeDm:
+		n = int(b[idDmLen]) + lenDmBase
+	default:
+		return 0, AddrTypeError(b[idType])
+	}
+	if len(b) < n {
+		return 0, errHeader2022
+	}
+	return n, nil
+}
+
+// writeHeader2022 appends the header chunks of the stream to buf and returns
+// the part of b left for regular chunks. The client sends the address of the
+// request, which starts b, with padding, the server echoes the request salt.
+func (c *Conn) writeHeader2022(buf, b []byte) (_, rest []byte, err error) {
+	var first []byte
+	fixed := make([]byte, 1+8, 1+8+len(c.decSalt)+2)
+	if c.decAEAD != nil {
+		fixed[0] = streamTypeServer
+		fixed = append(fixed, c.decSalt...)
+		first, rest = b, nil
+		if len(first) > sip022MaxPayload {
+			first, rest = b[:sip022MaxPayload], b[sip022MaxPayload:]
+		}
+	} else {
+		fixed[0] = streamTypeClient
+		n, err := addrLen(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		padding := 0
+		if len(b) == n {
+			padding = 1 + mrand.Intn(sip022MaxPadding)
+		}
+		first = make([]byte, n+2+padding, n+2+padding+len(b)-n)
+		copy(first, b[:n])
+		binary.BigEndian.PutUint16(first[n:], uint16(padding))
+		rand.Read(first[n+2:])
+		rest = b[n:]
+		if room := sip022MaxPayload - len(first); len(rest) > room {
+			first, rest = append(first, rest[:room]...), rest[room:]
+		} else {
+			first, rest = append(first, rest...), nil
+		}
+	}
+	putTimestamp(fixed[1:])
+	fixed = fixed[:len(fixed)+2]
+	binary.BigEndian.PutUint16(fixed[len(fixed)-2:], uint16(len(first)))
+	buf = c.sealChunk(buf, fixed)
+	buf = c.sealChunk(buf, first)
+	return buf, rest, nil
+}
+
+// readHeader2022 reads the header chunks of the stream and returns the data
+// following them. For a request that's the address and initial payload,
+// without padding.
+func (c *Conn) readHeader2022() ([]byte, error) {
+	client := c.encAEAD != nil
+	size := 1 + 8 + 2
+	if client {
+		size += len(c.encSalt)
+	}
+	fixed, err := c.openChunk(size)
+	if err != nil {
+		return nil, err
+	}
+	if client && (fixed[0] != streamTypeServer || !bytes.Equal(fixed[9:size-2], c.encSalt)) ||
+		!client && fixed[0] != streamTypeClient {
+		return nil, errHeader2022
+	}
+	if err = checkTimestamp(binary.BigEndian.Uint64(fixed[1:])); err != nil {
+		return nil, err
+	}
+	first, err := c.openChunk(int(binary.BigEndian.Uint16(fixed[size-2:])))
+	if err != nil || client {
+		return first, err
+	}
+	n, err := addrLen(first)
+	if err != nil {
+		return nil, err
+	}
+	if len(first) < n+2 {
+		return nil, errHeader2022
+	}
+	padding := int(binary.BigEndian.Uint16(first[n:]))
+	if len(first) < n+2+padding {
+		return nil, errHeader2022
+	}
+	return append(first[:n], first[n+2+padding:]...), nil
+}
+
+// udp2022 keeps the Shadowsocks 2022 UDP sessions of a UDPConn. Each packet
+// starts with a 16 byte header of session id and packet id, encrypted with
+// the PSK as AES block. The rest is sealed with the subkey of the session
+// and the last 12 bytes of the header as nonce:
+//
+//	client: type, timestamp, padding length, padding, address, payload
+//	server: type, timestamp, client session id, padding length, padding,
+//	        address, payload
+//
+// A client UDPConn (Read/Write) has one session, a server UDPConn
+// (ReadFromUDP/WriteToUDP) has one for each client address.
+type udp2022 struct {
+	sync.Mutex
+	*Cipher
+	block     cipher.Block
+	local     *udpSession            // client side
+	remote    map[string]*udpSession // server side, by client address
+	lastPrune time.Time
+}
+
+type udpSession struct {
+	id       uint64 // our session id
+	packetID uint64
+	aead     cipher.AEAD
+
+	peerID   uint64 // session id of the other end
+	peerAEAD cipher.AEAD
+	window   packetWindow
+	lastSeen time.Time
+}
+
+const udpSessionTimeout = 120 * time.Second
+
+func newUDP2022(c *Cipher) *udp2022 {
+	// the key size has been checked by NewCipher
+	block, _ := aes.NewCipher(c.key)
+	return &udp2022{Cipher: c, block: block, remote: make(map[string]*udpSession)}
+}
+
+func (u *udp2022) newSession() (*udpSession, error) {
+	var id [8]byte
+	if _, err := io.ReadFull(rand.Reader, id[:]); err != nil {
+		return nil, err
+	}
+	aead, err := u.subkeyAEAD(id[:])
+	if err != nil {
+		return nil, err
+	}
+	return &udpSession{id: binary.BigEndian.Uint64(id[:]), aead: aead}, nil
+}
+
+// seal encrypts b, an address followed by payload, in session s.
+func (u *udp2022) seal(s *udpSession, b []byte, server bool) []byte {
+	hdr := make([]byte, 16)
+	binary.BigEndian.PutUint64(hdr, s.id)
+	binary.BigEndian.PutUint64(hdr[8:], s.packetID)
+	s.packetID++
+	body := make([]byte, 0, 1+8+8+2+len(b))
+	if server {
+		body = append(body, streamTypeServer, 0, 0, 0, 0, 0, 0, 0, 0)
+		body = binary.BigEndian.AppendUint64(body, s.peerID)
+	} else {
+		body = append(body, streamTypeClient, 0, 0, 0, 0, 0, 0, 0, 0)
+	}
+	putTimestamp(body[1:])
+	body = append(body, 0, 0) // no padding
+	body = append(body, b...)
+
+	pkt := make([]byte, 16, 16+len(body)+s.aead.Overhead())
+	u.block.Encrypt(pkt, hdr)
+	return s.aead.Seal(pkt, hdr[4:], body, nil)
+}
+
+// open decrypts pkt into dst and returns the address and payload. s is the
+// session pkt is expected in, if nil a new session is created.
+func (u *udp2022) open(s *udpSession, dst, pkt []byte, server bool) (_ *udpSession, n int, err error) {
+	if len(pkt) < 16+16+1+8+2 {
+		return s, 0, errUDPShort
+	}
+	hdr := make([]byte, 16)
+	u.block.Decrypt(hdr, pkt[:16])
+	id, packetID := binary.BigEndian.Uint64(hdr), binary.BigEndian.Uint64(hdr[8:])
+
+	aead := s.peerAEADFor(id)
+	if aead == nil {
+		if aead, err = u.subkeyAEAD(hdr[:8]); err != nil {
+			return s, 0, err
+		}
+	}
+	body, err := aead.Open(nil, hdr[4:], pkt[16:], nil)
+	if err != nil {
+		return s, 0, ErrAuth
+	}
+	want, off := byte(streamTypeClient), 1+8
+	if !server {
+		want, off = streamTypeServer, off+8
+	}
+	if body[0] != want || len(body) < off+2 {
+		return s, 0, errHeader2022
+	}
+	if err = checkTimestamp(binary.BigEndian.Uint64(body[1:])); err != nil {
+		return s, 0, err
+	}
+	if !server && (s == nil || binary.BigEndian.Uint64(body[9:]) != s.id) {
+		return s, 0, errHeader2022
+	}
+	off += 2 + int(binary.BigEndian.Uint16(body[off:]))
+	if len(body) < off {
+		return s, 0, errHeader2022
+	}
+
+	if server && (s == nil || s.peerID != id) {
+		// a new client session gets a new server session
+		if s, err = u.newSession(); err != nil {
+			return nil, 0, err
+		}
+	}
+	if s.peerAEAD == nil || s.peerID != id {
+		s.peerID, s.peerAEAD, s.window = id, aead, packetWindow{}
+	}
+	if !s.window.add(packetID) {
+		return s, 0, ErrReplay
+	}
+	s.lastSeen = time.Now()
+	return s, copy(dst, body[off:]), nil
+}
+
+func (s *udpSession) peerAEADFor(id uint64) cipher.AEAD {
+	if s != nil && s.peerAEAD != nil && s.peerID == id {
+		return s.peerAEAD
+	}
+	return nil
+}
+
+// Write sends b, an address followed by payload, as client.
+func (u *udp2022) write(conn UDP, b []byte) (int, error) {
+	u.Lock()
+	if u.local == nil {
+		s, err := u.newSession()
+		if err != nil {
+			u.Unlock()
+			return 0, err
+		}
+		u.local = s
+	}
+	pkt := u.seal(u.local, b, false)
+	u.Unlock()
+	return conn.Write(pkt)
+}
+
+func (u *udp2022) read(conn UDP, b []byte) (int, error) {
+	buf := getUDPBuf()
+	defer PutBuf(buf)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return 0, err
+	}
+	if n == len(buf) {
+		return 0, errUDPOversized
+	}
+	u.Lock()
+	defer u.Unlock()
+	if u.local == nil {
+		return 0, errHeader2022
+	}
+	_, n, err = u.open(u.local, b, buf[:n], false)
+	return n, err
+}
+
+func (u *udp2022) readFrom(conn UDP, b []byte) (n int, src *net.UDPAddr, err error) {
+	buf := getUDPBuf()
+	defer PutBuf(buf)
+	n, src, err = conn.ReadFromUDP(buf)
+	if err != nil {
+		return
+	}
+	if n == len(buf) {
+		return 0, src, errUDPOversized
+	}
+	k := src.String()
+	u.Lock()
+	defer u.Unlock()
+	u.prune()
+	s, n, err := u.open(u.remote[k], b, buf[:n], true)
+	if err == nil {
+		u.remote[k] = s
+	}
+	return
+}
+
+// writeTo sends b, an address followed by payload, to the client at dst.
+func (u *udp2022) writeTo(conn UDP, b []byte, dst *net.UDPAddr) (int, error) {
+	u.Lock()
+	s := u.remote[dst.String()]
+	if s == nil {
+		u.Unlock()
+		return 0, errHeader2022
+	}
+	pkt := u.seal(s, b, true)
+	u.Unlock()
+	return conn.WriteToUDP(pkt, dst)
+}
+
+// prune drops sessions of clients gone quiet, called with u locked.
+func (u *udp2022) prune() {
+	if time.Since(u.lastPrune) < udpSessionTimeout {
+		return
+	}
+	u.lastPrune = time.Now()
+	for k, s := range u.remote {
+		if time.Since(s.lastSeen) > udpSessionTimeout {
+			delete(u.remote, k)
+		}
+	}
+}
+
+// packetWindow rejects packet ids seen before, or too old to tell.
+type packetWindow struct {
+	init bool
+	last uint64
+	seen uint64 // bit i is set if packet last-i has been seen
+}
+
+func (w *packetWindow) add(id uint64) bool {
+	switch {
+	case !w.init || id > w.last:
+		if shift := id - w.last; !w.init || shift >= 64 {
+			w.seen = 1
+		} else {
+			w.seen = w.seen<<shift | 1
+		}
+		w.init, w.last = true, id
+		return true
+	case w.last-id >= 64:
+		return false
+	default:
+		bit := uint64(1) << (w.last - id)
+		if w.seen&bit != 0 {
+			return false
+		}
+		w.seen |= bit
+		return true
+	}
+}
@@ -0,0 +1,229 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBlake3(t *testing.T) {
+	// from the BLAKE3 test vectors, input is i%251 for i < length
+	input := func(n int) []byte {
+		b := make([]byte, n)
+		for i := range b {
+			b[i] = byte(i % 251)
+		}
+		return b
+	}
+	for _, tt := range []struct {
+		len  int
+		hash string
+	}{
+		{0, "af1349b9f5f9a1a6a0404dea36dcc9499bcb25c9adc112b7cc9a93cae41f3262"},
+		{1, "2d3adedff11b61f14c886e35afa036736dcd87a74d27b5c1510225d0f592e213"},
+		{1024, "42214739f095a406f3fc83deb889744ac00df831c10daa55189b5d121c855af7"},
+		{1025, "d00278ae47eb27b34faecf67b4fe263f82d5412916c1ffd97c8cb7fb814b8444"},
+		{2048, "e776b6028c7cd22a4d0ba182a8bf62205d2ef576467e838ed6f2529b85fba24a"},
+		{102400, "bc3e3d41a1146b069abffad3c0d44860cf664390afce4d9661f7902e7943e085"},
+	} {
+		out := make([]byte, 32)
+		blake3Hash(&blake3IV, 0, input(tt.len), out)
+		if got := hex.EncodeToString(out); got != tt.hash {
+			t.Errorf("hash of %d bytes: got %s, want %s", tt.len, got, tt.hash)
+		}
+	}
+	out := make([]byte, 32)
+	blake3DeriveKey("BLAKE3 2019-12-27 16:29:52 test vectors context", nil, out)
+	if got := hex.EncodeToString(out); got != "2cc39783c223154fea8dfb7c1b1660f2ac2dcbd1c1de8277b0b0dd39b7e50d7d" {
+		t.Error("derive_key of empty input:", got)
+	}
+}
+
+func TestNewCipher2022(t *testing.T) {
+	if _, err := NewCipher("2022-blake3-aes-256-gcm", "foobar"); err == nil {
+		t.Error("a password that isn't a base64 key should be rejected")
+	}
+	// a 16 byte key for a 32 byte cipher
+	if _, err := NewCipher("2022-blake3-aes-256-gcm", "AAAAAAAAAAAAAAAAAAAAAA=="); err == nil {
+		t.Error("a key of the wrong size should be rejected")
+	}
+	for _, method := range []string{"2022-blake3-aes-128-gcm", "2022-blake3-aes-256-gcm"} {
+		password, err := RandomPassword(method)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = NewCipher(method, password); err != nil {
+			t.Error(method, err)
+		}
+		if key, _ := base64.StdEncoding.DecodeString(password); len(key) != KeySize(method) {
+			t.Errorf("%s: %d byte key, want %d", method, len(key), KeySize(method))
+		}
+	}
+}
+
+func newCipher2022(t *testing.T) *Cipher {
+	password, _ := RandomPassword("2022-blake3-aes-256-gcm")
+	c, err := NewCipher("2022-blake3-aes-256-gcm", password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestStream2022(t *testing.T) {
+	cipher := newCipher2022(t)
+	rawaddr, _ := RawAddr("example.com:443")
+	for _, size := range []int{0, 100, 2*sip022MaxPayload + 10} {
+		payload := make([]byte, size)
+		for i := range payload {
+			payload[i] = byte(i)
+		}
+		cl, sv := net.Pipe()
+		client, server := NewConn(cl, cipher.Copy()), NewConn(sv, cipher.Copy())
+		go client.Write(append(rawaddr, payload...))
+
+		host, port, extra, err := GetRequest(server)
+		if err != nil {
+			t.Fatal(size, err)
+		}
+		if host != "example.com" || port != "443" {
+			t.Errorf("request to %s:%s", host, port)
+		}
+		got := append([]byte{}, extra...)
+		rest := make([]byte, size-len(got))
+		if _, err = io.ReadFull(server, rest); err != nil {
+			t.Fatal(size, err)
+		}
+		if !bytes.Equal(append(got, rest...), payload) {
+			t.Errorf("%d bytes: request payload differs", size)
+		}
+
+		// response
+		go server.Write([]byte(text))
+		resp := make([]byte, len(text))
+		if _, err = io.ReadFull(client, resp); err != nil {
+			t.Fatal(size, err)
+		}
+		if string(resp) != text {
+			t.Errorf("%d bytes: response differs", size)
+		}
+		cl.Close()
+		sv.Close()
+	}
+}
+
+// recordRequest returns the bytes a client sends for a request.
+func recordRequest(t *testing.T, cipher *Cipher) []byte {
+	rawaddr, _ := RawAddr("example.com:443")
+	return encryptStream(t, cipher, rawaddr)
+}
+
+func TestStream2022Replay(t *testing.T) {
+	cipher := newCipher2022(t)
+	data := recordRequest(t, cipher.Copy())
+	for i, want := range []error{nil, ErrReplay} {
+		cl, sv := net.Pipe()
+		go func() {
+			cl.Write(data)
+			cl.Close()
+		}()
+		_, _, _, err := GetRequest(NewConn(sv, cipher.Copy()))
+		if err != want {
+			t.Errorf("request %d: got %v, want %v", i, err, want)
+		}
+	}
+}
+
+func TestStream2022Timestamp(t *testing.T) {
+	cipher := newCipher2022(t)
+	// seal a request header with a stale timestamp by hand
+	c := NewConn(nil, cipher.Copy())
+	buf, _ := c.initAEADEncrypt()
+	fixed := make([]byte, 11)
+	binary.BigEndian.PutUint64(fixed[1:], uint64(time.Now().Add(-time.Minute).Unix()))
+	binary.BigEndian.PutUint16(fixed[9:], 10)
+	buf = c.sealChunk(buf, fixed)
+	buf = c.sealChunk(buf, make([]byte, 10))
+
+	cl, sv := net.Pipe()
+	go func() {
+		cl.Write(buf)
+		cl.Close()
+	}()
+	if _, _, _, err := GetRequest(NewConn(sv, cipher.Copy())); err != ErrBadTimestamp {
+		t.Error("stale request should give ErrBadTimestamp, got", err)
+	}
+}
+
+func TestUDP2022(t *testing.T) {
+	cipher := newCipher2022(t)
+	srv, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	conn, err := net.DialUDP("udp", nil, srv.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	server, client := NewUDPConn(srv, cipher.Copy()), NewUDPConn(conn, cipher.Copy())
+	srv.SetDeadline(time.Now().Add(time.Second))
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	rawaddr, _ := RawAddr("example.com:53")
+	msg := append(rawaddr, text...)
+	buf := make([]byte, 4096)
+	for i := 0; i < 2; i++ {
+		if _, err = client.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		n, src, err := server.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:n], msg) {
+			t.Error("server read differs from client write")
+		}
+		if _, err = server.WriteToUDP(msg, src); err != nil {
+			t.Fatal(err)
+		}
+		if n, err = client.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:n], msg) {
+			t.Error("client read differs from server write")
+		}
+	}
+
+	// a replayed packet is rejected
+	pkt := client.s2022.seal(client.s2022.local, msg, false)
+	for i, want := range []error{nil, ErrReplay} {
+		if _, err = conn.Write(pkt); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err = server.ReadFromUDP(buf); err != want {
+			t.Errorf("packet %d: got %v, want %v", i, err, want)
+		}
+	}
+}
+
+func TestPacketWindow(t *testing.T) {
+	var w packetWindow
+	for _, tt := range []struct {
+		id uint64
+		ok bool
+	}{
+		{0, true}, {0, false}, {2, true}, {1, true}, {1, false},
+		{100, true}, {37, true}, {36, false}, {99, true}, {2, false},
+	} {
+		if ok := w.add(tt.id); ok != tt.ok {
+			t.Errorf("add(%d) = %v, want %v", tt.id, ok, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package shadowsocks
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// A socks5 UDP datagram is RSV(2) FRAG(1) followed by the address and the
+// payload, which is exactly a shadowsocks UDP request after the header.
+const SocksUDPHeaderLen = 3
+
+var (
+	errSocksUDPShort = errors.New("socks5 udp datagram too short")
+	errSocksUDPFrag  = errors.New("fragmented socks5 udp datagram")
+)
+
+// ParseSocksUDP returns the shadowsocks UDP request carried by the socks5
+// UDP datagram b. Fragmented datagrams are not supported.
+func ParseSocksUDP(b []byte) ([]byte, error) {
+	if len(b) <= SocksUDPHeaderLen {
+		return nil, errSocksUDPShort
+	}
+	if b[2] != 0 {
+		return nil, errSocksUDPFrag
+	}
+	return b[SocksUDPHeaderLen:], nil
+}
+
+// SocksUDPRelay relays the datagrams of a socks5 UDP association through a
+// shadowsocks server. Each source address of the client gets its own NAT
+// mapping, a relay connection to the server, so applications using several
+// sockets, or QUIC changing its port, get their replies on the right one.
+type SocksUDPRelay struct {
+	conn     *net.UDPConn
+	clientIP net.IP
+	dial     func() (UDPRelayConn, error)
+
+	mu     sync.Mutex
+	nat    map[string]UDPRelayConn
+	closed bool
+}
+
+// NewSocksUDPRelay returns a relay for the association of the client at
+// clientIP, served on conn, the socket given to the client in the reply to
+// UDP ASSOCIATE. Datagrams from other hosts are dropped. dial returns a new
+// relay connection to the server.
+func NewSocksUDPRelay(conn *net.UDPConn, clientIP net.IP, dial func() (UDPRelayConn, error)) *SocksUDPRelay {
+	return &SocksUDPRelay{conn: conn, clientIP: clientIP, dial: dial, nat: make(map[string]UDPRelayConn)}
+}
+
+// Serve relays the datagrams of the client until conn is closed.
+func (r *SocksUDPRelay) Serve() error {
+	buf := GetBuf(LargeBufSize)
+	defer PutBuf(buf)
+	for {
+		n, addr, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			return err
+		}
+		if !addr.IP.Equal(r.clientIP) {
+			continue
+		}
+		req, err := ParseSocksUDP(buf[:n])
+		if err != nil {
+			logger.Debug("drop socks5 udp datagram from", addr, err)
+			udpDropped.Add(1)
+			continue
+		}
+		remote, err := r.mapping(addr)
+		if err != nil {
+			logger.Debug("udp connect to server:", err)
+			continue
+		}
+		if _, err = remote.Write(req); err != nil {
+			logger.Debug("udp write to server:", err)
+		}
+	}
+}
+
+// mapping returns the relay connection of the client address addr, dialing
+// it if needed.
+func (r *SocksUDPRelay) mapping(addr *net.UDPAddr) (UDPRelayConn, error) {
+	key := addr.String()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil, net.ErrClosed
+	}
+	if remote, ok := r.nat[key]; ok {
+		return remote, nil
+	}
+	remote, err := r.dial()
+	if err != nil {
+		return nil, err
+	}
+	r.nat[key] = remote
+	go r.relayReplies(key, addr, remote)
+	return remote, nil
+}
+
+// relayReplies sends the replies from the server to the client address to
+// with the socks5 header prepended, until the mapping is idle for the UDP
+// timeout.
+func (r *SocksUDPRelay) relayReplies(key string, to *net.UDPAddr, remote UDPRelayConn) {
+	defer func() {
+		r.mu.Lock()
+		if r.nat[key] == remote {
+			delete(r.nat, key)
+		}
+		r.mu.Unlock()
+		remote.Close()
+	}()
+	buf := GetBuf(LargeBufSize)
+	defer PutBuf(buf)
+	for {
+		remote.SetReadDeadline(time.Now().Add(natTimeout()))
+		n, err := remote.Read(buf[SocksUDPHeaderLen:])
+		if err != nil {
+			// replies that can't be decrypted or are too large are
+			// skipped, a UDP over TCP connection ends with EOF
+			var ne net.Error
+			if errors.As(err, &ne) || err == io.EOF || err == io.ErrUnexpectedEOF {
+				return
+			}
+			logger.Debug("udp read from server:", err)
+			continue
+		}
+		buf[0], buf[1], buf[2] = 0, 0, 0
+		if _, err = r.conn.WriteToUDP(buf[:SocksUDPHeaderLen+n], to); err != nil {
+			return
+		}
+	}
+}
+
+// Mappings returns the number of client addresses relayed.
+func (r *SocksUDPRelay) Mappings() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.nat)
+}
+
+// Close closes conn and the relay connections of all mappings.
+func (r *SocksUDPRelay) Close() error {
+	r.mu.Lock()
+	r.closed = true
+	for key, remote := range r.nat {
+		remote.Close()
+		delete(r.nat, key)
+	}
+	r.mu.Unlock()
+	return r.conn.Close()
+}
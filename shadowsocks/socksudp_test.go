@@ -0,0 +1,93 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseSocksUDP(t *testing.T) {
+	if _, err := ParseSocksUDP([]byte{0, 0, 0}); err != errSocksUDPShort {
+		t.Errorf("empty datagram: %v", err)
+	}
+	if _, err := ParseSocksUDP([]byte{0, 0, 1, typeIPv4}); err != errSocksUDPFrag {
+		t.Errorf("fragment: %v", err)
+	}
+	req, err := ParseSocksUDP([]byte{0, 0, 0, typeIPv4, 1})
+	if err != nil || !bytes.Equal(req, []byte{typeIPv4, 1}) {
+		t.Errorf("got %v %v", req, err)
+	}
+}
+
+func TestSocksUDPRelay(t *testing.T) {
+	allowed := UDPDestAllowed
+	UDPDestAllowed = func(domain, ip, port, openvpn string) bool { return true }
+	defer func() { UDPDestAllowed = allowed }()
+
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, addr, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(buf[:n], addr)
+		}
+	}()
+
+	cipher, err := NewCipher("aes-256-gcm", "foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	go HandleUDPConnection(NewUDPConn(srv, cipher.Copy()), "")
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay := NewSocksUDPRelay(conn, net.IPv4(127, 0, 0, 1), func() (UDPRelayConn, error) {
+		raw, err := net.DialUDP("udp", nil, srv.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			return nil, err
+		}
+		return NewUDPConn(raw, cipher.Copy()), nil
+	})
+	defer relay.Close()
+	go relay.Serve()
+
+	// each client socket gets its own mapping and its own replies
+	for i, msg := range []string{"first socket", "second socket"} {
+		c, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		dgram := append([]byte{0, 0, 0}, ParseHeader(echo.LocalAddr())...)
+		if _, err = c.Write(append(dgram, msg...)); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 4096)
+		n, err := c.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := append(dgram, msg...); !bytes.Equal(buf[:n], want) {
+			t.Errorf("got %q, want %q", buf[:n], want)
+		}
+		if m := relay.Mappings(); m != i+1 {
+			t.Errorf("%d mappings, want %d", m, i+1)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package shadowsocks
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// SourceLimiter limits what each client IP may use across all ports: open
+// TCP connections, new connections per second and UDP NAT entries. Sources
+// going over a limit, or failing handshakes repeatedly, are banned for a
+// while, when they may open nothing.
+type SourceLimiter struct {
+	sync.Mutex
+	maxConns int
+	maxNAT   int
+	banTime  time.Duration
+	rate     *RateLimiter
+
+	// bans for failed handshakes, see SetFailureBan
+	failures    int
+	failWindow  time.Duration
+	failBanTime time.Duration
+
+	conns  map[string]int
+	nat    map[string]int
+	failed map[string]*failRecord
+	swept  time.Time
+	banned map[string]time.Time // until when
+
+	// OnBan is called with each source banned and the duration of the ban,
+	// e.g. to ban it at the firewall too
+	OnBan func(ip string, d time.Duration)
+}
+
+type failRecord struct {
+	n     int
+	first time.Time
+}
+
+// NewSourceLimiter returns a limiter without limits, see SetLimits.
+func NewSourceLimiter() *SourceLimiter {
+	return &SourceLimiter{
+		rate:   NewRateLimiter(0, 0),
+		conns:  make(map[string]int),
+		nat:    make(map[string]int),
+		failed: make(map[string]*failRecord),
+		swept:  time.Now(),
+		banned: make(map[string]time.Time),
+	}
+}
+
+// SetLimits sets the max open TCP connections, new connections per second
+// and NAT entries of each source, 0 for no limit, and how long sources going
+// over a limit are banned, 0 to only reject what's over the limit.
+// Connections already open are kept.
+func (sl *SourceLimiter) SetLimits(maxConns, rate, maxNAT int, banTime time.Duration) {
+	sl.rate.SetRate(rate, 0)
+	sl.Lock()
+	sl.maxConns, sl.maxNAT, sl.banTime = maxConns, maxNAT, banTime
+	sl.clearBans()
+	sl.Unlock()
+}
+
+// SetFailureBan bans sources failing failures handshakes within window for
+// banTime, failures 0 disables it.
+func (sl *SourceLimiter) SetFailureBan(failures int, window, banTime time.Duration) {
+	sl.Lock()
+	sl.failures, sl.failWindow, sl.failBanTime = failures, window, banTime
+	if failures <= 0 {
+		sl.failed = make(map[string]*failRecord)
+	}
+	sl.clearBans()
+	sl.Unlock()
+}
+
+// clearBans lifts the bans once nothing bans, called with sl locked.
+func (sl *SourceLimiter) clearBans() {
+	if sl.banTime <= 0 && sl.failures <= 0 {
+		sl.banned = make(map[string]time.Time)
+	}
+}
+
+// Fail records a failed handshake of ip, which is banned once it fails as
+// many times as set by SetFailureBan.
+func (sl *SourceLimiter) Fail(ip string) {
+	sl.Lock()
+	defer sl.Unlock()
+	if sl.failures <= 0 {
+		return
+	}
+	now := time.Now()
+	if now.Sub(sl.swept) > sl.failWindow {
+		for k, r := range sl.failed {
+			if now.Sub(r.first) > sl.failWindow {
+				delete(sl.failed, k)
+			}
+		}
+		sl.swept = now
+	}
+	r, ok := sl.failed[ip]
+	if !ok || now.Sub(r.first) > sl.failWindow {
+		r = &failRecord{first: now}
+		sl.failed[ip] = r
+	}
+	r.n++
+	if r.n >= sl.failures {
+		delete(sl.failed, ip)
+		sl.banFor(ip, sl.failBanTime, fmt.Sprintf("%d failed handshakes", r.n))
+	}
+}
+
+// Open reports whether ip may open another TCP connection and counts it if
+// so, call Close when it's closed.
+func (sl *SourceLimiter) Open(ip string) bool {
+	sl.Lock()
+	defer sl.Unlock()
+	if sl.isBanned(ip) {
+		return false
+	}
+	if !sl.rate.Allow(ip) {
+		sl.ban(ip, "too many new connections")
+		return false
+	}
+	if sl.maxConns > 0 && sl.conns[ip] >= sl.maxConns {
+		sl.ban(ip, "too many open connections")
+		return false
+	}
+	sl.conns[ip]++
+	return true
+}
+
+// Close releases a connection of ip counted by Open.
+func (sl *SourceLimiter) Close(ip string) {
+	sl.Lock()
+	defer sl.Unlock()
+	if sl.conns[ip]--; sl.conns[ip] <= 0 {
+		delete(sl.conns, ip)
+	}
+}
+
+// OpenNAT reports whether ip may have another UDP NAT entry and counts it
+// if so, call CloseNAT when it's removed.
+func (sl *SourceLimiter) OpenNAT(ip string) bool {
+	sl.Lock()
+	defer sl.Unlock()
+	if sl.isBanned(ip) {
+		return false
+	}
+	if sl.maxNAT > 0 && sl.nat[ip] >= sl.maxNAT {
+		sl.ban(ip, "too many UDP NAT entries")
+		return false
+	}
+	sl.nat[ip]++
+	return true
+}
+
+// CloseNAT releases a NAT entry of ip counted by OpenNAT.
+func (sl *SourceLimiter) CloseNAT(ip string) {
+	sl.Lock()
+	defer sl.Unlock()
+	if sl.nat[ip]--; sl.nat[ip] <= 0 {
+		delete(sl.nat, ip)
+	}
+}
+
+// Banned returns the banned sources and until when they're banned.
+func (sl *SourceLimiter) Banned() map[string]time.Time {
+	sl.Lock()
+	defer sl.Unlock()
+	m := make(map[string]time.Time, len(sl.banned))
+	for ip := range sl.banned {
+		if sl.isBanned(ip) {
+			m[ip] = sl.banned[ip]
+		}
+	}
+	return m
+}
+
+// isBanned reports whether ip is banned, forgetting bans that expired,
+// called with sl locked.
+func (sl *SourceLimiter) isBanned(ip string) bool {
+	until, ok := sl.banned[ip]
+	if !ok {
+		return false
+	}
+	if time.Now().Before(until) {
+		return true
+	}
+	delete(sl.banned, ip)
+	return false
+}
+
+// ban bans ip for the ban time, called with sl locked.
+func (sl *SourceLimiter) ban(ip, reason string) {
+	sl.banFor(ip, sl.banTime, reason)
+}
+
+// banFor bans ip for d, called with sl locked.
+func (sl *SourceLimiter) banFor(ip string, d time.Duration, reason string) {
+	if d <= 0 {
+		return
+	}
+	sl.banned[ip] = time.Now().Add(d)
+	logger.Warnf("banning %s for %v: %s", ip, d, reason)
+	if sl.OnBan != nil {
+		go sl.OnBan(ip, d)
+	}
+}
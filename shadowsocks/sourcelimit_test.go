@@ -0,0 +1,83 @@
+package shadowsocks
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSourceLimiter(t *testing.T) {
+	sl := NewSourceLimiter()
+	for i := 0; i < 10; i++ {
+		if !sl.Open("192.0.2.1") {
+			t.Fatal("connection refused without limits")
+		}
+	}
+
+	sl = NewSourceLimiter()
+	sl.SetLimits(2, 0, 1, 0)
+	if !sl.Open("192.0.2.1") || !sl.Open("192.0.2.1") {
+		t.Fatal("connections within the limit refused")
+	}
+	if sl.Open("192.0.2.1") {
+		t.Error("connection over the limit allowed")
+	}
+	if !sl.Open("192.0.2.2") {
+		t.Error("other source refused")
+	}
+	sl.Close("192.0.2.1")
+	if !sl.Open("192.0.2.1") {
+		t.Error("connection refused after one was closed")
+	}
+	if !sl.OpenNAT("192.0.2.1") || sl.OpenNAT("192.0.2.1") {
+		t.Error("NAT entries not limited to 1")
+	}
+	sl.CloseNAT("192.0.2.1")
+	if !sl.OpenNAT("192.0.2.1") {
+		t.Error("NAT entry refused after one was removed")
+	}
+
+	// going over a limit bans the source from everything
+	sl = NewSourceLimiter()
+	sl.SetLimits(0, 1, 0, time.Hour)
+	if !sl.Open("192.0.2.1") || sl.Open("192.0.2.1") {
+		t.Fatal("connection rate not limited to 1")
+	}
+	if sl.OpenNAT("192.0.2.1") {
+		t.Error("banned source got a NAT entry")
+	}
+	if _, ok := sl.Banned()["192.0.2.1"]; !ok {
+		t.Error("source not listed as banned")
+	}
+	sl.SetLimits(0, 0, 0, 0)
+	if !sl.Open("192.0.2.1") {
+		t.Error("source still banned after bans were disabled")
+	}
+}
+
+func TestSourceLimiterFailures(t *testing.T) {
+	sl := NewSourceLimiter()
+	banned := make(chan string, 1)
+	sl.OnBan = func(ip string, d time.Duration) { banned <- ip }
+	sl.SetFailureBan(3, time.Minute, time.Hour)
+	sl.Fail("192.0.2.1")
+	sl.Fail("192.0.2.1")
+	sl.Fail("192.0.2.2")
+	if !sl.Open("192.0.2.1") {
+		t.Fatal("source banned before failing 3 times")
+	}
+	sl.Fail("192.0.2.1")
+	if sl.Open("192.0.2.1") {
+		t.Error("source failing 3 times not banned")
+	}
+	if !sl.Open("192.0.2.2") {
+		t.Error("other source banned")
+	}
+	select {
+	case ip := <-banned:
+		if ip != "192.0.2.1" {
+			t.Error("OnBan called for", ip)
+		}
+	case <-time.After(time.Second):
+		t.Error("OnBan not called")
+	}
+}
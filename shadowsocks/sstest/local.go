@@ -0,0 +1,343 @@
+package sstest
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+const (
+	socksVer5       = 5
+	socksCmdConnect = 1
+	socksCmdUDP     = 3
+)
+
+// Local is a socks5 proxy on loopback relaying through a shadowsocks server,
+// like shadowsocks-local: CONNECT through the TCP port of the server, UDP
+// ASSOCIATE through its UDP relay.
+type Local struct {
+	ln        net.Listener
+	server    string
+	cipher    *ss.Cipher
+	transport string
+	path      string
+	udp       bool
+
+	mu    sync.Mutex
+	conns map[net.Conn]bool
+	wg    sync.WaitGroup
+}
+
+// clientOf returns the method, password and transport config connects
+// with: those of its only port if it has one, else the global ones.
+func clientOf(config *ss.Config) (method, password, transport string) {
+	method, password, transport = config.Method, config.Password, config.Transport
+	if password == "" && len(config.PortPassword) == 1 {
+		for p, pw := range config.PortPassword {
+			method, password, transport = config.MethodOf(p), pw[0], config.TransportOf(p)
+		}
+	}
+	return
+}
+
+// NewLocal starts a socks5 proxy relaying through the server at server with
+// the method, password and transport of config, see StartTestLocal.
+func NewLocal(server string, config *ss.Config) (*Local, error) {
+	method, password, transport := clientOf(config)
+	if password == "" {
+		return nil, errors.New("sstest: config has no password")
+	}
+	if transport != "" && transport != ss.TransportTCP && transport != ss.TransportWS {
+		return nil, errors.New("sstest: transport " + transport + " isn't supported")
+	}
+	cipher, err := ss.NewCipher(method, password)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	l := &Local{ln: ln, server: server, cipher: cipher, transport: transport, path: config.WSPath,
+		udp: ss.UDPSupported(method), conns: make(map[net.Conn]bool)}
+	if l.path == "" {
+		l.path = "/"
+	}
+	l.wg.Add(1)
+	go l.serve()
+	return l, nil
+}
+
+// StartTestLocal starts a socks5 proxy relaying through the server at
+// serverAddr, as returned by StartTestServer, and returns its address and
+// the function stopping it. config is the one of the server, with a single
+// port. The test fails if it can't be started.
+func StartTestLocal(t testing.TB, serverAddr string, config *ss.Config) (socksAddr string, cleanup func()) {
+	l, err := NewLocal(serverAddr, config)
+	if err != nil {
+		t.Fatal("sstest: local:", err)
+	}
+	return l.Addr(), func() { l.Close() }
+}
+
+// Addr returns the address of the socks5 proxy.
+func (l *Local) Addr() string { return l.ln.Addr().String() }
+
+// Close stops the proxy and closes its connections.
+func (l *Local) Close() error {
+	err := l.ln.Close()
+	l.mu.Lock()
+	for c := range l.conns {
+		c.Close()
+	}
+	l.mu.Unlock()
+	l.wg.Wait()
+	return err
+}
+
+func (l *Local) serve() {
+	defer l.wg.Done()
+	for {
+		conn, err := l.ln.Accept()
+		if err != nil {
+			return
+		}
+		l.mu.Lock()
+		l.conns[conn] = true
+		l.mu.Unlock()
+		l.wg.Add(1)
+		go func() {
+			defer l.wg.Done()
+			l.handle(conn)
+			l.mu.Lock()
+			delete(l.conns, conn)
+			l.mu.Unlock()
+		}()
+	}
+}
+
+func (l *Local) handle(conn net.Conn) {
+	defer conn.Close()
+	cmd, addr, err := readSocksRequest(conn)
+	if err != nil {
+		return
+	}
+	switch {
+	case cmd == socksCmdConnect:
+		remote, err := dial(addr, l.server, l.transport, l.path, l.cipher.Copy())
+		if err != nil {
+			conn.Write([]byte{socksVer5, 0x05, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		if _, err = conn.Write([]byte{socksVer5, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0}); err != nil {
+			remote.Close()
+			return
+		}
+		ss.Relay(conn, remote, ss.RelayOptions{})
+	case cmd == socksCmdUDP && l.udp:
+		l.associate(conn)
+	default:
+		conn.Write([]byte{socksVer5, 0x07, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	}
+}
+
+// associate relays the datagrams of the client through the UDP relay of the
+// server until the control connection conn is closed.
+func (l *Local) associate(conn net.Conn) {
+	uc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		conn.Write([]byte{socksVer5, 0x01, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	if _, err = conn.Write(append([]byte{socksVer5, 0x00, 0x00}, ss.ParseHeader(uc.LocalAddr())...)); err != nil {
+		uc.Close()
+		return
+	}
+	relay := ss.NewSocksUDPRelay(uc, conn.RemoteAddr().(*net.TCPAddr).IP, func() (ss.UDPRelayConn, error) {
+		saddr, err := net.ResolveUDPAddr("udp", l.server)
+		if err != nil {
+			return nil, err
+		}
+		c, err := net.DialUDP("udp", nil, saddr)
+		if err != nil {
+			return nil, err
+		}
+		return ss.NewUDPConn(c, l.cipher.Copy()), nil
+	})
+	defer relay.Close()
+	go relay.Serve()
+	io.Copy(ioutil.Discard, conn)
+}
+
+// readSocksRequest reads the greeting and the request of a socks5 client,
+// accepting no authentication.
+func readSocksRequest(conn net.Conn) (cmd byte, addr string, err error) {
+	buf := make([]byte, 258)
+	if _, err = io.ReadFull(conn, buf[:2]); err != nil {
+		return
+	}
+	if buf[0] != socksVer5 {
+		return 0, "", errors.New("sstest: not socks5")
+	}
+	if _, err = io.ReadFull(conn, buf[:buf[1]]); err != nil {
+		return
+	}
+	if _, err = conn.Write([]byte{socksVer5, 0}); err != nil {
+		return
+	}
+	if _, err = io.ReadFull(conn, buf[:4]); err != nil {
+		return
+	}
+	cmd = buf[1]
+	addr, err = readSocksAddr(conn, buf[3])
+	return
+}
+
+// readSocksAddr reads an address of type atyp and its port.
+func readSocksAddr(r io.Reader, atyp byte) (string, error) {
+	var host []byte
+	switch atyp {
+	case 1:
+		host = make([]byte, net.IPv4len)
+	case 4:
+		host = make([]byte, net.IPv6len)
+	case 3:
+		n := make([]byte, 1)
+		if _, err := io.ReadFull(r, n); err != nil {
+			return "", err
+		}
+		host = make([]byte, n[0])
+	default:
+		return "", ss.AddrTypeError(atyp)
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, host); err != nil {
+		return "", err
+	}
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+	h := string(host)
+	if atyp != 3 {
+		h = net.IP(host).String()
+	}
+	return net.JoinHostPort(h, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// socksRequest sends the greeting and a request of cmd for addr to the
+// socks5 proxy conn, and returns the address of its reply.
+func socksRequest(conn net.Conn, cmd byte, addr string) (string, error) {
+	rawaddr, err := ss.RawAddr(addr)
+	if err != nil {
+		return "", err
+	}
+	if _, err = conn.Write([]byte{socksVer5, 1, 0}); err != nil {
+		return "", err
+	}
+	buf := make([]byte, 4)
+	if _, err = io.ReadFull(conn, buf[:2]); err != nil {
+		return "", err
+	}
+	if buf[0] != socksVer5 || buf[1] != 0 {
+		return "", errors.New("sstest: socks5 authentication refused")
+	}
+	if _, err = conn.Write(append([]byte{socksVer5, cmd, 0}, rawaddr...)); err != nil {
+		return "", err
+	}
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		return "", err
+	}
+	if buf[1] != 0 {
+		return "", errors.New("sstest: socks5 request failed with reply " + strconv.Itoa(int(buf[1])))
+	}
+	return readSocksAddr(conn, buf[3])
+}
+
+// DialLocal connects to addr through the socks5 proxy at socksAddr.
+func DialLocal(socksAddr, addr string) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", socksAddr, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = socksRequest(conn, socksCmdConnect, addr); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// socksPacketConn relays datagrams through a socks5 UDP association, ctrl
+// being its control connection.
+type socksPacketConn struct {
+	*net.UDPConn
+	ctrl net.Conn
+}
+
+// ListenPacketLocal returns a connection relaying datagrams through a UDP
+// association of the socks5 proxy at socksAddr: WriteTo sends to any
+// address, ReadFrom returns the datagrams of the destinations with their
+// address.
+func ListenPacketLocal(socksAddr string) (net.PacketConn, error) {
+	ctrl, err := net.DialTimeout("tcp", socksAddr, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	bnd, err := socksRequest(ctrl, socksCmdUDP, "0.0.0.0:0")
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	raddr, err := net.ResolveUDPAddr("udp", bnd)
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	uc, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	return &socksPacketConn{UDPConn: uc, ctrl: ctrl}, nil
+}
+
+func (c *socksPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	header := append([]byte{0, 0, 0}, ss.ParseHeader(addr)...)
+	if _, err := c.UDPConn.Write(append(header, b...)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// ReadFrom returns the next datagram of the association, skipping those
+// without an IP address header.
+func (c *socksPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := make([]byte, len(b)+ss.SocksUDPHeaderLen+1+net.IPv6len+2)
+	for {
+		n, err := c.UDPConn.Read(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		if n <= ss.SocksUDPHeaderLen {
+			continue
+		}
+		addr, hl := ss.ParseUDPHeader(buf[ss.SocksUDPHeaderLen:n])
+		if addr == nil {
+			continue
+		}
+		return copy(b, buf[ss.SocksUDPHeaderLen+hl:n]), addr, nil
+	}
+}
+
+// Close ends the association.
+func (c *socksPacketConn) Close() error {
+	c.ctrl.Close()
+	return c.UDPConn.Close()
+}
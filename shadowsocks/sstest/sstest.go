@@ -0,0 +1,407 @@
+// Package sstest provides helpers for integration tests of programs embedding
+// the shadowsocks library: an in-process server started from a Config, a
+// client dialer matching it, a socks5 local proxy, echo destinations and
+// traffic assertions.
+//
+//	srv, err := sstest.NewServer(&ss.Config{Method: "aes-256-cfb", Password: "foobar"})
+//	...
+//	defer srv.Close()
+//	echo := sstest.NewEchoServer(t)
+//	defer echo.Close()
+//	conn, err := srv.Dial(echo.Addr())
+//	sstest.AssertRoundTrip(t, conn, 64*1024)
+//
+// StartTestServer and StartTestLocal start both ends for a config in one
+// call, to test the round trips of applications through the socks5 proxy:
+//
+//	config := &ss.Config{Method: "chacha20-ietf-poly1305", Password: "foobar"}
+//	server, stopServer := sstest.StartTestServer(t, config)
+//	defer stopServer()
+//	local, stopLocal := sstest.StartTestLocal(t, server, config)
+//	defer stopLocal()
+//	conn, err := sstest.DialLocal(local, echo.Addr())
+//
+// The server is the one of package server, started in process with
+// server.Start, so connections go through its destination checks, quotas
+// and limits like in production. Each port of the config listens on a
+// loopback port of its own through port_listen, TCP and UDP on the same
+// number, with the UDP relay for methods supporting it. Loopback
+// destinations, where the echo servers listen, are allowed by dest_allow,
+// the other options of the config apply. The tcp and ws (v2ray-plugin in
+// websocket mode) transports are supported. A single server runs in a
+// process at a time.
+package sstest
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/shadowsocks/shadowsocks-go/server"
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+// DefaultPort is the port name of a server created from a config without
+// port_password.
+const DefaultPort = "default"
+
+// Server is a shadowsocks server listening on loopback.
+type Server struct {
+	ports map[string]*port // by port name in the config
+	stop  func()
+}
+
+type port struct {
+	key       string // port of the server config
+	addr      string // loopback address listened on
+	cipher    *ss.Cipher
+	transport string
+	path      string // of the ws transport
+	udp       bool
+	conns     int64 // closed before the server started, see Conns
+}
+
+// freePort returns a port number free for both TCP and UDP on loopback.
+func freePort() (string, error) {
+	var err error
+	for i := 0; i < 10; i++ {
+		var ln net.Listener
+		if ln, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+			return "", err
+		}
+		n := ln.Addr().(*net.TCPAddr).Port
+		var uc *net.UDPConn
+		uc, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: n})
+		ln.Close()
+		if err == nil {
+			uc.Close()
+			return strconv.Itoa(n), nil
+		}
+		// the UDP port is taken, try another
+	}
+	return "", err
+}
+
+// NewServer starts a server for config. Every entry of config.PortPassword
+// and of its tenants is served on a loopback port, use Addr and DialPort
+// with the port from the config. If PortPassword is empty, config.Password
+// is served as DefaultPort. config isn't modified.
+func NewServer(config *ss.Config) (*Server, error) {
+	c := *config
+	c.PortPassword = make(map[string][3]string)
+	c.PortListen = make(map[string][]string)
+	c.DestAllow = append(append([]string{}, config.DestAllow...), "127.0.0.0/8:*", "[::1]:*")
+	// a port that can't be bound fails NewServer right away
+	c.BindRetry = -1
+	s := &Server{ports: make(map[string]*port)}
+	add := func(name, key string) error {
+		if transport := c.TransportOf(key); transport != "" && transport != ss.TransportTCP && transport != ss.TransportWS {
+			return errors.New("sstest: transport " + transport + " isn't supported")
+		}
+		p, err := freePort()
+		if err != nil {
+			return err
+		}
+		pt := &port{key: key, addr: net.JoinHostPort("127.0.0.1", p)}
+		if st := ss.GetConnStats(key); st != nil {
+			pt.conns = st.Conns
+		}
+		c.PortListen[key] = []string{pt.addr}
+		s.ports[name] = pt
+		return nil
+	}
+	// the UDP relay runs on ports whose method supports it
+	for p, pw := range config.PortPassword {
+		if err := add(p, p); err != nil {
+			return nil, err
+		}
+		c.PortPassword[p] = [3]string{pw[0], pw[1], "ok"}
+	}
+	if len(config.Tenants) > 0 {
+		c.Tenants = make(map[string]*ss.Tenant, len(config.Tenants))
+	}
+	for name, t := range config.Tenants {
+		tc := *t
+		tc.PortPassword = make(map[string][3]string, len(t.PortPassword))
+		c.Tenants[name] = &tc
+		for p, pw := range t.PortPassword {
+			if err := add(p, p); err != nil {
+				return nil, err
+			}
+			tc.PortPassword[p] = [3]string{pw[0], pw[1], "ok"}
+		}
+	}
+	if len(s.ports) == 0 {
+		if config.Password == "" {
+			return nil, errors.New("sstest: config has no password")
+		}
+		key, err := freePort()
+		if err != nil {
+			return nil, err
+		}
+		if err = add(DefaultPort, key); err != nil {
+			return nil, err
+		}
+		c.Password = ""
+		c.PortPassword[key] = [3]string{config.Password, "", "ok"}
+	}
+	stop, err := server.Start(&c, true)
+	if err != nil {
+		return nil, fmt.Errorf("sstest: %v", err)
+	}
+	s.stop = stop
+	// Start set the defaults and merged the tenants
+	for _, pt := range s.ports {
+		method := c.MethodOf(pt.key)
+		if pt.cipher, err = ss.NewCipher(method, c.PortPassword[pt.key][0]); err != nil {
+			stop()
+			return nil, err
+		}
+		pt.transport, pt.path, pt.udp = c.TransportOf(pt.key), c.WSPath, ss.UDPSupported(method)
+	}
+	return s, nil
+}
+
+// StartTestServer starts a Server for config, which must have a single
+// port, and returns its address and the function stopping it. The test
+// fails if it can't be started.
+func StartTestServer(t testing.TB, config *ss.Config) (addr string, cleanup func()) {
+	s, err := NewServer(config)
+	if err != nil {
+		t.Fatal("sstest: server:", err)
+	}
+	if len(s.ports) != 1 {
+		s.Close()
+		t.Fatal("sstest: StartTestServer needs a config with a single port, use NewServer")
+	}
+	return s.Addr(""), func() { s.Close() }
+}
+
+// Close stops the server: its ports are closed, their connections stop
+// relaying, and the functions and options of the shadowsocks package the
+// server set are restored.
+func (s *Server) Close() error {
+	s.stop()
+	return nil
+}
+
+// Ports returns the ports of the config the server listens for, sorted.
+func (s *Server) Ports() []string {
+	ports := make([]string, 0, len(s.ports))
+	for p := range s.ports {
+		ports = append(ports, p)
+	}
+	sort.Strings(ports)
+	return ports
+}
+
+// Addr returns the address the config port is served on, or "" if the server
+// has no such port. With a single port, port may be "".
+func (s *Server) Addr(port string) string {
+	if pt := s.port(port); pt != nil {
+		return pt.addr
+	}
+	return ""
+}
+
+func (s *Server) port(p string) *port {
+	if p == "" && len(s.ports) == 1 {
+		for _, pt := range s.ports {
+			return pt
+		}
+	}
+	return s.ports[p]
+}
+
+// Dial connects to addr through the server, which must have a single port.
+func (s *Server) Dial(addr string) (net.Conn, error) {
+	return s.DialPort("", addr)
+}
+
+// DialPort connects to addr through the config port of the server, using
+// the method and password of that port.
+func (s *Server) DialPort(port, addr string) (net.Conn, error) {
+	pt := s.port(port)
+	if pt == nil {
+		return nil, errors.New("sstest: server has no port " + strconv.Quote(port))
+	}
+	return dial(addr, pt.addr, pt.transport, pt.path, pt.cipher.Copy())
+}
+
+// dial connects to addr through the server at server with transport.
+func dial(addr, server, transport, path string, cipher *ss.Cipher) (net.Conn, error) {
+	if transport != ss.TransportWS {
+		return ss.Dial(addr, server, cipher)
+	}
+	rawaddr, err := ss.RawAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := net.Dial("tcp", server)
+	if err != nil {
+		return nil, err
+	}
+	ws, err := ss.DialWS(raw, server, path)
+	if err != nil {
+		raw.Close()
+		return nil, err
+	}
+	c := ss.NewConn(ws, cipher)
+	if _, err = c.Write(rawaddr); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// ListenPacket returns a connection relaying datagrams through the UDP
+// relay of port, see ss.ListenPacket.
+func (s *Server) ListenPacket(port string) (net.PacketConn, error) {
+	pt := s.port(port)
+	if pt == nil || !pt.udp {
+		return nil, errors.New("sstest: server has no UDP relay on port " + strconv.Quote(port))
+	}
+	return ss.ListenPacket("udp", pt.addr, pt.cipher.Copy())
+}
+
+// Traffic returns the bytes relayed on port, both ways, over TCP and UDP,
+// as counted by the server for quotas. The count of a TCP relay is complete
+// once it's closed.
+func (s *Server) Traffic(port string) int64 {
+	if pt := s.port(port); pt != nil {
+		traffic, _ := ss.GetTraffic(pt.key)
+		return int64(traffic[pt.key])
+	}
+	return 0
+}
+
+// Conns returns the number of TCP relays of port the server closed.
+func (s *Server) Conns(port string) int64 {
+	if pt := s.port(port); pt != nil {
+		if st := ss.GetConnStats(pt.key); st != nil {
+			return st.Conns - pt.conns
+		}
+	}
+	return 0
+}
+
+// EchoServer is a TCP server on loopback writing back everything it reads.
+type EchoServer struct {
+	ln net.Listener
+}
+
+// NewEchoServer starts an echo server, the test fails if it can't listen.
+func NewEchoServer(t testing.TB) *EchoServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("sstest: echo server:", err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return &EchoServer{ln}
+}
+
+func (e *EchoServer) Addr() string { return e.ln.Addr().String() }
+
+func (e *EchoServer) Close() error { return e.ln.Close() }
+
+// UDPEchoServer is a UDP server on loopback sending back every datagram.
+type UDPEchoServer struct {
+	conn *net.UDPConn
+}
+
+// NewUDPEchoServer starts a UDP echo server, the test fails if it can't
+// listen.
+func NewUDPEchoServer(t testing.TB) *UDPEchoServer {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal("sstest: udp echo server:", err)
+	}
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(buf[:n], addr)
+		}
+	}()
+	return &UDPEchoServer{conn}
+}
+
+func (e *UDPEchoServer) Addr() net.Addr { return e.conn.LocalAddr() }
+
+func (e *UDPEchoServer) Close() error { return e.conn.Close() }
+
+// AssertPacketRoundTrip sends a datagram of size random bytes to addr, an
+// echo server, through pc, and checks that it comes back from addr.
+func AssertPacketRoundTrip(t testing.TB, pc net.PacketConn, addr net.Addr, size int) {
+	msg := make([]byte, size)
+	rand.Read(msg)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer pc.SetReadDeadline(time.Time{})
+	if _, err := pc.WriteTo(msg, addr); err != nil {
+		t.Fatal("sstest: write datagram:", err)
+	}
+	buf := make([]byte, size+1)
+	n, from, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal("sstest: read echoed datagram:", err)
+	}
+	if !bytes.Equal(buf[:n], msg) {
+		t.Fatal("sstest: echoed datagram differs from the one sent")
+	}
+	if from.String() != addr.String() {
+		t.Errorf("sstest: datagram echoed from %v, want %v", from, addr)
+	}
+}
+
+// AssertRoundTrip writes size random bytes to conn, which must be connected
+// to an echo server, and checks that the same bytes are read back. conn is
+// closed afterwards.
+func AssertRoundTrip(t testing.TB, conn net.Conn, size int) {
+	defer conn.Close()
+	msg := make([]byte, size)
+	rand.Read(msg)
+	errc := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(msg)
+		errc <- err
+	}()
+	got := make([]byte, size)
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal("sstest: read echo:", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal("sstest: write:", err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("sstest: data read back differs from data written")
+	}
+}
+
+// AssertTraffic checks that at least n bytes have been relayed on port of
+// the server, see Server.Traffic.
+func AssertTraffic(t testing.TB, s *Server, port string, n int64) {
+	if got := s.Traffic(port); got < n {
+		t.Errorf("sstest: port %q relayed %d bytes, want at least %d", port, got, n)
+	}
+}
@@ -0,0 +1,132 @@
+package sstest
+
+import (
+	"testing"
+	"time"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+func TestServerRoundTrip(t *testing.T) {
+	srv, err := NewServer(&ss.Config{Method: "aes-128-cfb", Password: "foobar"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	echo := NewEchoServer(t)
+	defer echo.Close()
+
+	conn, err := srv.Dial(echo.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	AssertRoundTrip(t, conn, 64*1024)
+	// traffic is counted when the relay finishes after the client closes
+	time.Sleep(100 * time.Millisecond)
+	AssertTraffic(t, srv, DefaultPort, 2*64*1024)
+	if n := srv.Conns(DefaultPort); n != 1 {
+		t.Errorf("expect 1 connection, got %d", n)
+	}
+}
+
+func TestServerPorts(t *testing.T) {
+	srv, err := NewServer(&ss.Config{
+		Method: "aes-256-cfb",
+		PortPassword: map[string][3]string{
+			"8387": {"foo"},
+			"8388": {"bar"},
+		},
+		Tenants: map[string]*ss.Tenant{
+			"acme": {Method: "chacha20", PortPassword: map[string][3]string{"8389": {"baz"}}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	echo := NewEchoServer(t)
+	defer echo.Close()
+
+	for _, port := range srv.Ports() {
+		conn, err := srv.DialPort(port, echo.Addr())
+		if err != nil {
+			t.Fatal(port, err)
+		}
+		AssertRoundTrip(t, conn, 1024)
+	}
+	if _, err := srv.DialPort("9999", echo.Addr()); err == nil {
+		t.Error("dialing unknown port should fail")
+	}
+}
+
+func TestServerUDP(t *testing.T) {
+	srv, err := NewServer(&ss.Config{Method: "aes-256-gcm", Password: "foobar"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	echo := NewUDPEchoServer(t)
+	defer echo.Close()
+
+	pc, err := srv.ListenPacket("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	AssertPacketRoundTrip(t, pc, echo.Addr(), 1200)
+	AssertPacketRoundTrip(t, pc, echo.Addr(), 10)
+}
+
+func TestServerWS(t *testing.T) {
+	srv, err := NewServer(&ss.Config{Method: "chacha20-ietf-poly1305", Password: "foobar",
+		Transport: ss.TransportWS, WSPath: "/ws"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	echo := NewEchoServer(t)
+	defer echo.Close()
+
+	conn, err := srv.Dial(echo.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	AssertRoundTrip(t, conn, 64*1024)
+
+	if _, err = NewServer(&ss.Config{Method: "aes-256-gcm", Password: "foobar", Transport: ss.TransportQUIC}); err == nil {
+		t.Error("quic transport should be refused")
+	}
+}
+
+func TestStartTestLocal(t *testing.T) {
+	echo := NewEchoServer(t)
+	defer echo.Close()
+	uecho := NewUDPEchoServer(t)
+	defer uecho.Close()
+
+	for _, config := range []*ss.Config{
+		{Method: "aes-128-gcm", Password: "foobar"},
+		{Method: "aes-256-cfb", PortPassword: map[string][3]string{"8388": {"foobar"}}},
+		{Method: "chacha20-ietf-poly1305", Password: "foobar", Transport: ss.TransportWS},
+	} {
+		server, stopServer := StartTestServer(t, config)
+		local, stopLocal := StartTestLocal(t, server, config)
+
+		conn, err := DialLocal(local, echo.Addr())
+		if err != nil {
+			t.Fatal(config.Method, err)
+		}
+		AssertRoundTrip(t, conn, 32*1024)
+
+		if ss.UDPSupported(config.Method) {
+			pc, err := ListenPacketLocal(local)
+			if err != nil {
+				t.Fatal(config.Method, err)
+			}
+			AssertPacketRoundTrip(t, pc, uecho.Addr(), 512)
+			pc.Close()
+		}
+		stopLocal()
+		stopServer()
+	}
+}
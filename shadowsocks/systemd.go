@@ -0,0 +1,105 @@
+package shadowsocks
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Under systemd, the server takes the sockets its socket units listen on
+// (socket activation) and reports its state to the service manager, see
+// sd_listen_fds(3) and sd_notify(3).
+
+// sdListenFdsStart is the first file descriptor passed by systemd.
+const sdListenFdsStart = 3
+
+// ListenFDs returns the sockets passed by systemd, keyed by "tcp/port" for
+// TCP listeners and "udp/port" for UDP sockets, nil if there are none. The
+// environment variables passing them are unset, so that child processes
+// don't take them too.
+func ListenFDs() (map[string]*os.File, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", os.Getenv("LISTEN_FDS"))
+	}
+	files := make(map[string]*os.File, n)
+	for fd := sdListenFdsStart; fd < sdListenFdsStart+n; fd++ {
+		f := os.NewFile(uintptr(fd), "systemd socket "+strconv.Itoa(fd))
+		key, err := socketKey(f)
+		if err == nil && files[key] != nil {
+			err = fmt.Errorf("another socket of %s is passed", key)
+		}
+		if err != nil {
+			f.Close()
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, fmt.Errorf("socket %d passed by systemd: %v", fd, err)
+		}
+		files[key] = f
+	}
+	return files, nil
+}
+
+// socketKey returns "tcp/port" for a TCP listener, "udp/port" for a UDP
+// socket.
+func socketKey(f *os.File) (string, error) {
+	if ln, err := net.FileListener(f); err == nil {
+		defer ln.Close()
+		if addr, ok := ln.Addr().(*net.TCPAddr); ok {
+			return "tcp/" + strconv.Itoa(addr.Port), nil
+		}
+		return "", fmt.Errorf("%s listener not supported", ln.Addr().Network())
+	}
+	if c, err := net.FilePacketConn(f); err == nil {
+		defer c.Close()
+		if addr, ok := c.LocalAddr().(*net.UDPAddr); ok {
+			return "udp/" + strconv.Itoa(addr.Port), nil
+		}
+		return "", fmt.Errorf("%s socket not supported", c.LocalAddr().Network())
+	}
+	return "", errors.New("not a TCP listener or UDP socket")
+}
+
+// SdNotify sends state, e.g. "READY=1", to the service manager, if it asks
+// for notifications by NOTIFY_SOCKET. sent is false if it doesn't.
+func SdNotify(state string) (sent bool, err error) {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return false, nil
+	}
+	// a leading @ names an abstract socket, which package net handles
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// SdWatchdog returns the watchdog timeout of the service manager, within
+// which it expects "WATCHDOG=1" again, 0 if the watchdog is off.
+func SdWatchdog() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
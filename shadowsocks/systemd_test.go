@@ -0,0 +1,106 @@
+package shadowsocks
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSocketKey(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	f, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	want := "tcp/" + strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+	if key, err := socketKey(f); err != nil || key != want {
+		t.Errorf("key of TCP listener %q %v, want %q", key, err, want)
+	}
+
+	uc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uc.Close()
+	f, err = uc.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	want = "udp/" + strconv.Itoa(uc.LocalAddr().(*net.UDPAddr).Port)
+	if key, err := socketKey(f); err != nil || key != want {
+		t.Errorf("key of UDP socket %q %v, want %q", key, err, want)
+	}
+
+	f, err = os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if key, err := socketKey(f); err == nil {
+		t.Errorf("key of %s %q", os.DevNull, key)
+	}
+}
+
+func TestListenFDsOfOtherProcess(t *testing.T) {
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	os.Setenv("LISTEN_FDS", "1")
+	files, err := ListenFDs()
+	if files != nil || err != nil {
+		t.Errorf("sockets of another process taken: %v %v", files, err)
+	}
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Error("LISTEN_FDS not unset")
+	}
+}
+
+func TestSdNotify(t *testing.T) {
+	os.Unsetenv("NOTIFY_SOCKET")
+	if sent, err := SdNotify("READY=1"); sent || err != nil {
+		t.Errorf("notified without NOTIFY_SOCKET: %v %v", sent, err)
+	}
+
+	name := filepath.Join(t.TempDir(), "notify")
+	c, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		t.Skip("unixgram not supported:", err)
+	}
+	defer c.Close()
+	os.Setenv("NOTIFY_SOCKET", name)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+	if sent, err := SdNotify("READY=1"); !sent || err != nil {
+		t.Fatalf("not notified: %v %v", sent, err)
+	}
+	buf := make([]byte, 64)
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := c.Read(buf)
+	if err != nil || string(buf[:n]) != "READY=1" {
+		t.Errorf("received %q %v", buf[:n], err)
+	}
+}
+
+func TestSdWatchdog(t *testing.T) {
+	defer os.Unsetenv("WATCHDOG_USEC")
+	defer os.Unsetenv("WATCHDOG_PID")
+	os.Setenv("WATCHDOG_USEC", "30000000")
+	if d := SdWatchdog(); d != 30*time.Second {
+		t.Errorf("watchdog timeout %v, want 30s", d)
+	}
+	os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	if d := SdWatchdog(); d != 0 {
+		t.Errorf("watchdog of another process %v", d)
+	}
+	os.Unsetenv("WATCHDOG_PID")
+	os.Setenv("WATCHDOG_USEC", "0")
+	if d := SdWatchdog(); d != 0 {
+		t.Errorf("watchdog timeout %v with WATCHDOG_USEC=0", d)
+	}
+}
@@ -0,0 +1,30 @@
+package shadowsocks
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// tcpInfo returns the smoothed rtt in microseconds and the send MSS of c.
+func tcpInfo(c net.Conn) (rtt, mss uint32, ok bool) {
+	tc, isTCP := c.(*net.TCPConn)
+	if !isTCP {
+		return
+	}
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		return
+	}
+	raw.Control(func(fd uintptr) {
+		info, err := unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+		if err == nil {
+			rtt, mss, ok = info.Rtt, info.Snd_mss, true
+		}
+	})
+	return
+}
+
+func init() {
+	RegisterFeature("tcpinfo")
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package shadowsocks
+
+import (
+	"net"
+)
+
+func tcpInfo(c net.Conn) (rtt, mss uint32, ok bool) {
+	return
+}
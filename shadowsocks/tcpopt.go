@@ -0,0 +1,103 @@
+package shadowsocks
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+var tcpOptions atomic.Value // TCPOptions, set by SetTCPOptions
+
+func init() {
+	tcpOptions.Store(TCPOptions{})
+}
+
+// SetTCPOptions sets the socket options ApplyTCPOptions applies, nil keeps
+// the defaults.
+func SetTCPOptions(o *TCPOptions) error {
+	if err := CheckTCPOptions(o); err != nil {
+		return err
+	}
+	var v TCPOptions
+	if o != nil {
+		v = *o
+	}
+	tcpOptions.Store(v)
+	return nil
+}
+
+// CheckTCPOptions returns an error if o has invalid values, or options not
+// supported on this platform.
+func CheckTCPOptions(o *TCPOptions) error {
+	if o == nil {
+		return nil
+	}
+	if o.KeepAlive < -1 || o.SendBuffer < 0 || o.RecvBuffer < 0 || o.UserTimeout < 0 {
+		return errors.New("tcp: negative keepalive, buffer size or user timeout")
+	}
+	if o.UserTimeout > 0 && !userTimeoutSupported {
+		return errors.New("tcp: user_timeout is only supported on Linux")
+	}
+	return nil
+}
+
+// tcpConnOf returns the TCP connection under c, through wrappers which
+// return it by NetConn, like *tls.Conn.
+func tcpConnOf(c net.Conn) *net.TCPConn {
+	for {
+		switch v := c.(type) {
+		case *net.TCPConn:
+			return v
+		case interface{ NetConn() net.Conn }:
+			c = v.NetConn()
+		default:
+			return nil
+		}
+	}
+}
+
+// ApplyTCPOptions sets the socket options of SetTCPOptions on c, accepted
+// or dialed. Connections which aren't TCP are left alone.
+func ApplyTCPOptions(c net.Conn) {
+	o := tcpOptions.Load().(TCPOptions)
+	if o == (TCPOptions{}) {
+		return
+	}
+	tc := tcpConnOf(c)
+	if tc == nil {
+		return
+	}
+	var err error
+	set := func(e error) {
+		if err == nil {
+			err = e
+		}
+	}
+	switch {
+	case o.KeepAlive < 0:
+		set(tc.SetKeepAlive(false))
+	case o.KeepAlive > 0:
+		set(tc.SetKeepAlive(true))
+		set(tc.SetKeepAlivePeriod(time.Duration(o.KeepAlive) * time.Second))
+	}
+	if o.NoDelay != nil {
+		set(tc.SetNoDelay(*o.NoDelay))
+	}
+	if o.SendBuffer > 0 {
+		set(tc.SetWriteBuffer(o.SendBuffer))
+	}
+	if o.RecvBuffer > 0 {
+		set(tc.SetReadBuffer(o.RecvBuffer))
+	}
+	if o.UserTimeout > 0 {
+		if raw, e := tc.SyscallConn(); e == nil {
+			set(setControl(raw, "setting TCP_USER_TIMEOUT", func(fd uintptr) error {
+				return setUserTimeout(fd, o.UserTimeout)
+			}))
+		}
+	}
+	if err != nil {
+		logger.Debugf("error setting socket options of %s: %v", c.RemoteAddr(), err)
+	}
+}
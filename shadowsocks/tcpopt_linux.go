@@ -0,0 +1,13 @@
+package shadowsocks
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+const userTimeoutSupported = true
+
+// setUserTimeout sets the milliseconds sent data of the socket fd may stay
+// unacknowledged before the connection is dropped.
+func setUserTimeout(fd uintptr, ms int) error {
+	return unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, ms)
+}
@@ -0,0 +1,60 @@
+package shadowsocks
+
+import (
+	"net"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestTCPOptions(t *testing.T) {
+	for _, bad := range []*TCPOptions{{KeepAlive: -2}, {SendBuffer: -1}, {UserTimeout: -1}} {
+		if err := SetTCPOptions(bad); err == nil {
+			t.Errorf("%+v accepted", *bad)
+		}
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err == nil {
+			defer c.Close()
+			c.Read(make([]byte, 1))
+		}
+	}()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	noDelay := false
+	o := &TCPOptions{KeepAlive: 30, NoDelay: &noDelay, RecvBuffer: 1 << 18, UserTimeout: 5000}
+	if err = SetTCPOptions(o); err != nil {
+		t.Fatal(err)
+	}
+	defer SetTCPOptions(nil)
+	// found under wrappers
+	ApplyTCPOptions(&proxyConn{Conn: c, remote: c.RemoteAddr()})
+
+	raw, err := c.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw.Control(func(fd uintptr) {
+		if v, _ := syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_NODELAY); v != 0 {
+			t.Error("TCP_NODELAY still set")
+		}
+		// Linux doubles the size for its bookkeeping
+		if v, _ := syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF); v < 1<<18 {
+			t.Errorf("SO_RCVBUF %d", v)
+		}
+		if v, _ := syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, unix.TCP_USER_TIMEOUT); v != 5000 {
+			t.Errorf("TCP_USER_TIMEOUT %d", v)
+		}
+	})
+}
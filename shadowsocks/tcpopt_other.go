@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package shadowsocks
+
+import (
+	"errors"
+)
+
+const userTimeoutSupported = false
+
+func setUserTimeout(fd uintptr, ms int) error {
+	return errors.New("not supported on this platform")
+}
@@ -0,0 +1,369 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	mrand "math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Spans of the operations of a connection are exported to an OpenTelemetry
+// collector with OTLP over HTTP, JSON encoded, so the latency of each step
+// can be followed across servers. A trace is started for a sampled part of
+// the connections, operations of connections not traced get a nil *Span,
+// whose methods do nothing.
+
+// Kinds of spans.
+const (
+	SpanInternal = 1
+	SpanServer   = 2
+	SpanClient   = 3
+)
+
+const (
+	traceFlushInterval = 5 * time.Second
+	// ended spans kept for export, more are dropped
+	traceQueueMax = 4096
+	// spans posted at once
+	traceBatchMax = 512
+)
+
+var traceDropped = expvar.NewInt("trace_spans_dropped")
+
+// tracing is the exporter, set by SetTracing.
+var tracing = struct {
+	sync.Mutex
+	endpoint string // URL spans are posted to, "" if tracing is off
+	rate     float64
+	resource []traceAttr
+	queue    []*Span
+	started  bool
+}{}
+
+var traceClient = &http.Client{Timeout: 10 * time.Second}
+
+// CheckTraceEndpoint checks the URL of an OTLP/HTTP collector.
+func CheckTraceEndpoint(endpoint string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return fmt.Errorf("trace_endpoint: %v", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("trace_endpoint %s is not an http or https URL", u.Redacted())
+	}
+	return nil
+}
+
+// SetTracing exports spans of service to the OTLP/HTTP collector at
+// endpoint, e.g. http://127.0.0.1:4318, tracing the given fraction of
+// connections. An empty endpoint turns tracing off.
+func SetTracing(endpoint string, sampleRate float64, service string) error {
+	if sampleRate < 0 || sampleRate > 1 {
+		return errors.New("trace_sample_rate must be between 0 and 1")
+	}
+	if endpoint != "" {
+		if err := CheckTraceEndpoint(endpoint); err != nil {
+			return err
+		}
+		if !strings.HasSuffix(endpoint, "/v1/traces") {
+			endpoint = strings.TrimSuffix(endpoint, "/") + "/v1/traces"
+		}
+	}
+	resource := []traceAttr{{"service.name", service}}
+	if host, err := os.Hostname(); err == nil {
+		resource = append(resource, traceAttr{"host.name", host})
+	}
+	tracing.Lock()
+	defer tracing.Unlock()
+	tracing.endpoint, tracing.rate, tracing.resource = endpoint, sampleRate, resource
+	if endpoint == "" {
+		tracing.queue = nil
+	} else if !tracing.started {
+		tracing.started = true
+		go exportSpans()
+	}
+	return nil
+}
+
+type traceAttr struct {
+	key   string
+	value interface{}
+}
+
+// Span is an operation of a traced connection, exported when it ends.
+type Span struct {
+	mu         sync.Mutex
+	traceID    [16]byte
+	spanID     [8]byte
+	parentID   [8]byte // zero for the root
+	name       string
+	kind       int
+	start, end time.Time
+	attrs      []traceAttr
+	err        string
+}
+
+type spanKey struct{}
+
+// StartTrace starts the root span of a trace of a sampled connection, nil
+// if it isn't traced. ctx carries it to the spans of its operations.
+func StartTrace(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	tracing.Lock()
+	on := tracing.endpoint != "" && mrand.Float64() < tracing.rate
+	tracing.Unlock()
+	if !on {
+		return ctx, nil
+	}
+	s := &Span{name: name, kind: kind, start: time.Now()}
+	rand.Read(s.traceID[:])
+	rand.Read(s.spanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// StartSpan starts a span of an operation of the trace of ctx, nil if
+// there's none.
+func StartSpan(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	parent, _ := ctx.Value(spanKey{}).(*Span)
+	s := parent.child(name, kind, time.Now())
+	if s == nil {
+		return ctx, nil
+	}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// child returns a span of s started at start.
+func (s *Span) child(name string, kind int, start time.Time) *Span {
+	if s == nil {
+		return nil
+	}
+	c := &Span{traceID: s.traceID, parentID: s.spanID, name: name, kind: kind, start: start}
+	rand.Read(c.spanID[:])
+	return c
+}
+
+// SetAttr sets an attribute of s, value being a string, bool or integer.
+func (s *Span) SetAttr(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attrs = append(s.attrs, traceAttr{key, value})
+	s.mu.Unlock()
+}
+
+// SetError marks s failed with err, if it's not nil.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.err = err.Error()
+	s.mu.Unlock()
+}
+
+// setStart moves the start of s back to t, for operations traced once
+// they turn out to start a trace.
+func (s *Span) setStart(t time.Time) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.start = t
+	s.mu.Unlock()
+}
+
+// End ends s and queues it for export.
+func (s *Span) End() {
+	s.endAt(time.Now())
+}
+
+func (s *Span) endAt(t time.Time) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if !s.end.IsZero() {
+		s.mu.Unlock()
+		return
+	}
+	s.end = t
+	s.mu.Unlock()
+	tracing.Lock()
+	defer tracing.Unlock()
+	if tracing.endpoint == "" {
+		return
+	}
+	if len(tracing.queue) >= traceQueueMax {
+		traceDropped.Add(1)
+		return
+	}
+	tracing.queue = append(tracing.queue, s)
+}
+
+// exportSpans posts the ended spans every traceFlushInterval.
+func exportSpans() {
+	for {
+		time.Sleep(traceFlushInterval)
+		FlushTraces()
+	}
+}
+
+// FlushTraces posts the ended spans now, those that can't be posted are
+// dropped.
+func FlushTraces() {
+	for {
+		tracing.Lock()
+		endpoint, resource := tracing.endpoint, tracing.resource
+		batch := tracing.queue
+		if len(batch) > traceBatchMax {
+			batch = batch[:traceBatchMax]
+		}
+		tracing.queue = tracing.queue[len(batch):]
+		tracing.Unlock()
+		if len(batch) == 0 || endpoint == "" {
+			return
+		}
+		if err := postSpans(endpoint, resource, batch); err != nil {
+			logger.Warnf("error exporting %d spans to %s: %v", len(batch), redactedURL(endpoint), err)
+			traceDropped.Add(int64(len(batch)))
+			return
+		}
+	}
+}
+
+func redactedURL(s string) string {
+	if u, err := url.Parse(s); err == nil {
+		return u.Redacted()
+	}
+	return s
+}
+
+// The OTLP/JSON encoding of an ExportTraceServiceRequest, ids are hex and
+// 64 bit integers decimal strings.
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+	IntValue    string  `json:"intValue,omitempty"`
+}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID      string      `json:"traceId"`
+	SpanID       string      `json:"spanId"`
+	ParentSpanID string      `json:"parentSpanId,omitempty"`
+	Name         string      `json:"name"`
+	Kind         int         `json:"kind"`
+	Start        string      `json:"startTimeUnixNano"`
+	End          string      `json:"endTimeUnixNano"`
+	Attributes   []otlpAttr  `json:"attributes,omitempty"`
+	Status       *otlpStatus `json:"status,omitempty"`
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttr `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+func otlpAttrs(attrs []traceAttr) []otlpAttr {
+	var l []otlpAttr
+	for _, a := range attrs {
+		var v otlpValue
+		switch x := a.value.(type) {
+		case string:
+			v.StringValue = &x
+		case bool:
+			v.BoolValue = &x
+		case int:
+			v.IntValue = strconv.Itoa(x)
+		case int64:
+			v.IntValue = strconv.FormatInt(x, 10)
+		default:
+			s := fmt.Sprint(x)
+			v.StringValue = &s
+		}
+		l = append(l, otlpAttr{a.key, v})
+	}
+	return l
+}
+
+func (s *Span) otlp() otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o := otlpSpan{
+		TraceID:    hex.EncodeToString(s.traceID[:]),
+		SpanID:     hex.EncodeToString(s.spanID[:]),
+		Name:       s.name,
+		Kind:       s.kind,
+		Start:      strconv.FormatInt(s.start.UnixNano(), 10),
+		End:        strconv.FormatInt(s.end.UnixNano(), 10),
+		Attributes: otlpAttrs(s.attrs),
+	}
+	if s.parentID != [8]byte{} {
+		o.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	if s.err != "" {
+		o.Status = &otlpStatus{Code: 2, Message: s.err}
+	}
+	return o
+}
+
+// postSpans posts spans of the resource to endpoint.
+func postSpans(endpoint string, resource []traceAttr, spans []*Span) error {
+	scope := otlpScopeSpans{}
+	scope.Scope.Name = "github.com/shadowsocks/shadowsocks-go"
+	for _, s := range spans {
+		scope.Spans = append(scope.Spans, s.otlp())
+	}
+	rs := otlpResourceSpans{ScopeSpans: []otlpScopeSpans{scope}}
+	rs.Resource.Attributes = otlpAttrs(resource)
+	body, err := json.Marshal(&otlpRequest{[]otlpResourceSpans{rs}})
+	if err != nil {
+		return err
+	}
+	resp, err := traceClient.Post(endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package shadowsocks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTracing(t *testing.T) {
+	got := make(chan otlpRequest, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			t.Errorf("spans posted to %s", r.URL.Path)
+		}
+		var req otlpRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		got <- req
+	}))
+	defer collector.Close()
+	defer SetTracing("", 0, "")
+
+	if err := SetTracing(collector.URL, 0, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, span := StartTrace(context.Background(), "connection", SpanServer); span != nil {
+		t.Error("connection traced with sample rate 0")
+	}
+	if _, span := StartSpan(context.Background(), "dial", SpanClient); span != nil {
+		t.Error("span started without a trace")
+	}
+
+	if err := SetTracing(collector.URL, 1, "test"); err != nil {
+		t.Fatal(err)
+	}
+	ctx, root := StartTrace(context.Background(), "connection", SpanServer)
+	root.SetAttr("ss.port", "8388")
+	_, dial := StartSpan(ctx, "dial", SpanClient)
+	dial.SetError(errors.New("refused"))
+	dial.End()
+	root.End()
+	FlushTraces()
+
+	req := <-got
+	if len(req.ResourceSpans) != 1 || len(req.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("got %+v", req)
+	}
+	if a := req.ResourceSpans[0].Resource.Attributes; len(a) == 0 || *a[0].Value.StringValue != "test" {
+		t.Errorf("resource attributes %+v", a)
+	}
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want 2", len(spans))
+	}
+	d, c := spans[0], spans[1]
+	if c.Name != "connection" || c.ParentSpanID != "" || c.Kind != SpanServer || len(c.TraceID) != 32 {
+		t.Errorf("root span %+v", c)
+	}
+	if len(c.Attributes) != 1 || c.Attributes[0].Key != "ss.port" || *c.Attributes[0].Value.StringValue != "8388" {
+		t.Errorf("root span attributes %+v", c.Attributes)
+	}
+	if d.Name != "dial" || d.TraceID != c.TraceID || d.ParentSpanID != c.SpanID {
+		t.Errorf("dial span %+v is not a child of %+v", d, c)
+	}
+	if d.Status == nil || d.Status.Code != 2 || d.Status.Message != "refused" {
+		t.Errorf("dial span status %+v", d.Status)
+	}
+
+	if err := SetTracing("ftp://example.com", 1, "test"); err == nil {
+		t.Error("ftp endpoint accepted")
+	}
+	if err := SetTracing(collector.URL, 2, "test"); err == nil {
+		t.Error("sample rate 2 accepted")
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"crypto/tls"
 	"encoding/json"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
 	"sync"
@@ -12,7 +11,8 @@ import (
 )
 
 var (
-	ts *trafficStat
+	// counters of the ports, those of ports without one are dropped
+	ts = &trafficStat{m: make(map[string]*trafficStruct, 100)}
 
 	tr     = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
 	client = &http.Client{Transport: tr}
@@ -21,15 +21,25 @@ var (
 type trafficStruct struct {
 	Traffic  int
 	ClientIP string
+
+	// bytes used since the quota was last reset, unlike Traffic this isn't
+	// cleared when traffic is reported
+	used     int64
+	quota    int64 // 0 for no quota
+	exceeded bool
 }
 
+// QuotaExceeded is called when a port uses up its quota. The server sets it
+// to close the port.
+var QuotaExceeded = func(port string) {}
+
 type trafficStat struct {
 	sync.Mutex
 	m map[string]*trafficStruct
 }
 
+// NewTraffic starts reporting the traffic of the ports.
 func NewTraffic() {
-	ts = &trafficStat{m: make(map[string]*trafficStruct, 100)}
 	go sendTraffic()
 }
 
@@ -38,11 +48,70 @@ func upTraffic(port string, traffic int, ip string) {
 	defer ts.Unlock()
 
 	if st, ok := ts.m[port]; ok {
+		addUsage(port, "", traffic)
 		st.Traffic += traffic
 		if ip != "" {
 			st.ClientIP = ip
 		}
+		st.used += int64(traffic)
+		if st.quota > 0 && st.used >= st.quota && !st.exceeded {
+			st.exceeded = true
+			go QuotaExceeded(port)
+		}
+	}
+}
+
+// SetQuota limits the traffic of port to quota bytes, 0 removes the limit.
+// Traffic used so far is kept.
+func SetQuota(port string, quota int64) {
+	ts.Lock()
+	defer ts.Unlock()
+
+	st, ok := ts.m[port]
+	if !ok {
+		st = &trafficStruct{}
+		ts.m[port] = st
+	}
+	st.quota = quota
+	if quota <= 0 || st.used < quota {
+		st.exceeded = false
+	} else if !st.exceeded {
+		// e.g. traffic restored after a restart used it up
+		st.exceeded = true
+		go QuotaExceeded(port)
+	}
+}
+
+// ResetQuota clears the traffic used by port against its quota.
+func ResetQuota(port string) {
+	ts.Lock()
+	defer ts.Unlock()
+
+	if st, ok := ts.m[port]; ok {
+		st.used = 0
+		st.exceeded = false
+	}
+}
+
+// GetQuota returns the traffic used by port since the quota was reset and
+// its quota, 0 if it has none.
+func GetQuota(port string) (used, quota int64) {
+	ts.Lock()
+	defer ts.Unlock()
+
+	if st, ok := ts.m[port]; ok {
+		return st.used, st.quota
 	}
+	return 0, 0
+}
+
+// OverQuota reports whether port has used up its quota.
+func OverQuota(port string) bool {
+	ts.Lock()
+	defer ts.Unlock()
+
+	st, ok := ts.m[port]
+	return ok && st.exceeded
 }
 
 func DelTraffic(port string) {
@@ -61,6 +130,27 @@ func AddTraffic(port string) {
 	}
 }
 
+// GetTraffic returns the traffic of the given ports, or of all ports if none
+// is given, along with the total.
+func GetTraffic(ports ...string) (m map[string]int, total int) {
+	ts.Lock()
+	defer ts.Unlock()
+
+	m = make(map[string]int)
+	if len(ports) == 0 {
+		for port := range ts.m {
+			ports = append(ports, port)
+		}
+	}
+	for _, port := range ports {
+		if st, ok := ts.m[port]; ok {
+			m[port] = st.Traffic
+			total += st.Traffic
+		}
+	}
+	return
+}
+
 func sendTraffic() {
 	for {
 		time.Sleep(30 * time.Second)
@@ -73,7 +163,7 @@ func sendTraffic() {
 		buf, err := json.Marshal(ts.m)
 		ts.Unlock()
 		if err != nil {
-			log.Println(err)
+			logger.Error(err)
 			continue
 		}
 
@@ -83,9 +173,9 @@ func sendTraffic() {
 			resp.Body.Close()
 			if string(cont) != "success" {
 				if err != nil {
-					log.Println(err)
+					logger.Warn(err)
 				} else {
-					log.Printf("%s\n", cont)
+					logger.Warnf("%s", cont)
 				}
 				continue
 			}
@@ -95,7 +185,7 @@ func sendTraffic() {
 			}
 			ts.Unlock()
 
-			Debug.Println("Update Traffic Stat Success")
+			logger.Debug("Update Traffic Stat Success")
 		}
 	}
 }
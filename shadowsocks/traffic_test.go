@@ -0,0 +1,110 @@
+package shadowsocks
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestQuota(t *testing.T) {
+	savedHook := QuotaExceeded
+	defer func() { QuotaExceeded = savedHook }()
+	exceeded := make(chan string, 2)
+	QuotaExceeded = func(port string) { exceeded <- port }
+	defer DelTraffic("8388")
+
+	AddTraffic("8388")
+	SetQuota("8388", 1000)
+	upTraffic("8388", 600, "")
+	if OverQuota("8388") {
+		t.Error("port is over quota before using it up")
+	}
+	upTraffic("8388", 600, "")
+	upTraffic("8388", 600, "")
+	select {
+	case port := <-exceeded:
+		if port != "8388" {
+			t.Error("QuotaExceeded called for", port)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("QuotaExceeded not called")
+	}
+	if used, quota := GetQuota("8388"); !OverQuota("8388") || used != 1800 || quota != 1000 {
+		t.Errorf("got used %d of %d, over quota %v", used, quota, OverQuota("8388"))
+	}
+
+	// reporting traffic doesn't reset the quota
+	ts.Lock()
+	ts.m["8388"].Traffic = 0
+	ts.Unlock()
+	if used, _ := GetQuota("8388"); used != 1800 {
+		t.Error("used traffic changed to", used)
+	}
+
+	ResetQuota("8388")
+	if used, _ := GetQuota("8388"); OverQuota("8388") || used != 0 {
+		t.Error("quota not reset")
+	}
+	// raising the quota above the used traffic lifts the limit too
+	upTraffic("8388", 1200, "")
+	<-exceeded
+	SetQuota("8388", 2000)
+	if OverQuota("8388") {
+		t.Error("port over quota after raising it")
+	}
+	if len(exceeded) != 0 {
+		t.Error("QuotaExceeded called once more")
+	}
+}
+
+func TestUDPQuota(t *testing.T) {
+	allowed, savedHook := UDPDestAllowed, QuotaExceeded
+	defer func() { UDPDestAllowed, QuotaExceeded = allowed, savedHook }()
+	UDPDestAllowed = func(domain, ip, port, openvpn string) bool { return true }
+	exceeded := make(chan string, 1)
+	QuotaExceeded = func(port string) { exceeded <- port }
+
+	// the destination never replies, only uploads are relayed
+	sink, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	cipher, err := NewCipher("aes-128-gcm", "foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	port := strconv.Itoa(srv.LocalAddr().(*net.UDPAddr).Port)
+	AddTraffic(port)
+	defer DelTraffic(port)
+	SetQuota(port, 1000)
+	go HandleUDPConnection(NewUDPConn(srv, cipher.Copy()), "")
+
+	conn, err := net.DialUDP("udp", nil, srv.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := NewUDPConn(conn, cipher.Copy())
+	msg := append(ParseHeader(sink.LocalAddr()), make([]byte, 500)...)
+	for i := 0; i < 3; i++ {
+		if _, err = c.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case p := <-exceeded:
+		if p != port {
+			t.Errorf("QuotaExceeded called for %s, want server port %s", p, port)
+		}
+	case <-time.After(5 * time.Second):
+		used, _ := GetQuota(port)
+		t.Fatalf("QuotaExceeded not called, %d bytes used", used)
+	}
+}
@@ -0,0 +1,70 @@
+package shadowsocks
+
+import "fmt"
+
+// Transports carry the shadowsocks stream between client and server, the
+// transport option of both ends must match.
+const (
+	TransportTCP  = "tcp"  // plain TCP, the default
+	TransportWS   = "ws"   // WebSocket, see websocket.go
+	TransportTLS  = "tls"  // TLS
+	TransportWSS  = "wss"  // WebSocket over TLS
+	TransportQUIC = "quic" // QUIC streams, see quic.go
+	TransportKCP  = "kcp"  // streams of kcptun, see kcpconn.go
+)
+
+// CheckTransport returns an error if transport isn't supported, "" is
+// TransportTCP.
+func CheckTransport(transport string) error {
+	switch transport {
+	case "", TransportTCP, TransportWS, TransportTLS, TransportWSS, TransportQUIC, TransportKCP:
+		return nil
+	}
+	return fmt.Errorf("unsupported transport %q, must be tcp, ws, tls, wss, quic or kcp", transport)
+}
+
+// IsWS reports whether transport carries the stream in WebSocket messages.
+func IsWS(transport string) bool {
+	return transport == TransportWS || transport == TransportWSS
+}
+
+// IsTLS reports whether transport runs over TLS.
+func IsTLS(transport string) bool {
+	return transport == TransportTLS || transport == TransportWSS
+}
+
+// OverUDP reports whether transport listens on the UDP port, which the UDP
+// relay can't use then.
+func OverUDP(transport string) bool {
+	return transport == TransportQUIC || transport == TransportKCP
+}
+
+// Transports returns the transports config uses, on all ports or some.
+func (config *Config) Transports() map[string]bool {
+	used := map[string]bool{config.Transport: true}
+	for _, t := range config.PortTransport {
+		used[t] = true
+	}
+	if used[""] {
+		delete(used, "")
+		used[TransportTCP] = true
+	}
+	return used
+}
+
+// CheckTransports returns an error if a transport of config isn't supported,
+// or the kcp parameters are invalid when it's used.
+func (config *Config) CheckTransports() error {
+	if err := CheckTransport(config.Transport); err != nil {
+		return err
+	}
+	for port, t := range config.PortTransport {
+		if err := CheckTransport(t); err != nil {
+			return fmt.Errorf("port %s: %v", port, err)
+		}
+	}
+	if config.Transports()[TransportKCP] {
+		return CheckKCP(config.KCP)
+	}
+	return nil
+}
@@ -0,0 +1,281 @@
+package shadowsocks
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// UDP over TCP carries the UDP relay in a shadowsocks connection, for
+// networks blocking UDP. It's the protocol of sing-box: the client connects
+// with UoTHost as destination, then sends a request, whether the connection
+// is connected to one destination (1 byte) and the address of the
+// destination. Packets are the address, a 2 byte length and the payload in
+// both directions, without the address on connected connections. Version 1,
+// with UoTHostV1 as destination, has no request and always has the address.
+
+// UoTHost and UoTHostV1 are the destinations of UDP over TCP connections
+// of version 2 and 1, which servers only accept with uot enabled.
+const (
+	UoTHost   = "sp.v2.udp-over-tcp.arpa"
+	UoTHostV1 = "sp.udp-over-tcp.arpa"
+)
+
+var errUoTDest = errors.New("uot: destination not allowed")
+
+// UDPRelayConn carries UDP relay requests to a server, the address of the
+// destination followed by the payload, and its replies back. *UDPConn
+// is one, as are UDP over TCP connections.
+type UDPRelayConn interface {
+	Read(b []byte) (int, error)
+	Write(b []byte) (int, error)
+	SetReadDeadline(t time.Time) error
+	Close() error
+}
+
+// readAddr reads an address from r, appending it to b.
+func readAddr(r io.Reader, b []byte) ([]byte, error) {
+	var t [2]byte
+	if _, err := io.ReadFull(r, t[:1]); err != nil {
+		return nil, err
+	}
+	var n int
+	switch t[0] {
+	case typeIPv4:
+		n = lenIPv4
+	case typeIPv6:
+		n = lenIPv6
+	case typeDm:
+		if _, err := io.ReadFull(r, t[1:]); err != nil {
+			return nil, err
+		}
+		n = int(t[1]) + lenDmBase
+	default:
+		return nil, AddrTypeError(t[0])
+	}
+	start := len(b)
+	if t[0] == typeDm {
+		b = append(b, t[:2]...)
+	} else {
+		b = append(b, t[0])
+	}
+	rest := n - (len(b) - start)
+	b = append(b, make([]byte, rest)...)
+	if _, err := io.ReadFull(r, b[len(b)-rest:]); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// uotConn is the client end of a version 2 UDP over TCP connection, not
+// connected, so every packet carries its address.
+type uotConn struct {
+	net.Conn
+	r         *bufio.Reader
+	mu        sync.Mutex // serializes writes of packets
+	requested bool       // the request went out with the first packet
+}
+
+// NewUoTConn returns a UDP relay connection carried by conn, a connection
+// to a server with UoTHost as destination. It sends the request with the
+// first packet.
+func NewUoTConn(conn net.Conn) UDPRelayConn {
+	return &uotConn{Conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (c *uotConn) Write(b []byte) (int, error) {
+	hl, err := addrLen(b)
+	if err != nil {
+		return 0, err
+	}
+	if len(b)-hl > 0xffff {
+		return 0, errUDPOversized
+	}
+	pkt := GetBuf(2*hl + len(b) + 3)
+	defer PutBuf(pkt)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pkt = pkt[:0]
+	if !c.requested {
+		// not connected, the address of the request isn't used then
+		pkt = append(pkt, 0)
+		pkt = append(pkt, b[:hl]...)
+	}
+	pkt = append(pkt, b[:hl]...)
+	pkt = append(pkt, byte((len(b)-hl)>>8), byte(len(b)-hl))
+	pkt = append(pkt, b[hl:]...)
+	if _, err = c.Conn.Write(pkt); err != nil {
+		return 0, err
+	}
+	c.requested = true
+	return len(b), nil
+}
+
+// Read returns the next reply, the address of the destination it's from
+// followed by the payload.
+func (c *uotConn) Read(b []byte) (int, error) {
+	var header [lenDmBase + 255]byte
+	pkt, err := readAddr(c.r, header[:0])
+	if err != nil {
+		return 0, err
+	}
+	var l [2]byte
+	if _, err = io.ReadFull(c.r, l[:]); err != nil {
+		return 0, err
+	}
+	n := int(binary.BigEndian.Uint16(l[:]))
+	hl := len(pkt)
+	if hl+n > len(b) {
+		// doesn't fit, skip it like a truncated datagram
+		if _, err = io.CopyN(io.Discard, c.r, int64(n)); err != nil {
+			return 0, err
+		}
+		return 0, errUDPOversized
+	}
+	copy(b, pkt)
+	if _, err = io.ReadFull(c.r, b[hl:hl+n]); err != nil {
+		return 0, err
+	}
+	return hl + n, nil
+}
+
+// ServeUoT relays the packets of conn, a UDP over TCP connection to server
+// port port whose request had destination host, UoTHost or UoTHostV1,
+// until it's closed or idle for the UDP timeout. Destinations are checked
+// like on the UDP relay.
+func ServeUoT(conn net.Conn, host, port, openvpn string) error {
+	r := bufio.NewReader(conn)
+	connected := false
+	var dst *net.UDPAddr
+	if host == UoTHost {
+		conn.SetReadDeadline(time.Now().Add(natTimeout()))
+		var isConnect [1]byte
+		if _, err := io.ReadFull(r, isConnect[:]); err != nil {
+			return err
+		}
+		addr, err := readAddr(r, nil)
+		if err != nil {
+			return err
+		}
+		if isConnect[0] != 0 {
+			if dst = uotDest(addr, port, openvpn); dst == nil {
+				return errUoTDest
+			}
+			connected = true
+		}
+	}
+	lc := net.ListenConfig{Control: OutboundControl}
+	pc, err := lc.ListenPacket(context.Background(), "udp", (&net.UDPAddr{IP: OutboundIP()}).String())
+	if err != nil {
+		return err
+	}
+	remote := pc.(*net.UDPConn)
+	defer remote.Close()
+	client := HostOf(conn.RemoteAddr())
+	go uotReplies(conn, remote, port, connected)
+
+	buf := getUDPBuf()
+	defer PutBuf(buf)
+	for {
+		conn.SetReadDeadline(time.Now().Add(natTimeout()))
+		to := dst
+		var addr []byte
+		if !connected {
+			if addr, err = readAddr(r, buf[:0]); err != nil {
+				return err
+			}
+		}
+		var l [2]byte
+		if _, err = io.ReadFull(r, l[:]); err != nil {
+			return err
+		}
+		n := int(binary.BigEndian.Uint16(l[:]))
+		if len(addr)+n > len(buf) {
+			if _, err = io.CopyN(io.Discard, r, int64(n)); err != nil {
+				return err
+			}
+			dropOversized(conn.RemoteAddr())
+			continue
+		}
+		payload := buf[len(addr) : len(addr)+n]
+		if _, err = io.ReadFull(r, payload); err != nil {
+			return err
+		}
+		if !connected {
+			if to = uotDest(addr, port, openvpn); to == nil {
+				udpDropped.Add(1)
+				continue
+			}
+		}
+		if _, err = remote.WriteToUDP(payload, to); err != nil {
+			logger.Debugf("[uot]write to %v: %v", to, err)
+			CountError(port, err)
+			udpDropped.Add(1)
+			continue
+		}
+		upTraffic(port, n, client)
+	}
+}
+
+// uotDest returns the destination of the address addr sent by a client of
+// server port port, nil if it can't be resolved or isn't allowed.
+func uotDest(addr []byte, port, openvpn string) *net.UDPAddr {
+	var ip net.IP
+	var domain, zone string
+	switch addr[idType] {
+	case typeIPv4:
+		ip = net.IP(addr[idIP0 : idIP0+net.IPv4len])
+	case typeIPv6:
+		ip = net.IP(addr[idIP0 : idIP0+net.IPv6len])
+	case typeDm:
+		domain = string(addr[idDm0 : idDm0+addr[idDmLen]])
+		dIP, err := UDPResolve(port, domain)
+		if err != nil {
+			logger.Warnf("[uot]failed to resolve domain name: %s", domain)
+			return nil
+		}
+		ip, zone = dIP.IP, dIP.Zone
+	}
+	p := int(binary.BigEndian.Uint16(addr[len(addr)-2:]))
+	if !udpDestAllowed(port, domain, ip.String(), strconv.Itoa(p), openvpn) {
+		return nil
+	}
+	return &net.UDPAddr{IP: append(net.IP{}, ip...), Port: p, Zone: zone}
+}
+
+// uotReplies sends the datagrams received on remote to the client of the
+// UDP over TCP connection conn, closing it when remote is closed.
+func uotReplies(conn net.Conn, remote *net.UDPConn, port string, connected bool) {
+	defer conn.Close()
+	buf := getUDPBuf()
+	defer PutBuf(buf)
+	// room for the longest address and the length before the payload
+	const room = lenIPv6 + 2
+	for {
+		n, from, err := remote.ReadFromUDP(buf[room:])
+		if err != nil {
+			return
+		}
+		if room+n == len(buf) {
+			dropOversized(from)
+			continue
+		}
+		start := room - 2
+		binary.BigEndian.PutUint16(buf[start:], uint16(n))
+		if !connected {
+			header := ParseHeader(from)
+			start -= len(header)
+			copy(buf[start:], header)
+		}
+		if _, err = conn.Write(buf[start : room+n]); err != nil {
+			return
+		}
+		upTraffic(port, n, "")
+	}
+}
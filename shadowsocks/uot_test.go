@@ -0,0 +1,103 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// uotPair returns the client end of a TCP connection whose server end is
+// served by ServeUoT with request destination host.
+func uotPair(t *testing.T, host string) net.Conn {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		ServeUoT(c, host, "8388", "")
+	}()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	return c
+}
+
+func TestUoT(t *testing.T) {
+	allowed := UDPDestAllowed
+	UDPDestAllowed = func(domain, ip, port, openvpn string) bool { return true }
+	defer func() { UDPDestAllowed = allowed }()
+
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, addr, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(buf[:n], addr)
+		}
+	}()
+	header := ParseHeader(echo.LocalAddr())
+
+	c := NewUoTConn(uotPair(t, UoTHost))
+	defer c.Close()
+	for _, msg := range []string{"first packet", "second packet"} {
+		req := append(append([]byte{}, header...), msg...)
+		if _, err = c.Write(req); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 4096)
+		n, err := c.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:n], req) {
+			t.Errorf("got %q, want %q", buf[:n], req)
+		}
+	}
+
+	// connected to the destination of the request, packets have no address
+	raw := uotPair(t, UoTHost)
+	defer raw.Close()
+	req := append(append([]byte{1}, header...), 0, 4)
+	if _, err = raw.Write(append(req, "ping"...)); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 6)
+	if _, err = io.ReadFull(raw, reply); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(reply, []byte("\x00\x04ping")) {
+		t.Errorf("connected reply %q", reply)
+	}
+
+	// version 1 has no request
+	raw1 := uotPair(t, UoTHostV1)
+	defer raw1.Close()
+	pkt := append(append([]byte{}, header...), 0, 4)
+	if _, err = raw1.Write(append(pkt, "pong"...)); err != nil {
+		t.Fatal(err)
+	}
+	reply = make([]byte, len(pkt)+4)
+	if _, err = io.ReadFull(raw1, reply); err != nil {
+		t.Fatal(err)
+	}
+	if want := append(pkt, "pong"...); !bytes.Equal(reply, want) {
+		t.Errorf("version 1 reply %q, want %q", reply, want)
+	}
+}
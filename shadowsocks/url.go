@@ -0,0 +1,204 @@
+package shadowsocks
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// ParseURL returns the config of a SIP002 URI,
+// ss://userinfo@host:port[/][?plugin=...][#tag], where userinfo is
+// method:password, percent-encoded or base64url encoded. The legacy
+// ss://base64(method:password@host:port) form is read too. The options of
+// v2ray-plugin are mapped to the ws, wss and quic transports, other plugins
+// aren't supported.
+func ParseURL(s string) (*Config, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "ss" {
+		return nil, fmt.Errorf("%s is not an ss:// URL", redactUserinfo(u))
+	}
+	if u.User == nil && u.Host != "" {
+		// legacy URL, all but the tag is base64 encoded
+		decoded, err := decodeBase64(u.Host)
+		if err != nil {
+			return nil, fmt.Errorf("ss:// URL: %v", err)
+		}
+		tag := u.Fragment
+		if u, err = url.Parse("ss://" + decoded); err != nil {
+			return nil, fmt.Errorf("ss:// URL: %v", err)
+		}
+		u.Fragment = tag
+	}
+	method, password, err := urlUserinfo(u)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil || port <= 0 || port > 65535 {
+		return nil, fmt.Errorf("%s has no valid port", redactUserinfo(u))
+	}
+	config := &Config{
+		Server:     u.Hostname(),
+		ServerPort: port,
+		Method:     method,
+		Password:   password,
+	}
+	if plugin := u.Query().Get("plugin"); plugin != "" {
+		if err = config.setPlugin(plugin); err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+// urlUserinfo returns the method and password of an ss:// URL.
+func urlUserinfo(u *url.URL) (method, password string, err error) {
+	if u.User == nil {
+		return "", "", fmt.Errorf("%s has no method and password", u.Redacted())
+	}
+	method = u.User.Username()
+	password, ok := u.User.Password()
+	if !ok {
+		userinfo, err := decodeBase64(method)
+		if err != nil {
+			return "", "", fmt.Errorf("bad userinfo in %s", redactUserinfo(u))
+		}
+		i := strings.IndexByte(userinfo, ':')
+		if i < 0 {
+			return "", "", fmt.Errorf("bad userinfo in %s", redactUserinfo(u))
+		}
+		method, password = userinfo[:i], userinfo[i+1:]
+	}
+	if err = CheckCipherMethod(method); err != nil {
+		return "", "", err
+	}
+	return method, password, nil
+}
+
+// decodeBase64 decodes s, base64 or base64url encoded, padded or not.
+func decodeBase64(s string) (string, error) {
+	s = strings.TrimRight(s, "=")
+	if strings.ContainsAny(s, "+/") {
+		b, err := base64.RawStdEncoding.DecodeString(s)
+		return string(b), err
+	}
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	return string(b), err
+}
+
+// redactUserinfo hides the method and password of an ss:// URL.
+func redactUserinfo(u *url.URL) string {
+	if u.User == nil {
+		return u.String()
+	}
+	r := *u
+	r.User = url.User("xxxxx")
+	return r.String()
+}
+
+// setPlugin sets the transport matching the SIP003 plugin and its options,
+// e.g. "v2ray-plugin;tls;host=example.com;path=/ws".
+func (config *Config) setPlugin(plugin string) error {
+	opts := strings.Split(plugin, ";")
+	if opts[0] != "v2ray-plugin" {
+		return fmt.Errorf("plugin %s is not supported, only v2ray-plugin", opts[0])
+	}
+	mode, tls := "websocket", false
+	for _, opt := range opts[1:] {
+		name, value, _ := strings.Cut(opt, "=")
+		switch name {
+		case "mode":
+			mode = value
+		case "tls":
+			tls = true
+		case "host":
+			config.WSHost = value
+		case "path":
+			config.WSPath = value
+		case "server":
+		default:
+			return fmt.Errorf("v2ray-plugin option %s is not supported", name)
+		}
+	}
+	switch {
+	case mode == "quic":
+		// always over TLS
+		config.Transport = TransportQUIC
+	case mode == "websocket" && tls:
+		config.Transport = TransportWSS
+	case mode == "websocket":
+		config.Transport = TransportWS
+	default:
+		return fmt.Errorf("v2ray-plugin mode %s is not supported", mode)
+	}
+	if (tls || mode == "quic") && config.WSHost != "" {
+		config.TLSServerName = config.WSHost
+	}
+	return nil
+}
+
+// envPrefix starts the names of environment variables setting options, the
+// option name in upper case follows, e.g. SS_SERVER_PORT.
+const envPrefix = "SS_"
+
+// ApplyEnv sets the options given by environment variables on top of
+// config: SS_URL, an ss:// URL read by ParseURL, sets the server, port,
+// method, password and transport, then SS_<OPTION> sets any option, e.g.
+// SS_METHOD or SS_PORT_PASSWORD. Values of options that aren't strings are
+// JSON, e.g. SS_PORT_PASSWORD='{"8388": ["foobar"]}'.
+func (config *Config) ApplyEnv() error {
+	return config.applyEnv(os.LookupEnv)
+}
+
+func (config *Config) applyEnv(lookup func(string) (string, bool)) error {
+	if s, ok := lookup(envPrefix + "URL"); ok && s != "" {
+		u, err := ParseURL(s)
+		if err != nil {
+			return fmt.Errorf("environment variable %sURL: %v", envPrefix, err)
+		}
+		config.Server = u.Server
+		config.ServerPort = u.ServerPort
+		config.Method = u.Method
+		config.Password = u.Password
+		if u.Transport != "" {
+			config.Transport = u.Transport
+			config.WSHost, config.WSPath, config.TLSServerName = u.WSHost, u.WSPath, u.TLSServerName
+		}
+	}
+	v := reflect.ValueOf(config).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		env := envPrefix + strings.ToUpper(name)
+		s, ok := lookup(env)
+		if !ok {
+			continue
+		}
+		f := v.Field(i)
+		switch f.Kind() {
+		case reflect.String:
+			f.SetString(s)
+		case reflect.Interface:
+			// server, a single address
+			f.Set(reflect.ValueOf(s))
+		default:
+			p := reflect.New(f.Type())
+			if err := json.Unmarshal([]byte(s), p.Interface()); err != nil {
+				return fmt.Errorf("environment variable %s: %v", env, err)
+			}
+			f.Set(p.Elem())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package shadowsocks
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestParseURL(t *testing.T) {
+	userinfo := base64.URLEncoding.EncodeToString([]byte("aes-256-gcm:foo:bar"))
+	legacy := base64.StdEncoding.EncodeToString([]byte("aes-256-gcm:foo:bar@192.0.2.1:8388"))
+	tests := []struct {
+		url       string
+		host      string
+		port      int
+		method    string
+		password  string
+		transport string
+	}{
+		{"ss://" + userinfo + "@192.0.2.1:8388/#tag", "192.0.2.1", 8388, "aes-256-gcm", "foo:bar", ""},
+		{"ss://2022-blake3-aes-128-gcm:YctPZ6U7xPPcU%2Bgp3u%2B0tx%2Fk@[2001:db8::1]:443", "2001:db8::1", 443, "2022-blake3-aes-128-gcm", "YctPZ6U7xPPcU+gp3u+0tx/k", ""},
+		{"ss://" + legacy + "#tag", "192.0.2.1", 8388, "aes-256-gcm", "foo:bar", ""},
+		{"ss://" + userinfo + "@example.com:443/?plugin=v2ray-plugin%3Btls%3Bhost%3Dcdn.example.com%3Bpath%3D%2Fws", "example.com", 443, "aes-256-gcm", "foo:bar", TransportWSS},
+		{"ss://" + userinfo + "@example.com:80?plugin=v2ray-plugin", "example.com", 80, "aes-256-gcm", "foo:bar", TransportWS},
+	}
+	for _, tt := range tests {
+		c, err := ParseURL(tt.url)
+		if err != nil {
+			t.Errorf("%s: %v", tt.url, err)
+			continue
+		}
+		if c.Server != tt.host || c.ServerPort != tt.port || c.Method != tt.method || c.Password != tt.password || c.Transport != tt.transport {
+			t.Errorf("%s parsed to %v %d %s %s %q", tt.url, c.Server, c.ServerPort, c.Method, c.Password, c.Transport)
+		}
+	}
+	c, _ := ParseURL(tests[3].url)
+	if c.WSHost != "cdn.example.com" || c.WSPath != "/ws" || c.TLSServerName != "cdn.example.com" {
+		t.Errorf("v2ray-plugin options parsed to host %s, path %s, server name %s", c.WSHost, c.WSPath, c.TLSServerName)
+	}
+
+	for _, s := range []string{
+		"http://example.com",
+		"ss://" + userinfo + "@example.com",
+		"ss://rot13:foobar@example.com:8388",
+		"ss://" + userinfo + "@example.com:8388?plugin=obfs-local%3Bobfs%3Dhttp",
+	} {
+		if _, err := ParseURL(s); err == nil {
+			t.Errorf("%s accepted", s)
+		}
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	env := map[string]string{
+		"SS_URL":           "ss://aes-128-gcm:foobar@192.0.2.1:8388",
+		"SS_METHOD":        "chacha20-ietf-poly1305",
+		"SS_TIMEOUT":       "60",
+		"SS_TARPIT":        "true",
+		"SS_PORT_PASSWORD": `{"8389": ["barfoo", "", "ok"]}`,
+	}
+	lookup := func(name string) (string, bool) {
+		s, ok := env[name]
+		return s, ok
+	}
+	c := &Config{Password: "from file", LocalPort: 1080}
+	if err := c.applyEnv(lookup); err != nil {
+		t.Fatal(err)
+	}
+	if c.Server != "192.0.2.1" || c.ServerPort != 8388 || c.Password != "foobar" || c.LocalPort != 1080 {
+		t.Errorf("SS_URL applied as %v %d %s, local port %d", c.Server, c.ServerPort, c.Password, c.LocalPort)
+	}
+	if c.Method != "chacha20-ietf-poly1305" || c.Timeout != 60 || !c.Tarpit || c.PortPassword["8389"][2] != "ok" {
+		t.Errorf("options applied as %s %d %v %v", c.Method, c.Timeout, c.Tarpit, c.PortPassword)
+	}
+
+	env["SS_TIMEOUT"] = "a minute"
+	if err := c.applyEnv(lookup); err == nil {
+		t.Error("SS_TIMEOUT of a string accepted")
+	}
+}
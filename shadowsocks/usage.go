@@ -0,0 +1,214 @@
+package shadowsocks
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// PortUsage is the traffic of a port in bytes, in total and by user id for
+// ports shared by users.
+type PortUsage struct {
+	Traffic int64            `json:"traffic"`
+	Users   map[string]int64 `json:"users,omitempty"`
+}
+
+// usage is the traffic not taken by TakeUsage yet, by port. Unlike the
+// counters of ports it's kept when a port is deleted, so no traffic is
+// missed by exporters.
+var usage = struct {
+	sync.Mutex
+	m      map[string]*PortUsage
+	report []byte // exported but not acknowledged, see SetUnackedReport
+}{m: make(map[string]*PortUsage)}
+
+// SetUnackedReport keeps report, the body of an export of taken usage the
+// receiver didn't acknowledge, so it's sent again unchanged: the receiver
+// may have applied it, and drops the reports it has seen by their id. nil
+// clears it once it's acknowledged. The report is saved with the traffic counters.
+func SetUnackedReport(report []byte) {
+	usage.Lock()
+	usage.report = report
+	usage.Unlock()
+}
+
+// UnackedReport returns the report kept by SetUnackedReport, nil if none.
+func UnackedReport() []byte {
+	usage.Lock()
+	defer usage.Unlock()
+	return usage.report
+}
+
+// addUsage adds n bytes to the usage of port, and of user if it's not "".
+func addUsage(port, user string, n int) {
+	usage.Lock()
+	defer usage.Unlock()
+
+	u, ok := usage.m[port]
+	if !ok {
+		u = &PortUsage{}
+		usage.m[port] = u
+	}
+	if user == "" {
+		u.Traffic += int64(n)
+		return
+	}
+	if u.Users == nil {
+		u.Users = make(map[string]int64)
+	}
+	u.Users[user] += int64(n)
+}
+
+// TakeUsage returns the traffic by port since it was last taken, and
+// clears it. Usage that couldn't be exported is given back by ReturnUsage.
+func TakeUsage() map[string]*PortUsage {
+	usage.Lock()
+	defer usage.Unlock()
+
+	m := usage.m
+	usage.m = make(map[string]*PortUsage)
+	return m
+}
+
+// ReturnUsage adds m, taken by TakeUsage, back to the usage, so it's taken
+// again with the traffic since.
+func ReturnUsage(m map[string]*PortUsage) {
+	for port, u := range m {
+		addUsage(port, "", int(u.Traffic))
+		for user, n := range u.Users {
+			addUsage(port, user, int(n))
+		}
+	}
+}
+
+// TrafficSnapshot holds the traffic counters, saved so they survive a
+// restart.
+type TrafficSnapshot struct {
+	Time time.Time `json:"time"`
+	// traffic of ports as reported by GetTraffic and GetUserTraffic
+	Ports map[string]*PortUsage `json:"ports"`
+	// traffic used against quotas by port
+	QuotaUsed map[string]int64 `json:"quota_used,omitempty"`
+	// traffic not taken by TakeUsage yet
+	Pending map[string]*PortUsage `json:"pending,omitempty"`
+	// report of taken traffic not acknowledged, see SetUnackedReport, kept
+	// byte for byte
+	Report []byte `json:"report,omitempty"`
+}
+
+// SnapshotTraffic returns the current traffic counters.
+func SnapshotTraffic() *TrafficSnapshot {
+	s := &TrafficSnapshot{
+		Time:      time.Now(),
+		Ports:     make(map[string]*PortUsage),
+		QuotaUsed: make(map[string]int64),
+		Pending:   make(map[string]*PortUsage),
+	}
+	ts.Lock()
+	for port, st := range ts.m {
+		s.Ports[port] = &PortUsage{Traffic: int64(st.Traffic)}
+		if st.used > 0 {
+			s.QuotaUsed[port] = st.used
+		}
+	}
+	ts.Unlock()
+	for port, u := range s.Ports {
+		u.Users = GetUserTraffic(port)
+	}
+	usage.Lock()
+	s.Report = usage.report
+	for port, u := range usage.m {
+		p := &PortUsage{Traffic: u.Traffic}
+		if len(u.Users) > 0 {
+			p.Users = make(map[string]int64, len(u.Users))
+			for user, n := range u.Users {
+				p.Users[user] = n
+			}
+		}
+		s.Pending[port] = p
+	}
+	usage.Unlock()
+	return s
+}
+
+// RestoreTraffic adds the counters of s to the current ones, creating the
+// counters of its ports, and its unacknowledged report unless there's one.
+// Call it before quotas are set, so ports that used up their quota aren't
+// started.
+func RestoreTraffic(s *TrafficSnapshot) {
+	ts.Lock()
+	for port, u := range s.Ports {
+		st, ok := ts.m[port]
+		if !ok {
+			st = &trafficStruct{}
+			ts.m[port] = st
+		}
+		st.Traffic += int(u.Traffic)
+		st.used += s.QuotaUsed[port]
+	}
+	ts.Unlock()
+	userTraffic.Lock()
+	for port, u := range s.Ports {
+		if len(u.Users) == 0 {
+			continue
+		}
+		m, ok := userTraffic.m[port]
+		if !ok {
+			m = make(map[string]int64)
+			userTraffic.m[port] = m
+		}
+		for user, n := range u.Users {
+			m[user] += n
+		}
+	}
+	userTraffic.Unlock()
+	ReturnUsage(s.Pending)
+	if len(s.Report) > 0 {
+		usage.Lock()
+		if usage.report == nil {
+			usage.report = s.Report
+		}
+		usage.Unlock()
+	}
+}
+
+// SaveTraffic writes the traffic counters to path as JSON, replacing the
+// file atomically.
+func SaveTraffic(path string) error {
+	f, err := os.CreateTemp(filepath.Dir(path), ".traffic")
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err = enc.Encode(SnapshotTraffic()); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// LoadTraffic restores the traffic counters saved to path by SaveTraffic,
+// see RestoreTraffic. A missing file restores nothing.
+func LoadTraffic(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var s TrafficSnapshot
+	if err = json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	RestoreTraffic(&s)
+	return nil
+}
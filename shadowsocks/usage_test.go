@@ -0,0 +1,69 @@
+package shadowsocks
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestUsage(t *testing.T) {
+	TakeUsage()
+	addUsage("8388", "", 100)
+	addUsage("8388", "alice", 60)
+	addUsage("8389", "", 1)
+	m := TakeUsage()
+	if m["8388"].Traffic != 100 || m["8388"].Users["alice"] != 60 || m["8389"].Traffic != 1 {
+		t.Errorf("took usage %+v %+v", m["8388"], m["8389"])
+	}
+	if len(TakeUsage()) != 0 {
+		t.Error("usage not cleared when taken")
+	}
+
+	// failed exports are taken again with the newer traffic
+	addUsage("8388", "", 5)
+	ReturnUsage(m)
+	m = TakeUsage()
+	if m["8388"].Traffic != 105 || m["8388"].Users["alice"] != 60 {
+		t.Errorf("took usage %+v after returning it", m["8388"])
+	}
+}
+
+func TestSaveTraffic(t *testing.T) {
+	TakeUsage()
+	defer DelTraffic("18388")
+	defer DelUserTraffic("18388")
+
+	AddTraffic("18388")
+	upTraffic("18388", 1000, "")
+	AddUserTraffic("18388", "bob", 300)
+	report := `{"id":"0123456789abcdef"}`
+	SetUnackedReport([]byte(report))
+	defer SetUnackedReport(nil)
+	path := filepath.Join(t.TempDir(), "traffic.json")
+	if err := SaveTraffic(path); err != nil {
+		t.Fatal(err)
+	}
+	SetUnackedReport(nil)
+
+	DelTraffic("18388")
+	TakeUsage()
+	DelUserTraffic("18388")
+	if err := LoadTraffic(path); err != nil {
+		t.Fatal(err)
+	}
+	traffic, _ := GetTraffic("18388")
+	if used, _ := GetQuota("18388"); traffic["18388"] != 1000 || used != 1000 {
+		t.Errorf("restored traffic %d, quota used %d", traffic["18388"], used)
+	}
+	if n := GetUserTraffic("18388")["bob"]; n != 300 {
+		t.Errorf("restored traffic of bob %d", n)
+	}
+	if m := TakeUsage(); m["18388"].Traffic != 1000 || m["18388"].Users["bob"] != 300 {
+		t.Errorf("restored usage %+v", m["18388"])
+	}
+	if r := string(UnackedReport()); r != report {
+		t.Errorf("restored report %q", r)
+	}
+	if err := LoadTraffic(filepath.Join(t.TempDir(), "missing.json")); err != nil {
+		t.Error("missing file:", err)
+	}
+}
@@ -0,0 +1,225 @@
+package shadowsocks
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+)
+
+// Users share a port and are told apart by their key. With the AEAD methods
+// of SIP004 the server tries the key of each user on the first chunk of a
+// connection, which costs a key derivation per user. With the Shadowsocks
+// 2022 methods the client sends an extensible identity header (EIH) after
+// the salt, the BLAKE3 hash of its key encrypted with a subkey of the key of
+// the port, so the user is looked up directly:
+//
+//	[salt][EIH][header chunks as in sip022.go, sealed with the user key]
+//
+// The key of the port is then only the identity key, clients give it before
+// their own key in the password, as in "iPSK:uPSK". Stream ciphers can't
+// tell a wrong key from garbage, so users need an AEAD method.
+type Users struct {
+	info     *cipherInfo
+	overhead int    // of the AEAD of the method
+	identity []byte // key of the port for 2022 methods, nil for SIP004
+	ids      []string
+	ciphers  []*Cipher
+	byHash   map[[aes.BlockSize]byte]int // index of users by key hash, 2022 only
+}
+
+var errUsersMethod = errors.New("users sharing a port need an AEAD method")
+
+// NewUsers returns the users of a port using method and password, keys
+// holds the key of each user by id. With SIP004 methods the password of the
+// port is a key too, of user "".
+func NewUsers(method, password string, keys map[string]string) (*Users, error) {
+	mi, ok := cipherMethod[method]
+	if !ok || mi.newAEAD == nil {
+		return nil, errUsersMethod
+	}
+	port, err := NewCipher(method, password)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := mi.newAEAD(make([]byte, mi.keyLen))
+	if err != nil {
+		return nil, err
+	}
+	u := &Users{info: mi, overhead: aead.Overhead()}
+	if port.sip022 {
+		u.identity = port.key
+		u.byHash = make(map[[aes.BlockSize]byte]int)
+	} else {
+		u.ids, u.ciphers = []string{""}, []*Cipher{port}
+	}
+	ids := make([]string, 0, len(keys))
+	for id := range keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		if id == "" {
+			return nil, errors.New("user id must not be empty")
+		}
+		c, err := NewCipher(method, keys[id])
+		if err != nil {
+			return nil, fmt.Errorf("user %s: %v", id, err)
+		}
+		if port.sip022 {
+			h := identityHash(c.key)
+			if _, dup := u.byHash[h]; dup {
+				return nil, fmt.Errorf("user %s: key used by another user", id)
+			}
+			u.byHash[h] = len(u.ciphers)
+		}
+		u.ids = append(u.ids, id)
+		u.ciphers = append(u.ciphers, c)
+	}
+	return u, nil
+}
+
+// identityHash is the hash of key sent in EIH.
+func identityHash(key []byte) (h [aes.BlockSize]byte) {
+	blake3Hash(&blake3IV, 0, key, h[:])
+	return
+}
+
+// identityBlock returns the cipher of the EIH for identity key key in the
+// session with salt.
+func identityBlock(key, salt []byte) (cipher.Block, error) {
+	subkey := make([]byte, len(key))
+	blake3DeriveKey("shadowsocks 2022 identity subkey", append(append([]byte{}, key...), salt...), subkey)
+	return aes.NewCipher(subkey)
+}
+
+// appendIdentityHeaders appends to buf the EIH of each identity key of a
+// client, for the session with salt.
+func (c *Cipher) appendIdentityHeaders(buf, salt []byte) ([]byte, error) {
+	for i, key := range c.identity {
+		block, err := identityBlock(key, salt)
+		if err != nil {
+			return nil, err
+		}
+		// each EIH names the key of the next hop, the last one ours
+		next := c.key
+		if i+1 < len(c.identity) {
+			next = c.identity[i+1]
+		}
+		h := identityHash(next)
+		eih := make([]byte, aes.BlockSize)
+		block.Encrypt(eih, h[:])
+		buf = append(buf, eih...)
+	}
+	return buf, nil
+}
+
+// identify reads the start of a connection from r to find its user. It
+// returns a copy of the cipher of the user and the bytes read that the
+// cipher has to read again, which don't include the EIH.
+func (u *Users) identify(r io.Reader) (id string, c *Cipher, pending []byte, err error) {
+	ivLen := u.info.ivLen
+	if u.identity != nil {
+		buf := make([]byte, ivLen+aes.BlockSize)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return
+		}
+		var block cipher.Block
+		if block, err = identityBlock(u.identity, buf[:ivLen]); err != nil {
+			return
+		}
+		var h [aes.BlockSize]byte
+		block.Decrypt(h[:], buf[ivLen:])
+		i, ok := u.byHash[h]
+		if !ok {
+			return "", nil, nil, ErrAuth
+		}
+		return u.ids[i], u.ciphers[i].Copy(), buf[:ivLen], nil
+	}
+	// salt and the sealed length of the first chunk
+	buf := make([]byte, ivLen+2+u.overhead)
+	if _, err = io.ReadFull(r, buf); err != nil {
+		return
+	}
+	for i, uc := range u.ciphers {
+		aead, err := uc.subkeyAEAD(buf[:ivLen])
+		if err != nil {
+			return "", nil, nil, err
+		}
+		if _, err = aead.Open(nil, make([]byte, aead.NonceSize()), buf[ivLen:], nil); err == nil {
+			return u.ids[i], uc.Copy(), buf, nil
+		}
+	}
+	return "", nil, nil, ErrAuth
+}
+
+// NewUsersConn returns a server connection of a port shared by users, the
+// user is identified by the first read, and then in the User field.
+func NewUsersConn(cn net.Conn, users *Users) *Conn {
+	return &Conn{Conn: cn, users: users}
+}
+
+// identify finds the user of c and sets up its cipher.
+func (c *Conn) identify() (err error) {
+	if c.User, c.Cipher, c.pending, err = c.users.identify(c.Conn); err == nil {
+		c.users = nil
+	}
+	return
+}
+
+// readFull fills b, with the bytes read to identify the user first.
+func (c *Conn) readFull(b []byte) error {
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	_, err := io.ReadFull(c.Conn, b[n:])
+	return err
+}
+
+// userTraffic is the traffic of users by port and user id.
+var userTraffic = struct {
+	sync.Mutex
+	m map[string]map[string]int64
+}{m: make(map[string]map[string]int64)}
+
+// AddUserTraffic adds n bytes to the traffic of user of port.
+func AddUserTraffic(port, user string, n int) {
+	userTraffic.Lock()
+	defer userTraffic.Unlock()
+
+	m, ok := userTraffic.m[port]
+	if !ok {
+		m = make(map[string]int64)
+		userTraffic.m[port] = m
+	}
+	m[user] += int64(n)
+	addUsage(port, user, n)
+}
+
+// GetUserTraffic returns the traffic of the users of port by user id, nil
+// if there's none.
+func GetUserTraffic(port string) map[string]int64 {
+	userTraffic.Lock()
+	defer userTraffic.Unlock()
+
+	m, ok := userTraffic.m[port]
+	if !ok {
+		return nil
+	}
+	traffic := make(map[string]int64, len(m))
+	for user, n := range m {
+		traffic[user] = n
+	}
+	return traffic
+}
+
+// DelUserTraffic forgets the traffic of the users of port.
+func DelUserTraffic(port string) {
+	userTraffic.Lock()
+	defer userTraffic.Unlock()
+
+	delete(userTraffic.m, port)
+}
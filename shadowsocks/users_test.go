@@ -0,0 +1,84 @@
+package shadowsocks
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+// requestAs sends a request to example.com:443 with payload from a client
+// using method and password, and returns the server end of the connection.
+func requestAs(t *testing.T, method, password string, users *Users) *Conn {
+	cipher, err := NewCipher(method, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawaddr, _ := RawAddr("example.com:443")
+	cl, sv := net.Pipe()
+	go func() {
+		NewConn(cl, cipher).Write(append(rawaddr, text...))
+		cl.Close()
+	}()
+	return NewUsersConn(sv, users)
+}
+
+func TestUsers(t *testing.T) {
+	psk := func(method string) string {
+		p, _ := RandomPassword(method)
+		return p
+	}
+	for _, method := range []string{"aes-128-gcm", "chacha20-ietf-poly1305", "2022-blake3-aes-256-gcm"} {
+		port, alice, bob := psk(method), psk(method), psk(method)
+		users, err := NewUsers(method, port, map[string]string{"alice": alice, "bob": bob})
+		if err != nil {
+			t.Fatal(method, err)
+		}
+		clients := map[string]string{"alice": alice, "bob": bob}
+		if method[:5] == "2022-" {
+			// the key of the port is the identity key
+			clients = map[string]string{"alice": port + ":" + alice, "bob": port + ":" + bob}
+		} else {
+			clients[""] = port
+		}
+		for want, password := range clients {
+			conn := requestAs(t, method, password, users)
+			host, _, extra, err := GetRequest(conn)
+			if err != nil {
+				t.Fatal(method, want, err)
+			}
+			rest, _ := io.ReadAll(conn)
+			if host != "example.com" || conn.User != want || string(extra)+string(rest) != text {
+				t.Errorf("%s: request of %q read as %s from %q", method, want, host, conn.User)
+			}
+		}
+
+		stranger := psk(method)
+		if method[:5] == "2022-" {
+			stranger = port + ":" + stranger
+		}
+		if _, _, _, err = GetRequest(requestAs(t, method, stranger, users)); err != ErrAuth {
+			t.Errorf("%s: unknown key got %v, want ErrAuth", method, err)
+		}
+	}
+
+	if _, err := NewUsers("aes-256-cfb", "port", map[string]string{"alice": "a"}); err == nil {
+		t.Error("users of stream ciphers should be rejected")
+	}
+	key := psk("2022-blake3-aes-128-gcm")
+	if _, err := NewUsers("2022-blake3-aes-128-gcm", key, map[string]string{"a": key, "b": key}); err == nil {
+		t.Error("users with the same 2022 key should be rejected")
+	}
+}
+
+func TestUserTraffic(t *testing.T) {
+	AddUserTraffic("8388", "alice", 100)
+	AddUserTraffic("8388", "alice", 20)
+	AddUserTraffic("8388", "bob", 1)
+	if m := GetUserTraffic("8388"); m["alice"] != 120 || m["bob"] != 1 {
+		t.Errorf("user traffic %v", m)
+	}
+	DelUserTraffic("8388")
+	if m := GetUserTraffic("8388"); m != nil {
+		t.Errorf("user traffic %v after deleting the port", m)
+	}
+}
@@ -1,15 +1,85 @@
 package shadowsocks
 
 import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
 )
 
 const version = "1.1.3"
 
+// Set at build time with
+// -ldflags "-X github.com/shadowsocks/shadowsocks-go/shadowsocks.GitCommit=..."
+var (
+	GitCommit = "unknown"
+	BuildDate = "unknown"
+)
+
+// features lists optional, build dependent capabilities compiled into the
+// binary, e.g. build tags or transports.
+var features []string
+
+// RegisterFeature records an optional capability shown in version output.
+// It should be called from init functions.
+func RegisterFeature(name string) {
+	features = append(features, name)
+}
+
+type VersionInfo struct {
+	Version   string   `json:"version"`
+	GitCommit string   `json:"git_commit"`
+	BuildDate string   `json:"build_date"`
+	GoVersion string   `json:"go_version"`
+	Platform  string   `json:"platform"`
+	Features  []string `json:"features"`
+	Ciphers   []string `json:"ciphers"`
+}
+
+func GetVersionInfo() *VersionInfo {
+	ciphers := make([]string, 0, len(cipherMethod))
+	for name := range cipherMethod {
+		ciphers = append(ciphers, name)
+	}
+	sort.Strings(ciphers)
+	feat := append([]string{}, features...)
+	sort.Strings(feat)
+	return &VersionInfo{
+		Version:   version,
+		GitCommit: GitCommit,
+		BuildDate: BuildDate,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+		Features:  feat,
+		Ciphers:   ciphers,
+	}
+}
+
 func PrintVersion() {
-	fmt.Println("shadowsocks-go version", version)
+	vi := GetVersionInfo()
+	fmt.Println("shadowsocks-go version", vi.Version)
+	fmt.Println("git commit:", vi.GitCommit)
+	fmt.Println("build date:", vi.BuildDate)
+	fmt.Println("go version:", vi.GoVersion, vi.Platform)
+	fmt.Println("features:", strings.Join(vi.Features, " "))
+	fmt.Println("ciphers:", strings.Join(vi.Ciphers, " "))
+}
+
+// PrintVersionJSON prints version information in JSON for scripts.
+func PrintVersionJSON() {
+	data, err := json.MarshalIndent(GetVersionInfo(), "", "  ")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	fmt.Println(string(data))
 }
 
 func IsFileExists(path string) (bool, error) {
@@ -25,3 +95,18 @@ func IsFileExists(path string) (bool, error) {
 	}
 	return false, err
 }
+
+var lastConnID uint64
+
+func init() {
+	// Start from a random value so IDs from different runs don't collide
+	// in the logs.
+	var b [4]byte
+	rand.Read(b[:])
+	lastConnID = uint64(binary.BigEndian.Uint32(b[:])) << 16
+}
+
+// NewConnID returns a short unique ID to tag log lines of one session.
+func NewConnID() string {
+	return strconv.FormatUint(atomic.AddUint64(&lastConnID, 1), 36)
+}
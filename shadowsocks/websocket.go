@@ -0,0 +1,273 @@
+package shadowsocks
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebSocket transport (RFC 6455), like v2ray-plugin without mux: the client
+// upgrades an HTTP request to the configured path, then the shadowsocks
+// stream is carried in binary messages. Only what the transport needs is
+// implemented, there are no extensions and messages are never buffered
+// whole.
+
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+// ErrWSHandshake is returned by reads of a server WSConn whose client didn't
+// send a valid WebSocket upgrade to the path.
+var ErrWSHandshake = errors.New("shadowsocks: invalid websocket handshake")
+
+// WSConn is a connection carrying data in WebSocket binary messages.
+type WSConn struct {
+	net.Conn
+	br     *bufio.Reader
+	client bool
+	path   string // server: path to accept the upgrade on
+	ready  bool   // upgraded
+
+	// frame being read
+	remaining int64
+	mask      [4]byte
+	masked    bool
+	maskPos   int
+
+	wmu    sync.Mutex // frames are written by Read too, for pongs
+	closed bool       // close frame sent
+}
+
+// NewWSServerConn returns the server end of a WebSocket connection. The
+// upgrade request is read by the first Read, a request that isn't an upgrade
+// to path is answered with 404, unless c falls back to a decoy server which
+// answers instead.
+func NewWSServerConn(c net.Conn, path string) *WSConn {
+	return &WSConn{Conn: c, br: bufio.NewReader(c), path: path}
+}
+
+func wsAccept(key string) string {
+	h := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+func headerHas(h http.Header, name, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// accept reads the upgrade request of the client and answers it.
+func (c *WSConn) accept() error {
+	req, err := http.ReadRequest(c.br)
+	if err != nil {
+		return err
+	}
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if req.Method != "GET" || req.URL.Path != c.path || key == "" ||
+		!headerHas(req.Header, "Upgrade", "websocket") || !headerHas(req.Header, "Connection", "upgrade") {
+		if _, ok := c.Conn.(*FallbackConn); !ok {
+			io.WriteString(c.Conn, "HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+		}
+		return ErrWSHandshake
+	}
+	c.ready = true
+	_, err = io.WriteString(c.Conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\n"+
+		"Connection: Upgrade\r\nSec-WebSocket-Accept: "+wsAccept(key)+"\r\n\r\n")
+	return err
+}
+
+// DialWS upgrades c, connected to a server, to a WebSocket connection to
+// path, with host as Host header.
+func DialWS(c net.Conn, host, path string) (*WSConn, error) {
+	var nonce [16]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+	req := "GET " + path + " HTTP/1.1\r\nHost: " + host + "\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + key + "\r\nSec-WebSocket-Version: 13\r\n\r\n"
+	if _, err := io.WriteString(c, req); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("shadowsocks: websocket upgrade refused: %s", resp.Status)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != wsAccept(key) {
+		return nil, ErrWSHandshake
+	}
+	return &WSConn{Conn: c, br: br, client: true, ready: true}, nil
+}
+
+// readHeader reads the header of the next frame.
+func (c *WSConn) readHeader() (opcode byte, err error) {
+	var h [2]byte
+	if _, err = io.ReadFull(c.br, h[:]); err != nil {
+		return
+	}
+	opcode = h[0] & 0x0F
+	c.masked = h[1]&0x80 != 0
+	c.remaining = int64(h[1] & 0x7F)
+	switch c.remaining {
+	case 126:
+		var l [2]byte
+		if _, err = io.ReadFull(c.br, l[:]); err != nil {
+			return
+		}
+		c.remaining = int64(binary.BigEndian.Uint16(l[:]))
+	case 127:
+		var l [8]byte
+		if _, err = io.ReadFull(c.br, l[:]); err != nil {
+			return
+		}
+		c.remaining = int64(binary.BigEndian.Uint64(l[:]) & (1<<63 - 1))
+	}
+	c.maskPos = 0
+	if c.masked {
+		_, err = io.ReadFull(c.br, c.mask[:])
+	}
+	return
+}
+
+func (c *WSConn) unmask(b []byte) {
+	if !c.masked {
+		return
+	}
+	for i := range b {
+		b[i] ^= c.mask[c.maskPos&3]
+		c.maskPos++
+	}
+}
+
+// Read returns the data of binary messages, answering pings and closes on
+// the way.
+func (c *WSConn) Read(b []byte) (n int, err error) {
+	if !c.ready {
+		if err = c.accept(); err != nil {
+			return
+		}
+	}
+	for c.remaining == 0 {
+		var opcode byte
+		if opcode, err = c.readHeader(); err != nil {
+			return
+		}
+		switch opcode {
+		case wsContinuation, wsText, wsBinary:
+		case wsClose, wsPing, wsPong:
+			if c.remaining > 125 {
+				return 0, errors.New("shadowsocks: websocket control frame too long")
+			}
+			payload := make([]byte, c.remaining)
+			if _, err = io.ReadFull(c.br, payload); err != nil {
+				return
+			}
+			c.unmask(payload)
+			c.remaining = 0
+			if opcode == wsClose {
+				c.writeFrame(wsClose, nil)
+				return 0, io.EOF
+			}
+			if opcode == wsPing {
+				if err = c.writeFrame(wsPong, payload); err != nil {
+					return
+				}
+			}
+		default:
+			return 0, fmt.Errorf("shadowsocks: websocket opcode %d not supported", opcode)
+		}
+	}
+	if int64(len(b)) > c.remaining {
+		b = b[:c.remaining]
+	}
+	n, err = c.br.Read(b)
+	c.unmask(b[:n])
+	c.remaining -= int64(n)
+	return
+}
+
+// writeFrame sends a frame, masked if c is the client.
+func (c *WSConn) writeFrame(opcode byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	if opcode == wsClose {
+		c.closed = true
+	}
+	buf := make([]byte, 2, 2+8+4+len(payload))
+	buf[0] = 0x80 | opcode
+	switch n := len(payload); {
+	case n < 126:
+		buf[1] = byte(n)
+	case n <= 0xFFFF:
+		buf[1] = 126
+		buf = binary.BigEndian.AppendUint16(buf, uint16(n))
+	default:
+		buf[1] = 127
+		buf = binary.BigEndian.AppendUint64(buf, uint64(n))
+	}
+	if !c.client {
+		_, err := c.Conn.Write(append(buf, payload...))
+		return err
+	}
+	buf[1] |= 0x80
+	var mask [4]byte
+	if _, err := io.ReadFull(rand.Reader, mask[:]); err != nil {
+		return err
+	}
+	buf = append(buf, mask[:]...)
+	for i, v := range payload {
+		buf = append(buf, v^mask[i&3])
+	}
+	_, err := c.Conn.Write(buf)
+	return err
+}
+
+// Write sends b in a binary message.
+func (c *WSConn) Write(b []byte) (int, error) {
+	if err := c.writeFrame(wsBinary, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close sends a close frame, if the handshake is done, and closes the
+// connection.
+func (c *WSConn) Close() error {
+	if c.ready {
+		// don't hang on a peer that stopped reading
+		c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+		c.writeFrame(wsClose, []byte{0x03, 0xE8}) // normal closure
+	}
+	return c.Conn.Close()
+}
@@ -0,0 +1,70 @@
+package shadowsocks
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestWebSocket(t *testing.T) {
+	cl, sv := net.Pipe()
+	server := NewWSServerConn(sv, "/tunnel")
+	payload := bytes.Repeat([]byte(text), 2000) // longer than 0xFFFF
+	go func() {
+		b, err := io.ReadAll(io.LimitReader(server, int64(len(payload))))
+		if err == nil {
+			_, err = server.Write(b)
+		}
+		if err != nil {
+			t.Error(err)
+		}
+		server.Close()
+	}()
+
+	client, err := DialWS(cl, "example.com", "/tunnel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the server answers pings between messages
+	go func() {
+		client.writeFrame(wsPing, []byte("ping"))
+		client.Write(payload[:10])
+		client.Write(payload[10:])
+	}()
+	got, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Errorf("echo of %d bytes differs, got %d bytes", len(payload), len(got))
+	}
+}
+
+func TestWebSocketBadUpgrade(t *testing.T) {
+	for _, req := range []string{
+		"GET /other HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n",
+		"GET /tunnel HTTP/1.1\r\nHost: example.com\r\n\r\n",
+	} {
+		cl, sv := net.Pipe()
+		go func() {
+			_, err := NewWSServerConn(sv, "/tunnel").Read(make([]byte, 10))
+			if err != ErrWSHandshake {
+				t.Errorf("got %v, want ErrWSHandshake", err)
+			}
+			sv.Close()
+		}()
+		io.WriteString(cl, req)
+		resp, err := http.ReadResponse(bufio.NewReader(cl), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%q answered with %s", strings.SplitN(req, "\r\n", 2)[0], resp.Status)
+		}
+		cl.Close()
+	}
+}
@@ -0,0 +1,106 @@
+package tun
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// utun picks the first free utunN if no name is given
+const defaultDevice = ""
+
+// utun prefixes each packet with the address family
+type utun struct {
+	*os.File
+	rbuf []byte
+}
+
+func (u *utun) Read(b []byte) (int, error) {
+	if cap(u.rbuf) < len(b)+4 {
+		u.rbuf = make([]byte, len(b)+4)
+	}
+	n, err := u.File.Read(u.rbuf[:len(b)+4])
+	if n < 4 {
+		return 0, err
+	}
+	return copy(b, u.rbuf[4:n]), err
+}
+
+func (u *utun) Write(b []byte) (int, error) {
+	buf := make([]byte, 4+len(b))
+	family := uint32(unix.AF_INET)
+	if len(b) > 0 && b[0]>>4 == 6 {
+		family = unix.AF_INET6
+	}
+	binary.BigEndian.PutUint32(buf, family)
+	copy(buf[4:], b)
+	n, err := u.File.Write(buf)
+	if n >= 4 {
+		n -= 4
+	}
+	return n, err
+}
+
+// openDevice creates the utun interface name, utunN.
+func openDevice(name string) (dev io.ReadWriteCloser, ifname string, err error) {
+	unit := 0 // the kernel picks the unit
+	if name != "" {
+		if !strings.HasPrefix(name, "utun") {
+			return nil, "", errors.New("tun device name must be utunN on darwin")
+		}
+		if unit, err = strconv.Atoi(name[len("utun"):]); err != nil {
+			return nil, "", errors.New("tun device name must be utunN on darwin")
+		}
+		unit++
+	}
+	fd, err := unix.Socket(unix.AF_SYSTEM, unix.SOCK_DGRAM, unix.AF_SYS_CONTROL)
+	if err != nil {
+		return
+	}
+	info := &unix.CtlInfo{}
+	copy(info.Name[:], "com.apple.net.utun_control")
+	if err = unix.IoctlCtlInfo(fd, info); err != nil {
+		unix.Close(fd)
+		return
+	}
+	if err = unix.Connect(fd, &unix.SockaddrCtl{ID: info.Id, Unit: uint32(unit)}); err != nil {
+		unix.Close(fd)
+		return
+	}
+	if ifname, err = unix.GetsockoptString(fd, 2 /* SYSPROTO_CONTROL */, 2 /* UTUN_OPT_IFNAME */); err != nil {
+		unix.Close(fd)
+		return
+	}
+	if err = unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return
+	}
+	return &utun{File: os.NewFile(uintptr(fd), ifname)}, ifname, nil
+}
+
+// setupDevice assigns addr (in CIDR notation) to the interface and brings
+// it up.
+func setupDevice(ifname, addr string, mtu int) error {
+	ip, ipnet, err := net.ParseCIDR(addr)
+	if err != nil {
+		return err
+	}
+	args := []string{ifname, "inet", ip.String(), ip.String(), "netmask", net.IP(ipnet.Mask).String(),
+		"mtu", strconv.Itoa(mtu), "up"}
+	if ip.To4() == nil {
+		ones, _ := ipnet.Mask.Size()
+		args = []string{ifname, "inet6", ip.String(), "prefixlen", strconv.Itoa(ones),
+			"mtu", strconv.Itoa(mtu), "up"}
+	}
+	if out, err := exec.Command("ifconfig", args...).CombinedOutput(); err != nil {
+		return &setupError{"ifconfig", args, out, err}
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package tun
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+const defaultDevice = "tun0"
+
+// openDevice creates the TUN interface name, its packets are read and
+// written without packet information header.
+func openDevice(name string) (dev io.ReadWriteCloser, ifname string, err error) {
+	fd, err := unix.Open("/dev/net/tun", unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return
+	}
+	ifr, err := unix.NewIfreq(name)
+	if err != nil {
+		unix.Close(fd)
+		return
+	}
+	ifr.SetUint16(unix.IFF_TUN | unix.IFF_NO_PI)
+	if err = unix.IoctlIfreq(fd, unix.TUNSETIFF, ifr); err != nil {
+		unix.Close(fd)
+		return
+	}
+	// non-blocking, so reads use the runtime poller and Close unblocks them
+	if err = unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return
+	}
+	return os.NewFile(uintptr(fd), "/dev/net/tun"), ifr.Name(), nil
+}
+
+// setupDevice assigns addr (in CIDR notation) to the interface and brings
+// it up.
+func setupDevice(ifname, addr string, mtu int) error {
+	for _, args := range [][]string{
+		{"addr", "add", addr, "dev", ifname},
+		{"link", "set", "dev", ifname, "mtu", strconv.Itoa(mtu), "up"},
+	} {
+		if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+			return &setupError{"ip", args, out, err}
+		}
+	}
+	return nil
+}
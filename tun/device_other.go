@@ -0,0 +1,21 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package tun
+
+import (
+	"errors"
+	"io"
+)
+
+const defaultDevice = ""
+
+var errNotSupported = errors.New("tun mode is only supported on linux and darwin")
+
+func openDevice(name string) (io.ReadWriteCloser, string, error) {
+	return nil, "", errNotSupported
+}
+
+func setupDevice(ifname, addr string, mtu int) error {
+	return errNotSupported
+}
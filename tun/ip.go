@@ -0,0 +1,207 @@
+package tun
+
+import (
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+)
+
+const (
+	protoTCP = 6
+	protoUDP = 17
+
+	ipv4HeaderLen = 20
+	ipv6HeaderLen = 40
+	tcpHeaderLen  = 20
+	udpHeaderLen  = 8
+)
+
+// TCP flags
+const (
+	flagFIN = 1 << iota
+	flagSYN
+	flagRST
+	flagPSH
+	flagACK
+)
+
+// packet is a parsed IP packet, payload is the transport header and data.
+type packet struct {
+	src, dst net.IP
+	proto    byte
+	payload  []byte
+}
+
+// parsePacket parses an IPv4 or IPv6 packet. Fragments and IPv6 extension
+// headers are not supported.
+func parsePacket(b []byte) (p packet, ok bool) {
+	if len(b) < 1 {
+		return
+	}
+	switch b[0] >> 4 {
+	case 4:
+		if len(b) < ipv4HeaderLen {
+			return
+		}
+		hlen := int(b[0]&0x0f) * 4
+		total := int(binary.BigEndian.Uint16(b[2:4]))
+		if hlen < ipv4HeaderLen || total < hlen || total > len(b) {
+			return
+		}
+		// more fragments flag or fragment offset
+		if binary.BigEndian.Uint16(b[6:8])&0x3fff != 0 {
+			return
+		}
+		p.src, p.dst = net.IP(b[12:16]), net.IP(b[16:20])
+		p.proto, p.payload = b[9], b[hlen:total]
+	case 6:
+		if len(b) < ipv6HeaderLen {
+			return
+		}
+		total := ipv6HeaderLen + int(binary.BigEndian.Uint16(b[4:6]))
+		if total > len(b) {
+			return
+		}
+		p.src, p.dst = net.IP(b[8:24]), net.IP(b[24:40])
+		p.proto, p.payload = b[6], b[ipv6HeaderLen:total]
+	default:
+		return
+	}
+	return p, true
+}
+
+func checksum(sum uint32, b []byte) uint32 {
+	for ; len(b) >= 2; b = b[2:] {
+		sum += uint32(b[0])<<8 | uint32(b[1])
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	return sum
+}
+
+func foldChecksum(sum uint32) uint16 {
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+var ipv4ID uint32 // the identification field, updated atomically
+
+// buildPacket returns an IP packet from src to dst carrying the transport
+// segment, whose checksum at csumOff is filled in.
+func buildPacket(src, dst net.IP, proto byte, segment []byte, csumOff int) []byte {
+	var b []byte
+	var pseudo uint32
+	if src4, dst4 := src.To4(), dst.To4(); src4 != nil && dst4 != nil {
+		b = make([]byte, ipv4HeaderLen+len(segment))
+		b[0] = 4<<4 | ipv4HeaderLen/4
+		binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+		binary.BigEndian.PutUint16(b[4:], uint16(atomic.AddUint32(&ipv4ID, 1)))
+		b[6] = 0x40 // don't fragment
+		b[8] = 64   // ttl
+		b[9] = proto
+		copy(b[12:16], src4)
+		copy(b[16:20], dst4)
+		binary.BigEndian.PutUint16(b[10:], foldChecksum(checksum(0, b[:ipv4HeaderLen])))
+		pseudo = checksum(0, b[12:20])
+	} else {
+		b = make([]byte, ipv6HeaderLen+len(segment))
+		b[0] = 6 << 4
+		binary.BigEndian.PutUint16(b[4:], uint16(len(segment)))
+		b[6] = proto
+		b[7] = 64 // hop limit
+		copy(b[8:24], src.To16())
+		copy(b[24:40], dst.To16())
+		pseudo = checksum(0, b[8:40])
+	}
+	pseudo += uint32(proto) + uint32(len(segment))
+	seg := b[len(b)-len(segment):]
+	copy(seg, segment)
+	seg[csumOff], seg[csumOff+1] = 0, 0
+	csum := foldChecksum(checksum(pseudo, seg))
+	if csum == 0 && proto == protoUDP {
+		csum = 0xffff // 0 means no checksum
+	}
+	binary.BigEndian.PutUint16(seg[csumOff:], csum)
+	return b
+}
+
+// tcpSegment is a parsed TCP segment.
+type tcpSegment struct {
+	srcPort, dstPort uint16
+	seq, ack         uint32
+	flags            byte
+	window           uint16
+	mss              uint16 // MSS option of SYN segments, 0 if absent
+	data             []byte
+}
+
+func parseTCP(b []byte) (s tcpSegment, ok bool) {
+	if len(b) < tcpHeaderLen {
+		return
+	}
+	off := int(b[12]>>4) * 4
+	if off < tcpHeaderLen || off > len(b) {
+		return
+	}
+	s.srcPort = binary.BigEndian.Uint16(b[0:2])
+	s.dstPort = binary.BigEndian.Uint16(b[2:4])
+	s.seq = binary.BigEndian.Uint32(b[4:8])
+	s.ack = binary.BigEndian.Uint32(b[8:12])
+	s.flags = b[13]
+	s.window = binary.BigEndian.Uint16(b[14:16])
+	s.data = b[off:]
+	for opts := b[tcpHeaderLen:off]; len(opts) > 0; {
+		switch opts[0] {
+		case 0: // end of options
+			opts = nil
+			continue
+		case 1: // nop
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || int(opts[1]) < 2 || int(opts[1]) > len(opts) {
+			break
+		}
+		if opts[0] == 2 && opts[1] == 4 {
+			s.mss = binary.BigEndian.Uint16(opts[2:4])
+		}
+		opts = opts[opts[1]:]
+	}
+	return s, true
+}
+
+// marshal returns the segment with the MSS option if s.mss isn't 0. The
+// checksum is left for buildPacket.
+func (s *tcpSegment) marshal() []byte {
+	hlen := tcpHeaderLen
+	if s.mss != 0 {
+		hlen += 4
+	}
+	b := make([]byte, hlen+len(s.data))
+	binary.BigEndian.PutUint16(b[0:], s.srcPort)
+	binary.BigEndian.PutUint16(b[2:], s.dstPort)
+	binary.BigEndian.PutUint32(b[4:], s.seq)
+	binary.BigEndian.PutUint32(b[8:], s.ack)
+	b[12] = byte(hlen/4) << 4
+	b[13] = s.flags
+	binary.BigEndian.PutUint16(b[14:], s.window)
+	if s.mss != 0 {
+		b[20], b[21] = 2, 4
+		binary.BigEndian.PutUint16(b[22:], s.mss)
+	}
+	copy(b[hlen:], s.data)
+	return b
+}
+
+// udpDatagram returns a UDP datagram, the checksum is left for buildPacket.
+func udpDatagram(srcPort, dstPort uint16, data []byte) []byte {
+	b := make([]byte, udpHeaderLen+len(data))
+	binary.BigEndian.PutUint16(b[0:], srcPort)
+	binary.BigEndian.PutUint16(b[2:], dstPort)
+	binary.BigEndian.PutUint16(b[4:], uint16(len(b)))
+	copy(b[udpHeaderLen:], data)
+	return b
+}
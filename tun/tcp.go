@@ -0,0 +1,445 @@
+package tun
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/shadowsocks/shadowsocks-go/local"
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+// The TCP connections of applications are terminated here and relayed
+// through the server. This is a minimal TCP: out of order segments are
+// dropped and lost data is resent go-back-N style, which is enough on the
+// loopback path between the kernel and the TUN device.
+
+const (
+	tcpBufSize    = 65535 // receive window and send buffer size
+	tcpRTO        = 500 * time.Millisecond
+	tcpMaxRetries = 8
+	defaultMSS    = 536
+)
+
+const (
+	stateDialing = iota // connecting to the server, SYN-ACK not sent yet
+	stateSynRcvd
+	stateEstablished
+	stateClosed
+)
+
+type flowKey struct {
+	src, dst         [16]byte
+	srcPort, dstPort uint16
+}
+
+func newFlowKey(src, dst net.IP, srcPort, dstPort uint16) (k flowKey) {
+	copy(k.src[:], src.To16())
+	copy(k.dst[:], dst.To16())
+	k.srcPort, k.dstPort = srcPort, dstPort
+	return
+}
+
+// tcpConn is a connection of an application, local is the application side
+// and remote the destination it connects to.
+type tcpConn struct {
+	st            *stack
+	key           flowKey
+	local, remote *net.TCPAddr
+	server        net.Conn
+
+	mu    sync.Mutex
+	cond  *sync.Cond
+	state int
+
+	iss    uint32
+	rcvNxt uint32
+	sndUna uint32
+	sndNxt uint32
+	sndWnd uint32 // window of the application
+	mss    int
+
+	rcvBuf []byte // received from the application, not sent to the server yet
+	sndBuf []byte // from the server, starting at sndUna
+
+	finRcvd  bool // application closed its side
+	eof      bool // server closed its side
+	finSent  bool
+	finAcked bool
+
+	timer   *time.Timer
+	retries int
+}
+
+func (st *stack) tcpInput(p packet) {
+	seg, ok := parseTCP(p.payload)
+	if !ok {
+		return
+	}
+	key := newFlowKey(p.src, p.dst, seg.srcPort, seg.dstPort)
+	st.mu.Lock()
+	c := st.tcp[key]
+	if c == nil && seg.flags&(flagSYN|flagACK|flagRST) == flagSYN {
+		c = st.newTCPConn(key, p, seg)
+		st.tcp[key] = c
+		st.mu.Unlock()
+		go c.dial()
+		return
+	}
+	st.mu.Unlock()
+	if c == nil {
+		if seg.flags&flagRST == 0 {
+			st.reset(p, seg)
+		}
+		return
+	}
+	c.input(seg)
+}
+
+func (st *stack) newTCPConn(key flowKey, p packet, seg tcpSegment) *tcpConn {
+	c := &tcpConn{
+		st:     st,
+		key:    key,
+		local:  &net.TCPAddr{IP: append(net.IP{}, p.src...), Port: int(seg.srcPort)},
+		remote: &net.TCPAddr{IP: append(net.IP{}, p.dst...), Port: int(seg.dstPort)},
+		iss:    rand.Uint32(),
+		rcvNxt: seg.seq + 1,
+		sndWnd: uint32(seg.window),
+		mss:    defaultMSS,
+	}
+	c.sndUna, c.sndNxt = c.iss, c.iss+1
+	if seg.mss != 0 {
+		c.mss = int(seg.mss)
+	}
+	if max := st.mss(p.src); c.mss > max {
+		c.mss = max
+	}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// reset answers a segment that belongs to no connection with RST.
+func (st *stack) reset(p packet, seg tcpSegment) {
+	rst := tcpSegment{srcPort: seg.dstPort, dstPort: seg.srcPort, flags: flagRST}
+	if seg.flags&flagACK != 0 {
+		rst.seq = seg.ack
+	} else {
+		rst.flags |= flagACK
+		rst.ack = seg.seq + uint32(len(seg.data))
+		if seg.flags&(flagSYN|flagFIN) != 0 {
+			rst.ack++
+		}
+	}
+	st.write(buildPacket(p.dst, p.src, protoTCP, rst.marshal(), 16))
+}
+
+// dial connects to the destination through the server, then accepts the
+// connection of the application.
+func (c *tcpConn) dial() {
+	addr := c.remote.String()
+	server, err := local.DialServer(ss.ParseHeader(c.remote), addr)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == stateClosed {
+		if err == nil {
+			server.Close()
+		}
+		return
+	}
+	if err != nil {
+		c.send(flagRST|flagACK, c.sndNxt, nil)
+		c.closeLocked()
+		return
+	}
+	logger.Debugf("tun tcp %s to %s", c.local, addr)
+	c.server = server
+	c.state = stateSynRcvd
+	c.sendSynAck()
+	go c.upload()
+	go c.download()
+}
+
+func (c *tcpConn) sendSynAck() {
+	seg := tcpSegment{
+		srcPort: uint16(c.remote.Port),
+		dstPort: uint16(c.local.Port),
+		seq:     c.iss,
+		ack:     c.rcvNxt,
+		flags:   flagSYN | flagACK,
+		window:  c.window(),
+		mss:     uint16(c.st.mss(c.local.IP)),
+	}
+	c.st.write(buildPacket(c.remote.IP, c.local.IP, protoTCP, seg.marshal(), 16))
+	c.armTimer()
+}
+
+// send sends a segment with seq and data, acknowledging everything received.
+func (c *tcpConn) send(flags byte, seq uint32, data []byte) {
+	seg := tcpSegment{
+		srcPort: uint16(c.remote.Port),
+		dstPort: uint16(c.local.Port),
+		seq:     seq,
+		ack:     c.rcvNxt,
+		flags:   flags,
+		window:  c.window(),
+		data:    data,
+	}
+	c.st.write(buildPacket(c.remote.IP, c.local.IP, protoTCP, seg.marshal(), 16))
+}
+
+func (c *tcpConn) window() uint16 {
+	return uint16(tcpBufSize - len(c.rcvBuf))
+}
+
+func (c *tcpConn) input(seg tcpSegment) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case c.state == stateClosed || c.state == stateDialing:
+		return
+	case seg.flags&flagRST != 0:
+		c.closeLocked()
+		return
+	case seg.flags&flagSYN != 0:
+		if c.state == stateSynRcvd {
+			// our SYN-ACK was lost
+			c.sendSynAck()
+		}
+		return
+	case seg.flags&flagACK == 0:
+		return
+	}
+
+	if c.state == stateSynRcvd {
+		if seg.ack != c.iss+1 {
+			return
+		}
+		c.state = stateEstablished
+		c.sndUna = seg.ack
+		c.retries = 0
+		c.stopTimer()
+	}
+	c.ack(seg)
+
+	needAck := false
+	data := seg.data
+	if len(data) > 0 || seg.flags&flagFIN != 0 {
+		needAck = true
+		// trim data already received, drop out of order data
+		if d := c.rcvNxt - seg.seq; d > 0 && int(d) <= len(data) {
+			data = data[d:]
+		} else if d != 0 {
+			data = nil
+			seg.flags &^= flagFIN
+		}
+	}
+	if len(data) > 0 && !c.finRcvd {
+		n := tcpBufSize - len(c.rcvBuf)
+		if n > len(data) {
+			n = len(data)
+		}
+		c.rcvBuf = append(c.rcvBuf, data[:n]...)
+		c.rcvNxt += uint32(n)
+		if n < len(data) {
+			seg.flags &^= flagFIN
+		}
+		c.cond.Broadcast()
+	}
+	if seg.flags&flagFIN != 0 && !c.finRcvd {
+		c.finRcvd = true
+		c.rcvNxt++
+		c.cond.Broadcast()
+	}
+	if needAck {
+		c.send(flagACK, c.sndNxt, nil)
+	}
+	if c.finRcvd && c.finAcked {
+		c.closeLocked()
+		return
+	}
+	c.output(false)
+}
+
+// ack handles the acknowledgment and window of seg.
+func (c *tcpConn) ack(seg tcpSegment) {
+	c.sndWnd = uint32(seg.window)
+	acked := seg.ack - c.sndUna
+	if acked == 0 || acked > c.sndNxt-c.sndUna {
+		return
+	}
+	n := int(acked)
+	if n > len(c.sndBuf) {
+		// our FIN is acknowledged
+		n = len(c.sndBuf)
+		c.finAcked = true
+	}
+	c.sndBuf = c.sndBuf[n:]
+	c.sndUna = seg.ack
+	c.retries = 0
+	c.stopTimer()
+	c.armTimer()
+	c.cond.Broadcast()
+}
+
+// output sends the data of sndBuf allowed by the window, and FIN after it
+// when the server has closed. force sends a segment even if the window is
+// closed, to probe it.
+func (c *tcpConn) output(force bool) {
+	if c.state != stateEstablished {
+		return
+	}
+	for {
+		inflight := int(c.sndNxt - c.sndUna)
+		if c.finSent {
+			return
+		}
+		limit := len(c.sndBuf)
+		if wnd := int(c.sndWnd); wnd < limit && !force {
+			limit = wnd
+		}
+		n := limit - inflight
+		if n <= 0 {
+			break
+		}
+		if n > c.mss {
+			n = c.mss
+		}
+		c.send(flagACK|flagPSH, c.sndNxt, c.sndBuf[inflight:inflight+n])
+		c.sndNxt += uint32(n)
+		force = false
+	}
+	if c.eof && int(c.sndNxt-c.sndUna) == len(c.sndBuf) {
+		c.send(flagFIN|flagACK, c.sndNxt, nil)
+		c.sndNxt++
+		c.finSent = true
+	}
+	c.armTimer()
+}
+
+// armTimer starts the retransmission timer if anything is waiting for an
+// acknowledgment.
+func (c *tcpConn) armTimer() {
+	pending := c.sndNxt != c.sndUna || len(c.sndBuf) > 0
+	if c.timer != nil || !pending {
+		return
+	}
+	rto := tcpRTO << uint(c.retries)
+	c.timer = time.AfterFunc(rto, c.retransmit)
+}
+
+func (c *tcpConn) stopTimer() {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+}
+
+func (c *tcpConn) retransmit() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.timer = nil
+	if c.state == stateClosed {
+		return
+	}
+	c.retries++
+	if c.retries > tcpMaxRetries {
+		logger.Debug("tun tcp timeout", c.local, c.remote)
+		c.send(flagRST|flagACK, c.sndNxt, nil)
+		c.closeLocked()
+		return
+	}
+	if c.state == stateSynRcvd {
+		c.sendSynAck()
+		return
+	}
+	// go back to the first unacknowledged byte
+	if c.finSent && !c.finAcked {
+		c.finSent = false
+	}
+	c.sndNxt = c.sndUna
+	c.output(true)
+}
+
+// upload sends the data received from the application to the server.
+func (c *tcpConn) upload() {
+	c.mu.Lock()
+	for {
+		for len(c.rcvBuf) == 0 && !c.finRcvd && c.state != stateClosed {
+			c.cond.Wait()
+		}
+		if c.state == stateClosed {
+			break
+		}
+		if len(c.rcvBuf) == 0 {
+			// application closed its side
+			if sc, ok := c.server.(*ss.Conn); ok {
+				if tc, ok := sc.Conn.(*net.TCPConn); ok {
+					tc.CloseWrite()
+				}
+			}
+			break
+		}
+		buf := append([]byte{}, c.rcvBuf...)
+		c.mu.Unlock()
+		_, err := c.server.Write(buf)
+		c.mu.Lock()
+		if err != nil {
+			if c.state != stateClosed {
+				c.send(flagRST|flagACK, c.sndNxt, nil)
+				c.closeLocked()
+			}
+			break
+		}
+		small := c.window() < uint16(c.mss)
+		c.rcvBuf = c.rcvBuf[len(buf):]
+		if small && c.state == stateEstablished {
+			// window update
+			c.send(flagACK, c.sndNxt, nil)
+		}
+	}
+	c.mu.Unlock()
+}
+
+// download sends the data from the server to the application.
+func (c *tcpConn) download() {
+	buf := ss.GetBuf(ss.MediumBufSize)
+	defer ss.PutBuf(buf)
+	for {
+		n, err := c.server.Read(buf)
+		c.mu.Lock()
+		for len(c.sndBuf) >= tcpBufSize && c.state != stateClosed {
+			c.cond.Wait()
+		}
+		if c.state == stateClosed {
+			c.mu.Unlock()
+			return
+		}
+		c.sndBuf = append(c.sndBuf, buf[:n]...)
+		if err != nil {
+			c.eof = true
+		}
+		c.output(false)
+		c.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// closeLocked releases the connection, with c.mu held.
+func (c *tcpConn) closeLocked() {
+	if c.state == stateClosed {
+		return
+	}
+	c.state = stateClosed
+	c.stopTimer()
+	if c.server != nil {
+		c.server.Close()
+	}
+	c.cond.Broadcast()
+	c.st.mu.Lock()
+	delete(c.st.tcp, c.key)
+	c.st.mu.Unlock()
+	logger.Debug("tun tcp closed", c.local, c.remote)
+}
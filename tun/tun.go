@@ -0,0 +1,159 @@
+// Package tun implements the shadowsocks TUN mode, which creates a TUN
+// interface and relays the TCP and UDP traffic routed to it through a
+// shadowsocks server, like tun2socks. All traffic of a machine can be
+// proxied by routing it to the interface, without iptables rules:
+//
+//	shadowsocks-tun -s server_ip -p 8388 -k password -tun-addr 10.255.0.1/24
+//	ip route add server_ip via original_gateway
+//	ip route add 0.0.0.0/1 dev tun0
+//	ip route add 128.0.0.0/1 dev tun0
+//
+// The route to the server through the original gateway keeps the relayed
+// traffic out of the tunnel.
+package tun
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/shadowsocks/shadowsocks-go/local"
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+var logger = ss.NewLogger("tun")
+
+type setupError struct {
+	cmd  string
+	args []string
+	out  []byte
+	err  error
+}
+
+func (e *setupError) Error() string {
+	return fmt.Sprintf("%s %s: %v: %s", e.cmd, strings.Join(e.args, " "), e.err,
+		strings.TrimSpace(string(e.out)))
+}
+
+// stack terminates the connections of the packets read from the TUN device.
+type stack struct {
+	dev io.ReadWriteCloser
+	mtu int
+
+	writeMu sync.Mutex
+
+	mu  sync.Mutex
+	tcp map[flowKey]*tcpConn
+	udp map[string]*udpSession
+}
+
+func newStack(dev io.ReadWriteCloser, mtu int) *stack {
+	return &stack{
+		dev: dev,
+		mtu: mtu,
+		tcp: make(map[flowKey]*tcpConn),
+		udp: make(map[string]*udpSession),
+	}
+}
+
+// mss returns the largest TCP segment that fits in the MTU.
+func (st *stack) mss(ip net.IP) int {
+	if ip.To4() != nil {
+		return st.mtu - ipv4HeaderLen - tcpHeaderLen
+	}
+	return st.mtu - ipv6HeaderLen - tcpHeaderLen
+}
+
+func (st *stack) write(pkt []byte) {
+	st.writeMu.Lock()
+	_, err := st.dev.Write(pkt)
+	st.writeMu.Unlock()
+	if err != nil {
+		logger.Debug("tun write:", err)
+	}
+}
+
+// run reads packets from the device until it's closed.
+func (st *stack) run() error {
+	buf := make([]byte, st.mtu+ipv6HeaderLen)
+	for {
+		n, err := st.dev.Read(buf)
+		if err != nil {
+			return err
+		}
+		p, ok := parsePacket(buf[:n])
+		if !ok {
+			continue
+		}
+		// packets are parsed in place, the buffer is reused
+		p.payload = append([]byte{}, p.payload...)
+		p.src = append(net.IP{}, p.src...)
+		p.dst = append(net.IP{}, p.dst...)
+		switch p.proto {
+		case protoTCP:
+			st.tcpInput(p)
+		case protoUDP:
+			st.udpInput(p)
+		}
+	}
+}
+
+// Main runs the TUN mode with command line arguments args, which don't
+// include the program name.
+func Main(args []string) {
+	var configFile, cmdServer, device, addr string
+	var cmdConfig ss.Config
+	var mtu int
+	var debug bool
+
+	fs := flag.NewFlagSet("tun", flag.ExitOnError)
+
+	fs.StringVar(&configFile, "c", "config.json", "specify config file")
+	fs.StringVar(&cmdServer, "s", "", "server address")
+	fs.StringVar(&cmdConfig.Password, "k", "", "password")
+	fs.IntVar(&cmdConfig.ServerPort, "p", 0, "server port")
+	fs.StringVar(&cmdConfig.Method, "m", "", "encryption method, default: aes-256-cfb")
+	fs.BoolVar(&cmdConfig.AllowInsecureCiphers, "allow-insecure-ciphers", false, "allow the broken or weak methods table, rc4, rc4-md5, des-cfb, bf-cfb and cast5-cfb")
+	fs.StringVar(&device, "tun", defaultDevice, "name of the TUN interface")
+	fs.StringVar(&addr, "tun-addr", "", "address of the TUN interface in CIDR notation, e.g. 10.255.0.1/24, the interface is left unconfigured if empty")
+	fs.IntVar(&mtu, "mtu", 1500, "MTU of the TUN interface")
+	fs.BoolVar(&debug, "d", false, "print debug message")
+	logOpts := ss.AddLogFlags(fs)
+
+	fs.Parse(args)
+
+	cmdConfig.Server = cmdServer
+	if err := logOpts.Setup(debug); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	config := local.LoadConfig(configFile, &cmdConfig)
+	if len(config.ServerPassword) == 0 &&
+		(config.Server == nil || config.ServerPort == 0 || config.Password == "") {
+		fmt.Fprintln(os.Stderr, "must specify server address, password and server port")
+		os.Exit(1)
+	}
+	if mtu < 1280 || mtu > 65535 {
+		fmt.Fprintln(os.Stderr, "mtu must be between 1280 and 65535")
+		os.Exit(1)
+	}
+
+	local.ParseServerConfig(config)
+
+	dev, ifname, err := openDevice(device)
+	if err != nil {
+		logger.Fatal("open tun device:", err)
+	}
+	if addr != "" {
+		if err = setupDevice(ifname, addr, mtu); err != nil {
+			logger.Fatal("configure tun device:", err)
+		}
+	}
+	logger.Infof("relaying traffic of tun device %s ...", ifname)
+	logger.Fatal(newStack(dev, mtu).run())
+}
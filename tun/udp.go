@@ -0,0 +1,86 @@
+package tun
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/shadowsocks/shadowsocks-go/local"
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+// idle time after which a UDP session is closed
+const udpTimeout = 60 * time.Second
+
+// udpSession relays the datagrams of one application socket through the
+// server.
+type udpSession struct {
+	st     *stack
+	key    string
+	client *net.UDPAddr
+	remote ss.UDPRelayConn
+}
+
+func (st *stack) udpInput(p packet) {
+	b := p.payload
+	if len(b) < udpHeaderLen {
+		return
+	}
+	client := &net.UDPAddr{IP: append(net.IP{}, p.src...), Port: int(binary.BigEndian.Uint16(b[0:2]))}
+	dst := &net.UDPAddr{IP: p.dst, Port: int(binary.BigEndian.Uint16(b[2:4]))}
+	data := b[udpHeaderLen:]
+	if n := int(binary.BigEndian.Uint16(b[4:6])); n >= udpHeaderLen && n <= len(b) {
+		data = b[udpHeaderLen:n]
+	}
+
+	key := client.String()
+	st.mu.Lock()
+	s := st.udp[key]
+	if s == nil {
+		remote, err := local.DialUDPServer()
+		if err != nil {
+			st.mu.Unlock()
+			logger.Debug("tun udp connect to server:", err)
+			return
+		}
+		s = &udpSession{st, key, client, remote}
+		st.udp[key] = s
+		logger.Debug("tun udp new session for", client)
+		go s.relayReplies()
+	}
+	st.mu.Unlock()
+	if _, err := s.remote.Write(append(ss.ParseHeader(dst), data...)); err != nil {
+		logger.Debug("tun udp write to server:", err)
+	}
+}
+
+// relayReplies writes the replies from the server to the TUN device, until
+// the session is idle for udpTimeout.
+func (s *udpSession) relayReplies() {
+	defer func() {
+		s.st.mu.Lock()
+		delete(s.st.udp, s.key)
+		s.st.mu.Unlock()
+		s.remote.Close()
+		logger.Debug("tun udp closed session for", s.client)
+	}()
+	buf := ss.GetBuf(ss.LargeBufSize)
+	defer ss.PutBuf(buf)
+	for {
+		s.remote.SetReadDeadline(time.Now().Add(udpTimeout))
+		n, err := s.remote.Read(buf)
+		if err != nil {
+			if _, ok := err.(net.Error); ok {
+				return
+			}
+			logger.Debug("tun udp read from server:", err)
+			continue
+		}
+		from, hlen := ss.ParseUDPHeader(buf[:n])
+		if from == nil || (from.IP.To4() == nil) != (s.client.IP.To4() == nil) {
+			continue
+		}
+		dgram := udpDatagram(uint16(from.Port), uint16(s.client.Port), buf[hlen:n])
+		s.st.write(buildPacket(from.IP, s.client.IP, protoUDP, dgram, 6))
+	}
+}